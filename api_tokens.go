@@ -0,0 +1,361 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// API_TOKENS_KEY is the Cfg key of the APITokens.
+const API_TOKENS_KEY = "apiTokens"
+
+// The scopes of an APIToken, where cluster:admin includes every scope
+// and index:write includes index:read.
+const (
+	API_SCOPE_INDEX_READ    = "index:read"
+	API_SCOPE_INDEX_WRITE   = "index:write"
+	API_SCOPE_CLUSTER_ADMIN = "cluster:admin"
+)
+
+// API_TOKEN_BOOTSTRAP_FILE is the file in the dataDir that receives
+// the bootstrap admin token, see Manager.BootstrapAPIToken().
+const API_TOKEN_BOOTSTRAP_FILE = "bootstrapAPIToken"
+
+// ErrAPITokenInvalid is returned for an unknown, revoked, expired or
+// malformed token.
+var ErrAPITokenInvalid = errors.New("api_tokens: invalid token")
+
+// ErrAPITokenScope is returned for a valid token that lacks a scope.
+var ErrAPITokenScope = errors.New("api_tokens: token lacks the scope")
+
+// ErrAPITokensBootstrapped is returned by a bootstrap of a cluster
+// whose tokens were already bootstrapped.
+var ErrAPITokensBootstrapped = errors.New("api_tokens: already bootstrapped")
+
+// APITokens are the API tokens of a cluster, as stored in the Cfg.
+// Only the SHA-256 hash of a token is stored, so a token is shown
+// just once, when it's created.
+type APITokens struct {
+	UUID         string               `json:"uuid"`
+	Tokens       map[string]*APIToken `json:"tokens"` // Keyed by APIToken.ID.
+	Bootstrapped bool                 `json:"bootstrapped,omitempty"`
+}
+
+// An APIToken is a token's metadata, where the token itself is of the
+// form "<ID>.<secret>".
+type APIToken struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Hash      string   `json:"hash"` // Hex SHA-256 of the token.
+	Scopes    []string `json:"scopes"`
+	CreatedAt string   `json:"createdAt"`
+	ExpiresAt string   `json:"expiresAt,omitempty"` // Empty means never.
+}
+
+// HasScope returns whether the token grants a scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == API_SCOPE_CLUSTER_ADMIN ||
+			(s == API_SCOPE_INDEX_WRITE && scope == API_SCOPE_INDEX_READ) {
+			return true
+		}
+	}
+	return false
+}
+
+// CfgGetAPITokens returns the APITokens from a Cfg.
+func CfgGetAPITokens(cfg Cfg) (*APITokens, uint64, error) {
+	v, cas, err := cfg.Get(API_TOKENS_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &APITokens{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetAPITokens updates the APITokens on a Cfg.
+func CfgSetAPITokens(cfg Cfg, tokens *APITokens, cas uint64) (
+	uint64, error) {
+	buf, err := json.Marshal(tokens)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(API_TOKENS_KEY, buf, cas)
+}
+
+// updateAPITokens applies a change to the APITokens with CAS retries.
+func updateAPITokens(cfg Cfg, cb func(tokens *APITokens) error) error {
+	retry := NewCASRetry(API_TOKENS_KEY)
+	for tries := 0; tries < 10; tries++ {
+		tokens, cas, err := CfgGetAPITokens(cfg)
+		if err != nil {
+			return err
+		}
+		if tokens == nil {
+			tokens = &APITokens{}
+		}
+		if tokens.Tokens == nil {
+			tokens.Tokens = map[string]*APIToken{}
+		}
+
+		err = cb(tokens)
+		if err != nil {
+			return err
+		}
+
+		tokens.UUID = NewUUID()
+
+		_, err = CfgSetAPITokens(cfg, tokens, cas)
+		if _, ok := err.(*CfgCASError); ok {
+			retry.Conflict()
+			continue
+		}
+		retry.Done(err)
+		return err
+	}
+
+	return fmt.Errorf("api_tokens: too many CAS conflicts")
+}
+
+func hashAPIToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newAPIToken returns a new token and its metadata.
+func newAPIToken(name string, scopes []string, ttl time.Duration) (
+	string, *APIToken, error) {
+	if len(scopes) <= 0 {
+		return "", nil, fmt.Errorf("api_tokens: no scopes, name: %s", name)
+	}
+	for _, scope := range scopes {
+		if scope != API_SCOPE_INDEX_READ && scope != API_SCOPE_INDEX_WRITE &&
+			scope != API_SCOPE_CLUSTER_ADMIN {
+			return "", nil, fmt.Errorf("api_tokens: unknown scope: %q",
+				scope)
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	token := id + "." + secret
+
+	now := Now()
+
+	t := &APIToken{
+		ID:        id,
+		Name:      name,
+		Hash:      hashAPIToken(token),
+		Scopes:    append([]string(nil), scopes...),
+		CreatedAt: now.Format(time.RFC3339Nano),
+	}
+	if ttl > 0 {
+		t.ExpiresAt = now.Add(ttl).Format(time.RFC3339Nano)
+	}
+
+	return token, t, nil
+}
+
+// CreateAPIToken stores a new token with the given scopes, which
+// expires after the ttl, unless the ttl is 0.  The returned token
+// isn't stored, so the caller must hand it over to its user.
+func CreateAPIToken(cfg Cfg, name string, scopes []string,
+	ttl time.Duration) (string, *APIToken, error) {
+	token, t, err := newAPIToken(name, scopes, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = updateAPITokens(cfg, func(tokens *APITokens) error {
+		tokens.Tokens[t.ID] = t
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, t, nil
+}
+
+// RevokeAPIToken removes a token, by its ID.
+func RevokeAPIToken(cfg Cfg, id string) error {
+	return updateAPITokens(cfg, func(tokens *APITokens) error {
+		if tokens.Tokens[id] == nil {
+			return fmt.Errorf("api_tokens: unknown token id: %s", id)
+		}
+		delete(tokens.Tokens, id)
+		return nil
+	})
+}
+
+// BootstrapAPIToken creates the first cluster:admin token of a new
+// cluster, with which the operator then creates the other tokens.  It
+// returns ErrAPITokensBootstrapped if the cluster was already
+// bootstrapped, so that only one caller, such as the first node of a
+// cluster, ever receives the bootstrap token.
+func BootstrapAPIToken(cfg Cfg) (string, *APIToken, error) {
+	token, t, err := newAPIToken("bootstrap",
+		[]string{API_SCOPE_CLUSTER_ADMIN}, 0)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = updateAPITokens(cfg, func(tokens *APITokens) error {
+		if tokens.Bootstrapped {
+			return ErrAPITokensBootstrapped
+		}
+		tokens.Bootstrapped = true
+		tokens.Tokens[t.ID] = t
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, t, nil
+}
+
+// AuthorizeAPIToken returns the metadata of a token that grants the
+// scope, or else ErrAPITokenInvalid or ErrAPITokenScope.
+func AuthorizeAPIToken(cfg Cfg, token, scope string) (*APIToken, error) {
+	id := strings.SplitN(token, ".", 2)[0]
+	if id == "" || id == token {
+		return nil, ErrAPITokenInvalid
+	}
+
+	tokens, _, err := CfgGetAPITokens(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tokens == nil || tokens.Tokens[id] == nil {
+		return nil, ErrAPITokenInvalid
+	}
+
+	t := tokens.Tokens[id]
+	if subtle.ConstantTimeCompare([]byte(hashAPIToken(token)),
+		[]byte(t.Hash)) != 1 {
+		return nil, ErrAPITokenInvalid
+	}
+
+	if t.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339Nano, t.ExpiresAt)
+		if err != nil || !Now().Before(expiresAt) {
+			return nil, ErrAPITokenInvalid
+		}
+	}
+
+	if !t.HasScope(scope) {
+		return nil, ErrAPITokenScope
+	}
+
+	return t, nil
+}
+
+// APITokenHandler wraps a REST handler so that it requires a token
+// with the scope, from an "Authorization: Bearer <token>" header.
+// Requests without a valid token are rejected with a 401, and
+// requests whose token lacks the scope with a 403.  The handler's
+// request context carries the token, see APITokenFromContext().
+func APITokenHandler(cfg Cfg, scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		t, err := AuthorizeAPIToken(cfg, token, scope)
+		switch err {
+		case nil:
+			next.ServeHTTP(w, r.WithContext(
+				context.WithValue(r.Context(), apiTokenKey{}, t)))
+		case ErrAPITokenScope:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case ErrAPITokenInvalid:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+type apiTokenKey struct{}
+
+// APITokenFromContext returns the token of a request that passed an
+// APITokenHandler, or else nil.
+func APITokenFromContext(ctx context.Context) *APIToken {
+	t, _ := ctx.Value(apiTokenKey{}).(*APIToken)
+	return t
+}
+
+// ---------------------------------------------------------
+
+// BootstrapAPIToken bootstraps the tokens of a new cluster, see
+// BootstrapAPIToken(), and writes the bootstrap token to the
+// API_TOKEN_BOOTSTRAP_FILE in the dataDir, readable only by its owner,
+// for the operator to pick up.
+func (mgr *Manager) BootstrapAPIToken() (string, error) {
+	token, t, err := BootstrapAPIToken(mgr.cfg)
+	if err != nil {
+		return "", err
+	}
+
+	if mgr.dataDir != "" {
+		path := filepath.Join(mgr.dataDir, API_TOKEN_BOOTSTRAP_FILE)
+		err = ioutil.WriteFile(path, []byte(token+"\n"), 0600)
+		if err != nil {
+			// Undo the bootstrap, as nobody can receive its token.
+			updateAPITokens(mgr.cfg, func(tokens *APITokens) error {
+				delete(tokens.Tokens, t.ID)
+				tokens.Bootstrapped = false
+				return nil
+			})
+			return "", fmt.Errorf("api_tokens: could not write %s,"+
+				" err: %v", path, err)
+		}
+	}
+
+	mgr.log.Printf("api_tokens: bootstrapped, token id: %s", t.ID)
+
+	return token, nil
+}
@@ -0,0 +1,121 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITokens(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), []string{"pindex"},
+		"", 1, "", ":1000", emptyDir, "", nil, nil)
+	defer mgr.Stop()
+
+	admin, err := mgr.BootstrapAPIToken()
+	if err != nil {
+		t.Fatalf("expected BootstrapAPIToken to work, err: %v", err)
+	}
+	buf, _ := ioutil.ReadFile(filepath.Join(emptyDir, API_TOKEN_BOOTSTRAP_FILE))
+	if strings.TrimSpace(string(buf)) != admin {
+		t.Errorf("expected the bootstrap token file, got: %q", buf)
+	}
+	_, _, err = BootstrapAPIToken(cfg)
+	if err != ErrAPITokensBootstrapped {
+		t.Errorf("expected a single bootstrap, err: %v", err)
+	}
+
+	reader, readerDef, err := CreateAPIToken(cfg, "reader",
+		[]string{API_SCOPE_INDEX_READ}, 0)
+	if err != nil {
+		t.Fatalf("expected CreateAPIToken to work, err: %v", err)
+	}
+	writer, _, err := CreateAPIToken(cfg, "writer",
+		[]string{API_SCOPE_INDEX_WRITE}, 0)
+	if err != nil {
+		t.Fatalf("expected CreateAPIToken to work, err: %v", err)
+	}
+	expired, _, err := CreateAPIToken(cfg, "expired",
+		[]string{API_SCOPE_INDEX_READ}, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("expected CreateAPIToken to work, err: %v", err)
+	}
+	_, _, err = CreateAPIToken(cfg, "bad", []string{"index:nuke"}, 0)
+	if err == nil {
+		t.Errorf("expected an unknown scope to fail")
+	}
+
+	tokens, _, _ := CfgGetAPITokens(cfg)
+	for _, tok := range tokens.Tokens {
+		if strings.Contains(reader, tok.Hash) || tok.Hash == "" {
+			t.Errorf("expected only hashes to be stored, got: %+v", tok)
+		}
+	}
+
+	tests := []struct {
+		token, scope string
+		exp          error
+	}{
+		{admin, API_SCOPE_CLUSTER_ADMIN, nil},
+		{admin, API_SCOPE_INDEX_WRITE, nil},
+		{writer, API_SCOPE_INDEX_READ, nil},
+		{writer, API_SCOPE_CLUSTER_ADMIN, ErrAPITokenScope},
+		{reader, API_SCOPE_INDEX_READ, nil},
+		{reader, API_SCOPE_INDEX_WRITE, ErrAPITokenScope},
+		{reader + "x", API_SCOPE_INDEX_READ, ErrAPITokenInvalid},
+		{expired, API_SCOPE_INDEX_READ, ErrAPITokenInvalid},
+		{"", API_SCOPE_INDEX_READ, ErrAPITokenInvalid},
+	}
+	for i, test := range tests {
+		_, err = AuthorizeAPIToken(cfg, test.token, test.scope)
+		if err != test.exp {
+			t.Errorf("%d: expected err: %v, got: %v", i, test.exp, err)
+		}
+	}
+
+	h := APITokenHandler(cfg, API_SCOPE_INDEX_READ, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	for _, test := range []struct {
+		token string
+		code  int
+	}{
+		{reader, http.StatusOK},
+		{"", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/api/index", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("expected code: %d, got: %d", test.code, rec.Code)
+		}
+	}
+
+	err = RevokeAPIToken(cfg, readerDef.ID)
+	if err != nil {
+		t.Fatalf("expected RevokeAPIToken to work, err: %v", err)
+	}
+	_, err = AuthorizeAPIToken(cfg, reader, API_SCOPE_INDEX_READ)
+	if err != ErrAPITokenInvalid {
+		t.Errorf("expected a revoked token to be invalid, err: %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AUDIT_SETTINGS_KEY is the Cfg key of the AuditSettings.
+const AUDIT_SETTINGS_KEY = "auditSettings"
+
+// The sinks of the audit records.
+const (
+	AUDIT_SINK_FILE   = "file"      // Daily files in the dataDir's "audit" dir.
+	AUDIT_SINK_EVENTS = "eventSink" // The EventSinks of the EVENT_CATEGORY_AUDIT.
+)
+
+// DEFAULT_AUDIT_RETENTION_DAYS is how long the audit files are kept,
+// unless the AuditSettings say otherwise.
+const DEFAULT_AUDIT_RETENTION_DAYS = 30
+
+// AuditSettings is the cluster-wide audit logging toggle, as stored
+// in the Cfg, so that every node audits the same way.
+type AuditSettings struct {
+	UUID    string `json:"uuid"`
+	Enabled bool   `json:"enabled"`
+
+	// Sink is AUDIT_SINK_FILE (the default) or AUDIT_SINK_EVENTS.
+	Sink string `json:"sink,omitempty"`
+
+	// RetentionDays is how long the AUDIT_SINK_FILE files are kept,
+	// where 0 means the DEFAULT_AUDIT_RETENTION_DAYS.
+	RetentionDays int `json:"retentionDays,omitempty"`
+}
+
+// An AuditRecord describes a state-changing call, such as an index
+// definition change, an options change or a rebalance control.
+type AuditRecord struct {
+	Time      string `json:"time"`
+	Node      string `json:"node"` // The UUID of the node that served the call.
+	Principal string `json:"principal"`
+	Op        string `json:"op"`
+	Request   string `json:"request"` // A summary, such as "POST /api/index/x".
+	Result    string `json:"result"`  // "ok", or else the error.
+	Status    int    `json:"status,omitempty"`
+}
+
+// CfgGetAuditSettings returns the AuditSettings from a Cfg.
+func CfgGetAuditSettings(cfg Cfg) (*AuditSettings, uint64, error) {
+	v, cas, err := cfg.Get(AUDIT_SETTINGS_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &AuditSettings{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetAuditSettings updates the AuditSettings on a Cfg.
+func CfgSetAuditSettings(cfg Cfg, settings *AuditSettings, cas uint64) (
+	uint64, error) {
+	settings.UUID = NewUUID()
+	buf, err := json.Marshal(settings)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(AUDIT_SETTINGS_KEY, buf, cas)
+}
+
+// ---------------------------------------------------------
+
+// Audit records a state-changing call, when enabled by the
+// AuditSettings.  A failure to record is logged and counted, but
+// doesn't fail the call that's audited.
+func (mgr *Manager) Audit(rec *AuditRecord) {
+	settings, _, err := CfgGetAuditSettings(mgr.cfg)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotAuditErr, 1)
+		mgr.log.Warnf("audit_log: settings, err: %v", err)
+		return
+	}
+	if settings == nil || !settings.Enabled {
+		return
+	}
+
+	if rec.Time == "" {
+		rec.Time = Now().Format(time.RFC3339Nano)
+	}
+	rec.Node = mgr.uuid
+
+	atomic.AddUint64(&mgr.stats.TotAudit, 1)
+
+	if settings.Sink == AUDIT_SINK_EVENTS {
+		mgr.PublishEvent(EVENT_CATEGORY_AUDIT, rec)
+		return
+	}
+
+	err = mgr.auditToFile(rec, settings)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotAuditErr, 1)
+		mgr.log.Warnf("audit_log: file, err: %v", err)
+	}
+}
+
+// auditToFile appends a record as a JSON line to the day's audit
+// file, and removes the files that are past the retention.
+func (mgr *Manager) auditToFile(rec *AuditRecord,
+	settings *AuditSettings) error {
+	if mgr.dataDir == "" {
+		return fmt.Errorf("audit_log: no dataDir")
+	}
+
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(mgr.dataDir, "audit")
+	now := Now()
+	day := now.UTC().Format("2006-01-02")
+
+	mgr.auditMutex.Lock()
+	defer mgr.auditMutex.Unlock()
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "audit-"+day+".log"),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(buf, '\n'))
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if mgr.auditPrunedDay != day {
+		mgr.auditPrunedDay = day
+
+		retentionDays := settings.RetentionDays
+		if retentionDays <= 0 {
+			retentionDays = DEFAULT_AUDIT_RETENTION_DAYS
+		}
+		pruneAuditFiles(dir, now.AddDate(0, 0, -retentionDays))
+	}
+
+	return nil
+}
+
+// pruneAuditFiles removes the audit files of the days before a cutoff.
+func pruneAuditFiles(dir string, cutoff time.Time) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	cutoffDay := cutoff.UTC().Format("2006-01-02")
+
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if !strings.HasPrefix(name, "audit-") ||
+			!strings.HasSuffix(name, ".log") {
+			continue
+		}
+		day := strings.TrimSuffix(strings.TrimPrefix(name, "audit-"), ".log")
+		if day < cutoffDay {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+// ---------------------------------------------------------
+
+// auditResponseWriter captures the status code of a response.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// AuditHandler wraps a REST handler so that its state-changing
+// requests, which are those other than GET, HEAD and OPTIONS, are
+// audited under the op, such as "createIndex".  The principal is the
+// request's APIToken, so an AuditHandler goes inside an
+// APITokenHandler, else the basic auth user, else "anonymous@" and
+// the client's address.  Only the method and path are recorded, as
+// request bodies may hold secrets.
+func AuditHandler(mgr *Manager, op string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		aw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(aw, r)
+
+		result := "ok"
+		if aw.status >= 400 {
+			result = http.StatusText(aw.status)
+		}
+
+		mgr.Audit(&AuditRecord{
+			Principal: auditPrincipal(r),
+			Op:        op,
+			Request:   r.Method + " " + r.URL.Path,
+			Result:    result,
+			Status:    aw.status,
+		})
+	})
+}
+
+func auditPrincipal(r *http.Request) string {
+	if t := APITokenFromContext(r.Context()); t != nil {
+		return "token:" + t.Name + "/" + t.ID
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return "user:" + user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "anonymous@" + host
+}
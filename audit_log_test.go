@@ -0,0 +1,129 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), []string{"pindex"},
+		"", 1, "", ":1000", emptyDir, "", nil, nil)
+	defer mgr.Stop()
+
+	writer, _, err := CreateAPIToken(cfg, "writer",
+		[]string{API_SCOPE_INDEX_WRITE}, 0)
+	if err != nil {
+		t.Fatalf("expected CreateAPIToken to work, err: %v", err)
+	}
+
+	h := APITokenHandler(cfg, API_SCOPE_INDEX_WRITE,
+		AuditHandler(mgr, "createIndex", http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/api/index/bad" {
+					http.Error(w, "bad", http.StatusBadRequest)
+				}
+			})))
+
+	serve := func(method, path string) {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+writer)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Disabled by default.
+	serve("PUT", "/api/index/a")
+
+	// A stale retained file is pruned on the first record of a day.
+	auditDir := filepath.Join(emptyDir, "audit")
+	os.MkdirAll(auditDir, 0700)
+	stale := filepath.Join(auditDir, "audit-2000-01-01.log")
+	ioutil.WriteFile(stale, []byte("{}\n"), 0600)
+
+	_, err = CfgSetAuditSettings(cfg, &AuditSettings{Enabled: true}, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetAuditSettings to work, err: %v", err)
+	}
+
+	serve("PUT", "/api/index/b")
+	serve("GET", "/api/index/b")
+	serve("PUT", "/api/index/bad")
+
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the stale audit file to be pruned, err: %v", err)
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(auditDir,
+		"audit-"+Now().UTC().Format("2006-01-02")+".log"))
+	if err != nil {
+		t.Fatalf("expected the audit file, err: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 audit records, got: %q", lines)
+	}
+
+	var recs []AuditRecord
+	for _, line := range lines {
+		var rec AuditRecord
+		json.Unmarshal([]byte(line), &rec)
+		recs = append(recs, rec)
+	}
+	if recs[0].Request != "PUT /api/index/b" || recs[0].Result != "ok" ||
+		recs[0].Op != "createIndex" || recs[0].Node != mgr.UUID() ||
+		!strings.HasPrefix(recs[0].Principal, "token:writer/") {
+		t.Errorf("unexpected record: %+v", recs[0])
+	}
+	if recs[1].Status != http.StatusBadRequest || recs[1].Result == "ok" {
+		t.Errorf("expected a failed record, got: %+v", recs[1])
+	}
+
+	// The event sink alternative.
+	_, err = CfgSetAuditSettings(cfg, &AuditSettings{Enabled: true,
+		Sink: AUDIT_SINK_EVENTS}, CFG_CAS_FORCE)
+	if err != nil {
+		t.Fatalf("expected CfgSetAuditSettings to work, err: %v", err)
+	}
+
+	sentCh := make(chan *SinkEvent, 10)
+	mgr.AddEventSink(&EventSinkDef{Name: "audit",
+		Categories: []string{EVENT_CATEGORY_AUDIT}},
+		EventSinkFunc(func(e *SinkEvent) error {
+			sentCh <- e
+			return nil
+		}))
+
+	serve("DELETE", "/api/index/b")
+
+	select {
+	case e := <-sentCh:
+		var rec AuditRecord
+		json.Unmarshal(e.Event, &rec)
+		if rec.Request != "DELETE /api/index/b" {
+			t.Errorf("unexpected audit event: %+v", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the audit event")
+	}
+}
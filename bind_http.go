@@ -0,0 +1,313 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrorBindHttp is returned for an advertised address that other
+// nodes can't use to reach a node, which must be a host:port whose
+// host isn't a wildcard, such as "", "0.0.0.0" or "::", and whose port
+// is a number from 1 to 65535.
+var ErrorBindHttp = errors.New("bindHttp: the advertised address must" +
+	" be a host:port with a non-wildcard host and a valid port")
+
+// ValidateAdvertiseHttp checks an advertised address against the
+// ErrorBindHttp rules.
+func ValidateAdvertiseHttp(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("bind_http: addr: %q, err: %v, %w", addr, err,
+			ErrorBindHttp)
+	}
+	if isWildcardHost(host) {
+		return fmt.Errorf("bind_http: addr: %q, wildcard host, %w", addr,
+			ErrorBindHttp)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("bind_http: addr: %q, invalid port, %w", addr,
+			ErrorBindHttp)
+	}
+	return nil
+}
+
+// ResolveAdvertiseHttp returns the address to advertise for a bindHttp
+// address.  A bindHttp with a wildcard host, such as "0.0.0.0:8095" or
+// ":8095", is advertised with the FQDN of the host if it can be
+// resolved, else with the IP address of a non-loopback network
+// interface, else with the loopback address, as for a single node
+// without a network.  For a dual-stack bindHttp, which is a list of
+// addresses, the first address is advertised.
+func ResolveAdvertiseHttp(bindHttp string) (string, error) {
+	bindHttp = SplitBindHttp(bindHttp)[0]
+
+	host, port, err := net.SplitHostPort(bindHttp)
+	if err != nil {
+		return "", fmt.Errorf("bind_http: bindHttp: %q, err: %v, %w",
+			bindHttp, err, ErrorBindHttp)
+	}
+
+	if isWildcardHost(host) {
+		host = detectAdvertiseHost()
+	}
+
+	rv := NormalizeHostPort(net.JoinHostPort(host, port))
+
+	return rv, ValidateAdvertiseHttp(rv)
+}
+
+func isWildcardHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// detectAdvertiseHost returns the FQDN of the host, or else the IP
+// address of a non-loopback network interface, preferring IPv4, or
+// else the loopback address.
+func detectAdvertiseHost() string {
+	hostname, err := os.Hostname()
+	if err == nil && hostname != "" {
+		cname, err := net.LookupCNAME(hostname)
+		if err == nil {
+			cname = strings.TrimSuffix(cname, ".")
+			if strings.Contains(cname, ".") {
+				return cname
+			}
+		}
+		if strings.Contains(hostname, ".") {
+			if _, err = net.LookupHost(hostname); err == nil {
+				return hostname
+			}
+		}
+	}
+
+	var ipv6 string
+
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() ||
+				ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				return ipNet.IP.String()
+			}
+			if ipv6 == "" {
+				ipv6 = ipNet.IP.String()
+			}
+		}
+	}
+
+	if ipv6 != "" {
+		return ipv6
+	}
+
+	return "127.0.0.1"
+}
+
+// ---------------------------------------------------------
+
+// NormalizeHostPort returns the canonical form of a host:port, so
+// that the addresses of a node compare equal, where an IPv6 literal
+// host is bracketed and in its RFC 5952 form, such as "[fd00::1]:8095"
+// for "[FD00:0::1]:8095".  A host:port that can't be parsed is
+// returned unchanged.
+func NormalizeHostPort(hostPort string) string {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return hostPort
+	}
+
+	ip, zone := host, ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		ip, zone = host[:i], host[i:]
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		host = parsed.String() + zone
+	} else {
+		host = strings.ToLower(host)
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// HostPortURL returns the URL of a node's host:port for a scheme, such
+// as "http://[fd00::1]:8095", where an IPv6 zone is escaped as
+// required in URLs, like "http://[fe80::1%25eth0]:8095".  A bare IPv6
+// literal, which has no port, is bracketed.
+func HostPortURL(scheme, hostPort string) string {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = hostPort, ""
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	}
+
+	host = strings.Replace(host, "%", "%25", 1)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+
+	return scheme + "://" + host
+}
+
+// SplitBindHttp returns the addresses of a bindHttp, which may be a
+// comma-separated list, such as "0.0.0.0:8095,[::]:8095" for a
+// dual-stack node.
+func SplitBindHttp(bindHttp string) []string {
+	var rv []string
+	for _, addr := range strings.Split(bindHttp, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			rv = append(rv, addr)
+		}
+	}
+	if len(rv) <= 0 {
+		rv = []string{bindHttp}
+	}
+	return rv
+}
+
+// ListenHttp listens on the addresses of a bindHttp, see
+// SplitBindHttp().  An address with an IPv4 literal host listens only
+// on IPv4, and one with an IPv6 literal host only on IPv6, so that
+// "0.0.0.0:8095,[::]:8095" has a socket for each family.  An address
+// with a hostname or without a host, such as ":8095", listens on both
+// families where the OS supports dual-stack sockets.
+func ListenHttp(bindHttp string) (net.Listener, error) {
+	var listeners []net.Listener
+
+	for _, addr := range SplitBindHttp(bindHttp) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("bind_http: addr: %q, err: %v, %w",
+				addr, err, ErrorBindHttp)
+		}
+
+		network := "tcp"
+		if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip != nil {
+			if ip.To4() != nil {
+				network = "tcp4"
+			} else {
+				network = "tcp6"
+			}
+		}
+
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("bind_http: listen, addr: %q, err: %v",
+				addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+
+	return newMultiListener(listeners), nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// multiListener accepts the connections of several listeners.
+type multiListener struct {
+	listeners []net.Listener
+	acceptCh  chan acceptResult
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		acceptCh:  make(chan acceptResult),
+		closeCh:   make(chan struct{}),
+	}
+
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				select {
+				case m.acceptCh <- acceptResult{conn, err}:
+				case <-m.closeCh:
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
+				if err != nil {
+					if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+						return
+					}
+				}
+			}
+		}(l)
+	}
+
+	return m
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.acceptCh:
+		return r.conn, r.err
+	case <-m.closeCh:
+		return nil, fmt.Errorf("bind_http: listener closed")
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.closeCh)
+		for _, l := range m.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,150 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateAdvertiseHttp(t *testing.T) {
+	for addr, valid := range map[string]bool{
+		"host.example.com:8095": true,
+		"10.1.2.3:8095":         true,
+		"[fd00::1]:8095":        true,
+		"127.0.0.1:8095":        true,
+		":8095":                 false,
+		"0.0.0.0:8095":          false,
+		"[::]:8095":             false,
+		"host.example.com":      false,
+		"host.example.com:0":    false,
+		"host.example.com:http": false,
+		"host.example.com:1e6":  false,
+	} {
+		err := ValidateAdvertiseHttp(addr)
+		if (err == nil) != valid {
+			t.Errorf("addr: %q, expected valid: %v, err: %v",
+				addr, valid, err)
+		}
+		if err != nil && !errors.Is(err, ErrorBindHttp) {
+			t.Errorf("addr: %q, expected an ErrorBindHttp, err: %v",
+				addr, err)
+		}
+	}
+}
+
+func TestResolveAdvertiseHttp(t *testing.T) {
+	addr, err := ResolveAdvertiseHttp("host.example.com:8095")
+	if err != nil || addr != "host.example.com:8095" {
+		t.Errorf("expected a non-wildcard host unchanged, got: %s, err: %v",
+			addr, err)
+	}
+
+	for _, bindHttp := range []string{":8095", "0.0.0.0:8095", "[::]:8095"} {
+		addr, err = ResolveAdvertiseHttp(bindHttp)
+		if err != nil || !strings.HasSuffix(addr, ":8095") {
+			t.Errorf("bindHttp: %s, expected a resolved addr, got: %s,"+
+				" err: %v", bindHttp, addr, err)
+		}
+	}
+
+	_, err = ResolveAdvertiseHttp("8095")
+	if !errors.Is(err, ErrorBindHttp) {
+		t.Errorf("expected an ErrorBindHttp, err: %v", err)
+	}
+}
+
+func TestNormalizeHostPort(t *testing.T) {
+	for hostPort, exp := range map[string]string{
+		"[FD00:0::1]:8095":     "[fd00::1]:8095",
+		"[fe80::1%eth0]:8095":  "[fe80::1%eth0]:8095",
+		"[::ffff:10.0.0.1]:80": "10.0.0.1:80",
+		"Host.Example.com:80":  "host.example.com:80",
+		"10.1.2.3:8095":        "10.1.2.3:8095",
+		"fd00::1":              "fd00::1", // Unparsable, so unchanged.
+	} {
+		if got := NormalizeHostPort(hostPort); got != exp {
+			t.Errorf("hostPort: %q, expected: %q, got: %q",
+				hostPort, exp, got)
+		}
+	}
+}
+
+func TestHostPortURL(t *testing.T) {
+	for hostPort, exp := range map[string]string{
+		"10.1.2.3:8095":       "http://10.1.2.3:8095",
+		"[fd00::1]:8095":      "http://[fd00::1]:8095",
+		"[fe80::1%eth0]:8095": "http://[fe80::1%25eth0]:8095",
+		"fd00::1":             "http://[fd00::1]",
+		"[fd00::1]":           "http://[fd00::1]",
+		"host.example.com":    "http://host.example.com",
+	} {
+		got := HostPortURL("http", hostPort)
+		if got != exp {
+			t.Errorf("hostPort: %q, expected: %q, got: %q",
+				hostPort, exp, got)
+		}
+		if _, err := url.Parse(got); err != nil {
+			t.Errorf("hostPort: %q, expected a valid URL, err: %v",
+				hostPort, err)
+		}
+	}
+}
+
+func TestListenHttpDualStack(t *testing.T) {
+	l, err := ListenHttp("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected ListenHttp to work, err: %v", err)
+	}
+	l.Close()
+
+	l6, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback, err: %v", err)
+	}
+	l6.Close()
+
+	l, err = ListenHttp("127.0.0.1:0, [::1]:0")
+	if err != nil {
+		t.Fatalf("expected a dual-stack ListenHttp to work, err: %v", err)
+	}
+	defer l.Close()
+
+	ml, ok := l.(*multiListener)
+	if !ok || len(ml.listeners) != 2 {
+		t.Fatalf("expected a listener per address, got: %#v", l)
+	}
+
+	for _, sub := range ml.listeners {
+		go func(addr string) {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+		}(sub.Addr().String())
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("expected Accept to work, err: %v", err)
+		}
+		conn.Close()
+	}
+
+	_, err = ListenHttp("8095")
+	if !errors.Is(err, ErrorBindHttp) {
+		t.Errorf("expected an ErrorBindHttp, err: %v", err)
+	}
+}
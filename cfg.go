@@ -11,6 +11,10 @@
 
 package cbgt
 
+import (
+	"errors"
+)
+
 // Cfg is the interface that configuration providers must implement.
 type Cfg interface {
 	// Get retrieves an entry from the Cfg.  A zero cas means don't do
@@ -51,4 +55,41 @@ type CfgEvent struct {
 	Key   string
 	CAS   uint64
 	Error error
+
+	// Heartbeat is true for an event that's a reply to a Ping() of a
+	// CfgPinger, which is not a change of the key, and which should
+	// be ignored by subscribers that don't ping.
+	Heartbeat bool
+}
+
+// A CfgPinger is a Cfg whose subscriptions can be checked for
+// liveness, which is important for a Cfg whose subscriptions are
+// watches on a remote backend that may silently expire.
+type CfgPinger interface {
+	// Ping asks the Cfg to send a CfgEvent with Heartbeat true for
+	// the key to each channel that's subscribed to the key, so that
+	// a subscriber that doesn't receive the heartbeat knows that its
+	// subscription is dead and should be subscribed again.
+	Ping(key string) error
+}
+
+// ErrCfgPingUnsupported is returned by CfgPing() when a Cfg isn't,
+// and doesn't wrap, a CfgPinger.
+var ErrCfgPingUnsupported = errors.New("cfg: ping is unsupported")
+
+// CfgPing pings a key of a Cfg that is a CfgPinger or that wraps
+// one, where a wrapper exposes its wrapped Cfg with an Inner() method
+// and subscribes its keys unchanged on the wrapped Cfg.
+func CfgPing(cfg Cfg, key string) error {
+	for cfg != nil {
+		if p, ok := cfg.(CfgPinger); ok {
+			return p.Ping(key)
+		}
+		w, ok := cfg.(interface{ Inner() Cfg })
+		if !ok {
+			break
+		}
+		cfg = w.Inner()
+	}
+	return ErrCfgPingUnsupported
 }
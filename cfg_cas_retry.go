@@ -0,0 +1,189 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// CASRetryOptions configures the adaptive backoff of the Cfg CAS
+// retry loops.
+type CASRetryOptions struct {
+	// BackoffStart is the most that the first retry of an uncontended
+	// key sleeps, which doubles with each further conflict, up to
+	// BackoffMax.
+	BackoffStart time.Duration
+	BackoffMax   time.Duration
+
+	// ContentionWeight scales the BackoffStart by the key's recent
+	// contention, from 0 to 1, so that the retries of a hot key, such
+	// as the nodeDefs during the cold-start of a large cluster, are
+	// spread out from the first conflict.
+	ContentionWeight float64
+}
+
+// DefaultCASRetryOptions are used by the CAS retry loops, and should
+// only be changed at init/startup time.
+var DefaultCASRetryOptions = CASRetryOptions{
+	BackoffStart:     time.Millisecond,
+	BackoffMax:       time.Second,
+	ContentionWeight: 16,
+}
+
+// casContentionAlpha is the smoothing factor of the exponentially
+// weighted moving average of a key's conflicts per attempt.
+const casContentionAlpha = 0.2
+
+// CAS_RETRIES_BUCKETS are the upper bounds of the buckets of the
+// conflicts before success histogram, where the last bucket is
+// unbounded.
+var CAS_RETRIES_BUCKETS = []int{0, 1, 2, 4, 8, 16, 32}
+
+// CASKeyStats are the CAS conflict analytics of a Cfg key.
+type CASKeyStats struct {
+	TotConflict uint64 `json:"totConflict"`
+	TotSuccess  uint64 `json:"totSuccess"`
+
+	// RetriesHistogram counts the successes by the conflicts that
+	// preceded them, bucketed by the CAS_RETRIES_BUCKETS.
+	RetriesHistogram []uint64 `json:"retriesHistogram"`
+
+	// Contention is the recent fraction of attempts that conflicted.
+	Contention float64 `json:"contention"`
+
+	LastConflict string `json:"lastConflict,omitempty"`
+}
+
+var casStatsM sync.Mutex
+var casStats = map[string]*CASKeyStats{} // Keyed by Cfg key.
+
+func casKeyStatsLOCKED(key string) *CASKeyStats {
+	s := casStats[key]
+	if s == nil {
+		s = &CASKeyStats{
+			RetriesHistogram: make([]uint64, len(CAS_RETRIES_BUCKETS)+1),
+		}
+		casStats[key] = s
+	}
+	return s
+}
+
+// CASConflictStats returns the CAS conflict analytics of this process,
+// keyed by Cfg key.
+func CASConflictStats() map[string]CASKeyStats {
+	casStatsM.Lock()
+	defer casStatsM.Unlock()
+
+	rv := make(map[string]CASKeyStats, len(casStats))
+	for key, s := range casStats {
+		c := *s
+		c.RetriesHistogram = append([]uint64(nil), s.RetriesHistogram...)
+		rv[key] = c
+	}
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// A CASRetry tracks the attempts of a CAS retry loop on a Cfg key, as
+// in...
+//
+//	r := NewCASRetry(key)
+//	for {
+//	    ...
+//	    _, err = cfg.Set(key, val, cas)
+//	    if _, ok := err.(*CfgCASError); ok {
+//	        r.Conflict()
+//	        continue
+//	    }
+//	    r.Done(err)
+//	    ...
+//	}
+type CASRetry struct {
+	key       string
+	conflicts int
+}
+
+// NewCASRetry returns a CASRetry for a retry loop on a Cfg key.
+func NewCASRetry(key string) *CASRetry {
+	return &CASRetry{key: key}
+}
+
+// Conflict records a CAS conflict and then sleeps for a randomly
+// jittered backoff, which grows with the loop's conflicts and with
+// the key's recent contention, before the caller's retry.
+func (r *CASRetry) Conflict() {
+	r.conflicts++
+
+	casStatsM.Lock()
+	s := casKeyStatsLOCKED(r.key)
+	s.TotConflict++
+	s.Contention += casContentionAlpha * (1 - s.Contention)
+	s.LastConflict = Now().Format(time.RFC3339Nano)
+	contention := s.Contention
+	casStatsM.Unlock()
+
+	time.Sleep(CASBackoff(r.conflicts, contention, DefaultCASRetryOptions))
+}
+
+// Done records the end of the retry loop, where a nil err means the
+// mutation succeeded.
+func (r *CASRetry) Done(err error) {
+	if err != nil {
+		return
+	}
+
+	casStatsM.Lock()
+	s := casKeyStatsLOCKED(r.key)
+	s.TotSuccess++
+	s.Contention -= casContentionAlpha * s.Contention
+	b := 0
+	for b < len(CAS_RETRIES_BUCKETS) && r.conflicts > CAS_RETRIES_BUCKETS[b] {
+		b++
+	}
+	s.RetriesHistogram[b]++
+	casStatsM.Unlock()
+}
+
+// RecordCASConflict records a CAS conflict on a Cfg key that the
+// caller won't retry, such as when a concurrent planner won.
+func RecordCASConflict(key string) {
+	casStatsM.Lock()
+	s := casKeyStatsLOCKED(key)
+	s.TotConflict++
+	s.Contention += casContentionAlpha * (1 - s.Contention)
+	s.LastConflict = Now().Format(time.RFC3339Nano)
+	casStatsM.Unlock()
+}
+
+// CASBackoff returns the "full jitter" backoff before the retry after
+// the given number of conflicts on a key with the given contention,
+// which is a random duration up to a limit that doubles with each
+// conflict, starting from a BackoffStart that's scaled up by the
+// contention, and capped at the BackoffMax.
+func CASBackoff(conflicts int, contention float64,
+	options CASRetryOptions) time.Duration {
+	limit := float64(options.BackoffStart) *
+		(1 + contention*options.ContentionWeight)
+	for i := 1; i < conflicts && limit < float64(options.BackoffMax); i++ {
+		limit *= 2
+	}
+	if limit > float64(options.BackoffMax) {
+		limit = float64(options.BackoffMax)
+	}
+	if limit < 1 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)) + 1)
+}
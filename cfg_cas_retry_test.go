@@ -0,0 +1,122 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCASBackoff(t *testing.T) {
+	options := CASRetryOptions{
+		BackoffStart:     time.Millisecond,
+		BackoffMax:       100 * time.Millisecond,
+		ContentionWeight: 4,
+	}
+
+	tests := []struct {
+		conflicts  int
+		contention float64
+		limit      time.Duration
+	}{
+		{1, 0, time.Millisecond},
+		{2, 0, 2 * time.Millisecond},
+		{4, 0, 8 * time.Millisecond},
+		{1, 1, 5 * time.Millisecond},
+		{3, 0.5, 12 * time.Millisecond},
+		{100, 0, 100 * time.Millisecond},
+		{100, 1, 100 * time.Millisecond},
+	}
+
+	for testi, test := range tests {
+		for i := 0; i < 100; i++ {
+			d := CASBackoff(test.conflicts, test.contention, options)
+			if d <= 0 || d > test.limit {
+				t.Errorf("testi: %d, test: %+v, got: %v",
+					testi, test, d)
+			}
+		}
+	}
+
+	if d := CASBackoff(1, 0, CASRetryOptions{}); d != 0 {
+		t.Errorf("expected no backoff for zero options, got: %v", d)
+	}
+}
+
+func TestCASRetryStats(t *testing.T) {
+	key := "TestCASRetryStats-" + NewUUID()
+
+	r := NewCASRetry(key)
+	r.Conflict()
+	r.Conflict()
+	r.Conflict()
+	r.Done(nil)
+
+	r = NewCASRetry(key)
+	r.Done(nil)
+
+	r = NewCASRetry(key)
+	r.Conflict()
+	r.Done(fmt.Errorf("not a success"))
+
+	RecordCASConflict(key)
+
+	s, exists := CASConflictStats()[key]
+	if !exists {
+		t.Fatalf("expected stats for key")
+	}
+	if s.TotConflict != 5 || s.TotSuccess != 2 {
+		t.Errorf("unexpected totals, stats: %+v", s)
+	}
+	if s.RetriesHistogram[0] != 1 || // 0 conflicts.
+		s.RetriesHistogram[3] != 1 { // 3-4 conflicts.
+		t.Errorf("unexpected histogram, stats: %+v", s)
+	}
+	if s.Contention <= 0 || s.Contention >= 1 {
+		t.Errorf("unexpected contention, stats: %+v", s)
+	}
+	if s.LastConflict == "" {
+		t.Errorf("expected a lastConflict, stats: %+v", s)
+	}
+}
+
+func TestSaveNodeDefConcurrently(t *testing.T) {
+	cfg := NewCfgMem()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		mgr := NewManager(Version, cfg, nil, fmt.Sprintf("node%d", i),
+			nil, "", 1, "", fmt.Sprintf(":%d", 1000+i), "", "some-datasource",
+			nil, nil)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := mgr.SaveNodeDef(NODE_DEFS_KNOWN, true); err != nil {
+				t.Errorf("expected SaveNodeDef to succeed, err: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	nodeDefs, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if err != nil || nodeDefs == nil || len(nodeDefs.NodeDefs) != 20 {
+		t.Errorf("expected 20 nodeDefs, got: %+v, err: %v", nodeDefs, err)
+	}
+
+	s := CASConflictStats()[CfgNodeDefsKey(NODE_DEFS_KNOWN)]
+	if s.TotSuccess < 20 {
+		t.Errorf("expected at least 20 successes, stats: %+v", s)
+	}
+}
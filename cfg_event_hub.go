@@ -0,0 +1,325 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A CfgEventHub multiplexes subscriptions to a Cfg, so that each key
+// is subscribed only once on the Cfg no matter how many parts of a
+// process are interested in it, using a single goroutine and channel
+// to receive all of the Cfg's events.
+//
+// Each CfgEventSub has its own goroutine to invoke its callback.
+// While a callback is running, further events for the same key are
+// coalesced into the latest event, so that a burst of changes to a
+// key results in a single extra callback instead of one per change.
+//
+// Heartbeat events are never delivered to the callbacks, and see
+// CheckSubscriptions().
+type CfgEventHub struct {
+	cfg    Cfg
+	ch     chan CfgEvent
+	stopCh chan struct{}
+
+	TotEvent          uint64
+	TotEventCoalesced uint64
+	TotEventDropped   uint64 // Events for keys with no subscribers.
+	TotResubscribe    uint64
+	TotPing           uint64
+	TotPingDead       uint64 // Pings whose heartbeat didn't arrive.
+
+	m          sync.Mutex                // Protects the fields that follow.
+	subs       map[string][]*CfgEventSub // Keyed by Cfg key, copy-on-write.
+	subscribed map[string]bool           // Keys subscribed on the Cfg.
+	pings      map[string]chan struct{}  // Closed on a key's heartbeat.
+	started    bool
+	stopped    bool
+}
+
+// A CfgEventSub is a subscription to one or more keys of a
+// CfgEventHub.
+type CfgEventSub struct {
+	hub    *CfgEventHub
+	keys   []string
+	fn     func(CfgEvent)
+	kickCh chan struct{}
+	doneCh chan struct{}
+
+	m       sync.Mutex // Protects the fields that follow.
+	pending map[string]CfgEvent
+	order   []string // Keys of the pending events, in arrival order.
+	done    bool
+}
+
+// NewCfgEventHub returns a CfgEventHub for a Cfg.
+func NewCfgEventHub(cfg Cfg) *CfgEventHub {
+	return &CfgEventHub{
+		cfg:        cfg,
+		ch:         make(chan CfgEvent),
+		stopCh:     make(chan struct{}),
+		subs:       map[string][]*CfgEventSub{},
+		subscribed: map[string]bool{},
+		pings:      map[string]chan struct{}{},
+	}
+}
+
+// Subscribe registers a callback for the events of the given keys.
+// The callback is never invoked concurrently with itself.
+func (h *CfgEventHub) Subscribe(keys []string,
+	fn func(CfgEvent)) (*CfgEventSub, error) {
+	s := &CfgEventSub{
+		hub:     h,
+		keys:    append([]string(nil), keys...),
+		fn:      fn,
+		kickCh:  make(chan struct{}, 1),
+		doneCh:  make(chan struct{}),
+		pending: map[string]CfgEvent{},
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	for _, key := range s.keys {
+		if !h.subscribed[key] {
+			err := h.cfg.Subscribe(key, h.ch)
+			if err != nil {
+				return nil, err
+			}
+			h.subscribed[key] = true
+		}
+	}
+
+	for _, key := range s.keys {
+		subs := make([]*CfgEventSub, 0, len(h.subs[key])+1)
+		subs = append(subs, h.subs[key]...)
+		h.subs[key] = append(subs, s)
+	}
+
+	if !h.started {
+		h.started = true
+		go h.run()
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Resubscribe subscribes the given keys of the hub on the Cfg again,
+// such as when the events of a key seem to be lost.  As a Cfg has no
+// way to unsubscribe, a key whose subscription is still working will
+// then have its events delivered twice, which is harmless, as the
+// events are coalesced and only signal that a key changed.
+func (h *CfgEventHub) Resubscribe(keys []string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	for _, key := range keys {
+		if h.subscribed[key] {
+			err := h.cfg.Subscribe(key, h.ch)
+			if err != nil {
+				return err
+			}
+			atomic.AddUint64(&h.TotResubscribe, 1)
+		}
+	}
+
+	return nil
+}
+
+// CheckSubscriptions pings all the keys that the hub subscribed on
+// the Cfg, and subscribes again the keys whose heartbeat didn't arrive
+// within the timeout, such as when a watch of the Cfg's backend
+// silently expired, returning those keys.  ErrCfgPingUnsupported is
+// returned when the Cfg can't be pinged.  See CfgPinger.
+func (h *CfgEventHub) CheckSubscriptions(timeout time.Duration) (
+	[]string, error) {
+	h.m.Lock()
+	keys := make([]string, 0, len(h.subscribed))
+	pings := make(map[string]chan struct{}, len(h.subscribed))
+	for key := range h.subscribed {
+		keys = append(keys, key)
+		pings[key] = make(chan struct{})
+		h.pings[key] = pings[key]
+	}
+	h.m.Unlock()
+
+	sort.Strings(keys)
+
+	defer func() {
+		h.m.Lock()
+		for key, ping := range pings {
+			if h.pings[key] == ping {
+				delete(h.pings, key)
+			}
+		}
+		h.m.Unlock()
+	}()
+
+	for _, key := range keys {
+		err := CfgPing(h.cfg, key)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddUint64(&h.TotPing, 1)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var dead []string
+	expired := false
+
+	for _, key := range keys {
+		if !expired {
+			select {
+			case <-h.stopCh:
+				return nil, nil
+			case <-pings[key]:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+
+		select {
+		case <-pings[key]:
+		default:
+			dead = append(dead, key)
+		}
+	}
+
+	if len(dead) <= 0 {
+		return nil, nil
+	}
+
+	atomic.AddUint64(&h.TotPingDead, uint64(len(dead)))
+
+	return dead, h.Resubscribe(dead)
+}
+
+// Stop stops the hub and all of its subscriptions.
+func (h *CfgEventHub) Stop() {
+	h.m.Lock()
+	if !h.stopped {
+		h.stopped = true
+		close(h.stopCh)
+	}
+	h.m.Unlock()
+}
+
+func (h *CfgEventHub) run() {
+	for {
+		select {
+		case <-h.stopCh:
+			return
+		case e := <-h.ch:
+			if e.Heartbeat {
+				h.m.Lock()
+				if ping := h.pings[e.Key]; ping != nil {
+					close(ping)
+					delete(h.pings, e.Key)
+				}
+				h.m.Unlock()
+				continue
+			}
+
+			atomic.AddUint64(&h.TotEvent, 1)
+
+			h.m.Lock()
+			subs := h.subs[e.Key]
+			h.m.Unlock()
+
+			if len(subs) <= 0 {
+				atomic.AddUint64(&h.TotEventDropped, 1)
+			}
+
+			for _, s := range subs {
+				s.post(e)
+			}
+		}
+	}
+}
+
+// Unsubscribe removes the subscription from its hub.  The callback
+// may still be invoked for an event that's already being delivered.
+// The keys stay subscribed on the Cfg, as a Cfg has no way to
+// unsubscribe, but their events are dropped once nobody's interested.
+func (s *CfgEventSub) Unsubscribe() {
+	h := s.hub
+
+	h.m.Lock()
+	for _, key := range s.keys {
+		subs := make([]*CfgEventSub, 0, len(h.subs[key]))
+		for _, x := range h.subs[key] {
+			if x != s {
+				subs = append(subs, x)
+			}
+		}
+		if len(subs) > 0 {
+			h.subs[key] = subs
+		} else {
+			delete(h.subs, key)
+		}
+	}
+	h.m.Unlock()
+
+	s.m.Lock()
+	if !s.done {
+		s.done = true
+		close(s.doneCh)
+	}
+	s.m.Unlock()
+}
+
+// post queues an event for the callback, coalescing it with any
+// pending event for the same key.
+func (s *CfgEventSub) post(e CfgEvent) {
+	s.m.Lock()
+	if _, exists := s.pending[e.Key]; exists {
+		atomic.AddUint64(&s.hub.TotEventCoalesced, 1)
+	} else {
+		s.order = append(s.order, e.Key)
+	}
+	s.pending[e.Key] = e
+	s.m.Unlock()
+
+	select {
+	case s.kickCh <- struct{}{}:
+	default: // The sub is already kicked.
+	}
+}
+
+func (s *CfgEventSub) run() {
+	for {
+		select {
+		case <-s.hub.stopCh:
+			return
+		case <-s.doneCh:
+			return
+		case <-s.kickCh:
+			s.m.Lock()
+			pending, order := s.pending, s.order
+			s.pending, s.order = map[string]CfgEvent{}, nil
+			s.m.Unlock()
+
+			for _, key := range order {
+				s.fn(pending[key])
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCfgEventHub(t *testing.T) {
+	cfg := NewCfgMem()
+	h := NewCfgEventHub(cfg)
+	defer h.Stop()
+
+	ch0 := make(chan CfgEvent, 100)
+	ch1 := make(chan CfgEvent, 100)
+
+	sub0, err := h.Subscribe([]string{"a", "b"}, func(e CfgEvent) {
+		ch0 <- e
+	})
+	if err != nil {
+		t.Fatalf("expected Subscribe() to work, err: %v", err)
+	}
+	_, err = h.Subscribe([]string{"a"}, func(e CfgEvent) {
+		ch1 <- e
+	})
+	if err != nil {
+		t.Fatalf("expected Subscribe() to work, err: %v", err)
+	}
+
+	if len(cfg.subscriptions["a"]) != 1 {
+		t.Errorf("expected a single cfg subscription, got: %d",
+			len(cfg.subscriptions["a"]))
+	}
+
+	cfg.Set("a", []byte("A"), 0)
+	if e := <-ch0; e.Key != "a" {
+		t.Errorf("expected event for a, got: %#v", e)
+	}
+	if e := <-ch1; e.Key != "a" {
+		t.Errorf("expected event for a, got: %#v", e)
+	}
+
+	cfg.Set("b", []byte("B"), 0)
+	if e := <-ch0; e.Key != "b" {
+		t.Errorf("expected event for b, got: %#v", e)
+	}
+
+	sub0.Unsubscribe()
+
+	cfg.Set("a", []byte("AA"), CFG_CAS_FORCE)
+	if e := <-ch1; e.Key != "a" {
+		t.Errorf("expected event for a, got: %#v", e)
+	}
+	select {
+	case e := <-ch0:
+		t.Errorf("expected no event after unsubscribe, got: %#v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestCfgEventHubCoalesce(t *testing.T) {
+	cfg := NewCfgMem()
+	h := NewCfgEventHub(cfg)
+	defer h.Stop()
+
+	blockCh := make(chan struct{})
+	eventCh := make(chan CfgEvent, 100)
+
+	_, err := h.Subscribe([]string{"a"}, func(e CfgEvent) {
+		eventCh <- e
+		<-blockCh
+	})
+	if err != nil {
+		t.Fatalf("expected Subscribe() to work, err: %v", err)
+	}
+
+	cfg.Set("a", []byte("A"), 0)
+	<-eventCh // The callback is now blocked.
+
+	for i := 0; i < 10; i++ {
+		cfg.FireEvent("a", uint64(100+i), nil)
+	}
+	for atomic.LoadUint64(&h.TotEvent) < 11 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(blockCh)
+
+	e := <-eventCh
+	if e.CAS < 100 {
+		t.Errorf("expected a coalesced event, got: %#v", e)
+	}
+	select {
+	case e = <-eventCh:
+		t.Errorf("expected a single coalesced event, got: %#v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if atomic.LoadUint64(&h.TotEventCoalesced) != 9 {
+		t.Errorf("expected 9 coalesced events, got: %d", h.TotEventCoalesced)
+	}
+}
+
+func TestCfgEventHubResubscribe(t *testing.T) {
+	cfg := NewCfgMem()
+	h := NewCfgEventHub(cfg)
+	defer h.Stop()
+
+	ch := make(chan CfgEvent, 100)
+	_, err := h.Subscribe([]string{"a"}, func(e CfgEvent) {
+		ch <- e
+	})
+	if err != nil {
+		t.Fatalf("expected Subscribe() to work, err: %v", err)
+	}
+
+	err = h.Resubscribe([]string{"a", "not-subscribed"})
+	if err != nil {
+		t.Fatalf("expected Resubscribe() to work, err: %v", err)
+	}
+	if len(cfg.subscriptions["a"]) != 2 ||
+		len(cfg.subscriptions["not-subscribed"]) != 0 {
+		t.Errorf("expected only a resubscribed, got: %#v", cfg.subscriptions)
+	}
+	if atomic.LoadUint64(&h.TotResubscribe) != 1 {
+		t.Errorf("expected 1 resubscribe, got: %d", h.TotResubscribe)
+	}
+
+	cfg.Set("a", []byte("A"), 0)
+	if e := <-ch; e.Key != "a" {
+		t.Errorf("expected event for a, got: %#v", e)
+	}
+}
+
+func TestCfgEventHubCheckSubscriptions(t *testing.T) {
+	cfg := NewCfgMem()
+	h := NewCfgEventHub(cfg)
+	defer h.Stop()
+
+	ch := make(chan CfgEvent, 100)
+	_, err := h.Subscribe([]string{"a", "b"}, func(e CfgEvent) {
+		ch <- e
+	})
+	if err != nil {
+		t.Fatalf("expected Subscribe() to work, err: %v", err)
+	}
+
+	dead, err := h.CheckSubscriptions(time.Second)
+	if err != nil || len(dead) != 0 {
+		t.Errorf("expected live subscriptions, dead: %v, err: %v", dead, err)
+	}
+	select {
+	case e := <-ch:
+		t.Errorf("expected no heartbeat for the callback, got: %#v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Emulate a watch of the Cfg that silently expired.
+	cfg.m.Lock()
+	delete(cfg.subscriptions, "b")
+	cfg.m.Unlock()
+
+	dead, err = h.CheckSubscriptions(50 * time.Millisecond)
+	if err != nil || len(dead) != 1 || dead[0] != "b" {
+		t.Errorf("expected b to be dead, dead: %v, err: %v", dead, err)
+	}
+	if atomic.LoadUint64(&h.TotPingDead) != 1 ||
+		atomic.LoadUint64(&h.TotResubscribe) != 1 {
+		t.Errorf("unexpected stats, TotPingDead: %d, TotResubscribe: %d",
+			h.TotPingDead, h.TotResubscribe)
+	}
+
+	cfg.Set("b", []byte("B"), 0)
+	if e := <-ch; e.Key != "b" || e.Heartbeat {
+		t.Errorf("expected event for b, got: %#v", e)
+	}
+
+	dead, err = h.CheckSubscriptions(time.Second)
+	if err != nil || len(dead) != 0 {
+		t.Errorf("expected live subscriptions, dead: %v, err: %v", dead, err)
+	}
+}
+
+func TestCfgEventHubCheckSubscriptionsUnsupported(t *testing.T) {
+	h := NewCfgEventHub(&ErrorOnlyCfg{})
+	defer h.Stop()
+
+	h.subscribed["a"] = true
+
+	_, err := h.CheckSubscriptions(time.Second)
+	if err != ErrCfgPingUnsupported {
+		t.Errorf("expected ErrCfgPingUnsupported, got: %v", err)
+	}
+}
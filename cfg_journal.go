@@ -0,0 +1,336 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CFG_JOURNAL_FILE_NAME is the conventional name of a node's Cfg
+// journal in its dataDir.
+const CFG_JOURNAL_FILE_NAME = "cfg.journal"
+
+// CfgJournalOptions configures a CfgJournal.
+type CfgJournalOptions struct {
+	// Path is the journal file, which is rotated to Path + ".1" when
+	// it exceeds MaxBytes.  An empty Path means in-memory only.
+	Path     string
+	MaxBytes int64
+
+	// Capacity is the number of recent entries kept in memory.
+	Capacity int
+}
+
+// DefaultCfgJournalOptions are the defaults for a CfgJournal.
+var DefaultCfgJournalOptions = CfgJournalOptions{
+	MaxBytes: 10 * 1024 * 1024,
+	Capacity: 1000,
+}
+
+// A CfgJournalEntry records a mutation of the Cfg that this node
+// attempted.  Each mutation is journaled twice, first with a Result of
+// "pending" before the mutation is attempted, and then with its
+// outcome, which share the same Seq.
+type CfgJournalEntry struct {
+	Seq    uint64 `json:"seq"`
+	Time   string `json:"time"`
+	Op     string `json:"op"` // "set" or "del".
+	Key    string `json:"key"`
+	CASIn  uint64 `json:"casIn"`
+	CASOut uint64 `json:"casOut,omitempty"`
+	Bytes  int    `json:"bytes,omitempty"` // The size of a set's val.
+
+	// Result is "pending", "ok", "cas" for a CAS mismatch, or "err".
+	Result string `json:"result"`
+	Err    string `json:"err,omitempty"`
+}
+
+// CfgJournalKeyStats are the outcomes of the mutations of a Cfg key,
+// which can be correlated with retry stats, such as
+// TotSaveNodeDefRetry, to debug concurrent planners.
+type CfgJournalKeyStats struct {
+	TotSet    uint64 `json:"totSet"`
+	TotSetCAS uint64 `json:"totSetCAS"`
+	TotSetErr uint64 `json:"totSetErr"`
+	TotDel    uint64 `json:"totDel"`
+	TotDelErr uint64 `json:"totDelErr"`
+}
+
+// CfgJournal wraps a Cfg to write-ahead journal every Set() and Del()
+// that this node attempts to a local, rotating file, and to remember
+// the recent entries, so that conflicts between concurrent planners
+// can be debugged after the fact.  Reads aren't journaled.
+type CfgJournal struct {
+	inner   Cfg
+	options CfgJournalOptions
+
+	m        sync.Mutex // Protects the fields that follow.
+	seq      uint64
+	file     *os.File
+	fileSize int64
+	recent   []*CfgJournalEntry // A ring of the recent outcomes.
+	next     int                // The next position in the recent ring.
+	keyStats map[string]*CfgJournalKeyStats
+	errs     uint64 // Failed journal writes.
+}
+
+// NewCfgJournal returns a CfgJournal that wraps the given Cfg, where
+// zero valued options fall back to the DefaultCfgJournalOptions.
+func NewCfgJournal(inner Cfg, options CfgJournalOptions) (
+	*CfgJournal, error) {
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultCfgJournalOptions.MaxBytes
+	}
+	if options.Capacity <= 0 {
+		options.Capacity = DefaultCfgJournalOptions.Capacity
+	}
+
+	c := &CfgJournal{
+		inner:    inner,
+		options:  options,
+		keyStats: map[string]*CfgJournalKeyStats{},
+	}
+
+	if options.Path != "" {
+		c.m.Lock()
+		err := c.openLOCKED()
+		c.m.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Inner returns the wrapped Cfg.
+func (c *CfgJournal) Inner() Cfg {
+	return c.inner
+}
+
+func (c *CfgJournal) openLOCKED() error {
+	f, err := os.OpenFile(c.options.Path,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cfg_journal: open, path: %s, err: %v",
+			c.options.Path, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cfg_journal: stat, path: %s, err: %v",
+			c.options.Path, err)
+	}
+
+	c.file = f
+	c.fileSize = fi.Size()
+
+	return nil
+}
+
+// Close closes the journal file, but not the wrapped Cfg.
+func (c *CfgJournal) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+func (c *CfgJournal) Get(key string, cas uint64) ([]byte, uint64, error) {
+	return c.inner.Get(key, cas)
+}
+
+func (c *CfgJournal) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	e := c.begin("set", key, cas)
+	e.Bytes = len(val)
+
+	casSuccess, err := c.inner.Set(key, val, cas)
+
+	e.CASOut = casSuccess
+	c.end(e, err)
+
+	return casSuccess, err
+}
+
+func (c *CfgJournal) Del(key string, cas uint64) error {
+	e := c.begin("del", key, cas)
+
+	err := c.inner.Del(key, cas)
+
+	c.end(e, err)
+
+	return err
+}
+
+func (c *CfgJournal) Subscribe(key string, ch chan CfgEvent) error {
+	return c.inner.Subscribe(key, ch)
+}
+
+func (c *CfgJournal) Refresh() error {
+	return c.inner.Refresh()
+}
+
+// begin journals a pending mutation.
+func (c *CfgJournal) begin(op, key string, cas uint64) *CfgJournalEntry {
+	c.m.Lock()
+	c.seq++
+	e := &CfgJournalEntry{
+		Seq:    c.seq,
+		Time:   Now().Format(time.RFC3339Nano),
+		Op:     op,
+		Key:    key,
+		CASIn:  cas,
+		Result: "pending",
+	}
+	c.writeLOCKED(e)
+	c.m.Unlock()
+
+	rv := *e
+	return &rv
+}
+
+// end journals the outcome of a mutation.
+func (c *CfgJournal) end(e *CfgJournalEntry, err error) {
+	e.Time = Now().Format(time.RFC3339Nano)
+	e.Result = "ok"
+	if err != nil {
+		e.Err = err.Error()
+		if _, ok := err.(*CfgCASError); ok {
+			e.Result = "cas"
+		} else {
+			e.Result = "err"
+		}
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.writeLOCKED(e)
+
+	if len(c.recent) < c.options.Capacity {
+		c.recent = append(c.recent, e)
+	} else {
+		c.recent[c.next] = e
+	}
+	c.next = (c.next + 1) % c.options.Capacity
+
+	ks := c.keyStats[e.Key]
+	if ks == nil {
+		ks = &CfgJournalKeyStats{}
+		c.keyStats[e.Key] = ks
+	}
+	if e.Op == "set" {
+		ks.TotSet++
+		if e.Result == "cas" {
+			ks.TotSetCAS++
+		} else if e.Result == "err" {
+			ks.TotSetErr++
+		}
+	} else {
+		ks.TotDel++
+		if e.Result != "ok" {
+			ks.TotDelErr++
+		}
+	}
+}
+
+// writeLOCKED appends an entry as a line of JSON to the journal file,
+// rotating the file when it's too large.  Journal write failures are
+// counted rather than failing the mutation.
+func (c *CfgJournal) writeLOCKED(e *CfgJournalEntry) {
+	if c.file == nil {
+		return
+	}
+
+	buf, _ := json.Marshal(e)
+	buf = append(buf, '\n')
+
+	if c.fileSize+int64(len(buf)) > c.options.MaxBytes && c.fileSize > 0 {
+		c.file.Close()
+		c.file = nil
+		err := os.Rename(c.options.Path, c.options.Path+".1")
+		if err == nil {
+			err = c.openLOCKED()
+		}
+		if err != nil {
+			c.errs++
+			return
+		}
+	}
+
+	n, err := c.file.Write(buf)
+	c.fileSize += int64(n)
+	if err != nil {
+		c.errs++
+	}
+}
+
+// Entries returns up to the limit of the most recent outcomes, oldest
+// first, where a limit <= 0 means all that are remembered.
+func (c *CfgJournal) Entries(limit int) []CfgJournalEntry {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	n := len(c.recent)
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+
+	rv := make([]CfgJournalEntry, 0, limit)
+	for i := n - limit; i < n; i++ {
+		// When the ring is full, the oldest entry is at c.next.
+		rv = append(rv, *c.recent[(c.next+i)%n])
+	}
+	return rv
+}
+
+// KeyStats returns the outcomes of the mutations, keyed by Cfg key.
+func (c *CfgJournal) KeyStats() map[string]CfgJournalKeyStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	rv := make(map[string]CfgJournalKeyStats, len(c.keyStats))
+	for key, ks := range c.keyStats {
+		rv[key] = *ks
+	}
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// CfgJournal returns the CfgJournal that the manager's Cfg is, or
+// wraps, or nil.
+func (mgr *Manager) CfgJournal() *CfgJournal {
+	cfg := mgr.cfg
+	for cfg != nil {
+		if cj, ok := cfg.(*CfgJournal); ok {
+			return cj
+		}
+		w, ok := cfg.(interface{ Inner() Cfg })
+		if !ok {
+			return nil
+		}
+		cfg = w.Inner()
+	}
+	return nil
+}
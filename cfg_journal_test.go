@@ -0,0 +1,112 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCfgJournal(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := filepath.Join(emptyDir, CFG_JOURNAL_FILE_NAME)
+
+	c, err := NewCfgJournal(NewCfgMem(), CfgJournalOptions{
+		Path: path, Capacity: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cas, err := c.Set("a", []byte("1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Set("a", []byte("2"), cas+100); err == nil {
+		t.Errorf("expected a CAS mismatch")
+	}
+	c.Set("b", []byte("1"), 0)
+	c.Del("b", 0)
+
+	entries := c.Entries(0)
+	if len(entries) != 3 ||
+		entries[0].Key != "a" || entries[0].Result != "cas" ||
+		entries[1].Op != "set" || entries[1].Result != "ok" ||
+		entries[2].Op != "del" {
+		t.Errorf("expected the 3 most recent outcomes, got: %#v", entries)
+	}
+	if entries = c.Entries(1); len(entries) != 1 || entries[0].Op != "del" {
+		t.Errorf("expected the most recent outcome, got: %#v", entries)
+	}
+
+	ks := c.KeyStats()
+	if ks["a"].TotSet != 2 || ks["a"].TotSetCAS != 1 || ks["b"].TotDel != 1 {
+		t.Errorf("unexpected key stats: %#v", ks)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var results []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e CfgJournalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, e.Result)
+	}
+	if len(results) != 8 || results[0] != "pending" || results[1] != "ok" {
+		t.Errorf("expected each mutation journaled ahead, got: %v", results)
+	}
+
+	m := NewManager(Version, c, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if m.CfgJournal() != c {
+		t.Errorf("expected the manager to find the journal")
+	}
+}
+
+func TestCfgJournalRotate(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := filepath.Join(emptyDir, CFG_JOURNAL_FILE_NAME)
+
+	c, err := NewCfgJournal(NewCfgMem(), CfgJournalOptions{
+		Path: path, MaxBytes: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		c.Set("k", []byte("v"), 0)
+	}
+
+	for _, p := range []string{path, path + ".1"} {
+		fi, err := os.Stat(p)
+		if err != nil || fi.Size() > 500 {
+			t.Errorf("expected a rotated journal, path: %s, fi: %v, err: %v",
+				p, fi, err)
+		}
+	}
+}
@@ -165,6 +165,25 @@ func (c *CfgMem) fireEvent(key string, cas uint64, err error) {
 	}
 }
 
+// Ping sends a heartbeat event for the key to its subscribers.
+func (c *CfgMem) Ping(key string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	var cas uint64
+	if entry, exists := c.Entries[key]; exists && entry != nil {
+		cas = entry.CAS
+	}
+
+	for _, ch := range c.subscriptions[key] {
+		go func(ch chan<- CfgEvent) {
+			ch <- CfgEvent{Key: key, CAS: cas, Heartbeat: true}
+		}(ch)
+	}
+
+	return nil
+}
+
 func (c *CfgMem) Refresh() error {
 	c.m.Lock()
 	defer c.m.Unlock()
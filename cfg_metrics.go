@@ -0,0 +1,285 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// CfgMetricsOptions configures a CfgMetrics.
+type CfgMetricsOptions struct {
+	// MaxRetries is the number of times a transient failure of an
+	// operation is retried, where CAS mismatches are never retried.
+	MaxRetries int
+
+	// BackoffStart is the sleep before the first retry, which is
+	// doubled on each further retry, up to BackoffMax.
+	BackoffStart time.Duration
+	BackoffMax   time.Duration
+
+	// UnreachableThreshold is how long the Cfg must be failing before
+	// OnUnreachable is invoked.
+	UnreachableThreshold time.Duration
+}
+
+// DefaultCfgMetricsOptions are the defaults for a CfgMetrics.
+var DefaultCfgMetricsOptions = CfgMetricsOptions{
+	MaxRetries:           3,
+	BackoffStart:         50 * time.Millisecond,
+	BackoffMax:           2 * time.Second,
+	UnreachableThreshold: 30 * time.Second,
+}
+
+// CfgMetrics wraps a Cfg to track per-operation latency and error
+// metrics, and to transparently retry transient failures with
+// exponential backoff, so that Cfg outages can be told apart from
+// planner issues.  Of note, a retried Set() whose first attempt
+// actually succeeded will result in a CfgCASError, which callers
+// already handle as a concurrent update.
+type CfgMetrics struct {
+	inner   Cfg
+	options CfgMetricsOptions
+
+	// OnUnreachable, when non-nil, is invoked once per outage when the
+	// Cfg has been failing for longer than the UnreachableThreshold.
+	// When nil, NewManager() sets it to emit a "cfgUnreachable"
+	// manager event.
+	OnUnreachable func(since time.Time, err error)
+
+	TotGet, TotGetErr             uint64
+	TotSet, TotSetErr, TotSetCAS  uint64
+	TotDel, TotDelErr             uint64
+	TotSubscribe, TotSubscribeErr uint64
+	TotRefresh, TotRefreshErr     uint64
+	TotRetry                      uint64
+	TotUnreachable                uint64
+
+	TimerGet     metrics.Timer
+	TimerSet     metrics.Timer
+	TimerDel     metrics.Timer
+	TimerRefresh metrics.Timer
+
+	m                sync.Mutex // Protects the fields that follow.
+	unreachableSince time.Time
+	unreachableSent  bool
+}
+
+// NewCfgMetrics returns a CfgMetrics that wraps the given Cfg, where
+// zero valued options fall back to the DefaultCfgMetricsOptions.
+func NewCfgMetrics(inner Cfg, options CfgMetricsOptions) *CfgMetrics {
+	if options.MaxRetries < 0 {
+		options.MaxRetries = 0
+	} else if options.MaxRetries == 0 {
+		options.MaxRetries = DefaultCfgMetricsOptions.MaxRetries
+	}
+	if options.BackoffStart <= 0 {
+		options.BackoffStart = DefaultCfgMetricsOptions.BackoffStart
+	}
+	if options.BackoffMax <= 0 {
+		options.BackoffMax = DefaultCfgMetricsOptions.BackoffMax
+	}
+	if options.UnreachableThreshold <= 0 {
+		options.UnreachableThreshold =
+			DefaultCfgMetricsOptions.UnreachableThreshold
+	}
+
+	return &CfgMetrics{
+		inner:        inner,
+		options:      options,
+		TimerGet:     metrics.NewTimer(),
+		TimerSet:     metrics.NewTimer(),
+		TimerDel:     metrics.NewTimer(),
+		TimerRefresh: metrics.NewTimer(),
+	}
+}
+
+// Inner returns the wrapped Cfg.
+func (c *CfgMetrics) Inner() Cfg {
+	return c.inner
+}
+
+func (c *CfgMetrics) Get(key string, cas uint64) (
+	val []byte, casSuccess uint64, err error) {
+	atomic.AddUint64(&c.TotGet, 1)
+	err = c.do(c.TimerGet, &c.TotGetErr, func() error {
+		val, casSuccess, err = c.inner.Get(key, cas)
+		return err
+	})
+	return val, casSuccess, err
+}
+
+func (c *CfgMetrics) Set(key string, val []byte, cas uint64) (
+	casSuccess uint64, err error) {
+	atomic.AddUint64(&c.TotSet, 1)
+	err = c.do(c.TimerSet, &c.TotSetErr, func() error {
+		casSuccess, err = c.inner.Set(key, val, cas)
+		return err
+	})
+	if _, ok := err.(*CfgCASError); ok {
+		atomic.AddUint64(&c.TotSetCAS, 1)
+	}
+	return casSuccess, err
+}
+
+func (c *CfgMetrics) Del(key string, cas uint64) error {
+	atomic.AddUint64(&c.TotDel, 1)
+	return c.do(c.TimerDel, &c.TotDelErr, func() error {
+		return c.inner.Del(key, cas)
+	})
+}
+
+func (c *CfgMetrics) Subscribe(key string, ch chan CfgEvent) error {
+	atomic.AddUint64(&c.TotSubscribe, 1)
+	return c.do(nil, &c.TotSubscribeErr, func() error {
+		return c.inner.Subscribe(key, ch)
+	})
+}
+
+func (c *CfgMetrics) Refresh() error {
+	atomic.AddUint64(&c.TotRefresh, 1)
+	return c.do(c.TimerRefresh, &c.TotRefreshErr, func() error {
+		return c.inner.Refresh()
+	})
+}
+
+// do invokes an operation, retrying transient failures, and updates
+// the metrics and the reachability of the Cfg.
+func (c *CfgMetrics) do(timer metrics.Timer, totErr *uint64,
+	op func() error) error {
+	backoff := c.options.BackoffStart
+
+	for tries := 0; ; tries++ {
+		startTime := time.Now()
+		err := op()
+		if timer != nil {
+			timer.UpdateSince(startTime)
+		}
+
+		if err == nil {
+			c.reachable()
+			return nil
+		}
+
+		if _, ok := err.(*CfgCASError); ok {
+			c.reachable() // A CAS mismatch means the Cfg responded.
+			return err
+		}
+
+		atomic.AddUint64(totErr, 1)
+
+		if tries >= c.options.MaxRetries {
+			c.unreachable(err)
+			return err
+		}
+
+		atomic.AddUint64(&c.TotRetry, 1)
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > c.options.BackoffMax {
+			backoff = c.options.BackoffMax
+		}
+	}
+}
+
+func (c *CfgMetrics) reachable() {
+	c.m.Lock()
+	c.unreachableSince = time.Time{}
+	c.unreachableSent = false
+	c.m.Unlock()
+}
+
+func (c *CfgMetrics) unreachable(err error) {
+	now := time.Now()
+
+	c.m.Lock()
+	if c.unreachableSince.IsZero() {
+		c.unreachableSince = now
+	}
+	since := c.unreachableSince
+	send := !c.unreachableSent &&
+		now.Sub(since) >= c.options.UnreachableThreshold
+	if send {
+		c.unreachableSent = true
+	}
+	onUnreachable := c.OnUnreachable
+	c.m.Unlock()
+
+	if send {
+		atomic.AddUint64(&c.TotUnreachable, 1)
+		if onUnreachable != nil {
+			onUnreachable(since, err)
+		}
+	}
+}
+
+// UnreachableSince returns when the Cfg started failing, or a zero
+// time if the Cfg is currently reachable.
+func (c *CfgMetrics) UnreachableSince() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.unreachableSince
+}
+
+// WriteJSON writes the metrics as JSON to a io.Writer.
+func (c *CfgMetrics) WriteJSON(w io.Writer) {
+	fmt.Fprintf(w, `{"TotGet":%d,"TotGetErr":%d`+
+		`,"TotSet":%d,"TotSetErr":%d,"TotSetCAS":%d`+
+		`,"TotDel":%d,"TotDelErr":%d`+
+		`,"TotSubscribe":%d,"TotSubscribeErr":%d`+
+		`,"TotRefresh":%d,"TotRefreshErr":%d`+
+		`,"TotRetry":%d,"TotUnreachable":%d`,
+		atomic.LoadUint64(&c.TotGet), atomic.LoadUint64(&c.TotGetErr),
+		atomic.LoadUint64(&c.TotSet), atomic.LoadUint64(&c.TotSetErr),
+		atomic.LoadUint64(&c.TotSetCAS),
+		atomic.LoadUint64(&c.TotDel), atomic.LoadUint64(&c.TotDelErr),
+		atomic.LoadUint64(&c.TotSubscribe),
+		atomic.LoadUint64(&c.TotSubscribeErr),
+		atomic.LoadUint64(&c.TotRefresh), atomic.LoadUint64(&c.TotRefreshErr),
+		atomic.LoadUint64(&c.TotRetry), atomic.LoadUint64(&c.TotUnreachable))
+
+	w.Write([]byte(`,"TimerGet":`))
+	WriteTimerJSON(w, c.TimerGet)
+	w.Write([]byte(`,"TimerSet":`))
+	WriteTimerJSON(w, c.TimerSet)
+	w.Write([]byte(`,"TimerDel":`))
+	WriteTimerJSON(w, c.TimerDel)
+	w.Write([]byte(`,"TimerRefresh":`))
+	WriteTimerJSON(w, c.TimerRefresh)
+
+	w.Write(JsonCloseBrace)
+}
+
+// ---------------------------------------------------------
+
+// cfgUnreachable emits a "cfgUnreachable" manager event.
+func (mgr *Manager) cfgUnreachable(since time.Time, err error) {
+	mgr.log.Warnf("cfg_metrics: cfg unreachable since: %v, err: %v",
+		since, err)
+
+	event, _ := json.Marshal(struct {
+		Event string `json:"event"`
+		Since string `json:"since"`
+		Err   string `json:"err"`
+		Time  string `json:"time"`
+	}{"cfgUnreachable", since.Format(time.RFC3339Nano), err.Error(),
+		time.Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+}
@@ -0,0 +1,102 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCfgMetricsRetry(t *testing.T) {
+	inner := &ErrorUntilCfg{inner: NewCfgMem(), errUntil: 3}
+	c := NewCfgMetrics(inner, CfgMetricsOptions{
+		MaxRetries:   2,
+		BackoffStart: time.Millisecond,
+	})
+
+	cas, err := c.Set("a", []byte("A"), 0)
+	if err != nil {
+		t.Fatalf("expected Set() to work after retries, err: %v", err)
+	}
+	if c.TotRetry != 2 || c.TotSetErr != 2 {
+		t.Errorf("expected 2 retries, got: %d, %d", c.TotRetry, c.TotSetErr)
+	}
+
+	_, err = c.Set("a", []byte("AA"), cas+100)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected CAS error, err: %v", err)
+	}
+	if c.TotRetry != 2 || c.TotSetCAS != 1 {
+		t.Errorf("expected no retry on CAS error, got: %d", c.TotRetry)
+	}
+
+	val, _, err := c.Get("a", 0)
+	if err != nil || string(val) != "A" {
+		t.Errorf("expected Get() to work, val: %s, err: %v", val, err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	c.WriteJSON(buf)
+	m := map[string]interface{}{}
+	if err = json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Errorf("expected JSON metrics, err: %v, %s", err, buf.Bytes())
+	}
+	if m["TotSet"].(float64) != 2 {
+		t.Errorf("expected TotSet 2, got: %v", m["TotSet"])
+	}
+}
+
+func TestCfgMetricsUnreachable(t *testing.T) {
+	c := NewCfgMetrics(&ErrorOnlyCfg{}, CfgMetricsOptions{
+		MaxRetries:           -1,
+		UnreachableThreshold: 20 * time.Millisecond,
+	})
+
+	var calls int
+	c.OnUnreachable = func(since time.Time, err error) {
+		calls++
+	}
+
+	c.Get("a", 0)
+	if calls != 0 || c.UnreachableSince().IsZero() {
+		t.Errorf("expected unreachable but below threshold")
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	c.Get("a", 0)
+	c.Get("a", 0)
+	if calls != 1 || c.TotUnreachable != 1 {
+		t.Errorf("expected 1 unreachable callback, got: %d", calls)
+	}
+
+	c.inner = NewCfgMem()
+	c.Get("a", 0)
+	if !c.UnreachableSince().IsZero() {
+		t.Errorf("expected reachable cfg")
+	}
+}
+
+func TestManagerCfgUnreachableEvent(t *testing.T) {
+	c := NewCfgMetrics(&ErrorOnlyCfg{}, CfgMetricsOptions{})
+	m := NewManager(Version, c, nil, NewUUID(), nil, "", 1, "", ":1000",
+		"", "some-datasource", nil, nil)
+	if c.OnUnreachable == nil {
+		t.Fatalf("expected manager to set OnUnreachable")
+	}
+
+	c.OnUnreachable(time.Now(), ErrNoIndexDefs)
+	if m.events.Len() != 1 {
+		t.Errorf("expected cfgUnreachable event, got: %d", m.events.Len())
+	}
+}
@@ -0,0 +1,234 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CFG_NAMESPACE_SEP separates a namespace from the keys within it, as
+// in "clusterA/indexDefs".
+const CFG_NAMESPACE_SEP = "/"
+
+var cfgNamespaceRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-]*$`)
+
+// ValidateCfgNamespace checks that a namespace is usable as a prefix
+// of the Cfg keys.
+func ValidateCfgNamespace(namespace string) error {
+	if !cfgNamespaceRE.MatchString(namespace) {
+		return fmt.Errorf("cfg_namespace: invalid namespace: %q,"+
+			" must match: %s", namespace, cfgNamespaceRE)
+	}
+	return nil
+}
+
+// CfgNamespaceKey returns the key of the backend Cfg for a key within
+// a namespace, where an empty namespace leaves the key unchanged.
+func CfgNamespaceKey(namespace, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return namespace + CFG_NAMESPACE_SEP + key
+}
+
+// CfgClusterKeys returns the keys that cbgt stores in the Cfg for a
+// cluster.  Applications that store their own keys in the Cfg need to
+// add them when moving a cluster into a namespace.
+func CfgClusterKeys() []string {
+	return []string{
+		versionKey,
+		INDEX_DEFS_KEY,
+		INDEX_DEFS_TRASH_KEY,
+		CfgNodeDefsKey(NODE_DEFS_KNOWN),
+		CfgNodeDefsKey(NODE_DEFS_WANTED),
+		CfgNodeDefsKey(NODE_DEFS_STANDBY),
+		PLAN_PINDEXES_KEY,
+		PINDEXES_RUNNING_KEY,
+		PINDEX_RATES_KEY,
+		MANAGER_CLUSTER_OPTIONS_KEY,
+		INDEX_BUILD_TARGETS_KEY,
+		FEED_RESTARTS_KEY,
+		OP_QUORUM_KEY,
+		REMOTE_CLUSTERS_KEY,
+		TASKS_KEY,
+		API_TOKENS_KEY,
+		AUDIT_SETTINGS_KEY,
+	}
+}
+
+// ---------------------------------------------------------
+
+// CfgNamespace wraps a Cfg so that all the keys are prefixed with a
+// namespace, which allows multiple independent cbgt clusters to share
+// one Cfg backend.  As the prefixing happens below the key helpers,
+// such as CfgNodeDefsKey(), the Manager and the rest of cbgt are
+// unaware of the namespace, and a subscriber's events carry the
+// un-prefixed keys.
+type CfgNamespace struct {
+	inner     Cfg
+	namespace string
+}
+
+// NewCfgNamespace returns a CfgNamespace that wraps the given Cfg.
+func NewCfgNamespace(inner Cfg, namespace string) (*CfgNamespace, error) {
+	err := ValidateCfgNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CfgNamespace{inner: inner, namespace: namespace}, nil
+}
+
+// Inner returns the wrapped Cfg.
+func (c *CfgNamespace) Inner() Cfg {
+	return c.inner
+}
+
+// Namespace returns the namespace of the keys.
+func (c *CfgNamespace) Namespace() string {
+	return c.namespace
+}
+
+func (c *CfgNamespace) Get(key string, cas uint64) ([]byte, uint64, error) {
+	return c.inner.Get(CfgNamespaceKey(c.namespace, key), cas)
+}
+
+func (c *CfgNamespace) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	return c.inner.Set(CfgNamespaceKey(c.namespace, key), val, cas)
+}
+
+func (c *CfgNamespace) Del(key string, cas uint64) error {
+	return c.inner.Del(CfgNamespaceKey(c.namespace, key), cas)
+}
+
+// Subscribe forwards the events of the prefixed key to the ch, with
+// the namespace stripped from the event's key.
+func (c *CfgNamespace) Subscribe(key string, ch chan CfgEvent) error {
+	innerCh := make(chan CfgEvent)
+
+	err := c.inner.Subscribe(CfgNamespaceKey(c.namespace, key), innerCh)
+	if err != nil {
+		return err
+	}
+
+	prefix := c.namespace + CFG_NAMESPACE_SEP
+
+	go func() {
+		for e := range innerCh {
+			e.Key = strings.TrimPrefix(e.Key, prefix)
+			ch <- e
+		}
+	}()
+
+	return nil
+}
+
+// Ping pings the namespaced key of the wrapped Cfg, whose heartbeats
+// are forwarded like any other event.
+func (c *CfgNamespace) Ping(key string) error {
+	return CfgPing(c.inner, CfgNamespaceKey(c.namespace, key))
+}
+
+func (c *CfgNamespace) Refresh() error {
+	return c.inner.Refresh()
+}
+
+// ---------------------------------------------------------
+
+// CfgMoveToNamespace moves the keys of an existing cluster, which are
+// not namespaced, into a namespace of the same Cfg, and returns the
+// keys that were moved.  A nil keys means the CfgClusterKeys().  The
+// cluster's nodes should be stopped during the move, and restarted
+// with the namespace afterwards.
+//
+// No key is written unless all the keys can be moved, so a key that
+// already exists in the namespace with a different value is an
+// error, while a key with the same value is skipped, so that an
+// interrupted move can be retried.  The original keys are deleted
+// only when deleteOld is true, where a CAS mismatch means that the
+// key was concurrently changed, such as by a node that's still
+// running.
+func CfgMoveToNamespace(cfg Cfg, namespace string, keys []string,
+	deleteOld bool) ([]string, error) {
+	err := ValidateCfgNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys == nil {
+		keys = CfgClusterKeys()
+	}
+
+	type move struct {
+		key    string
+		val    []byte
+		cas    uint64
+		exists bool // The key already exists in the namespace.
+	}
+
+	var moves []*move
+
+	for _, key := range keys {
+		val, cas, err := cfg.Get(key, 0)
+		if err != nil {
+			return nil, fmt.Errorf("cfg_namespace: get key: %s, err: %v",
+				key, err)
+		}
+		if val == nil {
+			continue
+		}
+
+		nsKey := CfgNamespaceKey(namespace, key)
+
+		nsVal, _, err := cfg.Get(nsKey, 0)
+		if err != nil {
+			return nil, fmt.Errorf("cfg_namespace: get key: %s, err: %v",
+				nsKey, err)
+		}
+		if nsVal != nil && !bytes.Equal(nsVal, val) {
+			return nil, fmt.Errorf("cfg_namespace: key: %s already exists"+
+				" in the namespace with a different value", nsKey)
+		}
+
+		moves = append(moves, &move{key, val, cas, nsVal != nil})
+	}
+
+	rv := make([]string, 0, len(moves))
+
+	for _, m := range moves {
+		if !m.exists {
+			_, err = cfg.Set(CfgNamespaceKey(namespace, m.key), m.val, 0)
+			if err != nil {
+				return rv, fmt.Errorf("cfg_namespace: set key: %s, err: %v",
+					CfgNamespaceKey(namespace, m.key), err)
+			}
+		}
+
+		rv = append(rv, m.key)
+	}
+
+	if deleteOld {
+		for _, m := range moves {
+			err = cfg.Del(m.key, m.cas)
+			if err != nil {
+				return rv, fmt.Errorf("cfg_namespace: del key: %s, err: %v",
+					m.key, err)
+			}
+		}
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,152 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCfgNamespace(t *testing.T) {
+	for _, ns := range []string{"", "a/b", "-a", "a b"} {
+		if _, err := NewCfgNamespace(NewCfgMem(), ns); err == nil {
+			t.Errorf("expected an invalid namespace: %q", ns)
+		}
+	}
+
+	inner := NewCfgMem()
+	a, _ := NewCfgNamespace(inner, "a")
+	b, _ := NewCfgNamespace(inner, "b")
+
+	ch := make(chan CfgEvent, 10)
+	if err := a.Subscribe(INDEX_DEFS_KEY, ch); err != nil {
+		t.Fatalf("expected Subscribe() to work, err: %v", err)
+	}
+
+	if _, err := a.Set(INDEX_DEFS_KEY, []byte("A"), 0); err != nil {
+		t.Errorf("expected Set() to work, err: %v", err)
+	}
+	if _, err := b.Set(INDEX_DEFS_KEY, []byte("B"), 0); err != nil {
+		t.Errorf("expected an independent Set(), err: %v", err)
+	}
+
+	if e := <-ch; e.Key != INDEX_DEFS_KEY || e.CAS == 0 {
+		t.Errorf("expected an un-prefixed event, got: %#v", e)
+	}
+
+	if v, _, _ := a.Get(INDEX_DEFS_KEY, 0); string(v) != "A" {
+		t.Errorf("expected A, got: %s", v)
+	}
+	if v, _, _ := inner.Get("b/"+INDEX_DEFS_KEY, 0); string(v) != "B" {
+		t.Errorf("expected a prefixed key in the inner cfg, got: %s", v)
+	}
+	if v, _, _ := inner.Get(INDEX_DEFS_KEY, 0); v != nil {
+		t.Errorf("expected no un-prefixed key, got: %s", v)
+	}
+}
+
+func TestCfgNamespaceManagers(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	inner := NewCfgMem()
+
+	var mgrs []*Manager
+	for _, ns := range []string{"x", "y"} {
+		cfg, _ := NewCfgNamespace(inner, ns)
+		m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "",
+			":1000", emptyDir, "some-datasource", nil, nil)
+		if err := m.Register("wanted"); err != nil {
+			t.Fatalf("expected Register() to work, err: %v", err)
+		}
+		mgrs = append(mgrs, m)
+	}
+
+	for i, m := range mgrs {
+		nodeDefs, _, err := CfgGetNodeDefs(m.Cfg(), NODE_DEFS_WANTED)
+		if err != nil || nodeDefs == nil || len(nodeDefs.NodeDefs) != 1 ||
+			nodeDefs.NodeDefs[m.UUID()] == nil {
+			t.Errorf("expected only the node of its own namespace, i: %d,"+
+				" nodeDefs: %#v, err: %v", i, nodeDefs, err)
+		}
+	}
+}
+
+func TestCfgMoveToNamespace(t *testing.T) {
+	cfg := NewCfgMem()
+	cfg.Set(INDEX_DEFS_KEY, []byte("I"), 0)
+	cfg.Set(CfgNodeDefsKey(NODE_DEFS_WANTED), []byte("N"), 0)
+	cfg.Set("appKey", []byte("X"), 0)
+
+	// A conflicting key in the namespace fails the move, before any
+	// key is written.
+	cfg.Set("ns/appKey", []byte("Y"), 0)
+	_, err := CfgMoveToNamespace(cfg, "ns",
+		append(CfgClusterKeys(), "appKey"), true)
+	if err == nil {
+		t.Errorf("expected a conflict")
+	}
+	if v, _, _ := cfg.Get("ns/"+INDEX_DEFS_KEY, 0); v != nil {
+		t.Errorf("expected no partial move, got: %s", v)
+	}
+
+	moved, err := CfgMoveToNamespace(cfg, "ns", nil, false)
+	exp := []string{INDEX_DEFS_KEY, CfgNodeDefsKey(NODE_DEFS_WANTED)}
+	if err != nil || !reflect.DeepEqual(moved, exp) {
+		t.Errorf("expected: %v, got: %v, err: %v", exp, moved, err)
+	}
+
+	// A retried move skips the moved keys, and deletes the originals.
+	moved, err = CfgMoveToNamespace(cfg, "ns", nil, true)
+	if err != nil || !reflect.DeepEqual(moved, exp) {
+		t.Errorf("expected: %v, got: %v, err: %v", exp, moved, err)
+	}
+
+	nsCfg, _ := NewCfgNamespace(cfg, "ns")
+	if v, _, _ := nsCfg.Get(INDEX_DEFS_KEY, 0); string(v) != "I" {
+		t.Errorf("expected a moved key, got: %s", v)
+	}
+	if v, _, _ := cfg.Get(INDEX_DEFS_KEY, 0); v != nil {
+		t.Errorf("expected a deleted key, got: %s", v)
+	}
+	if v, _, _ := cfg.Get("appKey", 0); string(v) != "X" {
+		t.Errorf("expected an unmoved application key, got: %s", v)
+	}
+}
+
+func TestCfgNamespacePing(t *testing.T) {
+	cfgNamespace, err := NewCfgNamespace(NewCfgMem(), "c1")
+	if err != nil {
+		t.Fatalf("expected NewCfgNamespace() to work, err: %v", err)
+	}
+	cfg := NewCfgMetrics(cfgNamespace, CfgMetricsOptions{})
+
+	ch := make(chan CfgEvent, 1)
+	err = cfg.Subscribe("a", ch)
+	if err != nil {
+		t.Fatalf("expected Subscribe() to work, err: %v", err)
+	}
+
+	err = CfgPing(cfg, "a")
+	if err != nil {
+		t.Fatalf("expected CfgPing() to work, err: %v", err)
+	}
+	if e := <-ch; e.Key != "a" || !e.Heartbeat {
+		t.Errorf("expected a heartbeat for a, got: %#v", e)
+	}
+
+	if CfgPing(&ErrorOnlyCfg{}, "a") != ErrCfgPingUnsupported {
+		t.Errorf("expected ErrCfgPingUnsupported")
+	}
+}
@@ -0,0 +1,62 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrCfgReadOnly is returned by the mutations of a CfgReadOnly.
+var ErrCfgReadOnly = errors.New("cfg_read_only: the cfg is read-only")
+
+// CfgReadOnly wraps a Cfg so that all the Set() and Del() operations
+// are rejected with ErrCfgReadOnly, so that inspection tools can
+// never accidentally mutate a cluster's state.
+type CfgReadOnly struct {
+	inner Cfg
+
+	TotRejected uint64
+}
+
+// NewCfgReadOnly returns a CfgReadOnly that wraps the given Cfg.
+func NewCfgReadOnly(inner Cfg) *CfgReadOnly {
+	return &CfgReadOnly{inner: inner}
+}
+
+// Inner returns the wrapped Cfg.
+func (c *CfgReadOnly) Inner() Cfg {
+	return c.inner
+}
+
+func (c *CfgReadOnly) Get(key string, cas uint64) ([]byte, uint64, error) {
+	return c.inner.Get(key, cas)
+}
+
+func (c *CfgReadOnly) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	atomic.AddUint64(&c.TotRejected, 1)
+	return 0, ErrCfgReadOnly
+}
+
+func (c *CfgReadOnly) Del(key string, cas uint64) error {
+	atomic.AddUint64(&c.TotRejected, 1)
+	return ErrCfgReadOnly
+}
+
+func (c *CfgReadOnly) Subscribe(key string, ch chan CfgEvent) error {
+	return c.inner.Subscribe(key, ch)
+}
+
+func (c *CfgReadOnly) Refresh() error {
+	return c.inner.Refresh()
+}
@@ -0,0 +1,45 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"testing"
+)
+
+func TestCfgReadOnly(t *testing.T) {
+	inner := NewCfgMem()
+	inner.Set(INDEX_DEFS_KEY, []byte("I"), 0)
+
+	c := NewCfgReadOnly(inner)
+
+	if v, cas, err := c.Get(INDEX_DEFS_KEY, 0); err != nil ||
+		string(v) != "I" || cas == 0 {
+		t.Errorf("expected Get() to work, v: %s, err: %v", v, err)
+	}
+
+	if _, err := c.Set(INDEX_DEFS_KEY, []byte("X"), CFG_CAS_FORCE); err != ErrCfgReadOnly {
+		t.Errorf("expected a rejected Set(), err: %v", err)
+	}
+	if err := c.Del(INDEX_DEFS_KEY, 0); err != ErrCfgReadOnly {
+		t.Errorf("expected a rejected Del(), err: %v", err)
+	}
+	if _, err := CfgSetIndexDefs(c, NewIndexDefs(Version), 0); err == nil {
+		t.Errorf("expected a rejected CfgSetIndexDefs()")
+	}
+
+	if v, _, _ := inner.Get(INDEX_DEFS_KEY, 0); string(v) != "I" {
+		t.Errorf("expected an unchanged cfg, got: %s", v)
+	}
+	if c.TotRejected != 3 {
+		t.Errorf("expected 3 rejections, got: %d", c.TotRejected)
+	}
+}
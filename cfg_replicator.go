@@ -0,0 +1,317 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_PLAN_REPLICATOR_INTERVAL is how often a PlanReplicator
+// re-syncs, in addition to syncing on the source Cfg's events.
+const DEFAULT_PLAN_REPLICATOR_INTERVAL = time.Minute
+
+// PlanReplicatorOptions configures a PlanReplicator.
+type PlanReplicatorOptions struct {
+	// ReplicatePlans, when true, also mirrors the source's plan, but
+	// only while it's stable.  See IsStablePlan().
+	ReplicatePlans bool
+
+	// TransformIndexDef, when non-nil, adjusts a copy of each index
+	// definition before it's written to the standby, such as to
+	// rewrite the source addresses in its SourceParams.  Returning a
+	// nil IndexDef skips the index.
+	TransformIndexDef func(indexDef *IndexDef) (*IndexDef, error)
+
+	// TransformPlanPIndexes, when non-nil, adjusts a copy of the
+	// source's plan before it's written to the standby, such as to
+	// map the node UUIDs of the primary cluster to the standby's.
+	TransformPlanPIndexes func(planPIndexes *PlanPIndexes) (
+		*PlanPIndexes, error)
+
+	// Interval is how often to re-sync, where 0 means the
+	// DEFAULT_PLAN_REPLICATOR_INTERVAL.
+	Interval time.Duration
+}
+
+// A PlanReplicator mirrors the index definitions, and optionally the
+// stable plans, from a primary cluster's Cfg to a standby cluster's
+// Cfg, so that a disaster-recovery cluster can be kept definition
+// synchronized and be activated quickly.  The standby's index
+// definitions are owned by the replicator, so any index that's
+// defined only on the standby is removed on the next sync.
+type PlanReplicator struct {
+	src     Cfg
+	dst     Cfg
+	log     Log
+	options PlanReplicatorOptions
+
+	hub    *CfgEventHub
+	kickCh chan struct{}
+	stopCh chan struct{}
+
+	TotSync          uint64
+	TotSyncErr       uint64
+	TotIndexDefsSet  uint64
+	TotPlanSet       uint64
+	TotPlanUnstable  uint64
+	TotIndexDefsSkip uint64 // Skipped by the TransformIndexDef.
+
+	m       sync.Mutex // Protects the fields that follow.
+	started bool
+	stopped bool
+	lastErr error
+}
+
+// NewPlanReplicator returns a PlanReplicator from the src to the dst
+// Cfg, which needs to be started.
+func NewPlanReplicator(src, dst Cfg, log Log,
+	options PlanReplicatorOptions) *PlanReplicator {
+	if options.Interval <= 0 {
+		options.Interval = DEFAULT_PLAN_REPLICATOR_INTERVAL
+	}
+
+	return &PlanReplicator{
+		src:     src,
+		dst:     dst,
+		log:     log,
+		options: options,
+		hub:     NewCfgEventHub(src),
+		kickCh:  make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// Start subscribes to the source Cfg and starts syncing in the
+// background, beginning with an immediate sync.
+func (r *PlanReplicator) Start() error {
+	r.m.Lock()
+	if r.started {
+		r.m.Unlock()
+		return fmt.Errorf("cfg_replicator: already started")
+	}
+	r.started = true
+	r.m.Unlock()
+
+	keys := []string{INDEX_DEFS_KEY}
+	if r.options.ReplicatePlans {
+		keys = append(keys, PLAN_PINDEXES_KEY)
+	}
+
+	_, err := r.hub.Subscribe(keys, func(e CfgEvent) { r.Kick() })
+	if err != nil {
+		return err
+	}
+
+	go r.run()
+
+	r.Kick()
+
+	return nil
+}
+
+// Stop stops the replicator.
+func (r *PlanReplicator) Stop() {
+	r.m.Lock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.stopCh)
+		r.hub.Stop()
+	}
+	r.m.Unlock()
+}
+
+// Kick asks for an asynchronous sync.
+func (r *PlanReplicator) Kick() {
+	select {
+	case r.kickCh <- struct{}{}:
+	default: // A sync is already pending.
+	}
+}
+
+// LastErr returns the error of the last sync, or nil.
+func (r *PlanReplicator) LastErr() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.lastErr
+}
+
+func (r *PlanReplicator) run() {
+	ticker := time.NewTicker(r.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+		case <-r.kickCh:
+		}
+
+		err := r.SyncOnce()
+		if err != nil {
+			r.log.Warnf("cfg_replicator: sync, err: %v", err)
+		}
+	}
+}
+
+// SyncOnce mirrors the source's index definitions, and optionally its
+// stable plan, to the standby.  Unchanged keys aren't written.
+func (r *PlanReplicator) SyncOnce() error {
+	atomic.AddUint64(&r.TotSync, 1)
+
+	err := r.syncIndexDefs()
+	if err == nil && r.options.ReplicatePlans {
+		err = r.syncPlanPIndexes()
+	}
+
+	if err != nil {
+		atomic.AddUint64(&r.TotSyncErr, 1)
+	}
+
+	r.m.Lock()
+	r.lastErr = err
+	r.m.Unlock()
+
+	return err
+}
+
+func (r *PlanReplicator) syncIndexDefs() error {
+	srcIndexDefs, _, err := CfgGetIndexDefs(r.src)
+	if err != nil {
+		return fmt.Errorf("cfg_replicator: get src indexDefs, err: %v", err)
+	}
+
+	dstIndexDefs, dstCAS, err := CfgGetIndexDefs(r.dst)
+	if err != nil {
+		return fmt.Errorf("cfg_replicator: get dst indexDefs, err: %v", err)
+	}
+
+	if srcIndexDefs == nil {
+		if dstIndexDefs == nil || len(dstIndexDefs.IndexDefs) <= 0 {
+			return nil
+		}
+		srcIndexDefs = NewIndexDefs(dstIndexDefs.ImplVersion)
+	}
+
+	indexDefs := NewIndexDefs(srcIndexDefs.ImplVersion)
+
+	for name, srcIndexDef := range srcIndexDefs.IndexDefs {
+		indexDef := &IndexDef{}
+		err = replicatorCopy(srcIndexDef, indexDef)
+		if err != nil {
+			return err
+		}
+
+		if r.options.TransformIndexDef != nil {
+			indexDef, err = r.options.TransformIndexDef(indexDef)
+			if err != nil {
+				return fmt.Errorf("cfg_replicator: transform,"+
+					" indexName: %s, err: %v", name, err)
+			}
+			if indexDef == nil {
+				atomic.AddUint64(&r.TotIndexDefsSkip, 1)
+				continue
+			}
+		}
+
+		indexDefs.IndexDefs[name] = indexDef
+	}
+
+	if dstIndexDefs != nil &&
+		reflect.DeepEqual(dstIndexDefs.IndexDefs, indexDefs.IndexDefs) {
+		return nil
+	}
+
+	_, err = CfgSetIndexDefs(r.dst, indexDefs, dstCAS)
+	if err != nil {
+		return fmt.Errorf("cfg_replicator: set dst indexDefs, err: %v", err)
+	}
+
+	atomic.AddUint64(&r.TotIndexDefsSet, 1)
+
+	r.log.Printf("cfg_replicator: indexDefs replicated, indexes: %d",
+		len(indexDefs.IndexDefs))
+
+	return nil
+}
+
+func (r *PlanReplicator) syncPlanPIndexes() error {
+	srcPlanPIndexes, _, err := CfgGetPlanPIndexes(r.src)
+	if err != nil {
+		return fmt.Errorf("cfg_replicator: get src plan, err: %v", err)
+	}
+	if srcPlanPIndexes == nil {
+		return nil
+	}
+
+	if !IsStablePlan(srcPlanPIndexes) {
+		atomic.AddUint64(&r.TotPlanUnstable, 1)
+		return nil // Wait for the source's plan to settle.
+	}
+
+	planPIndexes := &PlanPIndexes{}
+	err = replicatorCopy(srcPlanPIndexes, planPIndexes)
+	if err != nil {
+		return err
+	}
+
+	if r.options.TransformPlanPIndexes != nil {
+		planPIndexes, err = r.options.TransformPlanPIndexes(planPIndexes)
+		if err != nil {
+			return fmt.Errorf("cfg_replicator: transform plan, err: %v", err)
+		}
+		if planPIndexes == nil {
+			return nil
+		}
+	}
+
+	dstPlanPIndexes, dstCAS, err := CfgGetPlanPIndexes(r.dst)
+	if err != nil {
+		return fmt.Errorf("cfg_replicator: get dst plan, err: %v", err)
+	}
+
+	if dstPlanPIndexes != nil &&
+		SamePlanPIndexes(dstPlanPIndexes, planPIndexes) {
+		return nil
+	}
+
+	_, err = CfgSetPlanPIndexes(r.dst, planPIndexes, dstCAS)
+	if err != nil {
+		return fmt.Errorf("cfg_replicator: set dst plan, err: %v", err)
+	}
+
+	atomic.AddUint64(&r.TotPlanSet, 1)
+
+	r.log.Printf("cfg_replicator: plan replicated, uuid: %s",
+		planPIndexes.UUID)
+
+	return nil
+}
+
+// replicatorCopy deep copies via JSON, so that the transforms can't
+// affect the source.
+func replicatorCopy(src, dst interface{}) error {
+	buf, err := json.Marshal(src)
+	if err != nil {
+		return fmt.Errorf("cfg_replicator: json marshal, err: %v", err)
+	}
+	err = json.Unmarshal(buf, dst)
+	if err != nil {
+		return fmt.Errorf("cfg_replicator: json unmarshal, err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlanReplicatorSyncOnce(t *testing.T) {
+	src, dst := NewCfgMem(), NewCfgMem()
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["a"] = &IndexDef{Name: "a", UUID: "aa",
+		SourceParams: `{"server":"primary:8091"}`}
+	indexDefs.IndexDefs["skip"] = &IndexDef{Name: "skip", UUID: "ss"}
+	srcCAS, err := CfgSetIndexDefs(src, indexDefs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planPIndexes := NewPlanPIndexes(Version)
+	planPIndexes.PlanPIndexes["a_0"] = &PlanPIndex{Name: "a_0",
+		IndexName: "a", IndexUUID: "aa",
+		Nodes: map[string]*PlanPIndexNode{"n0": {CanRead: true}}}
+	if _, err = CfgSetPlanPIndexes(src, planPIndexes, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewPlanReplicator(src, dst, NewStdLibLog(ioutil.Discard, "", 0),
+		PlanReplicatorOptions{
+			ReplicatePlans: true,
+			TransformIndexDef: func(indexDef *IndexDef) (*IndexDef, error) {
+				if indexDef.Name == "skip" {
+					return nil, nil
+				}
+				indexDef.SourceParams = strings.Replace(indexDef.SourceParams,
+					"primary:8091", "standby:8091", -1)
+				return indexDef, nil
+			},
+		})
+
+	for i := 0; i < 2; i++ {
+		if err = r.SyncOnce(); err != nil {
+			t.Fatalf("expected SyncOnce() to work, err: %v", err)
+		}
+	}
+	if r.TotIndexDefsSet != 1 || r.TotPlanSet != 1 {
+		t.Errorf("expected one write per key, got: %d, %d",
+			r.TotIndexDefsSet, r.TotPlanSet)
+	}
+
+	dstIndexDefs, _, err := CfgGetIndexDefs(dst)
+	if err != nil || dstIndexDefs == nil ||
+		len(dstIndexDefs.IndexDefs) != 1 ||
+		dstIndexDefs.IndexDefs["a"].SourceParams != `{"server":"standby:8091"}` {
+		t.Errorf("expected transformed indexDefs, got: %#v, err: %v",
+			dstIndexDefs, err)
+	}
+	if indexDefs.IndexDefs["a"].SourceParams != `{"server":"primary:8091"}` {
+		t.Errorf("expected the source to be untouched")
+	}
+
+	dstPlanPIndexes, _, err := CfgGetPlanPIndexes(dst)
+	if err != nil || dstPlanPIndexes == nil ||
+		!SamePlanPIndexes(dstPlanPIndexes, planPIndexes) {
+		t.Errorf("expected replicated plan, got: %#v, err: %v",
+			dstPlanPIndexes, err)
+	}
+
+	// A deleted index is removed from the standby.
+	delete(indexDefs.IndexDefs, "a")
+	if _, err = CfgSetIndexDefs(src, indexDefs, srcCAS); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.SyncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	dstIndexDefs, _, _ = CfgGetIndexDefs(dst)
+	if dstIndexDefs == nil || len(dstIndexDefs.IndexDefs) != 0 {
+		t.Errorf("expected no indexDefs on the standby, got: %#v",
+			dstIndexDefs)
+	}
+}
+
+func TestPlanReplicatorStart(t *testing.T) {
+	src, dst := NewCfgMem(), NewCfgMem()
+
+	r := NewPlanReplicator(src, dst, NewStdLibLog(ioutil.Discard, "", 0),
+		PlanReplicatorOptions{})
+	if err := r.Start(); err != nil {
+		t.Fatalf("expected Start() to work, err: %v", err)
+	}
+	defer r.Stop()
+
+	if err := r.Start(); err == nil {
+		t.Errorf("expected err on a second Start()")
+	}
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["a"] = &IndexDef{Name: "a", UUID: "aa"}
+	if _, err := CfgSetIndexDefs(src, indexDefs, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&r.TotIndexDefsSet) < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the indexDefs to be replicated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dstIndexDefs, _, err := CfgGetIndexDefs(dst)
+	if err != nil || dstIndexDefs == nil || dstIndexDefs.IndexDefs["a"] == nil {
+		t.Errorf("expected replicated indexDefs, got: %#v, err: %v",
+			dstIndexDefs, err)
+	}
+}
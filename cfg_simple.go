@@ -109,6 +109,13 @@ func (c *CfgSimple) Subscribe(key string, ch chan CfgEvent) error {
 	return c.cfgMem.Subscribe(key, ch)
 }
 
+func (c *CfgSimple) Ping(key string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.cfgMem.Ping(key)
+}
+
 func (c *CfgSimple) Refresh() error {
 	c.m.Lock()
 	defer c.m.Unlock()
@@ -0,0 +1,125 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The UUID generator and clock are pluggable, so that tests of the
+// planning, pindex and rebalance code can be deterministic.  The
+// clock is used for the times that are recorded or compared, such as
+// in events, the Cfg and ages; timeouts and sleeps stay on the real
+// clock, so that an overridden clock can't hang a process.
+
+var uuidGenerator atomic.Value // Holds a func() string.
+
+var clock atomic.Value // Holds a func() time.Time.
+
+func init() {
+	uuidGenerator.Store(newRandomUUID)
+	clock.Store(time.Now)
+}
+
+// SetUUIDGenerator overrides the generator that NewUUID uses, returning
+// a func that restores the previous generator.
+func SetUUIDGenerator(g func() string) (restore func()) {
+	prev := uuidGenerator.Load().(func() string)
+	uuidGenerator.Store(g)
+	return func() { uuidGenerator.Store(prev) }
+}
+
+// SetClock overrides the clock that Now uses, returning a func that
+// restores the previous clock.
+func SetClock(c func() time.Time) (restore func()) {
+	prev := clock.Load().(func() time.Time)
+	clock.Store(c)
+	return func() { clock.Store(prev) }
+}
+
+// Now returns the current time of the clock, which is time.Now unless
+// overridden by SetClock.
+func Now() time.Time {
+	return clock.Load().(func() time.Time)()
+}
+
+// NewSeqUUIDGenerator returns a UUID generator for SetUUIDGenerator
+// whose UUIDs are the prefix followed by a sequence number, such as
+// "test0000000000001", for deterministic and readable plans.
+func NewSeqUUIDGenerator(prefix string) func() string {
+	var seq uint64
+	return func() string {
+		return fmt.Sprintf("%s%013x", prefix, atomic.AddUint64(&seq, 1))
+	}
+}
+
+// ---------------------------------------------------------
+
+// A ManualClock is a clock for SetClock that only moves when told.
+type ManualClock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a ManualClock that starts at the given time.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the ManualClock's current time.
+func (c *ManualClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+// Advance moves the ManualClock forwards by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.m.Lock()
+	c.now = c.now.Add(d)
+	c.m.Unlock()
+}
+
+// ---------------------------------------------------------
+
+// NextHybridTime returns the clock's current time as a count of units
+// since the epoch, such as milliseconds, unless that's not after the
+// prev, when prev+1 is returned instead.  A sequence of hybrid times
+// is strictly increasing, so it orders its events even when the clock
+// steps backwards or stalls, while otherwise following the clock.
+func NextHybridTime(prev int64, unit time.Duration) int64 {
+	t := Now().UnixNano() / int64(unit)
+	if t <= prev {
+		return prev + 1
+	}
+	return t
+}
+
+// A HybridClock issues strictly increasing hybrid times, in
+// nanoseconds, and is safe for concurrent use.  See NextHybridTime().
+type HybridClock struct {
+	last int64
+}
+
+// Next returns the next hybrid time of the HybridClock.
+func (c *HybridClock) Next() int64 {
+	for {
+		prev := atomic.LoadInt64(&c.last)
+		next := NextHybridTime(prev, time.Nanosecond)
+		if atomic.CompareAndSwapInt64(&c.last, prev, next) {
+			return next
+		}
+	}
+}
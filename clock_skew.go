@@ -0,0 +1,292 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_CLOCK_SKEW_MAX is the clock skew to another node above
+// which a manager reports its clock as skewed, which may be
+// overridden by the "clockSkewMax" manager option.
+const DEFAULT_CLOCK_SKEW_MAX = 5 * time.Second
+
+// CLOCK_STEP_MIN is the smallest jump of the wall clock, relative to
+// the monotonic clock, that's reported as a step of the clock.
+const CLOCK_STEP_MIN = time.Second
+
+// CLOCK_SKEW_TIMEOUT bounds the requests that measure the clock skew
+// to the other nodes.
+const CLOCK_SKEW_TIMEOUT = 5 * time.Second
+
+// CLOCK_SKEW_CONCURRENCY is the max number of the concurrent requests
+// of a clock check.
+const CLOCK_SKEW_CONCURRENCY = 16
+
+// CLOCK_SKEW_CHECK_TIMEOUT bounds a whole clock check, where the nodes
+// that weren't measured in time are listed as unreachable.
+var CLOCK_SKEW_CHECK_TIMEOUT = 10 * time.Second
+
+// A NodeClockSkew is how far the clock of another node is ahead of
+// the local clock, as measured from the Date header of its HTTP
+// response, which has a resolution of a second.
+type NodeClockSkew struct {
+	UUID     string `json:"uuid"`
+	HostPort string `json:"hostPort"`
+	Skew     string `json:"skew,omitempty"`
+	Err      string `json:"err,omitempty"`
+}
+
+// A ClockSkewStatus is the outcome of the last clock check of a
+// manager.  The times that nodes write, such as in events, tasks and
+// the Cfg, are only comparable across nodes when it's not Skewed.
+type ClockSkewStatus struct {
+	Time    string           `json:"time"`
+	MaxSkew string           `json:"maxSkew"`
+	Nodes   []*NodeClockSkew `json:"nodes"`
+	Skewed  bool             `json:"skewed"`
+
+	// The last step of the local clock, if any, such as "-1m30s".
+	LastStep     string `json:"lastStep,omitempty"`
+	LastStepTime string `json:"lastStepTime,omitempty"`
+}
+
+// clockStep returns how far the wall clock jumped between two
+// readings of time.Now(), relative to their monotonic clock readings,
+// and is a var for testing.
+var clockStep = func(prev, now time.Time) time.Duration {
+	return now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
+}
+
+// httpClockSkew returns how far the clock of a node is ahead of the
+// local clock, from the Date header of any response, even an error
+// response, of the node's HTTP server to a GET of the path, compared
+// to the midpoint of the request.
+func httpClockSkew(ctx context.Context, client *http.Client,
+	hostPort, path string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		HostPortURL("http", hostPort)+path, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	t0 := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	t1 := time.Now()
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no date header, err: %v", err)
+	}
+
+	mid := t0.Add(t1.Sub(t0) / 2)
+
+	return date.Sub(mid).Round(time.Second), nil
+}
+
+// calcClockSkews concurrently measures the clock skew to each node of
+// the nodeDefs, other than the selfUUID, until the ctx is done, and
+// also returns the number of the nodes that are unreachable, and of
+// those whose skew is above the maxSkew.
+func calcClockSkews(ctx context.Context, client *http.Client,
+	nodeDefs *NodeDefs, selfUUID, path string, maxSkew time.Duration) (
+	skews []*NodeClockSkew, unreachable, skewed int) {
+	skews = []*NodeClockSkew{}
+
+	var wg sync.WaitGroup
+	sema := make(chan struct{}, CLOCK_SKEW_CONCURRENCY)
+
+	for _, nodeUUID := range sortedNodeUUIDs(nodeDefs) {
+		if nodeUUID == selfUUID {
+			continue
+		}
+		nodeDef := nodeDefs.NodeDefs[nodeUUID]
+
+		s := &NodeClockSkew{UUID: nodeUUID, HostPort: nodeDef.HostPort}
+		skews = append(skews, s)
+
+		select {
+		case sema <- struct{}{}:
+		case <-ctx.Done():
+			s.Err = ctx.Err().Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() { <-sema; wg.Done() }()
+
+			skew, err := httpClockSkew(ctx, client, s.HostPort, path)
+			if err != nil {
+				s.Err = err.Error()
+				return
+			}
+			s.Skew = skew.String()
+		}()
+	}
+
+	wg.Wait()
+
+	for _, s := range skews {
+		if s.Err != "" {
+			unreachable++
+			continue
+		}
+		skew, _ := time.ParseDuration(s.Skew)
+		if skew > maxSkew || skew < -maxSkew {
+			skewed++
+		}
+	}
+
+	return skews, unreachable, skewed
+}
+
+// ---------------------------------------------------------
+
+// ClockSkewLoop periodically checks the local clock for steps, and
+// against the clocks of the other known nodes, see
+// checkClockSkewOnce().  As the clocks of the other nodes are read
+// from the responses of their HTTP servers, which are owned by the
+// application, the checks are off unless the application sets the
+// "clockSkewCheckInterval" manager option, such as to "1m".  The
+// "clockSkewPath" manager option is the path that's requested from
+// the other nodes, which defaults to "/".
+func (mgr *Manager) ClockSkewLoop() {
+	interval, err := time.ParseDuration(
+		mgr.Options()["clockSkewCheckInterval"])
+	if err != nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			mgr.checkClockSkewOnce(time.Now())
+		}
+	}
+}
+
+// ClockSkew returns the outcome of the last clock check, or nil.
+func (mgr *Manager) ClockSkew() *ClockSkewStatus {
+	mgr.clockSkewMutex.Lock()
+	defer mgr.clockSkewMutex.Unlock()
+
+	if mgr.clockSkew == nil {
+		return nil
+	}
+	rv := *mgr.clockSkew
+	return &rv
+}
+
+// checkClockSkewOnce reports a step of the local clock since the
+// previous check as a "clockStepped" event, and measures the clock
+// skew to the other known nodes, where the transitions into and out
+// of a skew that's above the max are reported as "clockSkewed" and
+// "clockSkewRecovered" events.  An unreachable node is listed, but
+// doesn't count as skewed.  The now must be a reading of time.Now().
+func (mgr *Manager) checkClockSkewOnce(now time.Time) {
+	maxSkew := DEFAULT_CLOCK_SKEW_MAX
+	if v, err := time.ParseDuration(
+		mgr.Options()["clockSkewMax"]); err == nil && v > 0 {
+		maxSkew = v
+	}
+
+	atomic.AddUint64(&mgr.stats.TotClockSkewCheck, 1)
+
+	path := mgr.Options()["clockSkewPath"]
+	if path == "" {
+		path = "/"
+	}
+
+	nodeDefs, _ := mgr.GetNodeDefs(NODE_DEFS_KNOWN, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		CLOCK_SKEW_CHECK_TIMEOUT)
+	skews, _, numSkewed := calcClockSkews(ctx, mgr.clockSkewClient,
+		nodeDefs, mgr.uuid, path, maxSkew)
+	cancel()
+	skewed := numSkewed > 0
+
+	mgr.clockSkewMutex.Lock()
+	prevCheck := mgr.clockSkewCheck
+	mgr.clockSkewCheck = now
+
+	prev := mgr.clockSkew
+	curr := &ClockSkewStatus{
+		Time:    now.Format(time.RFC3339Nano),
+		MaxSkew: maxSkew.String(),
+		Nodes:   skews,
+		Skewed:  skewed,
+	}
+	if prev != nil {
+		curr.LastStep, curr.LastStepTime = prev.LastStep, prev.LastStepTime
+	}
+
+	var step time.Duration
+	if !prevCheck.IsZero() {
+		step = clockStep(prevCheck, now)
+		if step < CLOCK_STEP_MIN && step > -CLOCK_STEP_MIN {
+			step = 0
+		}
+	}
+	if step != 0 {
+		curr.LastStep = step.String()
+		curr.LastStepTime = curr.Time
+	}
+
+	mgr.clockSkew = curr
+	mgr.clockSkewMutex.Unlock()
+
+	if step != 0 {
+		atomic.AddUint64(&mgr.stats.TotClockStep, 1)
+		mgr.log.Warnf("clock_skew: the clock stepped by: %s", step)
+		mgr.addClockSkewEvent("clockStepped", curr)
+	}
+
+	if skewed && (prev == nil || !prev.Skewed) {
+		atomic.AddUint64(&mgr.stats.TotClockSkewed, 1)
+		mgr.log.Warnf("clock_skew: the clock is skewed above: %s,"+
+			" nodes: %s", maxSkew, clockSkewsString(skews))
+		mgr.addClockSkewEvent("clockSkewed", curr)
+	} else if !skewed && prev != nil && prev.Skewed {
+		mgr.log.Printf("clock_skew: the clock is no longer skewed")
+		mgr.addClockSkewEvent("clockSkewRecovered", curr)
+	}
+}
+
+func clockSkewsString(skews []*NodeClockSkew) string {
+	buf, _ := json.Marshal(skews)
+	return string(buf)
+}
+
+func (mgr *Manager) addClockSkewEvent(name string, s *ClockSkewStatus) {
+	event, _ := json.Marshal(struct {
+		Event string `json:"event"`
+		*ClockSkewStatus
+	}{name, s})
+	mgr.AddEvent(event)
+}
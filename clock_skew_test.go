@@ -0,0 +1,183 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	var ahead int64 // In nanoseconds.
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			d := time.Duration(atomic.LoadInt64(&ahead))
+			w.Header().Set("Date",
+				time.Now().Add(d).UTC().Format(http.TimeFormat))
+		}))
+	defer s.Close()
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Register("known"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+
+	nodeDefs, cas, _ := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	nodeDefs.NodeDefs["other"] = &NodeDef{UUID: "other",
+		HostPort: strings.TrimPrefix(s.URL, "http://")}
+	if _, err := CfgSetNodeDefs(cfg, NODE_DEFS_KNOWN, nodeDefs,
+		cas); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs() to work, err: %v", err)
+	}
+	m.GetNodeDefs(NODE_DEFS_KNOWN, true)
+
+	events := func() (rv []string) {
+		m.VisitEvents(func(event []byte) {
+			var e struct {
+				Event string `json:"event"`
+			}
+			json.Unmarshal(event, &e)
+			rv = append(rv, e.Event)
+		})
+		return rv
+	}
+
+	t0 := time.Now()
+	m.checkClockSkewOnce(t0)
+	cs := m.ClockSkew()
+	if cs == nil || cs.Skewed || len(cs.Nodes) != 1 ||
+		cs.Nodes[0].UUID != "other" || cs.Nodes[0].Err != "" {
+		t.Fatalf("expected no skew, got: %#v", cs)
+	}
+
+	atomic.StoreInt64(&ahead, int64(time.Minute))
+	m.checkClockSkewOnce(t0.Add(time.Minute))
+	if cs = m.ClockSkew(); !cs.Skewed || cs.LastStep != "" {
+		t.Errorf("expected a skew, got: %#v", cs)
+	}
+
+	// The clock of this node is stepped forwards to catch up.
+	defer func(prev func(time.Time, time.Time) time.Duration) {
+		clockStep = prev
+	}(clockStep)
+	clockStep = func(prev, now time.Time) time.Duration {
+		return time.Minute
+	}
+
+	atomic.StoreInt64(&ahead, 0)
+	m.checkClockSkewOnce(t0.Add(2 * time.Minute))
+	if cs = m.ClockSkew(); cs.Skewed || cs.LastStep != "1m0s" {
+		t.Errorf("expected a step without skew, got: %#v", cs)
+	}
+
+	exp := []string{"clockSkewed", "clockStepped", "clockSkewRecovered"}
+	if got := events(); strings.Join(got, ",") != strings.Join(exp, ",") {
+		t.Errorf("expected events: %v, got: %v", exp, got)
+	}
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotClockSkewCheck != 3 || stats.TotClockSkewed != 1 ||
+		stats.TotClockStep != 1 {
+		t.Errorf("unexpected stats: %d, %d, %d", stats.TotClockSkewCheck,
+			stats.TotClockSkewed, stats.TotClockStep)
+	}
+}
+
+func TestCalcClockSkewsConcurrent(t *testing.T) {
+	// Each request is held until both nodes were requested, so the
+	// nodes are only measured in time when they're concurrent.
+	var arrived int32
+	bothCh := make(chan struct{})
+	hangCh := make(chan struct{})
+	defer close(hangCh)
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/hang" {
+				select {
+				case <-hangCh:
+				case <-r.Context().Done():
+				}
+				return
+			}
+			if atomic.AddInt32(&arrived, 1) == 2 {
+				close(bothCh)
+			}
+			select {
+			case <-bothCh:
+			case <-time.After(time.Second):
+			}
+		}))
+	defer s.Close()
+
+	hostPort := strings.TrimPrefix(s.URL, "http://")
+	nodeDefs := &NodeDefs{NodeDefs: map[string]*NodeDef{
+		"a":    {UUID: "a", HostPort: hostPort},
+		"b":    {UUID: "b", HostPort: hostPort},
+		"self": {UUID: "self", HostPort: "unused"},
+	}}
+
+	start := time.Now()
+	skews, unreachable, skewed := calcClockSkews(context.Background(),
+		http.DefaultClient, nodeDefs, "self", "/", time.Second)
+	if len(skews) != 2 || unreachable != 0 || skewed != 0 {
+		t.Errorf("expected 2 measured nodes, got: %s, %d, %d",
+			clockSkewsString(skews), unreachable, skewed)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("expected concurrent requests, took: %s", elapsed)
+	}
+
+	// A hanging node is bounded by the ctx of the whole check.
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+
+	skews, unreachable, _ = calcClockSkews(ctx, http.DefaultClient,
+		nodeDefs, "self", "/hang", time.Second)
+	if len(skews) != 2 || unreachable != 2 || skews[0].Err == "" {
+		t.Errorf("expected unreachable nodes, got: %s, %d",
+			clockSkewsString(skews), unreachable)
+	}
+}
+
+func TestClockSkewLoopOffByDefault(t *testing.T) {
+	m := NewManager(Version, nil, nil, NewUUID(), nil, "", 1, "", "",
+		"dir", "svr", nil, nil)
+
+	doneCh := make(chan struct{})
+	go func() {
+		m.ClockSkewLoop()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		m.Stop()
+		t.Errorf("expected the clock checks to be off by default")
+	}
+}
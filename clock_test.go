@@ -0,0 +1,157 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSetUUIDGenerator(t *testing.T) {
+	restore := SetUUIDGenerator(NewSeqUUIDGenerator("abc"))
+	if a, b := NewUUID(), NewUUID(); a != "abc0000000000001" ||
+		b != "abc0000000000002" {
+		t.Errorf("expected seq uuids, got: %s, %s", a, b)
+	}
+	restore()
+
+	if a := NewUUID(); len(a) != 16 || a == "abc0000000000003" {
+		t.Errorf("expected a restored random uuid, got: %s", a)
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := NewManualClock(start)
+
+	restore := SetClock(c.Now)
+	if !Now().Equal(start) {
+		t.Errorf("expected the manual clock, got: %v", Now())
+	}
+	c.Advance(time.Hour)
+	if Now().Sub(start) != time.Hour {
+		t.Errorf("expected an advanced clock, got: %v", Now())
+	}
+	restore()
+
+	if time.Since(Now()) > time.Minute {
+		t.Errorf("expected a restored clock, got: %v", Now())
+	}
+}
+
+func TestDeterministicCalcPlan(t *testing.T) {
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["x"] = &IndexDef{Name: "x", UUID: "xx",
+		Type: "blackhole", SourceType: "primary",
+		SourceParams: `{"numPartitions":4}`,
+		PlanParams:   PlanParams{MaxPartitionsPerPIndex: 1, NumReplicas: 1}}
+
+	nodeDefs := NewNodeDefs(Version)
+	for _, nodeUUID := range []string{"a", "b", "c"} {
+		nodeDefs.NodeDefs[nodeUUID] = &NodeDef{UUID: nodeUUID,
+			ImplVersion: Version, HostPort: nodeUUID + ":1"}
+	}
+
+	calcPlan := func() string {
+		defer SetUUIDGenerator(NewSeqUUIDGenerator("plan"))()
+
+		planPIndexes, err := CalcPlan(nil, "", indexDefs, nodeDefs, nil,
+			Version, "", nil, nil)
+		if err != nil {
+			t.Fatalf("expected CalcPlan() to work, err: %v", err)
+		}
+		j, _ := json.Marshal(planPIndexes)
+		return string(j)
+	}
+
+	if a, b := calcPlan(), calcPlan(); a != b {
+		t.Errorf("expected identical plans, got: %s\nvs: %s", a, b)
+	}
+}
+
+func TestManagerGCNodeDefsManualClock(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	c := NewManualClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	defer SetClock(c.Now)()
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+	err := registerNode(&NodeDef{HostPort: "gone", UUID: "gone",
+		ImplVersion: Version}, NODE_DEFS_KNOWN, m)
+	if err != nil {
+		t.Fatalf("registerNode err: %v", err)
+	}
+
+	opts := NodeDefsGCOptions{MaxAge: time.Hour}
+
+	res, err := m.GCNodeDefs(opts)
+	if err != nil || len(res.Stale) != 1 || len(res.Removed) != 0 {
+		t.Errorf("expected a stale node, res: %#v, err: %v", res, err)
+	}
+
+	c.Advance(59 * time.Minute)
+	res, _ = m.GCNodeDefs(opts)
+	if len(res.Removed) != 0 {
+		t.Errorf("expected nothing removed before max age, res: %#v", res)
+	}
+
+	c.Advance(time.Minute)
+	res, _ = m.GCNodeDefs(opts)
+	if len(res.Removed) != 1 || res.Removed[0] != "gone" {
+		t.Errorf("expected gone removed at max age, res: %#v", res)
+	}
+}
+
+func TestHybridClock(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := NewManualClock(start)
+
+	restore := SetClock(c.Now)
+	defer restore()
+
+	var hc HybridClock
+
+	a := hc.Next()
+	if a != start.UnixNano() {
+		t.Errorf("expected the clock's time, got: %d", a)
+	}
+	if b := hc.Next(); b != a+1 {
+		t.Errorf("expected a+1 on a stalled clock, got: %d", b)
+	}
+
+	c.Advance(-time.Hour)
+	if b := hc.Next(); b != a+2 {
+		t.Errorf("expected a+2 after a step backwards, got: %d", b)
+	}
+
+	c.Advance(2 * time.Hour)
+	if b := hc.Next(); b != start.Add(time.Hour).UnixNano() {
+		t.Errorf("expected the clock's time again, got: %d", b)
+	}
+
+	ms := NextHybridTime(0, time.Millisecond)
+	if ms != start.Add(time.Hour).UnixNano()/1000000 {
+		t.Errorf("expected the clock's time in ms, got: %d", ms)
+	}
+	if x := NextHybridTime(ms+10, time.Millisecond); x != ms+11 {
+		t.Errorf("expected the prev+1, got: %d", x)
+	}
+}
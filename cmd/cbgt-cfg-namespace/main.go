@@ -0,0 +1,109 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Command cbgt-cfg-namespace moves the Cfg keys of an existing
+// cluster into a namespace, so that the cluster can share its Cfg
+// backend with other clusters.  The cluster's nodes should be stopped
+// during the move, and restarted with the -cfg-namespace afterwards.
+// Without the -write flag, the Cfg is only read, and the keys that
+// would be moved are printed.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/blugelabs/cbgt"
+	"github.com/blugelabs/cbgt/cmd"
+)
+
+func main() {
+	c := cmd.DefaultConfig()
+
+	var namespace, extraKeys string
+	var deleteOld, write bool
+
+	flag.StringVar(&c.CfgConnect, "cfg-connect", c.CfgConnect,
+		"the Cfg, as simple[:path] or k8s:namespace/name")
+	flag.StringVar(&c.DataDir, "data-dir", c.DataDir,
+		"the data directory of a simple Cfg without a path")
+	flag.StringVar(&namespace, "namespace", "",
+		"the namespace to move the cluster's keys into")
+	flag.StringVar(&extraKeys, "extra-keys", "",
+		"comma-separated keys of the application to move as well")
+	flag.BoolVar(&deleteOld, "delete", false,
+		"delete the original keys after the move")
+	flag.BoolVar(&write, "write", false,
+		"move the keys, instead of only listing them")
+	flag.Parse()
+
+	err := cbgt.ValidateCfgNamespace(namespace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cbgt-cfg-namespace: %v\n", err)
+		os.Exit(1)
+	}
+
+	cfg, err := cmd.NewCfgClient(c.CfgConnect, c.DataDir, "", write)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cbgt-cfg-namespace: %v\n", err)
+		os.Exit(1)
+	}
+
+	keys := cbgt.CfgClusterKeys()
+	for _, key := range strings.Split(extraKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	if !write {
+		var found []string
+		for _, key := range keys {
+			val, _, err := cfg.Get(key, 0)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cbgt-cfg-namespace: key: %s, err: %v\n",
+					key, err)
+				os.Exit(1)
+			}
+			if val != nil {
+				found = append(found, key)
+			}
+		}
+
+		printJSON(map[string]interface{}{
+			"namespace": namespace,
+			"toMove":    found,
+		})
+		return
+	}
+
+	moved, err := cbgt.CfgMoveToNamespace(cfg, namespace, keys, deleteOld)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cbgt-cfg-namespace: moved: %v, err: %v\n",
+			moved, err)
+		os.Exit(1)
+	}
+
+	printJSON(map[string]interface{}{
+		"namespace": namespace,
+		"moved":     moved,
+		"deleted":   deleteOld,
+	})
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
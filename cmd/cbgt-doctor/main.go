@@ -0,0 +1,48 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Command cbgt-doctor checks whether a node is able to join its
+// cluster and to serve, with the same config file, environment
+// variables and flags as the node, and prints the report as JSON.  It
+// should be run while the node is stopped, as the node's ports are
+// checked too.  The exit code is 1 when a check failed, and 2 when a
+// check only warned.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/blugelabs/cbgt"
+	"github.com/blugelabs/cbgt/cmd"
+)
+
+func main() {
+	c, err := cmd.Load("cbgt-doctor", os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cbgt-doctor: %v\n", err)
+		os.Exit(1)
+	}
+
+	r := cmd.RunDoctor(c)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(r)
+
+	switch r.Status {
+	case cbgt.DOCTOR_FAIL:
+		os.Exit(1)
+	case cbgt.DOCTOR_WARN:
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,85 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Command cbgt-load starts a cluster of in-process nodes, creates
+// synthetic indexes, drives mutations and queries at target rates,
+// and prints the per-node ingest and query latencies as JSON, for
+// capacity planning and regression testing.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/blugelabs/cbgt"
+	"github.com/blugelabs/cbgt/cmd"
+)
+
+func main() {
+	options := cmd.DefaultLoadOptions()
+
+	var verbose bool
+
+	flag.StringVar(&options.DataDir, "data-dir", options.DataDir,
+		"the parent directory of the nodes' data directories")
+	flag.IntVar(&options.Nodes, "nodes", options.Nodes,
+		"the number of in-process nodes")
+	flag.IntVar(&options.Indexes, "indexes", options.Indexes,
+		"the number of synthetic indexes")
+	flag.StringVar(&options.IndexType, "index-type", options.IndexType,
+		"the index type, such as blackhole, latency or counting")
+	flag.StringVar(&options.IndexParams, "index-params", options.IndexParams,
+		"the indexParams JSON")
+	flag.IntVar(&options.PlanParams.MaxPartitionsPerPIndex,
+		"max-partitions-per-pindex", options.PlanParams.MaxPartitionsPerPIndex,
+		"the planParams maxPartitionsPerPIndex")
+	flag.IntVar(&options.PlanParams.NumReplicas, "replicas", 0,
+		"the planParams numReplicas")
+	flag.StringVar(&options.SourceType, "source-type", options.SourceType,
+		"the source type, whose feeds must be Dests to drive mutations")
+	flag.StringVar(&options.SourceParams, "source-params",
+		options.SourceParams, "the sourceParams JSON")
+	flag.IntVar(&options.Rate, "rate", options.Rate,
+		"the target mutations per second")
+	flag.IntVar(&options.QueryRate, "query-rate", options.QueryRate,
+		"the target queries per second")
+	flag.StringVar(&options.Query, "query", options.Query,
+		"the query request JSON")
+	flag.IntVar(&options.ValSize, "val-size", options.ValSize,
+		"the bytes per mutation value")
+	flag.DurationVar(&options.Duration, "duration", options.Duration,
+		"how long to drive the load")
+	flag.DurationVar(&options.ReadyTimeout, "ready-timeout",
+		options.ReadyTimeout, "how long to wait for the indexes to be fed")
+	flag.BoolVar(&verbose, "v", false, "log the nodes' messages")
+	flag.Parse()
+
+	logOut := ioutil.Discard
+	if verbose {
+		logOut = os.Stderr
+	}
+	options.Log = cbgt.NewStdLibLog(logOut, "", log.LstdFlags)
+	log.SetOutput(logOut) // Some of cbgt also logs to the std lib log.
+
+	report, err := cmd.RunLoad(options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cbgt-load: %v\n", err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
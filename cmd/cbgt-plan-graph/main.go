@@ -0,0 +1,88 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Command cbgt-plan-graph reads the current plan from a cluster's
+// Cfg, and prints it as a graph of the nodes, the pindexes and their
+// primary and replica assignments, in the graphviz DOT format or as
+// JSON, such as for...
+//
+//	cbgt-plan-graph -cfg-connect=simple:cbgt.cfg | dot -Tsvg > plan.svg
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/blugelabs/cbgt"
+	"github.com/blugelabs/cbgt/cmd"
+)
+
+func main() {
+	c := cmd.DefaultConfig()
+
+	var indexName, format string
+
+	flag.StringVar(&c.CfgConnect, "cfg-connect", c.CfgConnect,
+		"the Cfg, as simple[:path] or k8s:namespace/name")
+	flag.StringVar(&c.DataDir, "data-dir", c.DataDir,
+		"the data directory of a simple Cfg without a path")
+	flag.StringVar(&c.CfgNamespace, "cfg-namespace", "",
+		"the optional namespace of the cluster's Cfg keys")
+	flag.StringVar(&indexName, "index", "",
+		"only graph the pindexes of this index")
+	flag.StringVar(&format, "format", "dot", "the output format, dot or json")
+	flag.Parse()
+
+	err := run(c, indexName, format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cbgt-plan-graph: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(c *cmd.Config, indexName, format string) error {
+	if format != "dot" && format != "json" {
+		return fmt.Errorf("unknown format: %q", format)
+	}
+
+	cfg, err := cmd.NewCfgClient(c.CfgConnect, c.DataDir,
+		c.CfgNamespace, false)
+	if err != nil {
+		return err
+	}
+
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		return err
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		return err
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		return err
+	}
+
+	g := cbgt.CalcPlanGraph(indexDefs, nodeDefs, planPIndexes, indexName)
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(g)
+	}
+
+	return cbgt.WritePlanGraphDOT(os.Stdout, g)
+}
@@ -0,0 +1,462 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package cmd provides helpers for the binaries that embed cbgt, so
+// that node startup configuration is handled in one place.
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blugelabs/cbgt"
+	"github.com/blugelabs/cbgt/k8s"
+)
+
+// ENV_PREFIX is the default prefix of the environment variables that
+// configure a node, as in CBGT_BIND_HTTP.
+const ENV_PREFIX = "CBGT_"
+
+// UUID_FILE_NAME is the file in the data directory that persists the
+// node's UUID across restarts.
+const UUID_FILE_NAME = "cbgt.uuid"
+
+// Config is the startup configuration of a cbgt node.  A Config is
+// populated, in increasing order of precedence, from its defaults,
+// an optional JSON config file, environment variables and flags.
+type Config struct {
+	BindHTTP      string            `json:"bindHTTP"`
+	AdvertiseHTTP string            `json:"advertiseHTTP"` // See AdvertiseAddr.
+	CfgConnect    string            `json:"cfgConnect"`    // See NewCfg.
+	CfgNamespace  string            `json:"cfgNamespace"`  // See CfgNamespace.
+	DataDir       string            `json:"dataDir"`
+	Server        string            `json:"server"`
+	Tags          []string          `json:"tags"`
+	Container     string            `json:"container"`
+	Weight        int               `json:"weight"`
+	Extras        string            `json:"extras"`
+	Register      string            `json:"register"` // See Manager.Register.
+	Options       map[string]string `json:"options"`
+}
+
+// DefaultConfig returns a Config with the default values.
+func DefaultConfig() *Config {
+	return &Config{
+		BindHTTP:   "0.0.0.0:8095",
+		CfgConnect: "simple",
+		DataDir:    "data",
+		Weight:     1,
+		Register:   "wanted",
+		Options:    map[string]string{},
+	}
+}
+
+// The config entries, which are used as flag names, and upper-cased
+// with dashes replaced by underscores as environment variable names.
+var configEntries = []struct {
+	name  string
+	usage string
+	get   func(c *Config) string
+	set   func(c *Config, v string) error
+}{
+	{"bind-http", "address:port of the node's http server, or a" +
+		" comma-separated list for dual-stack, like 0.0.0.0:8095,[::]:8095",
+		func(c *Config) string { return c.BindHTTP },
+		func(c *Config, v string) error { c.BindHTTP = v; return nil }},
+	{"advertise-http", "address:port that other nodes use to reach the" +
+		" node, detected from the bind-http when empty",
+		func(c *Config) string { return c.AdvertiseHTTP },
+		func(c *Config, v string) error { c.AdvertiseHTTP = v; return nil }},
+	{"cfg-connect", "the Cfg, as mem, simple[:path] or k8s:namespace/name",
+		func(c *Config) string { return c.CfgConnect },
+		func(c *Config, v string) error { c.CfgConnect = v; return nil }},
+	{"cfg-namespace", "optional namespace of the cluster's Cfg keys, so" +
+		" that multiple clusters can share one Cfg",
+		func(c *Config) string { return c.CfgNamespace },
+		func(c *Config, v string) error { c.CfgNamespace = v; return nil }},
+	{"data-dir", "the node's data directory",
+		func(c *Config) string { return c.DataDir },
+		func(c *Config, v string) error { c.DataDir = v; return nil }},
+	{"server", "url of the default datasource",
+		func(c *Config) string { return c.Server },
+		func(c *Config, v string) error { c.Server = v; return nil }},
+	{"tags", "comma-separated node tags, such as planner,pindex",
+		func(c *Config) string { return strings.Join(c.Tags, ",") },
+		func(c *Config, v string) error {
+			c.Tags = nil
+			for _, tag := range strings.Split(v, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					c.Tags = append(c.Tags, tag)
+				}
+			}
+			return nil
+		}},
+	{"container", "'/' separated containment path, such as rack1/host1",
+		func(c *Config) string { return c.Container },
+		func(c *Config, v string) error { c.Container = v; return nil }},
+	{"weight", "the node's weight for pindex assignment",
+		func(c *Config) string { return strconv.Itoa(c.Weight) },
+		func(c *Config, v string) (err error) {
+			c.Weight, err = strconv.Atoi(v)
+			return err
+		}},
+	{"extras", "extra info about the node",
+		func(c *Config) string { return c.Extras },
+		func(c *Config, v string) error { c.Extras = v; return nil }},
+	{"register", "how the node registers: wanted, known, unknown, unwanted",
+		func(c *Config) string { return c.Register },
+		func(c *Config, v string) error { c.Register = v; return nil }},
+	{"options", "comma-separated key=value manager options",
+		func(c *Config) string {
+			var kvs []string
+			for k, v := range c.Options {
+				kvs = append(kvs, k+"="+v)
+			}
+			sort.Strings(kvs)
+			return strings.Join(kvs, ",")
+		},
+		func(c *Config, v string) error {
+			c.Options = map[string]string{}
+			for _, kv := range strings.Split(v, ",") {
+				if kv = strings.TrimSpace(kv); kv == "" {
+					continue
+				}
+				a := strings.SplitN(kv, "=", 2)
+				if len(a) != 2 {
+					return fmt.Errorf("cmd: invalid option: %q", kv)
+				}
+				c.Options[a[0]] = a[1]
+			}
+			return nil
+		}},
+}
+
+// Load populates a Config from the defaults, an optional JSON config
+// file named by the -config flag or the CBGT_CONFIG environment
+// variable, the environment variables, and the flags in the args.
+// The getenv is usually os.Getenv.
+func Load(name string, args []string,
+	getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	configPath := fs.String("config", "", "optional JSON config file")
+
+	flagVals := map[string]*string{}
+	for _, e := range configEntries {
+		flagVals[e.name] = fs.String(e.name, "", e.usage)
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	c := DefaultConfig()
+
+	path := *configPath
+	if path == "" {
+		path = getenv(ENV_PREFIX + "CONFIG")
+	}
+	if path != "" {
+		err = c.LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.LoadEnv(ENV_PREFIX, getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	setters := map[string]func(*Config, string) error{}
+	for _, e := range configEntries {
+		setters[e.name] = e.set
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if set := setters[f.Name]; set != nil && err == nil {
+			err = set(c, *flagVals[f.Name])
+			if err != nil {
+				err = fmt.Errorf("cmd: flag: %s, err: %v", f.Name, err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// LoadFile overlays the entries of a JSON config file.
+func (c *Config) LoadFile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cmd: config file, err: %v", err)
+	}
+	err = json.Unmarshal(buf, c)
+	if err != nil {
+		return fmt.Errorf("cmd: config file: %s, err: %v", path, err)
+	}
+	return nil
+}
+
+// LoadEnv overlays the non-empty environment variables, such as
+// CBGT_DATA_DIR for the data-dir entry with the default prefix.
+func (c *Config) LoadEnv(prefix string, getenv func(string) string) error {
+	for _, e := range configEntries {
+		name := prefix +
+			strings.ToUpper(strings.Replace(e.name, "-", "_", -1))
+		if v := getenv(name); v != "" {
+			err := e.set(c, v)
+			if err != nil {
+				return fmt.Errorf("cmd: env: %s, err: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the Config for obvious mistakes.
+func (c *Config) Validate() error {
+	if c.BindHTTP == "" {
+		return fmt.Errorf("cmd: bind-http is required")
+	}
+	for _, addr := range cbgt.SplitBindHttp(c.BindHTTP) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("cmd: bind-http: %q, err: %v", c.BindHTTP, err)
+		}
+	}
+	if c.AdvertiseHTTP != "" {
+		err := cbgt.ValidateAdvertiseHttp(c.AdvertiseHTTP)
+		if err != nil {
+			return fmt.Errorf("cmd: advertise-http, err: %v", err)
+		}
+	}
+	if c.DataDir == "" {
+		return fmt.Errorf("cmd: data-dir is required")
+	}
+	if c.Weight <= 0 {
+		return fmt.Errorf("cmd: weight must be positive, weight: %d",
+			c.Weight)
+	}
+	switch c.Register {
+	case "wanted", "wantedForce", "known", "knownForce",
+		"standby", "standbyForce", "unknown", "unwanted", "unchanged":
+	default:
+		return fmt.Errorf("cmd: unknown register: %q", c.Register)
+	}
+	kind := strings.SplitN(c.CfgConnect, ":", 2)[0]
+	switch kind {
+	case "mem", "simple", "k8s":
+	default:
+		return fmt.Errorf("cmd: unknown cfg-connect: %q", c.CfgConnect)
+	}
+	if c.CfgNamespace != "" {
+		err := cbgt.ValidateCfgNamespace(c.CfgNamespace)
+		if err != nil {
+			return fmt.Errorf("cmd: cfg-namespace, err: %v", err)
+		}
+	}
+	return nil
+}
+
+// String returns the Config in flag form, for logging.
+func (c *Config) String() string {
+	var s []string
+	for _, e := range configEntries {
+		s = append(s, fmt.Sprintf("-%s=%s", e.name, e.get(c)))
+	}
+	return strings.Join(s, " ")
+}
+
+// AdvertiseAddr returns the address:port that other nodes use to
+// reach the node, which is the advertise-http, or else is resolved
+// from the bind-http, such as to the host's FQDN for "0.0.0.0:8095".
+func (c *Config) AdvertiseAddr() (string, error) {
+	if c.AdvertiseHTTP != "" {
+		return c.AdvertiseHTTP, cbgt.ValidateAdvertiseHttp(c.AdvertiseHTTP)
+	}
+	return cbgt.ResolveAdvertiseHttp(c.BindHTTP)
+}
+
+// ---------------------------------------------------------
+
+// NewCfg returns the Cfg for a cfg-connect string, which is "mem" for
+// a non-persistent CfgMem, "simple" or "simple:path" for a CfgSimple
+// whose file defaults to cbgt.cfg in the dataDir, or
+// "k8s:namespace/name" for a ConfigMap of the Kubernetes cluster.
+func NewCfg(cfgConnect, dataDir string) (cbgt.Cfg, error) {
+	a := strings.SplitN(cfgConnect, ":", 2)
+
+	switch a[0] {
+	case "mem":
+		return cbgt.NewCfgMem(), nil
+
+	case "simple":
+		path := filepath.Join(dataDir, "cbgt.cfg")
+		if len(a) > 1 && a[1] != "" {
+			path = a[1]
+		}
+		cfg := cbgt.NewCfgSimple(path)
+		err := cfg.Load()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cmd: load cfg: %s, err: %v", path, err)
+		}
+		return cfg, nil
+
+	case "k8s":
+		if len(a) < 2 || !strings.Contains(a[1], "/") {
+			return nil, fmt.Errorf("cmd: cfg-connect needs"+
+				" k8s:namespace/name, got: %q", cfgConnect)
+		}
+		nn := strings.SplitN(a[1], "/", 2)
+		client, err := k8s.NewInClusterClient()
+		if err != nil {
+			return nil, err
+		}
+		cfg := k8s.NewCfgConfigMap(client, nn[0], nn[1])
+		err = cfg.Load()
+		if err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+
+	return nil, fmt.Errorf("cmd: unknown cfg-connect: %q", cfgConnect)
+}
+
+// NewCfgClient returns the Cfg for a tool, such as an inspection
+// command, which is also namespaced by the cfgNamespace when it's
+// non-empty.  The Cfg is read-only, so that the tool can never
+// accidentally mutate the cluster's state, unless write is true.
+func NewCfgClient(cfgConnect, dataDir, cfgNamespace string,
+	write bool) (cbgt.Cfg, error) {
+	cfg, err := NewCfg(cfgConnect, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfgNamespace != "" {
+		cfg, err = cbgt.NewCfgNamespace(cfg, cfgNamespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !write {
+		cfg = cbgt.NewCfgReadOnly(cfg)
+	}
+
+	return cfg, nil
+}
+
+// MainUUID returns the node's UUID from the dataDir, generating and
+// persisting a new UUID on the node's first start.
+func MainUUID(dataDir string) (string, error) {
+	path := filepath.Join(dataDir, UUID_FILE_NAME)
+
+	buf, err := ioutil.ReadFile(path)
+	if err == nil {
+		uuid := strings.TrimSpace(string(buf))
+		if uuid == "" {
+			return "", fmt.Errorf("cmd: empty uuid file: %s", path)
+		}
+		return uuid, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("cmd: read uuid file: %s, err: %v", path, err)
+	}
+
+	uuid := cbgt.NewUUID()
+	err = ioutil.WriteFile(path, []byte(uuid), 0600)
+	if err != nil {
+		return "", fmt.Errorf("cmd: write uuid file: %s, err: %v", path, err)
+	}
+	return uuid, nil
+}
+
+// StartManager creates the dataDir if needed, and then constructs and
+// starts a Manager from the Config.  The "cfgJournal" option of "true"
+// journals the node's Cfg mutations to the dataDir; see CfgJournal.
+func StartManager(c *Config, version string, log cbgt.Log,
+	meh cbgt.ManagerEventHandlers) (*cbgt.Manager, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(c.DataDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("cmd: data-dir: %s, err: %v", c.DataDir, err)
+	}
+
+	cfg, err := NewCfg(c.CfgConnect, c.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.CfgNamespace != "" {
+		cfg, err = cbgt.NewCfgNamespace(cfg, c.CfgNamespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Options["cfgJournal"] == "true" {
+		cfg, err = cbgt.NewCfgJournal(cfg, cbgt.CfgJournalOptions{
+			Path: filepath.Join(c.DataDir, cbgt.CFG_JOURNAL_FILE_NAME),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uuid, err := MainUUID(c.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	advertise, err := c.AdvertiseAddr()
+	if err != nil {
+		return nil, fmt.Errorf("cmd: advertise-http, err: %v", err)
+	}
+
+	options := map[string]string{}
+	for k, v := range c.Options {
+		options[k] = v
+	}
+	options["advertiseHttp"] = advertise
+
+	mgr := cbgt.NewManager(version, cfg, log, uuid, c.Tags, c.Container,
+		c.Weight, c.Extras, c.BindHTTP, c.DataDir, c.Server, meh, options)
+
+	err = mgr.Start(c.Register)
+	if err != nil {
+		return nil, fmt.Errorf("cmd: start manager, err: %v", err)
+	}
+
+	return mgr, nil
+}
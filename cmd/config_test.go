@@ -0,0 +1,151 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blugelabs/cbgt"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cmd")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	err := ioutil.WriteFile(path, []byte(`{"dataDir":"fromFile",`+
+		`"server":"fromFile","weight":3,"tags":["pindex"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"CBGT_CONFIG": path,
+		"CBGT_SERVER": "fromEnv",
+		"CBGT_TAGS":   "planner, pindex",
+	}
+
+	c, err := Load("test", []string{"-server=fromFlag",
+		"-options=a=1,b=2"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("expected Load() to work, err: %v", err)
+	}
+
+	if c.DataDir != "fromFile" || c.Weight != 3 {
+		t.Errorf("expected file entries, got: %#v", c)
+	}
+	if !reflect.DeepEqual(c.Tags, []string{"planner", "pindex"}) {
+		t.Errorf("expected env to override the file, got: %v", c.Tags)
+	}
+	if c.Server != "fromFlag" {
+		t.Errorf("expected flags to override env, got: %s", c.Server)
+	}
+	if c.Options["a"] != "1" || c.Options["b"] != "2" {
+		t.Errorf("expected options, got: %v", c.Options)
+	}
+	if c.BindHTTP != DefaultConfig().BindHTTP {
+		t.Errorf("expected a default bindHTTP, got: %s", c.BindHTTP)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	noEnv := func(string) string { return "" }
+
+	for _, args := range [][]string{
+		{"-weight=x"},
+		{"-weight=0"},
+		{"-register=sometimes"},
+		{"-cfg-connect=couchbase:http://x"},
+		{"-options=novalue"},
+		{"-cfg-namespace=a/b"},
+		{"-bind-http=8095"},
+		{"-advertise-http=0.0.0.0:8095"},
+		{"-advertise-http=host.example.com"},
+		{"-not-a-flag"},
+	} {
+		if _, err := Load("test", args, noEnv); err == nil {
+			t.Errorf("expected err, args: %v", args)
+		}
+	}
+}
+
+func TestStartManager(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cmd")
+	defer os.RemoveAll(dir)
+
+	c := DefaultConfig()
+	c.DataDir = filepath.Join(dir, "data")
+	c.CfgConnect = "simple"
+	c.Tags = []string{"pindex"}
+
+	mgr, err := StartManager(c, cbgt.Version, nil, nil)
+	if err != nil {
+		t.Fatalf("expected StartManager() to work, err: %v", err)
+	}
+	mgr.Stop()
+
+	uuid, err := MainUUID(c.DataDir)
+	if err != nil || uuid != mgr.UUID() {
+		t.Errorf("expected a persisted uuid: %s, got: %s, err: %v",
+			mgr.UUID(), uuid, err)
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(mgr.Cfg(), cbgt.NODE_DEFS_WANTED)
+	if err != nil || nodeDefs == nil || nodeDefs.NodeDefs[uuid] == nil {
+		t.Fatalf("expected the node registered, got: %#v, err: %v",
+			nodeDefs, err)
+	}
+
+	hostPort := nodeDefs.NodeDefs[uuid].HostPort
+	if err = cbgt.ValidateAdvertiseHttp(hostPort); err != nil ||
+		hostPort != mgr.AdvertiseHttp() || mgr.BindHttp() != c.BindHTTP {
+		t.Errorf("expected a resolved advertised address, got: %s, err: %v",
+			hostPort, err)
+	}
+
+	if _, err = os.Stat(filepath.Join(c.DataDir, "cbgt.cfg")); err != nil {
+		t.Errorf("expected the simple cfg file, err: %v", err)
+	}
+}
+
+func TestNewCfgClient(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cmd")
+	defer os.RemoveAll(dir)
+
+	cfgConnect := "simple:" + filepath.Join(dir, "test.cfg")
+
+	cfg, err := NewCfgClient(cfgConnect, dir, "ns", true)
+	if err != nil {
+		t.Fatalf("expected NewCfgClient() to work, err: %v", err)
+	}
+	if _, err = cfg.Set("k", []byte("v"), 0); err != nil {
+		t.Fatalf("expected a writable cfg, err: %v", err)
+	}
+
+	cfg, err = NewCfgClient(cfgConnect, dir, "ns", false)
+	if err != nil {
+		t.Fatalf("expected NewCfgClient() to work, err: %v", err)
+	}
+	if v, _, err := cfg.Get("k", 0); err != nil || string(v) != "v" {
+		t.Errorf("expected a namespaced read, got: %s, err: %v", v, err)
+	}
+	if _, err = cfg.Set("k", []byte("x"), 0); err != cbgt.ErrCfgReadOnly {
+		t.Errorf("expected a read-only cfg, err: %v", err)
+	}
+	if err = cfg.Del("k", 0); err != cbgt.ErrCfgReadOnly {
+		t.Errorf("expected a read-only cfg, err: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// RunDoctor runs the cbgt.RunDoctor() self-test for the startup
+// configuration of a node, before the node is started, where a Cfg
+// that can't be created is reported as a failed check.  The node's
+// UUID is read from its dataDir, if any, but is never generated.
+func RunDoctor(c *Config) *cbgt.DoctorReport {
+	o := cbgt.DoctorOptions{
+		DataDir:  c.DataDir,
+		BindHttp: c.BindHTTP,
+		Server:   c.Server,
+		Options:  c.Options,
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(c.DataDir, UUID_FILE_NAME))
+	if err == nil {
+		o.UUID = strings.TrimSpace(string(buf))
+	}
+
+	cfg, err := NewCfgClient(c.CfgConnect, c.DataDir, c.CfgNamespace, true)
+	if err != nil {
+		r := cbgt.RunDoctor(o)
+		for _, check := range r.Checks {
+			if check.Name == "cfg" {
+				check.Message = err.Error()
+			}
+		}
+		return r
+	}
+	o.Cfg = cfg
+
+	return cbgt.RunDoctor(o)
+}
@@ -0,0 +1,54 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/blugelabs/cbgt"
+)
+
+func TestRunDoctor(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cmd")
+	defer os.RemoveAll(dir)
+
+	c := DefaultConfig()
+	c.DataDir = dir
+	c.BindHTTP = "127.0.0.1:0"
+	c.CfgConnect = "mem"
+
+	r := RunDoctor(c)
+	if r.Status != cbgt.DOCTOR_OK {
+		t.Errorf("expected an ok report, got: %#v", r.Checks)
+	}
+
+	_, err := os.Stat(dir + "/" + UUID_FILE_NAME)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no uuid file, err: %v", err)
+	}
+
+	c.CfgConnect = "k8s:missing-name"
+
+	r = RunDoctor(c)
+	for _, check := range r.Checks {
+		if check.Name == "cfg" && (check.Status != cbgt.DOCTOR_FAIL ||
+			!strings.Contains(check.Message, "k8s:namespace/name")) {
+			t.Errorf("expected a failed cfg check, got: %#v", check)
+		}
+	}
+	if r.Status != cbgt.DOCTOR_FAIL {
+		t.Errorf("expected a failed report, got: %#v", r.Checks)
+	}
+}
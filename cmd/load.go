@@ -0,0 +1,466 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// LoadOptions configures RunLoad, which starts a cluster of
+// in-process nodes that share a CfgMem, creates synthetic indexes and
+// then drives mutations and queries at them.
+type LoadOptions struct {
+	DataDir string // The parent of each node's data directory.
+	Nodes   int
+
+	Indexes     int
+	IndexType   string // Such as "blackhole", "latency" or "counting".
+	IndexParams string
+	PlanParams  cbgt.PlanParams
+
+	// The source of the indexes, whose feeds must also implement Dest
+	// for mutations to be driven through them, as with "primary".
+	SourceType   string
+	SourceParams string
+
+	Rate      int // Mutations per second, where 0 means no mutations.
+	QueryRate int // Queries per second, where 0 means no queries.
+	Query     string
+	ValSize   int
+
+	Duration     time.Duration
+	ReadyTimeout time.Duration // For the indexes to be planned and fed.
+
+	Log cbgt.Log
+}
+
+// DefaultLoadOptions returns the LoadOptions of a small load on
+// blackhole indexes fed by primary sources, whose pindexes are small
+// enough to be spread across the nodes.
+func DefaultLoadOptions() *LoadOptions {
+	return &LoadOptions{
+		DataDir:      "load",
+		Nodes:        3,
+		Indexes:      10,
+		IndexType:    "blackhole",
+		PlanParams:   cbgt.PlanParams{MaxPartitionsPerPIndex: 2},
+		SourceType:   "primary",
+		SourceParams: `{"numPartitions":8}`,
+		Rate:         1000,
+		QueryRate:    10,
+		Query:        "{}",
+		ValSize:      100,
+		Duration:     10 * time.Second,
+		ReadyTimeout: 30 * time.Second,
+	}
+}
+
+// LoadReport is the outcome of RunLoad.
+type LoadReport struct {
+	Ready     time.Duration `json:"ready"` // Until the indexes were fed.
+	Elapsed   time.Duration `json:"elapsed"`
+	Mutations uint64        `json:"mutations"`
+	Queries   uint64        `json:"queries"`
+
+	Nodes map[string]*LoadNodeReport `json:"nodes"` // Keyed by node UUID.
+}
+
+// LoadNodeReport is the load that a node handled.
+type LoadNodeReport struct {
+	PIndexes int            `json:"pindexes"`
+	Ingest   *LatencyReport `json:"ingest"`
+	Query    *LatencyReport `json:"query"`
+}
+
+// LatencyReport summarizes the latencies of an operation.
+type LatencyReport struct {
+	Count uint64        `json:"count"`
+	Errs  uint64        `json:"errs"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// ---------------------------------------------------------
+
+// The most latency samples kept per node and operation, beyond which
+// reservoir sampling keeps the percentiles representative.
+const loadMaxSamples = 100000
+
+type latencyRecorder struct {
+	m       sync.Mutex
+	count   uint64
+	errs    uint64
+	sum     time.Duration
+	max     time.Duration
+	samples []time.Duration
+}
+
+func (r *latencyRecorder) record(d time.Duration, err error) {
+	r.m.Lock()
+	r.count++
+	if err != nil {
+		r.errs++
+	}
+	r.sum += d
+	if d > r.max {
+		r.max = d
+	}
+	if len(r.samples) < loadMaxSamples {
+		r.samples = append(r.samples, d)
+	} else if i := rand.Int63n(int64(r.count)); i < loadMaxSamples {
+		r.samples[i] = d
+	}
+	r.m.Unlock()
+}
+
+func (r *latencyRecorder) report() *LatencyReport {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	rv := &LatencyReport{Count: r.count, Errs: r.errs, Max: r.max}
+	if r.count <= 0 {
+		return rv
+	}
+	rv.Mean = r.sum / time.Duration(r.count)
+
+	samples := append([]time.Duration(nil), r.samples...)
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	percentile := func(p int) time.Duration {
+		return samples[(len(samples)-1)*p/100]
+	}
+	rv.P50, rv.P90, rv.P99 = percentile(50), percentile(90), percentile(99)
+
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// A loadRoute is a feed on a node that delivers a source partition.
+type loadRoute struct {
+	node string
+	dest cbgt.Dest
+}
+
+// RunLoad starts options.Nodes in-process nodes, creates the
+// synthetic indexes, waits until they're planned and fed, and then
+// for the options.Duration drives mutations through the feeds and
+// queries at the pindexes, at the target rates.  The nodes are
+// stopped before RunLoad returns, but their data directories are
+// kept.
+func RunLoad(options *LoadOptions) (*LoadReport, error) {
+	if options.Nodes <= 0 || options.Indexes <= 0 {
+		return nil, fmt.Errorf("cmd: load needs nodes and indexes")
+	}
+
+	feedType := cbgt.FeedTypes[options.SourceType]
+	if feedType == nil {
+		return nil, fmt.Errorf("cmd: load, unknown sourceType: %s",
+			options.SourceType)
+	}
+
+	partitions, err := feedType.Partitions(options.SourceType, "load", "",
+		options.SourceParams, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("cmd: load, partitions, err: %v", err)
+	}
+
+	cfg := cbgt.NewCfgMem()
+
+	var mgrs []*cbgt.Manager
+	defer func() {
+		for _, mgr := range mgrs {
+			mgr.Stop()
+		}
+	}()
+
+	for i := 0; i < options.Nodes; i++ {
+		dataDir := filepath.Join(options.DataDir, "node"+strconv.Itoa(i))
+		err = os.MkdirAll(dataDir, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("cmd: load, data-dir: %s, err: %v",
+				dataDir, err)
+		}
+
+		mgr := cbgt.NewManager(cbgt.Version, cfg, options.Log,
+			"node"+strconv.Itoa(i), nil, "", 1, "",
+			"127.0.0.1:"+strconv.Itoa(10000+i), dataDir, "", nil, nil)
+		err = mgr.Register("wanted")
+		if err != nil {
+			return nil, fmt.Errorf("cmd: load, register node: %d, err: %v",
+				i, err)
+		}
+		mgrs = append(mgrs, mgr)
+	}
+
+	// Start the nodes after they're all registered, so that the
+	// first planning spreads the pindexes across all of them.
+	for i, mgr := range mgrs {
+		err = mgr.Start("wanted")
+		if err != nil {
+			return nil, fmt.Errorf("cmd: load, start node: %d, err: %v",
+				i, err)
+		}
+	}
+
+	indexNames := make([]string, options.Indexes)
+	for i := range indexNames {
+		indexNames[i] = fmt.Sprintf("load%d", i)
+		err = mgrs[0].CreateIndex(options.SourceType, "load", "",
+			options.SourceParams, options.IndexType, indexNames[i],
+			options.IndexParams, options.PlanParams, "")
+		if err != nil {
+			return nil, fmt.Errorf("cmd: load, create index: %s, err: %v",
+				indexNames[i], err)
+		}
+	}
+
+	report := &LoadReport{Nodes: map[string]*LoadNodeReport{}}
+	start := time.Now()
+
+	routes, err := loadWaitReady(mgrs, indexNames, partitions,
+		options.ReadyTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Ready = time.Since(start)
+
+	ingest := map[string]*latencyRecorder{}
+	query := map[string]*latencyRecorder{}
+	for _, mgr := range mgrs {
+		ingest[mgr.UUID()] = &latencyRecorder{}
+		query[mgr.UUID()] = &latencyRecorder{}
+	}
+
+	stopCh := make(chan struct{})
+	time.AfterFunc(options.Duration, func() { close(stopCh) })
+
+	var wg sync.WaitGroup
+
+	if options.Rate > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Mutations = loadMutations(options, indexNames,
+				partitions, routes, ingest, stopCh)
+		}()
+	}
+
+	if options.QueryRate > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Queries = loadQueries(options, mgrs, query, stopCh)
+		}()
+	}
+
+	start = time.Now()
+	wg.Wait()
+	<-stopCh
+	report.Elapsed = time.Since(start)
+
+	for _, mgr := range mgrs {
+		_, pindexes := mgr.CurrentMaps()
+		report.Nodes[mgr.UUID()] = &LoadNodeReport{
+			PIndexes: len(pindexes),
+			Ingest:   ingest[mgr.UUID()].report(),
+			Query:    query[mgr.UUID()].report(),
+		}
+	}
+
+	return report, nil
+}
+
+// loadWaitReady waits until every node's pindexes and feeds agree
+// with the plan, and every partition of every index has a feed, and
+// returns the feeds that are Dests, keyed by index and partition.
+func loadWaitReady(mgrs []*cbgt.Manager, indexNames, partitions []string,
+	timeout time.Duration) (map[string]map[string][]*loadRoute, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		routes, ready := loadRoutes(mgrs, indexNames, partitions)
+		if ready {
+			return routes, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("cmd: load, indexes not ready"+
+				" after: %v", timeout)
+		}
+
+		for _, mgr := range mgrs {
+			mgr.JanitorKick("load")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func loadRoutes(mgrs []*cbgt.Manager, indexNames, partitions []string) (
+	map[string]map[string][]*loadRoute, bool) {
+	fed := map[string]map[string]bool{} // Keyed by index, partition.
+	routes := map[string]map[string][]*loadRoute{}
+	for _, indexName := range indexNames {
+		fed[indexName] = map[string]bool{}
+		routes[indexName] = map[string][]*loadRoute{}
+	}
+
+	for _, mgr := range mgrs {
+		violations, err := mgr.CheckInvariants()
+		if err != nil || len(violations) > 0 {
+			return nil, false
+		}
+
+		feeds, _ := mgr.CurrentMaps()
+		for _, feed := range feeds {
+			if fed[feed.IndexName()] == nil {
+				continue
+			}
+			dest, isDest := feed.(cbgt.Dest)
+			for partition := range feed.Dests() {
+				fed[feed.IndexName()][partition] = true
+				if isDest {
+					routes[feed.IndexName()][partition] = append(
+						routes[feed.IndexName()][partition],
+						&loadRoute{node: mgr.UUID(), dest: dest})
+				}
+			}
+		}
+	}
+
+	for _, indexName := range indexNames {
+		for _, partition := range partitions {
+			if !fed[indexName][partition] {
+				return nil, false
+			}
+		}
+	}
+
+	return routes, true
+}
+
+// loadMutations round-robins updates across the indexes and their
+// partitions at the options.Rate, delivering each update to every
+// feed of its partition, such as to the replicas, and returns the
+// number of updates.
+func loadMutations(options *LoadOptions, indexNames, partitions []string,
+	routes map[string]map[string][]*loadRoute,
+	ingest map[string]*latencyRecorder, stopCh chan struct{}) uint64 {
+	val := make([]byte, options.ValSize)
+	for i := range val {
+		val[i] = 'a' + byte(i%26)
+	}
+
+	seqs := map[string]uint64{} // Keyed by index/partition.
+
+	var n uint64
+
+	loadPace(options.Rate, stopCh, func() {
+		indexName := indexNames[int(n)%len(indexNames)]
+		partition := "0"
+		if len(partitions) > 0 {
+			partition = partitions[int(n/uint64(len(indexNames)))%
+				len(partitions)]
+		}
+
+		k := indexName + "/" + partition
+		seqs[k]++
+		key := []byte("key" + strconv.FormatUint(n, 10))
+
+		for _, route := range routes[indexName][partition] {
+			t := time.Now()
+			err := route.dest.DataUpdate(partition, key, seqs[k], val, 0,
+				cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+			ingest[route.node].record(time.Since(t), err)
+		}
+
+		n++
+	})
+
+	return n
+}
+
+// loadQueries round-robins the options.Query across the pindexes of
+// the nodes at the options.QueryRate, and returns the number of
+// queries.
+func loadQueries(options *LoadOptions, mgrs []*cbgt.Manager,
+	query map[string]*latencyRecorder, stopCh chan struct{}) uint64 {
+	type target struct {
+		node   string
+		pindex *cbgt.PIndex
+	}
+
+	var targets []*target
+	for _, mgr := range mgrs {
+		_, pindexes := mgr.CurrentMaps()
+		for _, pindex := range pindexes {
+			targets = append(targets, &target{mgr.UUID(), pindex})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].pindex.Name < targets[j].pindex.Name
+	})
+	if len(targets) <= 0 {
+		return 0
+	}
+
+	var n uint64
+
+	loadPace(options.QueryRate, stopCh, func() {
+		target := targets[int(n)%len(targets)]
+		t := time.Now()
+		err := target.pindex.Dest.Query(target.pindex,
+			[]byte(options.Query), ioutil.Discard, nil)
+		query[target.node].record(time.Since(t), err)
+		n++
+	})
+
+	return n
+}
+
+// loadPace invokes f at the rate per second until the stopCh is
+// closed, catching up after any slow invocations.
+func loadPace(rate int, stopCh chan struct{}, f func()) {
+	start := time.Now()
+
+	for i := 0; ; {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		due := int(time.Since(start).Seconds() * float64(rate))
+		if i >= due {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		for ; i < due; i++ {
+			f()
+		}
+	}
+}
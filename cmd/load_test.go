@@ -0,0 +1,69 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blugelabs/cbgt"
+)
+
+func TestRunLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cmd")
+	defer os.RemoveAll(dir)
+
+	options := DefaultLoadOptions()
+	options.DataDir = dir
+	options.Nodes = 2
+	options.Indexes = 2
+	options.IndexType = "counting"
+	options.SourceParams = `{"numPartitions":4}`
+	options.PlanParams.MaxPartitionsPerPIndex = 2
+	options.Rate = 500
+	options.QueryRate = 20
+	options.Duration = 200 * time.Millisecond
+	options.Log = cbgt.NewStdLibLog(ioutil.Discard, "", log.LstdFlags)
+
+	report, err := RunLoad(options)
+	if err != nil {
+		t.Fatalf("expected RunLoad() to work, err: %v", err)
+	}
+	if report.Mutations <= 0 || report.Queries <= 0 || len(report.Nodes) != 2 {
+		t.Errorf("expected mutations and queries, got: %#v", report)
+	}
+
+	var pindexes int
+	var ingest, queries uint64
+	for _, node := range report.Nodes {
+		pindexes += node.PIndexes
+		ingest += node.Ingest.Count
+		queries += node.Query.Count
+		if node.Ingest.Errs != 0 || node.Ingest.P50 > node.Ingest.Max {
+			t.Errorf("unexpected ingest latencies: %#v", node.Ingest)
+		}
+	}
+	if pindexes != 4 || ingest != report.Mutations ||
+		queries != report.Queries {
+		t.Errorf("expected the nodes to add up, pindexes: %d,"+
+			" ingest: %d, queries: %d, report: %#v",
+			pindexes, ingest, queries, report)
+	}
+
+	options.SourceType = "not-a-source"
+	if _, err = RunLoad(options); err == nil {
+		t.Errorf("expected err on an unknown sourceType")
+	}
+}
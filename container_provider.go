@@ -0,0 +1,170 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A ContainerProvider derives a node's '/' separated containment
+// path, such as "region/zone", from its environment.  The result is
+// used as the Manager's container, which feeds the rack-awareness
+// (node hierarchy) logic of the planner.
+type ContainerProvider interface {
+	Container() (string, error)
+}
+
+// ContainerProviders is a global registry of the available container
+// providers, keyed by name.  It should be immutable after startup.
+var ContainerProviders = map[string]ContainerProvider{
+	"ec2": &EC2ContainerProvider{},
+	"gcp": &GCPContainerProvider{},
+}
+
+// RegisterContainerProvider is invoked at init/startup time to
+// register a ContainerProvider.
+func RegisterContainerProvider(name string, p ContainerProvider) {
+	ContainerProviders[name] = p
+}
+
+// ContainerFromProviders returns the container from the first of the
+// named providers that succeeds.
+func ContainerFromProviders(names []string) (string, error) {
+	var errs []string
+	for _, name := range names {
+		p := ContainerProviders[name]
+		if p == nil {
+			errs = append(errs, fmt.Sprintf("%s: unknown provider", name))
+			continue
+		}
+
+		container, err := p.Container()
+		if err == nil && container != "" {
+			return container, nil
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+	}
+
+	return "", fmt.Errorf("container_provider: no container,"+
+		" errs: %s", strings.Join(errs, "; "))
+}
+
+// ------------------------------------------------------------------------
+
+// containerProviderTimeout bounds metadata requests, since metadata
+// endpoints are unreachable when not running on that cloud.
+const containerProviderTimeout = 2 * time.Second
+
+func metadataGet(httpClient *http.Client, method, url string,
+	headers map[string]string) (string, error) {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: containerProviderTimeout}
+	}
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("container_provider: %s %s, status: %d",
+			method, url, resp.StatusCode)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+// EC2ContainerProvider derives "region/availabilityZone" from the
+// EC2 instance metadata service, using IMDSv2 session tokens.
+type EC2ContainerProvider struct {
+	BaseURL    string // Defaults to "http://169.254.169.254".
+	HTTPClient *http.Client
+}
+
+func (p *EC2ContainerProvider) Container() (string, error) {
+	baseURL := p.BaseURL
+	if baseURL == "" {
+		baseURL = "http://169.254.169.254"
+	}
+
+	token, err := metadataGet(p.HTTPClient, "PUT", baseURL+"/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return "", err
+	}
+
+	headers := map[string]string{"X-aws-ec2-metadata-token": token}
+
+	region, err := metadataGet(p.HTTPClient, "GET",
+		baseURL+"/latest/meta-data/placement/region", headers)
+	if err != nil {
+		return "", err
+	}
+
+	zone, err := metadataGet(p.HTTPClient, "GET",
+		baseURL+"/latest/meta-data/placement/availability-zone", headers)
+	if err != nil {
+		return "", err
+	}
+
+	return region + "/" + zone, nil
+}
+
+// GCPContainerProvider derives "region/zone" from the GCE metadata
+// server.
+type GCPContainerProvider struct {
+	BaseURL    string // Defaults to "http://metadata.google.internal".
+	HTTPClient *http.Client
+}
+
+func (p *GCPContainerProvider) Container() (string, error) {
+	baseURL := p.BaseURL
+	if baseURL == "" {
+		baseURL = "http://metadata.google.internal"
+	}
+
+	// Ex: "projects/123456789/zones/us-central1-a".
+	zone, err := metadataGet(p.HTTPClient, "GET",
+		baseURL+"/computeMetadata/v1/instance/zone",
+		map[string]string{"Metadata-Flavor": "Google"})
+	if err != nil {
+		return "", err
+	}
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+
+	// A zone is named after its region, like "us-central1-a".
+	i := strings.LastIndex(zone, "-")
+	if i <= 0 {
+		return "", fmt.Errorf("container_provider: gcp, unexpected"+
+			" zone: %q", zone)
+	}
+
+	return zone[:i] + "/" + zone, nil
+}
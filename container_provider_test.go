@@ -0,0 +1,72 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContainerProviders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/latest/api/token":
+				w.Write([]byte("tok"))
+			case "/latest/meta-data/placement/region":
+				if r.Header.Get("X-aws-ec2-metadata-token") != "tok" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte("us-east-1"))
+			case "/latest/meta-data/placement/availability-zone":
+				w.Write([]byte("us-east-1b\n"))
+			case "/computeMetadata/v1/instance/zone":
+				if r.Header.Get("Metadata-Flavor") != "Google" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Write([]byte("projects/123/zones/us-central1-a"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+
+	c, err := (&EC2ContainerProvider{BaseURL: server.URL}).Container()
+	if err != nil || c != "us-east-1/us-east-1b" {
+		t.Errorf("unexpected ec2 container: %q, err: %v", c, err)
+	}
+
+	c, err = (&GCPContainerProvider{BaseURL: server.URL}).Container()
+	if err != nil || c != "us-central1/us-central1-a" {
+		t.Errorf("unexpected gcp container: %q, err: %v", c, err)
+	}
+
+	RegisterContainerProvider("test-bad",
+		&GCPContainerProvider{BaseURL: server.URL + "/nope"})
+	RegisterContainerProvider("test-good",
+		&EC2ContainerProvider{BaseURL: server.URL})
+	defer delete(ContainerProviders, "test-bad")
+	defer delete(ContainerProviders, "test-good")
+
+	c, err = ContainerFromProviders([]string{"unknown", "test-bad", "test-good"})
+	if err != nil || c != "us-east-1/us-east-1b" {
+		t.Errorf("expected fallback to test-good, got: %q, err: %v", c, err)
+	}
+
+	_, err = ContainerFromProviders([]string{"test-bad"})
+	if err == nil {
+		t.Errorf("expected err when all providers fail")
+	}
+}
@@ -17,7 +17,6 @@ import (
 	"math"
 	"reflect"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/blugelabs/blance"
@@ -101,8 +100,40 @@ type PlanParams struct {
 	// {"replica":[{"includeLevel":1,"excludeLevel":0}]}
 	// Try to put the first replica on a different rack...
 	// {"replica":[{"includeLevel":2,"excludeLevel":1}]}
+	//
+	// The levels count up from a node through the containers of its
+	// NodeDef.Container, where level 0 is the node, level 1 is its
+	// rack (or server group), level 2 the rack's datacenter, etc.
+	// The i-th rule of the "replica" state applies to the i-th
+	// replica, whose candidates are the nodes under the same level
+	// IncludeLevel ancestor as the primary, but not under the same
+	// level ExcludeLevel ancestor, so ExcludeLevel must be less than
+	// IncludeLevel.  Only the "replica" state has rules, see
+	// ValidateHierarchyRules().  When a rule has no candidates in the
+	// current topology, the planner falls back to any node and
+	// reports a plan warning.  When there are no HierarchyRules but
+	// the nodes have containers, the planner applies the different
+	// rack rule above, see IndexHierarchyRules().  The HierarchyRules
+	// are not applied with the PrimaryNodeTags or ReplicaNodeTags.
 	HierarchyRules blance.HierarchyRules `json:"hierarchyRules,omitempty"`
 
+	// PlacementPolicy optionally places the PIndexes over a node
+	// topology of any depth, such as region/zone/rack, as an
+	// alternative to the lower level HierarchyRules.  See
+	// PlacementPolicy.
+	PlacementPolicy *PlacementPolicy `json:"placementPolicy,omitempty"`
+
+	// PrimaryNodeTags and ReplicaNodeTags optionally restrict the
+	// primary and the replica PIndexes to the nodes having any of the
+	// given tags, such as for clusters with separate ingest and serve
+	// tiers.  For example, with PrimaryNodeTags of ["indexer"] and
+	// ReplicaNodeTags of ["query"], the primaries are assigned to the
+	// "indexer" tagged nodes and the replicas to the "query" tagged
+	// nodes.  A node without any tags matches any tag.  Empty means
+	// any node.
+	PrimaryNodeTags []string `json:"primaryNodeTags,omitempty"`
+	ReplicaNodeTags []string `json:"replicaNodeTags,omitempty"`
+
 	// NodePlanParams allows users to specify per-node input to the
 	// planner, such as whether PIndexes assigned to different nodes
 	// can be readable or writable.  Keyed by node UUID.  Value is
@@ -117,11 +148,34 @@ type PlanParams struct {
 	// have more entries (higher weight) than other index partitions.
 	PIndexWeights map[string]int `json:"pindexWeights,omitempty"`
 
+	// PIndexPins optionally pins PIndexes to nodes, such as for data
+	// locality with co-located services.  The planner and rebalancer
+	// assign a pinned PIndex to its pinned nodes, overriding the
+	// computed assignment, and report conflicting or unsatisfiable
+	// pins as plan warnings.  See PIndexPin.
+	PIndexPins []*PIndexPin `json:"pindexPins,omitempty"`
+
 	// PlanFrozen means the planner should not change the previous
 	// plan for an index, even if as nodes join or leave and even if
 	// there was no previous plan.  Defaults to false (allow
 	// re-planning).
 	PlanFrozen bool `json:"planFrozen,omitempty"`
+
+	// SourceUUIDChangePolicy controls what happens when the index's
+	// source is recreated with a different sourceUUID.  Valid values
+	// are "" (only report), "reset", "pause" and "readOnly".  See
+	// SourceUUIDChangeReset and friends.
+	SourceUUIDChangePolicy string `json:"sourceUUIDChangePolicy,omitempty"`
+
+	// IngestLimit optionally bounds the rate at which each node's
+	// feeds send mutations to the index's pindexes on that node.  See
+	// IngestLimit.
+	IngestLimit *IngestLimit `json:"ingestLimit,omitempty"`
+
+	// IndexTemplate optionally names the IndexTemplate whose default
+	// planParams and sourceParams an index definition inherits, where
+	// the index's own values take precedence.  See IndexTemplate.
+	IndexTemplate string `json:"indexTemplate,omitempty"`
 }
 
 // A NodePlanParam defines whether a particular node can service a
@@ -151,6 +205,21 @@ type NodeDef struct {
 	Weight      int      `json:"weight"`
 	Extras      string   `json:"extras"`
 
+	// NoAccept is true while the node refuses new pindex assignments,
+	// such as while it's low on disk space, so that the planner
+	// assigns them to other nodes instead.  See DiskSpaceLoop().
+	NoAccept bool `json:"noAccept,omitempty"`
+
+	// Cordoned is true while a rolling restart has drained the node,
+	// so that the queries prefer the replicas on other nodes.  See
+	// StartRollingRestart().
+	Cordoned bool `json:"cordoned,omitempty"`
+
+	// MaxPIndexes, when > 0, caps the number of pindexes that the
+	// planner assigns to the node, overriding the "maxPIndexesPerNode"
+	// cluster option.  See the "nodeMaxPIndexes" manager option.
+	MaxPIndexes int `json:"maxPIndexes,omitempty"`
+
 	m            sync.Mutex
 	extrasParsed map[string]interface{}
 }
@@ -233,6 +302,12 @@ type PlanPIndexNode struct {
 	CanRead  bool `json:"canRead"`
 	CanWrite bool `json:"canWrite"`
 	Priority int  `json:"priority"` // Lower is higher priority, 0 is highest.
+
+	// MinSeqs, when non-empty, is a consistency barrier on a node
+	// that was newly promoted during a rebalance, so that queries
+	// don't observe the node's pindex before it has caught up to the
+	// former primary.  Keyed by source partition, value is seq.
+	MinSeqs map[string]uint64 `json:"minSeqs,omitempty"`
 }
 
 // PlanPIndexNodeCanRead returns true if PlanPIndexNode.CanRead is
@@ -325,6 +400,12 @@ const NODE_DEFS_KEY = "nodeDefs"  // NODE_DEFS_KEY is used for Cfg access.
 const NODE_DEFS_KNOWN = "known"   // NODE_DEFS_KNOWN is used for Cfg access.
 const NODE_DEFS_WANTED = "wanted" // NODE_DEFS_WANTED is used for Cfg access.
 
+// NODE_DEFS_STANDBY is used for Cfg access to the warm standby nodes,
+// which are known and running, but are not wanted, so the planner
+// assigns them no pindexes until they're promoted.  See
+// PromoteStandbyNodes().
+const NODE_DEFS_STANDBY = "standby"
+
 // Returns an initialized NodeDefs.
 func NewNodeDefs(version string) *NodeDefs {
 	return &NodeDefs{
@@ -443,18 +524,32 @@ func removeNodeDef(cfg Cfg, kind, uuid, version string, force bool) error {
 // ------------------------------------------------------------------------
 
 // UnregisterNodes removes the given nodes (by their UUID) from the
-// nodes wanted & known cfg entries.
+// nodes wanted, standby & known cfg entries.
 func UnregisterNodes(cfg Cfg, version string, nodeUUIDs []string) error {
 	return UnregisterNodesWithRetries(cfg, version, nodeUUIDs, 10)
 }
 
 // UnregisterNodesWithRetries removes the given nodes (by their UUID)
-// from the nodes wanted & known cfg entries, and performs retries a
-// max number of times if there were CAS conflict errors.
+// from the nodes wanted, standby & known cfg entries, and performs
+// retries a max number of times if there were CAS conflict errors.
+// While the OpQuorum is enabled, the OP_QUORUM_UNREGISTER_NODES of the
+// nodes must be confirmed first.
 func UnregisterNodesWithRetries(cfg Cfg, version string, nodeUUIDs []string,
+	maxTries int) error {
+	err := CheckOpQuorum(cfg, OP_QUORUM_UNREGISTER_NODES,
+		OpQuorumNodesTarget(nodeUUIDs))
+	if err != nil {
+		return err
+	}
+
+	return unregisterNodesWithRetries(cfg, version, nodeUUIDs, maxTries)
+}
+
+func unregisterNodesWithRetries(cfg Cfg, version string, nodeUUIDs []string,
 	maxTries int) error {
 	for _, nodeUUID := range nodeUUIDs {
-		for _, kind := range []string{NODE_DEFS_WANTED, NODE_DEFS_KNOWN} {
+		for _, kind := range []string{NODE_DEFS_WANTED,
+			NODE_DEFS_STANDBY, NODE_DEFS_KNOWN} {
 		LOOP_TRIES:
 			for tries := 0; tries < maxTries; tries++ {
 				err := CfgRemoveNodeDef(cfg, kind, nodeUUID, version)
@@ -476,6 +571,80 @@ func UnregisterNodesWithRetries(cfg Cfg, version string, nodeUUIDs []string,
 	return nil
 }
 
+// PromoteStandbyNodes moves the given warm standby nodes (by their
+// UUID) into the nodes wanted cfg entry, so that the planner, a
+// failover or a rebalance can immediately start to assign pindexes to
+// them, without the usual join lag.  An error is returned if a node
+// isn't a standby node, unless it's already wanted.
+func PromoteStandbyNodes(cfg Cfg, version string, nodeUUIDs []string) error {
+	for _, nodeUUID := range nodeUUIDs {
+		nodeDefsStandby, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_STANDBY)
+		if err != nil {
+			return err
+		}
+
+		var nodeDef *NodeDef
+		if nodeDefsStandby != nil {
+			nodeDef = nodeDefsStandby.NodeDefs[nodeUUID]
+		}
+
+		retry := NewCASRetry(CfgNodeDefsKey(NODE_DEFS_WANTED))
+		for tries := 0; ; tries++ {
+			if tries >= 100 {
+				return fmt.Errorf("defs: PromoteStandbyNodes,"+
+					" nodeUUID: %s, too many tries", nodeUUID)
+			}
+
+			nodeDefsWanted, cas, err := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+			if err != nil {
+				return err
+			}
+			if nodeDefsWanted == nil {
+				nodeDefsWanted = NewNodeDefs(version)
+			}
+			if nodeDefsWanted.NodeDefs[nodeUUID] != nil {
+				break // Already wanted.
+			}
+			if nodeDef == nil {
+				return fmt.Errorf("defs: PromoteStandbyNodes,"+
+					" not a standby node, nodeUUID: %s", nodeUUID)
+			}
+
+			nodeDefsWanted.UUID = NewUUID()
+			nodeDefsWanted.NodeDefs[nodeUUID] = nodeDef
+			nodeDefsWanted.ImplVersion = version
+
+			_, err = CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefsWanted, cas)
+			if err != nil {
+				if _, ok := err.(*CfgCASError); ok {
+					retry.Conflict()
+					continue
+				}
+				return err
+			}
+			retry.Done(nil)
+			break
+		}
+
+		retry = NewCASRetry(CfgNodeDefsKey(NODE_DEFS_STANDBY))
+		for tries := 0; ; tries++ {
+			err = CfgRemoveNodeDef(cfg, NODE_DEFS_STANDBY, nodeUUID, version)
+			if _, ok := err.(*CfgCASError); ok && tries < 100 {
+				retry.Conflict()
+				continue
+			}
+			retry.Done(err)
+			if err != nil {
+				return fmt.Errorf("defs: PromoteStandbyNodes,"+
+					" nodeUUID: %s, remove standby, err: %v", nodeUUID, err)
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
 // ------------------------------------------------------------------------
 
 // PLAN_PINDEXES_KEY is used for Cfg access.
@@ -505,21 +674,78 @@ func CopyPlanPIndexes(planPIndexes *PlanPIndexes,
 	return r
 }
 
+// Clone returns a copy of the planPIndexes that structurally shares
+// the PlanPIndex children, so that the copy's maps may be modified
+// without affecting the original.  A shared PlanPIndex must be treated
+// as immutable, so to modify one, replace it in the copy with its
+// PlanPIndex.Clone() first.
+func (p *PlanPIndexes) Clone() *PlanPIndexes {
+	if p == nil {
+		return nil
+	}
+
+	rv := *p
+
+	rv.PlanPIndexes = make(map[string]*PlanPIndex, len(p.PlanPIndexes))
+	for name, planPIndex := range p.PlanPIndexes {
+		rv.PlanPIndexes[name] = planPIndex
+	}
+
+	if p.Warnings != nil {
+		rv.Warnings = make(map[string][]string, len(p.Warnings))
+		for name, warnings := range p.Warnings {
+			rv.Warnings[name] = warnings
+		}
+	}
+
+	return &rv
+}
+
+// Clone returns a copy of the planPIndex, including its Nodes, which
+// may be modified without affecting the original.
+func (p *PlanPIndex) Clone() *PlanPIndex {
+	if p == nil {
+		return nil
+	}
+
+	rv := *p
+
+	if p.Nodes != nil {
+		rv.Nodes = make(map[string]*PlanPIndexNode, len(p.Nodes))
+		for nodeUUID, planPIndexNode := range p.Nodes {
+			n := *planPIndexNode
+			rv.Nodes[nodeUUID] = &n
+		}
+	}
+
+	return &rv
+}
+
 // Retrieves PlanPIndexes from a Cfg provider.
 func CfgGetPlanPIndexes(cfg Cfg) (*PlanPIndexes, uint64, error) {
 	v, cas, err := cfg.Get(PLAN_PINDEXES_KEY, 0)
 	if err != nil {
 		return nil, cas, err
 	}
+	rv, err := parsePlanPIndexes(v)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// parsePlanPIndexes parses the PlanPIndexes value of a Cfg, where a
+// nil value means no PlanPIndexes.
+func parsePlanPIndexes(v []byte) (*PlanPIndexes, error) {
 	if v == nil {
-		return nil, cas, nil
+		return nil, nil
 	}
 	rv := &PlanPIndexes{}
-	err = json.Unmarshal(v, rv)
+	err := json.Unmarshal(v, rv)
 	if err != nil {
-		return nil, cas, err
+		return nil, err
 	}
-	return rv, cas, nil
+	return rv, nil
 }
 
 // Updates PlanPIndexes on a Cfg provider.
@@ -672,28 +898,11 @@ func IndexPartitionSettings(mgr *Manager) *PartitionSettings {
 // IsFeatureSupportedByCluster checks whether the given feature is
 // supported across the cluster/given NodeDefs
 func IsFeatureSupportedByCluster(feature string, nodeDefs *NodeDefs) bool {
-	if nodeDefs == nil ||
-		(nodeDefs != nil && len(nodeDefs.NodeDefs) == 0) {
+	if nodeDefs == nil || len(nodeDefs.NodeDefs) == 0 {
 		return false
 	}
-	for _, v1 := range nodeDefs.NodeDefs {
-		featureEnabled := false
-		if v1.Extras != "" {
-			extras := map[string]string{}
-			err := json.Unmarshal([]byte(v1.Extras), &extras)
-			if err != nil {
-				return false
-			}
-
-			features := strings.Split(extras["features"], ",")
-			for _, f := range features {
-				if f == feature {
-					featureEnabled = true
-					break
-				}
-			}
-		}
-		if !featureEnabled {
+	for _, nodeDef := range nodeDefs.NodeDefs {
+		if !StringsToMap(NodeDefFeatures(nodeDef))[feature] {
 			return false
 		}
 	}
@@ -118,6 +118,46 @@ func TestPlanPIndexes(t *testing.T) {
 	}
 }
 
+func TestPlanPIndexesClone(t *testing.T) {
+	var nilPlan *PlanPIndexes
+	if nilPlan.Clone() != nil {
+		t.Errorf("expected nil clone of nil")
+	}
+
+	p := NewPlanPIndexes("1.2.3")
+	p.PlanPIndexes["a"] = &PlanPIndex{
+		Name:      "a",
+		IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{
+			"n0": {CanRead: true, CanWrite: true, Priority: 0},
+		},
+	}
+	p.Warnings["x"] = []string{"w"}
+
+	c := p.Clone()
+	if !reflect.DeepEqual(p, c) {
+		t.Errorf("expected clone to equal original")
+	}
+	if c.PlanPIndexes["a"] != p.PlanPIndexes["a"] {
+		t.Errorf("expected planPIndex to be shared")
+	}
+
+	c.PlanPIndexes["b"] = &PlanPIndex{Name: "b"}
+	delete(c.Warnings, "x")
+	if len(p.PlanPIndexes) != 1 || len(p.Warnings) != 1 {
+		t.Errorf("expected original maps to be unchanged")
+	}
+
+	pp := c.PlanPIndexes["a"].Clone()
+	pp.Nodes["n0"].Priority = 1
+	pp.Nodes["n1"] = &PlanPIndexNode{}
+	c.PlanPIndexes["a"] = pp
+	if p.PlanPIndexes["a"].Nodes["n0"].Priority != 0 ||
+		len(p.PlanPIndexes["a"].Nodes) != 1 {
+		t.Errorf("expected original planPIndex to be unchanged")
+	}
+}
+
 func TestSamePlanPIndexes(t *testing.T) {
 	a := NewPlanPIndexes("0.0.1")
 	b := NewPlanPIndexes("0.0.1")
@@ -0,0 +1,207 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// DestCheckpointer is an optional interface of a Dest for the
+// two-phase checkpoint protocol between a Feed and a Dest...
+//
+// 1. At the end of a snapshot, the Feed proposes the snapshot's end
+// seq via CheckpointPropose().
+//
+// 2. The Dest invokes the ack func, exactly once, after all the
+// mutations of the partition up to the seq are durably persisted, or
+// with an error if they can't be.
+//
+// 3. Only then does the Feed advance the partition's opaque via
+// OpaqueSet(), so that a restarted Feed resumes from a seq whose
+// mutations the Dest has persisted.
+//
+// A Feed proposes a partition's next checkpoint only after the ack
+// of its previous checkpoint, so that crash recovery never replays
+// more than one snapshot worth of data.  The ack may be invoked from
+// any goroutine, including from within CheckpointPropose(), and
+// should not block.  Feeds should use a FeedCheckpointer rather than
+// invoking CheckpointPropose() directly.
+type DestCheckpointer interface {
+	CheckpointPropose(partition string, seq uint64,
+		ack func(err error)) error
+}
+
+// DestCheckpointPropose proposes a checkpoint to a Dest, where a Dest
+// that isn't a DestCheckpointer is acked right away, as its OpaqueSet()
+// is all the durability that it offers.  Dest wrappers use it to
+// forward the protocol.
+func DestCheckpointPropose(dest Dest, partition string, seq uint64,
+	ack func(err error)) error {
+	if dc, ok := dest.(DestCheckpointer); ok {
+		return dc.CheckpointPropose(partition, seq, ack)
+	}
+	ack(nil)
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// A FeedCheckpointer is the Feed side of the DestCheckpointer
+// protocol, which tracks the proposed, unacknowledged checkpoint of
+// each partition.  Its methods for a partition should be invoked from
+// the goroutine that sends the partition's mutations, so that the
+// OpaqueSet() calls are in-stream.
+type FeedCheckpointer struct {
+	m       sync.Mutex
+	pending map[string]*feedCheckpoint // Keyed by partition.
+
+	stats FeedCheckpointerStats
+}
+
+// FeedCheckpointerStats are the counters of a FeedCheckpointer.
+type FeedCheckpointerStats struct {
+	TotPropose    uint64 `json:"totPropose"`
+	TotProposeErr uint64 `json:"totProposeErr"`
+	TotAck        uint64 `json:"totAck"`
+	TotAckErr     uint64 `json:"totAckErr"`
+	TotAckWait    uint64 `json:"totAckWait"` // Waits for a previous ack.
+}
+
+type feedCheckpoint struct {
+	seq    uint64
+	opaque []byte
+	doneCh chan struct{}
+	err    error // Valid after the doneCh is closed.
+}
+
+// NewFeedCheckpointer returns a ready-to-use FeedCheckpointer.
+func NewFeedCheckpointer() *FeedCheckpointer {
+	return &FeedCheckpointer{pending: map[string]*feedCheckpoint{}}
+}
+
+// Stats returns a copy of the counters.
+func (c *FeedCheckpointer) Stats() FeedCheckpointerStats {
+	var rv FeedCheckpointerStats
+	AtomicCopyMetrics(&c.stats, &rv, nil)
+	return rv
+}
+
+// Checkpoint proposes the end seq of a partition's snapshot, whose
+// mutations were already sent to the dest, and arranges for the
+// partition's opaque to advance to the opaque once the dest acks.  It
+// first waits for the ack of the partition's previous checkpoint,
+// which it then advances, or until the cancelCh is readable or
+// closed.  An error, such as a failed ack, means that the feed should
+// restart from the partition's last opaque.
+func (c *FeedCheckpointer) Checkpoint(dest Dest, partition string,
+	seq uint64, opaque []byte, cancelCh <-chan bool) error {
+	err := c.Wait(dest, partition, cancelCh)
+	if err != nil {
+		return err
+	}
+
+	cp := &feedCheckpoint{
+		seq:    seq,
+		opaque: append([]byte(nil), opaque...),
+		doneCh: make(chan struct{}),
+	}
+
+	var once sync.Once
+
+	c.m.Lock()
+	c.pending[partition] = cp
+	c.m.Unlock()
+
+	atomic.AddUint64(&c.stats.TotPropose, 1)
+
+	err = DestCheckpointPropose(dest, partition, seq, func(err error) {
+		once.Do(func() {
+			if err != nil {
+				atomic.AddUint64(&c.stats.TotAckErr, 1)
+			} else {
+				atomic.AddUint64(&c.stats.TotAck, 1)
+			}
+			cp.err = err
+			close(cp.doneCh)
+		})
+	})
+	if err != nil {
+		atomic.AddUint64(&c.stats.TotProposeErr, 1)
+
+		c.m.Lock()
+		delete(c.pending, partition)
+		c.m.Unlock()
+
+		return fmt.Errorf("dest_checkpoint: propose, partition: %s,"+
+			" seq: %d, err: %v", partition, seq, err)
+	}
+
+	// Advance right away when the dest already acked, as for a
+	// dest that isn't a DestCheckpointer.
+	select {
+	case <-cp.doneCh:
+		return c.Wait(dest, partition, cancelCh)
+	default:
+		return nil
+	}
+}
+
+// Wait waits for the ack of a partition's proposed checkpoint, if
+// any, and then advances the partition's opaque, such as before a
+// feed closes.
+func (c *FeedCheckpointer) Wait(dest Dest, partition string,
+	cancelCh <-chan bool) error {
+	c.m.Lock()
+	cp := c.pending[partition]
+	c.m.Unlock()
+
+	if cp == nil {
+		return nil
+	}
+
+	select {
+	case <-cp.doneCh:
+	default:
+		atomic.AddUint64(&c.stats.TotAckWait, 1)
+
+		select {
+		case <-cp.doneCh:
+		case <-cancelCh:
+			return fmt.Errorf("dest_checkpoint: cancelled,"+
+				" partition: %s, seq: %d", partition, cp.seq)
+		}
+	}
+
+	c.m.Lock()
+	delete(c.pending, partition)
+	c.m.Unlock()
+
+	if cp.err != nil {
+		return fmt.Errorf("dest_checkpoint: ack, partition: %s,"+
+			" seq: %d, err: %v", partition, cp.seq, cp.err)
+	}
+
+	return dest.OpaqueSet(partition, cp.opaque)
+}
+
+// Pending returns the seq of a partition's proposed checkpoint whose
+// opaque hasn't advanced yet, if any.
+func (c *FeedCheckpointer) Pending(partition string) (uint64, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if cp := c.pending[partition]; cp != nil {
+		return cp.seq, true
+	}
+	return 0, false
+}
@@ -0,0 +1,167 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// checkpointTestDest holds the acks of its proposed checkpoints until
+// the test acks them, and records its opaques.
+type checkpointTestDest struct {
+	TestDest
+
+	m       sync.Mutex
+	acks    []func(err error)
+	opaques []string
+}
+
+func (d *checkpointTestDest) CheckpointPropose(partition string,
+	seq uint64, ack func(err error)) error {
+	d.m.Lock()
+	d.acks = append(d.acks, ack)
+	d.m.Unlock()
+	return nil
+}
+
+func (d *checkpointTestDest) OpaqueSet(partition string,
+	value []byte) error {
+	d.m.Lock()
+	d.opaques = append(d.opaques, string(value))
+	d.m.Unlock()
+	return nil
+}
+
+func (d *checkpointTestDest) ack(i int, err error) {
+	d.m.Lock()
+	ack := d.acks[i]
+	d.m.Unlock()
+	ack(err)
+}
+
+func (d *checkpointTestDest) getOpaques() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return append([]string(nil), d.opaques...)
+}
+
+func TestFeedCheckpointer(t *testing.T) {
+	dest := &checkpointTestDest{}
+	c := NewFeedCheckpointer()
+
+	err := c.Checkpoint(dest, "0", 10, []byte("s10"), nil)
+	if err != nil {
+		t.Fatalf("expected Checkpoint to work, err: %v", err)
+	}
+	if seq, ok := c.Pending("0"); !ok || seq != 10 {
+		t.Errorf("expected a pending checkpoint, got: %d, %v", seq, ok)
+	}
+	if len(dest.getOpaques()) != 0 {
+		t.Errorf("expected no opaque before the ack")
+	}
+
+	// The next checkpoint waits for the previous ack.
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- c.Checkpoint(dest, "0", 20, []byte("s20"), nil)
+	}()
+
+	dest.ack(0, nil)
+
+	if err = <-doneCh; err != nil {
+		t.Fatalf("expected Checkpoint to work, err: %v", err)
+	}
+	if exp := []string{"s10"}; !reflect.DeepEqual(dest.getOpaques(), exp) {
+		t.Errorf("expected opaques: %v, got: %v", exp, dest.getOpaques())
+	}
+
+	dest.ack(1, nil)
+
+	err = c.Wait(dest, "0", nil)
+	if err != nil {
+		t.Errorf("expected Wait to work, err: %v", err)
+	}
+	if exp := []string{"s10", "s20"}; !reflect.DeepEqual(dest.getOpaques(), exp) {
+		t.Errorf("expected opaques: %v, got: %v", exp, dest.getOpaques())
+	}
+	if _, ok := c.Pending("0"); ok {
+		t.Errorf("expected no pending checkpoint")
+	}
+
+	// A failed ack doesn't advance the opaque.
+	err = c.Checkpoint(dest, "0", 30, []byte("s30"), nil)
+	if err != nil {
+		t.Fatalf("expected Checkpoint to work, err: %v", err)
+	}
+	dest.ack(2, fmt.Errorf("disk full"))
+	err = c.Checkpoint(dest, "0", 40, []byte("s40"), nil)
+	if err == nil {
+		t.Errorf("expected the failed ack err")
+	}
+	if exp := []string{"s10", "s20"}; !reflect.DeepEqual(dest.getOpaques(), exp) {
+		t.Errorf("expected opaques: %v, got: %v", exp, dest.getOpaques())
+	}
+
+	// A cancelled wait.
+	err = c.Checkpoint(dest, "0", 50, []byte("s50"), nil)
+	if err != nil {
+		t.Fatalf("expected Checkpoint to work, err: %v", err)
+	}
+	cancelCh := make(chan bool)
+	close(cancelCh)
+	err = c.Checkpoint(dest, "0", 60, []byte("s60"), cancelCh)
+	if err == nil {
+		t.Errorf("expected a cancelled err")
+	}
+
+	stats := c.Stats()
+	if stats.TotPropose != 4 || stats.TotAck != 2 || stats.TotAckErr != 1 ||
+		stats.TotAckWait < 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestFeedCheckpointerNonCheckpointer(t *testing.T) {
+	var opaques []string
+
+	dest := &DestForwarder{&FanInDestProvider{
+		&opaqueTestDest{opaques: &opaques},
+	}}
+
+	c := NewFeedCheckpointer()
+
+	// A dest that isn't a DestCheckpointer advances right away, even
+	// through a wrapper.
+	err := c.Checkpoint(dest, "0", 10, []byte("s10"), nil)
+	if err != nil {
+		t.Fatalf("expected Checkpoint to work, err: %v", err)
+	}
+	if exp := []string{"s10"}; !reflect.DeepEqual(opaques, exp) {
+		t.Errorf("expected opaques: %v, got: %v", exp, opaques)
+	}
+	if _, ok := c.Pending("0"); ok {
+		t.Errorf("expected no pending checkpoint")
+	}
+}
+
+type opaqueTestDest struct {
+	TestDest
+	opaques *[]string
+}
+
+func (d *opaqueTestDest) OpaqueSet(partition string, value []byte) error {
+	*d.opaques = append(*d.opaques, string(value))
+	return nil
+}
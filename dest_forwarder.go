@@ -123,6 +123,16 @@ func (t *DestForwarder) RollbackEx(partition string,
 		" partition %s", partition)
 }
 
+func (t *DestForwarder) CheckpointPropose(partition string, seq uint64,
+	ack func(err error)) error {
+	dest, err := t.DestProvider.Dest(partition)
+	if err != nil {
+		return err
+	}
+
+	return DestCheckpointPropose(dest, partition, seq, ack)
+}
+
 func (t *DestForwarder) ConsistencyWait(partition, partitionUUID string,
 	consistencyLevel string,
 	consistencySeq uint64,
@@ -0,0 +1,282 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package destgrpc lets an index engine in another process, perhaps
+// written in another language, be a cbgt pindex backend.  A DestGRPC
+// is a cbgt.Dest that forwards its calls over gRPC to the engine,
+// which implements the Dest service of dest.proto.  A Go engine can
+// use the Server shim to serve its cbgt.Dest's.  The "grpc" pindex
+// type, whose indexParams have the addr of the engine, is registered
+// when this package is imported.
+package destgrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// DestGRPC is a cbgt.Dest and cbgt.PIndexImpl that forwards its
+// calls for a pindex over a gRPC connection.
+type DestGRPC struct {
+	conn      *grpc.ClientConn
+	pindex    string
+	closeConn bool
+
+	m      sync.Mutex
+	closed bool
+}
+
+// NewDestGRPC returns a DestGRPC that forwards the calls for a pindex
+// over a conn, which the caller still owns.
+func NewDestGRPC(conn *grpc.ClientConn, pindex string) *DestGRPC {
+	return &DestGRPC{conn: conn, pindex: pindex}
+}
+
+// DialDestGRPC dials the engine at an addr, without blocking, and
+// returns a DestGRPC that owns the connection, closing it on Close().
+func DialDestGRPC(addr, pindex string, opts ...grpc.DialOption) (
+	*DestGRPC, error) {
+	if len(opts) <= 0 {
+		opts = []grpc.DialOption{grpc.WithInsecure()}
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("destgrpc: dial, addr: %s, err: %v",
+			addr, err)
+	}
+	d := NewDestGRPC(conn, pindex)
+	d.closeConn = true
+	return d, nil
+}
+
+func (d *DestGRPC) invoke(ctx context.Context, method string,
+	in, out interface{}) error {
+	err := d.conn.Invoke(ctx, "/"+destServiceName+"/"+method, in, out)
+	if err != nil {
+		return fmt.Errorf("destgrpc: %s, pindex: %s, err: %v",
+			method, d.pindex, err)
+	}
+	return nil
+}
+
+// cancelContext returns a context that's cancelled when the cancelCh
+// is readable or closed, or when the returned cancel func is called.
+func cancelContext(cancelCh <-chan bool) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if cancelCh != nil {
+		go func() {
+			select {
+			case <-cancelCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// Close forwards the Close() and then closes the connection, if the
+// DestGRPC owns it.
+func (d *DestGRPC) Close() error {
+	d.m.Lock()
+	if d.closed {
+		d.m.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.m.Unlock()
+
+	err := d.invoke(context.Background(), "Close",
+		&CloseRequest{Pindex: d.pindex}, &Empty{})
+
+	if d.closeConn {
+		d.conn.Close()
+	}
+
+	return err
+}
+
+func (d *DestGRPC) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType cbgt.DestExtrasType, extras []byte) error {
+	return d.invoke(context.Background(), "DataUpdate",
+		&DataUpdateRequest{
+			Pindex:     d.pindex,
+			Partition:  partition,
+			Key:        key,
+			Seq:        seq,
+			Val:        val,
+			Cas:        cas,
+			ExtrasType: uint32(extrasType),
+			Extras:     extras,
+		}, &Empty{})
+}
+
+func (d *DestGRPC) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType cbgt.DestExtrasType, extras []byte) error {
+	return d.invoke(context.Background(), "DataDelete",
+		&DataDeleteRequest{
+			Pindex:     d.pindex,
+			Partition:  partition,
+			Key:        key,
+			Seq:        seq,
+			Cas:        cas,
+			ExtrasType: uint32(extrasType),
+			Extras:     extras,
+		}, &Empty{})
+}
+
+func (d *DestGRPC) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	return d.invoke(context.Background(), "SnapshotStart",
+		&SnapshotStartRequest{
+			Pindex:    d.pindex,
+			Partition: partition,
+			SnapStart: snapStart,
+			SnapEnd:   snapEnd,
+		}, &Empty{})
+}
+
+func (d *DestGRPC) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	out := &OpaqueGetResponse{}
+	err = d.invoke(context.Background(), "OpaqueGet",
+		&OpaqueGetRequest{Pindex: d.pindex, Partition: partition}, out)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(out.Value) <= 0 {
+		return nil, out.LastSeq, nil
+	}
+	return out.Value, out.LastSeq, nil
+}
+
+func (d *DestGRPC) OpaqueSet(partition string, value []byte) error {
+	return d.invoke(context.Background(), "OpaqueSet",
+		&OpaqueSetRequest{
+			Pindex:    d.pindex,
+			Partition: partition,
+			Value:     value,
+		}, &Empty{})
+}
+
+func (d *DestGRPC) Rollback(partition string, rollbackSeq uint64) error {
+	return d.invoke(context.Background(), "Rollback",
+		&RollbackRequest{
+			Pindex:      d.pindex,
+			Partition:   partition,
+			RollbackSeq: rollbackSeq,
+		}, &Empty{})
+}
+
+// ConsistencyWait forwards the wait, which is cancelled when the
+// cancelCh is readable or closed.  A wait that the engine reports as
+// not having reached the consistency is a cbgt.ErrorConsistencyWait.
+func (d *DestGRPC) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	ctx, cancel := cancelContext(cancelCh)
+	defer cancel()
+
+	out := &ConsistencyWaitResponse{}
+	err := d.invoke(ctx, "ConsistencyWait",
+		&ConsistencyWaitRequest{
+			Pindex:           d.pindex,
+			Partition:        partition,
+			PartitionUuid:    partitionUUID,
+			ConsistencyLevel: consistencyLevel,
+			ConsistencySeq:   consistencySeq,
+		}, out)
+	if err != nil {
+		if ctx.Err() != nil {
+			return &cbgt.ErrorConsistencyWait{
+				Err:    err,
+				Status: "cancelled",
+			}
+		}
+		return err
+	}
+
+	if out.Status == "" {
+		return nil
+	}
+
+	return &cbgt.ErrorConsistencyWait{
+		Err:    errors.New(out.Err),
+		Status: out.Status,
+		StartEndSeqs: map[string][]uint64{
+			partition: out.StartEndSeqs,
+		},
+	}
+}
+
+func (d *DestGRPC) Count(pindex *cbgt.PIndex,
+	cancelCh <-chan bool) (uint64, error) {
+	ctx, cancel := cancelContext(cancelCh)
+	defer cancel()
+
+	in := &CountRequest{Pindex: d.pindex}
+	if pindex != nil {
+		in.IndexName, in.IndexUuid = pindex.IndexName, pindex.IndexUUID
+	}
+
+	out := &CountResponse{}
+	err := d.invoke(ctx, "Count", in, out)
+	if err != nil {
+		return 0, err
+	}
+	return out.Count, nil
+}
+
+func (d *DestGRPC) Query(pindex *cbgt.PIndex, req []byte, w io.Writer,
+	cancelCh <-chan bool) error {
+	ctx, cancel := cancelContext(cancelCh)
+	defer cancel()
+
+	in := &QueryRequest{Pindex: d.pindex, Req: req}
+	if pindex != nil {
+		in.IndexName, in.IndexUuid = pindex.IndexName, pindex.IndexUUID
+	}
+
+	out := &QueryResponse{}
+	err := d.invoke(ctx, "Query", in, out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out.Res)
+	return err
+}
+
+func (d *DestGRPC) Stats(w io.Writer) error {
+	out := &StatsResponse{}
+	err := d.invoke(context.Background(), "Stats",
+		&StatsRequest{Pindex: d.pindex}, out)
+	if err != nil {
+		return err
+	}
+	if len(out.Stats) <= 0 {
+		_, err = w.Write(cbgt.JsonNULL)
+		return err
+	}
+	_, err = w.Write(out.Stats)
+	return err
+}
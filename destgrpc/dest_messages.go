@@ -0,0 +1,299 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package destgrpc
+
+// The messages and service descriptor of dest.proto, which are
+// maintained by hand, so that the build doesn't need protoc.  The
+// struct tags are the proto3 wire encoding of the messages.
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+type Empty struct{}
+
+func (m *Empty) Reset()         { *m = Empty{} }
+func (m *Empty) String() string { return proto.CompactTextString(m) }
+func (*Empty) ProtoMessage()    {}
+
+type DataUpdateRequest struct {
+	Pindex     string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+	Partition  string `protobuf:"bytes,2,opt,name=partition,proto3"`
+	Key        []byte `protobuf:"bytes,3,opt,name=key,proto3"`
+	Seq        uint64 `protobuf:"varint,4,opt,name=seq,proto3"`
+	Val        []byte `protobuf:"bytes,5,opt,name=val,proto3"`
+	Cas        uint64 `protobuf:"varint,6,opt,name=cas,proto3"`
+	ExtrasType uint32 `protobuf:"varint,7,opt,name=extras_type,json=extrasType,proto3"`
+	Extras     []byte `protobuf:"bytes,8,opt,name=extras,proto3"`
+}
+
+func (m *DataUpdateRequest) Reset()         { *m = DataUpdateRequest{} }
+func (m *DataUpdateRequest) String() string { return proto.CompactTextString(m) }
+func (*DataUpdateRequest) ProtoMessage()    {}
+
+type DataDeleteRequest struct {
+	Pindex     string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+	Partition  string `protobuf:"bytes,2,opt,name=partition,proto3"`
+	Key        []byte `protobuf:"bytes,3,opt,name=key,proto3"`
+	Seq        uint64 `protobuf:"varint,4,opt,name=seq,proto3"`
+	Cas        uint64 `protobuf:"varint,5,opt,name=cas,proto3"`
+	ExtrasType uint32 `protobuf:"varint,6,opt,name=extras_type,json=extrasType,proto3"`
+	Extras     []byte `protobuf:"bytes,7,opt,name=extras,proto3"`
+}
+
+func (m *DataDeleteRequest) Reset()         { *m = DataDeleteRequest{} }
+func (m *DataDeleteRequest) String() string { return proto.CompactTextString(m) }
+func (*DataDeleteRequest) ProtoMessage()    {}
+
+type SnapshotStartRequest struct {
+	Pindex    string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+	Partition string `protobuf:"bytes,2,opt,name=partition,proto3"`
+	SnapStart uint64 `protobuf:"varint,3,opt,name=snap_start,json=snapStart,proto3"`
+	SnapEnd   uint64 `protobuf:"varint,4,opt,name=snap_end,json=snapEnd,proto3"`
+}
+
+func (m *SnapshotStartRequest) Reset()         { *m = SnapshotStartRequest{} }
+func (m *SnapshotStartRequest) String() string { return proto.CompactTextString(m) }
+func (*SnapshotStartRequest) ProtoMessage()    {}
+
+type OpaqueGetRequest struct {
+	Pindex    string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+	Partition string `protobuf:"bytes,2,opt,name=partition,proto3"`
+}
+
+func (m *OpaqueGetRequest) Reset()         { *m = OpaqueGetRequest{} }
+func (m *OpaqueGetRequest) String() string { return proto.CompactTextString(m) }
+func (*OpaqueGetRequest) ProtoMessage()    {}
+
+type OpaqueGetResponse struct {
+	Value   []byte `protobuf:"bytes,1,opt,name=value,proto3"`
+	LastSeq uint64 `protobuf:"varint,2,opt,name=last_seq,json=lastSeq,proto3"`
+}
+
+func (m *OpaqueGetResponse) Reset()         { *m = OpaqueGetResponse{} }
+func (m *OpaqueGetResponse) String() string { return proto.CompactTextString(m) }
+func (*OpaqueGetResponse) ProtoMessage()    {}
+
+type OpaqueSetRequest struct {
+	Pindex    string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+	Partition string `protobuf:"bytes,2,opt,name=partition,proto3"`
+	Value     []byte `protobuf:"bytes,3,opt,name=value,proto3"`
+}
+
+func (m *OpaqueSetRequest) Reset()         { *m = OpaqueSetRequest{} }
+func (m *OpaqueSetRequest) String() string { return proto.CompactTextString(m) }
+func (*OpaqueSetRequest) ProtoMessage()    {}
+
+type RollbackRequest struct {
+	Pindex      string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+	Partition   string `protobuf:"bytes,2,opt,name=partition,proto3"`
+	RollbackSeq uint64 `protobuf:"varint,3,opt,name=rollback_seq,json=rollbackSeq,proto3"`
+}
+
+func (m *RollbackRequest) Reset()         { *m = RollbackRequest{} }
+func (m *RollbackRequest) String() string { return proto.CompactTextString(m) }
+func (*RollbackRequest) ProtoMessage()    {}
+
+type ConsistencyWaitRequest struct {
+	Pindex           string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+	Partition        string `protobuf:"bytes,2,opt,name=partition,proto3"`
+	PartitionUuid    string `protobuf:"bytes,3,opt,name=partition_uuid,json=partitionUuid,proto3"`
+	ConsistencyLevel string `protobuf:"bytes,4,opt,name=consistency_level,json=consistencyLevel,proto3"`
+	ConsistencySeq   uint64 `protobuf:"varint,5,opt,name=consistency_seq,json=consistencySeq,proto3"`
+}
+
+func (m *ConsistencyWaitRequest) Reset()         { *m = ConsistencyWaitRequest{} }
+func (m *ConsistencyWaitRequest) String() string { return proto.CompactTextString(m) }
+func (*ConsistencyWaitRequest) ProtoMessage()    {}
+
+type ConsistencyWaitResponse struct {
+	Status       string   `protobuf:"bytes,1,opt,name=status,proto3"`
+	Err          string   `protobuf:"bytes,2,opt,name=err,proto3"`
+	StartEndSeqs []uint64 `protobuf:"varint,3,rep,packed,name=start_end_seqs,json=startEndSeqs,proto3"`
+}
+
+func (m *ConsistencyWaitResponse) Reset()         { *m = ConsistencyWaitResponse{} }
+func (m *ConsistencyWaitResponse) String() string { return proto.CompactTextString(m) }
+func (*ConsistencyWaitResponse) ProtoMessage()    {}
+
+type CountRequest struct {
+	Pindex    string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+	IndexName string `protobuf:"bytes,2,opt,name=index_name,json=indexName,proto3"`
+	IndexUuid string `protobuf:"bytes,3,opt,name=index_uuid,json=indexUuid,proto3"`
+}
+
+func (m *CountRequest) Reset()         { *m = CountRequest{} }
+func (m *CountRequest) String() string { return proto.CompactTextString(m) }
+func (*CountRequest) ProtoMessage()    {}
+
+type CountResponse struct {
+	Count uint64 `protobuf:"varint,1,opt,name=count,proto3"`
+}
+
+func (m *CountResponse) Reset()         { *m = CountResponse{} }
+func (m *CountResponse) String() string { return proto.CompactTextString(m) }
+func (*CountResponse) ProtoMessage()    {}
+
+type QueryRequest struct {
+	Pindex    string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+	IndexName string `protobuf:"bytes,2,opt,name=index_name,json=indexName,proto3"`
+	IndexUuid string `protobuf:"bytes,3,opt,name=index_uuid,json=indexUuid,proto3"`
+	Req       []byte `protobuf:"bytes,4,opt,name=req,proto3"`
+}
+
+func (m *QueryRequest) Reset()         { *m = QueryRequest{} }
+func (m *QueryRequest) String() string { return proto.CompactTextString(m) }
+func (*QueryRequest) ProtoMessage()    {}
+
+type QueryResponse struct {
+	Res []byte `protobuf:"bytes,1,opt,name=res,proto3"`
+}
+
+func (m *QueryResponse) Reset()         { *m = QueryResponse{} }
+func (m *QueryResponse) String() string { return proto.CompactTextString(m) }
+func (*QueryResponse) ProtoMessage()    {}
+
+type StatsRequest struct {
+	Pindex string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+}
+
+func (m *StatsRequest) Reset()         { *m = StatsRequest{} }
+func (m *StatsRequest) String() string { return proto.CompactTextString(m) }
+func (*StatsRequest) ProtoMessage()    {}
+
+type StatsResponse struct {
+	Stats []byte `protobuf:"bytes,1,opt,name=stats,proto3"`
+}
+
+func (m *StatsResponse) Reset()         { *m = StatsResponse{} }
+func (m *StatsResponse) String() string { return proto.CompactTextString(m) }
+func (*StatsResponse) ProtoMessage()    {}
+
+type CloseRequest struct {
+	Pindex string `protobuf:"bytes,1,opt,name=pindex,proto3"`
+}
+
+func (m *CloseRequest) Reset()         { *m = CloseRequest{} }
+func (m *CloseRequest) String() string { return proto.CompactTextString(m) }
+func (*CloseRequest) ProtoMessage()    {}
+
+// ---------------------------------------------------------
+
+// DestServer is the server API of the Dest service.
+type DestServer interface {
+	DataUpdate(context.Context, *DataUpdateRequest) (*Empty, error)
+	DataDelete(context.Context, *DataDeleteRequest) (*Empty, error)
+	SnapshotStart(context.Context, *SnapshotStartRequest) (*Empty, error)
+	OpaqueGet(context.Context, *OpaqueGetRequest) (*OpaqueGetResponse, error)
+	OpaqueSet(context.Context, *OpaqueSetRequest) (*Empty, error)
+	Rollback(context.Context, *RollbackRequest) (*Empty, error)
+	ConsistencyWait(context.Context, *ConsistencyWaitRequest) (
+		*ConsistencyWaitResponse, error)
+	Count(context.Context, *CountRequest) (*CountResponse, error)
+	Query(context.Context, *QueryRequest) (*QueryResponse, error)
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+	Close(context.Context, *CloseRequest) (*Empty, error)
+}
+
+// RegisterDestServer registers a DestServer with a grpc.Server.
+func RegisterDestServer(s *grpc.Server, srv DestServer) {
+	s.RegisterService(&destServiceDesc, srv)
+}
+
+const destServiceName = "cbgt.destgrpc.Dest"
+
+var destServiceDesc = grpc.ServiceDesc{
+	ServiceName: destServiceName,
+	HandlerType: (*DestServer)(nil),
+	Methods: []grpc.MethodDesc{
+		destMethod("DataUpdate", func() proto.Message { return &DataUpdateRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.DataUpdate(ctx, in.(*DataUpdateRequest))
+			}),
+		destMethod("DataDelete", func() proto.Message { return &DataDeleteRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.DataDelete(ctx, in.(*DataDeleteRequest))
+			}),
+		destMethod("SnapshotStart", func() proto.Message { return &SnapshotStartRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.SnapshotStart(ctx, in.(*SnapshotStartRequest))
+			}),
+		destMethod("OpaqueGet", func() proto.Message { return &OpaqueGetRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.OpaqueGet(ctx, in.(*OpaqueGetRequest))
+			}),
+		destMethod("OpaqueSet", func() proto.Message { return &OpaqueSetRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.OpaqueSet(ctx, in.(*OpaqueSetRequest))
+			}),
+		destMethod("Rollback", func() proto.Message { return &RollbackRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.Rollback(ctx, in.(*RollbackRequest))
+			}),
+		destMethod("ConsistencyWait", func() proto.Message { return &ConsistencyWaitRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.ConsistencyWait(ctx, in.(*ConsistencyWaitRequest))
+			}),
+		destMethod("Count", func() proto.Message { return &CountRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.Count(ctx, in.(*CountRequest))
+			}),
+		destMethod("Query", func() proto.Message { return &QueryRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.Query(ctx, in.(*QueryRequest))
+			}),
+		destMethod("Stats", func() proto.Message { return &StatsRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.Stats(ctx, in.(*StatsRequest))
+			}),
+		destMethod("Close", func() proto.Message { return &CloseRequest{} },
+			func(s DestServer, ctx context.Context, in proto.Message) (interface{}, error) {
+				return s.Close(ctx, in.(*CloseRequest))
+			}),
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "dest.proto",
+}
+
+// destMethod returns the grpc.MethodDesc of a unary method, whose
+// request is decoded into a newIn() and then passed to the call.
+func destMethod(name string, newIn func() proto.Message,
+	call func(s DestServer, ctx context.Context, in proto.Message) (
+		interface{}, error)) grpc.MethodDesc {
+	fullMethod := "/" + destServiceName + "/" + name
+
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context,
+			dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := newIn()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(DestServer), ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: fullMethod,
+			}
+			return interceptor(ctx, in, info,
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					return call(srv.(DestServer), ctx, req.(proto.Message))
+				})
+		},
+	}
+}
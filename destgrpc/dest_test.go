@@ -0,0 +1,253 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package destgrpc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/blugelabs/cbgt"
+	"github.com/blugelabs/cbgt/desttest"
+)
+
+// testEngine is an engine process, in-process, whose pindexes are
+// counting dests that are created on demand.
+type testEngine struct {
+	m     sync.Mutex
+	dests map[string]*cbgt.Counting
+
+	addr string
+	s    *grpc.Server
+}
+
+func startTestEngine(t *testing.T) *testEngine {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected listen to work, err: %v", err)
+	}
+
+	e := &testEngine{
+		dests: map[string]*cbgt.Counting{},
+		addr:  l.Addr().String(),
+		s:     grpc.NewServer(),
+	}
+
+	RegisterDestServer(e.s, NewServer(func(pindex string) (
+		cbgt.Dest, error) {
+		e.m.Lock()
+		defer e.m.Unlock()
+		dest := e.dests[pindex]
+		if dest == nil {
+			dest = cbgt.NewCounting()
+			e.dests[pindex] = dest
+		}
+		return dest, nil
+	}))
+
+	go e.s.Serve(l)
+
+	return e
+}
+
+func (e *testEngine) dest(pindex string) *cbgt.Counting {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.dests[pindex]
+}
+
+func TestDestGRPC(t *testing.T) {
+	e := startTestEngine(t)
+	defer e.s.Stop()
+
+	d, err := DialDestGRPC(e.addr, "p0")
+	if err != nil {
+		t.Fatalf("expected dial to work, err: %v", err)
+	}
+
+	err = d.SnapshotStart("0", 1, 2)
+	if err != nil {
+		t.Fatalf("expected SnapshotStart to work, err: %v", err)
+	}
+	err = d.DataUpdate("0", []byte("a"), 1, []byte("{}"), 0,
+		cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Errorf("expected DataUpdate to work, err: %v", err)
+	}
+	err = d.DataDelete("0", []byte("a"), 2, 0,
+		cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Errorf("expected DataDelete to work, err: %v", err)
+	}
+
+	value, lastSeq, err := d.OpaqueGet("0")
+	if err != nil || value != nil || lastSeq != 2 {
+		t.Errorf("expected no opaque and lastSeq 2, got: %q, %d, %v",
+			value, lastSeq, err)
+	}
+	err = d.OpaqueSet("0", []byte("opaque"))
+	if err != nil {
+		t.Errorf("expected OpaqueSet to work, err: %v", err)
+	}
+	value, _, err = d.OpaqueGet("0")
+	if err != nil || string(value) != "opaque" {
+		t.Errorf("expected the opaque, got: %q, %v", value, err)
+	}
+
+	count, err := d.Count(nil, nil)
+	if err != nil || count != 2 {
+		t.Errorf("expected count 2, got: %d, %v", count, err)
+	}
+
+	var buf bytes.Buffer
+	err = d.Stats(&buf)
+	if err != nil || !strings.Contains(buf.String(), `"lastSeq":2`) {
+		t.Errorf("expected the engine's stats, got: %s, %v",
+			buf.String(), err)
+	}
+
+	err = d.Query(nil, []byte("{}"), &buf, nil)
+	if err == nil || !strings.Contains(err.Error(), "not queryable") {
+		t.Errorf("expected the engine's query err, got: %v", err)
+	}
+
+	err = d.ConsistencyWait("0", "", "at_plus", 2, nil)
+	if err != nil {
+		t.Errorf("expected a reached ConsistencyWait, err: %v", err)
+	}
+
+	cancelCh := make(chan bool)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(cancelCh)
+	}()
+	err = d.ConsistencyWait("0", "", "at_plus", 100, cancelCh)
+	errCW, ok := err.(*cbgt.ErrorConsistencyWait)
+	if !ok || errCW.Status != "cancelled" {
+		t.Errorf("expected a cancelled ConsistencyWait, got: %v", err)
+	}
+
+	err = d.Rollback("0", 1)
+	if err != nil {
+		t.Errorf("expected Rollback to work, err: %v", err)
+	}
+	_, lastSeq, _ = d.OpaqueGet("0")
+	if lastSeq != 1 {
+		t.Errorf("expected the rollback to lastSeq 1, got: %d", lastSeq)
+	}
+
+	if n, violations := e.dest("p0").Violations(); n != 0 {
+		t.Errorf("expected no violations, got: %v", violations)
+	}
+
+	err = d.Close()
+	if err != nil {
+		t.Errorf("expected Close to work, err: %v", err)
+	}
+	err = d.DataUpdate("0", []byte("b"), 3, nil, 0,
+		cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	if err == nil {
+		t.Errorf("expected err after Close")
+	}
+}
+
+func TestDestGRPCUnknownPIndex(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected listen to work, err: %v", err)
+	}
+	s := grpc.NewServer()
+	RegisterDestServer(s, NewServerDests(map[string]cbgt.Dest{
+		"p0": cbgt.NewCounting(),
+	}))
+	go s.Serve(l)
+	defer s.Stop()
+
+	d, err := DialDestGRPC(l.Addr().String(), "unknown")
+	if err != nil {
+		t.Fatalf("expected dial to work, err: %v", err)
+	}
+	defer d.Close()
+
+	err = d.SnapshotStart("0", 1, 2)
+	if err == nil || !strings.Contains(err.Error(), "unknown pindex") {
+		t.Errorf("expected an unknown pindex err, got: %v", err)
+	}
+}
+
+func TestDestGRPCConformance(t *testing.T) {
+	e := startTestEngine(t)
+	defer e.s.Stop()
+
+	i := 0
+
+	desttest.Run(t, func(t *testing.T) cbgt.Dest {
+		i++
+		d, err := DialDestGRPC(e.addr, fmt.Sprintf("p%d", i))
+		if err != nil {
+			t.Fatalf("expected dial to work, err: %v", err)
+		}
+		return d
+	}, desttest.Options{})
+}
+
+func TestPIndexImpl(t *testing.T) {
+	e := startTestEngine(t)
+	defer e.s.Stop()
+
+	testDir, _ := ioutil.TempDir("", "destgrpc")
+	defer os.RemoveAll(testDir)
+
+	path := filepath.Join(testDir, "idx_0.pindex")
+
+	err := ValidatePIndexImpl("grpc", "idx", `{}`)
+	if err == nil {
+		t.Errorf("expected err on missing addr")
+	}
+
+	indexParams := fmt.Sprintf(`{"addr":%q}`, e.addr)
+
+	_, dest, err := NewPIndexImpl("grpc", indexParams, path, nil)
+	if err != nil {
+		t.Fatalf("expected NewPIndexImpl to work, err: %v", err)
+	}
+	err = dest.DataUpdate("0", []byte("a"), 1, nil, 0,
+		cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Errorf("expected DataUpdate to work, err: %v", err)
+	}
+	dest.Close()
+
+	_, dest, err = OpenPIndexImpl("grpc", path, nil)
+	if err != nil {
+		t.Fatalf("expected OpenPIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	count, err := dest.Count(nil, nil)
+	if err != nil || count != 1 {
+		t.Errorf("expected the engine's pindex by path name,"+
+			" got: %d, %v", count, err)
+	}
+	if e.dest("idx_0.pindex") == nil {
+		t.Errorf("expected the engine to know the pindex by its path name")
+	}
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package destgrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/blugelabs/cbgt"
+)
+
+func init() {
+	cbgt.RegisterPIndexImplType("grpc", &cbgt.PIndexImplType{
+		Validate:  ValidatePIndexImpl,
+		New:       NewPIndexImpl,
+		Open:      OpenPIndexImpl,
+		OpenUsing: OpenPIndexImplUsing,
+		Count:     nil, // The engine is counted per pindex via the Dest.
+		Query:     nil, // The engine is queried per pindex via the Dest.
+		Description: "advanced/grpc" +
+			" - a grpc index forwards to an index engine in another" +
+			" process, which implements the destgrpc Dest service",
+		StartSample: &PIndexParams{Addr: "localhost:9130"},
+	})
+}
+
+// PIndexParams are the indexParams of a "grpc" pindex.
+type PIndexParams struct {
+	Addr string `json:"addr"` // The host:port of the engine.
+}
+
+const pindexParamsFileName = "grpc.json"
+
+func parsePIndexParams(indexParams string) (*PIndexParams, error) {
+	params := &PIndexParams{}
+	if indexParams != "" {
+		err := json.Unmarshal([]byte(indexParams), params)
+		if err != nil {
+			return nil, fmt.Errorf("destgrpc: indexParams: %s, err: %v",
+				indexParams, err)
+		}
+	}
+	if params.Addr == "" {
+		return nil, fmt.Errorf("destgrpc: indexParams needs an addr")
+	}
+	return params, nil
+}
+
+func ValidatePIndexImpl(indexType, indexName, indexParams string) error {
+	_, err := parsePIndexParams(indexParams)
+	return err
+}
+
+// NewPIndexImpl persists the indexParams in the path, so that the
+// pindex can be reopened, and dials the engine.  The engine knows the
+// pindex by the name of its path.
+func NewPIndexImpl(indexType, indexParams, path string,
+	restart func()) (cbgt.PIndexImpl, cbgt.Dest, error) {
+	params, err := parsePIndexParams(indexParams)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return openPIndexImpl(params, path)
+}
+
+func OpenPIndexImpl(indexType, path string, restart func()) (
+	cbgt.PIndexImpl, cbgt.Dest, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(path, pindexParamsFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	params, err := parsePIndexParams(string(buf))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return openPIndexImpl(params, path)
+}
+
+func OpenPIndexImplUsing(indexType, path, indexParams string,
+	restart func()) (cbgt.PIndexImpl, cbgt.Dest, error) {
+	params, err := parsePIndexParams(indexParams)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return openPIndexImpl(params, path)
+}
+
+func openPIndexImpl(params *PIndexParams, path string) (
+	cbgt.PIndexImpl, cbgt.Dest, error) {
+	buf, err := json.Marshal(params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(path, pindexParamsFileName),
+		buf, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dest, err := DialDestGRPC(params.Addr, filepath.Base(path))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dest, dest, nil
+}
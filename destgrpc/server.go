@@ -0,0 +1,232 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package destgrpc
+
+import (
+	"bytes"
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// DestLookup returns the cbgt.Dest of a pindex for a Server, which
+// should be a codes.NotFound status error for an unknown pindex.
+type DestLookup func(pindex string) (cbgt.Dest, error)
+
+// Server is the server-side shim of the Dest service, which forwards
+// the calls of each pindex to its cbgt.Dest, and is the reference
+// for how engines in other languages should behave.  A typical use
+// by an engine process is...
+//
+//	s := grpc.NewServer()
+//	destgrpc.RegisterDestServer(s, destgrpc.NewServer(lookup))
+//	s.Serve(listener)
+type Server struct {
+	lookup DestLookup
+}
+
+// NewServer returns a Server that finds the dests with a lookup.
+func NewServer(lookup DestLookup) *Server {
+	return &Server{lookup: lookup}
+}
+
+// NewServerDests returns a Server for a fixed map of dests, keyed by
+// pindex name.
+func NewServerDests(dests map[string]cbgt.Dest) *Server {
+	return NewServer(func(pindex string) (cbgt.Dest, error) {
+		dest := dests[pindex]
+		if dest == nil {
+			return nil, status.Errorf(codes.NotFound,
+				"destgrpc: unknown pindex: %s", pindex)
+		}
+		return dest, nil
+	})
+}
+
+// cancelCh returns a cbgt-style cancelCh that's closed when the ctx
+// is done, and a func that must be called when the call returns.
+func cancelCh(ctx context.Context) (<-chan bool, func()) {
+	ch := make(chan bool)
+	doneCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(ch)
+		case <-doneCh:
+		}
+	}()
+	return ch, func() { close(doneCh) }
+}
+
+func (s *Server) DataUpdate(ctx context.Context,
+	in *DataUpdateRequest) (*Empty, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, dest.DataUpdate(in.Partition, in.Key, in.Seq,
+		in.Val, in.Cas, cbgt.DestExtrasType(in.ExtrasType), in.Extras)
+}
+
+func (s *Server) DataDelete(ctx context.Context,
+	in *DataDeleteRequest) (*Empty, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, dest.DataDelete(in.Partition, in.Key, in.Seq,
+		in.Cas, cbgt.DestExtrasType(in.ExtrasType), in.Extras)
+}
+
+func (s *Server) SnapshotStart(ctx context.Context,
+	in *SnapshotStartRequest) (*Empty, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, dest.SnapshotStart(in.Partition,
+		in.SnapStart, in.SnapEnd)
+}
+
+func (s *Server) OpaqueGet(ctx context.Context,
+	in *OpaqueGetRequest) (*OpaqueGetResponse, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+	value, lastSeq, err := dest.OpaqueGet(in.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &OpaqueGetResponse{Value: value, LastSeq: lastSeq}, nil
+}
+
+func (s *Server) OpaqueSet(ctx context.Context,
+	in *OpaqueSetRequest) (*Empty, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, dest.OpaqueSet(in.Partition, in.Value)
+}
+
+func (s *Server) Rollback(ctx context.Context,
+	in *RollbackRequest) (*Empty, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, dest.Rollback(in.Partition, in.RollbackSeq)
+}
+
+// ConsistencyWait waits until the consistency is reached or the call
+// is cancelled, where a cbgt.ErrorConsistencyWait is a response
+// rather than an error.
+func (s *Server) ConsistencyWait(ctx context.Context,
+	in *ConsistencyWaitRequest) (*ConsistencyWaitResponse, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, done := cancelCh(ctx)
+	defer done()
+
+	err = dest.ConsistencyWait(in.Partition, in.PartitionUuid,
+		in.ConsistencyLevel, in.ConsistencySeq, ch)
+	if errCW, ok := err.(*cbgt.ErrorConsistencyWait); ok {
+		rv := &ConsistencyWaitResponse{
+			Status:       errCW.Status,
+			StartEndSeqs: errCW.StartEndSeqs[in.Partition],
+		}
+		if errCW.Err != nil {
+			rv.Err = errCW.Err.Error()
+		}
+		if rv.Status == "" {
+			rv.Status = "error"
+		}
+		return rv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ConsistencyWaitResponse{}, nil
+}
+
+func (s *Server) Count(ctx context.Context,
+	in *CountRequest) (*CountResponse, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, done := cancelCh(ctx)
+	defer done()
+
+	count, err := dest.Count(&cbgt.PIndex{
+		Name:      in.Pindex,
+		IndexName: in.IndexName,
+		IndexUUID: in.IndexUuid,
+	}, ch)
+	if err != nil {
+		return nil, err
+	}
+	return &CountResponse{Count: count}, nil
+}
+
+func (s *Server) Query(ctx context.Context,
+	in *QueryRequest) (*QueryResponse, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, done := cancelCh(ctx)
+	defer done()
+
+	var buf bytes.Buffer
+	err = dest.Query(&cbgt.PIndex{
+		Name:      in.Pindex,
+		IndexName: in.IndexName,
+		IndexUUID: in.IndexUuid,
+	}, in.Req, &buf, ch)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryResponse{Res: buf.Bytes()}, nil
+}
+
+func (s *Server) Stats(ctx context.Context,
+	in *StatsRequest) (*StatsResponse, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = dest.Stats(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsResponse{Stats: buf.Bytes()}, nil
+}
+
+func (s *Server) Close(ctx context.Context,
+	in *CloseRequest) (*Empty, error) {
+	dest, err := s.lookup(in.Pindex)
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, dest.Close()
+}
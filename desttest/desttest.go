@@ -0,0 +1,359 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package desttest provides a conformance test kit for cbgt.Dest
+// implementations, which drives a Dest through the same kinds of
+// mutation, deletion, snapshot, rollback, opaque and consistency wait
+// sequences that a feed would, and asserts the invariants that the
+// rest of cbgt relies upon.  A typical use from the tests of a new
+// PIndexImplType is...
+//
+//	func TestMyDest(t *testing.T) {
+//		desttest.Run(t, func(t *testing.T) cbgt.Dest {
+//			return newMyDest(t)
+//		}, desttest.Options{})
+//	}
+package desttest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// NewDestFunc returns a brand new, empty Dest for each scenario.  The
+// test kit closes the Dest at the end of the scenario.
+type NewDestFunc func(t *testing.T) cbgt.Dest
+
+// Options declares which optional behaviors the Dest under test
+// supports.  The zero value checks everything.
+type Options struct {
+	// Partitions are the source partitions to use, which defaults to
+	// two partitions, "0" and "1".
+	Partitions []string
+
+	// SkipOpaque skips the checks that OpaqueSet() values are
+	// returned by OpaqueGet().
+	SkipOpaque bool
+
+	// SkipSeqs skips the checks that OpaqueGet() returns the last
+	// seq received per partition.
+	SkipSeqs bool
+
+	// SkipRollback skips the rollback scenario, such as for a Dest
+	// that can't be used anymore after a Rollback().
+	SkipRollback bool
+
+	// SkipConsistencyWait skips the consistency wait scenario.
+	SkipConsistencyWait bool
+
+	// PIndex, when non-nil, is passed to Dest.Count(), whose results
+	// are then checked against the live docs.
+	PIndex *cbgt.PIndex
+
+	// Timeout bounds each wait for the Dest, defaulting to 5 seconds.
+	Timeout time.Duration
+}
+
+// Run runs each conformance scenario as a subtest of t.
+func Run(t *testing.T, newDest NewDestFunc, options Options) {
+	if len(options.Partitions) <= 0 {
+		options.Partitions = []string{"0", "1"}
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+
+	k := &kit{newDest: newDest, options: options}
+
+	t.Run("Empty", k.testEmpty)
+	t.Run("Opaque", k.testOpaque)
+	t.Run("Mutations", k.testMutations)
+	t.Run("Rollback", k.testRollback)
+	t.Run("ConsistencyWait", k.testConsistencyWait)
+}
+
+type kit struct {
+	newDest NewDestFunc
+	options Options
+}
+
+func (k *kit) withDest(t *testing.T, f func(dest cbgt.Dest)) {
+	dest := k.newDest(t)
+	if dest == nil {
+		t.Fatalf("desttest: newDest returned a nil dest")
+	}
+
+	f(dest)
+
+	if err := dest.Close(); err != nil {
+		t.Errorf("desttest: Close, err: %v", err)
+	}
+}
+
+// ---------------------------------------------------------
+
+// A brand new Dest has no opaque value nor seqs, and has stats.
+func (k *kit) testEmpty(t *testing.T) {
+	k.withDest(t, func(dest cbgt.Dest) {
+		for _, partition := range k.options.Partitions {
+			value, lastSeq, err := dest.OpaqueGet(partition)
+			if err != nil || len(value) != 0 || lastSeq != 0 {
+				t.Errorf("desttest: expected empty OpaqueGet, partition: %s,"+
+					" value: %q, lastSeq: %d, err: %v",
+					partition, value, lastSeq, err)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := dest.Stats(&buf); err != nil {
+			t.Errorf("desttest: Stats, err: %v", err)
+		}
+
+		k.checkCount(t, dest, 0)
+	})
+}
+
+// OpaqueSet values are copied and kept per partition.
+func (k *kit) testOpaque(t *testing.T) {
+	if k.options.SkipOpaque {
+		t.Skip("desttest: SkipOpaque")
+	}
+
+	k.withDest(t, func(dest cbgt.Dest) {
+		p0 := k.options.Partitions[0]
+
+		value := []byte(`{"opaque":0}`)
+		if err := dest.OpaqueSet(p0, value); err != nil {
+			t.Fatalf("desttest: OpaqueSet, err: %v", err)
+		}
+		copy(value, "XXXXXXXXXXXX") // The Dest must have made a copy.
+
+		got, _, err := dest.OpaqueGet(p0)
+		if err != nil || string(got) != `{"opaque":0}` {
+			t.Errorf("desttest: expected the OpaqueSet value,"+
+				" got: %q, err: %v", got, err)
+		}
+
+		for _, partition := range k.options.Partitions[1:] {
+			got, _, err := dest.OpaqueGet(partition)
+			if err != nil || len(got) != 0 {
+				t.Errorf("desttest: expected no opaque value for another"+
+					" partition: %s, got: %q, err: %v", partition, got, err)
+			}
+		}
+
+		if err = dest.OpaqueSet(p0, []byte(`{"opaque":1}`)); err != nil {
+			t.Fatalf("desttest: OpaqueSet, err: %v", err)
+		}
+		got, _, err = dest.OpaqueGet(p0)
+		if err != nil || string(got) != `{"opaque":1}` {
+			t.Errorf("desttest: expected the latest OpaqueSet value,"+
+				" got: %q, err: %v", got, err)
+		}
+	})
+}
+
+// Updates and deletes advance each partition's seq independently.
+func (k *kit) testMutations(t *testing.T) {
+	k.withDest(t, func(dest cbgt.Dest) {
+		expSeqs, expCount := k.mutate(t, dest)
+
+		k.checkSeqs(t, dest, expSeqs)
+		k.checkCount(t, dest, expCount)
+	})
+}
+
+// A Rollback leaves a partition at or before the rollback seq, and the
+// partition can then be fed again.
+func (k *kit) testRollback(t *testing.T) {
+	if k.options.SkipRollback {
+		t.Skip("desttest: SkipRollback")
+	}
+
+	k.withDest(t, func(dest cbgt.Dest) {
+		expSeqs, _ := k.mutate(t, dest)
+
+		p0 := k.options.Partitions[0]
+
+		if err := dest.Rollback(p0, 2); err != nil {
+			t.Fatalf("desttest: Rollback, err: %v", err)
+		}
+
+		_, lastSeq, err := dest.OpaqueGet(p0)
+		if err != nil || lastSeq > 2 {
+			t.Errorf("desttest: expected lastSeq <= 2 after Rollback,"+
+				" got: %d, err: %v", lastSeq, err)
+		}
+
+		// The other partitions are untouched.
+		delete(expSeqs, p0)
+		k.checkSeqs(t, dest, expSeqs)
+
+		k.update(t, dest, p0, "again", lastSeq+1)
+		k.checkSeqs(t, dest, map[string]uint64{p0: lastSeq + 1})
+	})
+}
+
+// Waits are satisfied by reaching the seq, and ended by cancellation.
+func (k *kit) testConsistencyWait(t *testing.T) {
+	if k.options.SkipConsistencyWait {
+		t.Skip("desttest: SkipConsistencyWait")
+	}
+
+	k.withDest(t, func(dest cbgt.Dest) {
+		expSeqs, _ := k.mutate(t, dest)
+
+		p0 := k.options.Partitions[0]
+		seq := expSeqs[p0]
+
+		// A stale ok level never waits.
+		err := k.wait(dest, p0, "", seq+1000, nil)
+		if err != nil {
+			t.Errorf("desttest: expected no wait for a stale ok level,"+
+				" err: %v", err)
+		}
+
+		err = k.wait(dest, p0, "at_plus", seq, nil)
+		if err != nil {
+			t.Errorf("desttest: expected a reached seq to not wait,"+
+				" err: %v", err)
+		}
+
+		cancelCh := make(chan bool)
+		close(cancelCh)
+		err = k.wait(dest, p0, "at_plus", seq+1000, cancelCh)
+		if err == nil {
+			t.Errorf("desttest: expected err on a cancelled wait")
+		}
+
+		// A pending wait is woken by the mutation that reaches its seq.
+		resCh := make(chan error, 1)
+		go func() {
+			resCh <- dest.ConsistencyWait(p0, "", "at_plus", seq+2, nil)
+		}()
+
+		k.update(t, dest, p0, "later1", seq+1)
+		k.update(t, dest, p0, "later2", seq+2)
+
+		select {
+		case err = <-resCh:
+			if err != nil {
+				t.Errorf("desttest: expected pending wait to work,"+
+					" err: %v", err)
+			}
+		case <-time.After(k.options.Timeout):
+			t.Errorf("desttest: pending wait timed out, seq: %d", seq+2)
+		}
+	})
+}
+
+// ---------------------------------------------------------
+
+// mutate feeds each partition a snapshot of updates and a delete, and
+// returns the expected last seqs and the expected count of live docs.
+func (k *kit) mutate(t *testing.T, dest cbgt.Dest) (
+	map[string]uint64, uint64) {
+	expSeqs := map[string]uint64{}
+	var expCount uint64
+
+	for i, partition := range k.options.Partitions {
+		numUpdates := uint64(3 + i)
+
+		if err := dest.SnapshotStart(partition, 1, numUpdates+1); err != nil {
+			t.Fatalf("desttest: SnapshotStart, partition: %s, err: %v",
+				partition, err)
+		}
+
+		var seq uint64
+		for seq = 1; seq <= numUpdates; seq++ {
+			k.update(t, dest, partition, fmt.Sprintf("k%d", seq), seq)
+		}
+
+		key := []byte(partition + "-k1")
+		err := dest.DataDelete(partition, key, seq, 0,
+			cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Fatalf("desttest: DataDelete, partition: %s, err: %v",
+				partition, err)
+		}
+		copy(key, "XXXX") // The Dest must have made a copy.
+
+		expSeqs[partition] = seq
+		expCount += numUpdates - 1
+	}
+
+	return expSeqs, expCount
+}
+
+func (k *kit) update(t *testing.T, dest cbgt.Dest, partition, key string,
+	seq uint64) {
+	keyBuf := []byte(partition + "-" + key)
+	valBuf := []byte(fmt.Sprintf(`{"seq":%d}`, seq))
+
+	err := dest.DataUpdate(partition, keyBuf, seq, valBuf, 0,
+		cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Fatalf("desttest: DataUpdate, partition: %s, seq: %d, err: %v",
+			partition, seq, err)
+	}
+
+	// The Dest must have made its own copies.
+	copy(keyBuf, "XXXX")
+	copy(valBuf, "XXXX")
+}
+
+func (k *kit) checkSeqs(t *testing.T, dest cbgt.Dest,
+	expSeqs map[string]uint64) {
+	if k.options.SkipSeqs {
+		return
+	}
+
+	for partition, expSeq := range expSeqs {
+		_, lastSeq, err := dest.OpaqueGet(partition)
+		if err != nil || lastSeq != expSeq {
+			t.Errorf("desttest: expected lastSeq: %d, partition: %s,"+
+				" got: %d, err: %v", expSeq, partition, lastSeq, err)
+		}
+	}
+}
+
+func (k *kit) checkCount(t *testing.T, dest cbgt.Dest, expCount uint64) {
+	if k.options.PIndex == nil {
+		return
+	}
+
+	count, err := dest.Count(k.options.PIndex, nil)
+	if err != nil || count != expCount {
+		t.Errorf("desttest: expected count: %d, got: %d, err: %v",
+			expCount, count, err)
+	}
+}
+
+// wait is a ConsistencyWait that's bounded by the Timeout.
+func (k *kit) wait(dest cbgt.Dest, partition, level string, seq uint64,
+	cancelCh <-chan bool) error {
+	resCh := make(chan error, 1)
+	go func() {
+		resCh <- dest.ConsistencyWait(partition, "", level, seq, cancelCh)
+	}()
+
+	select {
+	case err := <-resCh:
+		return err
+	case <-time.After(k.options.Timeout):
+		return fmt.Errorf("desttest: ConsistencyWait timed out,"+
+			" partition: %s, level: %q, seq: %d", partition, level, seq)
+	}
+}
@@ -0,0 +1,252 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package desttest
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// memDest is a minimal, in-memory Dest that follows all of the
+// invariants, to check the test kit itself.
+type memDest struct {
+	m          sync.Mutex
+	partitions map[string]*memPartition
+}
+
+type memPartition struct {
+	opaque  []byte
+	lastSeq uint64
+	docs    map[string]uint64 // Key -> seq.
+	waiters []*cbgt.ConsistencyWaitReq
+}
+
+func newMemDest() *memDest {
+	return &memDest{partitions: map[string]*memPartition{}}
+}
+
+func (d *memDest) partitionLOCKED(partition string) *memPartition {
+	p := d.partitions[partition]
+	if p == nil {
+		p = &memPartition{docs: map[string]uint64{}}
+		d.partitions[partition] = p
+	}
+	return p
+}
+
+func (d *memDest) seqLOCKED(p *memPartition, seq uint64) {
+	p.lastSeq = seq
+
+	waiters := p.waiters[:0]
+	for _, w := range p.waiters {
+		if w.ConsistencySeq <= seq {
+			close(w.DoneCh)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	p.waiters = waiters
+}
+
+func (d *memDest) Close() error { return nil }
+
+func (d *memDest) DataUpdate(partition string, key []byte, seq uint64,
+	val []byte, cas uint64,
+	extrasType cbgt.DestExtrasType, extras []byte) error {
+	d.m.Lock()
+	p := d.partitionLOCKED(partition)
+	p.docs[string(key)] = seq
+	d.seqLOCKED(p, seq)
+	d.m.Unlock()
+	return nil
+}
+
+func (d *memDest) DataDelete(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType cbgt.DestExtrasType, extras []byte) error {
+	d.m.Lock()
+	p := d.partitionLOCKED(partition)
+	delete(p.docs, string(key))
+	d.seqLOCKED(p, seq)
+	d.m.Unlock()
+	return nil
+}
+
+func (d *memDest) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	return nil
+}
+
+func (d *memDest) OpaqueGet(partition string) ([]byte, uint64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	p := d.partitions[partition]
+	if p == nil {
+		return nil, 0, nil
+	}
+	return p.opaque, p.lastSeq, nil
+}
+
+func (d *memDest) OpaqueSet(partition string, value []byte) error {
+	d.m.Lock()
+	d.partitionLOCKED(partition).opaque = append([]byte(nil), value...)
+	d.m.Unlock()
+	return nil
+}
+
+func (d *memDest) Rollback(partition string, rollbackSeq uint64) error {
+	d.m.Lock()
+	p := d.partitionLOCKED(partition)
+	for key, seq := range p.docs {
+		if seq > rollbackSeq {
+			delete(p.docs, key)
+		}
+	}
+	p.lastSeq = rollbackSeq
+	d.m.Unlock()
+	return nil
+}
+
+func (d *memDest) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string, consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	if consistencyLevel == "" {
+		return nil
+	}
+
+	d.m.Lock()
+	p := d.partitionLOCKED(partition)
+	if p.lastSeq >= consistencySeq {
+		d.m.Unlock()
+		return nil
+	}
+	w := &cbgt.ConsistencyWaitReq{
+		ConsistencyLevel: consistencyLevel,
+		ConsistencySeq:   consistencySeq,
+		CancelCh:         cancelCh,
+		DoneCh:           make(chan error),
+	}
+	p.waiters = append(p.waiters, w)
+	d.m.Unlock()
+
+	return cbgt.ConsistencyWaitDone(partition, cancelCh, w.DoneCh,
+		func() uint64 {
+			d.m.Lock()
+			defer d.m.Unlock()
+			return p.lastSeq
+		})
+}
+
+func (d *memDest) Count(pindex *cbgt.PIndex,
+	cancelCh <-chan bool) (uint64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	var rv uint64
+	for _, p := range d.partitions {
+		rv += uint64(len(p.docs))
+	}
+	return rv, nil
+}
+
+func (d *memDest) Query(pindex *cbgt.PIndex, req []byte, w io.Writer,
+	cancelCh <-chan bool) error {
+	return nil
+}
+
+func (d *memDest) Stats(w io.Writer) error {
+	_, err := w.Write(cbgt.JsonNULL)
+	return err
+}
+
+// ---------------------------------------------------------
+
+func TestMemDest(t *testing.T) {
+	Run(t, func(t *testing.T) cbgt.Dest {
+		return newMemDest()
+	}, Options{PIndex: &cbgt.PIndex{Name: "mem"}})
+}
+
+func TestBlackHole(t *testing.T) {
+	Run(t, func(t *testing.T) cbgt.Dest {
+		return &cbgt.BlackHole{}
+	}, Options{
+		SkipOpaque:          true,
+		SkipSeqs:            true,
+		SkipRollback:        true,
+		SkipConsistencyWait: true,
+	})
+}
+
+func TestDestForwarder(t *testing.T) {
+	Run(t, func(t *testing.T) cbgt.Dest {
+		dest := newMemDest()
+		return &cbgt.DestForwarder{
+			DestProvider: &memDestProvider{dest: dest},
+		}
+	}, Options{})
+}
+
+type memDestProvider struct {
+	dest *memDest
+}
+
+func (p *memDestProvider) Dest(partition string) (cbgt.Dest, error) {
+	return p.dest, nil
+}
+
+func (p *memDestProvider) Count(pindex *cbgt.PIndex,
+	cancelCh <-chan bool) (uint64, error) {
+	return p.dest.Count(pindex, cancelCh)
+}
+
+func (p *memDestProvider) Query(pindex *cbgt.PIndex, req []byte,
+	res io.Writer, cancelCh <-chan bool) error {
+	return nil
+}
+
+func (p *memDestProvider) Stats(w io.Writer) error {
+	return p.dest.Stats(w)
+}
+
+func (p *memDestProvider) Close() error {
+	return nil
+}
+
+func TestCounting(t *testing.T) {
+	Run(t, func(t *testing.T) cbgt.Dest {
+		return cbgt.NewCounting()
+	}, Options{})
+}
+
+func TestLatency(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "desttest")
+	defer os.RemoveAll(dir)
+
+	Run(t, func(t *testing.T) cbgt.Dest {
+		_, dest, err := cbgt.NewLatencyPIndexImpl("latency",
+			`{"delays":{"dataUpdate":"1ms"}}`, dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dest
+	}, Options{
+		SkipOpaque:          true,
+		SkipSeqs:            true,
+		SkipRollback:        true,
+		SkipConsistencyWait: true,
+	})
+}
@@ -0,0 +1,383 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_DISK_SPACE_CHECK_INTERVAL is how often the free disk space
+// of a node's dataDir is checked, which may be overridden by the
+// "diskSpaceCheckInterval" manager option, such as "1m".
+const DEFAULT_DISK_SPACE_CHECK_INTERVAL = 10 * time.Second
+
+// DISK_SPACE_RESUME_FACTOR is how much more free space than its
+// threshold a node that's low on disk space needs before it accepts
+// new pindexes again, so that it doesn't flap around the threshold.
+const DISK_SPACE_RESUME_FACTOR = 1.1
+
+// DiskSpaceStatus is the free disk space of a node's dataDir against
+// its thresholds, as of the last check.
+type DiskSpaceStatus struct {
+	Free           uint64   `json:"free"`  // In bytes.
+	Total          uint64   `json:"total"` // In bytes.
+	MinFree        uint64   `json:"minFree,omitempty"`
+	MinFreePercent float64  `json:"minFreePercent,omitempty"`
+	Low            bool     `json:"low"`
+	Since          string   `json:"since,omitempty"` // When low.
+	Refused        []string `json:"refused,omitempty"`
+	Err            string   `json:"err,omitempty"`
+}
+
+// diskUsage returns the free and total bytes of the filesystem of a
+// path, and is a var for testing.
+var diskUsage = diskUsageOS
+
+// diskSpaceOptions parses the "diskFreeMinBytes" and the
+// "diskFreeMinPercent" manager options, where 0 means no threshold.
+func diskSpaceOptions(options map[string]string) (
+	minFree uint64, minFreePercent float64) {
+	minFree, _ = strconv.ParseUint(options["diskFreeMinBytes"], 10, 64)
+
+	if v, err := strconv.ParseFloat(options["diskFreeMinPercent"],
+		64); err == nil && v > 0 && v < 100 {
+		minFreePercent = v
+	}
+
+	return minFree, minFreePercent
+}
+
+// DiskSpaceLoop periodically checks the free disk space of the
+// dataDir against the node's thresholds.  While the free space is
+// below a threshold, the node refuses to create new pindexes and
+// registers its NodeDef with NoAccept, so that the planner assigns
+// them to other nodes, instead of the index builds failing with
+// ENOSPC.  The existing pindexes of the node keep running.
+func (mgr *Manager) DiskSpaceLoop() {
+	interval := DEFAULT_DISK_SPACE_CHECK_INTERVAL
+	if v, err := time.ParseDuration(
+		mgr.Options()["diskSpaceCheckInterval"]); err == nil && v > 0 {
+		interval = v
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			mgr.checkDiskSpaceOnce()
+		}
+	}
+}
+
+// checkDiskSpaceOnce checks the free disk space against the
+// thresholds, and returns whether the node is low on disk space.
+func (mgr *Manager) checkDiskSpaceOnce() bool {
+	minFree, minFreePercent := diskSpaceOptions(mgr.Options())
+	if (minFree <= 0 && minFreePercent <= 0) || mgr.dataDir == "" {
+		mgr.setDiskSpaceLow(false, DiskSpaceStatus{})
+		return false
+	}
+
+	atomic.AddUint64(&mgr.stats.TotDiskSpaceCheck, 1)
+
+	free, total, err := diskUsage(mgr.dataDir)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotDiskSpaceCheckErr, 1)
+		mgr.log.Warnf("disk_space: check, dataDir: %s, err: %v",
+			mgr.dataDir, err)
+
+		// Keep the previous state, as the free space is unknown.
+		mgr.diskMutex.Lock()
+		mgr.diskStatus.Err = err.Error()
+		low := mgr.diskLow
+		mgr.diskMutex.Unlock()
+
+		return low
+	}
+
+	threshold := float64(minFree)
+	if p := float64(total) * minFreePercent / 100; p > threshold {
+		threshold = p
+	}
+
+	mgr.diskMutex.Lock()
+	low := mgr.diskLow
+	mgr.diskMutex.Unlock()
+
+	if float64(free) < threshold {
+		low = true
+	} else if float64(free) >= threshold*DISK_SPACE_RESUME_FACTOR {
+		low = false
+	}
+
+	mgr.setDiskSpaceLow(low, DiskSpaceStatus{
+		Free:           free,
+		Total:          total,
+		MinFree:        minFree,
+		MinFreePercent: minFreePercent,
+	})
+
+	return low
+}
+
+// setDiskSpaceLow records a disk space check, and on a change of the
+// low state, reports an event and updates the NodeDef.
+func (mgr *Manager) setDiskSpaceLow(low bool, status DiskSpaceStatus) {
+	mgr.diskMutex.Lock()
+	wasLow := mgr.diskLow
+	mgr.diskLow = low
+	mgr.diskStatus = status
+	now := Now()
+	if low && !wasLow {
+		mgr.diskSince = now
+	}
+	if !low {
+		mgr.diskRefused = nil
+	}
+	mgr.diskMutex.Unlock()
+
+	if low == wasLow {
+		return
+	}
+
+	event := "diskSpaceRecovered"
+	if low {
+		event = "diskSpaceLow"
+		atomic.AddUint64(&mgr.stats.TotDiskSpaceLow, 1)
+		mgr.log.Warnf("disk_space: low, dataDir: %s, free: %d, total: %d",
+			mgr.dataDir, status.Free, status.Total)
+	} else {
+		atomic.AddUint64(&mgr.stats.TotDiskSpaceRecovered, 1)
+		mgr.log.Printf("disk_space: recovered, dataDir: %s, free: %d",
+			mgr.dataDir, status.Free)
+	}
+
+	eventBytes, _ := json.Marshal(struct {
+		Event string `json:"event"`
+		Free  uint64 `json:"free"`
+		Total uint64 `json:"total"`
+		Time  string `json:"time"`
+	}{event, status.Free, status.Total, now.Format(time.RFC3339Nano)})
+	mgr.AddEvent(eventBytes)
+
+	mgr.saveNodeDefsRegistered()
+}
+
+// diskSpaceLow returns whether the node was low on disk space at the
+// last check.
+func (mgr *Manager) diskSpaceLow() bool {
+	mgr.diskMutex.Lock()
+	defer mgr.diskMutex.Unlock()
+	return mgr.diskLow
+}
+
+// diskSpaceAccept returns the planPIndexes that the janitor may start,
+// where the new pindexes, whose files don't exist yet, are refused
+// while the node is low on disk space.  A refusal is reported as an
+// event, and the planner then assigns the refused pindexes to other
+// nodes.
+func (mgr *Manager) diskSpaceAccept(planPIndexes []*PlanPIndex) []*PlanPIndex {
+	if len(planPIndexes) <= 0 || !mgr.checkDiskSpaceOnce() {
+		return planPIndexes
+	}
+
+	var rv []*PlanPIndex
+	var refused []string
+
+	for _, planPIndex := range planPIndexes {
+		path, err := mgr.pindexPath(planPIndex.Name)
+		if err == nil {
+			if _, err = os.Stat(path); err == nil {
+				rv = append(rv, planPIndex) // Reopens its existing files.
+				continue
+			}
+		}
+		refused = append(refused, planPIndex.Name)
+	}
+
+	if len(refused) <= 0 {
+		return rv
+	}
+
+	atomic.AddUint64(&mgr.stats.TotDiskSpaceRefused, uint64(len(refused)))
+
+	mgr.diskMutex.Lock()
+	if mgr.diskRefused == nil {
+		mgr.diskRefused = map[string]bool{}
+	}
+	for _, name := range refused {
+		mgr.diskRefused[name] = true
+	}
+	status := mgr.diskStatus
+	mgr.diskMutex.Unlock()
+
+	mgr.log.Warnf("disk_space: refused pindexes: %v, free: %d",
+		refused, status.Free)
+
+	eventBytes, _ := json.Marshal(struct {
+		Event    string   `json:"event"`
+		PIndexes []string `json:"pindexes"`
+		Free     uint64   `json:"free"`
+		Total    uint64   `json:"total"`
+		Time     string   `json:"time"`
+	}{"diskSpaceRefusedPIndexes", refused, status.Free, status.Total,
+		Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(eventBytes)
+
+	return rv
+}
+
+// DiskSpaceStatus returns the free disk space of the dataDir against
+// the node's thresholds, as of the last check.
+func (mgr *Manager) DiskSpaceStatus() *DiskSpaceStatus {
+	mgr.diskMutex.Lock()
+	defer mgr.diskMutex.Unlock()
+
+	rv := mgr.diskStatus
+	rv.Low = mgr.diskLow
+	if mgr.diskLow {
+		rv.Since = mgr.diskSince.Format(time.RFC3339Nano)
+	}
+	rv.Refused = make([]string, 0, len(mgr.diskRefused))
+	for name := range mgr.diskRefused {
+		rv.Refused = append(rv.Refused, name)
+	}
+	sort.Strings(rv.Refused)
+
+	return &rv
+}
+
+// ---------------------------------------------------------
+
+// nodeDefsNoAccept returns whether any of the nodes is NoAccept.
+func nodeDefsNoAccept(nodeDefs *NodeDefs) bool {
+	if nodeDefs != nil {
+		for _, nodeDef := range nodeDefs.NodeDefs {
+			if nodeDef.NoAccept {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyNoAcceptNodes moves the planPIndexes of an index that were
+// newly assigned to NoAccept nodes onto other nodes.  A NoAccept node
+// keeps the assignments of the previous plan, unless the running
+// pindexes show that it never started the pindex, such as after
+// refusing it.  A moved assignment goes to the least loaded of the
+// nodes that accept new pindexes and don't already have the
+// planPIndex, or is dropped with a warning when there's none.
+func applyNoAcceptNodes(indexDef *IndexDef,
+	planPIndexesForIndex map[string]*PlanPIndex,
+	planPIndexesPrev *PlanPIndexes, nodeDefs *NodeDefs,
+	running *PIndexesRunning, nodeUUIDs []string) (warnings []string) {
+	if !nodeDefsNoAccept(nodeDefs) {
+		return nil
+	}
+
+	noAccept := func(nodeUUID string) bool {
+		nodeDef := nodeDefs.NodeDefs[nodeUUID]
+		return nodeDef != nil && nodeDef.NoAccept
+	}
+
+	keep := func(planPIndexName, nodeUUID string) bool {
+		if planPIndexesPrev == nil {
+			return false
+		}
+		prev := planPIndexesPrev.PlanPIndexes[planPIndexName]
+		if prev == nil || prev.Nodes[nodeUUID] == nil {
+			return false
+		}
+		if running == nil || running.Nodes[nodeUUID] == nil {
+			return true
+		}
+		names := running.Nodes[nodeUUID].PIndexes
+		i := sort.SearchStrings(names, planPIndexName)
+		return i < len(names) && names[i] == planPIndexName
+	}
+
+	loads := map[string]int{}
+	for _, planPIndex := range planPIndexesForIndex {
+		for nodeUUID := range planPIndex.Nodes {
+			loads[nodeUUID]++
+		}
+	}
+
+	planPIndexNames := make([]string, 0, len(planPIndexesForIndex))
+	for name := range planPIndexesForIndex {
+		planPIndexNames = append(planPIndexNames, name)
+	}
+	sort.Strings(planPIndexNames)
+
+	for _, name := range planPIndexNames {
+		planPIndex := planPIndexesForIndex[name]
+
+		assigned := make([]string, 0, len(planPIndex.Nodes))
+		for nodeUUID := range planPIndex.Nodes {
+			assigned = append(assigned, nodeUUID)
+		}
+		sort.Strings(assigned)
+
+		for _, nodeUUID := range assigned {
+			if !noAccept(nodeUUID) || keep(name, nodeUUID) {
+				continue
+			}
+
+			planPIndexNode := planPIndex.Nodes[nodeUUID]
+			delete(planPIndex.Nodes, nodeUUID)
+			loads[nodeUUID]--
+
+			target := ""
+			for _, n := range nodeUUIDs {
+				if noAccept(n) || planPIndex.Nodes[n] != nil ||
+					nodeDefs.NodeDefs[n] == nil {
+					continue
+				}
+				if target == "" || loads[n] < loads[target] {
+					target = n
+				}
+			}
+
+			if target == "" {
+				warnings = append(warnings, "could not assign planPIndex: "+
+					name+", as node: "+nodeUUID+" does not accept it"+
+					" and no other node is available")
+				continue
+			}
+
+			canRead, canWrite := true, true
+			if npp := GetNodePlanParam(indexDef.PlanParams.NodePlanParams,
+				target, indexDef.Name, name); npp != nil {
+				canRead, canWrite = npp.CanRead, npp.CanWrite
+			}
+
+			planPIndex.Nodes[target] = &PlanPIndexNode{
+				CanRead:  canRead,
+				CanWrite: canWrite,
+				Priority: planPIndexNode.Priority,
+			}
+			loads[target]++
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,151 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiskSpace(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	var free uint64 = 50
+	diskUsage = func(path string) (uint64, uint64, error) {
+		return free, 1000, nil
+	}
+	defer func() { diskUsage = diskUsageOS }()
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), []string{"pindex"}, "",
+		1, "", ":1000", emptyDir, "", nil, map[string]string{
+			"diskFreeMinBytes":   "10",
+			"diskFreeMinPercent": "10",
+		})
+	defer mgr.Stop()
+
+	err := mgr.Register("wanted")
+	if err != nil {
+		t.Fatalf("expected Register to work, err: %v", err)
+	}
+
+	existing := &PlanPIndex{Name: "existing"}
+	path, _ := mgr.pindexPath(existing.Name)
+	os.MkdirAll(path, 0700)
+
+	planPIndexes := []*PlanPIndex{existing, {Name: "new"}}
+
+	got := mgr.diskSpaceAccept(planPIndexes)
+	if !reflect.DeepEqual(got, []*PlanPIndex{existing}) {
+		t.Errorf("expected only the existing pindex, got: %v", got)
+	}
+
+	nodeDefs, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if !nodeDefs.NodeDefs[mgr.UUID()].NoAccept {
+		t.Errorf("expected a NoAccept NodeDef")
+	}
+
+	status := mgr.DiskSpaceStatus()
+	if !status.Low || status.Free != 50 ||
+		!reflect.DeepEqual(status.Refused, []string{"new"}) {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// Just above the threshold isn't enough to recover.
+	free = 105
+	if !mgr.checkDiskSpaceOnce() {
+		t.Errorf("expected to stay low")
+	}
+
+	free = 200
+	if got := mgr.diskSpaceAccept(planPIndexes); len(got) != 2 {
+		t.Errorf("expected all the pindexes after recovering, got: %v", got)
+	}
+
+	nodeDefs, _, _ = CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if nodeDefs.NodeDefs[mgr.UUID()].NoAccept {
+		t.Errorf("expected the NodeDef to accept again")
+	}
+
+	if mgr.stats.TotDiskSpaceLow != 1 || mgr.stats.TotDiskSpaceRecovered != 1 ||
+		mgr.stats.TotDiskSpaceRefused != 1 {
+		t.Errorf("unexpected stats: %+v", mgr.stats)
+	}
+}
+
+func TestApplyNoAcceptNodes(t *testing.T) {
+	nodeDefs := &NodeDefs{NodeDefs: map[string]*NodeDef{
+		"a": {UUID: "a", NoAccept: true},
+		"b": {UUID: "b"},
+		"c": {UUID: "c"},
+	}}
+
+	planPIndexesPrev := &PlanPIndexes{PlanPIndexes: map[string]*PlanPIndex{
+		"p0": {Name: "p0", Nodes: map[string]*PlanPIndexNode{"a": {}}},
+		"p1": {Name: "p1", Nodes: map[string]*PlanPIndexNode{"a": {}}},
+	}}
+
+	planPIndexesForIndex := map[string]*PlanPIndex{
+		"p0": {Name: "p0", Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true, CanWrite: true}}},
+		"p1": {Name: "p1", Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true, CanWrite: true},
+			"b": {CanRead: true, CanWrite: true, Priority: 1}}},
+		"p2": {Name: "p2", Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true, CanWrite: true}}},
+	}
+
+	// The node a runs p0, but refused p1.
+	running := &PIndexesRunning{Nodes: map[string]*NodePIndexesRunning{
+		"a": {PIndexes: []string{"p0"}},
+	}}
+
+	warnings := applyNoAcceptNodes(&IndexDef{Name: "x"},
+		planPIndexesForIndex, planPIndexesPrev, nodeDefs, running,
+		[]string{"a", "b", "c"})
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	assigned := map[string][]string{}
+	for name, planPIndex := range planPIndexesForIndex {
+		for nodeUUID := range planPIndex.Nodes {
+			assigned[name] = append(assigned[name], nodeUUID)
+		}
+	}
+	for _, v := range assigned {
+		sort.Strings(v)
+	}
+
+	exp := map[string][]string{
+		"p0": {"a"},      // Kept, as it's running.
+		"p1": {"b", "c"}, // Refused, so moved off a, but not onto b.
+		"p2": {"b"},      // New, so moved onto a least loaded node.
+	}
+	if !reflect.DeepEqual(assigned, exp) {
+		t.Errorf("expected: %v, got: %v", exp, assigned)
+	}
+
+	nodeDefs.NodeDefs["b"].NoAccept = true
+	nodeDefs.NodeDefs["c"].NoAccept = true
+	warnings = applyNoAcceptNodes(&IndexDef{Name: "x"},
+		map[string]*PlanPIndex{"p3": {Name: "p3",
+			Nodes: map[string]*PlanPIndexNode{"b": {}}}},
+		planPIndexesPrev, nodeDefs, running, []string{"a", "b", "c"})
+	if len(warnings) != 1 {
+		t.Errorf("expected a warning when no node accepts, got: %v", warnings)
+	}
+}
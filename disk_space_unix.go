@@ -0,0 +1,31 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package cbgt
+
+import (
+	"syscall"
+)
+
+// diskUsageOS returns the bytes that are available to unprivileged
+// users, and the total bytes, of the filesystem of a path.
+func diskUsageOS(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize),
+		uint64(st.Blocks) * uint64(st.Bsize), nil
+}
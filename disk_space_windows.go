@@ -0,0 +1,22 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+)
+
+// diskUsageOS isn't supported on windows, where the disk space
+// thresholds therefore have no effect.
+func diskUsageOS(path string) (free, total uint64, err error) {
+	return 0, 0, fmt.Errorf("disk_space: not supported on windows")
+}
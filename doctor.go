@@ -0,0 +1,373 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The statuses of a DoctorCheck and of a DoctorReport, in increasing
+// order of severity.
+const (
+	DOCTOR_OK   = "ok"
+	DOCTOR_WARN = "warn"
+	DOCTOR_FAIL = "fail"
+)
+
+// DEFAULT_DOCTOR_MAX_CLOCK_SKEW is the clock skew to another node
+// above which a DoctorReport warns.
+const DEFAULT_DOCTOR_MAX_CLOCK_SKEW = 5 * time.Second
+
+// DEFAULT_DOCTOR_TIMEOUT is the timeout of the requests of the clock
+// skew checks to the other nodes.
+const DEFAULT_DOCTOR_TIMEOUT = 5 * time.Second
+
+// DoctorOptions is what RunDoctor() checks, which is usually the
+// startup configuration of a node that's about to join a cluster.
+type DoctorOptions struct {
+	DataDir  string
+	Cfg      Cfg    // Should be writable, for the CAS checks.
+	UUID     string // The node's own UUID, to skip in the clock checks.
+	BindHttp string // See SplitBindHttp().
+	Server   string // The default datasource.
+	Options  map[string]string
+
+	MaxClockSkew time.Duration // Defaults to DEFAULT_DOCTOR_MAX_CLOCK_SKEW.
+	Timeout      time.Duration // Defaults to DEFAULT_DOCTOR_TIMEOUT.
+	HttpClient   *http.Client  // Optional.
+}
+
+// A DoctorCheck is the outcome of one check of a DoctorReport.
+type DoctorCheck struct {
+	Name    string      `json:"name"`
+	Status  string      `json:"status"` // See DOCTOR_OK.
+	Message string      `json:"message,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// A DoctorReport is the outcome of RunDoctor(), whose Status is the
+// most severe status of its checks.
+type DoctorReport struct {
+	Status string         `json:"status"`
+	Time   string         `json:"time"`
+	Checks []*DoctorCheck `json:"checks"`
+}
+
+// RunDoctor checks whether a node is able to join a cluster and to
+// serve, which are the writability of its dataDir, the connectivity
+// and the CAS behavior of the Cfg, the binding of its ports, the
+// reachability of the sources of the indexes in the Cfg, and the
+// clock skew to the other nodes, and returns a structured report.
+// The checks that depend on an unreachable Cfg are skipped.
+func RunDoctor(o DoctorOptions) *DoctorReport {
+	r := &DoctorReport{Time: time.Now().Format(time.RFC3339Nano)}
+
+	r.Checks = append(r.Checks, DoctorDataDir(o.DataDir))
+
+	cfgCheck := DoctorCfg(o.Cfg)
+	r.Checks = append(r.Checks, cfgCheck)
+
+	if o.BindHttp != "" {
+		r.Checks = append(r.Checks, DoctorBindHttp(o.BindHttp))
+	}
+
+	if cfgCheck.Status != DOCTOR_FAIL {
+		r.Checks = append(r.Checks, DoctorSources(o.Cfg, o.Server, o.Options))
+		r.Checks = append(r.Checks, DoctorClockSkews(o))
+	}
+
+	r.Status = DOCTOR_OK
+	for _, c := range r.Checks {
+		r.Status = doctorWorse(r.Status, c.Status)
+	}
+
+	return r
+}
+
+func doctorWorse(a, b string) string {
+	if a == DOCTOR_FAIL || b == DOCTOR_FAIL {
+		return DOCTOR_FAIL
+	}
+	if a == DOCTOR_WARN || b == DOCTOR_WARN {
+		return DOCTOR_WARN
+	}
+	return DOCTOR_OK
+}
+
+func doctorCheck(name string, err error, details interface{}) *DoctorCheck {
+	if err != nil {
+		return &DoctorCheck{Name: name, Status: DOCTOR_FAIL,
+			Message: err.Error(), Details: details}
+	}
+	return &DoctorCheck{Name: name, Status: DOCTOR_OK, Details: details}
+}
+
+// DoctorDataDir checks that a file can be written, synced, read back
+// and removed in the dataDir, which is created if needed, and reports
+// the dataDir's free disk space.
+func DoctorDataDir(dataDir string) *DoctorCheck {
+	if dataDir == "" {
+		return doctorCheck("dataDir", fmt.Errorf("doctor: no dataDir"), nil)
+	}
+
+	err := os.MkdirAll(dataDir, 0700)
+	if err != nil {
+		return doctorCheck("dataDir", fmt.Errorf("doctor: mkdir,"+
+			" dataDir: %s, err: %v", dataDir, err), nil)
+	}
+
+	path := filepath.Join(dataDir, "doctor-"+NewUUID()+".tmp")
+	defer os.Remove(path)
+
+	val := []byte(path)
+
+	err = func() error {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(val)
+		if err == nil {
+			err = f.Sync()
+		}
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		return err
+	}()
+	if err != nil {
+		return doctorCheck("dataDir", fmt.Errorf("doctor: write,"+
+			" dataDir: %s, err: %v", dataDir, err), nil)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err == nil && !bytes.Equal(buf, val) {
+		err = fmt.Errorf("mismatched contents")
+	}
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		return doctorCheck("dataDir", fmt.Errorf("doctor: read back,"+
+			" dataDir: %s, err: %v", dataDir, err), nil)
+	}
+
+	details := map[string]interface{}{"dataDir": dataDir}
+	if free, total, err := diskUsage(dataDir); err == nil {
+		details["free"] = free
+		details["total"] = total
+	}
+
+	return doctorCheck("dataDir", nil, details)
+}
+
+// DoctorCfg checks that the Cfg is reachable, and that it implements
+// the CAS semantics that the cluster relies on, using a temporary key
+// that's removed afterwards: a create of an existing key, and an
+// update or a delete with a stale CAS, must fail.
+func DoctorCfg(cfg Cfg) *DoctorCheck {
+	if cfg == nil {
+		return doctorCheck("cfg", fmt.Errorf("doctor: no cfg"), nil)
+	}
+
+	_, _, err := cfg.Get(versionKey, 0)
+	if err != nil {
+		return doctorCheck("cfg", fmt.Errorf("doctor: cfg get, err: %v",
+			err), nil)
+	}
+
+	key := "doctor-" + NewUUID()
+
+	cas0, err := cfg.Set(key, []byte("0"), 0)
+	if err != nil {
+		return doctorCheck("cfg", fmt.Errorf("doctor: cfg create,"+
+			" key: %s, err: %v", key, err), nil)
+	}
+	defer cfg.Del(key, 0)
+
+	err = doctorCfgCAS(cfg, key, cas0)
+	if err != nil {
+		return doctorCheck("cfg", fmt.Errorf("doctor: cfg cas,"+
+			" key: %s, err: %v", key, err), nil)
+	}
+
+	return doctorCheck("cfg", nil, nil)
+}
+
+func doctorCfgCAS(cfg Cfg, key string, cas0 uint64) error {
+	if _, err := cfg.Set(key, []byte("x"), 0); err == nil {
+		return fmt.Errorf("a create of an existing key succeeded")
+	}
+
+	cas1, err := cfg.Set(key, []byte("1"), cas0)
+	if err != nil {
+		return fmt.Errorf("an update with the current cas failed, err: %v",
+			err)
+	}
+	if cas1 == cas0 {
+		return fmt.Errorf("an update didn't change the cas: %d", cas0)
+	}
+
+	if _, err = cfg.Set(key, []byte("x"), cas0); err == nil {
+		return fmt.Errorf("an update with a stale cas succeeded")
+	}
+
+	val, cas, err := cfg.Get(key, 0)
+	if err != nil || cas != cas1 || string(val) != "1" {
+		return fmt.Errorf("a get didn't return the update, val: %q,"+
+			" cas: %d, expected cas: %d, err: %v", val, cas, cas1, err)
+	}
+
+	if err = cfg.Del(key, cas0); err == nil {
+		return fmt.Errorf("a delete with a stale cas succeeded")
+	}
+
+	return cfg.Del(key, cas1)
+}
+
+// DoctorBindHttp checks that the addresses of the bindHttp can be
+// listened on, which fails while the node is already running.
+func DoctorBindHttp(bindHttp string) *DoctorCheck {
+	l, err := ListenHttp(bindHttp)
+	if err != nil {
+		return doctorCheck("bindHttp", fmt.Errorf("doctor: %v", err), nil)
+	}
+	l.Close()
+
+	return doctorCheck("bindHttp", nil, SplitBindHttp(bindHttp))
+}
+
+// DoctorSources checks that the partitions of the source of each
+// index in the Cfg can be retrieved by the source's feed type, where
+// a source type without a registered feed type fails.
+func DoctorSources(cfg Cfg, server string,
+	options map[string]string) *DoctorCheck {
+	indexDefs, _, err := CfgGetIndexDefs(cfg)
+	if err != nil {
+		return doctorCheck("sources", fmt.Errorf("doctor: index defs,"+
+			" err: %v", err), nil)
+	}
+	if indexDefs == nil {
+		return doctorCheck("sources", nil, nil)
+	}
+
+	type source struct {
+		SourceType string `json:"sourceType"`
+		SourceName string `json:"sourceName"`
+		Partitions int    `json:"partitions"`
+		Err        string `json:"err,omitempty"`
+	}
+
+	var sources []*source
+	seen := map[string]bool{}
+	failed := 0
+
+	for _, indexName := range sortedIndexDefNames(indexDefs) {
+		indexDef := indexDefs.IndexDefs[indexName]
+
+		k := indexDef.SourceType + "\x00" + indexDef.SourceName + "\x00" +
+			indexDef.SourceUUID + "\x00" + indexDef.SourceParams
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+
+		s := &source{
+			SourceType: indexDef.SourceType,
+			SourceName: indexDef.SourceName,
+		}
+		sources = append(sources, s)
+
+		feedType := FeedTypes[indexDef.SourceType]
+		if feedType == nil || feedType.Partitions == nil {
+			s.Err = "unknown source type"
+			failed++
+			continue
+		}
+
+		partitions, err := feedType.Partitions(indexDef.SourceType,
+			indexDef.SourceName, indexDef.SourceUUID,
+			indexDef.SourceParams, server, options)
+		if err != nil {
+			s.Err = err.Error()
+			failed++
+			continue
+		}
+		s.Partitions = len(partitions)
+	}
+
+	if failed > 0 {
+		return doctorCheck("sources", fmt.Errorf("doctor: unreachable"+
+			" sources: %d", failed), sources)
+	}
+
+	return doctorCheck("sources", nil, sources)
+}
+
+func sortedIndexDefNames(indexDefs *IndexDefs) []string {
+	rv := make([]string, 0, len(indexDefs.IndexDefs))
+	for indexName := range indexDefs.IndexDefs {
+		rv = append(rv, indexName)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// DoctorClockSkews checks the clock skew to each of the known nodes
+// in the Cfg, other than the node itself, and warns about a node that
+// is unreachable or whose clock skew is above the MaxClockSkew, as
+// the times in the Cfg, the events and the ages are compared across
+// the nodes.
+func DoctorClockSkews(o DoctorOptions) *DoctorCheck {
+	maxSkew := o.MaxClockSkew
+	if maxSkew <= 0 {
+		maxSkew = DEFAULT_DOCTOR_MAX_CLOCK_SKEW
+	}
+
+	client := o.HttpClient
+	if client == nil {
+		timeout := o.Timeout
+		if timeout <= 0 {
+			timeout = DEFAULT_DOCTOR_TIMEOUT
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+
+	nodeDefs, _, err := CfgGetNodeDefs(o.Cfg, NODE_DEFS_KNOWN)
+	if err != nil {
+		return doctorCheck("clockSkew", fmt.Errorf("doctor: node defs,"+
+			" err: %v", err), nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		CLOCK_SKEW_CHECK_TIMEOUT)
+	skews, unreachable, skewed := calcClockSkews(ctx, client, nodeDefs,
+		o.UUID, "/", maxSkew)
+	cancel()
+	warn := unreachable + skewed
+
+	c := doctorCheck("clockSkew", nil, skews)
+	if warn > 0 {
+		c.Status = DOCTOR_WARN
+		c.Message = fmt.Sprintf("doctor: nodes that are unreachable or"+
+			" whose clock skew is above %s: %d", maxSkew, warn)
+	}
+	return c
+}
@@ -0,0 +1,163 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doctorChecks(r *DoctorReport) map[string]*DoctorCheck {
+	rv := map[string]*DoctorCheck{}
+	for _, c := range r.Checks {
+		rv[c.Name] = c
+	}
+	return rv
+}
+
+func TestRunDoctor(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["a"] = &IndexDef{Name: "a", SourceType: "nil"}
+	indexDefs.IndexDefs["b"] = &IndexDef{Name: "b", SourceType: "nil"}
+	_, err := CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs() to work, err: %v", err)
+	}
+
+	// A node whose clock is ahead by a minute.
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date",
+				time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		}))
+	defer s.Close()
+
+	nodeDefs := NewNodeDefs(Version)
+	nodeDefs.NodeDefs["self"] = &NodeDef{UUID: "self", HostPort: "unused"}
+	nodeDefs.NodeDefs["ahead"] = &NodeDef{UUID: "ahead",
+		HostPort: strings.TrimPrefix(s.URL, "http://")}
+	_, err = CfgSetNodeDefs(cfg, NODE_DEFS_KNOWN, nodeDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetNodeDefs() to work, err: %v", err)
+	}
+
+	o := DoctorOptions{
+		DataDir:  emptyDir,
+		Cfg:      cfg,
+		UUID:     "self",
+		BindHttp: "127.0.0.1:0",
+	}
+
+	r := RunDoctor(o)
+	if r.Status != DOCTOR_WARN {
+		t.Errorf("expected a warn report, got: %#v", r)
+	}
+	checks := doctorChecks(r)
+	for _, name := range []string{"dataDir", "cfg", "bindHttp", "sources"} {
+		if checks[name] == nil || checks[name].Status != DOCTOR_OK {
+			t.Errorf("expected %s to be ok, got: %#v", name, checks[name])
+		}
+	}
+	skews, _ := checks["clockSkew"].Details.([]*NodeClockSkew)
+	if checks["clockSkew"].Status != DOCTOR_WARN || len(skews) != 1 ||
+		skews[0].UUID != "ahead" || skews[0].Err != "" {
+		t.Errorf("expected a clock skew warning, got: %#v, %#v",
+			checks["clockSkew"], skews)
+	}
+	if d, _ := time.ParseDuration(skews[0].Skew); d < 58*time.Second ||
+		d > 62*time.Second {
+		t.Errorf("expected a minute of skew, got: %s", skews[0].Skew)
+	}
+
+	// The temporary files and keys were removed.
+	files, _ := ioutil.ReadDir(emptyDir)
+	if len(files) != 0 {
+		t.Errorf("expected an empty dataDir, got: %d files", len(files))
+	}
+	for key := range cfg.Entries {
+		if strings.HasPrefix(key, "doctor-") {
+			t.Errorf("expected no doctor keys, got: %s", key)
+		}
+	}
+
+	// With the same clock, and a source type that's not registered.
+	o.MaxClockSkew = 2 * time.Minute
+	indexDefs.IndexDefs["c"] = &IndexDef{Name: "c", SourceType: "unknown"}
+	_, err = CfgSetIndexDefs(cfg, indexDefs, CFG_CAS_FORCE)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs() to work, err: %v", err)
+	}
+
+	r = RunDoctor(o)
+	checks = doctorChecks(r)
+	if r.Status != DOCTOR_FAIL || checks["sources"].Status != DOCTOR_FAIL ||
+		checks["clockSkew"].Status != DOCTOR_OK {
+		t.Errorf("expected a failed source, got: %#v, %#v",
+			checks["sources"], checks["clockSkew"])
+	}
+}
+
+func TestRunDoctorFailures(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected listen to work, err: %v", err)
+	}
+	defer l.Close()
+
+	r := RunDoctor(DoctorOptions{
+		DataDir:  emptyDir,
+		Cfg:      &ErrorOnlyCfg{},
+		BindHttp: l.Addr().String(),
+	})
+	if r.Status != DOCTOR_FAIL {
+		t.Errorf("expected a failed report, got: %#v", r)
+	}
+	checks := doctorChecks(r)
+	if checks["cfg"].Status != DOCTOR_FAIL ||
+		checks["bindHttp"].Status != DOCTOR_FAIL {
+		t.Errorf("expected failed cfg and bindHttp, got: %#v", r.Checks)
+	}
+	if checks["sources"] != nil || checks["clockSkew"] != nil {
+		t.Errorf("expected the cfg dependent checks to be skipped")
+	}
+}
+
+// A noCASCfg is a broken Cfg that ignores the CAS of its mutations.
+type noCASCfg struct {
+	*CfgMem
+}
+
+func (c *noCASCfg) Set(key string, val []byte, cas uint64) (uint64, error) {
+	return c.CfgMem.Set(key, val, CFG_CAS_FORCE)
+}
+
+func TestDoctorCfgCAS(t *testing.T) {
+	c := DoctorCfg(&noCASCfg{NewCfgMem()})
+	if c.Status != DOCTOR_FAIL ||
+		!strings.Contains(c.Message, "a create of an existing key") {
+		t.Errorf("expected a failed cas check, got: %#v", c)
+	}
+}
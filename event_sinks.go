@@ -0,0 +1,519 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The categories of the events that are published to the EventSinks.
+const (
+	EVENT_CATEGORY_MANAGER    = "manager"   // See Manager.AddEvent().
+	EVENT_CATEGORY_INDEX      = "index"     // See IndexEvent.
+	EVENT_CATEGORY_FEED_ERROR = "feedError" // See Manager.OnFeedError().
+	EVENT_CATEGORY_PLAN       = "plan"      // New plans saved, or observed, by this node.
+	EVENT_CATEGORY_REBALANCE  = "rebalance" // See the rebalance package.
+	EVENT_CATEGORY_AUDIT      = "audit"     // See AuditRecord.
+)
+
+// DEFAULT_EVENT_SINK_MAX_QUEUE is the default number of undelivered
+// events that a sink holds, beyond which the oldest are dropped.
+const DEFAULT_EVENT_SINK_MAX_QUEUE = 1000
+
+// EVENT_SINK_RETRY_INIT and EVENT_SINK_RETRY_MAX bound the backoff
+// between the retries of a failed delivery.
+var EVENT_SINK_RETRY_INIT = 100 * time.Millisecond
+var EVENT_SINK_RETRY_MAX = 30 * time.Second
+
+// A SinkEvent is an event that's delivered to an EventSink.
+type SinkEvent struct {
+	// ID is unique to the event, so that a receiver can drop the
+	// redelivered events.
+	ID       string          `json:"id"`
+	Category string          `json:"category"`
+	Node     string          `json:"node"` // The UUID of the publishing node.
+	Time     string          `json:"time"`
+	Event    json.RawMessage `json:"event"`
+
+	// Seq is a hybrid time in nanoseconds, which strictly increases
+	// across the events of a node, so that they can be ordered even
+	// when the node's clock steps, unlike the Time.  The Seq of a
+	// restarted node keeps increasing unless its clock stepped
+	// backwards by more than its downtime.  See NextHybridTime().
+	Seq int64 `json:"seq"`
+}
+
+// An EventSink receives the events of a Manager with at-least-once
+// semantics: the events are delivered in order, one at a time, and an
+// event whose Send() returns an error is retried with backoff until
+// it succeeds.  The undelivered events of a sink are spooled to the
+// Manager's dataDir, so that they survive a restart.
+type EventSink interface {
+	Send(e *SinkEvent) error
+}
+
+// EventSinkFunc adapts a func, such as an application's callback, to
+// an EventSink.
+type EventSinkFunc func(e *SinkEvent) error
+
+func (f EventSinkFunc) Send(e *SinkEvent) error {
+	return f(e)
+}
+
+// An EventSinkDef configures an EventSink.  The "eventSinks" manager
+// option is a JSON array of EventSinkDefs.
+type EventSinkDef struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // A key of the EventSinkTypes.
+
+	// Categories filters the events, where empty means all.
+	Categories []string `json:"categories,omitempty"`
+
+	Params map[string]string `json:"params,omitempty"`
+
+	// MaxQueue defaults to DEFAULT_EVENT_SINK_MAX_QUEUE.
+	MaxQueue int `json:"maxQueue,omitempty"`
+}
+
+// An EventSinkType creates an EventSink from its definition.
+type EventSinkType func(def *EventSinkDef) (EventSink, error)
+
+// EventSinkTypes is a global registry of the EventSink types, such as
+// "webhook".  An application can register more types at init time,
+// such as a Kafka topic producer, as cbgt itself doesn't depend on a
+// Kafka client.
+var EventSinkTypes = map[string]EventSinkType{
+	"webhook": NewEventSinkWebhook,
+}
+
+// EventSinkStats are the counters of an EventSink.
+type EventSinkStats struct {
+	TotPublish uint64 `json:"totPublish"`
+	TotSend    uint64 `json:"totSend"`
+	TotSendErr uint64 `json:"totSendErr"` // Each is retried.
+	TotDrop    uint64 `json:"totDrop"`    // Dropped by a full queue.
+	Queued     uint64 `json:"queued"`
+}
+
+// ---------------------------------------------------------
+
+// eventSinkWebhook POSTs the JSON of each event to a URL.
+type eventSinkWebhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewEventSinkWebhook returns an EventSink that POSTs the JSON of each
+// SinkEvent to the "url" param, where the delivery fails unless the
+// response has a 2xx status code.  The optional "timeout" param, such
+// as "10s", bounds each POST.
+func NewEventSinkWebhook(def *EventSinkDef) (EventSink, error) {
+	url := def.Params["url"]
+	if url == "" {
+		return nil, fmt.Errorf("event_sinks: webhook needs a url,"+
+			" name: %s", def.Name)
+	}
+
+	timeout := 10 * time.Second
+	if v := def.Params["timeout"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("event_sinks: webhook timeout,"+
+				" name: %s, err: %v", def.Name, err)
+		}
+		timeout = d
+	}
+
+	return &eventSinkWebhook{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (s *eventSinkWebhook) Send(e *SinkEvent) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json",
+		bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("event_sinks: webhook, url: %s, status code: %d",
+			s.url, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// An eventSinkRunner delivers the queued events of a sink.
+type eventSinkRunner struct {
+	mgr        *Manager
+	def        EventSinkDef
+	sink       EventSink
+	categories map[string]bool // Nil means all.
+	spoolPath  string          // Empty means no spool.
+
+	stats EventSinkStats
+
+	m      sync.Mutex // Protects the queue.
+	queue  []*SinkEvent
+	kickCh chan struct{}
+	stopCh chan struct{}
+}
+
+func newEventSinkRunner(mgr *Manager, def *EventSinkDef,
+	sink EventSink) *eventSinkRunner {
+	r := &eventSinkRunner{
+		mgr:    mgr,
+		def:    *def,
+		sink:   sink,
+		kickCh: make(chan struct{}, 1),
+		stopCh: make(chan struct{}),
+	}
+	if r.def.MaxQueue <= 0 {
+		r.def.MaxQueue = DEFAULT_EVENT_SINK_MAX_QUEUE
+	}
+	if len(def.Categories) > 0 {
+		r.categories = StringsToMap(def.Categories)
+	}
+	if mgr.dataDir != "" {
+		r.spoolPath = filepath.Join(mgr.dataDir,
+			"eventSink-"+def.Name+".json")
+		r.loadSpool()
+	}
+	return r
+}
+
+func (r *eventSinkRunner) loadSpool() {
+	buf, err := ioutil.ReadFile(r.spoolPath)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &r.queue)
+	if err != nil {
+		r.mgr.log.Warnf("event_sinks: spool, name: %s, err: %v",
+			r.def.Name, err)
+		r.queue = nil
+	}
+	atomic.StoreUint64(&r.stats.Queued, uint64(len(r.queue)))
+}
+
+// saveSpoolLOCKED persists the undelivered events.
+func (r *eventSinkRunner) saveSpoolLOCKED() {
+	if r.spoolPath == "" {
+		return
+	}
+
+	if len(r.queue) <= 0 {
+		os.Remove(r.spoolPath)
+		return
+	}
+
+	buf, err := json.Marshal(r.queue)
+	if err == nil {
+		tmp := r.spoolPath + ".tmp"
+		err = ioutil.WriteFile(tmp, buf, 0600)
+		if err == nil {
+			err = os.Rename(tmp, r.spoolPath)
+		}
+	}
+	if err != nil {
+		r.mgr.log.Warnf("event_sinks: spool, name: %s, err: %v",
+			r.def.Name, err)
+	}
+}
+
+func (r *eventSinkRunner) publish(e *SinkEvent) {
+	if r.categories != nil && !r.categories[e.Category] {
+		return
+	}
+
+	atomic.AddUint64(&r.stats.TotPublish, 1)
+
+	r.m.Lock()
+	for len(r.queue) >= r.def.MaxQueue {
+		r.queue = r.queue[1:]
+		atomic.AddUint64(&r.stats.TotDrop, 1)
+	}
+	r.queue = append(r.queue, e)
+	atomic.StoreUint64(&r.stats.Queued, uint64(len(r.queue)))
+	r.saveSpoolLOCKED()
+	r.m.Unlock()
+
+	select {
+	case r.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued events until the runner or the manager
+// stops.
+func (r *eventSinkRunner) run() {
+	backoff := EVENT_SINK_RETRY_INIT
+
+	for {
+		r.m.Lock()
+		var e *SinkEvent
+		if len(r.queue) > 0 {
+			e = r.queue[0]
+		}
+		r.m.Unlock()
+
+		if e == nil {
+			select {
+			case <-r.stopCh:
+				return
+			case <-r.mgr.stopCh:
+				return
+			case <-r.kickCh:
+				continue
+			}
+		}
+
+		err := r.sink.Send(e)
+		if err != nil {
+			atomic.AddUint64(&r.stats.TotSendErr, 1)
+			r.mgr.log.Warnf("event_sinks: send, name: %s, id: %s,"+
+				" err: %v", r.def.Name, e.ID, err)
+
+			select {
+			case <-r.stopCh:
+				return
+			case <-r.mgr.stopCh:
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > EVENT_SINK_RETRY_MAX {
+				backoff = EVENT_SINK_RETRY_MAX
+			}
+			continue
+		}
+
+		atomic.AddUint64(&r.stats.TotSend, 1)
+		backoff = EVENT_SINK_RETRY_INIT
+
+		r.m.Lock()
+		if len(r.queue) > 0 && r.queue[0] == e {
+			r.queue = r.queue[1:]
+		}
+		atomic.StoreUint64(&r.stats.Queued, uint64(len(r.queue)))
+		r.saveSpoolLOCKED()
+		r.m.Unlock()
+	}
+}
+
+// ---------------------------------------------------------
+
+// AddEventSink starts delivering the published events to a sink, which
+// replaces any sink of the same name.  When the sink is nil, it's
+// created from the def's Type.
+func (mgr *Manager) AddEventSink(def *EventSinkDef, sink EventSink) error {
+	mgr.refreshEventSinks()
+
+	return mgr.addEventSink(def, sink, false)
+}
+
+func (mgr *Manager) addEventSink(def *EventSinkDef, sink EventSink,
+	configured bool) error {
+	if def.Name == "" {
+		return fmt.Errorf("event_sinks: a sink needs a name")
+	}
+
+	if sink == nil {
+		sinkType := EventSinkTypes[def.Type]
+		if sinkType == nil {
+			return fmt.Errorf("event_sinks: unknown type: %q, name: %s",
+				def.Type, def.Name)
+		}
+		var err error
+		sink, err = sinkType(def)
+		if err != nil {
+			return err
+		}
+	}
+
+	r := newEventSinkRunner(mgr, def, sink)
+
+	mgr.eventSinksMutex.Lock()
+	if prev := mgr.eventSinks[def.Name]; prev != nil {
+		close(prev.stopCh)
+	}
+	if mgr.eventSinks == nil {
+		mgr.eventSinks = map[string]*eventSinkRunner{}
+	}
+	mgr.eventSinks[def.Name] = r
+	if configured {
+		mgr.eventSinksConfigured[def.Name] = true
+	} else {
+		delete(mgr.eventSinksConfigured, def.Name)
+	}
+	mgr.eventSinksMutex.Unlock()
+
+	go r.run()
+
+	return nil
+}
+
+// RemoveEventSink stops delivering events to a sink, keeping its
+// spooled events for when a sink of the same name is added again.
+func (mgr *Manager) RemoveEventSink(name string) {
+	mgr.eventSinksMutex.Lock()
+	if r := mgr.eventSinks[name]; r != nil {
+		close(r.stopCh)
+		delete(mgr.eventSinks, name)
+		delete(mgr.eventSinksConfigured, name)
+	}
+	mgr.eventSinksMutex.Unlock()
+}
+
+// EventSinkStats returns the counters of the sinks, keyed by name.
+func (mgr *Manager) EventSinkStats() map[string]EventSinkStats {
+	mgr.eventSinksMutex.Lock()
+	defer mgr.eventSinksMutex.Unlock()
+
+	rv := make(map[string]EventSinkStats, len(mgr.eventSinks))
+	for name, r := range mgr.eventSinks {
+		var s EventSinkStats
+		AtomicCopyMetrics(&r.stats, &s, nil)
+		rv[name] = s
+	}
+	return rv
+}
+
+// eventSinkDefsFromOptions returns the sinks that are configured by
+// the "eventSinks" manager option, and by the "indexEventsWebhookURL"
+// manager option, which is a shorthand for a webhook of the index
+// events.
+func eventSinkDefsFromOptions(options map[string]string) (
+	[]*EventSinkDef, error) {
+	var defs []*EventSinkDef
+
+	if v := options["eventSinks"]; v != "" {
+		err := json.Unmarshal([]byte(v), &defs)
+		if err != nil {
+			return nil, fmt.Errorf("event_sinks: eventSinks option,"+
+				" err: %v", err)
+		}
+	}
+
+	if url := options["indexEventsWebhookURL"]; url != "" {
+		defs = append(defs, &EventSinkDef{
+			Name:       "indexEventsWebhook",
+			Type:       "webhook",
+			Categories: []string{EVENT_CATEGORY_INDEX},
+			Params:     map[string]string{"url": url},
+		})
+	}
+
+	return defs, nil
+}
+
+// refreshEventSinks reconciles the configured sinks with the manager
+// options, whenever the options changed.
+func (mgr *Manager) refreshEventSinks() {
+	options := mgr.Options()
+	applied := options["eventSinks"] + "\n" + options["indexEventsWebhookURL"]
+
+	mgr.eventSinksMutex.Lock()
+	if mgr.eventSinksApplied != nil && *mgr.eventSinksApplied == applied {
+		mgr.eventSinksMutex.Unlock()
+		return
+	}
+	mgr.eventSinksApplied = &applied
+	if mgr.eventSinksConfigured == nil {
+		mgr.eventSinksConfigured = map[string]bool{}
+	}
+	var prevConfigured []string
+	for name := range mgr.eventSinksConfigured {
+		prevConfigured = append(prevConfigured, name)
+	}
+	mgr.eventSinksMutex.Unlock()
+
+	defs, err := eventSinkDefsFromOptions(options)
+	if err != nil {
+		mgr.log.Warnf("%v", err)
+		return
+	}
+
+	for _, name := range prevConfigured {
+		mgr.RemoveEventSink(name)
+	}
+
+	for _, def := range defs {
+		err = mgr.addEventSink(def, nil, true)
+		if err != nil {
+			mgr.log.Warnf("event_sinks: add, name: %s, err: %v",
+				def.Name, err)
+		}
+	}
+}
+
+// PublishEvent delivers an event, which is a JSON []byte or else is
+// marshaled to JSON, to the sinks of its category, such as
+// EVENT_CATEGORY_REBALANCE.
+func (mgr *Manager) PublishEvent(category string, event interface{}) {
+	buf, ok := event.([]byte)
+	if !ok {
+		var err error
+		buf, err = json.Marshal(event)
+		if err != nil {
+			mgr.log.Warnf("event_sinks: publish, category: %s, err: %v",
+				category, err)
+			return
+		}
+	}
+
+	mgr.refreshEventSinks()
+
+	mgr.eventSinksMutex.Lock()
+	runners := make([]*eventSinkRunner, 0, len(mgr.eventSinks))
+	for _, r := range mgr.eventSinks {
+		runners = append(runners, r)
+	}
+	mgr.eventSinksMutex.Unlock()
+
+	if len(runners) <= 0 {
+		return
+	}
+
+	e := &SinkEvent{
+		ID:       NewUUID(),
+		Category: category,
+		Node:     mgr.uuid,
+		Time:     Now().Format(time.RFC3339Nano),
+		Event:    json.RawMessage(buf),
+		Seq:      mgr.eventClock.Next(),
+	}
+
+	for _, r := range runners {
+		r.publish(e)
+	}
+}
@@ -0,0 +1,193 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventSinks(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := NewManager(Version, NewCfgMem(), nil, NewUUID(),
+		[]string{"pindex"}, "", 1, "", ":1000", emptyDir, "", nil, nil)
+	defer mgr.Stop()
+
+	var m sync.Mutex
+	var got []string
+	var seqs []int64
+	failures := 2
+
+	sentCh := make(chan struct{}, 10)
+
+	err := mgr.AddEventSink(&EventSinkDef{
+		Name:       "cb",
+		Categories: []string{EVENT_CATEGORY_FEED_ERROR},
+	}, EventSinkFunc(func(e *SinkEvent) error {
+		m.Lock()
+		defer m.Unlock()
+		if failures > 0 {
+			failures--
+			return fmt.Errorf("not yet")
+		}
+		got = append(got, e.Category+":"+string(e.Event))
+		seqs = append(seqs, e.Seq)
+		sentCh <- struct{}{}
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("expected AddEventSink to work, err: %v", err)
+	}
+
+	mgr.PublishEvent(EVENT_CATEGORY_PLAN, "skipped")
+	mgr.PublishEvent(EVENT_CATEGORY_FEED_ERROR, "a")
+	mgr.PublishEvent(EVENT_CATEGORY_FEED_ERROR, "b")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sentCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the sink deliveries")
+		}
+	}
+
+	m.Lock()
+	if len(got) != 2 || got[0] != `feedError:"a"` || got[1] != `feedError:"b"` {
+		t.Errorf("expected the in-order retried events, got: %v", got)
+	}
+	if len(seqs) != 2 || seqs[0] <= 0 || seqs[1] <= seqs[0] {
+		t.Errorf("expected increasing seqs, got: %v", seqs)
+	}
+	m.Unlock()
+
+	stats := mgr.EventSinkStats()["cb"]
+	if stats.TotPublish != 2 || stats.TotSend != 2 ||
+		stats.TotSendErr != 2 || stats.Queued != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	mgr.RemoveEventSink("cb")
+	if len(mgr.EventSinkStats()) != 0 {
+		t.Errorf("expected no sinks after RemoveEventSink")
+	}
+}
+
+func TestEventSinkSpool(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := NewManager(Version, NewCfgMem(), nil, NewUUID(),
+		[]string{"pindex"}, "", 1, "", ":1000", emptyDir, "", nil, nil)
+	defer mgr.Stop()
+
+	def := &EventSinkDef{Name: "down", MaxQueue: 2}
+
+	err := mgr.AddEventSink(def, EventSinkFunc(func(e *SinkEvent) error {
+		return fmt.Errorf("down")
+	}))
+	if err != nil {
+		t.Fatalf("expected AddEventSink to work, err: %v", err)
+	}
+
+	mgr.AddEvent([]byte(`{"event":"a"}`))
+	mgr.AddEvent([]byte(`{"event":"b"}`))
+	mgr.AddEvent([]byte(`{"event":"c"}`))
+
+	if stats := mgr.EventSinkStats()["down"]; stats.TotDrop != 1 ||
+		stats.Queued != 2 {
+		t.Errorf("expected the oldest dropped, stats: %+v", stats)
+	}
+
+	mgr.RemoveEventSink("down")
+
+	// The spooled events are delivered by the sink's replacement.
+	sentCh := make(chan *SinkEvent, 10)
+	err = mgr.AddEventSink(def, EventSinkFunc(func(e *SinkEvent) error {
+		sentCh <- e
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("expected AddEventSink to work, err: %v", err)
+	}
+
+	for _, exp := range []string{`{"event":"b"}`, `{"event":"c"}`} {
+		select {
+		case e := <-sentCh:
+			if string(e.Event) != exp ||
+				e.Category != EVENT_CATEGORY_MANAGER ||
+				e.Node != mgr.UUID() || e.ID == "" {
+				t.Errorf("expected event: %s, got: %+v", exp, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the spooled events")
+		}
+	}
+}
+
+func TestEventSinksOption(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	webhookCh := make(chan *SinkEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			e := &SinkEvent{}
+			json.NewDecoder(r.Body).Decode(e)
+			webhookCh <- e
+		}))
+	defer webhook.Close()
+
+	mgr := NewManager(Version, NewCfgMem(), nil, NewUUID(),
+		[]string{"pindex"}, "", 1, "", ":1000", emptyDir, "", nil,
+		map[string]string{
+			"eventSinks": `[{"name":"hook","type":"webhook",` +
+				`"categories":["plan"],"params":{"url":"` + webhook.URL + `"}}]`,
+		})
+	defer mgr.Stop()
+
+	mgr.PublishEvent(EVENT_CATEGORY_MANAGER, "skipped")
+	mgr.PublishEvent(EVENT_CATEGORY_PLAN, map[string]string{"uuid": "p"})
+
+	select {
+	case e := <-webhookCh:
+		if e.Category != EVENT_CATEGORY_PLAN ||
+			string(e.Event) != `{"uuid":"p"}` {
+			t.Errorf("unexpected webhook event: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the webhook event")
+	}
+
+	// A sink removed from the options is stopped.
+	err := mgr.SetOptions(map[string]string{})
+	if err != nil {
+		t.Fatalf("expected SetOptions to work, err: %v", err)
+	}
+	mgr.PublishEvent(EVENT_CATEGORY_PLAN, "gone")
+	if len(mgr.EventSinkStats()) != 0 {
+		t.Errorf("expected no sinks, got: %v", mgr.EventSinkStats())
+	}
+
+	_, err = NewEventSinkWebhook(&EventSinkDef{Name: "nourl"})
+	if err == nil {
+		t.Errorf("expected a webhook without a url to fail")
+	}
+}
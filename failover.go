@@ -0,0 +1,141 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A FailoverResult describes the outcome, or for a dry run the
+// expected outcome, of failing over nodes.
+type FailoverResult struct {
+	Nodes  []string  `json:"nodes"`
+	DryRun bool      `json:"dryRun"`
+	Diff   *PlanDiff `json:"diff"`
+
+	// LostPIndexes are the planPIndexes that had no copies outside of
+	// the failed over nodes, so they'll be rebuilt from the source.
+	LostPIndexes []string `json:"lostPIndexes"`
+
+	PlanPIndexes *PlanPIndexes `json:"-"` // The failover plan.
+}
+
+// Failover removes the given nodes from the cluster without moving
+// any data, by unregistering the nodes and then planning in
+// "failover" mode, which promotes the surviving replicas of the
+// pindexes whose primaries were on the failed nodes.  With dryRun,
+// the Cfg is left untouched and only the expected plan changes are
+// returned.  A failed over node can later be added back with a
+// recovery rebalance, once it has re-registered.
+//
+// As the planners of the cluster also react to the unregistered
+// nodes, Failover is best run while the other planners are idle.
+// While the OpQuorum is enabled, the OP_QUORUM_FAILOVER of the nodes
+// must be confirmed first, except for a dry run.
+func Failover(log Log, cfg Cfg, version, server string,
+	options map[string]string, nodeUUIDs []string, dryRun bool) (
+	*FailoverResult, error) {
+	if len(nodeUUIDs) <= 0 {
+		return nil, fmt.Errorf("failover: no nodes")
+	}
+
+	nodeDefsWanted, err := PlannerGetNodeDefs(cfg, version, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, nodeUUID := range nodeUUIDs {
+		if nodeDefsWanted.NodeDefs[nodeUUID] == nil {
+			return nil, fmt.Errorf("failover: unknown node: %s", nodeUUID)
+		}
+	}
+
+	if !dryRun {
+		err = CheckOpQuorum(cfg, OP_QUORUM_FAILOVER,
+			OpQuorumNodesTarget(nodeUUIDs))
+		if err != nil {
+			return nil, err
+		}
+
+		err = unregisterNodesWithRetries(cfg, version, nodeUUIDs, 10)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	failed := StringsToMap(nodeUUIDs)
+
+	retry := NewCASRetry(PLAN_PINDEXES_KEY)
+	for tries := 0; tries < 10; tries++ {
+		indexDefs, nodeDefs, planPIndexesPrev, cas, err :=
+			PlannerGetPlan(log, cfg, version, "")
+		if err != nil {
+			return nil, err
+		}
+
+		// For a dry run, the nodes are still registered.
+		nodeDefsRemaining := NewNodeDefs(nodeDefs.ImplVersion)
+		for nodeUUID, nodeDef := range nodeDefs.NodeDefs {
+			if !failed[nodeUUID] {
+				nodeDefsRemaining.NodeDefs[nodeUUID] = nodeDef
+			}
+		}
+
+		planPIndexes, err := CalcPlan(log, "failover", indexDefs,
+			nodeDefsRemaining, planPIndexesPrev, version, server,
+			options, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failover: CalcPlan, err: %v", err)
+		}
+
+		rv := &FailoverResult{
+			Nodes:        append([]string(nil), nodeUUIDs...),
+			DryRun:       dryRun,
+			Diff:         DiffPlanPIndexes(planPIndexesPrev, planPIndexes),
+			LostPIndexes: []string{},
+			PlanPIndexes: planPIndexes,
+		}
+		sort.Strings(rv.Nodes)
+
+		for _, planPIndex := range sortedPlanPIndexes(planPIndexesPrev) {
+			lost := len(planPIndex.Nodes) > 0
+			for nodeUUID := range planPIndex.Nodes {
+				if !failed[nodeUUID] {
+					lost = false
+				}
+			}
+			if lost {
+				rv.LostPIndexes = append(rv.LostPIndexes, planPIndex.Name)
+			}
+		}
+
+		if dryRun || SamePlanPIndexes(planPIndexes, planPIndexesPrev) {
+			return rv, nil
+		}
+
+		_, err = CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+		if err == nil {
+			retry.Done(nil)
+			log.Printf("failover: nodes: %v, changed pindexes: %d,"+
+				" lost pindexes: %d", rv.Nodes, len(rv.Diff.Changed),
+				len(rv.LostPIndexes))
+			return rv, nil
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			return nil, fmt.Errorf("failover: could not save plan,"+
+				" err: %v", err)
+		}
+		retry.Conflict()
+	}
+
+	return nil, fmt.Errorf("failover: could not save plan, too many tries")
+}
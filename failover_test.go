@@ -0,0 +1,90 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestFailover(t *testing.T) {
+	log := NewStdLibLog(ioutil.Discard, "", 0)
+	cfg := NewCfgMem()
+
+	nodeDefs := NewNodeDefs(Version)
+	for _, nodeUUID := range []string{"a", "b", "c"} {
+		nodeDefs.NodeDefs[nodeUUID] = &NodeDef{UUID: nodeUUID,
+			ImplVersion: Version, HostPort: nodeUUID + ":1"}
+	}
+	for _, kind := range []string{NODE_DEFS_WANTED, NODE_DEFS_KNOWN} {
+		if _, err := CfgSetNodeDefs(cfg, kind, nodeDefs, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["x"] = &IndexDef{Name: "x", UUID: "xx",
+		Type: "blackhole", SourceType: "primary",
+		SourceParams: `{"numPartitions":6}`,
+		PlanParams:   PlanParams{MaxPartitionsPerPIndex: 1, NumReplicas: 1}}
+	if _, err := CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Plan(log, cfg, Version, "", "", nil, nil); err != nil {
+		t.Fatalf("expected Plan() to work, err: %v", err)
+	}
+	planPIndexesBefore, _, _ := CfgGetPlanPIndexes(cfg)
+
+	if _, err := Failover(log, cfg, Version, "", nil,
+		[]string{"not-a-node"}, true); err == nil {
+		t.Errorf("expected err on an unknown node")
+	}
+
+	dry, err := Failover(log, cfg, Version, "", nil, []string{"a"}, true)
+	if err != nil {
+		t.Fatalf("expected a dry run Failover() to work, err: %v", err)
+	}
+	if dry.Diff.Empty() || len(dry.LostPIndexes) != 0 {
+		t.Errorf("expected plan changes and no lost pindexes, got: %#v", dry)
+	}
+	if p, _, _ := CfgGetPlanPIndexes(cfg); !SamePlanPIndexes(p, planPIndexesBefore) {
+		t.Errorf("expected a dry run to leave the plan untouched")
+	}
+
+	res, err := Failover(log, cfg, Version, "", nil, []string{"a"}, false)
+	if err != nil {
+		t.Fatalf("expected Failover() to work, err: %v", err)
+	}
+	if !SamePlanPIndexes(res.PlanPIndexes, dry.PlanPIndexes) {
+		t.Errorf("expected the dry run plan to match the failover plan")
+	}
+
+	wanted, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if wanted.NodeDefs["a"] != nil || len(wanted.NodeDefs) != 2 {
+		t.Errorf("expected node a unregistered, got: %#v", wanted.NodeDefs)
+	}
+
+	planPIndexes, _, _ := CfgGetPlanPIndexes(cfg)
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.Nodes["a"] != nil {
+			t.Errorf("expected node a removed, pindex: %s", name)
+		}
+		for nodeUUID, n := range planPIndex.Nodes {
+			if n.Priority == 0 &&
+				planPIndexesBefore.PlanPIndexes[name].Nodes[nodeUUID] == nil {
+				t.Errorf("expected a promotion, not a move, pindex: %s,"+
+					" node: %s", name, nodeUUID)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A node advertises the features that it supports as the comma
+// separated "features" of its NodeDef extras, such as...
+//
+//   {"features":"leanPlan,osoBackfill", ...}
+//
+// During an online upgrade, the nodes of a cluster run different
+// versions, so a feature, such as a new plan format, must only be
+// used once all the wanted nodes support it.  A feature that's
+// advertised by all the wanted nodes is active, or cluster-effective.
+
+// NodeDefFeatures returns the features advertised by a node, where
+// unparsable extras advertise no features.
+func NodeDefFeatures(nodeDef *NodeDef) []string {
+	if nodeDef == nil || nodeDef.Extras == "" {
+		return nil
+	}
+
+	extras := map[string]string{}
+	err := json.Unmarshal([]byte(nodeDef.Extras), &extras)
+	if err != nil {
+		return nil
+	}
+
+	var rv []string
+	for _, f := range strings.Split(extras["features"], ",") {
+		f = strings.TrimSpace(f)
+		if f != "" {
+			rv = append(rv, f)
+		}
+	}
+
+	return rv
+}
+
+// ClusterFeatures is the outcome of the feature negotiation across
+// the wanted nodes of a cluster.
+type ClusterFeatures struct {
+	// Active are the features advertised by all the wanted nodes.
+	Active []string `json:"active"`
+
+	// Inactive are the features advertised by only some of the
+	// wanted nodes, keyed by feature, with the UUID's of the nodes
+	// that don't advertise the feature.
+	Inactive map[string][]string `json:"inactive"`
+}
+
+// IsActive returns true if the feature is cluster-effective.
+func (c *ClusterFeatures) IsActive(feature string) bool {
+	for _, f := range c.Active {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// CalcClusterFeatures negotiates the features of the nodeDefs, which
+// should be the wanted nodes.  No feature is active without nodes.
+func CalcClusterFeatures(nodeDefs *NodeDefs) *ClusterFeatures {
+	rv := &ClusterFeatures{
+		Active:   []string{},
+		Inactive: map[string][]string{},
+	}
+
+	if nodeDefs == nil || len(nodeDefs.NodeDefs) <= 0 {
+		return rv
+	}
+
+	nodeFeatures := map[string]map[string]bool{} // Keyed by node UUID.
+	all := map[string]bool{}
+	for nodeUUID, nodeDef := range nodeDefs.NodeDefs {
+		nodeFeatures[nodeUUID] = StringsToMap(NodeDefFeatures(nodeDef))
+		for f := range nodeFeatures[nodeUUID] {
+			all[f] = true
+		}
+	}
+
+	for f := range all {
+		var missing []string
+		for nodeUUID, features := range nodeFeatures {
+			if !features[f] {
+				missing = append(missing, nodeUUID)
+			}
+		}
+
+		if len(missing) <= 0 {
+			rv.Active = append(rv.Active, f)
+		} else {
+			sort.Strings(missing)
+			rv.Inactive[f] = missing
+		}
+	}
+
+	sort.Strings(rv.Active)
+
+	return rv
+}
+
+// ClusterFeatures returns the cluster-effective features, based on
+// the manager's latest wanted nodeDefs.
+func (mgr *Manager) ClusterFeatures() (*ClusterFeatures, error) {
+	nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return CalcClusterFeatures(nodeDefs), nil
+}
+
+// IsFeatureActive returns true if the feature is advertised by all
+// the wanted nodes, so that this node may use it.
+func (mgr *Manager) IsFeatureActive(feature string) bool {
+	c, err := mgr.ClusterFeatures()
+	if err != nil {
+		return false
+	}
+
+	return c.IsActive(feature)
+}
+
+// refreshClusterFeatures renegotiates the features when the wanted
+// nodeDefs change, and emits an event for every feature whose
+// activation state changed, such as when the last node of an online
+// upgrade joins, or when an older node rejoins the cluster.
+func (mgr *Manager) refreshClusterFeatures() {
+	c, err := mgr.ClusterFeatures()
+	if err != nil {
+		mgr.log.Warnf("features: ClusterFeatures, err: %v", err)
+		return
+	}
+
+	curr := StringsToMap(c.Active)
+
+	mgr.featuresMutex.Lock()
+	prev := mgr.features
+	mgr.features = curr
+	mgr.featuresMutex.Unlock()
+
+	if prev == nil {
+		// The initial negotiation of the node is not a change.
+		mgr.log.Printf("features: active: %v", c.Active)
+		return
+	}
+
+	var activated, deactivated []string
+	for f := range curr {
+		if !prev[f] {
+			activated = append(activated, f)
+		}
+	}
+	for f := range prev {
+		if !curr[f] {
+			deactivated = append(deactivated, f)
+		}
+	}
+	sort.Strings(activated)
+	sort.Strings(deactivated)
+
+	now := Now().Format(time.RFC3339Nano)
+
+	for _, f := range activated {
+		mgr.log.Printf("features: activated, feature: %s", f)
+		mgr.addFeatureEvent("featureActivated", f, nil, now)
+	}
+	for _, f := range deactivated {
+		mgr.log.Warnf("features: deactivated, feature: %s, nodes: %v",
+			f, c.Inactive[f])
+		mgr.addFeatureEvent("featureDeactivated", f, c.Inactive[f], now)
+	}
+}
+
+func (mgr *Manager) addFeatureEvent(event, feature string,
+	nodes []string, now string) {
+	eventBytes, _ := json.Marshal(struct {
+		Event   string   `json:"event"`
+		Feature string   `json:"feature"`
+		Nodes   []string `json:"nodes,omitempty"` // Lacking the feature.
+		Time    string   `json:"time"`
+	}{event, feature, nodes, now})
+	mgr.AddEvent(eventBytes)
+}
@@ -0,0 +1,120 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCalcClusterFeatures(t *testing.T) {
+	c := CalcClusterFeatures(nil)
+	if len(c.Active) != 0 || c.IsActive("a") {
+		t.Errorf("expected no active features without nodes, got: %#v", c)
+	}
+
+	nodeDefs := NewNodeDefs(Version)
+	nodeDefs.NodeDefs["n0"] = &NodeDef{UUID: "n0",
+		Extras: `{"features":"a, b,c"}`}
+	nodeDefs.NodeDefs["n1"] = &NodeDef{UUID: "n1",
+		Extras: `{"features":"b,a"}`}
+	nodeDefs.NodeDefs["n2"] = &NodeDef{UUID: "n2",
+		Extras: `{"features":"a,b,c","nsHostPort":"h:1"}`}
+
+	c = CalcClusterFeatures(nodeDefs)
+	if !reflect.DeepEqual(c.Active, []string{"a", "b"}) ||
+		!reflect.DeepEqual(c.Inactive, map[string][]string{"c": {"n1"}}) {
+		t.Errorf("unexpected features: %#v", c)
+	}
+	if !IsFeatureSupportedByCluster("b", nodeDefs) ||
+		IsFeatureSupportedByCluster("c", nodeDefs) {
+		t.Errorf("expected IsFeatureSupportedByCluster to agree")
+	}
+
+	// A node with unparsable extras, such as an older node, advertises
+	// no features.
+	nodeDefs.NodeDefs["n3"] = &NodeDef{UUID: "n3", Extras: "not json"}
+
+	c = CalcClusterFeatures(nodeDefs)
+	if len(c.Active) != 0 ||
+		!reflect.DeepEqual(c.Inactive["a"], []string{"n3"}) ||
+		!reflect.DeepEqual(c.Inactive["c"], []string{"n1", "n3"}) {
+		t.Errorf("unexpected features: %#v", c)
+	}
+}
+
+func TestManagerClusterFeatures(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1,
+		`{"features":"a,b"}`, ":1000", emptyDir, "some-datasource", nil, nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	if !m.IsFeatureActive("a") || !m.IsFeatureActive("b") ||
+		m.IsFeatureActive("c") {
+		t.Errorf("expected the features of the single node to be active")
+	}
+
+	refresh := func() {
+		m.GetNodeDefs(NODE_DEFS_WANTED, true)
+		m.refreshClusterFeatures()
+	}
+
+	featureEvents := func() (rv []string) {
+		m.VisitEvents(func(event []byte) {
+			var e struct {
+				Event   string `json:"event"`
+				Feature string `json:"feature"`
+			}
+			json.Unmarshal(event, &e)
+			if e.Feature != "" {
+				rv = append(rv, e.Event+":"+e.Feature)
+			}
+		})
+		return rv
+	}
+
+	// An older node joins, which deactivates the b feature.
+	registerNode(&NodeDef{UUID: "old", HostPort: "old:1000",
+		Extras: `{"features":"a"}`}, NODE_DEFS_WANTED, m)
+	refresh()
+
+	c, err := m.ClusterFeatures()
+	if err != nil || !c.IsActive("a") || c.IsActive("b") ||
+		!reflect.DeepEqual(c.Inactive["b"], []string{"old"}) {
+		t.Errorf("unexpected features: %#v, err: %v", c, err)
+	}
+	if exp := []string{"featureDeactivated:b"}; !reflect.DeepEqual(featureEvents(), exp) {
+		t.Errorf("expected: %v, got: %v", exp, featureEvents())
+	}
+
+	// The older node is upgraded, which activates the b feature again.
+	registerNode(&NodeDef{UUID: "old", HostPort: "old:1000",
+		Extras: `{"features":"a,b"}`}, NODE_DEFS_WANTED, m)
+	refresh()
+	refresh()
+
+	if !m.IsFeatureActive("b") {
+		t.Errorf("expected the b feature to be active")
+	}
+	exp := []string{"featureDeactivated:b", "featureActivated:b"}
+	if !reflect.DeepEqual(featureEvents(), exp) {
+		t.Errorf("expected: %v, got: %v", exp, featureEvents())
+	}
+}
@@ -120,6 +120,27 @@ func RegisterFeedType(sourceType string, f *FeedType) {
 	FeedTypes[sourceType] = f
 }
 
+// OnFeedError is invoked by a feed when it hits an error that it
+// can't recover from on its own, such as a deleted source, and
+// forwards the error to the ManagerEventHandlers, if any, and to the
+// EventSinks of the EVENT_CATEGORY_FEED_ERROR.
+func (mgr *Manager) OnFeedError(srcType string, r Feed, err error) {
+	mgr.log.Warnf("feed: OnFeedError, srcType: %s, feed: %s, err: %v",
+		srcType, r.Name(), err)
+
+	mgr.PublishEvent(EVENT_CATEGORY_FEED_ERROR, map[string]string{
+		"event":     "feedError",
+		"srcType":   srcType,
+		"feedName":  r.Name(),
+		"indexName": r.IndexName(),
+		"err":       err.Error(),
+	})
+
+	if mgr.meh != nil {
+		mgr.meh.OnFeedError(srcType, r, err)
+	}
+}
+
 // ------------------------------------------------------------------------
 
 // dataSourcePartitions is a helper function that returns the data
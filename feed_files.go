@@ -25,12 +25,36 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const filesFeedSleepStartMS = 5000
 const filesFeedBackoffFactor = 1.5
 const filesFeedMaxSleepMS = 1000 * 60 * 5 // 5 minutes.
+const filesFeedMaxRecentErrors = 20
+
+// The FilesFeedParams.Symlinks policies.
+const (
+	// FILES_SYMLINKS_SKIP skips the symlinks, which is the default.
+	FILES_SYMLINKS_SKIP = "skip"
+
+	// FILES_SYMLINKS_FOLLOW follows the symlinks to files whose
+	// canonical paths are within the source dir.  Symlinks to dirs
+	// aren't walked, as their targets within the source dir are
+	// walked anyway.
+	FILES_SYMLINKS_FOLLOW = "follow"
+)
+
+// The reasons that a file is skipped by a FilesFeed, other than by
+// its modification time, size, regexps or ignore patterns.
+const (
+	FILES_SKIP_SYMLINK     = "symlink"
+	FILES_SKIP_ESCAPE      = "escape"     // The canonical path is outside of the source dir.
+	FILES_SKIP_NOT_REGULAR = "notRegular" // Such as a device or a named pipe.
+	FILES_SKIP_PARSE       = "parse"      // The file's parser failed.
+	FILES_SKIP_ERROR       = "error"
+)
 
 func init() {
 	RegisterFeedType("files", &FeedType{
@@ -41,6 +65,8 @@ func init() {
 			" - files under a dataDir subdirectory tree will be the data source",
 		StartSample: &FilesFeedParams{
 			RegExps:       []string{".txt$", ".md$"},
+			Symlinks:      FILES_SYMLINKS_SKIP,
+			Ignore:        []string{".git/", "*.tmp"},
 			SleepStartMS:  filesFeedSleepStartMS,
 			BackoffFactor: filesFeedBackoffFactor,
 			MaxSleepMS:    filesFeedMaxSleepMS,
@@ -78,8 +104,20 @@ type FilesFeed struct {
 	dests      map[string]Dest
 	disable    bool
 
-	m       sync.Mutex
-	closeCh chan struct{}
+	chunker     *filesChunker  // Nil when not chunking.
+	chunkCounts map[string]int // Keyed by path, only used by the poller.
+
+	// The parsed files of the current poll, and the keys of the
+	// documents last sent for each parsed path, only used by the
+	// poller.
+	parsed     map[string]*filesParsed
+	parsedKeys map[string][]string
+
+	stats FilesFeedStats
+
+	m            sync.Mutex
+	closeCh      chan struct{}
+	recentErrors []*FilesSkip // Protected by m, newest last.
 
 	log Log
 }
@@ -87,12 +125,65 @@ type FilesFeed struct {
 // FilesFeedParams represents the JSON expected as the sourceParams
 // for a FilesFeed.
 type FilesFeedParams struct {
-	RegExps       []string `json:"regExps"`
-	MaxFileSize   int64    `json:"maxFileSize"`
-	NumPartitions int      `json:"numPartitions"`
-	SleepStartMS  int      `json:"sleepStartMS"`
-	BackoffFactor float32  `json:"backoffFactor"`
-	MaxSleepMS    int      `json:"maxSleepMS"`
+	RegExps []string `json:"regExps"`
+
+	// Symlinks is the symlink policy, as FILES_SYMLINKS_SKIP (the
+	// default) or FILES_SYMLINKS_FOLLOW.
+	Symlinks string `json:"symlinks"`
+
+	// Ignore are .gitignore-style patterns of the paths, relative to
+	// the source dir, that are excluded.
+	Ignore []string `json:"ignore"`
+
+	MaxFileSize int64 `json:"maxFileSize"`
+
+	// ChunkSize, when > 0, is the max bytes of a document, so that a
+	// large file is streamed as multiple documents, one per chunk,
+	// whose keys are from FilesChunkKey().  ChunkBy is the
+	// FILES_CHUNK_BY_BYTES (the default), FILES_CHUNK_BY_LINES or
+	// FILES_CHUNK_BY_RECORDS mode, where the ChunkRegExp matches the
+	// start of each record.
+	ChunkSize   int    `json:"chunkSize"`
+	ChunkBy     string `json:"chunkBy"`
+	ChunkRegExp string `json:"chunkRegExp"`
+
+	// Parsers are keyed by file extension, like ".jsonl", where each
+	// file with a parser is transformed by the parser into documents,
+	// whose keys are from FilesParsedKey(), instead of being sent as
+	// a whole file or as chunks.
+	Parsers map[string]*FilesParserParams `json:"parsers"`
+
+	NumPartitions int     `json:"numPartitions"`
+	SleepStartMS  int     `json:"sleepStartMS"`
+	BackoffFactor float32 `json:"backoffFactor"`
+	MaxSleepMS    int     `json:"maxSleepMS"`
+}
+
+// FilesFeedStats are the counters of a FilesFeed, which are
+// reported, along with its recent per-file errors, by Stats().
+type FilesFeedStats struct {
+	TotPoll    uint64 `json:"totPoll"`
+	TotFile    uint64 `json:"totFile"` // Files sent to the dests.
+	TotFileErr uint64 `json:"totFileErr"`
+
+	TotChunk       uint64 `json:"totChunk"` // Chunks of chunked files.
+	TotChunkDelete uint64 `json:"totChunkDelete"`
+
+	TotParsedDoc    uint64 `json:"totParsedDoc"` // Documents of parsed files.
+	TotParsedDelete uint64 `json:"totParsedDelete"`
+
+	TotSkipSymlink    uint64 `json:"totSkipSymlink"`
+	TotSkipEscape     uint64 `json:"totSkipEscape"`
+	TotSkipNotRegular uint64 `json:"totSkipNotRegular"`
+	TotSkipIgnored    uint64 `json:"totSkipIgnored"`
+}
+
+// A FilesSkip is a file that a FilesFeed skipped or couldn't read.
+type FilesSkip struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	Err    string `json:"err,omitempty"`
+	Time   string `json:"time,omitempty"`
 }
 
 // fileDoc represents the JSON for each file/document that will be
@@ -101,6 +192,8 @@ type fileDoc struct {
 	Name     string `json:"name"`
 	Path     string `json:"path"` // Path relative to the source name.
 	Contents string `json:"contents"`
+
+	Chunk *fileChunk `json:"chunk,omitempty"` // When chunked.
 }
 
 // StartFilesFeed starts a FilesFeed and is the the callback function
@@ -157,16 +250,44 @@ func NewFilesFeed(mgr *Manager, name, indexName, sourceName,
 		}
 	}
 
+	switch params.Symlinks {
+	case "", FILES_SYMLINKS_SKIP, FILES_SYMLINKS_FOLLOW:
+	default:
+		return nil, fmt.Errorf("feed_files: unknown symlinks policy,"+
+			" name: %s, symlinks: %q", name, params.Symlinks)
+	}
+
+	_, err := newFilesIgnore(params.Ignore)
+	if err != nil {
+		return nil, fmt.Errorf("feed_files: ignore, name: %s, err: %v",
+			name, err)
+	}
+
+	chunker, err := newFilesChunker(params)
+	if err != nil {
+		return nil, fmt.Errorf("feed_files: chunk, name: %s, err: %v",
+			name, err)
+	}
+
+	err = validateFilesParsers(params.Parsers)
+	if err != nil {
+		return nil, fmt.Errorf("feed_files: parsers, name: %s, err: %v",
+			name, err)
+	}
+
 	return &FilesFeed{
-		mgr:        mgr,
-		name:       name,
-		indexName:  indexName,
-		sourceName: sourceName,
-		params:     params,
-		dests:      dests,
-		disable:    disable,
-		closeCh:    make(chan struct{}),
-		log:        log,
+		mgr:         mgr,
+		name:        name,
+		indexName:   indexName,
+		sourceName:  sourceName,
+		params:      params,
+		dests:       dests,
+		disable:     disable,
+		chunker:     chunker,
+		chunkCounts: map[string]int{},
+		parsedKeys:  map[string][]string{},
+		closeCh:     make(chan struct{}),
+		log:         log,
 	}, nil
 }
 
@@ -242,33 +363,56 @@ func (t *FilesFeed) Start() error {
 
 				progress := false
 
-				paths, err := FilesFindMatches(t.mgr.DataDir(),
-					t.sourceName, t.params.RegExps, prevStartTime,
-					t.params.MaxFileSize)
+				atomic.AddUint64(&t.stats.TotPoll, 1)
+
+				found, err := FilesFind(t.mgr.DataDir(), t.sourceName,
+					FilesFindOptions{
+						RegExps:    t.params.RegExps,
+						ModTimeGTE: prevStartTime,
+						MaxSize:    t.params.MaxFileSize,
+						Symlinks:   t.params.Symlinks,
+						Ignore:     t.params.Ignore,
+					})
 				if err != nil {
-					t.log.Warnf("feed_files, FilesFindMatches, err: %v", err)
+					t.log.Warnf("feed_files, FilesFind, err: %v", err)
 					return -1
 				}
 
+				atomic.AddUint64(&t.stats.TotSkipIgnored,
+					uint64(found.TotIgnored))
+				for _, skip := range found.Skipped {
+					t.recordSkip(skip)
+				}
+
+				paths := found.Paths
+
+				t.parsed = map[string]*filesParsed{}
+
 				seqDeltaMax := uint64(0)
 
 				seqEnds := map[string]uint64{}
 
-				for _, path := range paths {
+				// The number of seqs of each path, which is one per
+				// chunk plus one per chunk that's gone since the last
+				// poll, when chunking.
+				numSeqs := make([]int, len(paths))
+
+				for i, path := range paths {
 					partition := FilesPathToPartition(h, partitions, path)
 
 					if t.dests[partition] == nil {
 						continue
 					}
 
+					numSeqs[i] = t.numSeqs(found.Root, path)
+
 					seq := seqs[partition]
 
 					seqEnd, exists := seqEnds[partition]
-					if exists {
-						seqEnd = seqEnd + 1
-					} else {
-						seqEnd = seq
+					if !exists {
+						seqEnd = seq - 1
 					}
+					seqEnd = seqEnd + uint64(numSeqs[i])
 					seqEnds[partition] = seqEnd
 
 					if seqDeltaMax < seqEnd-seq {
@@ -278,7 +422,7 @@ func (t *FilesFeed) Start() error {
 
 				snapshotSent := map[string]bool{}
 
-				for _, path := range paths {
+				for i, path := range paths {
 					select {
 					case <-closeCh:
 						return -1
@@ -293,55 +437,49 @@ func (t *FilesFeed) Start() error {
 					}
 
 					seqCur := seqs[partition]
-					seqs[partition] = seqCur + 1
-
-					buf, err := ioutil.ReadFile(path)
-					if err != nil {
-						t.log.Warnf("feed_files: read file,"+
-							" name: %s, path: %s, err: %v",
-							t.Name(), path, err)
-						continue
-					}
+					seqs[partition] = seqCur + uint64(numSeqs[i])
 
-					jbuf, err := json.Marshal(fileDoc{
-						Name:     filepath.Base(path),
-						Path:     path,
-						Contents: string(buf),
-					})
-					if err != nil {
-						t.mgr.log.Warnf("feed_files: json marshal file,"+
-							" name: %s, path: %s, err: %v",
-							t.Name(), path, err)
-						continue
-					}
-
-					if !snapshotSent[partition] {
-						err = dest.SnapshotStart(partition, seqCur,
+					snapshotStart := func() error {
+						if snapshotSent[partition] {
+							return nil
+						}
+						err := dest.SnapshotStart(partition, seqCur,
 							seqEnds[partition])
 						if err != nil {
 							t.mgr.log.Warnf("feed_files: SnapshotStart,"+
 								" name: %s, partition: %s, seqCur: %d,"+
 								" seqEnd: %d, err: %v", t.Name(), partition,
 								seqCur, seqEnds[partition], err)
-							return -1
+							return err
 						}
-
 						snapshotSent[partition] = true
+						return nil
 					}
 
-					pathBuf := []byte(path)
-
-					err = dest.DataUpdate(partition, pathBuf, seqCur,
-						jbuf, 0, DEST_EXTRAS_TYPE_NIL, nil)
+					var sent bool
+					var skip *FilesSkip
+					if t.parsed[path] != nil {
+						sent, skip, err = t.sendParsed(dest, partition,
+							path, seqCur, snapshotStart)
+					} else if t.chunker != nil {
+						sent, skip, err = t.sendChunks(dest, partition,
+							found.Root, path, seqCur, numSeqs[i],
+							snapshotStart)
+					} else {
+						sent, skip, err = t.sendFile(dest, partition,
+							found.Root, path, seqCur, snapshotStart)
+					}
+					if skip != nil {
+						t.recordSkip(skip)
+					}
 					if err != nil {
-						t.mgr.log.Warnf("feed_files: DataUpdate,"+
-							" name: %s, path: %s, partition: %s,"+
-							" seqCur: %d, err: %v", t.Name(), path,
-							partition, seqCur, err)
 						return -1
 					}
 
-					progress = true
+					if sent {
+						atomic.AddUint64(&t.stats.TotFile, 1)
+						progress = true
+					}
 				}
 
 				prevStartTime = startTime
@@ -374,6 +512,270 @@ func (t *FilesFeed) Start() error {
 	return nil
 }
 
+// numSeqs returns the number of seqs that a found path needs, which
+// is 1 when neither parsing nor chunking.  A parsed path is kept for
+// its send.
+func (t *FilesFeed) numSeqs(root, path string) int {
+	if params := t.params.Parsers[filepath.Ext(path)]; params != nil {
+		p := t.parseFile(root, path, params)
+		t.parsed[path] = p
+		if n := len(p.docs) + len(p.gone); n > 0 {
+			return n
+		}
+		return 1
+	}
+
+	if t.chunker == nil {
+		return 1
+	}
+
+	n := 0
+
+	f, skip := filesOpenFile(root, path, t.params.Symlinks)
+	if skip == nil {
+		n, _ = t.chunker.count(f) // A read error is reported on send.
+		f.Close()
+	}
+
+	if prev := t.chunkCounts[path]; prev > n {
+		n += prev - n // For the deletes of the gone chunks.
+	}
+	if n <= 0 {
+		n = 1
+	}
+	return n
+}
+
+// sendFile sends a whole file as a document.
+func (t *FilesFeed) sendFile(dest Dest, partition, root, path string,
+	seq uint64, snapshotStart func() error) (bool, *FilesSkip, error) {
+	buf, skip := filesReadFile(root, path, t.params.Symlinks)
+	if skip != nil {
+		return false, skip, nil
+	}
+
+	jbuf, err := json.Marshal(fileDoc{
+		Name:     filepath.Base(path),
+		Path:     path,
+		Contents: string(buf),
+	})
+	if err != nil {
+		return false, &FilesSkip{Path: path,
+			Reason: FILES_SKIP_ERROR, Err: err.Error()}, nil
+	}
+
+	err = snapshotStart()
+	if err != nil {
+		return false, nil, err
+	}
+
+	err = dest.DataUpdate(partition, []byte(path), seq,
+		jbuf, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.mgr.log.Warnf("feed_files: DataUpdate,"+
+			" name: %s, path: %s, partition: %s,"+
+			" seqCur: %d, err: %v", t.Name(), path,
+			partition, seq, err)
+		return false, nil, err
+	}
+
+	return true, nil, nil
+}
+
+// filesParsed is a file that was transformed by its parser, where
+// gone are the keys of the documents last sent for the path that
+// aren't among the docs anymore.
+type filesParsed struct {
+	docs []*FilesParsedDoc
+	keys []string // The docs' keys, from FilesParsedKey().
+	gone []string
+	skip *FilesSkip
+}
+
+func (t *FilesFeed) parseFile(root, path string,
+	params *FilesParserParams) *filesParsed {
+	buf, skip := filesReadFile(root, path, t.params.Symlinks)
+	if skip != nil {
+		return &filesParsed{skip: skip}
+	}
+
+	docs, err := FilesParsers[params.Parser](path, buf, params)
+	if err != nil {
+		return &filesParsed{skip: &FilesSkip{Path: path,
+			Reason: FILES_SKIP_PARSE, Err: err.Error()}}
+	}
+
+	rv := &filesParsed{docs: docs, keys: make([]string, len(docs))}
+
+	keys := make(map[string]bool, len(docs))
+	for i, doc := range docs {
+		key := doc.Key
+		if key == "" {
+			key = strconv.Itoa(i)
+		}
+		rv.keys[i] = FilesParsedKey(path, key)
+		keys[rv.keys[i]] = true
+	}
+
+	for _, key := range t.parsedKeys[path] {
+		if !keys[key] {
+			rv.gone = append(rv.gone, key)
+		}
+	}
+
+	return rv
+}
+
+// sendParsed sends the documents of a parsed file, and deletes the
+// documents that are gone since the file's last send.
+func (t *FilesFeed) sendParsed(dest Dest, partition, path string,
+	seq uint64, snapshotStart func() error) (bool, *FilesSkip, error) {
+	p := t.parsed[path]
+	delete(t.parsed, path)
+
+	if p.skip != nil {
+		return false, p.skip, nil
+	}
+
+	for i, doc := range p.docs {
+		err := snapshotStart()
+		if err != nil {
+			return false, nil, err
+		}
+
+		err = dest.DataUpdate(partition, []byte(p.keys[i]), seq,
+			doc.Val, 0, DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.mgr.log.Warnf("feed_files: DataUpdate,"+
+				" name: %s, key: %s, partition: %s,"+
+				" seqCur: %d, err: %v", t.Name(), p.keys[i],
+				partition, seq, err)
+			return false, nil, err
+		}
+
+		atomic.AddUint64(&t.stats.TotParsedDoc, 1)
+
+		seq++
+	}
+
+	for _, key := range p.gone {
+		err := snapshotStart()
+		if err != nil {
+			return false, nil, err
+		}
+
+		err = dest.DataDelete(partition, []byte(key), seq,
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.mgr.log.Warnf("feed_files: DataDelete,"+
+				" name: %s, key: %s, partition: %s,"+
+				" seqCur: %d, err: %v", t.Name(), key,
+				partition, seq, err)
+			return false, nil, err
+		}
+
+		atomic.AddUint64(&t.stats.TotParsedDelete, 1)
+
+		seq++
+	}
+
+	t.parsedKeys[path] = p.keys
+
+	return len(p.docs) > 0 || len(p.gone) > 0, nil, nil
+}
+
+// sendChunks streams a file as a document per chunk, using up to
+// numSeqs seqs, and deletes the documents of the chunks that are gone
+// since the file's last send.  Any chunks beyond the numSeqs, as the
+// file grew since its chunks were counted, are sent on a later poll.
+func (t *FilesFeed) sendChunks(dest Dest, partition, root, path string,
+	seq uint64, numSeqs int, snapshotStart func() error) (
+	bool, *FilesSkip, error) {
+	f, skip := filesOpenFile(root, path, t.params.Symlinks)
+	if skip != nil {
+		return false, skip, nil
+	}
+	defer f.Close()
+
+	var errDest error
+
+	n := 0
+	err := t.chunker.each(f, func(index int, offset int64, chunk []byte) error {
+		if index >= numSeqs {
+			return io.EOF
+		}
+
+		jbuf, err := json.Marshal(fileDoc{
+			Name:     filepath.Base(path),
+			Path:     path,
+			Contents: string(chunk),
+			Chunk: &fileChunk{
+				Index:  index,
+				Offset: offset,
+				Length: len(chunk),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		errDest = snapshotStart()
+		if errDest != nil {
+			return errDest
+		}
+
+		key := FilesChunkKey(path, index)
+
+		errDest = dest.DataUpdate(partition, []byte(key), seq+uint64(index),
+			jbuf, 0, DEST_EXTRAS_TYPE_NIL, nil)
+		if errDest != nil {
+			t.mgr.log.Warnf("feed_files: DataUpdate,"+
+				" name: %s, key: %s, partition: %s,"+
+				" seqCur: %d, err: %v", t.Name(), key,
+				partition, seq+uint64(index), errDest)
+			return errDest
+		}
+
+		atomic.AddUint64(&t.stats.TotChunk, 1)
+
+		n = index + 1
+		return nil
+	})
+	if errDest != nil {
+		return false, nil, errDest
+	}
+	if err != nil && err != io.EOF {
+		return n > 0, &FilesSkip{Path: path,
+			Reason: FILES_SKIP_ERROR, Err: err.Error()}, nil
+	}
+
+	prev := t.chunkCounts[path]
+	t.chunkCounts[path] = n
+
+	for index := n; index < prev && index < numSeqs; index++ {
+		err = snapshotStart()
+		if err != nil {
+			return n > 0, nil, err
+		}
+
+		key := FilesChunkKey(path, index)
+
+		err = dest.DataDelete(partition, []byte(key), seq+uint64(index),
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.mgr.log.Warnf("feed_files: DataDelete,"+
+				" name: %s, key: %s, partition: %s,"+
+				" seqCur: %d, err: %v", t.Name(), key,
+				partition, seq+uint64(index), err)
+			return n > 0, nil, err
+		}
+
+		atomic.AddUint64(&t.stats.TotChunkDelete, 1)
+	}
+
+	return n > 0 || prev > 0, nil, nil
+}
+
 func (t *FilesFeed) Close() error {
 	t.m.Lock()
 	if t.closeCh != nil {
@@ -389,9 +791,51 @@ func (t *FilesFeed) Dests() map[string]Dest {
 	return t.dests
 }
 
+// Stats writes the FilesFeedStats and the recent per-file errors as
+// JSON.
 func (t *FilesFeed) Stats(w io.Writer) error {
-	_, err := w.Write([]byte("{}"))
-	return err
+	t.m.Lock()
+	recentErrors := append([]*FilesSkip(nil), t.recentErrors...)
+	t.m.Unlock()
+
+	stats := struct {
+		FilesFeedStats
+		RecentErrors []*FilesSkip `json:"recentErrors"`
+	}{
+		RecentErrors: recentErrors,
+	}
+	AtomicCopyMetrics(&t.stats, &stats.FilesFeedStats, nil)
+
+	return json.NewEncoder(w).Encode(stats)
+}
+
+// recordSkip counts a skipped file, and logs and keeps it as a recent
+// error, unless it was merely ignored.
+func (t *FilesFeed) recordSkip(skip *FilesSkip) {
+	switch skip.Reason {
+	case FILES_SKIP_SYMLINK:
+		atomic.AddUint64(&t.stats.TotSkipSymlink, 1)
+	case FILES_SKIP_ESCAPE:
+		atomic.AddUint64(&t.stats.TotSkipEscape, 1)
+	case FILES_SKIP_NOT_REGULAR:
+		atomic.AddUint64(&t.stats.TotSkipNotRegular, 1)
+	default:
+		atomic.AddUint64(&t.stats.TotFileErr, 1)
+	}
+
+	if t.log != nil {
+		t.log.Warnf("feed_files: skipped file, name: %s, path: %s,"+
+			" reason: %s, err: %s", t.Name(), skip.Path, skip.Reason, skip.Err)
+	}
+
+	skip.Time = time.Now().Format(time.RFC3339Nano)
+
+	t.m.Lock()
+	t.recentErrors = append(t.recentErrors, skip)
+	if len(t.recentErrors) > filesFeedMaxRecentErrors {
+		t.recentErrors = t.recentErrors[1:]
+	}
+	t.m.Unlock()
 }
 
 // -----------------------------------------------------
@@ -426,10 +870,45 @@ func FilesFeedPartitions(sourceType, sourceName, sourceUUID, sourceParams,
 //
 // Additionally, a candidate file must have been modified since a
 // modTimeGTE and (if maxSize is > 0) should have size that's <=
-// maxSize.
+// maxSize.  Symlinks are skipped.  See also FilesFind().
 func FilesFindMatches(dataDir, sourceName string,
 	regExps []string, modTimeGTE time.Time, maxSize int64) (
 	[]string, error) {
+	rv, err := FilesFind(dataDir, sourceName, FilesFindOptions{
+		RegExps:    regExps,
+		ModTimeGTE: modTimeGTE,
+		MaxSize:    maxSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv.Paths, nil
+}
+
+// FilesFindOptions are the criteria of the files found by FilesFind().
+type FilesFindOptions struct {
+	RegExps    []string
+	ModTimeGTE time.Time
+	MaxSize    int64    // When > 0, the max size of a file.
+	Symlinks   string   // FILES_SYMLINKS_SKIP (default) or FILES_SYMLINKS_FOLLOW.
+	Ignore     []string // The .gitignore-style patterns.
+}
+
+// FilesFindResult is the outcome of FilesFind().
+type FilesFindResult struct {
+	Root       string // The canonical path of the source dir.
+	Paths      []string
+	Skipped    []*FilesSkip
+	TotIgnored int
+}
+
+// FilesFind finds the leaf file paths in the subdirectory tree of a
+// source dir, like FilesFindMatches(), where the files that aren't
+// regular files, or are symlinks that aren't followed, or whose
+// canonical paths escape the source dir, or that couldn't be read,
+// are reported as Skipped rather than silently skipped.
+func FilesFind(dataDir, sourceName string, options FilesFindOptions) (
+	*FilesFindResult, error) {
 	walkPath, err := filepath.EvalSymlinks(dataDir +
 		string(os.PathSeparator) + "files" +
 		string(os.PathSeparator) + sourceName)
@@ -437,31 +916,99 @@ func FilesFindMatches(dataDir, sourceName string,
 		return nil, err
 	}
 
-	pathsOk := []string(nil)
+	ignore, err := newFilesIgnore(options.Ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	regExps := make([]*regexp.Regexp, 0, len(options.RegExps))
+	for _, reStr := range options.RegExps {
+		re, err := regexp.Compile(reStr)
+		if err != nil {
+			return nil, fmt.Errorf("feed_files, MatchString,"+
+				" reStr: %s, err: %v", reStr, err)
+		}
+		regExps = append(regExps, re)
+	}
+
+	rv := &FilesFindResult{Root: walkPath}
+
+	skip := func(path, reason string, err error) {
+		s := &FilesSkip{Path: path, Reason: reason}
+		if err != nil {
+			s.Err = err.Error()
+		}
+		rv.Skipped = append(rv.Skipped, s)
+	}
 
 	err = filepath.Walk(walkPath,
 		func(path string, fi os.FileInfo, err error) error {
-			if err != nil ||
-				fi.IsDir() ||
-				fi.ModTime().Before(modTimeGTE) ||
-				(maxSize > 0 && fi.Size() > maxSize) {
+			if err != nil {
+				skip(path, FILES_SKIP_ERROR, err)
 				return nil
 			}
 
-			if len(regExps) <= 0 {
-				pathsOk = append(pathsOk, path)
+			if path != walkPath {
+				relPath, err := filepath.Rel(walkPath, path)
+				if err == nil &&
+					ignore.match(filepath.ToSlash(relPath), fi.IsDir()) {
+					rv.TotIgnored++
+					if fi.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+
+			if fi.IsDir() {
 				return nil
 			}
 
-			for _, reStr := range regExps {
-				matched, err := regexp.MatchString(reStr, path)
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if options.Symlinks != FILES_SYMLINKS_FOLLOW {
+					if !fi.ModTime().Before(options.ModTimeGTE) {
+						skip(path, FILES_SKIP_SYMLINK, nil)
+					}
+					return nil
+				}
+
+				target, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					skip(path, FILES_SKIP_ERROR, err)
+					return nil
+				}
+				if !filesPathWithin(walkPath, target) {
+					skip(path, FILES_SKIP_ESCAPE, nil)
+					return nil
+				}
+				fi, err = os.Stat(target)
 				if err != nil {
-					return fmt.Errorf("feed_files, MatchString,"+
-						" reStr: %s, path: %s, err: %v",
-						reStr, path, err)
+					skip(path, FILES_SKIP_ERROR, err)
+					return nil
 				}
-				if matched {
-					pathsOk = append(pathsOk, path)
+				if fi.IsDir() {
+					return nil
+				}
+			}
+
+			if fi.ModTime().Before(options.ModTimeGTE) ||
+				(options.MaxSize > 0 && fi.Size() > options.MaxSize) {
+				return nil
+			}
+
+			if !fi.Mode().IsRegular() {
+				skip(path, FILES_SKIP_NOT_REGULAR, nil)
+				return nil
+			}
+
+			if len(regExps) <= 0 {
+				rv.Paths = append(rv.Paths, path)
+				return nil
+			}
+
+			for _, re := range regExps {
+				if re.MatchString(path) {
+					rv.Paths = append(rv.Paths, path)
 					return nil
 				}
 			}
@@ -472,7 +1019,72 @@ func FilesFindMatches(dataDir, sourceName string,
 		return nil, err
 	}
 
-	return pathsOk, nil
+	return rv, nil
+}
+
+// filesPathWithin returns true if a canonical path is the root or is
+// within the root.
+func filesPathWithin(root, path string) bool {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return relPath != ".." &&
+		!strings.HasPrefix(relPath, ".."+string(os.PathSeparator))
+}
+
+// filesOpenFile opens a file that was found by FilesFind() in a root,
+// re-checking its symlinks and canonical path, as the file might have
+// been replaced since it was found.
+func filesOpenFile(root, path, symlinks string) (*os.File, *FilesSkip) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, &FilesSkip{Path: path, Reason: FILES_SKIP_ERROR,
+			Err: err.Error()}
+	}
+	if fi.Mode()&os.ModeSymlink != 0 && symlinks != FILES_SYMLINKS_FOLLOW {
+		return nil, &FilesSkip{Path: path, Reason: FILES_SKIP_SYMLINK}
+	}
+
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, &FilesSkip{Path: path, Reason: FILES_SKIP_ERROR,
+			Err: err.Error()}
+	}
+	if !filesPathWithin(root, target) {
+		return nil, &FilesSkip{Path: path, Reason: FILES_SKIP_ESCAPE}
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return nil, &FilesSkip{Path: path, Reason: FILES_SKIP_ERROR,
+			Err: err.Error()}
+	}
+	return f, nil
+}
+
+// filesReadFile reads a whole file, like filesOpenFile().
+func filesReadFile(root, path, symlinks string) ([]byte, *FilesSkip) {
+	f, skip := filesOpenFile(root, path, symlinks)
+	if skip != nil {
+		return nil, skip
+	}
+	defer f.Close()
+
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, &FilesSkip{Path: path, Reason: FILES_SKIP_ERROR,
+			Err: err.Error()}
+	}
+	return buf, nil
 }
 
 // FilesPathToPartition hashes a file path to a partition.
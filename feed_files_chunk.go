@@ -0,0 +1,181 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// The FilesFeedParams.ChunkBy modes, for when a FilesFeedParams has a
+// ChunkSize, so that large files are streamed as multiple documents.
+// A line or record that's larger than the ChunkSize is split at the
+// ChunkSize.
+const (
+	// FILES_CHUNK_BY_BYTES splits a file every ChunkSize bytes, which
+	// is the default.
+	FILES_CHUNK_BY_BYTES = "bytes"
+
+	// FILES_CHUNK_BY_LINES splits a file at line boundaries, packing
+	// whole lines into chunks of up to ChunkSize bytes.
+	FILES_CHUNK_BY_LINES = "lines"
+
+	// FILES_CHUNK_BY_RECORDS splits a file where the ChunkRegExp
+	// matches, which is the start of each record, packing whole
+	// records into chunks of up to ChunkSize bytes.
+	FILES_CHUNK_BY_RECORDS = "records"
+)
+
+// fileChunk describes a chunk of a file in its fileDoc.
+type fileChunk struct {
+	Index  int   `json:"index"`
+	Offset int64 `json:"offset"`
+	Length int   `json:"length"`
+}
+
+// FilesChunkKey returns the derived key of a chunk of a file.
+func FilesChunkKey(path string, index int) string {
+	return path + "#" + strconv.Itoa(index)
+}
+
+// filesChunker splits a stream into chunks, reading at most about
+// twice the chunk size into memory.
+type filesChunker struct {
+	size int
+	by   string
+	re   *regexp.Regexp
+}
+
+// newFilesChunker returns a filesChunker for the chunk params of a
+// FilesFeedParams, or nil when the params don't have a ChunkSize.
+func newFilesChunker(params *FilesFeedParams) (*filesChunker, error) {
+	if params.ChunkSize <= 0 {
+		if params.ChunkBy != "" || params.ChunkRegExp != "" {
+			return nil, fmt.Errorf("feed_files_chunk: chunkBy or" +
+				" chunkRegExp needs a chunkSize")
+		}
+		return nil, nil
+	}
+
+	c := &filesChunker{size: params.ChunkSize, by: params.ChunkBy}
+
+	switch c.by {
+	case "":
+		c.by = FILES_CHUNK_BY_BYTES
+	case FILES_CHUNK_BY_BYTES, FILES_CHUNK_BY_LINES:
+	case FILES_CHUNK_BY_RECORDS:
+		if params.ChunkRegExp == "" {
+			return nil, fmt.Errorf("feed_files_chunk: chunkBy records" +
+				" needs a chunkRegExp")
+		}
+		re, err := regexp.Compile(params.ChunkRegExp)
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_chunk: chunkRegExp: %q,"+
+				" err: %v", params.ChunkRegExp, err)
+		}
+		c.re = re
+	default:
+		return nil, fmt.Errorf("feed_files_chunk: unknown chunkBy: %q",
+			params.ChunkBy)
+	}
+
+	if c.by != FILES_CHUNK_BY_RECORDS && params.ChunkRegExp != "" {
+		return nil, fmt.Errorf("feed_files_chunk: chunkRegExp needs" +
+			" chunkBy records")
+	}
+
+	return c, nil
+}
+
+// each invokes the fn on each chunk of a stream, in order, where the
+// chunk is only valid during the fn's invocation.  An empty stream has
+// no chunks.
+func (c *filesChunker) each(r io.Reader,
+	fn func(index int, offset int64, chunk []byte) error) error {
+	buf := make([]byte, 0, 2*c.size)
+	index := 0
+	offset := int64(0)
+	eof := false
+
+	for {
+		for !eof && len(buf) < c.size+1 {
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if len(buf) == 0 {
+			return nil
+		}
+
+		cut := len(buf)
+		if cut > c.size {
+			cut = c.cut(buf)
+		}
+
+		err := fn(index, offset, buf[:cut])
+		if err != nil {
+			return err
+		}
+
+		index++
+		offset += int64(cut)
+		buf = buf[:copy(buf, buf[cut:])]
+	}
+}
+
+// cut returns the length of the next chunk of a buf that's longer
+// than the chunk size.
+func (c *filesChunker) cut(buf []byte) int {
+	switch c.by {
+	case FILES_CHUNK_BY_LINES:
+		i := bytes.LastIndexByte(buf[:c.size], '\n')
+		if i >= 0 {
+			return i + 1
+		}
+
+	case FILES_CHUNK_BY_RECORDS:
+		// The last record start within the chunk size, other than at
+		// the start of the chunk.
+		cut := 0
+		for _, loc := range c.re.FindAllIndex(buf, -1) {
+			if loc[0] > c.size {
+				break
+			}
+			if loc[0] > 0 {
+				cut = loc[0]
+			}
+		}
+		if cut > 0 {
+			return cut
+		}
+	}
+
+	return c.size
+}
+
+// count returns the number of chunks of a stream.
+func (c *filesChunker) count(r io.Reader) (int, error) {
+	rv := 0
+	err := c.each(r, func(int, int64, []byte) error {
+		rv++
+		return nil
+	})
+	return rv, err
+}
@@ -0,0 +1,146 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// filesIgnore matches the paths, relative to a files feed's source
+// dir, against .gitignore-style patterns, where...
+//
+// - blank lines and lines starting with '#' are ignored;
+// - a leading '!' negates a pattern, re-including the paths that an
+// earlier pattern excluded, where the last matching pattern wins;
+// - a trailing '/' matches only dirs;
+// - a pattern with a leading or middle '/' is relative to the source
+// dir, otherwise it matches at any level;
+// - '*' and '?' match within a path segment, '[...]' is a character
+// class, and '**' matches across segments, as in "**/tmp", "a/**"
+// and "a/**/b".
+//
+// As with .gitignore, the files in an excluded dir can't be
+// re-included, because the dir isn't walked.
+type filesIgnore struct {
+	rules []*filesIgnoreRule
+}
+
+type filesIgnoreRule struct {
+	pattern string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+func newFilesIgnore(patterns []string) (*filesIgnore, error) {
+	rv := &filesIgnore{}
+
+	for _, pattern := range patterns {
+		p := strings.TrimSpace(pattern)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+
+		rule := &filesIgnoreRule{pattern: pattern}
+
+		if strings.HasPrefix(p, "!") {
+			rule.negate = true
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			rule.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+
+		anchored := strings.Contains(p, "/")
+		p = strings.TrimPrefix(p, "/")
+		if p == "" {
+			return nil, fmt.Errorf("feed_files_ignore: empty pattern: %q",
+				pattern)
+		}
+
+		reStr := filesIgnoreGlobToRegexp(p)
+		if anchored {
+			reStr = "^" + reStr + "$"
+		} else {
+			reStr = "^(.*/)?" + reStr + "$"
+		}
+
+		re, err := regexp.Compile(reStr)
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_ignore: pattern: %q,"+
+				" err: %v", pattern, err)
+		}
+		rule.re = re
+
+		rv.rules = append(rv.rules, rule)
+	}
+
+	return rv, nil
+}
+
+// match returns true when a path, which is '/' separated and relative
+// to the source dir, is excluded.
+func (fi *filesIgnore) match(relPath string, isDir bool) bool {
+	if fi == nil {
+		return false
+	}
+	rv := false
+	for _, rule := range fi.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(relPath) {
+			rv = !rule.negate
+		}
+	}
+	return rv
+}
+
+func filesIgnoreGlobToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(glob[i+1:], ']')
+			if j < 0 {
+				b.WriteString(regexp.QuoteMeta(glob[i:]))
+				return b.String()
+			}
+			class := glob[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += j + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,331 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// FilesParsers allows applications to register content-type aware
+// parsers for the files feed, which a FilesFeedParams selects by file
+// extension in its Parsers.  The "jsonl", "csv" and "xml" parsers are
+// built-in.  It should be modified only during the init()'ialization
+// phase of process startup.
+var FilesParsers = map[string]FilesParser{
+	"jsonl": FilesParseJSONLines,
+	"csv":   FilesParseCSV,
+	"xml":   FilesParseXML,
+}
+
+// A FilesParser transforms the contents of a file into the documents
+// that the files feed forwards to its Dest, one mutation per document.
+type FilesParser func(path string, contents []byte,
+	params *FilesParserParams) ([]*FilesParsedDoc, error)
+
+// A FilesParsedDoc is a document parsed from a file.
+type FilesParsedDoc struct {
+	// Key is unique within the file, and the document's key is then
+	// from FilesParsedKey().  When empty, the document's index within
+	// the file is used.
+	Key string
+
+	Val []byte // The JSON of the document.
+}
+
+// FilesParserParams are the per-extension parser params of a
+// FilesFeedParams.
+type FilesParserParams struct {
+	Parser string `json:"parser"` // The name of a FilesParsers entry.
+
+	// KeyField, if any, is the field whose value is a document's key.
+	KeyField string `json:"keyField"`
+
+	// Header, for "csv", are the field names of the columns, else the
+	// first row of a file is its header.
+	Header []string `json:"header"`
+
+	// Fields, for "csv", maps column names to field names, where the
+	// unmapped columns keep their names.
+	Fields map[string]string `json:"fields"`
+
+	// Comma, for "csv", is the field delimiter, which defaults to ",".
+	Comma string `json:"comma"`
+
+	// RecordElement, for "xml", is the name of the elements that are
+	// each a document, else a file's root element is its only
+	// document.
+	RecordElement string `json:"recordElement"`
+
+	// Options are for the parsers registered by applications.
+	Options map[string]string `json:"options"`
+}
+
+// FilesParsedKey returns the derived key of a document that was
+// parsed from a file.
+func FilesParsedKey(path, key string) string {
+	return path + "#" + key
+}
+
+// validateFilesParsers checks the Parsers of a FilesFeedParams.
+func validateFilesParsers(parsers map[string]*FilesParserParams) error {
+	for ext, p := range parsers {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("feed_files_parser: extension: %q,"+
+				" should start with '.'", ext)
+		}
+		if p == nil || FilesParsers[p.Parser] == nil {
+			return fmt.Errorf("feed_files_parser: extension: %q,"+
+				" unknown parser", ext)
+		}
+		if p.Comma != "" && utf8.RuneCountInString(p.Comma) != 1 {
+			return fmt.Errorf("feed_files_parser: extension: %q,"+
+				" comma should be a single char: %q", ext, p.Comma)
+		}
+	}
+	return nil
+}
+
+// filesParsedKeyOf returns the string value of a document's key
+// field, or "" when the params don't have a KeyField.
+func filesParsedKeyOf(params *FilesParserParams,
+	doc map[string]interface{}, what string) (string, error) {
+	if params.KeyField == "" {
+		return "", nil
+	}
+	v, exists := doc[params.KeyField]
+	if !exists || v == nil {
+		return "", fmt.Errorf("feed_files_parser: %s,"+
+			" missing keyField: %q", what, params.KeyField)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// ---------------------------------------------------------
+
+// FilesParseJSONLines parses a file of JSON lines, where each
+// non-blank line is a JSON object that's a document.
+func FilesParseJSONLines(path string, contents []byte,
+	params *FilesParserParams) ([]*FilesParsedDoc, error) {
+	var rv []*FilesParsedDoc
+
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	s.Buffer(nil, len(contents)+1)
+
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var doc map[string]interface{}
+		err := json.Unmarshal(line, &doc)
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_parser: jsonl,"+
+				" line: %d, err: %v", lineNum, err)
+		}
+
+		key, err := filesParsedKeyOf(params, doc,
+			fmt.Sprintf("jsonl, line: %d", lineNum))
+		if err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, &FilesParsedDoc{
+			Key: key,
+			Val: append([]byte(nil), line...),
+		})
+	}
+
+	return rv, s.Err()
+}
+
+// FilesParseCSV parses a CSV file, where each row after the header is
+// a document whose fields are named by the header, as mapped by the
+// params' Fields.  The field values are strings.
+func FilesParseCSV(path string, contents []byte,
+	params *FilesParserParams) ([]*FilesParsedDoc, error) {
+	r := csv.NewReader(bytes.NewReader(contents))
+	if params.Comma != "" {
+		r.Comma, _ = utf8.DecodeRuneInString(params.Comma)
+	}
+
+	header := params.Header
+	if len(header) == 0 {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_parser: csv,"+
+				" header, err: %v", err)
+		}
+		header = row
+	}
+
+	fields := make([]string, len(header))
+	for i, column := range header {
+		fields[i] = column
+		if field, exists := params.Fields[column]; exists {
+			fields[i] = field
+		}
+	}
+
+	r.FieldsPerRecord = len(fields)
+
+	var rv []*FilesParsedDoc
+
+	for rowNum := 1; ; rowNum++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			return rv, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_parser: csv, err: %v", err)
+		}
+
+		doc := make(map[string]interface{}, len(fields))
+		for i, field := range fields {
+			doc[field] = row[i]
+		}
+
+		key, err := filesParsedKeyOf(params, doc,
+			fmt.Sprintf("csv, row: %d", rowNum))
+		if err != nil {
+			return nil, err
+		}
+
+		val, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, &FilesParsedDoc{Key: key, Val: val})
+	}
+}
+
+// FilesParseXML parses an XML file, where each element named by the
+// params' RecordElement, or else the root element, is a document.  An
+// element becomes a JSON object whose fields are its attributes,
+// prefixed by "@", and its child elements, where repeated child
+// elements become an array, and where the text of an element with
+// neither attributes nor child elements becomes a string, else the
+// "#text" field.
+func FilesParseXML(path string, contents []byte,
+	params *FilesParserParams) ([]*FilesParsedDoc, error) {
+	d := xml.NewDecoder(bytes.NewReader(contents))
+
+	var rv []*FilesParsedDoc
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return rv, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_parser: xml, err: %v", err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || (params.RecordElement != "" &&
+			start.Name.Local != params.RecordElement) {
+			continue
+		}
+
+		v, err := filesXMLElement(d, start)
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_parser: xml, err: %v", err)
+		}
+
+		doc, ok := v.(map[string]interface{})
+		if !ok {
+			doc = map[string]interface{}{"#text": v}
+		}
+
+		key, err := filesParsedKeyOf(params, doc,
+			fmt.Sprintf("xml, record: %d", len(rv)+1))
+		if err != nil {
+			return nil, err
+		}
+
+		val, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, &FilesParsedDoc{Key: key, Val: val})
+
+		if params.RecordElement == "" {
+			return rv, nil
+		}
+	}
+}
+
+// filesXMLElement converts the rest of an element, whose start was
+// already decoded, into a string or a map.
+func filesXMLElement(d *xml.Decoder, start xml.StartElement) (
+	interface{}, error) {
+	m := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		m["@"+attr.Name.Local] = attr.Value
+	}
+
+	var text strings.Builder
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			v, err := filesXMLElement(d, tok)
+			if err != nil {
+				return nil, err
+			}
+
+			name := tok.Name.Local
+			switch prev := m[name].(type) {
+			case nil:
+				m[name] = v
+			case []interface{}:
+				m[name] = append(prev, v)
+			default:
+				m[name] = []interface{}{prev, v}
+			}
+
+		case xml.CharData:
+			text.Write(tok)
+
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(m) == 0 {
+				return s, nil
+			}
+			if s != "" {
+				m["#text"] = s
+			}
+			return m, nil
+		}
+	}
+}
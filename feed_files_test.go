@@ -13,11 +13,15 @@ package cbgt
 
 import (
 	"bytes"
+	"encoding/json"
 	"hash/crc32"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -169,6 +173,501 @@ func TestFilesFindMatches(t *testing.T) {
 	}
 }
 
+func TestFilesFindSymlinksAndIgnore(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	srcDir := filepath.Join(testDir, "files", "src")
+	for _, dir := range []string{"a", "b/tmp", ".git"} {
+		os.MkdirAll(filepath.Join(srcDir, dir), 0700)
+	}
+	for _, path := range []string{"a/x.txt", "a/y.tmp", "a/keep.tmp",
+		"b/tmp/z.txt", ".git/config"} {
+		ioutil.WriteFile(filepath.Join(srcDir, path), []byte(path), 0600)
+	}
+
+	outside := filepath.Join(testDir, "outside.txt")
+	ioutil.WriteFile(outside, []byte("secret"), 0600)
+
+	absOutside, _ := filepath.Abs(outside)
+	absX, _ := filepath.Abs(filepath.Join(srcDir, "a", "x.txt"))
+	os.Symlink(absOutside, filepath.Join(srcDir, "escape.txt"))
+	os.Symlink(absX, filepath.Join(srcDir, "inside.txt"))
+
+	rel := func(res *FilesFindResult) []string {
+		var rv []string
+		for _, path := range res.Paths {
+			relPath, _ := filepath.Rel(res.Root, path)
+			rv = append(rv, filepath.ToSlash(relPath))
+		}
+		sort.Strings(rv)
+		return rv
+	}
+	skipped := func(res *FilesFindResult) map[string]string {
+		rv := map[string]string{}
+		for _, s := range res.Skipped {
+			relPath, _ := filepath.Rel(res.Root, s.Path)
+			rv[filepath.ToSlash(relPath)] = s.Reason
+		}
+		return rv
+	}
+
+	res, err := FilesFind(testDir, "src", FilesFindOptions{
+		Ignore: []string{".git/", "*.tmp", "!keep.tmp", "/b/**/z.txt"},
+	})
+	if err != nil {
+		t.Fatalf("expected FilesFind to work, err: %v", err)
+	}
+	if exp := []string{"a/keep.tmp", "a/x.txt"}; !reflect.DeepEqual(rel(res), exp) {
+		t.Errorf("expected paths: %v, got: %v", exp, rel(res))
+	}
+	if res.TotIgnored != 3 {
+		t.Errorf("expected 3 ignored, got: %d", res.TotIgnored)
+	}
+	if exp := map[string]string{
+		"escape.txt": FILES_SKIP_SYMLINK,
+		"inside.txt": FILES_SKIP_SYMLINK,
+	}; !reflect.DeepEqual(skipped(res), exp) {
+		t.Errorf("expected skipped: %v, got: %v", exp, skipped(res))
+	}
+
+	res, err = FilesFind(testDir, "src", FilesFindOptions{
+		RegExps:  []string{".txt$"},
+		Symlinks: FILES_SYMLINKS_FOLLOW,
+	})
+	if err != nil {
+		t.Fatalf("expected FilesFind to work, err: %v", err)
+	}
+	if exp := []string{"a/x.txt", "b/tmp/z.txt", "inside.txt"}; !reflect.DeepEqual(rel(res), exp) {
+		t.Errorf("expected paths: %v, got: %v", exp, rel(res))
+	}
+	if exp := map[string]string{
+		"escape.txt": FILES_SKIP_ESCAPE,
+	}; !reflect.DeepEqual(skipped(res), exp) {
+		t.Errorf("expected skipped: %v, got: %v", exp, skipped(res))
+	}
+
+	_, skip := filesReadFile(res.Root, filepath.Join(res.Root, "escape.txt"),
+		FILES_SYMLINKS_FOLLOW)
+	if skip == nil || skip.Reason != FILES_SKIP_ESCAPE {
+		t.Errorf("expected an escape on read, got: %+v", skip)
+	}
+	buf, skip := filesReadFile(res.Root, filepath.Join(res.Root, "inside.txt"),
+		FILES_SYMLINKS_FOLLOW)
+	if skip != nil || string(buf) != "a/x.txt" {
+		t.Errorf("expected a followed read, got: %s, %+v", buf, skip)
+	}
+	_, skip = filesReadFile(res.Root, filepath.Join(res.Root, "inside.txt"),
+		FILES_SYMLINKS_SKIP)
+	if skip == nil || skip.Reason != FILES_SKIP_SYMLINK {
+		t.Errorf("expected a skipped symlink on read, got: %+v", skip)
+	}
+
+	_, err = FilesFind(testDir, "src", FilesFindOptions{Ignore: []string{"!"}})
+	if err == nil {
+		t.Errorf("expected err on an empty ignore pattern")
+	}
+}
+
+func TestFilesIgnore(t *testing.T) {
+	fi, err := newFilesIgnore([]string{
+		"# comment", "", "*.log", "!important.log", "build/",
+		"/root.txt", "docs/**/*.md", "a?c", "[xy].bin",
+	})
+	if err != nil {
+		t.Fatalf("expected newFilesIgnore to work, err: %v", err)
+	}
+	for path, exp := range map[string]bool{
+		"x.log":            true,
+		"deep/dir/x.log":   true,
+		"important.log":    false,
+		"d/important.log":  false,
+		"build":            true, // As a dir.
+		"src/build":        true, // As a dir.
+		"root.txt":         true,
+		"sub/root.txt":     false,
+		"docs/a.md":        true,
+		"docs/x/y/a.md":    true,
+		"other/docs/a.md":  false,
+		"abc":              true,
+		"abbc":             false,
+		"x.bin":            true,
+		"z.bin":            false,
+		"logs/x.log.other": false,
+	} {
+		if got := fi.match(path, path == "build" || path == "src/build"); got != exp {
+			t.Errorf("path: %s, expected: %v, got: %v", path, exp, got)
+		}
+	}
+	if fi.match("build", false) {
+		t.Errorf("expected a dir pattern to not match a file")
+	}
+}
+
+func TestFilesFeedStats(t *testing.T) {
+	ff, err := NewFilesFeed(nil, "name", "indexName", "sourceName",
+		`{"symlinks":"sometimes"}`, nil, false, nil)
+	if err == nil || ff != nil {
+		t.Errorf("expected err on an unknown symlinks policy")
+	}
+
+	ff, err = NewFilesFeed(nil, "name", "indexName", "sourceName",
+		`{"ignore":["/"]}`, nil, false, nil)
+	if err == nil || ff != nil {
+		t.Errorf("expected err on a bad ignore pattern")
+	}
+
+	ff, err = NewFilesFeed(nil, "name", "indexName", "sourceName",
+		`{"symlinks":"follow"}`, nil, false, nil)
+	if err != nil {
+		t.Fatalf("expected no err, err: %v", err)
+	}
+
+	for i := 0; i < filesFeedMaxRecentErrors+1; i++ {
+		ff.recordSkip(&FilesSkip{Path: "p", Reason: FILES_SKIP_ERROR})
+	}
+	ff.recordSkip(&FilesSkip{Path: "s", Reason: FILES_SKIP_ESCAPE})
+
+	var buf bytes.Buffer
+	if err = ff.Stats(&buf); err != nil {
+		t.Fatalf("expected stats to work, err: %v", err)
+	}
+
+	var stats struct {
+		FilesFeedStats
+		RecentErrors []*FilesSkip `json:"recentErrors"`
+	}
+	if err = json.Unmarshal(buf.Bytes(), &stats); err != nil {
+		t.Fatalf("expected stats json, err: %v", err)
+	}
+	if stats.TotFileErr != uint64(filesFeedMaxRecentErrors+1) ||
+		stats.TotSkipEscape != 1 ||
+		len(stats.RecentErrors) != filesFeedMaxRecentErrors ||
+		stats.RecentErrors[len(stats.RecentErrors)-1].Path != "s" {
+		t.Errorf("unexpected stats: %s", buf.String())
+	}
+}
+
+func TestFilesChunker(t *testing.T) {
+	chunks := func(params *FilesFeedParams, s string) []string {
+		c, err := newFilesChunker(params)
+		if err != nil {
+			t.Fatalf("expected newFilesChunker to work, err: %v", err)
+		}
+		var rv []string
+		offset := int64(0)
+		err = c.each(strings.NewReader(s),
+			func(index int, off int64, chunk []byte) error {
+				if index != len(rv) || off != offset {
+					t.Errorf("unexpected index: %d, offset: %d", index, off)
+				}
+				offset += int64(len(chunk))
+				rv = append(rv, string(chunk))
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("expected each to work, err: %v", err)
+		}
+		n, _ := c.count(strings.NewReader(s))
+		if n != len(rv) {
+			t.Errorf("expected count: %d, got: %d", len(rv), n)
+		}
+		return rv
+	}
+
+	for _, test := range []struct {
+		params *FilesFeedParams
+		in     string
+		exp    []string
+	}{
+		{&FilesFeedParams{ChunkSize: 4}, "", nil},
+		{&FilesFeedParams{ChunkSize: 4}, "abcdefghij",
+			[]string{"abcd", "efgh", "ij"}},
+		{&FilesFeedParams{ChunkSize: 4}, "abcd", []string{"abcd"}},
+		{&FilesFeedParams{ChunkSize: 8, ChunkBy: FILES_CHUNK_BY_LINES},
+			"ab\ncd\nefghijklmn\no\n",
+			[]string{"ab\ncd\n", "efghijkl", "mn\no\n"}},
+		{&FilesFeedParams{ChunkSize: 11, ChunkBy: FILES_CHUNK_BY_RECORDS,
+			ChunkRegExp: "(?m)^---"},
+			"---a\n---bb\n---cccccccc\n---d",
+			[]string{"---a\n---bb\n", "---cccccccc", "\n---d"}},
+	} {
+		got := chunks(test.params, test.in)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("params: %+v, in: %q, expected: %q, got: %q",
+				test.params, test.in, test.exp, got)
+		}
+	}
+
+	for _, params := range []*FilesFeedParams{
+		{ChunkBy: FILES_CHUNK_BY_LINES},
+		{ChunkSize: 1, ChunkBy: "sentences"},
+		{ChunkSize: 1, ChunkBy: FILES_CHUNK_BY_RECORDS},
+		{ChunkSize: 1, ChunkBy: FILES_CHUNK_BY_RECORDS, ChunkRegExp: "[bad"},
+		{ChunkSize: 1, ChunkRegExp: "x"},
+	} {
+		if _, err := newFilesChunker(params); err == nil {
+			t.Errorf("expected err, params: %+v", params)
+		}
+	}
+}
+
+// chunksTestDest records the keys of its updates and deletes.
+type chunksTestDest struct {
+	TestDest
+	updates []string
+	vals    []string
+	deletes []string
+	seqs    []uint64
+}
+
+func (t *chunksTestDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	doc := fileDoc{}
+	json.Unmarshal(val, &doc)
+	t.updates = append(t.updates, string(key)+"="+doc.Contents)
+	t.vals = append(t.vals, string(val))
+	t.seqs = append(t.seqs, seq)
+	return nil
+}
+
+func (t *chunksTestDest) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	t.deletes = append(t.deletes, string(key))
+	t.seqs = append(t.seqs, seq)
+	return nil
+}
+
+func TestFilesFeedChunks(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	root := filepath.Join(testDir, "files", "src")
+	os.MkdirAll(root, 0700)
+	path := filepath.Join(root, "big.txt")
+	ioutil.WriteFile(path, []byte("aaa\nbbb\nccc\n"), 0600)
+
+	ff, err := NewFilesFeed(nil, "name", "indexName", "src",
+		`{"chunkSize":4,"chunkBy":"lines"}`, nil, false, nil)
+	if err != nil {
+		t.Fatalf("expected no err, err: %v", err)
+	}
+
+	dest := &chunksTestDest{}
+	snapshotStarts := 0
+	snapshotStart := func() error {
+		snapshotStarts++
+		return nil
+	}
+
+	numSeqs := ff.numSeqs(root, path)
+	if numSeqs != 3 {
+		t.Errorf("expected 3 seqs, got: %d", numSeqs)
+	}
+	sent, skip, err := ff.sendChunks(dest, "", root, path, 10, numSeqs,
+		snapshotStart)
+	if !sent || skip != nil || err != nil {
+		t.Fatalf("expected sendChunks to work, %v, %+v, %v", sent, skip, err)
+	}
+	if exp := []string{FilesChunkKey(path, 0) + "=aaa\n",
+		FilesChunkKey(path, 1) + "=bbb\n",
+		FilesChunkKey(path, 2) + "=ccc\n"}; !reflect.DeepEqual(dest.updates, exp) {
+		t.Errorf("expected updates: %q, got: %q", exp, dest.updates)
+	}
+
+	// The file shrinks, so its gone chunks are deleted.
+	ioutil.WriteFile(path, []byte("zzz\n"), 0600)
+	dest = &chunksTestDest{}
+
+	numSeqs = ff.numSeqs(root, path)
+	if numSeqs != 3 {
+		t.Errorf("expected 1 update and 2 delete seqs, got: %d", numSeqs)
+	}
+	sent, skip, err = ff.sendChunks(dest, "", root, path, 20, numSeqs,
+		snapshotStart)
+	if !sent || skip != nil || err != nil {
+		t.Fatalf("expected sendChunks to work, %v, %+v, %v", sent, skip, err)
+	}
+	if exp := []string{FilesChunkKey(path, 0) + "=zzz\n"}; !reflect.DeepEqual(dest.updates, exp) {
+		t.Errorf("expected updates: %q, got: %q", exp, dest.updates)
+	}
+	if exp := []string{FilesChunkKey(path, 1),
+		FilesChunkKey(path, 2)}; !reflect.DeepEqual(dest.deletes, exp) {
+		t.Errorf("expected deletes: %q, got: %q", exp, dest.deletes)
+	}
+	if exp := []uint64{20, 21, 22}; !reflect.DeepEqual(dest.seqs, exp) {
+		t.Errorf("expected seqs: %v, got: %v", exp, dest.seqs)
+	}
+	if snapshotStarts != 6 {
+		t.Errorf("expected a snapshotStart per mutation, got: %d",
+			snapshotStarts)
+	}
+
+	var buf bytes.Buffer
+	ff.Stats(&buf)
+	if !strings.Contains(buf.String(), `"totChunk":4,"totChunkDelete":2`) {
+		t.Errorf("expected chunk stats, got: %s", buf.String())
+	}
+}
+
+func TestFilesParsers(t *testing.T) {
+	tests := []struct {
+		parser   string
+		params   FilesParserParams
+		contents string
+		expKeys  []string
+		expVals  []string
+		expErr   bool
+	}{
+		{"jsonl", FilesParserParams{}, "", nil, nil, false},
+		{"jsonl", FilesParserParams{},
+			"{\"a\":1}\n\n  {\"a\":2}\n",
+			[]string{"", ""},
+			[]string{`{"a":1}`, `{"a":2}`}, false},
+		{"jsonl", FilesParserParams{KeyField: "id"},
+			"{\"id\":\"x\"}\n{\"id\":7}\n",
+			[]string{"x", "7"},
+			[]string{`{"id":"x"}`, `{"id":7}`}, false},
+		{"jsonl", FilesParserParams{KeyField: "id"},
+			"{\"id\":\"x\"}\n{\"a\":1}\n", nil, nil, true},
+		{"jsonl", FilesParserParams{}, "{\"a\":1}\n[1]\n", nil, nil, true},
+		{"csv", FilesParserParams{}, "", nil, nil, false},
+		{"csv", FilesParserParams{
+			KeyField: "id",
+			Fields:   map[string]string{"Name": "name"},
+		}, "id,Name\n1,a\n2,\"b,c\"\n",
+			[]string{"1", "2"},
+			[]string{`{"id":"1","name":"a"}`, `{"id":"2","name":"b,c"}`},
+			false},
+		{"csv", FilesParserParams{Header: []string{"x", "y"}, Comma: ";"},
+			"1;2\n",
+			[]string{""},
+			[]string{`{"x":"1","y":"2"}`}, false},
+		{"csv", FilesParserParams{}, "a,b\n1\n", nil, nil, true},
+		{"xml", FilesParserParams{},
+			`<doc id="1"><title>hi</title></doc>`,
+			[]string{""},
+			[]string{`{"@id":"1","title":"hi"}`}, false},
+		{"xml", FilesParserParams{RecordElement: "item", KeyField: "@id"},
+			`<items><item id="a"><tag>x</tag><tag>y</tag></item>` +
+				`<other/><item id="b">text</item></items>`,
+			[]string{"a", "b"},
+			[]string{`{"@id":"a","tag":["x","y"]}`,
+				`{"#text":"text","@id":"b"}`}, false},
+		{"xml", FilesParserParams{}, `<doc><a></doc>`, nil, nil, true},
+	}
+
+	for i, test := range tests {
+		docs, err := FilesParsers[test.parser]("p", []byte(test.contents),
+			&test.params)
+		if (err != nil) != test.expErr {
+			t.Errorf("test %d, expErr: %v, err: %v", i, test.expErr, err)
+			continue
+		}
+		var keys, vals []string
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+			vals = append(vals, string(doc.Val))
+		}
+		if !reflect.DeepEqual(keys, test.expKeys) ||
+			!reflect.DeepEqual(vals, test.expVals) {
+			t.Errorf("test %d, expected keys: %q, vals: %q,"+
+				" got keys: %q, vals: %q",
+				i, test.expKeys, test.expVals, keys, vals)
+		}
+	}
+
+	for _, params := range []string{
+		`{"parsers":{"jsonl":{"parser":"jsonl"}}}`,
+		`{"parsers":{".jsonl":{"parser":"unknown"}}}`,
+		`{"parsers":{".csv":{"parser":"csv","comma":";;"}}}`,
+	} {
+		_, err := NewFilesFeed(nil, "name", "indexName", "src",
+			params, nil, false, nil)
+		if err == nil {
+			t.Errorf("expected err on params: %s", params)
+		}
+	}
+}
+
+func TestFilesFeedParsed(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	root := filepath.Join(testDir, "files", "src")
+	os.MkdirAll(root, 0700)
+	path := filepath.Join(root, "docs.jsonl")
+	ioutil.WriteFile(path, []byte(`{"id":"a"}`+"\n"+`{"id":"b"}`+"\n"), 0600)
+
+	ff, err := NewFilesFeed(nil, "name", "indexName", "src",
+		`{"parsers":{".jsonl":{"parser":"jsonl","keyField":"id"}},`+
+			`"chunkSize":4}`, nil, false, nil)
+	if err != nil {
+		t.Fatalf("expected no err, err: %v", err)
+	}
+
+	snapshotStart := func() error { return nil }
+
+	ff.parsed = map[string]*filesParsed{}
+	numSeqs := ff.numSeqs(root, path)
+	if numSeqs != 2 {
+		t.Errorf("expected 2 seqs, got: %d", numSeqs)
+	}
+	dest := &chunksTestDest{}
+	sent, skip, err := ff.sendParsed(dest, "", path, 10, snapshotStart)
+	if !sent || skip != nil || err != nil {
+		t.Fatalf("expected sendParsed to work, %v, %+v, %v", sent, skip, err)
+	}
+	if exp := []string{`{"id":"a"}`, `{"id":"b"}`}; !reflect.DeepEqual(dest.vals, exp) {
+		t.Errorf("expected vals: %q, got: %q", exp, dest.vals)
+	}
+
+	// The file changes, so the docs that are gone are deleted.
+	ioutil.WriteFile(path, []byte(`{"id":"b"}`+"\n"+`{"id":"c"}`+"\n"), 0600)
+
+	numSeqs = ff.numSeqs(root, path)
+	if numSeqs != 3 {
+		t.Errorf("expected 2 update and 1 delete seqs, got: %d", numSeqs)
+	}
+	dest = &chunksTestDest{}
+	sent, skip, err = ff.sendParsed(dest, "", path, 20, snapshotStart)
+	if !sent || skip != nil || err != nil {
+		t.Fatalf("expected sendParsed to work, %v, %+v, %v", sent, skip, err)
+	}
+	if exp := []string{FilesParsedKey(path, "b") + "=",
+		FilesParsedKey(path, "c") + "="}; !reflect.DeepEqual(dest.updates, exp) {
+		t.Errorf("expected updates: %q, got: %q", exp, dest.updates)
+	}
+	if exp := []string{FilesParsedKey(path, "a")}; !reflect.DeepEqual(dest.deletes, exp) {
+		t.Errorf("expected deletes: %q, got: %q", exp, dest.deletes)
+	}
+	if exp := []uint64{20, 21, 22}; !reflect.DeepEqual(dest.seqs, exp) {
+		t.Errorf("expected seqs: %v, got: %v", exp, dest.seqs)
+	}
+
+	// A parse error skips the file, keeping its docs.
+	ioutil.WriteFile(path, []byte("not json\n"), 0600)
+
+	if numSeqs = ff.numSeqs(root, path); numSeqs != 1 {
+		t.Errorf("expected 1 seq, got: %d", numSeqs)
+	}
+	dest = &chunksTestDest{}
+	sent, skip, err = ff.sendParsed(dest, "", path, 30, snapshotStart)
+	if sent || skip == nil || skip.Reason != FILES_SKIP_PARSE || err != nil {
+		t.Errorf("expected a parse skip, %v, %+v, %v", sent, skip, err)
+	}
+
+	var buf bytes.Buffer
+	ff.Stats(&buf)
+	if !strings.Contains(buf.String(), `"totParsedDoc":4,"totParsedDelete":1`) {
+		t.Errorf("expected parsed stats, got: %s", buf.String())
+	}
+}
+
 func TestFilesFeedPartitions(t *testing.T) {
 	sourceType := ""
 	sourceName := ""
@@ -187,6 +187,15 @@ func (t *PrimaryFeed) RollbackEx(partition string,
 	return dest.Rollback(partition, rollbackSeq)
 }
 
+func (t *PrimaryFeed) CheckpointPropose(partition string, seq uint64,
+	ack func(err error)) error {
+	dest, err := t.pf(partition, nil, t.dests)
+	if err != nil {
+		return fmt.Errorf("feed_primary: PrimaryFeed pf, err: %v", err)
+	}
+	return DestCheckpointPropose(dest, partition, seq, ack)
+}
+
 func (t *PrimaryFeed) ConsistencyWait(partition, partitionUUID string,
 	consistencyLevel string,
 	consistencySeq uint64,
@@ -0,0 +1,225 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// FEED_RESTARTS_KEY is the Cfg key for the cluster-wide feed restart
+// requests, which every janitor watches.
+const FEED_RESTARTS_KEY = "feedRestarts"
+
+const JANITOR_RESTART_FEED = "janitor_restart_feed"
+
+// FeedRestarts holds the latest cluster-wide feed restart request per
+// index.
+type FeedRestarts struct {
+	UUID     string                         `json:"uuid"`
+	Requests map[string]*FeedRestartRequest `json:"requests"` // Keyed by index name.
+}
+
+// A FeedRestartRequest asks every node to restart its feeds of an
+// index.  A node acts on a request once, when its ID changes.
+type FeedRestartRequest struct {
+	ID        string `json:"id"`
+	IndexUUID string `json:"indexUUID"`
+	Time      string `json:"time"`
+}
+
+// CfgGetFeedRestarts retrieves the FeedRestarts from a Cfg.
+func CfgGetFeedRestarts(cfg Cfg) (*FeedRestarts, uint64, error) {
+	v, cas, err := cfg.Get(FEED_RESTARTS_KEY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &FeedRestarts{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetFeedRestarts updates the FeedRestarts in a Cfg.
+func CfgSetFeedRestarts(cfg Cfg, f *FeedRestarts, cas uint64) (
+	uint64, error) {
+	buf, err := json.Marshal(f)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(FEED_RESTARTS_KEY, buf, cas)
+}
+
+// ---------------------------------------------------------
+
+// RestartFeed force-closes a feed of this node, such as one that's
+// stuck on its source connection, and has the janitor start it again
+// without disturbing the feed's pindexes.
+func (mgr *Manager) RestartFeed(feedName string) error {
+	feeds, _ := mgr.CurrentMaps()
+	feed := feeds[feedName]
+	if feed == nil {
+		return fmt.Errorf("feed_restart: no feed, name: %s", feedName)
+	}
+
+	if mgr.tagsMap != nil &&
+		(!mgr.tagsMap["pindex"] || !mgr.tagsMap["janitor"]) {
+		return fmt.Errorf("feed_restart: not a janitor node")
+	}
+
+	return syncWorkReq(mgr.janitorCh, JANITOR_RESTART_FEED,
+		"api-RestartFeed", feed)
+}
+
+// RestartIndexFeeds restarts all of this node's feeds of an index,
+// returning the names of the restarted feeds.
+func (mgr *Manager) RestartIndexFeeds(indexName string) ([]string, error) {
+	feeds, _ := mgr.CurrentMaps()
+
+	var rv []string
+	for name, feed := range feeds {
+		if feed.IndexName() == indexName {
+			rv = append(rv, name)
+		}
+	}
+	sort.Strings(rv)
+
+	for _, name := range rv {
+		err := mgr.RestartFeed(name)
+		if err != nil {
+			return rv, err
+		}
+	}
+
+	return rv, nil
+}
+
+// restartFeed is invoked on the janitor goroutine, so it doesn't race
+// with the janitor's own feed changes.
+func (mgr *Manager) restartFeed(feed Feed) error {
+	atomic.AddUint64(&mgr.stats.TotFeedRestart, 1)
+
+	mgr.log.Printf("feed_restart: restarting feed: %s", feed.Name())
+
+	err := mgr.stopFeed(feed)
+	if err == nil {
+		// The janitor sees that the feed is missing and starts it.
+		err = mgr.JanitorOnce("restart feed: " + feed.Name())
+	}
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotFeedRestartErr, 1)
+		return fmt.Errorf("feed_restart: feed: %s, err: %v", feed.Name(), err)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// RequestIndexFeedsRestart asks every node of the cluster to restart
+// its feeds of an index.
+func (mgr *Manager) RequestIndexFeedsRestart(indexName string) error {
+	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return err
+	}
+	if indexDefs == nil || indexDefs.IndexDefs[indexName] == nil {
+		return fmt.Errorf("feed_restart: no index, name: %s", indexName)
+	}
+	indexDef := indexDefs.IndexDefs[indexName]
+
+	atomic.AddUint64(&mgr.stats.TotFeedRestartRequest, 1)
+
+	for tries := 0; tries < 100; tries++ {
+		f, cas, err := CfgGetFeedRestarts(mgr.cfg)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			f = &FeedRestarts{}
+		}
+		if f.Requests == nil {
+			f.Requests = map[string]*FeedRestartRequest{}
+		}
+
+		// Forget the requests of deleted indexes.
+		for name := range f.Requests {
+			if indexDefs.IndexDefs[name] == nil {
+				delete(f.Requests, name)
+			}
+		}
+
+		f.UUID = NewUUID()
+		f.Requests[indexName] = &FeedRestartRequest{
+			ID:        NewUUID(),
+			IndexUUID: indexDef.UUID,
+			Time:      time.Now().Format(time.RFC3339Nano),
+		}
+
+		_, err = CfgSetFeedRestarts(mgr.cfg, f, cas)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			return err
+		}
+	}
+
+	return fmt.Errorf("feed_restart: could not save request, too many tries")
+}
+
+// applyFeedRestarts restarts this node's feeds for the cluster-wide
+// requests that it hasn't seen yet.  With onlyMarkSeen, such as on
+// startup when the feeds are new anyways, the requests are only
+// remembered as seen.
+func (mgr *Manager) applyFeedRestarts(onlyMarkSeen bool) {
+	f, _, err := CfgGetFeedRestarts(mgr.cfg)
+	if err != nil || f == nil {
+		return
+	}
+
+	mgr.feedRestartsMutex.Lock()
+	if mgr.feedRestartsSeen == nil {
+		mgr.feedRestartsSeen = map[string]string{}
+	}
+	var indexNames []string
+	for indexName, req := range f.Requests {
+		if mgr.feedRestartsSeen[indexName] != req.ID {
+			mgr.feedRestartsSeen[indexName] = req.ID
+			indexNames = append(indexNames, indexName)
+		}
+	}
+	mgr.feedRestartsMutex.Unlock()
+
+	if onlyMarkSeen {
+		return
+	}
+
+	sort.Strings(indexNames)
+	for _, indexName := range indexNames {
+		restarted, err := mgr.RestartIndexFeeds(indexName)
+		if err != nil {
+			mgr.log.Warnf("feed_restart: index: %s, err: %v", indexName, err)
+		} else {
+			mgr.log.Printf("feed_restart: index: %s, restarted feeds: %v",
+				indexName, restarted)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManagerRestartFeed(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	go func() {
+		for r := range m.plannerCh {
+			close(r.resCh)
+		}
+	}()
+
+	if err := m.CreateIndex("primary", "default", "123", "{}",
+		"blackhole", "x", "{}", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	if _, err := m.PlannerOnce("test"); err != nil {
+		t.Fatalf("expected PlannerOnce() to work, err: %v", err)
+	}
+	if err := m.JanitorOnce("test"); err != nil {
+		t.Fatalf("expected JanitorOnce() to work, err: %v", err)
+	}
+
+	go m.JanitorLoop()
+
+	feeds, _ := m.CurrentMaps()
+	if len(feeds) != 1 {
+		t.Fatalf("expected 1 feed, got: %#v", feeds)
+	}
+	var feedName string
+	var feed Feed
+	for name, f := range feeds {
+		feedName, feed = name, f
+	}
+
+	if err := m.RestartFeed("not-a-feed"); err == nil {
+		t.Errorf("expected err on an unknown feed")
+	}
+	if err := m.RestartFeed(feedName); err != nil {
+		t.Fatalf("expected RestartFeed() to work, err: %v", err)
+	}
+
+	feeds, _ = m.CurrentMaps()
+	if feeds[feedName] == nil || feeds[feedName] == feed {
+		t.Errorf("expected a new feed, got: %#v", feeds)
+	}
+	if atomic.LoadUint64(&m.stats.TotFeedRestart) != 1 {
+		t.Errorf("expected 1 feed restart, stats: %#v", m.stats)
+	}
+
+	if err := m.RequestIndexFeedsRestart("not-an-index"); err == nil {
+		t.Errorf("expected err on an unknown index")
+	}
+	if err := m.RequestIndexFeedsRestart("x"); err != nil {
+		t.Fatalf("expected RequestIndexFeedsRestart() to work, err: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&m.stats.TotFeedRestart) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a cluster-wide feed restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f, _, err := CfgGetFeedRestarts(cfg)
+	if err != nil || f == nil || f.Requests["x"] == nil {
+		t.Errorf("expected a restart request, got: %#v, err: %v", f, err)
+	}
+}
@@ -0,0 +1,559 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package feedtest provides a conformance test kit for registered
+// cbgt.FeedType implementations, which checks the Partitions and
+// PartitionSeqs contracts, starting and cleanly closing a feed, the
+// stopAfter source params, stats and error propagation.  A typical
+// use from the tests of a new feed type is...
+//
+//	func TestMyFeed(t *testing.T) {
+//		feedtest.Run(t, feedtest.Options{
+//			SourceType:   "myFeed",
+//			SourceName:   "mySource",
+//			SourceParams: `{"numPartitions":4}`,
+//		})
+//	}
+package feedtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// Options describes the registered feed type to test and its source.
+type Options struct {
+	SourceType   string // The registered cbgt.FeedType name.
+	SourceName   string
+	SourceUUID   string
+	SourceParams string
+	Server       string
+	MgrOptions   map[string]string // The manager and feed options.
+
+	// Setup, when non-nil, prepares the source before a feed starts,
+	// such as by creating files in the manager's dataDir.
+	Setup func(t *testing.T, dataDir string)
+
+	// ExpectData means that the source has data, so a started feed
+	// must send at least one mutation to its dests.
+	ExpectData bool
+
+	// StopAfter means that the feed type supports the stopAfter of
+	// cbgt.StopAfterSourceParams, which needs PartitionSeqs.
+	StopAfter bool
+
+	// BadSourceParams, when non-empty, are sourceParams that the
+	// feed type must reject, whether from Partitions(), from
+	// Start() or via the manager's OnFeedError().
+	BadSourceParams string
+
+	// Timeout bounds each wait for the feed, defaulting to 5 seconds.
+	Timeout time.Duration
+}
+
+// Run runs each conformance scenario as a subtest of t.
+func Run(t *testing.T, options Options) {
+	feedType := cbgt.FeedTypes[options.SourceType]
+	if feedType == nil {
+		t.Fatalf("feedtest: unregistered sourceType: %s", options.SourceType)
+	}
+	if feedType.Start == nil || feedType.Partitions == nil {
+		t.Fatalf("feedtest: Start and Partitions are required,"+
+			" sourceType: %s", options.SourceType)
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+
+	k := &kit{feedType: feedType, options: options}
+
+	t.Run("Partitions", k.testPartitions)
+	t.Run("PartitionSeqs", k.testPartitionSeqs)
+	t.Run("StartClose", k.testStartClose)
+	t.Run("StopAfter", k.testStopAfter)
+	t.Run("Errors", k.testErrors)
+}
+
+type kit struct {
+	feedType *cbgt.FeedType
+	options  Options
+}
+
+func (k *kit) partitions(sourceParams string) ([]string, error) {
+	o := k.options
+	return k.feedType.Partitions(o.SourceType, o.SourceName, o.SourceUUID,
+		sourceParams, o.Server, o.MgrOptions)
+}
+
+// ---------------------------------------------------------
+
+// Partitions are unique, non-empty and stable.
+func (k *kit) testPartitions(t *testing.T) {
+	partitions, err := k.partitions(k.options.SourceParams)
+	if err != nil {
+		t.Fatalf("feedtest: Partitions, err: %v", err)
+	}
+
+	seen := map[string]bool{}
+	for _, partition := range partitions {
+		if partition == "" || seen[partition] {
+			t.Errorf("feedtest: empty or duplicate partition: %q,"+
+				" partitions: %v", partition, partitions)
+		}
+		seen[partition] = true
+	}
+
+	again, err := k.partitions(k.options.SourceParams)
+	if err != nil {
+		t.Fatalf("feedtest: Partitions again, err: %v", err)
+	}
+	if fmt.Sprint(sorted(again)) != fmt.Sprint(sorted(partitions)) {
+		t.Errorf("feedtest: expected stable partitions,"+
+			" got: %v, then: %v", partitions, again)
+	}
+}
+
+// PartitionSeqs cover only known partitions, and never go backwards.
+func (k *kit) testPartitionSeqs(t *testing.T) {
+	if k.feedType.PartitionSeqs == nil {
+		if k.options.StopAfter {
+			t.Errorf("feedtest: StopAfter needs PartitionSeqs")
+		}
+		t.Skip("feedtest: no PartitionSeqs")
+	}
+
+	partitions, err := k.partitions(k.options.SourceParams)
+	if err != nil {
+		t.Fatalf("feedtest: Partitions, err: %v", err)
+	}
+	known := cbgt.StringsToMap(partitions)
+
+	seqs, err := k.partitionSeqs()
+	if err != nil {
+		t.Fatalf("feedtest: PartitionSeqs, err: %v", err)
+	}
+	for partition := range seqs {
+		if !known[partition] {
+			t.Errorf("feedtest: PartitionSeqs has an unknown partition: %q",
+				partition)
+		}
+	}
+
+	again, err := k.partitionSeqs()
+	if err != nil {
+		t.Fatalf("feedtest: PartitionSeqs again, err: %v", err)
+	}
+	for partition, uuidSeq := range seqs {
+		if a, exists := again[partition]; exists &&
+			a.UUID == uuidSeq.UUID && a.Seq < uuidSeq.Seq {
+			t.Errorf("feedtest: seq went backwards, partition: %s,"+
+				" seq: %d, then: %d", partition, uuidSeq.Seq, a.Seq)
+		}
+	}
+}
+
+func (k *kit) partitionSeqs() (map[string]cbgt.UUIDSeq, error) {
+	o := k.options
+	return k.feedType.PartitionSeqs(o.SourceType, o.SourceName,
+		o.SourceUUID, o.SourceParams, o.Server, o.MgrOptions)
+}
+
+// A started feed is registered, describes itself, has valid stats,
+// and sends nothing after Close().
+func (k *kit) testStartClose(t *testing.T) {
+	h := k.startFeed(t, k.options.SourceParams)
+	defer h.cleanup()
+
+	if h.startErr != nil {
+		t.Fatalf("feedtest: Start, err: %v", h.startErr)
+	}
+
+	feed := h.feed(t)
+	if feed.IndexName() != feedTestIndexName {
+		t.Errorf("feedtest: expected IndexName: %s, got: %s",
+			feedTestIndexName, feed.IndexName())
+	}
+	if fmt.Sprint(sortedKeys(feed.Dests())) !=
+		fmt.Sprint(sortedKeys(h.dests)) {
+		t.Errorf("feedtest: expected Dests() to be the started dests,"+
+			" got: %v", sortedKeys(feed.Dests()))
+	}
+
+	var buf bytes.Buffer
+	if err := feed.Stats(&buf); err != nil {
+		t.Errorf("feedtest: Stats, err: %v", err)
+	} else if !json.Valid(buf.Bytes()) {
+		t.Errorf("feedtest: Stats is not valid JSON: %q", buf.Bytes())
+	}
+
+	if k.options.ExpectData {
+		if !h.rec.waitFor(k.options.Timeout, func() bool {
+			return h.rec.updates > 0
+		}) {
+			t.Errorf("feedtest: expected data from the feed")
+		}
+	}
+
+	if err := feed.Close(); err != nil {
+		t.Errorf("feedtest: Close, err: %v", err)
+	}
+
+	// Give a misbehaving feed a chance to send after its Close().
+	calls := h.rec.numCalls()
+	time.Sleep(100 * time.Millisecond)
+	if n := h.rec.numCalls(); n != calls {
+		t.Errorf("feedtest: expected no dest calls after Close,"+
+			" got: %d", n-calls)
+	}
+
+	// A second Close() may return an error, but must not panic.
+	feed.Close()
+}
+
+// With stopAfter markReached, a feed sends nothing beyond the marked
+// seqs.
+func (k *kit) testStopAfter(t *testing.T) {
+	if !k.options.StopAfter {
+		t.Skip("feedtest: no StopAfter")
+	}
+	if k.feedType.PartitionSeqs == nil {
+		t.Fatalf("feedtest: StopAfter needs PartitionSeqs")
+	}
+
+	marks, err := k.partitionSeqs()
+	if err != nil {
+		t.Fatalf("feedtest: PartitionSeqs, err: %v", err)
+	}
+
+	params := map[string]interface{}{}
+	if k.options.SourceParams != "" {
+		err = json.Unmarshal([]byte(k.options.SourceParams), &params)
+		if err != nil {
+			t.Fatalf("feedtest: SourceParams, err: %v", err)
+		}
+	}
+	params["stopAfter"] = "markReached"
+	params["markPartitionSeqs"] = marks
+	sourceParams, _ := json.Marshal(params)
+
+	h := k.startFeed(t, string(sourceParams))
+	defer h.cleanup()
+
+	if h.startErr != nil {
+		t.Fatalf("feedtest: Start, err: %v", h.startErr)
+	}
+
+	h.rec.waitFor(k.options.Timeout, func() bool {
+		for partition, mark := range marks {
+			if h.rec.maxSeqs[partition] < mark.Seq {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Give the feed a chance to send past the marks.
+	time.Sleep(100 * time.Millisecond)
+
+	h.rec.m.Lock()
+	for partition, mark := range marks {
+		if seq := h.rec.maxSeqs[partition]; seq > mark.Seq {
+			t.Errorf("feedtest: expected no seq past the mark,"+
+				" partition: %s, mark: %d, seq: %d",
+				partition, mark.Seq, seq)
+		}
+	}
+	h.rec.m.Unlock()
+
+	h.feed(t).Close()
+}
+
+// Bad sourceParams are rejected or reported to OnFeedError.
+func (k *kit) testErrors(t *testing.T) {
+	if k.options.BadSourceParams == "" {
+		t.Skip("feedtest: no BadSourceParams")
+	}
+
+	if _, err := k.partitions(k.options.BadSourceParams); err != nil {
+		return
+	}
+
+	h := k.startFeed(t, k.options.BadSourceParams)
+	defer h.cleanup()
+
+	if h.startErr != nil {
+		return
+	}
+
+	if !h.meh.waitFor(k.options.Timeout) {
+		t.Errorf("feedtest: expected bad sourceParams to be rejected" +
+			" or reported to OnFeedError")
+	}
+
+	if feeds, _ := h.mgr.CurrentMaps(); feeds[feedTestFeedName] != nil {
+		feeds[feedTestFeedName].Close()
+	}
+}
+
+// ---------------------------------------------------------
+
+const feedTestFeedName = "feedtest_feed"
+const feedTestIndexName = "feedtest_index"
+
+// A harness is a started feed, with its manager and dests.
+type harness struct {
+	mgr      *cbgt.Manager
+	dataDir  string
+	meh      *recMEH
+	rec      *recDest
+	dests    map[string]cbgt.Dest
+	startErr error
+}
+
+func (k *kit) startFeed(t *testing.T, sourceParams string) *harness {
+	dataDir, err := ioutil.TempDir("", "feedtest")
+	if err != nil {
+		t.Fatalf("feedtest: TempDir, err: %v", err)
+	}
+
+	if k.options.Setup != nil {
+		k.options.Setup(t, dataDir)
+	}
+
+	h := &harness{dataDir: dataDir, meh: &recMEH{}, rec: newRecDest()}
+
+	o := k.options
+
+	h.mgr = cbgt.NewManager(cbgt.Version, cbgt.NewCfgMem(),
+		cbgt.NewStdLibLog(ioutil.Discard, "", 0), cbgt.NewUUID(),
+		nil, "", 1, "", "", dataDir, o.Server, h.meh, o.MgrOptions)
+
+	partitions, err := k.partitions(sourceParams)
+	if err != nil {
+		h.startErr = err
+		return h
+	}
+
+	// As with the janitor, no partitions means a single "" partition.
+	h.dests = map[string]cbgt.Dest{}
+	if len(partitions) <= 0 {
+		partitions = []string{""}
+	}
+	for _, partition := range partitions {
+		h.dests[partition] = h.rec
+	}
+
+	h.startErr = k.feedType.Start(h.mgr, feedTestFeedName,
+		feedTestIndexName, "feedtest_index_uuid", o.SourceType,
+		o.SourceName, o.SourceUUID, sourceParams, h.dests)
+
+	return h
+}
+
+// feed returns the feed that Start() registered with the manager.
+func (h *harness) feed(t *testing.T) cbgt.Feed {
+	feeds, _ := h.mgr.CurrentMaps()
+	feed := feeds[feedTestFeedName]
+	if feed == nil {
+		t.Fatalf("feedtest: expected Start to register feed: %s,"+
+			" got: %v", feedTestFeedName, sortedKeysFeeds(feeds))
+	}
+	if feed.Name() != feedTestFeedName {
+		t.Errorf("feedtest: expected Name: %s, got: %s",
+			feedTestFeedName, feed.Name())
+	}
+	return feed
+}
+
+func (h *harness) cleanup() {
+	h.mgr.Stop()
+	os.RemoveAll(h.dataDir)
+}
+
+// ---------------------------------------------------------
+
+// recMEH records the OnFeedError callbacks.
+type recMEH struct {
+	m    sync.Mutex
+	errs []error
+}
+
+func (r *recMEH) OnRegisterPIndex(pindex *cbgt.PIndex)   {}
+func (r *recMEH) OnUnregisterPIndex(pindex *cbgt.PIndex) {}
+
+func (r *recMEH) OnFeedError(srcType string, feed cbgt.Feed, err error) {
+	r.m.Lock()
+	r.errs = append(r.errs, err)
+	r.m.Unlock()
+}
+
+func (r *recMEH) waitFor(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		r.m.Lock()
+		n := len(r.errs)
+		r.m.Unlock()
+		if n > 0 {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// recDest records the calls that a feed makes on its dests.
+type recDest struct {
+	m       sync.Mutex
+	calls   int
+	updates int
+	maxSeqs map[string]uint64
+	opaque  map[string][]byte
+}
+
+func newRecDest() *recDest {
+	return &recDest{maxSeqs: map[string]uint64{}, opaque: map[string][]byte{}}
+}
+
+func (r *recDest) record(partition string, seq uint64, update bool) {
+	r.m.Lock()
+	r.calls++
+	if update {
+		r.updates++
+	}
+	if seq > r.maxSeqs[partition] {
+		r.maxSeqs[partition] = seq
+	}
+	r.m.Unlock()
+}
+
+func (r *recDest) numCalls() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.calls
+}
+
+func (r *recDest) waitFor(timeout time.Duration, f func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		r.m.Lock()
+		done := f()
+		r.m.Unlock()
+		if done {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func (r *recDest) Close() error { return nil }
+
+func (r *recDest) DataUpdate(partition string, key []byte, seq uint64,
+	val []byte, cas uint64,
+	extrasType cbgt.DestExtrasType, extras []byte) error {
+	r.record(partition, seq, true)
+	return nil
+}
+
+func (r *recDest) DataDelete(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType cbgt.DestExtrasType, extras []byte) error {
+	r.record(partition, seq, false)
+	return nil
+}
+
+func (r *recDest) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	r.record(partition, 0, false)
+	return nil
+}
+
+func (r *recDest) OpaqueGet(partition string) ([]byte, uint64, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.opaque[partition], r.maxSeqs[partition], nil
+}
+
+func (r *recDest) OpaqueSet(partition string, value []byte) error {
+	r.m.Lock()
+	r.calls++
+	r.opaque[partition] = append([]byte(nil), value...)
+	r.m.Unlock()
+	return nil
+}
+
+func (r *recDest) Rollback(partition string, rollbackSeq uint64) error {
+	r.m.Lock()
+	r.calls++
+	if r.maxSeqs[partition] > rollbackSeq {
+		r.maxSeqs[partition] = rollbackSeq
+	}
+	r.m.Unlock()
+	return nil
+}
+
+func (r *recDest) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string, consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	return nil
+}
+
+func (r *recDest) Count(pindex *cbgt.PIndex,
+	cancelCh <-chan bool) (uint64, error) {
+	return 0, nil
+}
+
+func (r *recDest) Query(pindex *cbgt.PIndex, req []byte, w io.Writer,
+	cancelCh <-chan bool) error {
+	return nil
+}
+
+func (r *recDest) Stats(w io.Writer) error {
+	_, err := w.Write(cbgt.JsonNULL)
+	return err
+}
+
+// ---------------------------------------------------------
+
+func sorted(a []string) []string {
+	rv := append([]string(nil), a...)
+	sort.Strings(rv)
+	return rv
+}
+
+func sortedKeys(m map[string]cbgt.Dest) []string {
+	var rv []string
+	for k := range m {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func sortedKeysFeeds(m map[string]cbgt.Feed) []string {
+	var rv []string
+	for k := range m {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
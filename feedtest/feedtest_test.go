@@ -0,0 +1,207 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package feedtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/blugelabs/cbgt"
+)
+
+func init() {
+	cbgt.RegisterFeedType("feedtest-counter", &cbgt.FeedType{
+		Start:         startCounterFeed,
+		Partitions:    counterFeedPartitions,
+		PartitionSeqs: counterFeedPartitionSeqs,
+	})
+}
+
+// counterSourceSeqs is the number of mutations per partition that a
+// counterFeed's source has.
+const counterSourceSeqs = 10
+
+type counterFeedParams struct {
+	NumPartitions int  `json:"numPartitions"`
+	Fail          bool `json:"fail"`
+	cbgt.StopAfterSourceParams
+}
+
+func parseCounterFeedParams(sourceParams string) (
+	*counterFeedParams, error) {
+	params := &counterFeedParams{}
+	if sourceParams != "" {
+		err := json.Unmarshal([]byte(sourceParams), params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+func counterFeedPartitions(sourceType, sourceName, sourceUUID,
+	sourceParams, server string, options map[string]string) (
+	[]string, error) {
+	params, err := parseCounterFeedParams(sourceParams)
+	if err != nil {
+		return nil, err
+	}
+	var rv []string
+	for i := 0; i < params.NumPartitions; i++ {
+		rv = append(rv, strconv.Itoa(i))
+	}
+	return rv, nil
+}
+
+func counterFeedPartitionSeqs(sourceType, sourceName, sourceUUID,
+	sourceParams, server string, options map[string]string) (
+	map[string]cbgt.UUIDSeq, error) {
+	partitions, err := counterFeedPartitions(sourceType, sourceName,
+		sourceUUID, sourceParams, server, options)
+	if err != nil {
+		return nil, err
+	}
+	rv := map[string]cbgt.UUIDSeq{}
+	for _, partition := range partitions {
+		rv[partition] = cbgt.UUIDSeq{UUID: "u", Seq: counterSourceSeqs / 2}
+	}
+	return rv, nil
+}
+
+// A counterFeed sends counterSourceSeqs mutations per partition,
+// honoring the stopAfter source params, and reports a failure to
+// OnFeedError when its params ask it to.
+type counterFeed struct {
+	mgr       *cbgt.Manager
+	name      string
+	indexName string
+	params    *counterFeedParams
+	dests     map[string]cbgt.Dest
+
+	m       sync.Mutex
+	closed  bool
+	closeCh chan struct{}
+	doneCh  chan struct{}
+}
+
+func startCounterFeed(mgr *cbgt.Manager, feedName, indexName, indexUUID,
+	sourceType, sourceName, sourceUUID, sourceParams string,
+	dests map[string]cbgt.Dest) error {
+	params, err := parseCounterFeedParams(sourceParams)
+	if err != nil {
+		return err
+	}
+	feed := &counterFeed{mgr: mgr, name: feedName, indexName: indexName,
+		params: params, dests: dests,
+		closeCh: make(chan struct{}), doneCh: make(chan struct{})}
+	err = mgr.RegisterFeed(feed)
+	if err != nil {
+		return err
+	}
+	return feed.Start()
+}
+
+func (t *counterFeed) Name() string                { return t.name }
+func (t *counterFeed) IndexName() string           { return t.indexName }
+func (t *counterFeed) Dests() map[string]cbgt.Dest { return t.dests }
+
+func (t *counterFeed) Start() error {
+	go func() {
+		defer close(t.doneCh)
+
+		if t.params.Fail {
+			t.mgr.OnFeedError("feedtest-counter", t,
+				fmt.Errorf("counterFeed: asked to fail"))
+			return
+		}
+
+		for seq := uint64(1); seq <= counterSourceSeqs; seq++ {
+			for partition, dest := range t.dests {
+				if t.params.StopAfter == "markReached" &&
+					seq > t.params.MarkPartitionSeqs[partition].Seq {
+					continue
+				}
+				select {
+				case <-t.closeCh:
+					return
+				default:
+				}
+				dest.DataUpdate(partition, []byte("k"), seq, []byte("{}"),
+					0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *counterFeed) Close() error {
+	t.m.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.closeCh)
+	}
+	t.m.Unlock()
+	<-t.doneCh
+	return nil
+}
+
+func (t *counterFeed) Stats(w io.Writer) error {
+	_, err := w.Write([]byte(`{"feedtest":true}`))
+	return err
+}
+
+// ---------------------------------------------------------
+
+func TestCounterFeed(t *testing.T) {
+	Run(t, Options{
+		SourceType:      "feedtest-counter",
+		SourceName:      "counter",
+		SourceParams:    `{"numPartitions":3}`,
+		ExpectData:      true,
+		StopAfter:       true,
+		BadSourceParams: `{"numPartitions":1,"fail":true}`,
+	})
+}
+
+func TestPrimaryFeed(t *testing.T) {
+	Run(t, Options{
+		SourceType:      "primary",
+		SourceParams:    `{"numPartitions":2}`,
+		BadSourceParams: `not json`,
+	})
+}
+
+func TestNILFeed(t *testing.T) {
+	Run(t, Options{SourceType: "nil"})
+}
+
+func TestFilesFeed(t *testing.T) {
+	Run(t, Options{
+		SourceType:   "files",
+		SourceName:   "docs",
+		SourceParams: `{"sleepStartMS":10}`,
+		Setup: func(t *testing.T, dataDir string) {
+			dir := filepath.Join(dataDir, "files", "docs")
+			os.MkdirAll(dir, 0700)
+			ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0600)
+		},
+		ExpectData:      true,
+		BadSourceParams: `{"numPartitions":"x"}`,
+	})
+}
@@ -5,8 +5,10 @@ go 1.13
 require (
 	github.com/blugelabs/blance v1.0.0
 	github.com/elazarl/go-bindata-assetfs v1.0.0
+	github.com/golang/protobuf v1.2.0
 	github.com/gorilla/context v0.0.0-20141217160251-215affda49ad // indirect
 	github.com/gorilla/mux v1.4.1-0.20170524010104-043ee6597c29
 	github.com/rcrowley/go-metrics v0.0.0-20141108142129-dee209f2455f
-	golang.org/x/net v0.0.0-20180120141536-44b7c21cbf19
+	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d // indirect
+	google.golang.org/grpc v1.18.0
 )
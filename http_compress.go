@@ -0,0 +1,169 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GzipHandler wraps a REST handler, such as of /api/stats or
+// /api/diag, so that its responses are gzip'ed for the clients that
+// accept gzip, at a compress/gzip level, where 0 means the
+// gzip.DefaultCompression.  The response is compressed as it's
+// written, so a handler that streams its JSON, see StreamJSON(), never
+// holds the whole payload in memory.
+func GzipHandler(level int, next http.Handler) http.Handler {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	pool := &sync.Pool{New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(nil, level)
+		return gz
+	}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) ||
+			r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gz := pool.Get().(*gzip.Writer)
+		gz.Reset(w)
+
+		gw := &gzipResponseWriter{ResponseWriter: w, gz: gz}
+
+		next.ServeHTTP(gw, r)
+
+		if gw.wroteHeader && gw.compress {
+			gz.Close()
+		}
+		pool.Put(gz)
+	})
+}
+
+// acceptsGzip returns whether an Accept-Encoding allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses a response, unless the handler already
+// encoded it, or the response has no body.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	compress    bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	w.compress = h.Get("Content-Encoding") == "" &&
+		status != http.StatusNoContent && status != http.StatusNotModified
+	if w.compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.compress {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Flush sends the compressed data so far, for a streaming handler.
+func (w *gzipResponseWriter) Flush() {
+	if w.compress {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// StreamJSON writes v as a JSON response, encoding it directly into
+// the response, instead of marshaling it into a buffer first, which
+// matters for large payloads such as /api/stats?partitions=true.
+func StreamJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(w).Encode(v)
+}
+
+// GunzipResponse replaces the body of a gzip'ed response with its
+// decompressed body, for clients that request gzip explicitly, which
+// disables the transparent decompression of an http.Transport.
+func GunzipResponse(res *http.Response) error {
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		return nil
+	}
+
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		return err
+	}
+
+	res.Body = &gunzipBody{Reader: gz, closer: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+
+	return nil
+}
+
+type gunzipBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *gunzipBody) Close() error {
+	return b.closer.Close()
+}
@@ -0,0 +1,113 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testPartitionStats returns a stats payload that's like that of
+// /api/stats?partitions=true for a number of partitions.
+func testPartitionStats(partitions int) map[string]interface{} {
+	pindexes := map[string]interface{}{}
+	for i := 0; i < partitions; i++ {
+		pindexes[fmt.Sprintf("idx_%x_%d", i*7919, i)] = map[string]interface{}{
+			"partitions": map[string]interface{}{
+				fmt.Sprintf("%d", i): map[string]uint64{
+					"seq": uint64(i * 1000), "uuid": uint64(i * 31),
+				},
+			},
+			"basic": map[string]uint64{"DocCount": uint64(i * 17)},
+		}
+	}
+	return map[string]interface{}{"pindexes": pindexes}
+}
+
+func TestGzipHandler(t *testing.T) {
+	stats := testPartitionStats(100)
+	statsJSON, _ := json.Marshal(stats)
+
+	h := GzipHandler(0, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/empty" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			StreamJSON(w, stats)
+		}))
+
+	tests := []struct {
+		path, acceptEncoding string
+		expGzip              bool
+	}{
+		{"/api/stats", "gzip", true},
+		{"/api/stats", "br, gzip;q=0.5", true},
+		{"/api/stats", "gzip;q=0", false},
+		{"/api/stats", "", false},
+		{"/empty", "gzip", false},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		res := rec.Result()
+		if (res.Header.Get("Content-Encoding") == "gzip") != test.expGzip {
+			t.Errorf("%d: expected gzip: %v, headers: %v",
+				i, test.expGzip, res.Header)
+		}
+
+		err := GunzipResponse(res)
+		if err != nil {
+			t.Fatalf("%d: expected GunzipResponse to work, err: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if test.path == "/api/stats" &&
+			string(body) != string(statsJSON)+"\n" {
+			t.Errorf("%d: expected the stats, got: %.100s", i, body)
+		}
+	}
+}
+
+func BenchmarkStatsPayload(b *testing.B) {
+	for _, partitions := range []int{1024, 4096} {
+		stats := testPartitionStats(partitions)
+
+		for _, acceptEncoding := range []string{"identity", "gzip"} {
+			h := GzipHandler(0, http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					StreamJSON(w, stats)
+				}))
+
+			b.Run(fmt.Sprintf("partitions=%d/%s", partitions, acceptEncoding),
+				func(b *testing.B) {
+					var wireBytes int
+					for i := 0; i < b.N; i++ {
+						req := httptest.NewRequest("GET", "/api/stats", nil)
+						req.Header.Set("Accept-Encoding", acceptEncoding)
+						rec := httptest.NewRecorder()
+						h.ServeHTTP(rec, req)
+						wireBytes = rec.Body.Len()
+					}
+					b.ReportMetric(float64(wireBytes), "wire-bytes/op")
+				})
+		}
+	}
+}
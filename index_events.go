@@ -0,0 +1,99 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// The lifecycle events of an index, which are the IndexEvent.Event.
+const (
+	INDEX_EVENT_CREATED  = "indexCreated"
+	INDEX_EVENT_UPDATED  = "indexUpdated"
+	INDEX_EVENT_PLANNED  = "indexPlanned"       // By the node whose planner saved the plan.
+	INDEX_EVENT_BUILT    = "indexBuildComplete" // By each node, see IndexBuildLoop.
+	INDEX_EVENT_DEGRADED = "indexDegraded"
+	INDEX_EVENT_DELETED  = "indexDeleted"
+)
+
+// An IndexEvent is a lifecycle event of an index, which is added to
+// the Manager's events, passed to the ManagerEventHandlers when they
+// implement ManagerIndexEventHandlers, and published to the EventSinks
+// of the EVENT_CATEGORY_INDEX, so that external systems can react to
+// the index state changes without polling.  The "indexEventsWebhookURL"
+// manager option is a shorthand for a webhook sink of the index events.
+type IndexEvent struct {
+	Event     string `json:"event"`
+	IndexName string `json:"indexName"`
+	IndexUUID string `json:"indexUUID,omitempty"`
+	Node      string `json:"node"` // The UUID of the node that saw the event.
+	Detail    string `json:"detail,omitempty"`
+	Time      string `json:"time"`
+}
+
+// ManagerIndexEventHandlers is an optional interface of the
+// ManagerEventHandlers, to receive the IndexEvents.
+type ManagerIndexEventHandlers interface {
+	OnIndexEvent(e *IndexEvent)
+}
+
+// addIndexEvent emits an index lifecycle event.
+func (mgr *Manager) addIndexEvent(event, indexName, indexUUID,
+	detail string) {
+	atomic.AddUint64(&mgr.stats.TotIndexEvent, 1)
+
+	e := &IndexEvent{
+		Event:     event,
+		IndexName: indexName,
+		IndexUUID: indexUUID,
+		Node:      mgr.uuid,
+		Detail:    detail,
+		Time:      Now().Format(time.RFC3339Nano),
+	}
+
+	buf, _ := json.Marshal(e)
+	mgr.addEvent(EVENT_CATEGORY_INDEX, buf)
+
+	if h, ok := mgr.meh.(ManagerIndexEventHandlers); ok {
+		h.OnIndexEvent(e)
+	}
+}
+
+// addIndexPlannedEvents emits an INDEX_EVENT_PLANNED for each index
+// whose current definition is planned for the first time by a new
+// plan.
+func (mgr *Manager) addIndexPlannedEvents(prev, curr *PlanPIndexes) {
+	if curr == nil {
+		return
+	}
+
+	type indexKey struct{ name, uuid string }
+
+	planned := map[indexKey]bool{}
+	if prev != nil {
+		for _, planPIndex := range prev.PlanPIndexes {
+			planned[indexKey{planPIndex.IndexName, planPIndex.IndexUUID}] = true
+		}
+	}
+
+	for _, planPIndex := range sortedPlanPIndexes(curr) {
+		k := indexKey{planPIndex.IndexName, planPIndex.IndexUUID}
+		if planned[k] {
+			continue
+		}
+		planned[k] = true
+
+		mgr.addIndexEvent(INDEX_EVENT_PLANNED, k.name, k.uuid, "")
+	}
+}
@@ -0,0 +1,123 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// indexEventsTestMEH records the index events.
+type indexEventsTestMEH struct {
+	TestMEH
+
+	m      sync.Mutex
+	events []string
+}
+
+func (meh *indexEventsTestMEH) OnIndexEvent(e *IndexEvent) {
+	meh.m.Lock()
+	meh.events = append(meh.events, e.Event+":"+e.IndexName)
+	meh.m.Unlock()
+}
+
+func TestIndexEvents(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	webhookCh := make(chan *IndexEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			se := &SinkEvent{}
+			json.NewDecoder(r.Body).Decode(se)
+			e := &IndexEvent{}
+			json.Unmarshal(se.Event, e)
+			webhookCh <- e
+		}))
+	defer webhook.Close()
+
+	meh := &indexEventsTestMEH{}
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(),
+		[]string{"pindex", "planner"}, "", 1, "", ":1000", emptyDir, "",
+		meh, map[string]string{
+			"indexEventsWebhookURL": webhook.URL,
+		})
+	defer mgr.Stop()
+
+	go mgr.PlannerLoop()
+
+	err := mgr.Register("wanted")
+	if err != nil {
+		t.Fatalf("expected Register to work, err: %v", err)
+	}
+
+	indexUUID, err := mgr.CreateIndexEx("primary", "src", "", "",
+		"blackhole", "idx", "", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndexEx to work, err: %v", err)
+	}
+
+	// An unchanged plan isn't a planned event.
+	mgr.PlannerKick("test")
+
+	_, err = mgr.DeleteIndexEx("idx", "")
+	if err != nil {
+		t.Fatalf("expected DeleteIndexEx to work, err: %v", err)
+	}
+
+	exp := []string{"indexCreated:idx", "indexPlanned:idx", "indexDeleted:idx"}
+	meh.m.Lock()
+	if !reflect.DeepEqual(meh.events, exp) {
+		t.Errorf("expected events: %v, got: %v", exp, meh.events)
+	}
+	meh.m.Unlock()
+
+	webhookEvents := map[string]*IndexEvent{}
+	for i := 0; i < len(exp); i++ {
+		select {
+		case e := <-webhookCh:
+			webhookEvents[e.Event] = e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the webhook events, got: %v", webhookEvents)
+		}
+	}
+	if e := webhookEvents[INDEX_EVENT_PLANNED]; e == nil ||
+		e.IndexUUID != indexUUID || e.Node != mgr.UUID() {
+		t.Errorf("unexpected planned event: %+v", e)
+	}
+
+	// The deletes of a dropped source are events, too.
+	_, err = mgr.CreateIndexEx("primary", "src2", "", "",
+		"blackhole", "idx2", "", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndexEx to work, err: %v", err)
+	}
+	_, err = mgr.DeleteIndexesBySource("primary", "src2", "", false)
+	if err != nil {
+		t.Fatalf("expected DeleteIndexesBySource to work, err: %v", err)
+	}
+	meh.m.Lock()
+	if n := len(meh.events); n <= 0 ||
+		meh.events[n-1] != "indexDeleted:idx2" {
+		t.Errorf("expected an indexDeleted event, got: %v", meh.events)
+	}
+	meh.m.Unlock()
+}
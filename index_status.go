@@ -0,0 +1,211 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// IndexStatus is the rollup status of an index, so that a UI needn't
+// stitch together the index definitions, the plan and the stats of a
+// node by hand.  The Build and Ingest are from the viewpoint of the
+// node that computed the IndexStatus.
+type IndexStatus struct {
+	Name        string `json:"name"`
+	UUID        string `json:"uuid"`
+	Type        string `json:"type"`
+	SourceType  string `json:"sourceType"`
+	SourceName  string `json:"sourceName,omitempty"`
+	NumReplicas int    `json:"numReplicas"`
+	PlanFrozen  bool   `json:"planFrozen,omitempty"`
+
+	// PIndexes is the number of the index's planned pindexes, which
+	// is 0 until the planner has planned the index.
+	PIndexes int `json:"pindexes"`
+
+	Replicas IndexReplicaStatus `json:"replicas"`
+
+	Build *IndexBuildProgress `json:"build,omitempty"`
+
+	Ingest IndexIngestStatus `json:"ingest"`
+
+	// Nodes is the placement of the index's pindexes, keyed by node
+	// UUID.
+	Nodes map[string]*IndexNodeStatus `json:"nodes"`
+}
+
+// IndexReplicaStatus is whether an index's pindexes have all their
+// wanted replicas on wanted nodes.
+type IndexReplicaStatus struct {
+	Satisfied bool `json:"satisfied"`
+
+	// UnderReplicated are the pindexes with fewer than NumReplicas+1
+	// nodes that are wanted, sorted.
+	UnderReplicated []string `json:"underReplicated,omitempty"`
+}
+
+// IndexIngestStatus is the ingest health of an index on a node.
+type IndexIngestStatus struct {
+	Healthy bool `json:"healthy"`
+
+	Feeds int `json:"feeds"` // The index's feeds running on this node.
+
+	// MissingPIndexes are the pindexes planned to this node that
+	// aren't running yet, sorted.
+	MissingPIndexes []string `json:"missingPIndexes,omitempty"`
+
+	// ReadOnlyPIndexes are the pindexes whose writes are disabled on
+	// some node, such as by a pindex's write circuit breaker, sorted.
+	ReadOnlyPIndexes []string `json:"readOnlyPIndexes,omitempty"`
+
+	Limit *IngestLimitStatus `json:"limit,omitempty"`
+
+	// Paused is whether the node's feeds are paused by its memory
+	// quota.
+	Paused bool `json:"paused,omitempty"`
+}
+
+// IndexNodeStatus is the placement of an index's pindexes on a node.
+type IndexNodeStatus struct {
+	HostPort string   `json:"hostPort,omitempty"`
+	Primary  []string `json:"primary"` // Pindex names, sorted.
+	Replica  []string `json:"replica"` // Pindex names, sorted.
+}
+
+// ListIndexStatus returns the rollup status of every index, sorted by
+// index name.
+func (mgr *Manager) ListIndexStatus() ([]*IndexStatus, error) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, fmt.Errorf("index_status: could not get"+
+			" indexDefs, err: %v", err)
+	}
+
+	nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_WANTED)
+	if err != nil {
+		return nil, fmt.Errorf("index_status: could not get"+
+			" nodeDefs, err: %v", err)
+	}
+
+	_, planPIndexesByName, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, fmt.Errorf("index_status: could not get"+
+			" planPIndexes, err: %v", err)
+	}
+
+	// A failed build progress only leaves out the builds.
+	builds, err := mgr.IndexBuildProgress()
+	if err != nil {
+		mgr.log.Warnf("index_status: IndexBuildProgress, err: %v", err)
+	}
+
+	feeds, pindexes := mgr.CurrentMaps()
+
+	feedCounts := map[string]int{} // Keyed by index name.
+	for _, feed := range feeds {
+		feedCounts[feed.IndexName()]++
+	}
+
+	paused := mgr.MemoryQuotaStatus().Paused
+
+	rv := make([]*IndexStatus, 0, len(indexDefsByName))
+
+	for indexName, indexDef := range indexDefsByName {
+		s := &IndexStatus{
+			Name:        indexDef.Name,
+			UUID:        indexDef.UUID,
+			Type:        indexDef.Type,
+			SourceType:  indexDef.SourceType,
+			SourceName:  indexDef.SourceName,
+			NumReplicas: indexDef.PlanParams.NumReplicas,
+			PlanFrozen:  indexDef.PlanParams.PlanFrozen,
+			Replicas:    IndexReplicaStatus{Satisfied: true},
+			Build:       builds[indexName],
+			Ingest: IndexIngestStatus{
+				Feeds:  feedCounts[indexName],
+				Limit:  mgr.IngestLimitStatus(indexName),
+				Paused: paused,
+			},
+			Nodes: map[string]*IndexNodeStatus{},
+		}
+
+		for _, planPIndex := range planPIndexesByName[indexName] {
+			if planPIndex.IndexUUID != indexDef.UUID {
+				continue // Not yet replanned since an update.
+			}
+
+			s.PIndexes++
+
+			wanted, readOnly := 0, false
+			for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+				n := s.Nodes[nodeUUID]
+				if n == nil {
+					n = &IndexNodeStatus{Primary: []string{}, Replica: []string{}}
+					if nodeDefs != nil && nodeDefs.NodeDefs[nodeUUID] != nil {
+						n.HostPort = nodeDefs.NodeDefs[nodeUUID].HostPort
+					}
+					s.Nodes[nodeUUID] = n
+				}
+				if planPIndexNode.Priority <= 0 {
+					n.Primary = append(n.Primary, planPIndex.Name)
+				} else {
+					n.Replica = append(n.Replica, planPIndex.Name)
+				}
+
+				if nodeDefs != nil && nodeDefs.NodeDefs[nodeUUID] != nil {
+					wanted++
+				}
+				if !planPIndexNode.CanWrite {
+					readOnly = true
+				}
+			}
+
+			if wanted < indexDef.PlanParams.NumReplicas+1 {
+				s.Replicas.Satisfied = false
+				s.Replicas.UnderReplicated =
+					append(s.Replicas.UnderReplicated, planPIndex.Name)
+			}
+			if readOnly {
+				s.Ingest.ReadOnlyPIndexes =
+					append(s.Ingest.ReadOnlyPIndexes, planPIndex.Name)
+			}
+			if planPIndex.Nodes[mgr.uuid] != nil &&
+				pindexes[planPIndex.Name] == nil {
+				s.Ingest.MissingPIndexes =
+					append(s.Ingest.MissingPIndexes, planPIndex.Name)
+			}
+		}
+
+		if s.PIndexes <= 0 {
+			s.Replicas.Satisfied = false
+		}
+
+		sort.Strings(s.Replicas.UnderReplicated)
+		sort.Strings(s.Ingest.MissingPIndexes)
+		sort.Strings(s.Ingest.ReadOnlyPIndexes)
+		for _, n := range s.Nodes {
+			sort.Strings(n.Primary)
+			sort.Strings(n.Replica)
+		}
+
+		s.Ingest.Healthy = !paused &&
+			len(s.Ingest.MissingPIndexes) <= 0 &&
+			len(s.Ingest.ReadOnlyPIndexes) <= 0
+
+		rv = append(rv, s)
+	}
+
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+
+	return rv, nil
+}
@@ -0,0 +1,114 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestListIndexStatus(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), []string{"pindex"},
+		"", 1, "", "localhost:1000", emptyDir, "", nil, nil)
+	defer mgr.Stop()
+
+	nodeDefs := NewNodeDefs(Version)
+	for _, uuid := range []string{mgr.UUID(), "n2"} {
+		nodeDefs.NodeDefs[uuid] = &NodeDef{UUID: uuid, HostPort: uuid + ":1000"}
+	}
+	_, err := CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, CFG_CAS_FORCE)
+	if err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["a"] = &IndexDef{Name: "a", UUID: "ua",
+		Type: "blackhole", SourceType: "nil",
+		PlanParams: PlanParams{NumReplicas: 1}}
+	indexDefs.IndexDefs["b"] = &IndexDef{Name: "b", UUID: "ub",
+		Type: "blackhole", SourceType: "nil"}
+	_, err = CfgSetIndexDefs(cfg, indexDefs, CFG_CAS_FORCE)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	planPIndexes := NewPlanPIndexes(Version)
+	planPIndexes.PlanPIndexes["p0"] = &PlanPIndex{
+		Name: "p0", IndexName: "a", IndexUUID: "ua",
+		Nodes: map[string]*PlanPIndexNode{
+			mgr.UUID(): {CanRead: true, CanWrite: true, Priority: 0},
+			"n2":       {CanRead: true, CanWrite: true, Priority: 1},
+		},
+	}
+	planPIndexes.PlanPIndexes["p1"] = &PlanPIndex{
+		Name: "p1", IndexName: "a", IndexUUID: "ua",
+		Nodes: map[string]*PlanPIndexNode{
+			"n2":   {CanRead: true, CanWrite: false, Priority: 0},
+			"gone": {CanRead: true, CanWrite: true, Priority: 1},
+		},
+	}
+	planPIndexes.PlanPIndexes["stale"] = &PlanPIndex{
+		Name: "stale", IndexName: "a", IndexUUID: "old",
+		Nodes: map[string]*PlanPIndexNode{
+			"n2": {CanRead: true, CanWrite: true},
+		},
+	}
+	_, err = CfgSetPlanPIndexes(cfg, planPIndexes, CFG_CAS_FORCE)
+	if err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+
+	statuses, err := mgr.ListIndexStatus()
+	if err != nil {
+		t.Fatalf("expected ListIndexStatus to work, err: %v", err)
+	}
+	if len(statuses) != 2 || statuses[0].Name != "a" || statuses[1].Name != "b" {
+		t.Fatalf("expected the sorted indexes, got: %+v", statuses)
+	}
+
+	a := statuses[0]
+	if a.PIndexes != 2 || a.NumReplicas != 1 || a.Type != "blackhole" {
+		t.Errorf("unexpected summary: %+v", a)
+	}
+	if !reflect.DeepEqual(a.Replicas, IndexReplicaStatus{
+		UnderReplicated: []string{"p1"},
+	}) {
+		t.Errorf("unexpected replicas: %+v", a.Replicas)
+	}
+	if a.Ingest.Healthy ||
+		!reflect.DeepEqual(a.Ingest.MissingPIndexes, []string{"p0"}) ||
+		!reflect.DeepEqual(a.Ingest.ReadOnlyPIndexes, []string{"p1"}) {
+		t.Errorf("unexpected ingest: %+v", a.Ingest)
+	}
+	expNodes := map[string]*IndexNodeStatus{
+		mgr.UUID(): {HostPort: mgr.UUID() + ":1000",
+			Primary: []string{"p0"}, Replica: []string{}},
+		"n2": {HostPort: "n2:1000",
+			Primary: []string{"p1"}, Replica: []string{"p0"}},
+		"gone": {Primary: []string{}, Replica: []string{"p1"}},
+	}
+	if !reflect.DeepEqual(a.Nodes, expNodes) {
+		t.Errorf("expected nodes: %+v, got: %+v", expNodes, a.Nodes)
+	}
+
+	b := statuses[1]
+	if b.PIndexes != 0 || b.Replicas.Satisfied || !b.Ingest.Healthy ||
+		len(b.Nodes) != 0 {
+		t.Errorf("expected an unplanned index, got: %+v", b)
+	}
+}
@@ -0,0 +1,492 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+// INDEX_TEMPLATES_KEY is the Cfg key of the IndexTemplates.
+const INDEX_TEMPLATES_KEY = "indexTemplates"
+
+// INDEX_TEMPLATE_MAX_DEPTH bounds the chain of a template's parents.
+const INDEX_TEMPLATE_MAX_DEPTH = 10
+
+// IndexTemplates holds the named IndexTemplates of a cluster.
+type IndexTemplates struct {
+	UUID      string                    `json:"uuid"`
+	Templates map[string]*IndexTemplate `json:"templates"` // Keyed by name.
+}
+
+// An IndexTemplate holds the default planParams and sourceParams, as
+// JSON object fragments, of the index definitions that reference it
+// via their PlanParams.IndexTemplate.  A template may inherit from a
+// Parent template, whose values it overrides.  The values of an index
+// definition override those of its template, where nested objects are
+// merged.
+type IndexTemplate struct {
+	Name         string                 `json:"name"`
+	UUID         string                 `json:"uuid"` // Like a revision id.
+	Parent       string                 `json:"parent,omitempty"`
+	PlanParams   map[string]interface{} `json:"planParams,omitempty"`
+	SourceParams map[string]interface{} `json:"sourceParams,omitempty"`
+}
+
+// CfgGetIndexTemplates retrieves the IndexTemplates from a Cfg.
+func CfgGetIndexTemplates(cfg Cfg) (*IndexTemplates, uint64, error) {
+	v, cas, err := cfg.Get(INDEX_TEMPLATES_KEY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &IndexTemplates{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetIndexTemplates updates the IndexTemplates in a Cfg.
+func CfgSetIndexTemplates(cfg Cfg, t *IndexTemplates, cas uint64) (
+	uint64, error) {
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(INDEX_TEMPLATES_KEY, buf, cas)
+}
+
+// ---------------------------------------------------------
+
+// A ResolvedIndexTemplate holds the inherited values of a template.
+type ResolvedIndexTemplate struct {
+	Chain        []string               `json:"chain"` // Root first.
+	PlanParams   map[string]interface{} `json:"planParams"`
+	SourceParams map[string]interface{} `json:"sourceParams"`
+}
+
+// ResolveIndexTemplate merges the values of a template with those of
+// its parents.
+func ResolveIndexTemplate(templates *IndexTemplates,
+	name string) (*ResolvedIndexTemplate, error) {
+	var chain []*IndexTemplate
+	seen := map[string]bool{}
+	for n := name; n != ""; {
+		if seen[n] {
+			return nil, fmt.Errorf("index_templates: cyclic parents,"+
+				" template: %s", name)
+		}
+		if len(chain) >= INDEX_TEMPLATE_MAX_DEPTH {
+			return nil, fmt.Errorf("index_templates: too many parents,"+
+				" template: %s", name)
+		}
+		seen[n] = true
+
+		var t *IndexTemplate
+		if templates != nil {
+			t = templates.Templates[n]
+		}
+		if t == nil {
+			return nil, fmt.Errorf("index_templates: no template: %s", n)
+		}
+		chain = append(chain, t)
+		n = t.Parent
+	}
+
+	rv := &ResolvedIndexTemplate{
+		PlanParams:   map[string]interface{}{},
+		SourceParams: map[string]interface{}{},
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		rv.Chain = append(rv.Chain, chain[i].Name)
+		rv.PlanParams = mergeJSONObjects(rv.PlanParams, chain[i].PlanParams)
+		rv.SourceParams = mergeJSONObjects(rv.SourceParams,
+			chain[i].SourceParams)
+	}
+	return rv, nil
+}
+
+// applyIndexTemplate returns the planParams and the sourceParams of
+// an index definition, with the defaults of its IndexTemplate, if
+// any, filled in from the Cfg.
+func applyIndexTemplate(cfg Cfg, planParams PlanParams,
+	sourceParams string) (PlanParams, string, error) {
+	if planParams.IndexTemplate == "" {
+		return planParams, sourceParams, nil
+	}
+
+	templates, _, err := CfgGetIndexTemplates(cfg)
+	if err != nil {
+		return planParams, sourceParams, err
+	}
+
+	resolved, err := ResolveIndexTemplate(templates, planParams.IndexTemplate)
+	if err != nil {
+		return planParams, sourceParams, err
+	}
+
+	pp, err := planParamsToJSONObject(planParams)
+	if err != nil {
+		return planParams, sourceParams, err
+	}
+	sp, err := sourceParamsToJSONObject(sourceParams)
+	if err != nil {
+		return planParams, sourceParams, err
+	}
+
+	return jsonObjectsToParams(mergeJSONObjects(resolved.PlanParams, pp),
+		mergeJSONObjects(resolved.SourceParams, sp), sourceParams)
+}
+
+// ---------------------------------------------------------
+
+// GetIndexTemplates returns the IndexTemplates from the Cfg.
+func (mgr *Manager) GetIndexTemplates() (*IndexTemplates, error) {
+	templates, _, err := CfgGetIndexTemplates(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if templates == nil {
+		templates = &IndexTemplates{Templates: map[string]*IndexTemplate{}}
+	}
+	return templates, nil
+}
+
+// UpdateIndexTemplate creates or updates a template.  With roll, the
+// change is also applied to the index definitions that derive from
+// the template, directly or via its children, where the values that
+// an index overrode are kept.  The names of the updated index
+// definitions are returned.
+func (mgr *Manager) UpdateIndexTemplate(template *IndexTemplate,
+	roll bool) ([]string, error) {
+	matched, err := regexp.MatchString(INDEX_NAME_REGEXP, template.Name)
+	if err != nil || !matched {
+		return nil, fmt.Errorf("index_templates: invalid name: %q",
+			template.Name)
+	}
+	if _, exists := template.PlanParams["indexTemplate"]; exists {
+		return nil, fmt.Errorf("index_templates: planParams may not"+
+			" reference a template, template: %s", template.Name)
+	}
+	if _, _, err = jsonObjectsToParams(template.PlanParams, nil, ""); err != nil {
+		return nil, fmt.Errorf("index_templates: invalid planParams,"+
+			" template: %s, err: %v", template.Name, err)
+	}
+
+	var prev *IndexTemplates
+
+	for tries := 0; ; tries++ {
+		if tries >= 100 {
+			return nil, fmt.Errorf("index_templates: could not save" +
+				" template, too many tries")
+		}
+
+		templates, cas, err := CfgGetIndexTemplates(mgr.cfg)
+		if err != nil {
+			return nil, err
+		}
+		if templates == nil {
+			templates = &IndexTemplates{}
+		}
+
+		next := &IndexTemplates{
+			UUID:      NewUUID(),
+			Templates: map[string]*IndexTemplate{},
+		}
+		for name, t := range templates.Templates {
+			next.Templates[name] = t
+		}
+		t := *template
+		t.UUID = next.UUID
+		next.Templates[t.Name] = &t
+
+		// Catch a missing parent or a cycle before saving.
+		_, err = ResolveIndexTemplate(next, t.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = CfgSetIndexTemplates(mgr.cfg, next, cas)
+		if err == nil {
+			prev = templates
+			break
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			return nil, err
+		}
+	}
+
+	mgr.log.Printf("index_templates: template updated, name: %s, roll: %t",
+		template.Name, roll)
+
+	if !roll {
+		return nil, nil
+	}
+
+	return mgr.rollIndexTemplate(template.Name, prev)
+}
+
+// rollIndexTemplate updates the index definitions that derive from a
+// template, from the values of the previous templates to the current.
+func (mgr *Manager) rollIndexTemplate(name string,
+	prev *IndexTemplates) ([]string, error) {
+	templates, _, err := CfgGetIndexTemplates(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil || indexDefs == nil {
+		return nil, err
+	}
+
+	var indexNames []string
+	for indexName := range indexDefs.IndexDefs {
+		indexNames = append(indexNames, indexName)
+	}
+	sort.Strings(indexNames)
+
+	var rolled []string
+
+	for _, indexName := range indexNames {
+		indexDef := indexDefs.IndexDefs[indexName]
+		if indexDef.PlanParams.IndexTemplate == "" {
+			continue
+		}
+
+		curr, err := ResolveIndexTemplate(templates,
+			indexDef.PlanParams.IndexTemplate)
+		if err != nil ||
+			len(StringsIntersectStrings(curr.Chain, []string{name})) == 0 {
+			continue
+		}
+
+		// A template that's new to the index's chain had no values.
+		old, err := ResolveIndexTemplate(prev,
+			indexDef.PlanParams.IndexTemplate)
+		if err != nil {
+			old = &ResolvedIndexTemplate{}
+		}
+
+		pp, err := planParamsToJSONObject(indexDef.PlanParams)
+		if err != nil {
+			return rolled, err
+		}
+		sp, err := sourceParamsToJSONObject(indexDef.SourceParams)
+		if err != nil {
+			return rolled, err
+		}
+
+		planParams, sourceParams, err := jsonObjectsToParams(
+			rollJSONObject(pp, old.PlanParams, curr.PlanParams),
+			rollJSONObject(sp, old.SourceParams, curr.SourceParams),
+			indexDef.SourceParams)
+		if err != nil {
+			return rolled, err
+		}
+
+		if reflect.DeepEqual(planParams, indexDef.PlanParams) &&
+			sourceParams == indexDef.SourceParams {
+			continue
+		}
+
+		_, err = mgr.CreateIndexEx(indexDef.SourceType, indexDef.SourceName,
+			indexDef.SourceUUID, sourceParams, indexDef.Type, indexDef.Name,
+			indexDef.Params, planParams, indexDef.UUID)
+		if err != nil {
+			return rolled, fmt.Errorf("index_templates: could not roll"+
+				" template: %s, to index: %s, err: %v", name, indexName, err)
+		}
+
+		rolled = append(rolled, indexName)
+	}
+
+	return rolled, nil
+}
+
+// DeleteIndexTemplate deletes a template that no index definition nor
+// other template references.
+func (mgr *Manager) DeleteIndexTemplate(name string) error {
+	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return err
+	}
+	if indexDefs != nil {
+		for indexName, indexDef := range indexDefs.IndexDefs {
+			if indexDef.PlanParams.IndexTemplate == name {
+				return fmt.Errorf("index_templates: template: %s,"+
+					" is referenced by index: %s", name, indexName)
+			}
+		}
+	}
+
+	for tries := 0; tries < 100; tries++ {
+		templates, cas, err := CfgGetIndexTemplates(mgr.cfg)
+		if err != nil {
+			return err
+		}
+		if templates == nil || templates.Templates[name] == nil {
+			return fmt.Errorf("index_templates: no template: %s", name)
+		}
+
+		next := &IndexTemplates{
+			UUID:      NewUUID(),
+			Templates: map[string]*IndexTemplate{},
+		}
+		for n, t := range templates.Templates {
+			if t.Parent == name {
+				return fmt.Errorf("index_templates: template: %s,"+
+					" is the parent of template: %s", name, n)
+			}
+			if n != name {
+				next.Templates[n] = t
+			}
+		}
+
+		_, err = CfgSetIndexTemplates(mgr.cfg, next, cas)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			return err
+		}
+	}
+
+	return fmt.Errorf("index_templates: could not delete template," +
+		" too many tries")
+}
+
+// ---------------------------------------------------------
+
+func planParamsToJSONObject(planParams PlanParams) (
+	map[string]interface{}, error) {
+	buf, err := json.Marshal(planParams)
+	if err != nil {
+		return nil, err
+	}
+	rv := map[string]interface{}{}
+	err = json.Unmarshal(buf, &rv)
+	return rv, err
+}
+
+func sourceParamsToJSONObject(sourceParams string) (
+	map[string]interface{}, error) {
+	rv := map[string]interface{}{}
+	if sourceParams == "" {
+		return rv, nil
+	}
+	err := json.Unmarshal([]byte(sourceParams), &rv)
+	if err != nil {
+		return nil, fmt.Errorf("index_templates: sourceParams is not"+
+			" a JSON object, err: %v", err)
+	}
+	return rv, nil
+}
+
+// jsonObjectsToParams converts the merged JSON objects back, where an
+// empty sourceParams object keeps the original sourceParams.
+func jsonObjectsToParams(pp, sp map[string]interface{},
+	sourceParamsOrig string) (PlanParams, string, error) {
+	var planParams PlanParams
+
+	buf, err := json.Marshal(pp)
+	if err != nil {
+		return planParams, sourceParamsOrig, err
+	}
+	err = json.Unmarshal(buf, &planParams)
+	if err != nil {
+		return planParams, sourceParamsOrig, err
+	}
+
+	if len(sp) == 0 {
+		return planParams, sourceParamsOrig, nil
+	}
+
+	buf, err = json.Marshal(sp)
+	if err != nil {
+		return planParams, sourceParamsOrig, err
+	}
+
+	return planParams, string(buf), nil
+}
+
+// mergeJSONObjects returns a copy of a, overridden by the values of b,
+// where the nested objects are merged.
+func mergeJSONObjects(a, b map[string]interface{}) map[string]interface{} {
+	rv := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		rv[k] = v
+	}
+	for k, v := range b {
+		am, aok := rv[k].(map[string]interface{})
+		bm, bok := v.(map[string]interface{})
+		if aok && bok {
+			rv[k] = mergeJSONObjects(am, bm)
+		} else {
+			rv[k] = v
+		}
+	}
+	return rv
+}
+
+// rollJSONObject applies the change from the old to the new values of
+// a template to the current values of an index, where a value that
+// the index overrode, as it differs from the old value, is kept.
+func rollJSONObject(curr, old, new map[string]interface{}) map[string]interface{} {
+	rv := make(map[string]interface{}, len(curr))
+	for k, v := range curr {
+		rv[k] = v
+	}
+
+	keys := map[string]bool{}
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range new {
+		keys[k] = true
+	}
+
+	for k := range keys {
+		ov, oin := old[k]
+		nv, nin := new[k]
+		if oin == nin && reflect.DeepEqual(ov, nv) {
+			continue
+		}
+
+		cv, cin := curr[k]
+
+		cm, cok := cv.(map[string]interface{})
+		om, ook := ov.(map[string]interface{})
+		nm, nok := nv.(map[string]interface{})
+		if cok && ook && nok {
+			rv[k] = rollJSONObject(cm, om, nm)
+			continue
+		}
+
+		if (!oin && !cin) || (oin && cin && reflect.DeepEqual(cv, ov)) {
+			if nin {
+				rv[k] = nv
+			} else {
+				delete(rv, k)
+			}
+		}
+	}
+
+	return rv
+}
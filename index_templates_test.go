@@ -0,0 +1,163 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestIndexTemplates(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), []string{"pindex"}, "",
+		1, "", ":1000", emptyDir, "some-datasource", nil, nil)
+	if err := mgr.Register("wanted"); err != nil {
+		t.Fatalf("expected Register to work, err: %v", err)
+	}
+
+	_, err := mgr.UpdateIndexTemplate(&IndexTemplate{
+		Name: "base",
+		PlanParams: map[string]interface{}{
+			"maxPartitionsPerPIndex": 4,
+			"sourceUUIDChangePolicy": "pause",
+		},
+		SourceParams: map[string]interface{}{
+			"numPartitions": 8,
+			"opts":          map[string]interface{}{"a": 1, "b": 2},
+		},
+	}, false)
+	if err != nil {
+		t.Fatalf("expected UpdateIndexTemplate to work, err: %v", err)
+	}
+	_, err = mgr.UpdateIndexTemplate(&IndexTemplate{
+		Name:       "child",
+		Parent:     "base",
+		PlanParams: map[string]interface{}{"maxPartitionsPerPIndex": 2},
+	}, false)
+	if err != nil {
+		t.Fatalf("expected UpdateIndexTemplate to work, err: %v", err)
+	}
+
+	err = mgr.CreateIndex("primary", "default", "", `{"opts":{"b":3}}`,
+		"blackhole", "i0", "", PlanParams{IndexTemplate: "child"}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex to work, err: %v", err)
+	}
+	err = mgr.CreateIndex("primary", "default", "", "",
+		"blackhole", "i1", "", PlanParams{IndexTemplate: "child",
+			MaxPartitionsPerPIndex: 5}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex to work, err: %v", err)
+	}
+	err = mgr.CreateIndex("primary", "default", "", "",
+		"blackhole", "i2", "", PlanParams{IndexTemplate: "missing"}, "")
+	if err == nil {
+		t.Errorf("expected CreateIndex to fail on a missing template")
+	}
+
+	check := func(indexName string, maxPartitions int, policy string,
+		sourceParams map[string]interface{}) {
+		indexDefs, _, _ := CfgGetIndexDefs(cfg)
+		indexDef := indexDefs.IndexDefs[indexName]
+		if indexDef.PlanParams.MaxPartitionsPerPIndex != maxPartitions ||
+			indexDef.PlanParams.SourceUUIDChangePolicy != policy {
+			t.Errorf("index: %s, unexpected planParams: %+v",
+				indexName, indexDef.PlanParams)
+		}
+		var sp map[string]interface{}
+		json.Unmarshal([]byte(indexDef.SourceParams), &sp)
+		exp, _ := json.Marshal(sourceParams)
+		var expSP map[string]interface{}
+		json.Unmarshal(exp, &expSP)
+		if !reflect.DeepEqual(sp, expSP) {
+			t.Errorf("index: %s, expected sourceParams: %v, got: %v",
+				indexName, expSP, sp)
+		}
+	}
+
+	opts := func(b int) map[string]interface{} {
+		return map[string]interface{}{"a": 1, "b": b}
+	}
+
+	check("i0", 2, "pause",
+		map[string]interface{}{"numPartitions": 8, "opts": opts(3)})
+	check("i1", 5, "pause",
+		map[string]interface{}{"numPartitions": 8, "opts": opts(2)})
+
+	// Roll a change of the parent to both derived indexes.
+	rolled, err := mgr.UpdateIndexTemplate(&IndexTemplate{
+		Name: "base",
+		PlanParams: map[string]interface{}{
+			"maxPartitionsPerPIndex": 4,
+			"sourceUUIDChangePolicy": "readOnly",
+		},
+		SourceParams: map[string]interface{}{
+			"numPartitions": 16,
+			"opts":          map[string]interface{}{"a": 1, "b": 4},
+		},
+	}, true)
+	if err != nil || !reflect.DeepEqual(rolled, []string{"i0", "i1"}) {
+		t.Fatalf("expected a roll to i0 and i1, got: %v, err: %v",
+			rolled, err)
+	}
+
+	check("i0", 2, "readOnly",
+		map[string]interface{}{"numPartitions": 16, "opts": opts(3)})
+	check("i1", 5, "readOnly",
+		map[string]interface{}{"numPartitions": 16, "opts": opts(4)})
+
+	// The index that overrode the changed value keeps its own.
+	rolled, err = mgr.UpdateIndexTemplate(&IndexTemplate{
+		Name:       "child",
+		Parent:     "base",
+		PlanParams: map[string]interface{}{"maxPartitionsPerPIndex": 3},
+	}, true)
+	if err != nil || !reflect.DeepEqual(rolled, []string{"i0"}) {
+		t.Fatalf("expected a roll to i0 only, got: %v, err: %v",
+			rolled, err)
+	}
+	check("i0", 3, "readOnly",
+		map[string]interface{}{"numPartitions": 16, "opts": opts(3)})
+	check("i1", 5, "readOnly",
+		map[string]interface{}{"numPartitions": 16, "opts": opts(4)})
+
+	_, err = mgr.UpdateIndexTemplate(&IndexTemplate{
+		Name: "base", Parent: "child"}, false)
+	if err == nil {
+		t.Errorf("expected an error for cyclic parents")
+	}
+
+	if mgr.DeleteIndexTemplate("base") == nil {
+		t.Errorf("expected an error deleting a parent template")
+	}
+	if mgr.DeleteIndexTemplate("child") == nil {
+		t.Errorf("expected an error deleting a referenced template")
+	}
+
+	_, err = mgr.UpdateIndexTemplate(&IndexTemplate{Name: "unused"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mgr.DeleteIndexTemplate("unused"); err != nil {
+		t.Errorf("expected DeleteIndexTemplate to work, err: %v", err)
+	}
+	templates, _ := mgr.GetIndexTemplates()
+	if len(templates.Templates) != 2 {
+		t.Errorf("expected 2 templates, got: %+v", templates.Templates)
+	}
+}
@@ -0,0 +1,245 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// CFG_DATA_KEY is the ConfigMap data entry that holds the Cfg.
+const CFG_DATA_KEY = "cfg"
+
+// CfgConfigMap is an implementation of the cbgt.Cfg interface that
+// stores all Cfg entries in a single Kubernetes ConfigMap, in the
+// same format as cbgt.CfgSimple.  Concurrent updates from different
+// nodes are serialized with optimistic concurrency on the ConfigMap's
+// resourceVersion, while the per-key CAS semantics are the same as
+// cbgt.CfgMem.
+type CfgConfigMap struct {
+	client    *Client
+	namespace string
+	name      string
+
+	m               sync.Mutex
+	resourceVersion string
+	cfgMem          *cbgt.CfgMem
+}
+
+// NewCfgConfigMap returns a CfgConfigMap that's backed by the named
+// ConfigMap, which is created on the first Set() if needed.
+func NewCfgConfigMap(client *Client, namespace, name string) *CfgConfigMap {
+	return &CfgConfigMap{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		cfgMem:    cbgt.NewCfgMem(),
+	}
+}
+
+func (c *CfgConfigMap) Get(key string, cas uint64) (
+	[]byte, uint64, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.cfgMem.Get(key, cas)
+}
+
+func (c *CfgConfigMap) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	return c.update(key, func(cfgMem *cbgt.CfgMem) (uint64, error) {
+		return cfgMem.Set(key, val, cas)
+	})
+}
+
+func (c *CfgConfigMap) Del(key string, cas uint64) error {
+	_, err := c.update(key, func(cfgMem *cbgt.CfgMem) (uint64, error) {
+		return 0, cfgMem.Del(key, cas)
+	})
+	return err
+}
+
+func (c *CfgConfigMap) Subscribe(key string, ch chan cbgt.CfgEvent) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.cfgMem.Subscribe(key, ch)
+}
+
+func (c *CfgConfigMap) Ping(key string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.cfgMem.Ping(key)
+}
+
+func (c *CfgConfigMap) Refresh() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	_, err := c.unlockedLoad()
+	if err != nil {
+		return err
+	}
+
+	return c.cfgMem.Refresh()
+}
+
+// Load reads the ConfigMap, without firing any events.
+func (c *CfgConfigMap) Load() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	_, err := c.unlockedLoad()
+	return err
+}
+
+// RefreshLoop polls the ConfigMap for changes made by other nodes
+// and notifies subscribers, until the stopCh is closed.
+func (c *CfgConfigMap) RefreshLoop(interval time.Duration,
+	stopCh chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			c.m.Lock()
+			changed, err := c.unlockedLoad()
+			if err == nil && changed {
+				c.cfgMem.Refresh()
+			}
+			c.m.Unlock()
+		}
+	}
+}
+
+// update applies a change of a key to a copy of the latest Cfg and
+// saves it, retrying when another node concurrently updated the
+// ConfigMap.  Only a saved change is visible to Get() and fires an
+// event to the key's subscribers.
+func (c *CfgConfigMap) update(key string,
+	cb func(cfgMem *cbgt.CfgMem) (uint64, error)) (uint64, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for tries := 0; tries < 100; tries++ {
+		_, err := c.unlockedLoad()
+		if err != nil {
+			return 0, err
+		}
+
+		// The copy has no subscriptions, so the callback fires no
+		// events, and its entries are replaced rather than modified.
+		next := cbgt.NewCfgMem()
+		next.CASNext = c.cfgMem.CASNext
+		for k, entry := range c.cfgMem.Entries {
+			next.Entries[k] = entry
+		}
+
+		cas, err := cb(next)
+		if err != nil {
+			return 0, err
+		}
+
+		err = c.unlockedSave(next)
+		if err != nil {
+			if IsConflict(err) {
+				continue // Another node won, so retry on its update.
+			}
+			return 0, err
+		}
+
+		c.cfgMem.CASNext = next.CASNext
+		c.cfgMem.Entries = next.Entries
+		c.cfgMem.FireEvent(key, cas, nil)
+
+		return cas, nil
+	}
+
+	return 0, fmt.Errorf("k8s: cfg update, too many conflicts,"+
+		" configmap: %s/%s", c.namespace, c.name)
+}
+
+// unlockedLoad reads the ConfigMap into the cfgMem, returning true if
+// the resourceVersion changed.  A missing ConfigMap is an empty Cfg.
+func (c *CfgConfigMap) unlockedLoad() (bool, error) {
+	cm, err := c.client.GetConfigMap(c.namespace, c.name)
+	if err != nil {
+		if IsNotFound(err) {
+			changed := c.resourceVersion != ""
+			c.resourceVersion = ""
+			c.cfgMem.CASNext = 1
+			c.cfgMem.Entries = map[string]*cbgt.CfgMemEntry{}
+			return changed, nil
+		}
+		return false, err
+	}
+
+	if cm.Metadata.ResourceVersion == c.resourceVersion {
+		return false, nil
+	}
+
+	cfgMem := cbgt.NewCfgMem()
+	if buf := cm.Data[CFG_DATA_KEY]; buf != "" {
+		err = json.Unmarshal([]byte(buf), cfgMem)
+		if err != nil {
+			return false, fmt.Errorf("k8s: cfg parse, configmap: %s/%s,"+
+				" err: %v", c.namespace, c.name, err)
+		}
+	}
+
+	c.resourceVersion = cm.Metadata.ResourceVersion
+	c.cfgMem.CASNext = cfgMem.CASNext
+	c.cfgMem.Entries = cfgMem.Entries
+
+	return true, nil
+}
+
+// unlockedSave writes the cfgMem to the ConfigMap.
+func (c *CfgConfigMap) unlockedSave(cfgMem *cbgt.CfgMem) error {
+	buf, err := json.Marshal(cfgMem)
+	if err != nil {
+		return err
+	}
+
+	cm := &ConfigMap{
+		Metadata: ObjectMeta{
+			Name:            c.name,
+			Namespace:       c.namespace,
+			ResourceVersion: c.resourceVersion,
+		},
+		Data: map[string]string{CFG_DATA_KEY: string(buf)},
+	}
+
+	if c.resourceVersion == "" {
+		cm, err = c.client.CreateConfigMap(cm)
+		if IsConflict(err) {
+			c.resourceVersion = "-" // Force a reload on the retry.
+		}
+	} else {
+		cm, err = c.client.UpdateConfigMap(cm)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.resourceVersion = cm.Metadata.ResourceVersion
+
+	return nil
+}
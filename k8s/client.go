@@ -0,0 +1,231 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package k8s allows cbgt clusters to run on Kubernetes without an
+// external coordination store, by keeping the Cfg in a ConfigMap and
+// by discovering nodes from the endpoints of a headless Service.
+//
+// Only the small subset of the Kubernetes REST API that's needed is
+// implemented, so there are no client-go dependencies.
+package k8s
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Paths of the service account credentials mounted into every pod.
+const (
+	ServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	ServiceAccountCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	ServiceAccountNSPath    = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// A Client is a minimal Kubernetes API client.
+type Client struct {
+	BaseURL    string // Ex: "https://10.0.0.1:443".
+	Token      string // Bearer token, optional.
+	HTTPClient *http.Client
+}
+
+// An APIError is returned for non-2xx responses from the API server.
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("k8s: api error, status: %d, body: %s",
+		e.StatusCode, e.Body)
+}
+
+// IsConflict returns true for an optimistic concurrency failure,
+// such as a stale resourceVersion.
+func IsConflict(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusConflict
+}
+
+// IsNotFound returns true when the requested resource is missing.
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// NewInClusterClient returns a Client that uses the pod's service
+// account to talk to the API server.
+func NewInClusterClient() (*Client, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("k8s: not running in a cluster," +
+			" KUBERNETES_SERVICE_HOST/PORT are not set")
+	}
+
+	token, err := ioutil.ReadFile(ServiceAccountTokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("k8s: read token, err: %v", err)
+	}
+
+	ca, err := ioutil.ReadFile(ServiceAccountCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("k8s: read ca, err: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("k8s: could not parse ca: %s",
+			ServiceAccountCAPath)
+	}
+
+	return &Client{
+		BaseURL: "https://" + net.JoinHostPort(host, port),
+		Token:   strings.TrimSpace(string(token)),
+		HTTPClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// InClusterNamespace returns the namespace of the pod's service
+// account, or "default".
+func InClusterNamespace() string {
+	ns, err := ioutil.ReadFile(ServiceAccountNSPath)
+	if err != nil || len(bytes.TrimSpace(ns)) <= 0 {
+		return "default"
+	}
+	return string(bytes.TrimSpace(ns))
+}
+
+// Do sends a request with an optional JSON body and decodes an
+// optional JSON response into out.
+func (c *Client) Do(method, path string, body, out interface{}) error {
+	var reqBody *bytes.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(buf)
+	} else {
+		reqBody = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &APIError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+
+	return nil
+}
+
+// ObjectMeta is the subset of the Kubernetes object metadata used
+// by this package.
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// A ConfigMap holds string data.
+type ConfigMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+func configMapPath(namespace, name string) string {
+	rv := "/api/v1/namespaces/" + namespace + "/configmaps"
+	if name != "" {
+		rv = rv + "/" + name
+	}
+	return rv
+}
+
+// GetConfigMap retrieves a ConfigMap.
+func (c *Client) GetConfigMap(namespace, name string) (*ConfigMap, error) {
+	rv := &ConfigMap{}
+	err := c.Do("GET", configMapPath(namespace, name), nil, rv)
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// CreateConfigMap creates a ConfigMap, failing with a conflict if it
+// already exists.
+func (c *Client) CreateConfigMap(cm *ConfigMap) (*ConfigMap, error) {
+	cm.APIVersion, cm.Kind = "v1", "ConfigMap"
+	rv := &ConfigMap{}
+	err := c.Do("POST", configMapPath(cm.Metadata.Namespace, ""), cm, rv)
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// UpdateConfigMap replaces a ConfigMap, failing with a conflict if
+// cm.Metadata.ResourceVersion is not the current resourceVersion.
+func (c *Client) UpdateConfigMap(cm *ConfigMap) (*ConfigMap, error) {
+	cm.APIVersion, cm.Kind = "v1", "ConfigMap"
+	rv := &ConfigMap{}
+	err := c.Do("PUT",
+		configMapPath(cm.Metadata.Namespace, cm.Metadata.Name), cm, rv)
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
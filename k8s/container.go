@@ -0,0 +1,62 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"os"
+)
+
+// The well-known topology labels of Kubernetes nodes.
+const (
+	TopologyRegionLabel = "topology.kubernetes.io/region"
+	TopologyZoneLabel   = "topology.kubernetes.io/zone"
+)
+
+// ContainerProvider is a cbgt.ContainerProvider that derives
+// "region/zone" from the topology labels of the Kubernetes node that
+// the pod is scheduled on.
+type ContainerProvider struct {
+	Client *Client
+
+	// NodeName is the Kubernetes node name, which defaults to the
+	// NODE_NAME env var, such as set via the downward API's
+	// spec.nodeName.
+	NodeName string
+}
+
+func (p *ContainerProvider) Container() (string, error) {
+	nodeName := p.NodeName
+	if nodeName == "" {
+		nodeName = os.Getenv("NODE_NAME")
+	}
+	if nodeName == "" {
+		return "", fmt.Errorf("k8s: container, no node name")
+	}
+
+	var node struct {
+		Metadata ObjectMeta `json:"metadata"`
+	}
+	err := p.Client.Do("GET", "/api/v1/nodes/"+nodeName, nil, &node)
+	if err != nil {
+		return "", err
+	}
+
+	region := node.Metadata.Labels[TopologyRegionLabel]
+	zone := node.Metadata.Labels[TopologyZoneLabel]
+	if region == "" || zone == "" {
+		return "", fmt.Errorf("k8s: container, node: %s is missing"+
+			" topology labels", nodeName)
+	}
+
+	return region + "/" + zone, nil
+}
@@ -0,0 +1,167 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package k8s
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// NodeDiscovery finds the addresses of the cbgt nodes that are the
+// ready endpoints of a (usually headless) Service.
+type NodeDiscovery struct {
+	Client    *Client
+	Namespace string
+	Service   string
+	PortName  string // Optional; the first port is used when "".
+}
+
+type endpointSliceList struct {
+	Items []struct {
+		Ports []struct {
+			Name *string `json:"name"`
+			Port *int32  `json:"port"`
+		} `json:"ports"`
+		Endpoints []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+		} `json:"endpoints"`
+	} `json:"items"`
+}
+
+type endpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int32  `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// Addresses returns the sorted "host:port" addresses of the ready
+// endpoints.  EndpointSlices are used when the API server supports
+// them, otherwise the older Endpoints resource is used.
+func (d *NodeDiscovery) Addresses() ([]string, error) {
+	rv, err := d.endpointSliceAddresses()
+	if IsNotFound(err) {
+		rv, err = d.endpointsAddresses()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(rv)
+	return rv, nil
+}
+
+func (d *NodeDiscovery) endpointSliceAddresses() ([]string, error) {
+	var list endpointSliceList
+	err := d.Client.Do("GET", "/apis/discovery.k8s.io/v1/namespaces/"+
+		d.Namespace+"/endpointslices?labelSelector="+
+		url.QueryEscape("kubernetes.io/service-name="+d.Service), nil, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+	for _, item := range list.Items {
+		port := int32(-1)
+		for _, p := range item.Ports {
+			if p.Port != nil && (d.PortName == "" ||
+				(p.Name != nil && *p.Name == d.PortName)) {
+				port = *p.Port
+				break
+			}
+		}
+		if port < 0 {
+			continue
+		}
+
+		for _, endpoint := range item.Endpoints {
+			// A nil ready condition should be interpreted as ready.
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, addr := range endpoint.Addresses {
+				rv = append(rv, net.JoinHostPort(addr,
+					strconv.Itoa(int(port))))
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+func (d *NodeDiscovery) endpointsAddresses() ([]string, error) {
+	var e endpoints
+	err := d.Client.Do("GET", "/api/v1/namespaces/"+d.Namespace+
+		"/endpoints/"+d.Service, nil, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+	for _, subset := range e.Subsets {
+		port := int32(-1)
+		for _, p := range subset.Ports {
+			if d.PortName == "" || p.Name == d.PortName {
+				port = p.Port
+				break
+			}
+		}
+		if port < 0 {
+			continue
+		}
+
+		// Only the ready addresses, as NotReadyAddresses are skipped.
+		for _, addr := range subset.Addresses {
+			rv = append(rv, net.JoinHostPort(addr.IP,
+				strconv.Itoa(int(port))))
+		}
+	}
+
+	return rv, nil
+}
+
+// MissingNodeDefs returns the sorted UUIDs of the node definitions
+// whose HostPort is not among the discovered addresses, such as pods
+// that were deleted.  The result can be passed to
+// cbgt.UnregisterNodes().
+func MissingNodeDefs(nodeDefs *cbgt.NodeDefs, addrs []string) []string {
+	if nodeDefs == nil {
+		return nil
+	}
+
+	discovered := map[string]bool{}
+	for _, addr := range addrs {
+		discovered[cbgt.NormalizeHostPort(addr)] = true
+	}
+
+	var rv []string
+	for uuid, nodeDef := range nodeDefs.NodeDefs {
+		if !discovered[cbgt.NormalizeHostPort(nodeDef.HostPort)] {
+			rv = append(rv, uuid)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv
+}
@@ -0,0 +1,243 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package k8s
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// fakeAPIServer implements just enough of the ConfigMap and
+// EndpointSlice APIs for testing.
+type fakeAPIServer struct {
+	m      sync.Mutex
+	cm     *ConfigMap
+	rv     int
+	slices string
+
+	failWrites int // The number of the next writes that fail.
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	switch {
+	case r.URL.Path == "/apis/discovery.k8s.io/v1/namespaces/ns/endpointslices":
+		if s.slices == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(s.slices))
+
+	case r.URL.Path == "/api/v1/namespaces/ns/endpoints/svc":
+		w.Write([]byte(`{"subsets":[{"addresses":[{"ip":"10.0.0.9"}],` +
+			`"ports":[{"name":"http","port":8094}]}]}`))
+
+	case r.Method == "GET" && r.URL.Path == "/api/v1/namespaces/ns/configmaps/cfg":
+		if s.cm == nil {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(s.cm)
+
+	case (r.Method == "POST" || r.Method == "PUT") && s.failWrites > 0:
+		s.failWrites--
+		w.WriteHeader(http.StatusInternalServerError)
+
+	case r.Method == "POST" || r.Method == "PUT":
+		var cm ConfigMap
+		json.NewDecoder(r.Body).Decode(&cm)
+		if (r.Method == "POST" && s.cm != nil) ||
+			(r.Method == "PUT" && (s.cm == nil ||
+				cm.Metadata.ResourceVersion != s.cm.Metadata.ResourceVersion)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.rv++
+		cm.Metadata.ResourceVersion = strconv.Itoa(s.rv)
+		s.cm = &cm
+		json.NewEncoder(w).Encode(s.cm)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestCfgConfigMap(t *testing.T) {
+	fake := &fakeAPIServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := &Client{BaseURL: server.URL}
+
+	c0 := NewCfgConfigMap(client, "ns", "cfg")
+	c1 := NewCfgConfigMap(client, "ns", "cfg")
+
+	val, cas, err := c0.Get("a", 0)
+	if err != nil || val != nil || cas != 0 {
+		t.Errorf("expected empty cfg, got: %s, %d, %v", val, cas, err)
+	}
+
+	cas, err = c0.Set("a", []byte("A"), 0)
+	if err != nil {
+		t.Fatalf("expected set to work, err: %v", err)
+	}
+
+	// c1 has a stale view, but sees c0's update when it writes.
+	_, err = c1.Set("a", []byte("AA"), 0)
+	if err == nil {
+		t.Errorf("expected create of existing key to fail")
+	}
+	_, err = c1.Set("a", []byte("AA"), cas+100)
+	if _, ok := err.(*cbgt.CfgCASError); !ok {
+		t.Errorf("expected CAS error, got: %v", err)
+	}
+	cas1, err := c1.Set("a", []byte("AA"), cas)
+	if err != nil {
+		t.Fatalf("expected CAS set to work, err: %v", err)
+	}
+
+	// c0 writes a different key on top of c1's update.
+	_, err = c0.Set("b", []byte("B"), 0)
+	if err != nil {
+		t.Fatalf("expected set of b to work, err: %v", err)
+	}
+
+	ch := make(chan cbgt.CfgEvent, 10)
+	c1.Subscribe("b", ch)
+	if err = c1.Refresh(); err != nil {
+		t.Fatalf("expected refresh to work, err: %v", err)
+	}
+	if e := <-ch; e.Key != "b" {
+		t.Errorf("expected event for b, got: %#v", e)
+	}
+
+	val, cas, _ = c1.Get("a", 0)
+	if string(val) != "AA" || cas != cas1 {
+		t.Errorf("expected AA, got: %s, %d", val, cas)
+	}
+	val, _, _ = c1.Get("b", 0)
+	if string(val) != "B" {
+		t.Errorf("expected B, got: %s", val)
+	}
+
+	if err = c0.Del("a", 0); err != nil {
+		t.Errorf("expected del to work, err: %v", err)
+	}
+	c1.Load()
+	if val, _, _ = c1.Get("a", 0); val != nil {
+		t.Errorf("expected a deleted, got: %s", val)
+	}
+}
+
+func TestCfgConfigMapFailedWrite(t *testing.T) {
+	fake := &fakeAPIServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	c := NewCfgConfigMap(&Client{BaseURL: server.URL}, "ns", "cfg")
+
+	cas, err := c.Set("a", []byte("A"), 0)
+	if err != nil {
+		t.Fatalf("expected set to work, err: %v", err)
+	}
+
+	ch := make(chan cbgt.CfgEvent, 10)
+	c.Subscribe("a", ch)
+	c.Subscribe("b", ch)
+
+	fake.m.Lock()
+	fake.failWrites = 1
+	fake.m.Unlock()
+
+	if _, err = c.Set("a", []byte("X"), cas); err == nil {
+		t.Fatalf("expected a failed write")
+	}
+	if val, cas2, _ := c.Get("a", 0); string(val) != "A" || cas2 != cas {
+		t.Errorf("expected the saved A, got: %s, %d", val, cas2)
+	}
+	if err = c.Del("a", 0); err != nil {
+		t.Fatalf("expected del to work, err: %v", err)
+	}
+	if e := <-ch; e.Key != "a" || e.CAS != 0 {
+		t.Errorf("expected only the del event, got: %#v", e)
+	}
+
+	c.Load()
+	if val, _, _ := c.Get("a", 0); val != nil {
+		t.Errorf("expected a deleted, got: %s", val)
+	}
+
+	fake.m.Lock()
+	fake.failWrites = 1
+	fake.m.Unlock()
+
+	if _, err = c.Set("b", []byte("B"), 0); err == nil {
+		t.Fatalf("expected a failed write")
+	}
+	if val, _, _ := c.Get("b", 0); val != nil {
+		t.Errorf("expected the unsaved b to be invisible, got: %s", val)
+	}
+	select {
+	case e := <-ch:
+		t.Errorf("expected no event for the unsaved b, got: %#v", e)
+	default:
+	}
+}
+
+func TestNodeDiscovery(t *testing.T) {
+	fake := &fakeAPIServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	d := &NodeDiscovery{
+		Client:    &Client{BaseURL: server.URL},
+		Namespace: "ns",
+		Service:   "svc",
+		PortName:  "http",
+	}
+
+	addrs, err := d.Addresses()
+	if err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.9:8094" {
+		t.Errorf("expected endpoints fallback, got: %v, err: %v", addrs, err)
+	}
+
+	fake.slices = `{"items":[{"ports":[{"name":"grpc","port":9000},` +
+		`{"name":"http","port":8094}],"endpoints":[` +
+		`{"addresses":["10.0.0.2"],"conditions":{"ready":true}},` +
+		`{"addresses":["10.0.0.3"],"conditions":{"ready":false}},` +
+		`{"addresses":["fd00::1"],"conditions":{}}]}]}`
+
+	addrs, err = d.Addresses()
+	if err != nil || len(addrs) != 2 ||
+		addrs[0] != "10.0.0.2:8094" || addrs[1] != "[fd00::1]:8094" {
+		t.Errorf("expected ready endpointslice addrs, got: %v, err: %v",
+			addrs, err)
+	}
+
+	nodeDefs := &cbgt.NodeDefs{NodeDefs: map[string]*cbgt.NodeDef{
+		"a": {UUID: "a", HostPort: "10.0.0.2:8094"},
+		"b": {UUID: "b", HostPort: "10.0.0.3:8094"},
+		"c": {UUID: "c", HostPort: "[FD00:0::1]:8094"}, // Non-canonical.
+	}}
+	missing := MissingNodeDefs(nodeDefs, addrs)
+	if len(missing) != 1 || missing[0] != "b" {
+		t.Errorf("expected b missing, got: %v", missing)
+	}
+}
@@ -0,0 +1,527 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LOCAL_PLAN_STORE_DIR is the subdirectory of a manager's dataDir
+// where the LocalPlanStore keeps its records.
+const LOCAL_PLAN_STORE_DIR = "planPIndexes"
+
+// LOCAL_PLAN_RECORD_VERSION is the current format version of the
+// records written by a LocalPlanStore.  Records written before
+// records were versioned hold just the PlanPIndexes JSON, and are
+// treated as version 0.
+const LOCAL_PLAN_RECORD_VERSION = 1
+
+// DEFAULT_LOCAL_PLAN_STORE_RETENTION is the number of stable plans
+// that a manager keeps on its local disk, which may be overridden by
+// the "localPlanStoreRetention" manager option.
+const DEFAULT_LOCAL_PLAN_STORE_RETENTION = 5
+
+// localPlanRecordPrefix is the file name prefix of plan records.
+const localPlanRecordPrefix = "recoveryPlan-"
+
+// localPlanCorruptPrefix is prepended to the file name of a record
+// that failed a Scrub(), which keeps it for inspection while it's no
+// longer a record.
+const localPlanCorruptPrefix = "corrupt-"
+
+// A LocalPlanStore persists recent, stable plans on a node's local
+// disk, such as for a failover-recovery, or so that a janitor can
+// make progress on startup while the Cfg is temporarily unreachable.
+//
+// Each record is a file named "recoveryPlan-$timeMS-$hashName-$hash",
+// where the hash is a checksum of the file's contents which is
+// verified on reads, by the PlanHash of the hashName, which is the
+// DEFAULT_PLAN_HASH unless changed with SetHash().  The records of
+// older versions, and the records of the "md5" PlanHash, are named
+// "recoveryPlan-$timeMS-$md5" instead.  Records that fail
+// verification are skipped in favor of the next most recent record,
+// and are quarantined by a Scrub().  Only the most recent Retention
+// records are kept, where a plan that's the same as the latest
+// record's plan isn't stored again.
+//
+// The timeMS is a hybrid time, which is after the timeMS of all the
+// existing records, so that the most recent record is found even when
+// the node's clock stepped backwards.  See NextHybridTime().
+type LocalPlanStore struct {
+	dir       string
+	retention int
+	log       Log
+
+	m        sync.RWMutex // Serializes the access to the records.
+	hashName string       // For the new records.
+
+	cacheM     sync.Mutex  // Protects the fields that follow.
+	cacheInfo  os.FileInfo // File of the cached record.
+	cacheEntry *LocalPlanRecord
+}
+
+// A LocalPlanRecordInfo describes a LocalPlanStore record, without its
+// plan, such as for choosing a plan for a failover-recovery.
+type LocalPlanRecordInfo struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	Time        string `json:"time,omitempty"`
+	ImplVersion string `json:"implVersion,omitempty"`
+	PlanUUID    string `json:"planUUID,omitempty"`
+	NumPIndexes int    `json:"numPIndexes"`
+	Err         string `json:"err,omitempty"` // Of a failed verification.
+}
+
+// A LocalPlanRecord is the content of a LocalPlanStore record.
+type LocalPlanRecord struct {
+	RecordVersion int           `json:"recordVersion"`
+	ImplVersion   string        `json:"implVersion"` // The writer's cbgt version.
+	Time          string        `json:"time"`
+	PlanPIndexes  *PlanPIndexes `json:"planPIndexes"`
+}
+
+// NewLocalPlanStore returns a LocalPlanStore that keeps up to
+// retention records in the dir, where a retention < 1 means 1.
+func NewLocalPlanStore(dir string, retention int, log Log) *LocalPlanStore {
+	if retention < 1 {
+		retention = 1
+	}
+	return &LocalPlanStore{dir: dir, retention: retention, log: log,
+		hashName: DEFAULT_PLAN_HASH}
+}
+
+// SetHash changes the PlanHash of the new records, such as to "md5"
+// so that the records can be read after a downgrade to a version that
+// only knows md5.  The existing records are still verified by the
+// PlanHash that they were written with.  A manager sets it from the
+// "localPlanStoreHash" manager option.
+func (s *LocalPlanStore) SetHash(hashName string) error {
+	if PlanHashes[hashName] == nil {
+		return fmt.Errorf("local_plan_store: unknown hash: %q", hashName)
+	}
+
+	s.m.Lock()
+	s.hashName = hashName
+	s.m.Unlock()
+
+	return nil
+}
+
+// Dir returns the directory of the records.
+func (s *LocalPlanStore) Dir() string {
+	return s.dir
+}
+
+// Store adds a new record for the planPIndexes, and then purges the
+// records beyond the retention.
+func (s *LocalPlanStore) Store(planPIndexes *PlanPIndexes) error {
+	val, err := json.Marshal(&LocalPlanRecord{
+		RecordVersion: LOCAL_PLAN_RECORD_VERSION,
+		ImplVersion:   Version,
+		Time:          Now().Format(time.RFC3339Nano),
+		PlanPIndexes:  planPIndexes,
+	})
+	if err != nil {
+		return fmt.Errorf("local_plan_store: json, err: %v", err)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// Decorate the file name with the hash of the record contents so
+	// that the content can be verified during the read paths.
+	planHash := PlanHashes[s.hashName]
+	if planHash == nil {
+		return fmt.Errorf("local_plan_store: unknown hash: %q", s.hashName)
+	}
+
+	sum, err := computeHash(planHash.New(), val)
+	if err != nil {
+		return err
+	}
+	if planHash.Name != "md5" {
+		sum = planHash.Name + "-" + sum
+	}
+
+	err = os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return fmt.Errorf("local_plan_store: mkdir, err: %v", err)
+	}
+
+	names, err := s.namesLOCKED()
+	if err != nil {
+		return fmt.Errorf("local_plan_store: readDir, err: %v", err)
+	}
+
+	if len(names) > 0 && s.isLatestLOCKED(names, planPIndexes) {
+		return nil
+	}
+
+	var prevTimeMS int64
+	if len(names) > 0 {
+		prevTimeMS = localPlanRecordTimeMS(names[len(names)-1])
+	}
+
+	timeStr := strconv.FormatInt(
+		NextHybridTime(prevTimeMS, time.Millisecond), 10)
+	fname := localPlanRecordPrefix + timeStr + "-" + sum
+
+	err = ioutil.WriteFile(filepath.Join(s.dir, fname), val, 0600)
+	if err != nil {
+		return fmt.Errorf("local_plan_store: write, err: %v", err)
+	}
+
+	return s.purgeLOCKED(fname)
+}
+
+// isLatestLOCKED returns whether the planPIndexes is the same as the
+// plan of the latest record, such as after a restart.
+func (s *LocalPlanStore) isLatestLOCKED(names []string,
+	planPIndexes *PlanPIndexes) bool {
+	rec, err := s.readLOCKED(names[len(names)-1])
+	if err != nil || planPIndexes == nil ||
+		rec.PlanPIndexes.UUID != planPIndexes.UUID {
+		return false
+	}
+
+	a, errA := json.Marshal(rec.PlanPIndexes)
+	b, errB := json.Marshal(planPIndexes)
+
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
+
+// purgeLOCKED removes the oldest records beyond the retention, but
+// never the just written record.
+func (s *LocalPlanStore) purgeLOCKED(keep string) error {
+	names, err := s.namesLOCKED()
+	if err != nil {
+		return err
+	}
+
+	for len(names) > s.retention {
+		if names[0] != keep {
+			err = os.Remove(filepath.Join(s.dir, names[0]))
+			if err != nil {
+				s.log.Errorf("local_plan_store: remove, err: %v", err)
+			}
+		}
+		names = names[1:]
+	}
+
+	return nil
+}
+
+// namesLOCKED returns the record file names, oldest first.
+func (s *LocalPlanStore) namesLOCKED() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var rv []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), localPlanRecordPrefix) {
+			rv = append(rv, f.Name())
+		}
+	}
+
+	// The timeMS of the names is compared as a number, as its digits
+	// may grow after a clock step.
+	sort.SliceStable(rv, func(i, j int) bool {
+		return localPlanRecordTimeMS(rv[i]) < localPlanRecordTimeMS(rv[j])
+	})
+
+	return rv, nil
+}
+
+// localPlanRecordHash returns the hashName and the hash of a record
+// file name, where a name without a hashName is of an md5.
+func localPlanRecordHash(name string) (hashName, sum string) {
+	a := strings.Split(strings.TrimPrefix(name, localPlanRecordPrefix), "-")
+	if len(a) == 3 {
+		return a[1], a[2]
+	}
+	return "md5", a[len(a)-1]
+}
+
+// localPlanRecordTimeMS returns the timeMS of a record file name, or
+// 0 when it can't be parsed.
+func localPlanRecordTimeMS(name string) int64 {
+	a := strings.Split(strings.TrimPrefix(name, localPlanRecordPrefix), "-")
+	timeMS, _ := strconv.ParseInt(a[0], 10, 64)
+	return timeMS
+}
+
+// Latest returns the most recent record that passes verification,
+// or nil if there's none.  The record is cached until its file
+// changes, so callers must treat it as a read-only snapshot.
+func (s *LocalPlanStore) Latest() *LocalPlanRecord {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	names, err := s.namesLOCKED()
+	if err != nil {
+		s.log.Errorf("local_plan_store: readDir, err: %v", err)
+		return nil
+	}
+
+	// Read the latest first, as there might be multiple records
+	// such as after a kill -9 or node crash on the writer side.
+	for i := len(names) - 1; i >= 0; i-- {
+		fi, err := os.Stat(filepath.Join(s.dir, names[i]))
+		if err == nil {
+			s.cacheM.Lock()
+			ci, rec := s.cacheInfo, s.cacheEntry
+			s.cacheM.Unlock()
+
+			if ci != nil && ci.Name() == fi.Name() &&
+				ci.Size() == fi.Size() && ci.ModTime().Equal(fi.ModTime()) {
+				return rec
+			}
+		}
+
+		rec, err := s.readLOCKED(names[i])
+		if err != nil {
+			s.log.Errorf("local_plan_store: %v", err)
+			continue
+		}
+
+		if fi != nil {
+			s.cacheM.Lock()
+			s.cacheInfo, s.cacheEntry = fi, rec
+			s.cacheM.Unlock()
+		}
+
+		return rec
+	}
+
+	return nil
+}
+
+// readLOCKED reads and verifies a record.
+func (s *LocalPlanStore) readLOCKED(name string) (*LocalPlanRecord, error) {
+	path := filepath.Join(s.dir, name)
+
+	val, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("readFile, path: %s, err: %v", path, err)
+	}
+
+	hashName, nameSum := localPlanRecordHash(name)
+
+	planHash := PlanHashes[hashName]
+	if planHash == nil {
+		return nil, fmt.Errorf("unknown hash: %q, path: %s", hashName, path)
+	}
+
+	contentSum, err := computeHash(planHash.New(), val)
+	if err != nil {
+		return nil, fmt.Errorf("computeHash, path: %s, err: %v", path, err)
+	}
+
+	if contentSum != nameSum {
+		return nil, fmt.Errorf("hash mismatch, content %s: %s,"+
+			" path: %s", hashName, contentSum, path)
+	}
+
+	rec := &LocalPlanRecord{}
+	err = json.Unmarshal(val, rec)
+	if err != nil {
+		return nil, fmt.Errorf("json, path: %s, err: %v", path, err)
+	}
+
+	if rec.RecordVersion == 0 {
+		// A record from before versioning, holding just the plan.
+		rec = &LocalPlanRecord{PlanPIndexes: &PlanPIndexes{}}
+		err = json.Unmarshal(val, rec.PlanPIndexes)
+		if err != nil {
+			return nil, fmt.Errorf("json, path: %s, err: %v", path, err)
+		}
+	} else if rec.RecordVersion > LOCAL_PLAN_RECORD_VERSION {
+		return nil, fmt.Errorf("unsupported recordVersion: %d, path: %s",
+			rec.RecordVersion, path)
+	}
+
+	if rec.PlanPIndexes == nil {
+		return nil, fmt.Errorf("no planPIndexes, path: %s", path)
+	}
+
+	return rec, nil
+}
+
+// List returns the infos of the records, the most recent first, where
+// a record that fails verification has an Err.
+func (s *LocalPlanStore) List() ([]*LocalPlanRecordInfo, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	names, err := s.namesLOCKED()
+	if err != nil {
+		return nil, fmt.Errorf("local_plan_store: readDir, err: %v", err)
+	}
+
+	rv := make([]*LocalPlanRecordInfo, 0, len(names))
+
+	for i := len(names) - 1; i >= 0; i-- {
+		info := &LocalPlanRecordInfo{Name: names[i]}
+		rv = append(rv, info)
+
+		if fi, err := os.Stat(filepath.Join(s.dir, names[i])); err == nil {
+			info.Size = fi.Size()
+		}
+
+		rec, err := s.readLOCKED(names[i])
+		if err != nil {
+			info.Err = err.Error()
+			continue
+		}
+
+		info.Time = rec.Time
+		info.ImplVersion = rec.ImplVersion
+		info.PlanUUID = rec.PlanPIndexes.UUID
+		info.NumPIndexes = len(rec.PlanPIndexes.PlanPIndexes)
+	}
+
+	return rv, nil
+}
+
+// Get returns a verified record by its name, as listed by List().
+func (s *LocalPlanStore) Get(name string) (*LocalPlanRecord, error) {
+	if !strings.HasPrefix(name, localPlanRecordPrefix) ||
+		filepath.Base(name) != name {
+		return nil, fmt.Errorf("local_plan_store: invalid name: %q", name)
+	}
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	rec, err := s.readLOCKED(name)
+	if err != nil {
+		return nil, fmt.Errorf("local_plan_store: %v", err)
+	}
+
+	return rec, nil
+}
+
+// Scrub verifies all the records against the hash of their names, and
+// quarantines the records that fail, by renaming them with a
+// "corrupt-" prefix, returning their original names.
+func (s *LocalPlanStore) Scrub() ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	names, err := s.namesLOCKED()
+	if err != nil {
+		return nil, fmt.Errorf("local_plan_store: readDir, err: %v", err)
+	}
+
+	var corrupt []string
+
+	for _, name := range names {
+		_, err := s.readLOCKED(name)
+		if err == nil {
+			continue
+		}
+
+		_, errStat := os.Stat(filepath.Join(s.dir, name))
+		if os.IsNotExist(errStat) {
+			continue // Removed concurrently, such as by an operator.
+		}
+
+		s.log.Warnf("local_plan_store: scrub, quarantined: %s, err: %v",
+			name, err)
+
+		err = os.Rename(filepath.Join(s.dir, name),
+			filepath.Join(s.dir, localPlanCorruptPrefix+name))
+		if err != nil {
+			return corrupt, fmt.Errorf("local_plan_store: scrub,"+
+				" rename, err: %v", err)
+		}
+
+		corrupt = append(corrupt, name)
+	}
+
+	return corrupt, nil
+}
+
+// ---------------------------------------------------------
+
+// DEFAULT_LOCAL_PLAN_STORE_SCRUB_INTERVAL is how often a manager
+// scrubs its LocalPlanStore, which may be overridden by the
+// "localPlanStoreScrubInterval" manager option, where "0" disables
+// the scrubbing.
+const DEFAULT_LOCAL_PLAN_STORE_SCRUB_INTERVAL = time.Hour
+
+// PlanStoreScrubLoop periodically scrubs the manager's LocalPlanStore,
+// so that a corrupted recovery plan is found before it's needed for a
+// failover-recovery.
+func (mgr *Manager) PlanStoreScrubLoop() {
+	interval := DEFAULT_LOCAL_PLAN_STORE_SCRUB_INTERVAL
+	if v, err := time.ParseDuration(
+		mgr.Options()["localPlanStoreScrubInterval"]); err == nil {
+		interval = v
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			mgr.scrubPlanStoreOnce()
+		}
+	}
+}
+
+// scrubPlanStoreOnce scrubs the LocalPlanStore, and reports the
+// quarantined records as a "planStoreCorrupt" event.
+func (mgr *Manager) scrubPlanStoreOnce() {
+	atomic.AddUint64(&mgr.stats.TotPlanStoreScrub, 1)
+
+	corrupt, err := mgr.planStore.Scrub()
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotPlanStoreScrubErr, 1)
+		mgr.log.Warnf("local_plan_store: scrub, err: %v", err)
+	}
+	if len(corrupt) <= 0 {
+		return
+	}
+
+	atomic.AddUint64(&mgr.stats.TotPlanStoreScrubCorrupt,
+		uint64(len(corrupt)))
+
+	event, _ := json.Marshal(struct {
+		Event string   `json:"event"`
+		Names []string `json:"names"`
+		Time  string   `json:"time"`
+	}{"planStoreCorrupt", corrupt, time.Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+}
@@ -0,0 +1,376 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalPlanStore(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	s := NewLocalPlanStore(filepath.Join(emptyDir, LOCAL_PLAN_STORE_DIR),
+		2, NewStdLibLog(os.Stderr, "", 0))
+	if s.Latest() != nil {
+		t.Errorf("expected no record in empty store")
+	}
+
+	for _, uuid := range []string{"a", "b", "c"} {
+		planPIndexes := NewPlanPIndexes(Version)
+		planPIndexes.UUID = uuid
+		if err := s.Store(planPIndexes); err != nil {
+			t.Fatalf("expected Store() to work, err: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond) // Distinct record names.
+	}
+
+	files, _ := ioutil.ReadDir(s.Dir())
+	if len(files) != 2 {
+		t.Errorf("expected retention of 2 records, got: %d", len(files))
+	}
+
+	rec := s.Latest()
+	if rec == nil || rec.PlanPIndexes.UUID != "c" ||
+		rec.RecordVersion != LOCAL_PLAN_RECORD_VERSION {
+		t.Fatalf("expected latest record c, got: %#v", rec)
+	}
+
+	// A corrupted record falls back to the previous record.
+	err := ioutil.WriteFile(filepath.Join(s.Dir(), files[1].Name()),
+		[]byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = s.Latest()
+	if rec == nil || rec.PlanPIndexes.UUID != "b" {
+		t.Fatalf("expected fallback to record b, got: %#v", rec)
+	}
+
+	// A record from before versioning holds just the plan.
+	planPIndexes := NewPlanPIndexes(Version)
+	planPIndexes.UUID = "legacy"
+	val, _ := json.Marshal(planPIndexes)
+	hashMD5, _ := computeMD5(val)
+	err = ioutil.WriteFile(filepath.Join(s.Dir(),
+		"recoveryPlan-9999999999999-"+hashMD5), val, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = s.Latest()
+	if rec == nil || rec.PlanPIndexes.UUID != "legacy" ||
+		rec.RecordVersion != 0 {
+		t.Fatalf("expected legacy record, got: %#v", rec)
+	}
+}
+
+func TestLocalPlanStoreLatestCached(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	s := NewLocalPlanStore(filepath.Join(emptyDir, LOCAL_PLAN_STORE_DIR),
+		2, NewStdLibLog(os.Stderr, "", 0))
+
+	planPIndexes := NewPlanPIndexes(Version)
+	planPIndexes.UUID = "a"
+	if err := s.Store(planPIndexes); err != nil {
+		t.Fatal(err)
+	}
+
+	rec0 := s.Latest()
+	if rec0 == nil || rec0.PlanPIndexes.UUID != "a" {
+		t.Fatalf("expected record a, got: %#v", rec0)
+	}
+	if s.Latest() != rec0 {
+		t.Errorf("expected the unchanged record to be reused")
+	}
+
+	time.Sleep(2 * time.Millisecond) // Distinct record names.
+
+	planPIndexes.UUID = "b"
+	if err := s.Store(planPIndexes); err != nil {
+		t.Fatal(err)
+	}
+	rec1 := s.Latest()
+	if rec1 == nil || rec1 == rec0 || rec1.PlanPIndexes.UUID != "b" {
+		t.Errorf("expected the newer record b, got: %#v", rec1)
+	}
+}
+
+func TestJanitorOnceLocalPlan(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(Version, &ErrorOnlyCfg{}, nil, NewUUID(), nil, "", 1,
+		"", ":1000", emptyDir, "some-datasource", nil, nil)
+
+	if err := m.JanitorOnce("test"); err == nil {
+		t.Errorf("expected err with no cfg and no local plan")
+	}
+
+	planPIndexes := NewPlanPIndexes(Version)
+	planPIndexes.PlanPIndexes["foo_0"] = &PlanPIndex{
+		Name:       "foo_0",
+		UUID:       "p0",
+		IndexType:  "blackhole",
+		IndexName:  "foo",
+		IndexUUID:  "i0",
+		SourceType: "nil",
+		Nodes: map[string]*PlanPIndexNode{
+			m.UUID(): {CanRead: true, CanWrite: true},
+		},
+	}
+	if err := m.LocalPlanStore().Store(planPIndexes); err != nil {
+		t.Fatalf("expected Store() to work, err: %v", err)
+	}
+
+	if err := m.JanitorOnce("test"); err == nil {
+		t.Errorf("expected err to report the unreachable cfg")
+	}
+
+	feeds, pindexes := m.CurrentMaps()
+	if len(pindexes) != 1 || pindexes["foo_0"] == nil {
+		t.Errorf("expected pindex from local plan, got: %#v", pindexes)
+	}
+	if len(feeds) != 1 {
+		t.Errorf("expected feed from local plan, got: %#v", feeds)
+	}
+}
+
+func TestLocalPlanStoreClockStep(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	c := NewManualClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	restore := SetClock(c.Now)
+	defer restore()
+
+	s := NewLocalPlanStore(filepath.Join(emptyDir, LOCAL_PLAN_STORE_DIR),
+		2, NewStdLibLog(os.Stderr, "", 0))
+
+	// The clock stalls and then steps backwards between the records.
+	for i, uuid := range []string{"a", "b", "c"} {
+		if i == 2 {
+			c.Advance(-24 * time.Hour)
+		}
+		planPIndexes := NewPlanPIndexes(Version)
+		planPIndexes.UUID = uuid
+		if err := s.Store(planPIndexes); err != nil {
+			t.Fatalf("expected Store() to work, err: %v", err)
+		}
+	}
+
+	files, _ := ioutil.ReadDir(s.Dir())
+	if len(files) != 2 {
+		t.Errorf("expected retention of 2 records, got: %d", len(files))
+	}
+
+	rec := s.Latest()
+	if rec == nil || rec.PlanPIndexes.UUID != "c" {
+		t.Fatalf("expected latest record c, got: %#v", rec)
+	}
+
+	// A record from a clock that was far ahead makes the timeMS grow
+	// a digit, which is still compared as a number.
+	planPIndexes := NewPlanPIndexes(Version)
+	planPIndexes.UUID = "ahead"
+	val, _ := json.Marshal(planPIndexes)
+	hashMD5, _ := computeMD5(val)
+	err := ioutil.WriteFile(filepath.Join(s.Dir(),
+		"recoveryPlan-9999999999999-"+hashMD5), val, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planPIndexes.UUID = "d"
+	if err = s.Store(planPIndexes); err != nil {
+		t.Fatalf("expected Store() to work, err: %v", err)
+	}
+	rec = s.Latest()
+	if rec == nil || rec.PlanPIndexes.UUID != "d" {
+		t.Fatalf("expected latest record d, got: %#v", rec)
+	}
+}
+
+func TestLocalPlanStoreListGetScrub(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	s := NewLocalPlanStore(filepath.Join(emptyDir, LOCAL_PLAN_STORE_DIR),
+		DEFAULT_LOCAL_PLAN_STORE_RETENTION, NewStdLibLog(os.Stderr, "", 0))
+
+	for _, uuid := range []string{"a", "b", "b", "c"} {
+		planPIndexes := NewPlanPIndexes(Version)
+		planPIndexes.UUID = uuid
+		if err := s.Store(planPIndexes); err != nil {
+			t.Fatalf("expected Store() to work, err: %v", err)
+		}
+	}
+
+	infos, err := s.List()
+	if err != nil || len(infos) != 3 {
+		t.Fatalf("expected 3 records without the repeated b, got: %d,"+
+			" err: %v", len(infos), err)
+	}
+	for i, uuid := range []string{"c", "b", "a"} {
+		if infos[i].PlanUUID != uuid || infos[i].Err != "" ||
+			infos[i].Size <= 0 || infos[i].ImplVersion != Version {
+			t.Errorf("expected record %s, got: %#v", uuid, infos[i])
+		}
+	}
+
+	rec, err := s.Get(infos[1].Name)
+	if err != nil || rec.PlanPIndexes.UUID != "b" {
+		t.Errorf("expected Get() of b, got: %#v, err: %v", rec, err)
+	}
+	for _, name := range []string{"", "../x", "recoveryPlan-../../x",
+		"recoveryPlan-0-nope"} {
+		if _, err = s.Get(name); err == nil {
+			t.Errorf("expected Get() to fail for: %q", name)
+		}
+	}
+
+	corrupt, err := s.Scrub()
+	if err != nil || len(corrupt) != 0 {
+		t.Errorf("expected no corrupt records, got: %v, err: %v", corrupt, err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(s.Dir(), infos[1].Name),
+		[]byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos, _ = s.List()
+	if len(infos) != 3 || infos[1].Err == "" {
+		t.Errorf("expected a listed corrupt record, got: %#v", infos[1])
+	}
+
+	corrupt, err = s.Scrub()
+	if err != nil || len(corrupt) != 1 || corrupt[0] != infos[1].Name {
+		t.Errorf("expected the corrupt b, got: %v, err: %v", corrupt, err)
+	}
+	if _, err = os.Stat(filepath.Join(s.Dir(),
+		"corrupt-"+infos[1].Name)); err != nil {
+		t.Errorf("expected a quarantined record, err: %v", err)
+	}
+
+	infos, _ = s.List()
+	if len(infos) != 2 || infos[0].PlanUUID != "c" ||
+		infos[1].PlanUUID != "a" {
+		t.Errorf("expected records c and a, got: %#v", infos)
+	}
+}
+
+func TestManagerScrubPlanStore(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(Version, NewCfgMem(), nil, NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, nil)
+
+	s := m.LocalPlanStore()
+	if err := s.Store(NewPlanPIndexes(Version)); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := s.List()
+	err := ioutil.WriteFile(filepath.Join(s.Dir(), infos[0].Name),
+		[]byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.scrubPlanStoreOnce()
+
+	var events []string
+	m.VisitEvents(func(event []byte) {
+		events = append(events, string(event))
+	})
+	if len(events) != 1 ||
+		!strings.Contains(events[0], `"planStoreCorrupt"`) ||
+		!strings.Contains(events[0], infos[0].Name) {
+		t.Errorf("expected a planStoreCorrupt event, got: %v", events)
+	}
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotPlanStoreScrub != 1 || stats.TotPlanStoreScrubCorrupt != 1 {
+		t.Errorf("unexpected stats: %d, %d", stats.TotPlanStoreScrub,
+			stats.TotPlanStoreScrubCorrupt)
+	}
+	if m.GetStableLocalPlanPIndexes() != nil {
+		t.Errorf("expected no recovery plan")
+	}
+}
+
+func TestLocalPlanStoreHash(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	s := NewLocalPlanStore(filepath.Join(emptyDir, LOCAL_PLAN_STORE_DIR),
+		DEFAULT_LOCAL_PLAN_STORE_RETENTION, NewStdLibLog(os.Stderr, "", 0))
+
+	store := func(uuid string) string {
+		planPIndexes := NewPlanPIndexes(Version)
+		planPIndexes.UUID = uuid
+		if err := s.Store(planPIndexes); err != nil {
+			t.Fatalf("expected Store() to work, err: %v", err)
+		}
+		infos, _ := s.List()
+		if infos[0].PlanUUID != uuid || infos[0].Err != "" {
+			t.Fatalf("expected a verified record %s, got: %#v", uuid, infos[0])
+		}
+		return infos[0].Name
+	}
+
+	name := store("a")
+	if hashName, sum := localPlanRecordHash(name); hashName != "sha256" ||
+		len(sum) != 64 {
+		t.Errorf("expected a sha256 name, got: %s", name)
+	}
+
+	if err := s.SetHash("nope"); err == nil {
+		t.Errorf("expected an unknown hash to fail")
+	}
+
+	if err := s.SetHash("md5"); err != nil {
+		t.Fatalf("expected SetHash() to work, err: %v", err)
+	}
+	name = store("b")
+	if hashName, sum := localPlanRecordHash(name); hashName != "md5" ||
+		len(sum) != 32 || strings.Count(name, "-") != 2 {
+		t.Errorf("expected an md5 name in the older format, got: %s", name)
+	}
+
+	// An environment that forbids md5 can't verify the md5 records.
+	md5Hash := PlanHashes["md5"]
+	delete(PlanHashes, "md5")
+	defer func() { PlanHashes["md5"] = md5Hash }()
+
+	if err := s.SetHash("md5"); err == nil {
+		t.Errorf("expected an unregistered hash to fail")
+	}
+	rec := s.Latest()
+	if rec == nil || rec.PlanPIndexes.UUID != "a" {
+		t.Errorf("expected the sha256 record a, got: %#v", rec)
+	}
+
+	if err := RegisterPlanHash(&PlanHash{Name: "Bad-Name"}); err == nil {
+		t.Errorf("expected an invalid hash name to fail")
+	}
+}
@@ -13,11 +13,13 @@ package cbgt
 
 import (
 	"container/list"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -60,6 +62,7 @@ type Manager struct {
 	weight    int
 	extras    string
 	bindHttp  string
+	advertise string // The bindHttp that other nodes use, as host:port.
 	dataDir   string
 	server    string // The default datasource that will be indexed.
 	stopCh    chan struct{}
@@ -76,8 +79,11 @@ type Manager struct {
 	lastIndexDefs          *IndexDefs
 	lastIndexDefsByName    map[string]*IndexDef
 	lastPlanPIndexes       *PlanPIndexes
+	lastPlanPIndexesCAS    uint64
 	lastPlanPIndexesByName map[string][]*PlanPIndex
 	coveringCache          map[CoveringPIndexesSpec]*CoveringPIndexes
+	nodeDefsStaleSince     map[string]time.Time // Keyed by node UUID.
+	warmingPIndexes        map[string]*PIndex   // Copy-on-write, keyed by PIndex.Name.
 
 	feedsMutex sync.RWMutex
 	feeds      map[string]Feed // Key is Feed.Name().
@@ -87,8 +93,112 @@ type Manager struct {
 
 	eventsMutex sync.RWMutex
 	events      *list.List
+	eventClock  HybridClock // Orders the SinkEvents.
 
-	stablePlanPIndexesMutex sync.RWMutex // Protects the local stable plan access.
+	breakersMutex sync.Mutex
+	breakers      map[string]*pindexBreaker // Keyed by PIndex.Name.
+
+	seqCachesMutex sync.Mutex
+	seqCaches      map[string]*seqCache // Keyed by PIndex.Name.
+
+	remoteClientPoolMutex sync.Mutex
+	remoteClientPool      *RemoteClientPool
+
+	ingestLimitsMutex sync.Mutex
+	ingestLimiters    map[string]*ingestLimiter // Keyed by index name.
+
+	memoryPaused   int32      // Accessed atomically, for a fast unpaused path.
+	memoryMutex    sync.Mutex // Protects the fields that follow.
+	memoryQuota    uint64
+	memoryUsedLast uint64
+	memoryPIndexes map[string]uint64 // Keyed by pindex name.
+	memoryExceeded bool
+	memorySince    time.Time
+	memoryActions  map[string]bool
+	memoryResumeCh chan struct{} // Non-nil while the feeds are paused.
+	memoryWeight   int           // Non-zero while the weight is reduced.
+
+	hardwareProfile *HardwareProfile // Non-nil when the weight was probed.
+
+	diskMutex   sync.Mutex // Protects the fields that follow.
+	diskLow     bool
+	diskSince   time.Time
+	diskStatus  DiskSpaceStatus
+	diskRefused map[string]bool // The refused planPIndex names.
+
+	stalePlanMutex   sync.Mutex // Protects the fields that follow.
+	janitorPlanCAS   uint64     // The plan of the last JanitorOnce.
+	janitorPlanUUID  string
+	stalePlanCache   stalePlanTracker
+	stalePlanJanitor stalePlanTracker
+	stalePlan        *StalePlanStatus // Non-nil while alarmed.
+
+	clockSkewMutex  sync.Mutex // Protects the fields that follow.
+	clockSkewCheck  time.Time  // Of the last check, with a monotonic reading.
+	clockSkew       *ClockSkewStatus
+	clockSkewClient *http.Client
+
+	buildMutex     sync.Mutex
+	buildCompleted map[string]string // Completion time keyed by index UUID.
+
+	eventSinksMutex      sync.Mutex
+	eventSinks           map[string]*eventSinkRunner // Keyed by sink name.
+	eventSinksConfigured map[string]bool             // Sinks from the options.
+	eventSinksApplied    *string                     // The options last applied.
+
+	auditMutex     sync.Mutex // Serializes the audit file appends.
+	auditPrunedDay string     // The day the audit files were last pruned.
+
+	planStore *LocalPlanStore // The recent, stable plans on local disk.
+
+	cfgHub *CfgEventHub // Multiplexes the Cfg subscriptions.
+
+	plannerInc plannerIncremental // For incremental planning passes.
+
+	plannerObservation *PlannerObservation // Protected by m.
+
+	featuresMutex sync.Mutex      // Protects the fields that follow.
+	features      map[string]bool // The last cluster-effective features.
+
+	degradedMutex   sync.Mutex // Protects the fields that follow.
+	degradedSince   time.Time
+	degradedErr     error // Non-nil when degraded due to the Cfg.
+	pendingIndexOps []*PendingIndexOp
+
+	operationsMutex sync.Mutex                 // Protects the fields that follow.
+	operations      map[string]*IndexOperation // Keyed by IndexOperation.ID.
+	operationIDs    []string                   // Oldest first.
+
+	tasksMutex  sync.Mutex                    // Protects the fields that follow.
+	taskCancels map[string]context.CancelFunc // Running tasks of this node.
+
+	feedRestartsMutex sync.Mutex
+	feedRestartsSeen  map[string]string // FeedRestartRequest.ID by index name.
+
+	sourceFlushMutex sync.Mutex
+	sourceFlushes    map[string]*sourceFlush // Keyed by index UUID.
+
+	startupMutex         sync.Mutex // Protects the fields that follow.
+	startupSequencedFlag bool
+	startupDone          bool
+	startupPhases        []*StartupPhase
+
+	compactMutex   sync.Mutex           // Protects the fields that follow.
+	compactRunning map[string]bool      // Keyed by pindex name.
+	compactLast    map[string]time.Time // Keyed by pindex name.
+
+	compactRebalanceRunning func(cfg Cfg) bool // See SetRebalanceRunning().
+
+	divergenceMutex  sync.Mutex                         // Protects the fields that follow.
+	divergenceChecks map[string]*replicaDivergenceCheck // Keyed by pindex name.
+
+	rollingApplyMutex sync.Mutex // Serializes applyRollingRestart().
+	rollingMutex      sync.Mutex // Protects the fields that follow.
+	rollingCordoned   bool
+	rollingSeen       string // RollingRestartNode.RestartID acted on.
+
+	servicePublishMutex sync.Mutex
+	lastServiceInfo     *ServiceInfo // The last successfully published.
 
 	log Log
 }
@@ -105,7 +215,12 @@ type ManagerStats struct {
 	TotRegisterPIndex   uint64
 	TotUnregisterPIndex uint64
 
-	TotLoadDataDir uint64
+	TotLoadDataDir             uint64
+	TotLoadDataDirPlanMatch    uint64
+	TotLoadDataDirPlanMismatch uint64
+
+	TotStartupTimeout     uint64
+	TotStartupRegisterErr uint64
 
 	TotSaveNodeDef       uint64
 	TotSaveNodeDefNil    uint64
@@ -122,24 +237,140 @@ type ManagerStats struct {
 	TotIndexControl   uint64
 	TotIndexControlOk uint64
 
+	TotSetReplicaCount   uint64
+	TotSetReplicaCountOk uint64
+
+	TotGCNodeDefs        uint64
+	TotGCNodeDefsRemoved uint64
+
+	TotSoftDeleteIndex    uint64
+	TotSoftDeleteIndexOk  uint64
+	TotUndeleteIndex      uint64
+	TotUndeleteIndexOk    uint64
+	TotTrashPIndex        uint64
+	TotRestoreTrashPIndex uint64
+	TotPurgeTrashPIndex   uint64
+
+	TotCheckSourceUUIDs  uint64
+	TotSourceUUIDChanged uint64
+
+	TotSourceFlushed            uint64
+	TotSourceFlushRollbackQuiet uint64
+
+	TotQueryBarrierWait     uint64
+	TotQueryBarrierTimeout  uint64
+	TotQueryBarrierFallback uint64
+
+	TotWarmPIndex    uint64
+	TotWarmPIndexOk  uint64
+	TotWarmPIndexErr uint64
+
+	TotCompaction              uint64
+	TotCompactionOk            uint64
+	TotCompactionErr           uint64
+	TotCompactionSkipRebalance uint64
+
+	TotPIndexBreakerOpen  uint64
+	TotPIndexBreakerClose uint64
+
+	TotFeedRestart        uint64
+	TotFeedRestartErr     uint64
+	TotFeedRestartRequest uint64
+
+	TotInvariantsCheck     uint64
+	TotInvariantsCheckErr  uint64
+	TotInvariantsViolation uint64
+
+	TotPIndexRatesPublish    uint64
+	TotPIndexRatesPublishErr uint64
+
+	TotReplicaDivergenceCheck    uint64
+	TotReplicaDivergenceCheckErr uint64
+	TotReplicaDiverged           uint64
+	TotReplicaRebuild            uint64
+	TotReplicaRebuildErr         uint64
+
+	TotPartitionSeqsCacheHit    uint64
+	TotPartitionSeqsCacheMiss   uint64
+	TotPartitionSeqsCacheUpdate uint64 // Partitions copied into a snapshot.
+
+	TotMemoryQuotaCheck     uint64
+	TotMemoryQuotaExceeded  uint64
+	TotMemoryQuotaRecovered uint64
+	TotMemoryQuotaPauseWait uint64 // Mutations blocked by a pause.
+
+	TotDiskSpaceCheck     uint64
+	TotDiskSpaceCheckErr  uint64
+	TotDiskSpaceLow       uint64
+	TotDiskSpaceRecovered uint64
+	TotDiskSpaceRefused   uint64 // PIndexes refused while low.
+
+	TotStalePlanCheck     uint64
+	TotStalePlan          uint64
+	TotStalePlanRecovered uint64
+
+	TotCfgPing        uint64
+	TotCfgPingErr     uint64
+	TotCfgResubscribe uint64
+
+	TotClockSkewCheck uint64
+	TotClockSkewed    uint64
+	TotClockStep      uint64
+
+	TotPlanStoreScrub        uint64
+	TotPlanStoreScrubErr     uint64
+	TotPlanStoreScrubCorrupt uint64 // Quarantined records.
+
+	TotIndexBuildTargetSave    uint64
+	TotIndexBuildTargetSaveErr uint64
+	TotIndexBuildComplete      uint64
+
+	TotIndexEvent uint64
+
+	TotAudit    uint64
+	TotAuditErr uint64
+
+	TotPIndexesRunningPublish    uint64
+	TotPIndexesRunningPublishErr uint64
+
+	TotServicePublish    uint64
+	TotServicePublishErr uint64
+
+	TotTaskStart uint64
+	TotTaskOk    uint64
+	TotTaskErr   uint64
+
+	TotRollingRestartNode    uint64
+	TotRollingRestartNodeErr uint64
+
+	TotDegraded      uint64
+	TotIndexOpQueued uint64
+
 	TotDeleteIndexBySource    uint64
 	TotDeleteIndexBySourceErr uint64
 	TotDeleteIndexBySourceOk  uint64
 
-	TotPlannerOpStart           uint64
-	TotPlannerOpRes             uint64
-	TotPlannerOpErr             uint64
-	TotPlannerOpDone            uint64
-	TotPlannerNOOP              uint64
-	TotPlannerNOOPOk            uint64
-	TotPlannerKick              uint64
-	TotPlannerKickStart         uint64
-	TotPlannerKickChanged       uint64
-	TotPlannerKickErr           uint64
-	TotPlannerKickOk            uint64
-	TotPlannerUnknownErr        uint64
-	TotPlannerSubscriptionEvent uint64
-	TotPlannerStop              uint64
+	TotPlannerOpStart                 uint64
+	TotPlannerOpRes                   uint64
+	TotPlannerOpErr                   uint64
+	TotPlannerOpDone                  uint64
+	TotPlannerNOOP                    uint64
+	TotPlannerNOOPOk                  uint64
+	TotPlannerKick                    uint64
+	TotPlannerKickStart               uint64
+	TotPlannerKickChanged             uint64
+	TotPlannerKickErr                 uint64
+	TotPlannerKickOk                  uint64
+	TotPlannerKickCoalesced           uint64
+	TotPlannerFull                    uint64
+	TotPlannerIncremental             uint64
+	TotPlannerIncrementalIndexSkipped uint64
+	TotPlannerUnknownErr              uint64
+	TotPlannerSubscriptionEvent       uint64
+	TotPlannerStop                    uint64
+	TotPlannerObserve                 uint64
+	TotPlannerObserveChanged          uint64
+	TotPlannerObserveErr              uint64
 
 	TotJanitorOpStart           uint64
 	TotJanitorOpRes             uint64
@@ -161,6 +392,8 @@ type ManagerStats struct {
 	TotRefreshLastNodeDefs     uint64
 	TotRefreshLastIndexDefs    uint64
 	TotRefreshLastPlanPIndexes uint64
+
+	TotRefreshLastPlanPIndexesSame uint64 // Snapshot reused, same CAS.
 }
 
 // ClusterOptions stores the configurable cluster-level
@@ -180,6 +413,8 @@ type ClusterOptions struct {
 	MaxFeedsPerDCPAgent                string `json:"maxFeedsPerDCPAgent"`
 	MaxConcurrentPartitionMovesPerNode string `json:"maxConcurrentPartitionMovesPerNode"`
 	UseOSOBackfill                     string `json:"useOSOBackfill"`
+	PindexWeightsFromRates             string `json:"pindexWeightsFromRates"`
+	MaxPIndexesPerNode                 string `json:"maxPIndexesPerNode"`
 }
 
 var ErrNoIndexDefs = errors.New("no index definitions found")
@@ -211,7 +446,19 @@ func NewManager(version string, cfg Cfg, l Log, uuid string, tags []string,
 		l = NewStdLibLog(os.Stderr, "", log.LstdFlags)
 	}
 
-	return &Manager{
+	planStoreRetention := DEFAULT_LOCAL_PLAN_STORE_RETENTION
+	if v, err := strconv.Atoi(options["localPlanStoreRetention"]); err == nil {
+		planStoreRetention = v
+	}
+
+	// The "advertiseHttp" option, such as from ResolveAdvertiseHttp(),
+	// is the address registered in the node's NodeDef.
+	advertise := options["advertiseHttp"]
+	if advertise == "" {
+		advertise = bindHttp
+	}
+
+	mgr := &Manager{
 		startTime:       time.Now(),
 		version:         version,
 		cfg:             cfg,
@@ -222,7 +469,8 @@ func NewManager(version string, cfg Cfg, l Log, uuid string, tags []string,
 		container:       container,
 		weight:          weight,
 		extras:          extras,
-		bindHttp:        bindHttp, // TODO: Need FQDN:port instead of ":8095".
+		bindHttp:        bindHttp,
+		advertise:       advertise,
 		dataDir:         dataDir,
 		server:          server,
 		stopCh:          make(chan struct{}),
@@ -236,32 +484,110 @@ func NewManager(version string, cfg Cfg, l Log, uuid string, tags []string,
 		events:          list.New(),
 
 		lastNodeDefs: make(map[string]*NodeDefs),
+
+		planStore: NewLocalPlanStore(filepath.Join(dataDir,
+			LOCAL_PLAN_STORE_DIR), planStoreRetention, l),
 	}
+
+	mgr.plannerInc.stats = &mgr.stats
+
+	if v := options["localPlanStoreHash"]; v != "" {
+		err := mgr.planStore.SetHash(v)
+		if err != nil {
+			l.Warnf("manager: localPlanStoreHash, err: %v", err)
+		}
+	}
+
+	mgr.clockSkewClient = &http.Client{Timeout: CLOCK_SKEW_TIMEOUT}
+
+	if cfg != nil {
+		mgr.cfgHub = NewCfgEventHub(cfg)
+	}
+
+	if cm, ok := cfg.(*CfgMetrics); ok && cm.OnUnreachable == nil {
+		cm.OnUnreachable = mgr.cfgUnreachable
+	}
+
+	return mgr
 }
 
 func (mgr *Manager) Stop() {
 	close(mgr.stopCh)
+
+	if mgr.cfgHub != nil {
+		mgr.cfgHub.Stop()
+	}
+
+	mgr.remoteClientPoolMutex.Lock()
+	if mgr.remoteClientPool != nil {
+		mgr.remoteClientPool.Close()
+	}
+	mgr.remoteClientPoolMutex.Unlock()
 }
 
 // Start will start and register a Manager instance with its
 // configured Cfg system, based on the register parameter.  See
-// Manager.Register().
+// Manager.Register(), and the "registerAfterLoad" manager option for
+// a sequenced startup.
 func (mgr *Manager) Start(register string) error {
-	err := mgr.Register(register)
+	err := mgr.probeNodeWeight()
 	if err != nil {
 		return err
 	}
 
-	if mgr.tagsMap == nil || mgr.tagsMap["pindex"] {
-		err := mgr.LoadDataDir()
+	// A sequenced startup registers the node only as known for now,
+	// and as wanted once its local pindexes are loaded and verified.
+	sequenced := mgr.startupSequenced(register)
+	mgr.startupMutex.Lock()
+	mgr.startupSequencedFlag = sequenced
+	mgr.startupMutex.Unlock()
+
+	registerNow := register
+	if sequenced {
+		registerNow = "known"
+		if register == "wantedForce" {
+			registerNow = "knownForce"
+		}
+	}
+
+	phase := STARTUP_PHASE_REGISTER
+	if sequenced {
+		phase = STARTUP_PHASE_REGISTER_KNOWN
+	}
+
+	err = mgr.startupPhase(phase,
+		func(p *StartupPhase) error {
+			return mgr.Register(registerNow)
+		})
+	if err != nil {
+		return err
+	}
+
+	if mgr.cfg != nil { // Might be nil for testing.
+		err = mgr.failOrphanedTasks()
+		if err != nil {
+			mgr.log.Warnf("manager: failOrphanedTasks, err: %v", err)
+		}
+	}
+
+	// A warm standby node loads no pindexes, as it has no plan
+	// assignments until it's promoted.
+	standby := register == "standby" || register == "standbyForce"
+
+	loadDoneCh := make(chan struct{})
+	if (mgr.tagsMap == nil || mgr.tagsMap["pindex"]) && !standby {
+		loadDoneCh, err = mgr.loadDataDir()
 		if err != nil {
 			return err
 		}
+	} else {
+		close(loadDoneCh)
 	}
 
 	if mgr.tagsMap == nil || mgr.tagsMap["planner"] {
 		go mgr.PlannerLoop()
 		go mgr.PlannerKick("start")
+		go mgr.SourceUUIDCheckLoop()
 	}
 
 	if mgr.tagsMap == nil ||
@@ -270,60 +596,78 @@ func (mgr *Manager) Start(register string) error {
 		go mgr.JanitorKick("start")
 	}
 
-	return mgr.StartCfg()
+	if mgr.tagsMap == nil || mgr.tagsMap["pindex"] {
+		go mgr.PIndexRatesLoop()
+		go mgr.InvariantsLoop()
+		go mgr.MemoryQuotaLoop()
+		go mgr.DiskSpaceLoop()
+		go mgr.IndexBuildLoop()
+		go mgr.CompactionLoop()
+		go mgr.ReplicaDivergenceLoop()
+	}
+
+	go mgr.StalePlanLoop()
+
+	go mgr.ClockSkewLoop()
+
+	go mgr.PlanStoreScrubLoop()
+
+	err = mgr.StartCfg()
+	if err != nil {
+		return err
+	}
+
+	if sequenced {
+		// The janitor must be running, as the loading of the pindexes
+		// kicks it.
+		go mgr.registerAfterLoad(register, loadDoneCh)
+	} else {
+		go mgr.startupLoaded(loadDoneCh)
+	}
+
+	return nil
 }
 
-// StartCfg will start Cfg subscriptions.
+// StartCfg will start Cfg subscriptions, which refresh the manager's
+// cached index definitions, plans, node definitions and options.
 func (mgr *Manager) StartCfg() error {
-	if mgr.cfg != nil { // TODO: Need err handling for Cfg subscriptions.
-		go func() {
-			ei := make(chan CfgEvent)
-			mgr.cfg.Subscribe(INDEX_DEFS_KEY, ei)
-			mgr.cfg.Subscribe(MANAGER_CLUSTER_OPTIONS_KEY, ei)
-			for {
-				select {
-				case <-mgr.stopCh:
-					return
-				case e := <-ei:
-					if e.Key == INDEX_DEFS_KEY {
-						mgr.GetIndexDefs(true)
-						continue
-					}
-
-					mgr.RefreshOptions()
-				}
+	if mgr.cfgHub != nil {
+		_, err := mgr.cfgHub.Subscribe([]string{
+			INDEX_DEFS_KEY,
+			MANAGER_CLUSTER_OPTIONS_KEY,
+			PLAN_PINDEXES_KEY,
+			PLAN_PINDEXES_DIRECTORY_STAMP,
+			CfgNodeDefsKey(NODE_DEFS_KNOWN),
+			CfgNodeDefsKey(NODE_DEFS_WANTED),
+			CfgNodeDefsKey(NODE_DEFS_STANDBY),
+		}, func(e CfgEvent) {
+			switch e.Key {
+			case INDEX_DEFS_KEY:
+				mgr.GetIndexDefs(true)
+			case MANAGER_CLUSTER_OPTIONS_KEY:
+				mgr.RefreshOptions()
+			case PLAN_PINDEXES_KEY, PLAN_PINDEXES_DIRECTORY_STAMP:
+				mgr.GetPlanPIndexes(true)
+				mgr.PublishService()
+			case CfgNodeDefsKey(NODE_DEFS_KNOWN):
+				mgr.GetNodeDefs(NODE_DEFS_KNOWN, true)
+				mgr.PublishService()
+			case CfgNodeDefsKey(NODE_DEFS_WANTED):
+				mgr.GetNodeDefs(NODE_DEFS_WANTED, true)
+				mgr.refreshClusterFeatures()
+			case CfgNodeDefsKey(NODE_DEFS_STANDBY):
+				mgr.GetNodeDefs(NODE_DEFS_STANDBY, true)
 			}
-		}()
+		})
+		if err != nil {
+			return err
+		}
 
-		go func() {
-			ep := make(chan CfgEvent)
-			mgr.cfg.Subscribe(PLAN_PINDEXES_KEY, ep)
-			mgr.cfg.Subscribe(PLAN_PINDEXES_DIRECTORY_STAMP, ep)
-			for {
-				select {
-				case <-mgr.stopCh:
-					return
-				case <-ep:
-					mgr.GetPlanPIndexes(true)
-				}
-			}
-		}()
+		go mgr.CfgPingLoop()
+	}
 
-		kinds := []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED}
-		for _, kind := range kinds {
-			go func(kind string) {
-				ep := make(chan CfgEvent)
-				mgr.cfg.Subscribe(CfgNodeDefsKey(kind), ep)
-				for {
-					select {
-					case <-mgr.stopCh:
-						return
-					case <-ep:
-						mgr.GetNodeDefs(kind, true)
-					}
-				}
-			}(kind)
-		}
+	if mgr.cfg != nil {
+		mgr.refreshClusterFeatures()
 	}
 
 	return nil
@@ -341,6 +685,8 @@ func (mgr *Manager) StartRegister(register string) error {
 // * wantedForce - same as wanted, but force a Cfg update
 // * known - register this node as known
 // * knownForce - same as unknown, but force a Cfg update
+// * standby - register this node as known and as a warm standby node
+// * standbyForce - same as standby, but force a Cfg update
 // * unwanted - unregister this node no longer wanted
 // * unknown - unregister this node no longer wanted and no longer known
 // * unchanged - don't change any Cfg registrations for this node
@@ -348,13 +694,18 @@ func (mgr *Manager) Register(register string) error {
 	if register == "unchanged" {
 		return nil
 	}
-	if register == "unwanted" || register == "unknown" {
+	if register == "unwanted" || register == "unknown" ||
+		register == "standby" || register == "standbyForce" {
 		err := mgr.RemoveNodeDef(NODE_DEFS_WANTED)
 		if err != nil {
 			return err
 		}
 		if register == "unknown" {
-			err := mgr.RemoveNodeDef(NODE_DEFS_KNOWN)
+			err := mgr.RemoveNodeDef(NODE_DEFS_STANDBY)
+			if err != nil {
+				return err
+			}
+			err = mgr.RemoveNodeDef(NODE_DEFS_KNOWN)
 			if err != nil {
 				return err
 			}
@@ -362,9 +713,11 @@ func (mgr *Manager) Register(register string) error {
 	}
 
 	if register == "known" || register == "knownForce" ||
-		register == "wanted" || register == "wantedForce" {
+		register == "wanted" || register == "wantedForce" ||
+		register == "standby" || register == "standbyForce" {
 		// Save our nodeDef (with our UUID) into the Cfg as a known node.
-		err := mgr.SaveNodeDef(NODE_DEFS_KNOWN, register == "knownForce")
+		err := mgr.SaveNodeDef(NODE_DEFS_KNOWN,
+			register == "knownForce" || register == "standbyForce")
 		if err != nil {
 			return err
 		}
@@ -374,8 +727,24 @@ func (mgr *Manager) Register(register string) error {
 			if err != nil {
 				return err
 			}
+			// A wanted node is no longer a standby node.
+			err = mgr.RemoveNodeDef(NODE_DEFS_STANDBY)
+			if err != nil {
+				return err
+			}
+		}
+		if register == "standby" || register == "standbyForce" {
+			// Save our nodeDef (with our UUID) into the Cfg as a standby node.
+			err := mgr.SaveNodeDef(NODE_DEFS_STANDBY, register == "standbyForce")
+			if err != nil {
+				return err
+			}
 		}
 	}
+
+	// A failed publish is logged, and is retried on the next change.
+	mgr.PublishService()
+
 	return nil
 }
 
@@ -391,16 +760,24 @@ func (mgr *Manager) SaveNodeDef(kind string, force bool) error {
 		return nil // Occurs during testing.
 	}
 
+	mgr.rollingMutex.Lock()
+	cordoned := mgr.rollingCordoned
+	mgr.rollingMutex.Unlock()
+
 	nodeDef := &NodeDef{
-		HostPort:    mgr.bindHttp,
+		HostPort:    mgr.advertise,
 		UUID:        mgr.uuid,
 		ImplVersion: mgr.version,
 		Tags:        mgr.tags,
 		Container:   mgr.container,
-		Weight:      mgr.weight,
+		Weight:      mgr.nodeDefWeight(),
 		Extras:      mgr.extras,
+		NoAccept:    mgr.diskSpaceLow() || cordoned,
+		Cordoned:    cordoned,
+		MaxPIndexes: mgr.nodeDefMaxPIndexes(),
 	}
 
+	retry := NewCASRetry(CfgNodeDefsKey(kind))
 	for {
 		nodeDefs, cas, err := CfgGetNodeDefs(mgr.cfg, kind)
 		if err != nil {
@@ -432,11 +809,13 @@ func (mgr *Manager) SaveNodeDef(kind string, force bool) error {
 				// multiple nodes are all racing to register themselves,
 				// such as in a full datacenter power restart.
 				atomic.AddUint64(&mgr.stats.TotSaveNodeDefRetry, 1)
+				retry.Conflict()
 				continue
 			}
 			atomic.AddUint64(&mgr.stats.TotSaveNodeDefSetErr, 1)
 			return err
 		}
+		retry.Done(nil)
 		break
 	}
 	atomic.AddUint64(&mgr.stats.TotSaveNodeDefOk, 1)
@@ -452,6 +831,7 @@ func (mgr *Manager) RemoveNodeDef(kind string) error {
 		return nil // Occurs during testing.
 	}
 
+	retry := NewCASRetry(CfgNodeDefsKey(kind))
 	for {
 		err := CfgRemoveNodeDef(mgr.cfg, kind, mgr.uuid, CfgGetVersion(mgr.cfg))
 		if err != nil {
@@ -459,10 +839,12 @@ func (mgr *Manager) RemoveNodeDef(kind string) error {
 				// Retry if it was a CAS mismatch, as perhaps multiple
 				// nodes are racing to register/unregister themselves,
 				// such as in a full cluster power restart.
+				retry.Conflict()
 				continue
 			}
 			return err
 		}
+		retry.Done(nil)
 		break
 	}
 
@@ -514,18 +896,92 @@ func (mgr *Manager) updateBootingStatus(pindex string, status bool) bool {
 
 type pindexLoadReq struct {
 	path, pindexName string
+	matchesPlan      bool // See bootPlanMatches().
+}
+
+// bootPlanMatches reads the PINDEX_META of the pindexes to load, keyed
+// by pindex name, and returns the names of those that match their
+// assignments to this node in the current plan, including their
+// UUIDs.  The janitor has no work for those, so that loading them
+// needn't kick it, unlike for the mismatches, whose reconciliation
+// needs the janitor.  The fast path is disabled by the
+// "loadDataDirFastPathDisable" manager option, or without a plan.
+func (mgr *Manager) bootPlanMatches(paths map[string]string) map[string]bool {
+	if mgr.cfg == nil || mgr.Options()["loadDataDirFastPathDisable"] == "true" {
+		return nil
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil || planPIndexes == nil {
+		return nil
+	}
+
+	rv := map[string]bool{}
+	for name, path := range paths {
+		planPIndex := planPIndexes.PlanPIndexes[name]
+		if planPIndex == nil || planPIndex.Nodes[mgr.uuid] == nil {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(path +
+			string(os.PathSeparator) + PINDEX_META_FILENAME)
+		if err != nil {
+			continue
+		}
+		pindex := &PIndex{}
+		if json.Unmarshal(buf, pindex) != nil {
+			continue
+		}
+
+		if PIndexMatchesPlan(pindex, planPIndex) {
+			rv[name] = true
+		}
+	}
+
+	atomic.AddUint64(&mgr.stats.TotLoadDataDirPlanMatch, uint64(len(rv)))
+	atomic.AddUint64(&mgr.stats.TotLoadDataDirPlanMismatch,
+		uint64(len(paths)-len(rv)))
+
+	return rv
 }
 
 // ---------------------------------------------------------------
 
 // Walk the data dir and register pindexes for a Manager instance.
 func (mgr *Manager) LoadDataDir() error {
+	_, err := mgr.loadDataDir()
+	return err
+}
+
+// loadDataDir is LoadDataDir(), which also returns a channel that's
+// closed once all the pindexes were opened.
+func (mgr *Manager) loadDataDir() (chan struct{}, error) {
 	log.Printf("manager: loading dataDir...")
 	dirEntries, err := ioutil.ReadDir(mgr.dataDir)
 	if err != nil {
-		return fmt.Errorf("manager: could not read dataDir: %s, err: %v",
+		return nil, fmt.Errorf("manager: could not read dataDir: %s, err: %v",
 			mgr.dataDir, err)
 	}
+	// validate the pindex paths here, if valid then
+	// send to workers for further processing
+	var reqs []*pindexLoadReq
+	paths := map[string]string{}
+	for _, dirInfo := range dirEntries {
+		path := mgr.dataDir + string(os.PathSeparator) + dirInfo.Name()
+		name, ok := mgr.ParsePIndexPath(path)
+		if !ok {
+			// Skip the entry that doesn't match the naming pattern.
+			continue
+		}
+		reqs = append(reqs, &pindexLoadReq{path: path, pindexName: name})
+		paths[name] = path
+	}
+	matchesPlan := mgr.bootPlanMatches(paths)
+	for _, req := range reqs {
+		req.matchesPlan = matchesPlan[req.pindexName]
+	}
+	var numMatched uint64
+
 	size := len(dirEntries)
 	openReqs := make(chan *pindexLoadReq, size)
 	nWorkers := getWorkerCount(size)
@@ -554,6 +1010,12 @@ func (mgr *Manager) LoadDataDir() error {
 						mgr.log.Errorf("manager: could not open pindex path: %s, err: %v",
 							req.path, err)
 					}
+				} else if req.matchesPlan {
+					mgr.registerPIndex(pindex)
+					// the janitor only needs to hook up the feeds of
+					// the pindexes that match the plan, which a single
+					// kick does once all the pindexes are loaded.
+					atomic.AddUint64(&numMatched, 1)
 				} else {
 					mgr.registerPIndex(pindex)
 					// kick the janitor only in case of successful pindex load
@@ -571,28 +1033,27 @@ func (mgr *Manager) LoadDataDir() error {
 		}()
 	}
 	// feed the openPIndex workers with pindex paths
-	for _, dirInfo := range dirEntries {
-		path := mgr.dataDir + string(os.PathSeparator) + dirInfo.Name()
-		// validate the pindex path here, if valid then
-		// send to workers for further processing
-		name, ok := mgr.ParsePIndexPath(path)
-		if !ok {
-			// Skip the entry that doesn't match the naming pattern.
-			continue
-		}
-		openReqs <- &pindexLoadReq{path: path, pindexName: name}
+	for _, req := range reqs {
+		openReqs <- req
 	}
 	close(openReqs)
 
+	doneCh := make(chan struct{})
+
 	// log this message only after all workers have completed
 	go func() {
 		wg.Wait()
 		atomic.AddUint64(&mgr.stats.TotLoadDataDir, 1)
 		log.Printf("manager: loading dataDir... done")
+		close(doneCh)
+
+		if atomic.LoadUint64(&numMatched) > 0 {
+			mgr.JanitorKick("loadDataDir matched the plan")
+		}
 	}()
 
 	// leave the pindex loading task to the async workers and return here
-	return nil
+	return doneCh, nil
 }
 
 // ---------------------------------------------------------------
@@ -628,6 +1089,12 @@ func (mgr *Manager) GetPIndex(pindexName string) *PIndex {
 }
 
 func (mgr *Manager) registerPIndex(pindex *PIndex) error {
+	err := ValidatePIndexName(pindex.Name)
+	if err != nil {
+		mgr.log.Warnf("manager: rejected registering pindex, err: %v", err)
+		return fmt.Errorf("manager: could not register pindex, err: %v", err)
+	}
+
 	mgr.m.Lock()
 	defer mgr.m.Unlock()
 
@@ -642,6 +1109,8 @@ func (mgr *Manager) registerPIndex(pindex *PIndex) error {
 	atomic.AddUint64(&mgr.stats.TotRegisterPIndex, 1)
 	mgr.coveringCache = nil
 
+	mgr.warmPIndexLOCKED(pindex)
+
 	if mgr.meh != nil {
 		mgr.meh.OnRegisterPIndex(pindex)
 	}
@@ -672,6 +1141,10 @@ func (mgr *Manager) unregisterPIndex(name string, pindexToMatch *PIndex) *PIndex
 		atomic.AddUint64(&mgr.stats.TotUnregisterPIndex, 1)
 		mgr.coveringCache = nil
 
+		if mgr.warmingPIndexes[name] == pindex {
+			mgr.setWarmingPIndexLOCKED(name, nil)
+		}
+
 		if mgr.meh != nil {
 			mgr.meh.OnUnregisterPIndex(pindex)
 		}
@@ -686,6 +1159,12 @@ func (mgr *Manager) unregisterPIndex(name string, pindexToMatch *PIndex) *PIndex
 
 // ---------------------------------------------------------------
 
+// RegisterFeed is invoked by a FeedStartFunc to register its started
+// feed, which lets feed types live outside of this package.
+func (mgr *Manager) RegisterFeed(feed Feed) error {
+	return mgr.registerFeed(feed)
+}
+
 func (mgr *Manager) registerFeed(feed Feed) error {
 	mgr.feedsMutex.Lock()
 	defer mgr.feedsMutex.Unlock()
@@ -791,7 +1270,9 @@ func (mgr *Manager) GetIndexDefs(refresh bool) (
 	if lastIndexDefs == nil || refresh {
 		mgr.m.Lock()
 		defer mgr.m.Unlock()
-		lastIndexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+
+		var err error
+		lastIndexDefs, _, err = CfgGetIndexDefs(mgr.cfg)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -808,6 +1289,8 @@ func (mgr *Manager) GetIndexDefs(refresh bool) (
 
 		mgr.coveringCache = nil
 
+		mgr.refreshIngestLimits(lastIndexDefsByName)
+
 		if RegisteredPIndexCallbacks.OnRefresh != nil {
 			RegisteredPIndexCallbacks.OnRefresh()
 		}
@@ -853,7 +1336,7 @@ func (mgr *Manager) GetIndexDef(indexName string, refresh bool) (
 			" indexName: %s", indexName)
 	}
 
-	pindexImplType := PIndexImplTypes[indexDef.Type]
+	pindexImplType := GetPIndexImplType(indexDef.Type)
 	if pindexImplType == nil {
 		return nil, nil, fmt.Errorf("manager: no pindexImplType,"+
 			" indexName: %s, indexDef.Type: %s",
@@ -877,10 +1360,24 @@ func (mgr *Manager) GetPlanPIndexes(refresh bool) (
 		mgr.m.Lock()
 		defer mgr.m.Unlock()
 
-		lastPlanPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+		v, cas, err := mgr.cfg.Get(PLAN_PINDEXES_KEY, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Reuse the snapshot when the plan in the Cfg is unchanged,
+		// skipping the parsing and comparison of a large plan.
+		if cas != 0 && cas == mgr.lastPlanPIndexesCAS &&
+			mgr.lastPlanPIndexes != nil {
+			atomic.AddUint64(&mgr.stats.TotRefreshLastPlanPIndexesSame, 1)
+			return mgr.lastPlanPIndexes, mgr.lastPlanPIndexesByName, nil
+		}
+
+		lastPlanPIndexes, err = parsePlanPIndexes(v)
 		if err != nil {
 			return nil, nil, err
 		}
+
 		// skip disk writes on repeated Cfg callbacks.
 		if !reflect.DeepEqual(mgr.lastPlanPIndexes, lastPlanPIndexes) {
 			// make a local copy of the updated plan,
@@ -888,6 +1385,7 @@ func (mgr *Manager) GetPlanPIndexes(refresh bool) (
 		}
 
 		mgr.lastPlanPIndexes = lastPlanPIndexes
+		mgr.lastPlanPIndexesCAS = cas
 		atomic.AddUint64(&mgr.stats.TotRefreshLastPlanPIndexes, 1)
 
 		lastPlanPIndexesByName = make(map[string][]*PlanPIndex)
@@ -914,62 +1412,21 @@ func (mgr *Manager) GetPlanPIndexes(refresh bool) (
 }
 
 // GetStableLocalPlanPIndexes retrieves the recovery plan for
-// a failover-recovery.
+// a failover-recovery, as a read-only snapshot.
 func (mgr *Manager) GetStableLocalPlanPIndexes() *PlanPIndexes {
-	dirPath := filepath.Join(mgr.dataDir, "planPIndexes")
-	mgr.stablePlanPIndexesMutex.RLock()
-	defer mgr.stablePlanPIndexesMutex.RUnlock()
-	// read the files from the planPIndexes directory.
-	files, err := ioutil.ReadDir(dirPath)
-	if err != nil {
-		mgr.log.Errorf("manager: GetStableLocalPlanPIndexes, readDir err: %v", err)
+	rec := mgr.planStore.Latest()
+	if rec == nil {
 		return nil
 	}
+	log.Printf("manager: GetStableLocalPlanPIndexes, recovery plan"+
+		" uuid: %s, time: %s", rec.PlanPIndexes.UUID, rec.Time)
+	return rec.PlanPIndexes
+}
 
-	rv := &PlanPIndexes{}
-	// There will only be a single file in the directory, and if the processing
-	// fails then fall back to the usual flow of recovery by returning nil,
-	// As the files are in the ascending order of their names, let's read the
-	// latest first. This helps the situation if there was a kill -9/node crash
-	// on the writer side to end up having multiple files on disk.
-	for i := len(files) - 1; i >= 0; i-- {
-		path := filepath.Join(dirPath, files[i].Name())
-		val, err := ioutil.ReadFile(path)
-		if err != nil {
-			mgr.log.Errorf("manager: GetStableLocalPlanPIndexes, readFile, err: %v", err)
-			// in case of a file read error, check for any subsequent plan files.
-			continue
-		}
-
-		contentMD5, err := computeMD5(val)
-		if err != nil {
-			mgr.log.Errorf("manager: GetStableLocalPlanPIndexes, computeMD5, err: %v", err)
-			// in case of a hash compute error, check for any subsequent plan files.
-			continue
-		}
-
-		// Get the hashMD5 from the file name
-		fname := files[i].Name()
-		nameMD5 := fname[strings.LastIndex(fname, "-")+1:]
-		if contentMD5 != nameMD5 {
-			mgr.log.Errorf("manager: GetStableLocalPlanPIndexes failed, hash mismatch "+
-				"contentMD5: %s, contents: %s, path: %s", contentMD5, val, path)
-			// in case of a hash mis match, check for any subsequent plan files.
-			continue
-		}
-
-		err = json.Unmarshal(val, rv)
-		if err != nil {
-			// if the file is read successfully and hash digest matched then json
-			// parsing should have passed too. So return here.
-			mgr.log.Errorf("manager: GetStableLocalPlanPIndexes, json, err: %v", err)
-			return nil
-		}
-		log.Printf("manager: GetStableLocalPlanPIndexes, recovery plan: %s", val)
-		return rv
-	}
-
-	return nil
+// LocalPlanStore returns the store of the recent, stable plans that
+// were persisted on the local node.
+func (mgr *Manager) LocalPlanStore() *LocalPlanStore {
+	return mgr.planStore
 }
 
 // IsStablePlan checks whether the given plan is a stable or evolving plan
@@ -1011,79 +1468,35 @@ func (mgr *Manager) checkAndStoreStablePlanPIndexes(planPIndexes *PlanPIndexes)
 	if !IsStablePlan(planPIndexes) {
 		return
 	}
-	val, err := json.Marshal(planPIndexes)
-	if err != nil {
-		mgr.log.Errorf("manager: persistPlanPIndexes, json err: %v", err)
-		return
-	}
-	// Decorate the file name with the hash of the plan contents so that
-	// the content can be verified during the read paths.
-	hashMD5, err := computeMD5(val)
+	err := mgr.planStore.Store(planPIndexes)
 	if err != nil {
-		return
+		mgr.log.Errorf("manager: persistPlanPIndexes, err: %v", err)
 	}
-	timeStr := strconv.FormatInt(time.Now().UnixNano()/1000000, 10)
-	fname := "recoveryPlan-" + timeStr + "-" + hashMD5
-	dirPath := filepath.Join(mgr.dataDir, "planPIndexes")
-	newPath := filepath.Join(dirPath, fname)
-
-	log.Printf("manager: persistPlanPIndexes, new plan path: %s", newPath)
+}
 
-	mgr.stablePlanPIndexesMutex.Lock()
-	defer mgr.stablePlanPIndexesMutex.Unlock()
+// ---------------------------------------------------------------
 
-	err = os.MkdirAll(dirPath, 0700)
-	if err != nil {
-		mgr.log.Errorf("manager: persistPlanPIndexes,  MkdirAll failed, err: %v", err)
-		return
-	}
-	err = ioutil.WriteFile(newPath, val, 0600)
+// pIndexPath returns the filesystem path for a given named pindex, or
+// "" for a pindex name that's invalid, which is logged, as its path
+// could escape the dataDir.  See also parsePIndexPath().
+func (mgr *Manager) PIndexPath(pindexName string) string {
+	path, err := mgr.pindexPath(pindexName)
 	if err != nil {
-		mgr.log.Errorf("manager: persistPlanPIndexes writeFile failed, err: %v", err)
-		return
+		return ""
 	}
+	return path
+}
 
-	// After successful write to disk for the latest plan,
-	// purge all older plans except the most recent one.
-	// The plan right before a failover ought to be a stable, usable
-	// plan for a failover-recovery operation.
-	// ReadDir returns files in the sorted order of their timestamped names.
-	files, err := ioutil.ReadDir(dirPath)
+func (mgr *Manager) pindexPath(pindexName string) (string, error) {
+	path, err := pIndexPath(mgr.dataDir, pindexName)
 	if err != nil {
-		mgr.log.Errorf("manager: persistPlanPIndexes, readDir failed, err: %v", err)
-		return
-	}
-	// No purging needs to be done for a single file on disk.
-	if len(files) <= 1 {
-		return
+		mgr.log.Warnf("manager: rejected pindex path, err: %v", err)
 	}
-	// As the files are in the sorted order of their timestamped names,
-	// purge all older plan files from disk.
-	files = files[:len(files)-1]
-	for _, f := range files {
-		fname := f.Name()
-		// extra check with the timestamp for the most recent one.
-		if strings.Contains(fname, timeStr) {
-			continue
-		}
-		err := os.Remove(filepath.Join(dirPath, fname))
-		if err != nil {
-			mgr.log.Errorf("manager: persistPlanPIndexes, remove failed, err %v", err)
-			continue
-		}
-	}
-}
-
-// ---------------------------------------------------------------
-
-// pIndexPath returns the filesystem path for a given named pindex.
-// See also parsePIndexPath().
-func (mgr *Manager) PIndexPath(pindexName string) string {
-	return pIndexPath(mgr.dataDir, pindexName)
+	return path, err
 }
 
 // parsePIndexPath returns the name for a pindex given a filesystem
-// path.  See also pIndexPath().
+// path, where an invalid pindex name is not ok.  See also pIndexPath().
 func (mgr *Manager) ParsePIndexPath(pindexPath string) (string, bool) {
 	return parsePIndexPath(mgr.dataDir, pindexPath)
 }
@@ -1127,7 +1540,8 @@ func (mgr *Manager) Container() string {
 	return mgr.container
 }
 
-// Returns the configured weight of a Manager.
+// Returns the configured weight of a Manager, or the weight that was
+// derived from its HardwareProfile.
 func (mgr *Manager) Weight() int {
 	return mgr.weight
 }
@@ -1142,6 +1556,12 @@ func (mgr *Manager) BindHttp() string {
 	return mgr.bindHttp
 }
 
+// Returns the advertised bindHttp of a Manager, which is the HostPort
+// of its NodeDef that other nodes use to reach it.
+func (mgr *Manager) AdvertiseHttp() string {
+	return mgr.advertise
+}
+
 // Returns the configured data dir of a Manager.
 func (mgr *Manager) DataDir() string {
 	return mgr.dataDir
@@ -1224,6 +1644,15 @@ func (mgr *Manager) StatsCopyTo(dst *ManagerStats) {
 	mgr.stats.AtomicCopyTo(dst)
 }
 
+// DiffManagerStats returns the changes of the stats from a to b, such
+// as from two StatsCopyTo() snapshots.
+func DiffManagerStats(a, b *ManagerStats) []FieldChange {
+	if a == nil || b == nil {
+		return nil
+	}
+	return StructFieldChanges(*a, *b)
+}
+
 // --------------------------------------------------------
 
 func (mgr *Manager) VisitEvents(callback func(event []byte)) {
@@ -1240,12 +1669,20 @@ func (mgr *Manager) VisitEvents(callback func(event []byte)) {
 // --------------------------------------------------------
 
 func (mgr *Manager) AddEvent(jsonBytes []byte) {
+	mgr.addEvent(EVENT_CATEGORY_MANAGER, jsonBytes)
+}
+
+// addEvent adds an event to the recent events and publishes it to the
+// EventSinks of its category.
+func (mgr *Manager) addEvent(category string, jsonBytes []byte) {
 	mgr.eventsMutex.Lock()
 	for mgr.events.Len() >= MANAGER_MAX_EVENTS {
 		mgr.events.Remove(mgr.events.Front())
 	}
 	mgr.events.PushBack(jsonBytes)
 	mgr.eventsMutex.Unlock()
+
+	mgr.PublishEvent(category, jsonBytes)
 }
 
 // --------------------------------------------------------
@@ -12,9 +12,11 @@
 package cbgt
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"regexp"
+	"sort"
 	"strconv"
 	"sync/atomic"
 )
@@ -47,96 +49,49 @@ func (mgr *Manager) CreateIndexEx(sourceType,
 	sourceName, sourceUUID, sourceParams,
 	indexType, indexName, indexParams string, planParams PlanParams,
 	prevIndexUUID string) (string, error) {
-	atomic.AddUint64(&mgr.stats.TotCreateIndex, 1)
-
-	matched, err := regexp.Match(INDEX_NAME_REGEXP, []byte(indexName))
-	if err != nil {
-		return "", fmt.Errorf("manager_api: CreateIndex,"+
-			" indexName parsing problem,"+
-			" indexName: %s, err: %v", indexName, err)
-	}
-	if !matched {
-		return "", fmt.Errorf("manager_api: CreateIndex,"+
-			" indexName is invalid, indexName: %q", indexName)
-	}
-
-	indexDef := &IndexDef{
-		Type:         indexType,
-		Name:         indexName,
-		Params:       indexParams,
-		SourceType:   sourceType,
-		SourceName:   sourceName,
-		SourceUUID:   sourceUUID,
-		SourceParams: sourceParams,
-		PlanParams:   planParams,
-	}
-
-	pindexImplType, exists := PIndexImplTypes[indexType]
-	if !exists {
-		return "", fmt.Errorf("manager_api: CreateIndex,"+
-			" unknown indexType: %s", indexType)
-	}
-
-	if pindexImplType.Prepare != nil {
-		indexDef, err = pindexImplType.Prepare(indexDef)
-		if err != nil {
-			return "", fmt.Errorf("manager_api: CreateIndex, Prepare failed,"+
-				" err: %v", err)
-		}
-	}
-	sourceParams = indexDef.SourceParams
-	indexParams = indexDef.Params
+	return mgr.CreateIndexContext(context.Background(), sourceType,
+		sourceName, sourceUUID, sourceParams, indexType, indexName,
+		indexParams, planParams, prevIndexUUID)
+}
 
-	if pindexImplType.Validate != nil {
-		err = pindexImplType.Validate(indexType, indexName, indexParams)
-		if err != nil {
-			return "", fmt.Errorf("manager_api: CreateIndex, invalid,"+
-				" err: %v", err)
-		}
-	}
+// CreateIndexContext is like CreateIndexEx, but gives up, returning
+// the ctx's error, when the ctx is done before the index definition
+// is saved to the Cfg.
+func (mgr *Manager) CreateIndexContext(ctx context.Context, sourceType,
+	sourceName, sourceUUID, sourceParams,
+	indexType, indexName, indexParams string, planParams PlanParams,
+	prevIndexUUID string) (string, error) {
+	atomic.AddUint64(&mgr.stats.TotCreateIndex, 1)
 
-	// First, check that the source exists.
-	sourceParams, err = dataSourcePrepParams(sourceType,
-		sourceName, sourceUUID, sourceParams, mgr.server, mgr.Options())
+	indexDef, err := mgr.prepareIndexDef(sourceType, sourceName,
+		sourceUUID, sourceParams, indexType, indexName, indexParams,
+		planParams)
 	if err != nil {
-		return "", fmt.Errorf("manager_api: failed to connect to"+
-			" or retrieve information from source,"+
-			" sourceType: %s, sourceName: %s, sourceUUID: %s, err: %v",
-			sourceType, sourceName, sourceUUID, err)
+		return "", err
 	}
-	indexDef.SourceParams = sourceParams
 
-	if len(sourceUUID) == 0 {
-		// If sourceUUID isn't available, fetch the sourceUUID for
-		// the sourceName by setting up a connection.
-		sourceUUID, err = DataSourceUUID(sourceType, sourceName, sourceParams,
-			mgr.server, mgr.Options())
-		if err != nil {
-			return "", fmt.Errorf("manager_api: failed to fetch sourceUUID"+
-				" for sourceName: %s, sourceType: %s, err: %v",
-				sourceName, sourceType, err)
-		}
-		indexDef.SourceUUID = sourceUUID
+	pendingIndexOp := &PendingIndexOp{
+		Op:            "create",
+		IndexName:     indexName,
+		PrevIndexUUID: prevIndexUUID,
+		IndexDef:      indexDef,
 	}
-
-	// Validate maxReplicasAllowed here.
-	maxReplicasAllowed, _ := strconv.Atoi(mgr.Options()["maxReplicasAllowed"])
-	if planParams.NumReplicas < 0 || planParams.NumReplicas > maxReplicasAllowed {
-		return "", fmt.Errorf("manager_api: CreateIndex failed, maxReplicasAllowed:"+
-			" '%v', but request for '%v'", maxReplicasAllowed, planParams.NumReplicas)
+	if mgr.Degraded() {
+		return "", mgr.queueIndexOp(pendingIndexOp)
 	}
 
 	nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_KNOWN)
 	if err != nil {
-		return "", fmt.Errorf("manager_api: CreateIndex failed, "+
-			"CfgGetNodeDefs err: %v", err)
+		mgr.enterDegraded(err)
+		return "", mgr.queueIndexOp(pendingIndexOp)
 	}
-	if len(nodeDefs.NodeDefs) < planParams.NumReplicas+1 {
+	if len(nodeDefs.NodeDefs) < indexDef.PlanParams.NumReplicas+1 {
 		return "", fmt.Errorf("manager_api: CreateIndex failed, cluster needs %d "+
 			"search nodes to support the requested replica count of %d",
-			planParams.NumReplicas+1, planParams.NumReplicas)
+			indexDef.PlanParams.NumReplicas+1, indexDef.PlanParams.NumReplicas)
 	}
 
+	retry := NewCASRetry(INDEX_DEFS_KEY)
 	tries := 0
 	version := CfgGetVersion(mgr.cfg)
 	for {
@@ -146,6 +101,10 @@ func (mgr *Manager) CreateIndexEx(sourceType,
 				" too many tries: %d", tries)
 		}
 
+		if err = ctx.Err(); err != nil {
+			return "", err
+		}
+
 		indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
 		if err != nil {
 			return "", fmt.Errorf("manager_api: CfgGetIndexDefs err: %v", err)
@@ -207,6 +166,7 @@ func (mgr *Manager) CreateIndexEx(sourceType,
 		_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
 		if err != nil {
 			if _, ok := err.(*CfgCASError); ok {
+				retry.Conflict()
 				continue // Retry on CAS mismatch.
 			}
 
@@ -214,6 +174,7 @@ func (mgr *Manager) CreateIndexEx(sourceType,
 				" err: %v", err)
 		}
 
+		retry.Done(nil)
 		break // Success.
 	}
 
@@ -221,36 +182,258 @@ func (mgr *Manager) CreateIndexEx(sourceType,
 		mgr.log.Printf("manager_api: index definition created,"+
 			" indexType: %s, indexName: %s, indexUUID: %s",
 			indexDef.Type, indexDef.Name, indexDef.UUID)
+		mgr.addIndexEvent(INDEX_EVENT_CREATED, indexDef.Name,
+			indexDef.UUID, "")
 	} else {
 		mgr.log.Printf("manager_api: index definition updated,"+
 			" indexType: %s, indexName: %s, indexUUID: %s, prevIndexUUID: %s",
 			indexDef.Type, indexDef.Name, indexDef.UUID, prevIndexUUID)
+		mgr.addIndexEvent(INDEX_EVENT_UPDATED, indexDef.Name,
+			indexDef.UUID, "prevIndexUUID: "+prevIndexUUID)
 	}
 
 	mgr.GetIndexDefs(true)
+
+	// A failed build target only leaves the build progress unknown.
+	err = mgr.saveIndexBuildTarget(indexDef)
+	if err != nil {
+		mgr.log.Warnf("manager_api: saveIndexBuildTarget,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
 	mgr.PlannerKick("api/CreateIndex, indexName: " + indexName)
 	atomic.AddUint64(&mgr.stats.TotCreateIndexOk, 1)
 	return indexDef.UUID, nil
 }
 
-// DeleteIndex deletes a logical index definition.
+// prepareIndexDef validates the parameters of an index definition
+// and returns the prepared IndexDef, without its UUID, as saved by
+// CreateIndexContext() or previewed by PreviewIndex().
+func (mgr *Manager) prepareIndexDef(sourceType,
+	sourceName, sourceUUID, sourceParams,
+	indexType, indexName, indexParams string, planParams PlanParams) (
+	*IndexDef, error) {
+	matched, err := regexp.Match(INDEX_NAME_REGEXP, []byte(indexName))
+	if err != nil {
+		return nil, fmt.Errorf("manager_api: CreateIndex,"+
+			" indexName parsing problem,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+	if !matched {
+		return nil, fmt.Errorf("manager_api: CreateIndex,"+
+			" indexName is invalid, indexName: %q", indexName)
+	}
+
+	// The pindex names add the index UUID and a partitions hash to
+	// the indexName, and must stay within the PINDEX_NAME_MAX_LEN.
+	err = ValidatePIndexName(PlanPIndexName(
+		&IndexDef{Name: indexName, UUID: NewUUID()}, ""))
+	if err != nil {
+		return nil, fmt.Errorf("manager_api: CreateIndex,"+
+			" indexName is too long, indexName: %q, err: %v",
+			indexName, err)
+	}
+
+	// Fill in the defaults of the index's template, if any.
+	planParams, sourceParams, err = applyIndexTemplate(mgr.cfg,
+		planParams, sourceParams)
+	if err != nil {
+		return nil, fmt.Errorf("manager_api: CreateIndex,"+
+			" indexTemplate: %s, err: %v", planParams.IndexTemplate, err)
+	}
+
+	indexDef := &IndexDef{
+		Type:         indexType,
+		Name:         indexName,
+		Params:       indexParams,
+		SourceType:   sourceType,
+		SourceName:   sourceName,
+		SourceUUID:   sourceUUID,
+		SourceParams: sourceParams,
+		PlanParams:   planParams,
+	}
+
+	pindexImplType := GetPIndexImplType(indexType)
+	if pindexImplType == nil {
+		return nil, fmt.Errorf("manager_api: CreateIndex,"+
+			" unknown indexType: %s", indexType)
+	}
+
+	if pindexImplType.Prepare != nil {
+		indexDef, err = pindexImplType.Prepare(indexDef)
+		if err != nil {
+			return nil, fmt.Errorf("manager_api: CreateIndex, Prepare failed,"+
+				" err: %v", err)
+		}
+	}
+	sourceParams = indexDef.SourceParams
+	indexParams = indexDef.Params
+
+	if pindexImplType.Validate != nil {
+		err = pindexImplType.Validate(indexType, indexName, indexParams)
+		if err != nil {
+			return nil, fmt.Errorf("manager_api: CreateIndex, invalid,"+
+				" err: %v", err)
+		}
+	}
+
+	// First, check that the source exists.
+	sourceParams, err = dataSourcePrepParams(sourceType,
+		sourceName, sourceUUID, sourceParams, mgr.server, mgr.Options())
+	if err != nil {
+		return nil, fmt.Errorf("manager_api: failed to connect to"+
+			" or retrieve information from source,"+
+			" sourceType: %s, sourceName: %s, sourceUUID: %s, err: %v",
+			sourceType, sourceName, sourceUUID, err)
+	}
+	indexDef.SourceParams = sourceParams
+
+	if len(sourceUUID) == 0 {
+		// If sourceUUID isn't available, fetch the sourceUUID for
+		// the sourceName by setting up a connection.
+		sourceUUID, err = DataSourceUUID(sourceType, sourceName, sourceParams,
+			mgr.server, mgr.Options())
+		if err != nil {
+			return nil, fmt.Errorf("manager_api: failed to fetch sourceUUID"+
+				" for sourceName: %s, sourceType: %s, err: %v",
+				sourceName, sourceType, err)
+		}
+		indexDef.SourceUUID = sourceUUID
+	}
+
+	// Validate maxReplicasAllowed here.
+	maxReplicasAllowed, _ := strconv.Atoi(mgr.Options()["maxReplicasAllowed"])
+	if planParams.NumReplicas < 0 || planParams.NumReplicas > maxReplicasAllowed {
+		return nil, fmt.Errorf("manager_api: CreateIndex failed, maxReplicasAllowed:"+
+			" '%v', but request for '%v'", maxReplicasAllowed, planParams.NumReplicas)
+	}
+
+	err = ValidatePIndexPins(planParams.PIndexPins)
+	if err != nil {
+		return nil, fmt.Errorf("manager_api: CreateIndex failed, err: %v", err)
+	}
+
+	err = ValidateHierarchyRules(planParams.HierarchyRules)
+	if err != nil {
+		return nil, fmt.Errorf("manager_api: CreateIndex failed, err: %v", err)
+	}
+
+	err = ValidatePlacementPolicy(&planParams)
+	if err != nil {
+		return nil, fmt.Errorf("manager_api: CreateIndex failed, err: %v", err)
+	}
+
+	switch planParams.SourceUUIDChangePolicy {
+	case SourceUUIDChangeNone, SourceUUIDChangeReset,
+		SourceUUIDChangePause, SourceUUIDChangeReadOnly:
+	default:
+		return nil, fmt.Errorf("manager_api: CreateIndex failed,"+
+			" unknown sourceUUIDChangePolicy: %q",
+			planParams.SourceUUIDChangePolicy)
+	}
+
+	return indexDef, nil
+}
+
+// DeleteIndex deletes a logical index definition.  When the
+// "indexDeleteMode" manager option is "soft", the index is instead
+// soft-deleted, see SoftDeleteIndex().
 func (mgr *Manager) DeleteIndex(indexName string) error {
-	_, err := mgr.DeleteIndexEx(indexName, "")
+	var err error
+	if mgr.Options()["indexDeleteMode"] == "soft" {
+		_, err = mgr.SoftDeleteIndex(indexName, "")
+	} else {
+		_, err = mgr.DeleteIndexEx(indexName, "")
+	}
 	log.Printf("manager_api: DeleteIndex, indexname: %s, err: %v",
 		indexName, err)
 	return err
 }
 
 // DeleteIndexEx deletes a logical index definition, with an optional
-// indexUUID ("" means don't care).
+// indexUUID ("" means don't care).  While the OpQuorum is enabled, the
+// OP_QUORUM_DELETE_INDEX of the index must be confirmed first.
 func (mgr *Manager) DeleteIndexEx(indexName, indexUUID string) (
 	string, error) {
 	atomic.AddUint64(&mgr.stats.TotDeleteIndex, 1)
 
+	err := mgr.checkIndexDeletesQuorum([]*PendingIndexOp{{
+		Op:        "delete",
+		IndexName: indexName,
+		IndexUUID: indexUUID,
+	}})
+	if err != nil {
+		return "", err
+	}
+
+	rv, err := mgr.deleteIndexEx(indexName, indexUUID)
+	if err == nil {
+		mgr.consumeIndexDeletesQuorum([]string{indexName})
+	}
+
+	return rv, err
+}
+
+// checkIndexDeletesQuorum checks that the OP_QUORUM_DELETE_INDEX of
+// every one of the deletes is confirmed, without consuming the
+// confirmations, so that a failed delete doesn't spend them.  While
+// the Cfg is unreachable, the deletes are queued and then checked on
+// their replay.
+func (mgr *Manager) checkIndexDeletesQuorum(ops []*PendingIndexOp) error {
+	if mgr.Degraded() {
+		return nil
+	}
+
+	indexNames := make([]string, 0, len(ops))
+	for _, op := range ops {
+		indexNames = append(indexNames, op.IndexName)
+	}
+
+	err := HasOpQuorum(mgr.cfg, OP_QUORUM_DELETE_INDEX, indexNames)
+	if _, ok := err.(*OpQuorumError); ok {
+		return err
+	}
+	if err != nil {
+		mgr.enterDegraded(err)
+		for _, op := range ops {
+			mgr.queueIndexOp(op)
+		}
+		return ErrIndexOpQueued
+	}
+
+	return nil
+}
+
+// consumeIndexDeletesQuorum consumes the OP_QUORUM_DELETE_INDEX
+// confirmations of the deleted indexes.
+func (mgr *Manager) consumeIndexDeletesQuorum(indexNames []string) {
+	err := ConsumeOpQuorum(mgr.cfg, OP_QUORUM_DELETE_INDEX, indexNames)
+	if err != nil {
+		mgr.log.Warnf("manager_api: ConsumeOpQuorum, indexNames: %v,"+
+			" err: %v", indexNames, err)
+	}
+}
+
+// deleteIndexEx deletes a logical index definition without the
+// OpQuorum check, such as for a soft delete.
+func (mgr *Manager) deleteIndexEx(indexName, indexUUID string) (
+	string, error) {
+
+	pendingIndexOp := &PendingIndexOp{
+		Op:        "delete",
+		IndexName: indexName,
+		IndexUUID: indexUUID,
+	}
+	if mgr.Degraded() {
+		return "", mgr.queueIndexOp(pendingIndexOp)
+	}
+
 	mgr.m.Lock()
 	indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
 	if err != nil {
-		return "", err
+		mgr.m.Unlock()
+		mgr.enterDegraded(err)
+		return "", mgr.queueIndexOp(pendingIndexOp)
 	}
 	if indexDefs == nil {
 		mgr.m.Unlock()
@@ -294,6 +477,8 @@ func (mgr *Manager) DeleteIndexEx(indexName, indexUUID string) (
 		indexDef.Type, indexDef.Name, indexDef.UUID)
 	mgr.m.Unlock()
 
+	mgr.addIndexEvent(INDEX_EVENT_DELETED, indexDef.Name, indexDef.UUID, "")
+
 	mgr.GetIndexDefs(true)
 	mgr.PlannerKick("api/DeleteIndex, indexName: " + indexName)
 	atomic.AddUint64(&mgr.stats.TotDeleteIndexOk, 1)
@@ -428,48 +613,112 @@ func (mgr *Manager) BumpIndexDefs(indexDefsUUID string) error {
 // sourceType and sourceName.
 func (mgr *Manager) DeleteAllIndexFromSource(
 	sourceType, sourceName, sourceUUID string) error {
+	_, err := mgr.DeleteIndexesBySource(sourceType, sourceName, sourceUUID,
+		false)
+	return err
+}
+
+// DeleteIndexesBySource deletes all the index definitions of a
+// source, such as when a source bucket or topic has been dropped, and
+// returns the sorted names of the affected indexes.  An index matches
+// when its sourceType and sourceName are the same, and when its
+// sourceUUID is the same, unless either sourceUUID is "".  With
+// dryRun, the affected indexes are only listed and not deleted.
+// While the OpQuorum is enabled, the OP_QUORUM_DELETE_INDEX of each
+// affected index must be confirmed first.
+func (mgr *Manager) DeleteIndexesBySource(
+	sourceType, sourceName, sourceUUID string, dryRun bool) (
+	[]string, error) {
 	mgr.m.Lock()
 
 	indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
 	if err != nil {
 		mgr.m.Unlock()
-		return err
+		return nil, err
 	}
 	if indexDefs == nil {
 		mgr.m.Unlock()
-		return fmt.Errorf("manager_api: DeleteAllIndexFromSource, no indexDefs")
+		return nil, fmt.Errorf("manager_api: DeleteIndexesBySource," +
+			" no indexDefs")
 	}
 	if VersionGTE(mgr.version, indexDefs.ImplVersion) == false {
 		mgr.m.Unlock()
-		return fmt.Errorf("manager_api: DeleteAllIndexFromSource,"+
+		return nil, fmt.Errorf("manager_api: DeleteIndexesBySource,"+
 			" indexDefs.ImplVersion: %s > mgr.version: %s",
 			indexDefs.ImplVersion, mgr.version)
 	}
 
-	var deletedCount uint64
-	for indexName, indexDef := range indexDefs.IndexDefs {
-		if indexDef.SourceType == sourceType &&
-			indexDef.SourceName == sourceName {
-			if sourceUUID != "" && indexDef.SourceUUID != "" &&
-				sourceUUID != indexDef.SourceUUID {
-				continue
-			}
+	indexNames := IndexNamesForSource(indexDefs,
+		sourceType, sourceName, sourceUUID)
 
-			atomic.AddUint64(&mgr.stats.TotDeleteIndexBySource, 1)
-			delete(indexDefs.IndexDefs, indexName)
+	// exit early if nothing to delete
+	if dryRun || len(indexNames) == 0 {
+		mgr.m.Unlock()
+		return indexNames, nil
+	}
+
+	// As with DeleteIndexEx(), the OP_QUORUM_DELETE_INDEX of every
+	// index must be confirmed first, where the confirmations are only
+	// consumed by the indexes that are actually deleted.
+	ops := make([]*PendingIndexOp, 0, len(indexNames))
+	for _, indexName := range indexNames {
+		ops = append(ops, &PendingIndexOp{
+			Op:        "delete",
+			IndexName: indexName,
+			IndexUUID: indexDefs.IndexDefs[indexName].UUID,
+		})
+	}
+	err = mgr.checkIndexDeletesQuorum(ops)
+	if err == ErrIndexOpQueued {
+		mgr.m.Unlock()
+		return indexNames, err
+	}
+	if err != nil {
+		mgr.m.Unlock()
+		return nil, err
+	}
+
+	// As with DeleteIndex(), the indexes go into the trash instead.
+	if mgr.Options()["indexDeleteMode"] == "soft" {
+		mgr.m.Unlock()
 
-			log.Printf("manager_api: starting index definition deletion,"+
-				" indexType: %s, indexName: %s, indexUUID: %s",
-				indexDef.Type, indexDef.Name, indexDef.UUID)
+		deleted := make([]string, 0, len(indexNames))
+		defer func() { mgr.consumeIndexDeletesQuorum(deleted) }()
 
-			deletedCount++
+		for _, indexName := range indexNames {
+			atomic.AddUint64(&mgr.stats.TotDeleteIndexBySource, 1)
+			_, err = mgr.softDeleteIndex(indexName,
+				indexDefs.IndexDefs[indexName].UUID)
+			if err != nil {
+				atomic.AddUint64(&mgr.stats.TotDeleteIndexBySourceErr, 1)
+				return indexNames, err
+			}
+			deleted = append(deleted, indexName)
+			atomic.AddUint64(&mgr.stats.TotDeleteIndexBySourceOk, 1)
 		}
+
+		log.Printf("manager_api: DeleteIndexesBySource,"+
+			" index soft deletions completed, indexNames: %v", indexNames)
+
+		return indexNames, nil
 	}
-	// exit early if nothing to delete
-	if deletedCount == 0 {
-		mgr.m.Unlock()
-		return nil
+
+	deletedDefs := make([]*IndexDef, 0, len(indexNames))
+
+	for _, indexName := range indexNames {
+		indexDef := indexDefs.IndexDefs[indexName]
+		deletedDefs = append(deletedDefs, indexDef)
+
+		atomic.AddUint64(&mgr.stats.TotDeleteIndexBySource, 1)
+		delete(indexDefs.IndexDefs, indexName)
+
+		log.Printf("manager_api: starting index definition deletion,"+
+			" indexType: %s, indexName: %s, indexUUID: %s",
+			indexDef.Type, indexDef.Name, indexDef.UUID)
 	}
+
+	deletedCount := uint64(len(indexNames))
+
 	// update the index definitions
 	indexDefs.UUID = NewUUID()
 	indexDefs.ImplVersion = CfgGetVersion(mgr.cfg)
@@ -478,11 +727,18 @@ func (mgr *Manager) DeleteAllIndexFromSource(
 
 	if err != nil {
 		atomic.AddUint64(&mgr.stats.TotDeleteIndexBySourceErr, deletedCount)
-		return fmt.Errorf("manager_api: could not save indexDefs,"+
+		return nil, fmt.Errorf("manager_api: could not save indexDefs,"+
 			" err: %v", err)
 	}
 
 	atomic.AddUint64(&mgr.stats.TotDeleteIndexBySourceOk, deletedCount)
+
+	mgr.consumeIndexDeletesQuorum(indexNames)
+
+	for _, indexDef := range deletedDefs {
+		mgr.addIndexEvent(INDEX_EVENT_DELETED, indexDef.Name, indexDef.UUID, "")
+	}
+
 	mgr.GetIndexDefs(true)
 	mgr.PlannerKick("api/DeleteIndexes, for bucket: " + sourceName)
 
@@ -491,10 +747,34 @@ func (mgr *Manager) DeleteAllIndexFromSource(
 	// indexDefs so the planner and other downstream tasks re-run.
 	err = mgr.BumpIndexDefs("")
 	if err != nil {
-		return err
+		return indexNames, err
 	}
-	log.Printf("manager_api: DeleteAllIndexFromSource," +
-		" index deletions completed")
+	log.Printf("manager_api: DeleteIndexesBySource,"+
+		" index deletions completed, indexNames: %v", indexNames)
 
-	return nil
+	return indexNames, nil
+}
+
+// IndexNamesForSource returns the sorted names of the index
+// definitions that match a source.  See DeleteIndexesBySource().
+func IndexNamesForSource(indexDefs *IndexDefs,
+	sourceType, sourceName, sourceUUID string) []string {
+	var rv []string
+	if indexDefs == nil {
+		return rv
+	}
+
+	for indexName, indexDef := range indexDefs.IndexDefs {
+		if indexDef.SourceType == sourceType &&
+			indexDef.SourceName == sourceName {
+			if sourceUUID != "" && indexDef.SourceUUID != "" &&
+				sourceUUID != indexDef.SourceUUID {
+				continue
+			}
+			rv = append(rv, indexName)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv
 }
@@ -0,0 +1,112 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_CFG_PING_INTERVAL is how often a manager checks that its
+// Cfg subscriptions are alive, which may be overridden by the
+// "cfgPingInterval" manager option, where "0" disables the checks.
+const DEFAULT_CFG_PING_INTERVAL = time.Minute
+
+// DEFAULT_CFG_PING_TIMEOUT is how long a manager waits for the
+// heartbeats of its Cfg subscriptions, which may be overridden by the
+// "cfgPingTimeout" manager option.
+const DEFAULT_CFG_PING_TIMEOUT = 10 * time.Second
+
+// CfgPingLoop periodically checks that the manager's Cfg
+// subscriptions are alive, subscribing again the dead ones, until the
+// manager is stopped or the Cfg turns out to not support pings.
+func (mgr *Manager) CfgPingLoop() {
+	interval := DEFAULT_CFG_PING_INTERVAL
+	if v, err := time.ParseDuration(
+		mgr.Options()["cfgPingInterval"]); err == nil {
+		interval = v
+	}
+	if interval <= 0 || mgr.cfgHub == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			if mgr.checkCfgSubscriptionsOnce() == ErrCfgPingUnsupported {
+				mgr.log.Printf("manager_cfg_ping: cfg ping unsupported")
+				return
+			}
+		}
+	}
+}
+
+// checkCfgSubscriptionsOnce pings the manager's Cfg subscriptions,
+// and reports the dead ones, which were subscribed again, as a
+// "cfgResubscribed" event, after which the cached Cfg data is
+// refreshed, as events may have been missed.
+func (mgr *Manager) checkCfgSubscriptionsOnce() error {
+	timeout := DEFAULT_CFG_PING_TIMEOUT
+	if v, err := time.ParseDuration(
+		mgr.Options()["cfgPingTimeout"]); err == nil && v > 0 {
+		timeout = v
+	}
+
+	atomic.AddUint64(&mgr.stats.TotCfgPing, 1)
+
+	dead, err := mgr.cfgHub.CheckSubscriptions(timeout)
+	if len(dead) <= 0 {
+		if err != nil && err != ErrCfgPingUnsupported {
+			atomic.AddUint64(&mgr.stats.TotCfgPingErr, 1)
+			mgr.log.Warnf("manager_cfg_ping: ping, err: %v", err)
+		}
+		return err
+	}
+
+	atomic.AddUint64(&mgr.stats.TotCfgResubscribe, 1)
+
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+		atomic.AddUint64(&mgr.stats.TotCfgPingErr, 1)
+	}
+
+	mgr.log.Warnf("manager_cfg_ping: dead cfg subscriptions,"+
+		" keys: %v, resubscribe err: %v", dead, err)
+
+	event, _ := json.Marshal(struct {
+		Event string   `json:"event"`
+		Keys  []string `json:"keys"`
+		Err   string   `json:"err,omitempty"`
+		Time  string   `json:"time"`
+	}{"cfgResubscribed", dead, errStr, time.Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+
+	// The events that were missed while the subscriptions were dead
+	// are made up for by a refresh.
+	mgr.GetIndexDefs(true)
+	mgr.GetPlanPIndexes(true)
+	mgr.GetNodeDefs(NODE_DEFS_KNOWN, true)
+	mgr.GetNodeDefs(NODE_DEFS_WANTED, true)
+	mgr.GetNodeDefs(NODE_DEFS_STANDBY, true)
+	mgr.RefreshOptions()
+	mgr.refreshClusterFeatures()
+	mgr.PublishService()
+
+	return err
+}
@@ -0,0 +1,71 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestManagerCfgPing(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil,
+		map[string]string{"cfgPingTimeout": "50ms"})
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if err := m.checkCfgSubscriptionsOnce(); err != nil {
+		t.Errorf("expected live subscriptions, err: %v", err)
+	}
+
+	// Emulate a watch of the Cfg that silently expired.
+	cfg.m.Lock()
+	delete(cfg.subscriptions, INDEX_DEFS_KEY)
+	cfg.m.Unlock()
+
+	if err := m.checkCfgSubscriptionsOnce(); err != nil {
+		t.Errorf("expected a resubscribe, err: %v", err)
+	}
+
+	var resubscribed []string
+	m.VisitEvents(func(event []byte) {
+		if strings.Contains(string(event), `"cfgResubscribed"`) {
+			resubscribed = append(resubscribed, string(event))
+		}
+	})
+	if len(resubscribed) != 1 ||
+		!strings.Contains(resubscribed[0], `"keys":["indexDefs"]`) {
+		t.Errorf("expected a cfgResubscribed event, got: %v", resubscribed)
+	}
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotCfgPing != 2 || stats.TotCfgResubscribe != 1 {
+		t.Errorf("unexpected stats, TotCfgPing: %d, TotCfgResubscribe: %d",
+			stats.TotCfgPing, stats.TotCfgResubscribe)
+	}
+
+	cfg.m.Lock()
+	n := len(cfg.subscriptions[INDEX_DEFS_KEY])
+	cfg.m.Unlock()
+	if n != 1 {
+		t.Errorf("expected the index defs to be subscribed again, got: %d", n)
+	}
+}
@@ -0,0 +1,212 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIndexOpQueued is returned by index definition operations that
+// were queued, as the manager is degraded due to an unreachable Cfg.
+// Queued operations are applied once the Cfg is reachable again.
+var ErrIndexOpQueued = errors.New("manager_degraded: cfg unreachable," +
+	" index operation queued")
+
+// DEFAULT_CFG_PROBE_INTERVAL is how often a degraded manager checks
+// whether the Cfg is reachable again, which may be overridden by the
+// "cfgProbeIntervalMS" manager option.
+const DEFAULT_CFG_PROBE_INTERVAL = time.Second
+
+// A PendingIndexOp is an index definition operation that was queued
+// while the manager was degraded.
+type PendingIndexOp struct {
+	Op            string    `json:"op"` // "create" or "delete".
+	IndexName     string    `json:"indexName"`
+	IndexUUID     string    `json:"indexUUID,omitempty"`     // For a delete.
+	PrevIndexUUID string    `json:"prevIndexUUID,omitempty"` // For a create.
+	IndexDef      *IndexDef `json:"indexDef,omitempty"`      // For a create.
+	QueuedAt      string    `json:"queuedAt"`
+}
+
+// ManagerHealth reports whether a manager is fully operational, or
+// degraded due to an unreachable Cfg, or due to a stale plan.  While
+// degraded due to the Cfg, the manager keeps serving its existing
+// pindexes and feeds, the janitor works from the LocalPlanStore, and
+// index definition operations are queued.
+type ManagerHealth struct {
+	Status          string            `json:"status"` // "ok" or "degraded".
+	DegradedSince   string            `json:"degradedSince,omitempty"`
+	CfgErr          string            `json:"cfgErr,omitempty"`
+	PendingIndexOps []*PendingIndexOp `json:"pendingIndexOps,omitempty"`
+	StalePlan       *StalePlanStatus  `json:"stalePlan,omitempty"`
+}
+
+// Health returns the current health of the manager.
+func (mgr *Manager) Health() *ManagerHealth {
+	rv := &ManagerHealth{Status: "ok", StalePlan: mgr.StalePlan()}
+	if rv.StalePlan != nil {
+		rv.Status = "degraded"
+	}
+
+	mgr.degradedMutex.Lock()
+	defer mgr.degradedMutex.Unlock()
+
+	if mgr.degradedErr != nil {
+		rv.Status = "degraded"
+		rv.DegradedSince = mgr.degradedSince.Format(time.RFC3339Nano)
+		rv.CfgErr = mgr.degradedErr.Error()
+		rv.PendingIndexOps =
+			append([]*PendingIndexOp(nil), mgr.pendingIndexOps...)
+	}
+
+	return rv
+}
+
+// Degraded returns true when the manager is degraded due to an
+// unreachable Cfg.
+func (mgr *Manager) Degraded() bool {
+	mgr.degradedMutex.Lock()
+	rv := mgr.degradedErr != nil
+	mgr.degradedMutex.Unlock()
+	return rv
+}
+
+// enterDegraded puts the manager into the degraded state, if not
+// already, and starts probing for the Cfg to become reachable.
+func (mgr *Manager) enterDegraded(errCfg error) {
+	mgr.degradedMutex.Lock()
+	entered := mgr.degradedErr == nil
+	if entered {
+		mgr.degradedSince = time.Now()
+	}
+	mgr.degradedErr = errCfg
+	mgr.degradedMutex.Unlock()
+
+	if !entered {
+		return
+	}
+
+	atomic.AddUint64(&mgr.stats.TotDegraded, 1)
+
+	mgr.log.Warnf("manager_degraded: cfg unreachable, err: %v", errCfg)
+
+	mgr.addDegradedEvent("cfgDegraded", errCfg.Error(), 0)
+
+	go mgr.probeCfgLoop()
+}
+
+// queueIndexOp queues an index definition operation for when the Cfg
+// is reachable again, returning ErrIndexOpQueued.
+func (mgr *Manager) queueIndexOp(op *PendingIndexOp) error {
+	op.QueuedAt = time.Now().Format(time.RFC3339Nano)
+
+	mgr.degradedMutex.Lock()
+	mgr.pendingIndexOps = append(mgr.pendingIndexOps, op)
+	mgr.degradedMutex.Unlock()
+
+	atomic.AddUint64(&mgr.stats.TotIndexOpQueued, 1)
+
+	mgr.log.Printf("manager_degraded: queued index op: %s,"+
+		" indexName: %s", op.Op, op.IndexName)
+
+	return ErrIndexOpQueued
+}
+
+// probeCfgLoop waits for the Cfg to be reachable again, and then
+// reconciles the manager.
+func (mgr *Manager) probeCfgLoop() {
+	interval := DEFAULT_CFG_PROBE_INTERVAL
+	if v, err := strconv.Atoi(mgr.Options()["cfgProbeIntervalMS"]); err == nil && v > 0 {
+		interval = time.Duration(v) * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			_, _, err := CfgGetPlanPIndexes(mgr.cfg)
+			if err != nil {
+				mgr.degradedMutex.Lock()
+				mgr.degradedErr = err
+				mgr.degradedMutex.Unlock()
+				continue
+			}
+
+			mgr.reconcileDegraded()
+			return
+		}
+	}
+}
+
+// reconcileDegraded leaves the degraded state, applies the queued
+// index definition operations in order, and then kicks the planner
+// and janitor to catch up with the Cfg.
+func (mgr *Manager) reconcileDegraded() {
+	mgr.degradedMutex.Lock()
+	ops := mgr.pendingIndexOps
+	mgr.pendingIndexOps = nil
+	mgr.degradedErr = nil
+	mgr.degradedMutex.Unlock()
+
+	mgr.log.Printf("manager_degraded: cfg reachable, pending index ops: %d",
+		len(ops))
+
+	mgr.addDegradedEvent("cfgRecovered", "", len(ops))
+
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "create":
+			d := op.IndexDef
+			_, err = mgr.CreateIndexEx(d.SourceType, d.SourceName,
+				d.SourceUUID, d.SourceParams, d.Type, d.Name, d.Params,
+				d.PlanParams, op.PrevIndexUUID)
+		case "delete":
+			_, err = mgr.DeleteIndexEx(op.IndexName, op.IndexUUID)
+		}
+
+		if err == ErrIndexOpQueued {
+			// The Cfg became unreachable again, so keep the
+			// remaining ops queued, in order, after the requeued op.
+			mgr.degradedMutex.Lock()
+			mgr.pendingIndexOps = append(mgr.pendingIndexOps, ops[i+1:]...)
+			mgr.degradedMutex.Unlock()
+			return
+		}
+
+		if err != nil {
+			mgr.log.Warnf("manager_degraded: queued index op: %s,"+
+				" indexName: %s, err: %v", op.Op, op.IndexName, err)
+		}
+	}
+
+	mgr.Kick("manager_degraded: cfg reachable")
+}
+
+func (mgr *Manager) addDegradedEvent(name, errStr string,
+	pendingIndexOps int) {
+	event, _ := json.Marshal(struct {
+		Event           string `json:"event"`
+		CfgErr          string `json:"cfgErr,omitempty"`
+		PendingIndexOps int    `json:"pendingIndexOps"`
+		Time            string `json:"time"`
+	}{name, errStr, pendingIndexOps, time.Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+}
@@ -0,0 +1,108 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// downCfg fails its reads and writes while down is non-zero.
+type downCfg struct {
+	Cfg
+	down int32
+}
+
+func (c *downCfg) Get(key string, cas uint64) ([]byte, uint64, error) {
+	if atomic.LoadInt32(&c.down) != 0 {
+		return nil, 0, fmt.Errorf("cfg down")
+	}
+	return c.Cfg.Get(key, cas)
+}
+
+func (c *downCfg) Set(key string, val []byte, cas uint64) (uint64, error) {
+	if atomic.LoadInt32(&c.down) != 0 {
+		return 0, fmt.Errorf("cfg down")
+	}
+	return c.Cfg.Set(key, val, cas)
+}
+
+func TestManagerDegraded(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := &downCfg{Cfg: NewCfgMem()}
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil,
+		map[string]string{"cfgProbeIntervalMS": "10"})
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	sourceParams := "{\"numPartitions\":1}"
+	if err := m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	if h := m.Health(); h.Status != "ok" {
+		t.Errorf("expected ok health, got: %#v", h)
+	}
+
+	atomic.StoreInt32(&cfg.down, 1)
+
+	if _, err := m.DeleteIndexEx("foo", ""); err != ErrIndexOpQueued {
+		t.Errorf("expected queued delete, err: %v", err)
+	}
+	if err := m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", "bar", "", PlanParams{}, ""); err != ErrIndexOpQueued {
+		t.Errorf("expected queued create, err: %v", err)
+	}
+
+	h := m.Health()
+	if h.Status != "degraded" || h.CfgErr == "" ||
+		len(h.PendingIndexOps) != 2 ||
+		h.PendingIndexOps[0].Op != "delete" ||
+		h.PendingIndexOps[1].Op != "create" {
+		t.Errorf("expected degraded health with 2 ops, got: %#v", h)
+	}
+
+	if _, pindexes := m.CurrentMaps(); len(pindexes) != 1 {
+		t.Errorf("expected pindex to be kept, got: %d", len(pindexes))
+	}
+
+	atomic.StoreInt32(&cfg.down, 0)
+
+	var indexDefs *IndexDefs
+	var err error
+	for i := 0; i < 200; i++ {
+		indexDefs, _, err = CfgGetIndexDefs(cfg)
+		if err == nil && indexDefs.IndexDefs["bar"] != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h := m.Health(); h.Status != "ok" {
+		t.Fatalf("expected recovered health, got: %#v", h)
+	}
+	if err != nil || indexDefs == nil ||
+		indexDefs.IndexDefs["foo"] != nil || indexDefs.IndexDefs["bar"] == nil {
+		t.Errorf("expected queued ops to be applied, got: %#v, err: %v",
+			indexDefs, err)
+	}
+}
@@ -0,0 +1,367 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/blugelabs/blance"
+)
+
+// A PlanExplanation reports why the planner placed the pindexes of an
+// index onto their nodes, as assembled from two simulated planner
+// runs against the current Cfg: one that starts from the current plan,
+// like the planner does, and a fresh one that ignores the index's
+// current plan, which tells the placements that are only held by
+// stickiness.
+type PlanExplanation struct {
+	IndexName string `json:"indexName"`
+	IndexUUID string `json:"indexUUID"`
+
+	// NodeOrder is the order of the nodes, rotated by the index name,
+	// in which blance breaks its ties, see NodeUUIDsForIndex().
+	NodeOrder     []string          `json:"nodeOrder"`
+	NodesToAdd    []string          `json:"nodesToAdd,omitempty"`
+	NodesToRemove []string          `json:"nodesToRemove,omitempty"`
+	NodeWeights   map[string]int    `json:"nodeWeights,omitempty"`
+	NodeHierarchy map[string]string `json:"nodeHierarchy,omitempty"`
+
+	// HierarchyRules are the rules that were applied, where
+	// HierarchyRulesDefault means they are the default rack-awareness
+	// rule, as the index has none of its own, see IndexHierarchyRules().
+	HierarchyRules        blance.HierarchyRules `json:"hierarchyRules,omitempty"`
+	HierarchyRulesDefault bool                  `json:"hierarchyRulesDefault,omitempty"`
+
+	PIndexes []*PIndexExplanation `json:"pindexes"` // Sorted by name.
+	Warnings []string             `json:"warnings,omitempty"`
+}
+
+// A PIndexExplanation reports the placement of one pindex.
+type PIndexExplanation struct {
+	Name             string             `json:"name"`
+	SourcePartitions string             `json:"sourcePartitions"`
+	Nodes            []*NodeExplanation `json:"nodes"` // By priority.
+
+	// FreshNodes are the nodes, by priority, that a fresh plan would
+	// choose for the pindex.
+	FreshNodes []string `json:"freshNodes"`
+}
+
+// A NodeExplanation reports why a pindex was placed onto a node.
+type NodeExplanation struct {
+	UUID      string   `json:"uuid"`
+	Priority  int      `json:"priority"`
+	State     string   `json:"state"` // "primary" or "replica".
+	Weight    int      `json:"weight,omitempty"`
+	Ancestors []string `json:"ancestors,omitempty"` // Such as rack, zone.
+	Reasons   []string `json:"reasons"`
+}
+
+// ExplainPlan explains the placement of an index's pindexes, where
+// the name is either an index name, or a pindex name, which limits
+// the explanation to that pindex.
+func (mgr *Manager) ExplainPlan(name string) (*PlanExplanation, error) {
+	indexDefs, nodeDefs, planPIndexesPrev, _, err :=
+		PlannerGetPlan(mgr.log, mgr.cfg, mgr.version, "")
+	if err != nil {
+		return nil, fmt.Errorf("manager_explain: PlannerGetPlan,"+
+			" name: %s, err: %v", name, err)
+	}
+
+	indexName, pindexName := name, ""
+	if indexDefs.IndexDefs[name] == nil {
+		planPIndex := planPIndexesPrev.PlanPIndexes[name]
+		if planPIndex == nil {
+			return nil, fmt.Errorf("manager_explain: no index or pindex,"+
+				" name: %s", name)
+		}
+		indexName, pindexName = planPIndex.IndexName, name
+	}
+
+	rv, err := CalcPlanExplanation(mgr.log, indexDefs, nodeDefs,
+		planPIndexesPrev, indexName, CfgGetVersion(mgr.cfg), mgr.server,
+		mgr.Options())
+	if err != nil || pindexName == "" {
+		return rv, err
+	}
+
+	// The pindex name changes with the index UUID, so match the
+	// pindex of the explanation by its source partitions.
+	sourcePartitions :=
+		planPIndexesPrev.PlanPIndexes[pindexName].SourcePartitions
+
+	pindexes := rv.PIndexes
+	rv.PIndexes = []*PIndexExplanation{}
+	for _, p := range pindexes {
+		if p.SourcePartitions == sourcePartitions {
+			rv.PIndexes = append(rv.PIndexes, p)
+		}
+	}
+
+	return rv, nil
+}
+
+// CalcPlanExplanation explains the placement of the pindexes of the
+// named index, by running the planner for just that index, once from
+// the planPIndexesPrev, and once from scratch.
+func CalcPlanExplanation(log Log, indexDefs *IndexDefs,
+	nodeDefs *NodeDefs, planPIndexesPrev *PlanPIndexes,
+	indexName string, version, server string,
+	options map[string]string) (*PlanExplanation, error) {
+	if indexDefs == nil || indexDefs.IndexDefs[indexName] == nil {
+		return nil, fmt.Errorf("manager_explain: no index,"+
+			" indexName: %s", indexName)
+	}
+	if nodeDefs == nil {
+		return nil, fmt.Errorf("manager_explain: no nodeDefs")
+	}
+	if planPIndexesPrev == nil {
+		planPIndexesPrev = NewPlanPIndexes(version)
+	}
+
+	indexDef := indexDefs.IndexDefs[indexName]
+
+	onlyIndex := func(def *IndexDef, prev, curr *PlanPIndexes) bool {
+		return def.Name == indexName
+	}
+
+	planPIndexes, err := CalcPlan(log, "", indexDefs, nodeDefs,
+		planPIndexesPrev, version, server, options, onlyIndex)
+	if err != nil {
+		return nil, fmt.Errorf("manager_explain: CalcPlan,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	// The fresh run starts from a plan without the index's pindexes.
+	planPIndexesFresh := NewPlanPIndexes(version)
+	for name, p := range planPIndexesPrev.PlanPIndexes {
+		if p.IndexName != indexName {
+			planPIndexesFresh.PlanPIndexes[name] = p
+		}
+	}
+
+	planPIndexesFresh, err = CalcPlan(log, "", indexDefs, nodeDefs,
+		planPIndexesFresh, version, server, options, onlyIndex)
+	if err != nil {
+		return nil, fmt.Errorf("manager_explain: CalcPlan fresh,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+	if planPIndexes == nil || planPIndexesFresh == nil {
+		return nil, fmt.Errorf("manager_explain: no plan,"+
+			" indexName: %s", indexName)
+	}
+
+	nodeUUIDsAll, nodeUUIDsToAdd, nodeUUIDsToRemove, nodeWeights,
+		nodeHierarchy := CalcNodesLayout(indexDefs, nodeDefs, planPIndexesPrev)
+
+	rv := &PlanExplanation{
+		IndexName:     indexName,
+		IndexUUID:     indexDef.UUID,
+		NodeOrder:     NodeUUIDsForIndex(indexName, nodeUUIDsAll),
+		NodesToAdd:    nodeUUIDsToAdd,
+		NodesToRemove: nodeUUIDsToRemove,
+		NodeWeights:   nodeWeights,
+		NodeHierarchy: nodeHierarchy,
+		PIndexes:      []*PIndexExplanation{},
+		Warnings:      planPIndexes.Warnings[indexName],
+	}
+
+	tiered := len(indexDef.PlanParams.PrimaryNodeTags) > 0 ||
+		len(indexDef.PlanParams.ReplicaNodeTags) > 0
+	if !tiered {
+		rv.HierarchyRules = IndexHierarchyRules(indexDef, nodeHierarchy)
+		rv.HierarchyRulesDefault = rv.HierarchyRules != nil &&
+			indexDef.PlanParams.HierarchyRules == nil
+	}
+
+	prevNodes := planNodesBySourcePartitions(indexName, planPIndexesPrev)
+	freshNodes := planNodesBySourcePartitions(indexName, planPIndexesFresh)
+
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.IndexName != indexName {
+			continue
+		}
+
+		p := &PIndexExplanation{
+			Name:             planPIndex.Name,
+			SourcePartitions: planPIndex.SourcePartitions,
+			Nodes:            []*NodeExplanation{},
+			FreshNodes:       []string{},
+		}
+
+		fresh := freshNodes[planPIndex.SourcePartitions]
+		for _, ref := range sortedPlanPIndexNodeRefs(fresh) {
+			p.FreshNodes = append(p.FreshNodes, ref.UUID)
+		}
+
+		refs := sortedPlanPIndexNodeRefs(planPIndex.Nodes)
+		for _, ref := range refs {
+			p.Nodes = append(p.Nodes, explainNode(indexDef, planPIndex,
+				ref, refs, prevNodes[planPIndex.SourcePartitions], fresh,
+				nodeDefs, nodeWeights, nodeHierarchy, rv.HierarchyRules,
+				tiered))
+		}
+
+		rv.PIndexes = append(rv.PIndexes, p)
+	}
+
+	sort.Slice(rv.PIndexes, func(i, j int) bool {
+		return rv.PIndexes[i].Name < rv.PIndexes[j].Name
+	})
+
+	return rv, nil
+}
+
+// explainNode assembles the reasons for a node assignment of a pindex,
+// where refs are all the node assignments of the pindex.
+func explainNode(indexDef *IndexDef, planPIndex *PlanPIndex,
+	ref *PlanPIndexNodeRef, refs PlanPIndexNodeRefs,
+	prev, fresh map[string]*PlanPIndexNode, nodeDefs *NodeDefs,
+	nodeWeights map[string]int, nodeHierarchy map[string]string,
+	hierarchyRules blance.HierarchyRules, tiered bool) *NodeExplanation {
+	state := "replica"
+	if ref.Node.Priority <= 0 {
+		state = "primary"
+	}
+
+	n := &NodeExplanation{
+		UUID:      ref.UUID,
+		Priority:  ref.Node.Priority,
+		State:     state,
+		Weight:    nodeWeights[ref.UUID],
+		Ancestors: nodeAncestors(ref.UUID, nodeHierarchy),
+		Reasons:   []string{},
+	}
+
+	reason := func(format string, args ...interface{}) {
+		n.Reasons = append(n.Reasons, fmt.Sprintf(format, args...))
+	}
+
+	for _, pin := range indexDef.PlanParams.PIndexPins {
+		if pin.pinMatches(planPIndex) {
+			for i, nodeUUID := range pin.Nodes {
+				if nodeUUID == ref.UUID {
+					reason("pinned as copy #%d by planParams.pindexPins", i)
+				}
+			}
+			break // The first matching pin wins.
+		}
+	}
+
+	if tiered {
+		tags := indexDef.PlanParams.ReplicaNodeTags
+		if state == "primary" {
+			tags = indexDef.PlanParams.PrimaryNodeTags
+		}
+		reason("tiered placement onto the nodes with tags: %v", tags)
+	}
+
+	if p, exists := prev[ref.UUID]; exists {
+		if (p.Priority <= 0) == (state == "primary") {
+			reason("sticky: kept from the previous plan")
+		} else {
+			reason("kept from the previous plan, but changed state")
+		}
+	} else {
+		reason("new: not in the previous plan")
+	}
+
+	if f, exists := fresh[ref.UUID]; exists {
+		if (f.Priority <= 0) == (state == "primary") {
+			reason("chosen by a fresh plan too")
+		} else {
+			reason("chosen by a fresh plan too, but as a different state")
+		}
+	} else if len(fresh) > 0 {
+		reason("not chosen by a fresh plan, so held by stickiness" +
+			" or a pin")
+	}
+
+	if n.Weight > 0 {
+		reason("node weight: %d", n.Weight)
+	}
+
+	if nodeDef := nodeDefs.NodeDefs[ref.UUID]; nodeDef != nil &&
+		nodeDef.NoAccept {
+		reason("node refuses new pindexes (noAccept), so only" +
+			" keeps its running pindexes")
+	}
+
+	// Report the other copies in the same container, which is the
+	// usual question about replicas that landed in the same rack.
+	if len(n.Ancestors) > 0 {
+		excluded := false
+		for _, rule := range hierarchyRules[state] {
+			if rule.ExcludeLevel >= 1 {
+				excluded = true
+			}
+		}
+		for _, other := range refs {
+			if other.UUID == ref.UUID ||
+				nodeHierarchy[other.UUID] != n.Ancestors[0] {
+				continue
+			}
+			if excluded {
+				reason("shares container %s with node %s, though the"+
+					" hierarchy rules exclude it, for lack of a node"+
+					" in another container",
+					n.Ancestors[0], other.UUID)
+			} else {
+				reason("shares container %s with node %s, as no"+
+					" hierarchy rule for the %s state excludes it",
+					n.Ancestors[0], other.UUID, state)
+			}
+		}
+	}
+
+	return n
+}
+
+// planNodesBySourcePartitions returns the node assignments of an
+// index's planPIndexes, keyed by their source partitions, which unlike
+// the planPIndex names don't change with the index UUID.
+func planNodesBySourcePartitions(indexName string,
+	planPIndexes *PlanPIndexes) map[string]map[string]*PlanPIndexNode {
+	rv := map[string]map[string]*PlanPIndexNode{}
+	if planPIndexes != nil {
+		for _, p := range planPIndexes.PlanPIndexes {
+			if p.IndexName == indexName {
+				rv[p.SourcePartitions] = p.Nodes
+			}
+		}
+	}
+	return rv
+}
+
+// sortedPlanPIndexNodeRefs returns node assignments by priority.
+func sortedPlanPIndexNodeRefs(
+	nodes map[string]*PlanPIndexNode) PlanPIndexNodeRefs {
+	refs := PlanPIndexNodeRefs{}
+	for nodeUUID, node := range nodes {
+		refs = append(refs, &PlanPIndexNodeRef{UUID: nodeUUID, Node: node})
+	}
+	sort.Sort(refs)
+	return refs
+}
+
+// nodeAncestors returns the containers of a node, nearest first.
+func nodeAncestors(nodeUUID string, nodeHierarchy map[string]string) []string {
+	var rv []string
+	seen := map[string]bool{nodeUUID: true}
+	for parent := nodeHierarchy[nodeUUID]; parent != "" &&
+		!seen[parent]; parent = nodeHierarchy[parent] {
+		seen[parent] = true
+		rv = append(rv, parent)
+	}
+	return rv
+}
@@ -0,0 +1,150 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func hasReason(n *NodeExplanation, prefix string) bool {
+	for _, reason := range n.Reasons {
+		if strings.HasPrefix(reason, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCalcPlanExplanationSameRack(t *testing.T) {
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["foo"] = &IndexDef{
+		Type:         "blackhole",
+		Name:         "foo",
+		UUID:         "fooUUID",
+		SourceType:   "primary",
+		SourceParams: "{\"numPartitions\":2}",
+		PlanParams:   PlanParams{MaxPartitionsPerPIndex: 2, NumReplicas: 1},
+	}
+
+	nodeDefs := NewNodeDefs(Version)
+	for _, n := range []string{"a", "b"} {
+		nodeDefs.NodeDefs[n] = &NodeDef{
+			UUID:        n,
+			HostPort:    n,
+			Container:   "dc/r1",
+			ImplVersion: Version,
+		}
+	}
+
+	log := NewStdLibLog(ioutil.Discard, "", 0)
+
+	rv, err := CalcPlanExplanation(log, indexDefs, nodeDefs, nil,
+		"foo", Version, "", nil)
+	if err != nil {
+		t.Fatalf("expected explanation, err: %v", err)
+	}
+	if !rv.HierarchyRulesDefault || rv.HierarchyRules == nil {
+		t.Errorf("expected the default hierarchy rules, got: %#v", rv)
+	}
+	if len(rv.Warnings) != 1 ||
+		!strings.HasPrefix(rv.Warnings[0], "hierarchy rule #0") {
+		t.Errorf("expected a hierarchy rule warning, got: %v", rv.Warnings)
+	}
+	if len(rv.NodeOrder) != 2 {
+		t.Errorf("expected 2 nodes in the node order, got: %v",
+			rv.NodeOrder)
+	}
+	if len(rv.PIndexes) != 1 {
+		t.Fatalf("expected 1 pindex, got: %#v", rv.PIndexes)
+	}
+
+	p := rv.PIndexes[0]
+	if len(p.Nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got: %#v", p.Nodes)
+	}
+	if p.Nodes[0].State != "primary" || p.Nodes[1].State != "replica" {
+		t.Errorf("unexpected states: %#v", p.Nodes)
+	}
+	if !reflect.DeepEqual(p.Nodes[0].Ancestors, []string{"r1", "dc"}) {
+		t.Errorf("unexpected ancestors: %v", p.Nodes[0].Ancestors)
+	}
+	if !hasReason(p.Nodes[0], "new:") ||
+		!hasReason(p.Nodes[0], "chosen by a fresh plan") {
+		t.Errorf("expected a new, fresh placement, got: %v",
+			p.Nodes[0].Reasons)
+	}
+	if !hasReason(p.Nodes[1], "shares container r1 with node "+
+		p.Nodes[0].UUID+", though") {
+		t.Errorf("expected the same rack reason, got: %v",
+			p.Nodes[1].Reasons)
+	}
+
+	if _, err = CalcPlanExplanation(log, indexDefs, nodeDefs, nil,
+		"notAnIndex", Version, "", nil); err == nil {
+		t.Errorf("expected err on missing index")
+	}
+}
+
+func TestManagerExplainPlan(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	sourceParams := "{\"numPartitions\":4}"
+	planParams := PlanParams{MaxPartitionsPerPIndex: 1}
+	if err := m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "", planParams, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+
+	if _, err := m.ExplainPlan("notAnIndex"); err == nil {
+		t.Errorf("expected err on missing index")
+	}
+
+	rv, err := m.ExplainPlan("foo")
+	if err != nil {
+		t.Fatalf("expected explanation, err: %v", err)
+	}
+	if len(rv.PIndexes) != 4 {
+		t.Fatalf("expected 4 pindexes, got: %d", len(rv.PIndexes))
+	}
+	for _, p := range rv.PIndexes {
+		if len(p.Nodes) != 1 || p.Nodes[0].UUID != m.UUID() ||
+			!hasReason(p.Nodes[0], "sticky:") {
+			t.Errorf("expected a sticky placement, got: %#v", p.Nodes)
+		}
+	}
+
+	planPIndexes, _, _ := CfgGetPlanPIndexes(cfg)
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		rv, err = m.ExplainPlan(name)
+		if err != nil {
+			t.Fatalf("expected pindex explanation, err: %v", err)
+		}
+		if rv.IndexName != "foo" || len(rv.PIndexes) != 1 ||
+			rv.PIndexes[0].SourcePartitions != planPIndex.SourcePartitions {
+			t.Errorf("unexpected pindex explanation: %#v", rv)
+		}
+		break
+	}
+}
@@ -0,0 +1,185 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of InvariantViolation.
+const (
+	// A planPIndex is assigned to this node, but no pindex is
+	// registered for it.
+	InvariantPIndexMissing = "pindexMissing"
+
+	// A registered pindex no longer matches its planPIndex, such as
+	// after an index definition change.
+	InvariantPIndexMismatch = "pindexMismatch"
+
+	// A registered pindex isn't assigned to this node by the plan.
+	InvariantPIndexUnplanned = "pindexUnplanned"
+
+	// A pindex that the plan allows to be written has no feed.
+	InvariantFeedMissing = "feedMissing"
+)
+
+// An InvariantViolation is a disagreement between the plan and the
+// pindexes and feeds that are running on this node.
+type InvariantViolation struct {
+	Kind   string `json:"kind"`
+	PIndex string `json:"pindex"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// CheckInvariants cross-checks the plan against this node's pindexes
+// and feeds, returning the violations sorted by pindex and kind.  As
+// the janitor converges asynchronously, a single check might include
+// transient violations; see InvariantsLoop.
+func (mgr *Manager) CheckInvariants() ([]*InvariantViolation, error) {
+	planPIndexes, _, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, err
+	}
+	if planPIndexes == nil {
+		planPIndexes = NewPlanPIndexes(mgr.version)
+	}
+
+	feeds, pindexes := mgr.CurrentMaps()
+
+	var rv []*InvariantViolation
+
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		node := planPIndex.Nodes[mgr.uuid]
+		if node == nil {
+			continue
+		}
+
+		pindex := pindexes[name]
+		if pindex == nil {
+			if !mgr.bootingPIndex(name) {
+				rv = append(rv, &InvariantViolation{
+					Kind: InvariantPIndexMissing, PIndex: name})
+			}
+			continue
+		}
+
+		if !PIndexMatchesPlan(pindex, planPIndex) {
+			rv = append(rv, &InvariantViolation{
+				Kind: InvariantPIndexMismatch, PIndex: name,
+				Detail: fmt.Sprintf("indexUUID: %s, planned indexUUID: %s",
+					pindex.IndexUUID, planPIndex.IndexUUID)})
+			continue
+		}
+
+		if node.CanWrite && pindex.Dest != nil &&
+			!feedsHaveDest(feeds, pindex.Dest) {
+			rv = append(rv, &InvariantViolation{
+				Kind: InvariantFeedMissing, PIndex: name})
+		}
+	}
+
+	for name := range pindexes {
+		planPIndex := planPIndexes.PlanPIndexes[name]
+		if planPIndex == nil || planPIndex.Nodes[mgr.uuid] == nil {
+			rv = append(rv, &InvariantViolation{
+				Kind: InvariantPIndexUnplanned, PIndex: name})
+		}
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].PIndex != rv[j].PIndex {
+			return rv[i].PIndex < rv[j].PIndex
+		}
+		return rv[i].Kind < rv[j].Kind
+	})
+
+	return rv, nil
+}
+
+func feedsHaveDest(feeds map[string]Feed, dest Dest) bool {
+	for _, feed := range feeds {
+		for _, d := range feed.Dests() {
+			if unwrapFeedDest(d) == dest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------
+
+// InvariantsLoop periodically runs CheckInvariants, when enabled by
+// the "invariantsCheckInterval" manager option, such as "1m".  Only
+// the violations that persist across two consecutive checks are
+// reported, as events, warnings and stats, so that the janitor's
+// in-flight work isn't mistaken for drift.
+func (mgr *Manager) InvariantsLoop() {
+	interval, err := time.ParseDuration(mgr.Options()["invariantsCheckInterval"])
+	if err != nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prev map[InvariantViolation]bool
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			prev = mgr.checkInvariantsOnce(prev)
+		}
+	}
+}
+
+// checkInvariantsOnce reports the violations that were also in the
+// previous check, and returns the current violations.
+func (mgr *Manager) checkInvariantsOnce(
+	prev map[InvariantViolation]bool) map[InvariantViolation]bool {
+	atomic.AddUint64(&mgr.stats.TotInvariantsCheck, 1)
+
+	violations, err := mgr.CheckInvariants()
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotInvariantsCheckErr, 1)
+		mgr.log.Warnf("manager_invariants: check, err: %v", err)
+		return prev
+	}
+
+	curr := map[InvariantViolation]bool{}
+	for _, v := range violations {
+		curr[*v] = true
+		if !prev[*v] {
+			continue
+		}
+
+		atomic.AddUint64(&mgr.stats.TotInvariantsViolation, 1)
+
+		mgr.log.Warnf("manager_invariants: violation, kind: %s,"+
+			" pindex: %s, detail: %s", v.Kind, v.PIndex, v.Detail)
+
+		event, _ := json.Marshal(struct {
+			Event string `json:"event"`
+			*InvariantViolation
+			Time string `json:"time"`
+		}{"invariantViolation", v, Now().Format(time.RFC3339Nano)})
+		mgr.AddEvent(event)
+	}
+
+	return curr
+}
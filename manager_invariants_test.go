@@ -0,0 +1,92 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManagerCheckInvariants(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+
+	go func() {
+		for r := range m.plannerCh {
+			close(r.resCh)
+		}
+	}()
+
+	if err := m.CreateIndex("primary", "default", "123", "{}",
+		"blackhole", "x", "{}", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	if _, err := m.PlannerOnce("test"); err != nil {
+		t.Fatalf("expected PlannerOnce() to work, err: %v", err)
+	}
+
+	violations, err := m.CheckInvariants()
+	if err != nil || len(violations) != 1 ||
+		violations[0].Kind != InvariantPIndexMissing {
+		t.Errorf("expected a missing pindex before the janitor,"+
+			" violations: %#v, err: %v", violations, err)
+	}
+
+	if err = m.JanitorOnce("test"); err != nil {
+		t.Fatalf("expected JanitorOnce() to work, err: %v", err)
+	}
+
+	violations, err = m.CheckInvariants()
+	if err != nil || len(violations) != 0 {
+		t.Errorf("expected no violations after the janitor,"+
+			" violations: %#v, err: %v", violations, err)
+	}
+
+	feeds, _ := m.CurrentMaps()
+	for _, feed := range feeds {
+		if err = m.stopFeed(feed); err != nil {
+			t.Fatalf("expected stopFeed() to work, err: %v", err)
+		}
+	}
+
+	prev := m.checkInvariantsOnce(nil)
+	if len(prev) != 1 || m.stats.TotInvariantsViolation != 0 {
+		t.Errorf("expected a first violation to not be reported,"+
+			" prev: %#v, stats: %#v", prev, m.stats)
+	}
+
+	m.checkInvariantsOnce(prev)
+	if m.stats.TotInvariantsCheck != 2 || m.stats.TotInvariantsViolation != 1 {
+		t.Errorf("expected a persistent violation to be reported,"+
+			" stats: %#v", m.stats)
+	}
+
+	var found bool
+	m.VisitEvents(func(event []byte) {
+		if bytes.Contains(event, []byte(`"invariantViolation"`)) &&
+			bytes.Contains(event, []byte(`"`+InvariantFeedMissing+`"`)) {
+			found = true
+		}
+	})
+	if !found {
+		t.Errorf("expected an invariantViolation event")
+	}
+}
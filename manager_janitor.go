@@ -56,22 +56,33 @@ func (mgr *Manager) JanitorKick(msg string) {
 
 // JanitorLoop is the main loop for the janitor.
 func (mgr *Manager) JanitorLoop() {
-	if mgr.cfg != nil { // Might be nil for testing.
-		go func() {
-			ec := make(chan CfgEvent)
-			mgr.cfg.Subscribe(PLAN_PINDEXES_KEY, ec)
-			mgr.cfg.Subscribe(PLAN_PINDEXES_DIRECTORY_STAMP, ec)
-			mgr.cfg.Subscribe(CfgNodeDefsKey(NODE_DEFS_WANTED), ec)
-			for {
-				select {
-				case <-mgr.stopCh:
-					return
-				case e := <-ec:
-					atomic.AddUint64(&mgr.stats.TotJanitorSubscriptionEvent, 1)
-					mgr.JanitorKick("cfg changed, key: " + e.Key)
-				}
+	if mgr.cfgHub != nil { // Might be nil for testing.
+		mgr.applyFeedRestarts(true)
+		go mgr.applyRollingRestart(true)
+
+		sub, err := mgr.cfgHub.Subscribe([]string{
+			PLAN_PINDEXES_KEY,
+			PLAN_PINDEXES_DIRECTORY_STAMP,
+			CfgNodeDefsKey(NODE_DEFS_WANTED),
+			FEED_RESTARTS_KEY,
+			ROLLING_RESTART_KEY,
+		}, func(e CfgEvent) {
+			atomic.AddUint64(&mgr.stats.TotJanitorSubscriptionEvent, 1)
+			if e.Key == FEED_RESTARTS_KEY {
+				mgr.applyFeedRestarts(false)
+				return
 			}
-		}()
+			if e.Key == ROLLING_RESTART_KEY {
+				go mgr.applyRollingRestart(false)
+				return
+			}
+			mgr.JanitorKick("cfg changed, key: " + e.Key)
+		})
+		if err != nil {
+			mgr.log.Warnf("janitor: subscribe, err: %v", err)
+		} else {
+			defer sub.Unsubscribe()
+		}
 	}
 
 	for {
@@ -104,6 +115,8 @@ func (mgr *Manager) JanitorLoop() {
 				mgr.stopPIndex(m.obj.(*PIndex), false)
 			} else if m.op == JANITOR_REMOVE_PINDEX {
 				mgr.stopPIndex(m.obj.(*PIndex), true)
+			} else if m.op == JANITOR_RESTART_FEED {
+				err = mgr.restartFeed(m.obj.(Feed))
 			} else {
 				err = fmt.Errorf("janitor: unknown op: %s, m: %#v", m.op, m)
 				atomic.AddUint64(&mgr.stats.TotJanitorUnknownErr, 1)
@@ -166,6 +179,8 @@ func (mgr *Manager) pindexesStop(removePIndexes []*PIndex) []error {
 }
 
 func (mgr *Manager) pindexesStart(addPlanPIndexes []*PlanPIndex) []error {
+	addPlanPIndexes = mgr.diskSpaceAccept(addPlanPIndexes)
+
 	var wg sync.WaitGroup
 	size := len(addPlanPIndexes)
 	requestCh := make(chan *PlanPIndex, size)
@@ -229,7 +244,12 @@ func (mgr *Manager) restartPIndex(req *pindexRestartReq) error {
 			" pindex: %s, err: %v", req.pindex.Name, err)
 	}
 	// rename the pindex folder and name as per the new plan
-	newPath := mgr.PIndexPath(req.planPIndexName)
+	newPath, err := mgr.pindexPath(req.planPIndexName)
+	if err != nil {
+		cleanDir(req.pindex.Path)
+		return fmt.Errorf("janitor: restartPIndex"+
+			" pindex: %s, err: %v", req.pindex.Name, err)
+	}
 	if newPath != req.pindex.Path {
 		err = os.Rename(req.pindex.Path, newPath)
 		if err != nil {
@@ -343,9 +363,10 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 	// because instead some planner will see that & update the plan;
 	// then relevant janitors will react by closing pindexes & feeds.
 
-	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	planPIndexes, planPIndexesCAS, err := CfgGetPlanPIndexes(mgr.cfg)
 	if err != nil {
-		return fmt.Errorf("janitor: skipped on CfgGetPlanPIndexes err: %v", err)
+		mgr.enterDegraded(err)
+		return mgr.janitorOnceLocalPlan(err)
 	}
 	if planPIndexes == nil {
 		// Might happen if janitor wins an initialization race.
@@ -394,6 +415,11 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 	// whole JanitorOnce call
 	errs = append(errs, mgr.pindexesStart(planPIndexesToAdd)...)
 
+	err = mgr.PurgeIndexTrash()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
 	var currFeeds map[string]Feed
 	currFeeds, currPIndexes = mgr.CurrentMaps()
 
@@ -430,6 +456,13 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 		}
 	}
 
+	err = mgr.publishPIndexesRunning()
+	if err != nil {
+		mgr.log.Warnf("janitor: publishPIndexesRunning, err: %v", err)
+	}
+
+	mgr.janitorPlanned(planPIndexes.UUID, planPIndexesCAS)
+
 	if len(errs) > 0 {
 		var s []string
 		for i, err := range errs {
@@ -442,6 +475,57 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 	return nil
 }
 
+// janitorOnceLocalPlan lets the janitor make progress while the Cfg
+// is unreachable, such as during a startup, by starting the missing
+// pindexes and feeds of the latest plan in the LocalPlanStore.  As
+// the local plan might be stale, nothing is removed or restarted.
+func (mgr *Manager) janitorOnceLocalPlan(errCfg error) error {
+	rec := mgr.planStore.Latest()
+	if rec == nil {
+		return fmt.Errorf("janitor: skipped on CfgGetPlanPIndexes err: %v",
+			errCfg)
+	}
+
+	feedAllotment := mgr.GetOptions()[FeedAllotmentOption]
+
+	_, currPIndexes := mgr.CurrentMaps()
+
+	addPlanPIndexes, _ := CalcPIndexesDelta(mgr.uuid, currPIndexes,
+		rec.PlanPIndexes, nil)
+
+	var planPIndexesToAdd []*PlanPIndex
+	for _, planPIndex := range addPlanPIndexes {
+		if _, exists := currPIndexes[planPIndex.Name]; !exists {
+			planPIndexesToAdd = append(planPIndexesToAdd, planPIndex)
+		}
+	}
+
+	log.Printf("janitor: using local plan, time: %s, pindexes to add: %d,"+
+		" CfgGetPlanPIndexes err: %v", rec.Time, len(planPIndexesToAdd), errCfg)
+
+	errs := mgr.pindexesStart(planPIndexesToAdd)
+
+	currFeeds, currPIndexes := mgr.CurrentMaps()
+
+	addFeeds, _ := CalcFeedsDelta(mgr.log, mgr.uuid, rec.PlanPIndexes,
+		currFeeds, currPIndexes, feedAllotment)
+	for _, addFeedTargetPIndexes := range addFeeds {
+		err := mgr.startFeed(addFeedTargetPIndexes)
+		if err != nil {
+			errs = append(errs,
+				fmt.Errorf("janitor: adding feed, err: %v", err))
+		}
+	}
+
+	var s []string
+	for i, err := range errs {
+		s = append(s, fmt.Sprintf("#%d: %v", i, err))
+	}
+
+	return fmt.Errorf("janitor: used local plan on CfgGetPlanPIndexes"+
+		" err: %v, errors: %d, %#v", errCfg, len(errs), s)
+}
+
 func classifyAddRemoveRestartPIndexes(mgr *Manager, addPlanPIndexes []*PlanPIndex,
 	removePIndexes []*PIndex) (planPIndexesToAdd []*PlanPIndex,
 	pindexesToRemove []*PIndex, pindexesToRestart []*pindexRestartReq) {
@@ -487,8 +571,8 @@ func classifyAddRemoveRestartPIndexes(mgr *Manager, addPlanPIndexes []*PlanPInde
 					SourcePartitionsPrev: getSourcePartitionsMapFromPIndexes(
 						pindexes)}
 
-				pindexImplType, exists := PIndexImplTypes[pindex.IndexType]
-				if !exists || pindexImplType == nil {
+				pindexImplType := GetPIndexImplType(pindex.IndexType)
+				if pindexImplType == nil {
 					pindexesToRemove = append(pindexesToRemove, pindexes...)
 					planPIndexesToAdd = append(planPIndexesToAdd, planPIndexes...)
 					continue
@@ -551,8 +635,8 @@ func advPIndexClassifier(mgr *Manager, indexPIndexMap map[string][]*PIndex,
 						SourcePartitionsPrev: getSourcePartitionsMapFromPIndexes(
 							[]*PIndex{pindex})}
 
-					pindexImplType, exists := PIndexImplTypes[pindex.IndexType]
-					if !exists || pindexImplType == nil {
+					pindexImplType := GetPIndexImplType(pindex.IndexType)
+					if pindexImplType == nil {
 						pindexesToRemove = append(pindexesToRemove, pindex)
 						continue
 					}
@@ -936,7 +1020,12 @@ func (mgr *Manager) startPIndex(planPIndex *PlanPIndex) error {
 	var pindex *PIndex
 	var err error
 
-	path := mgr.PIndexPath(planPIndex.Name)
+	path, err := mgr.pindexPath(planPIndex.Name)
+	if err != nil {
+		return fmt.Errorf("janitor: startPIndex, err: %v", err)
+	}
+	// Reuse the files of an undeleted index, if any.
+	mgr.restoreTrashedPIndex(path)
 	// First, try reading the path with openPIndex().  An
 	// existing path might happen during a case of rollback.
 	_, err = os.Stat(path)
@@ -989,7 +1078,7 @@ func (mgr *Manager) stopPIndex(pindex *PIndex, remove bool) error {
 	feeds, _ := mgr.CurrentMaps()
 	for _, feed := range feeds {
 		for _, dest := range feed.Dests() {
-			if dest == pindex.Dest {
+			if unwrapFeedDest(dest) == pindex.Dest {
 				err := mgr.stopFeed(feed)
 				if err != nil {
 					return err
@@ -1002,7 +1091,7 @@ func (mgr *Manager) stopPIndex(pindex *PIndex, remove bool) error {
 		buf := bytes.NewBuffer(nil)
 		buf.Write([]byte(fmt.Sprintf(
 			`{"event":"stopPIndex","name":"%s","remove":%t,"time":"%s","stats":`,
-			pindex.Name, remove, time.Now().Format(time.RFC3339Nano))))
+			pindex.Name, remove, Now().Format(time.RFC3339Nano))))
 		err := pindex.Dest.Stats(buf)
 		if err == nil {
 			buf.Write(JsonCloseBrace)
@@ -1019,12 +1108,22 @@ func (mgr *Manager) stopPIndex(pindex *PIndex, remove bool) error {
 			" pindex: %#v, pindexUnreg: %#v", pindex, pindexUnreg)
 	}
 
+	mgr.removeSeqCache(pindex)
+
 	if remove {
 		atomic.AddUint64(&mgr.stats.TotJanitorRemovePIndex, 1)
+		mgr.removeBreaker(pindex.Name)
+		mgr.removeSourceFlush(pindex.IndexUUID)
+		mgr.removeCompaction(pindex.Name)
 	} else {
 		atomic.AddUint64(&mgr.stats.TotJanitorClosePIndex, 1)
 	}
 
+	// Retain the files of soft-deleted indexes for a possible undelete.
+	if remove && mgr.isPIndexTrashed(pindex) {
+		return mgr.trashPIndex(pindex)
+	}
+
 	return pindex.Close(remove)
 }
 
@@ -1047,13 +1146,17 @@ func (mgr *Manager) startFeed(pindexes []*PIndex) error {
 				" pindex: %#v", f, feedName, pindex)
 		}
 
+		dest := mgr.wrapFlushDest(pindex, mgr.wrapSeqCacheDest(pindex,
+			mgr.wrapRateDest(pindex, mgr.wrapIngestLimitDest(pindex,
+				mgr.wrapBreakerDest(pindex)))))
+
 		addSourcePartition := func(sourcePartition string) error {
 			if _, exists := dests[sourcePartition]; exists {
 				return fmt.Errorf("janitor: startFeed collision,"+
 					" sourcePartition: %s, feedName: %s, pindex: %#v",
 					sourcePartition, feedName, pindex)
 			}
-			dests[sourcePartition] = pindex.Dest
+			dests[sourcePartition] = dest
 			return nil
 		}
 
@@ -1080,6 +1183,13 @@ func (mgr *Manager) startFeed(pindexes []*PIndex) error {
 		dests)
 }
 
+// unwrapFeedDest returns the pindex's Dest of a Dest that
+// startFeed() wrapped for a feed.
+func unwrapFeedDest(dest Dest) Dest {
+	return unwrapBreakerDest(unwrapIngestLimitDest(unwrapRateDest(
+		unwrapSeqCacheDest(unwrapFlushDest(dest)))))
+}
+
 // TODO: Need way to track dead cows (non-beef)
 // TODO: Need a way to collect these errors so REST api
 // can show them to user ("hey, perhaps you deleted a bucket
@@ -1103,7 +1213,7 @@ func (mgr *Manager) stopFeed(feed Feed) error {
 	buf := bytes.NewBuffer(nil)
 	buf.Write([]byte(fmt.Sprintf(
 		`{"event":"stopFeed","name":"%s","time":"%s","stats":`,
-		feed.Name(), time.Now().Format(time.RFC3339Nano))))
+		feed.Name(), Now().Format(time.RFC3339Nano))))
 	err := feed.Stats(buf)
 	if err == nil {
 		buf.Write(JsonCloseBrace)
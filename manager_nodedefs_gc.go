@@ -0,0 +1,203 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// NodeDefsGCOptions controls which stale known node definitions are
+// garbage collected by Manager.GCNodeDefs().
+type NodeDefsGCOptions struct {
+	// UUIDs explicitly confirms the stale nodes to remove.
+	UUIDs []string
+
+	// MaxAge, when > 0, removes nodes that this manager has observed
+	// as stale for at least MaxAge, even if not explicitly confirmed.
+	// When 0, the "nodeDefsGCMaxAge" manager option is used, if any.
+	MaxAge time.Duration
+
+	// DryRun only reports the nodes that would be removed.
+	DryRun bool
+}
+
+// NodeDefsGCResult reports the outcome of a Manager.GCNodeDefs().
+type NodeDefsGCResult struct {
+	Stale   []string `json:"stale"`   // All currently stale node UUIDs.
+	Removed []string `json:"removed"` // Removed (or removable on DryRun).
+}
+
+// CalcStaleNodeDefs returns the sorted UUIDs of known node
+// definitions that are neither wanted nor assigned any pindex in the
+// plan, such as the nodes of long decommissioned machines.
+func CalcStaleNodeDefs(nodeDefsKnown, nodeDefsWanted *NodeDefs,
+	planPIndexes *PlanPIndexes) []string {
+	if nodeDefsKnown == nil {
+		return nil
+	}
+
+	inUse := map[string]bool{}
+	if nodeDefsWanted != nil {
+		for uuid := range nodeDefsWanted.NodeDefs {
+			inUse[uuid] = true
+		}
+	}
+	if planPIndexes != nil {
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			for uuid := range planPIndex.Nodes {
+				inUse[uuid] = true
+			}
+		}
+	}
+
+	var rv []string
+	for uuid := range nodeDefsKnown.NodeDefs {
+		if !inUse[uuid] {
+			rv = append(rv, uuid)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv
+}
+
+// GCNodeDefs removes stale entries from the known node definitions.
+// Only stale nodes are ever removed, and only those that are either
+// explicitly confirmed in opts.UUIDs or have been observed as stale
+// by this manager for longer than the max age.
+func (mgr *Manager) GCNodeDefs(opts NodeDefsGCOptions) (
+	*NodeDefsGCResult, error) {
+	atomic.AddUint64(&mgr.stats.TotGCNodeDefs, 1)
+
+	nodeDefsKnown, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_KNOWN)
+	if err != nil {
+		return nil, fmt.Errorf("manager_nodedefs_gc: known, err: %v", err)
+	}
+	nodeDefsWanted, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_WANTED)
+	if err != nil {
+		return nil, fmt.Errorf("manager_nodedefs_gc: wanted, err: %v", err)
+	}
+	nodeDefsStandby, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_STANDBY)
+	if err != nil {
+		return nil, fmt.Errorf("manager_nodedefs_gc: standby, err: %v", err)
+	}
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("manager_nodedefs_gc: plan, err: %v", err)
+	}
+
+	maxAge := opts.MaxAge
+	if maxAge <= 0 {
+		if v, exists := mgr.Options()["nodeDefsGCMaxAge"]; exists {
+			maxAge, err = time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("manager_nodedefs_gc:"+
+					" nodeDefsGCMaxAge: %q, err: %v", v, err)
+			}
+		}
+	}
+
+	confirmed := StringsToMap(opts.UUIDs)
+
+	// Standby nodes are in use, like the wanted nodes.
+	nodeDefsInUse := NewNodeDefs(mgr.version)
+	for _, nodeDefs := range []*NodeDefs{nodeDefsWanted, nodeDefsStandby} {
+		if nodeDefs != nil {
+			for uuid, nodeDef := range nodeDefs.NodeDefs {
+				nodeDefsInUse.NodeDefs[uuid] = nodeDef
+			}
+		}
+	}
+
+	rv := &NodeDefsGCResult{
+		Stale: CalcStaleNodeDefs(nodeDefsKnown, nodeDefsInUse, planPIndexes),
+	}
+
+	now := Now()
+
+	mgr.m.Lock()
+	staleSince := map[string]time.Time{}
+	for _, uuid := range rv.Stale {
+		t, exists := mgr.nodeDefsStaleSince[uuid]
+		if !exists {
+			t = now
+		}
+		staleSince[uuid] = t
+
+		if confirmed[uuid] || (maxAge > 0 && now.Sub(t) >= maxAge) {
+			rv.Removed = append(rv.Removed, uuid)
+		}
+	}
+	mgr.nodeDefsStaleSince = staleSince
+	mgr.m.Unlock()
+
+	if opts.DryRun || len(rv.Removed) <= 0 {
+		return rv, nil
+	}
+
+	for _, uuid := range rv.Removed {
+		err = mgr.removeStaleNodeDef(uuid)
+		if err != nil {
+			return rv, err
+		}
+
+		mgr.log.Printf("manager_nodedefs_gc: removed stale known nodeDef,"+
+			" uuid: %s", uuid)
+	}
+
+	mgr.GetNodeDefs(NODE_DEFS_KNOWN, true)
+	atomic.AddUint64(&mgr.stats.TotGCNodeDefsRemoved, uint64(len(rv.Removed)))
+
+	return rv, nil
+}
+
+// removeStaleNodeDef removes a known nodeDef, retrying on CAS
+// conflicts, and re-checking staleness on every try as the node might
+// have concurrently rejoined.
+func (mgr *Manager) removeStaleNodeDef(uuid string) error {
+	for tries := 0; tries < 10; tries++ {
+		nodeDefsWanted, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_WANTED)
+		if err != nil {
+			return err
+		}
+		if nodeDefsWanted != nil && nodeDefsWanted.NodeDefs[uuid] != nil {
+			return nil // The node came back, so it's no longer stale.
+		}
+
+		nodeDefsStandby, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_STANDBY)
+		if err != nil {
+			return err
+		}
+		if nodeDefsStandby != nil && nodeDefsStandby.NodeDefs[uuid] != nil {
+			return nil // The node came back as a standby.
+		}
+
+		err = CfgRemoveNodeDef(mgr.cfg, NODE_DEFS_KNOWN, uuid,
+			CfgGetVersion(mgr.cfg))
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				continue // Retry on CAS mismatch.
+			}
+
+			return fmt.Errorf("manager_nodedefs_gc: remove, uuid: %s,"+
+				" err: %v", uuid, err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("manager_nodedefs_gc: remove, uuid: %s,"+
+		" too many tries", uuid)
+}
@@ -0,0 +1,355 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// PINDEXES_RUNNING_KEY is the Cfg key where each node publishes the
+// names of its running pindexes, so that the rollout of an index can
+// be tracked across nodes.
+const PINDEXES_RUNNING_KEY = "pindexesRunning"
+
+// MAX_INDEX_OPERATIONS is the number of recent index operations that a
+// manager remembers.
+const MAX_INDEX_OPERATIONS = 100
+
+// Statuses of an IndexOperation, in the order they're reached.
+const (
+	IndexOperationPending = "pending" // The Cfg write is in flight.
+	IndexOperationFailed  = "failed"
+	IndexOperationCreated = "created" // The index definition is saved.
+	IndexOperationPlanned = "planned" // The plan covers the index.
+	IndexOperationRunning = "running" // All planned pindexes are running.
+)
+
+// PIndexesRunning holds the running pindexes of each node.
+type PIndexesRunning struct {
+	UUID  string                          `json:"uuid"`
+	Nodes map[string]*NodePIndexesRunning `json:"nodes"` // Keyed by node UUID.
+}
+
+// NodePIndexesRunning holds the running pindexes of a node.
+type NodePIndexesRunning struct {
+	Time     string   `json:"time"`
+	PIndexes []string `json:"pindexes"` // Sorted pindex names.
+}
+
+// CfgGetPIndexesRunning returns the PIndexesRunning from a Cfg.
+func CfgGetPIndexesRunning(cfg Cfg) (*PIndexesRunning, uint64, error) {
+	v, cas, err := cfg.Get(PINDEXES_RUNNING_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &PIndexesRunning{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetPIndexesRunning updates the PIndexesRunning on a Cfg.
+func CfgSetPIndexesRunning(cfg Cfg, pindexesRunning *PIndexesRunning,
+	cas uint64) (uint64, error) {
+	buf, err := json.Marshal(pindexesRunning)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(PINDEXES_RUNNING_KEY, buf, cas)
+}
+
+// publishPIndexesRunning updates the entry of this node in the Cfg's
+// PIndexesRunning, retrying on concurrent updates by other nodes.
+func (mgr *Manager) publishPIndexesRunning() (err error) {
+	_, pindexes := mgr.CurrentMaps()
+
+	names := make([]string, 0, len(pindexes))
+	for name := range pindexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for tries := 0; tries < 10; tries++ {
+		var all *PIndexesRunning
+		var cas uint64
+
+		all, cas, err = CfgGetPIndexesRunning(mgr.cfg)
+		if err != nil {
+			break
+		}
+		if all == nil {
+			all = &PIndexesRunning{}
+		}
+		if all.Nodes == nil {
+			all.Nodes = map[string]*NodePIndexesRunning{}
+		}
+
+		if prev := all.Nodes[mgr.uuid]; prev != nil &&
+			reflect.DeepEqual(prev.PIndexes, names) {
+			return nil // Skip the Cfg update, as nothing changed.
+		}
+
+		all.UUID = NewUUID()
+		all.Nodes[mgr.uuid] = &NodePIndexesRunning{
+			Time:     time.Now().Format(time.RFC3339Nano),
+			PIndexes: names,
+		}
+
+		_, err = CfgSetPIndexesRunning(mgr.cfg, all, cas)
+		if err == nil {
+			atomic.AddUint64(&mgr.stats.TotPIndexesRunningPublish, 1)
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			break
+		}
+	}
+
+	atomic.AddUint64(&mgr.stats.TotPIndexesRunningPublishErr, 1)
+
+	return err
+}
+
+// ---------------------------------------------------------
+
+// An IndexOperation tracks the rollout of an asynchronous index
+// creation, from the Cfg write, through the planner, to the pindexes
+// running on all their planned nodes.
+type IndexOperation struct {
+	ID        string `json:"id"`
+	Op        string `json:"op"` // "create".
+	IndexName string `json:"indexName"`
+	IndexUUID string `json:"indexUUID,omitempty"`
+	Status    string `json:"status"`
+	Err       string `json:"err,omitempty"`
+
+	StartedAt string `json:"startedAt"`
+	CreatedAt string `json:"createdAt,omitempty"`
+	PlannedAt string `json:"plannedAt,omitempty"`
+	RunningAt string `json:"runningAt,omitempty"`
+
+	// TotPIndexNodes is the number of planned pindex assignments to
+	// nodes, of which RunningPIndexNodes are running.
+	TotPIndexNodes     int `json:"totPIndexNodes"`
+	RunningPIndexNodes int `json:"runningPIndexNodes"`
+}
+
+// CreateIndexAsync starts the creation of an index definition as an
+// "indexCreate" task, returning an ID that can be passed to both
+// GetIndexOperation and GetTask to watch the rollout.  The ctx
+// governs only the Cfg write, as with CreateIndexContext, while the
+// task runs until the index's pindexes are running or the task is
+// canceled.
+func (mgr *Manager) CreateIndexAsync(ctx context.Context, sourceType,
+	sourceName, sourceUUID, sourceParams,
+	indexType, indexName, indexParams string, planParams PlanParams,
+	prevIndexUUID string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	op := &IndexOperation{
+		Op:        "create",
+		IndexName: indexName,
+		Status:    IndexOperationPending,
+		StartedAt: time.Now().Format(time.RFC3339Nano),
+	}
+
+	id, err := mgr.StartTask("indexCreate",
+		func(taskCtx context.Context, h *TaskHandle) error {
+			createCtx, cancel := context.WithCancel(taskCtx)
+			defer cancel()
+
+			go func() {
+				select {
+				case <-ctx.Done():
+					cancel()
+				case <-createCtx.Done():
+				}
+			}()
+
+			indexUUID, err := mgr.CreateIndexContext(createCtx, sourceType,
+				sourceName, sourceUUID, sourceParams, indexType, indexName,
+				indexParams, planParams, prevIndexUUID)
+
+			mgr.operationsMutex.Lock()
+			if err != nil {
+				op.Status = IndexOperationFailed
+				op.Err = err.Error()
+			} else {
+				op.Status = IndexOperationCreated
+				op.IndexUUID = indexUUID
+				op.CreatedAt = time.Now().Format(time.RFC3339Nano)
+			}
+			mgr.operationsMutex.Unlock()
+
+			if err != nil {
+				mgr.log.Warnf("manager_operations: create, id: %s,"+
+					" indexName: %s, err: %v", h.ID(), indexName, err)
+				return err
+			}
+
+			return mgr.waitIndexRollout(taskCtx, h, op)
+		})
+	if err != nil {
+		return "", err
+	}
+
+	mgr.operationsMutex.Lock()
+	op.ID = id
+	if mgr.operations == nil {
+		mgr.operations = map[string]*IndexOperation{}
+	}
+	mgr.operations[id] = op
+	mgr.operationIDs = append(mgr.operationIDs, id)
+	for len(mgr.operationIDs) > MAX_INDEX_OPERATIONS {
+		delete(mgr.operations, mgr.operationIDs[0])
+		mgr.operationIDs = mgr.operationIDs[1:]
+	}
+	mgr.operationsMutex.Unlock()
+
+	return id, nil
+}
+
+// waitIndexRollout reports the rollout of an index operation as the
+// progress of its task, until all its planned pindexes are running.
+func (mgr *Manager) waitIndexRollout(ctx context.Context,
+	h *TaskHandle, op *IndexOperation) error {
+	ticker := time.NewTicker(DEFAULT_TASK_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		rv, err := mgr.refreshIndexOperation(op)
+		if err != nil {
+			mgr.log.Warnf("manager_operations: rollout, id: %s, err: %v",
+				h.ID(), err)
+		} else {
+			if rv.Status == IndexOperationRunning {
+				return nil
+			}
+			if rv.TotPIndexNodes > 0 {
+				h.SetProgress(float64(rv.RunningPIndexNodes)/
+					float64(rv.TotPIndexNodes), rv.Status)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetIndexOperation returns a copy of a recent index operation, with
+// its status brought up to date against the current plan and the
+// running pindexes published by the nodes.
+func (mgr *Manager) GetIndexOperation(id string) (*IndexOperation, error) {
+	mgr.operationsMutex.Lock()
+	op := mgr.operations[id]
+	mgr.operationsMutex.Unlock()
+
+	if op == nil {
+		return nil, fmt.Errorf("manager_operations: no operation, id: %s", id)
+	}
+
+	return mgr.refreshIndexOperation(op)
+}
+
+// refreshIndexOperation returns a copy of an index operation, after
+// updating its status.
+func (mgr *Manager) refreshIndexOperation(op *IndexOperation) (
+	*IndexOperation, error) {
+	mgr.operationsMutex.Lock()
+	rv := *op
+	mgr.operationsMutex.Unlock()
+
+	if rv.Status != IndexOperationCreated &&
+		rv.Status != IndexOperationPlanned {
+		return &rv, nil
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+	pindexesRunning, _, err := CfgGetPIndexesRunning(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tot, running := calcIndexRollout(rv.IndexName, rv.IndexUUID,
+		planPIndexes, pindexesRunning)
+
+	rv.TotPIndexNodes, rv.RunningPIndexNodes = tot, running
+
+	now := time.Now().Format(time.RFC3339Nano)
+	if tot > 0 && rv.Status == IndexOperationCreated {
+		rv.Status, rv.PlannedAt = IndexOperationPlanned, now
+	}
+	if tot > 0 && running >= tot {
+		rv.Status, rv.RunningAt = IndexOperationRunning, now
+	}
+
+	mgr.operationsMutex.Lock()
+	op.Status, op.PlannedAt, op.RunningAt = rv.Status, rv.PlannedAt, rv.RunningAt
+	op.TotPIndexNodes, op.RunningPIndexNodes = tot, running
+	rv.ID = op.ID
+	mgr.operationsMutex.Unlock()
+
+	return &rv, nil
+}
+
+// calcIndexRollout returns the number of planned pindex assignments
+// to nodes of an index, and how many of them are running.
+func calcIndexRollout(indexName, indexUUID string,
+	planPIndexes *PlanPIndexes,
+	pindexesRunning *PIndexesRunning) (tot, running int) {
+	if planPIndexes == nil {
+		return 0, 0
+	}
+
+	runningByNode := map[string]map[string]bool{}
+	if pindexesRunning != nil {
+		for nodeUUID, n := range pindexesRunning.Nodes {
+			if n != nil {
+				runningByNode[nodeUUID] = StringsToMap(n.PIndexes)
+			}
+		}
+	}
+
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.IndexName != indexName ||
+			planPIndex.IndexUUID != indexUUID {
+			continue
+		}
+		for nodeUUID := range planPIndex.Nodes {
+			tot++
+			if runningByNode[nodeUUID][planPIndex.Name] {
+				running++
+			}
+		}
+	}
+
+	return tot, running
+}
@@ -0,0 +1,118 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCalcIndexRollout(t *testing.T) {
+	planPIndexes := NewPlanPIndexes(Version)
+	planPIndexes.PlanPIndexes["x_0"] = &PlanPIndex{Name: "x_0",
+		IndexName: "x", IndexUUID: "xx", Nodes: map[string]*PlanPIndexNode{
+			"a": {}, "b": {Priority: 1}}}
+	planPIndexes.PlanPIndexes["y_0"] = &PlanPIndex{Name: "y_0",
+		IndexName: "y", IndexUUID: "yy", Nodes: map[string]*PlanPIndexNode{
+			"a": {}}}
+
+	running := &PIndexesRunning{Nodes: map[string]*NodePIndexesRunning{
+		"a": {PIndexes: []string{"x_0", "y_0"}},
+		"b": {PIndexes: []string{"y_0"}},
+	}}
+
+	if tot, r := calcIndexRollout("x", "xx", planPIndexes, running); tot != 2 || r != 1 {
+		t.Errorf("expected 1 of 2 running, got: %d of %d", r, tot)
+	}
+	if tot, r := calcIndexRollout("x", "old", planPIndexes, running); tot != 0 || r != 0 {
+		t.Errorf("expected no rollout for another indexUUID, got: %d, %d", r, tot)
+	}
+}
+
+func TestManagerCreateIndexAsync(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+
+	go func() {
+		for r := range m.plannerCh {
+			close(r.resCh)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.CreateIndexContext(ctx, "primary", "default", "123",
+		"{}", "blackhole", "x", "{}", PlanParams{}, ""); err != context.Canceled {
+		t.Errorf("expected a canceled CreateIndexContext(), err: %v", err)
+	}
+	if _, err := m.CreateIndexAsync(ctx, "primary", "default", "123",
+		"{}", "blackhole", "x", "{}", PlanParams{}, ""); err == nil {
+		t.Errorf("expected err on a canceled CreateIndexAsync()")
+	}
+
+	id, err := m.CreateIndexAsync(context.Background(), "primary",
+		"default", "123", "{}", "blackhole", "x", "{}", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndexAsync() to work, err: %v", err)
+	}
+
+	waitForStatus := func(status string) *IndexOperation {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			op, err := m.GetIndexOperation(id)
+			if err != nil {
+				t.Fatalf("expected GetIndexOperation() to work, err: %v", err)
+			}
+			if op.Status == status {
+				return op
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected status: %s, got: %#v", status, op)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitForStatus(IndexOperationCreated)
+
+	if _, err = m.PlannerOnce("test"); err != nil {
+		t.Fatalf("expected PlannerOnce() to work, err: %v", err)
+	}
+	op := waitForStatus(IndexOperationPlanned)
+	if op.TotPIndexNodes != 1 || op.RunningPIndexNodes != 0 {
+		t.Errorf("expected 0 of 1 running, got: %#v", op)
+	}
+
+	if err = m.JanitorOnce("test"); err != nil {
+		t.Fatalf("expected JanitorOnce() to work, err: %v", err)
+	}
+	op = waitForStatus(IndexOperationRunning)
+	if op.RunningAt == "" || op.PlannedAt == "" || op.CreatedAt == "" {
+		t.Errorf("expected rollout times, got: %#v", op)
+	}
+
+	waitForTaskState(t, m, id, TaskSucceeded)
+
+	if _, err = m.GetIndexOperation("not-an-op"); err == nil {
+		t.Errorf("expected err on an unknown operation")
+	}
+}
@@ -17,8 +17,11 @@ import (
 	"io"
 	"log"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/blugelabs/blance"
 )
@@ -97,70 +100,153 @@ func (mgr *Manager) PlannerKick(msg string) {
 
 // PlannerLoop is the main loop for the planner.
 func (mgr *Manager) PlannerLoop() {
-	if mgr.cfg != nil { // Might be nil for testing.
-		go func() {
-			ec := make(chan CfgEvent)
-			mgr.cfg.Subscribe(INDEX_DEFS_KEY, ec)
-			mgr.cfg.Subscribe(CfgNodeDefsKey(NODE_DEFS_WANTED), ec)
-			for {
-				select {
-				case <-mgr.stopCh:
-					return
-				case e := <-ec:
-					atomic.AddUint64(&mgr.stats.TotPlannerSubscriptionEvent, 1)
-					mgr.PlannerKick("cfg changed, key: " + e.Key)
-				}
-			}
-		}()
+	if mgr.cfgHub != nil { // Might be nil for testing.
+		sub, err := mgr.cfgHub.Subscribe([]string{
+			INDEX_DEFS_KEY,
+			CfgNodeDefsKey(NODE_DEFS_WANTED),
+		}, func(e CfgEvent) {
+			atomic.AddUint64(&mgr.stats.TotPlannerSubscriptionEvent, 1)
+			mgr.PlannerKick("cfg changed, key: " + e.Key)
+		})
+		if err != nil {
+			mgr.log.Warnf("planner: subscribe, err: %v", err)
+		} else {
+			defer sub.Unsubscribe()
+		}
 	}
 
+	var next *workReq // A request that arrived while coalescing kicks.
+
 	for {
-		select {
-		case <-mgr.stopCh:
-			atomic.AddUint64(&mgr.stats.TotPlannerStop, 1)
-			return
-
-		case m := <-mgr.plannerCh:
-			atomic.AddUint64(&mgr.stats.TotPlannerOpStart, 1)
-
-			mgr.log.Printf("planner: awakes, op: %v, msg: %s", m.op, m.msg)
-
-			var err error
-
-			if m.op == WORK_KICK {
-				atomic.AddUint64(&mgr.stats.TotPlannerKickStart, 1)
-				changed, err2 := mgr.PlannerOnce(m.msg)
-				if err2 != nil {
-					mgr.log.Warnf("planner: PlannerOnce, err: %v", err2)
-					atomic.AddUint64(&mgr.stats.TotPlannerKickErr, 1)
-					// Keep looping as perhaps it's a transient issue.
-				} else {
-					if changed {
-						atomic.AddUint64(&mgr.stats.TotPlannerKickChanged, 1)
-						mgr.JanitorKick("the plans have changed")
-					}
-					atomic.AddUint64(&mgr.stats.TotPlannerKickOk, 1)
-				}
-			} else if m.op == WORK_NOOP {
-				atomic.AddUint64(&mgr.stats.TotPlannerNOOPOk, 1)
+		m := next
+		next = nil
+
+		if m == nil {
+			select {
+			case <-mgr.stopCh:
+				atomic.AddUint64(&mgr.stats.TotPlannerStop, 1)
+				return
+
+			case m = <-mgr.plannerCh:
+			}
+		}
+
+		atomic.AddUint64(&mgr.stats.TotPlannerOpStart, 1)
+
+		mgr.log.Printf("planner: awakes, op: %v, msg: %s", m.op, m.msg)
+
+		reqs := []*workReq{m}
+
+		var err error
+
+		if m.op == WORK_KICK {
+			reqs, next = mgr.coalescePlannerKicks(m)
+
+			atomic.AddUint64(&mgr.stats.TotPlannerKickStart, 1)
+			changed, err2 := mgr.PlannerOnce(plannerKickReasons(reqs))
+			if err2 != nil {
+				mgr.log.Warnf("planner: PlannerOnce, err: %v", err2)
+				atomic.AddUint64(&mgr.stats.TotPlannerKickErr, 1)
+				// Keep looping as perhaps it's a transient issue.
 			} else {
-				err = fmt.Errorf("planner: unknown op: %s, m: %#v", m.op, m)
-				atomic.AddUint64(&mgr.stats.TotPlannerUnknownErr, 1)
+				if changed {
+					atomic.AddUint64(&mgr.stats.TotPlannerKickChanged, 1)
+					mgr.JanitorKick("the plans have changed")
+				}
+				atomic.AddUint64(&mgr.stats.TotPlannerKickOk, 1)
 			}
+		} else if m.op == WORK_NOOP {
+			atomic.AddUint64(&mgr.stats.TotPlannerNOOPOk, 1)
+		} else {
+			err = fmt.Errorf("planner: unknown op: %s, m: %#v", m.op, m)
+			atomic.AddUint64(&mgr.stats.TotPlannerUnknownErr, 1)
+		}
 
+		for _, r := range reqs {
 			atomic.AddUint64(&mgr.stats.TotPlannerOpRes, 1)
 
-			if m.resCh != nil {
+			if r.resCh != nil {
 				if err != nil {
 					atomic.AddUint64(&mgr.stats.TotPlannerOpErr, 1)
-					m.resCh <- err
+					r.resCh <- err
 				}
-				close(m.resCh)
+				close(r.resCh)
 			}
+		}
+
+		atomic.AddUint64(&mgr.stats.TotPlannerOpDone, 1)
+	}
+}
+
+// DEFAULT_PLANNER_KICK_DEBOUNCE is how long the planner waits after a
+// kick for further kicks to arrive, so that a burst of kicks, such as
+// from many index creations, is handled by a single planning pass.
+// It may be overridden by the "plannerKickDebounceMS" manager option,
+// where 0 means that only the kicks that are already waiting are
+// coalesced.
+const DEFAULT_PLANNER_KICK_DEBOUNCE = 10 * time.Millisecond
+
+// coalescePlannerKicks collects the kick requests that arrive within
+// the debounce window after the kick request m.  A request of another
+// op ends the window early, and is returned as next so that it's
+// handled after the planning pass for the kicks.
+func (mgr *Manager) coalescePlannerKicks(m *workReq) (
+	kicks []*workReq, next *workReq) {
+	kicks = []*workReq{m}
+
+	debounce := DEFAULT_PLANNER_KICK_DEBOUNCE
+	if v, err := strconv.Atoi(mgr.Options()["plannerKickDebounceMS"]); err == nil && v >= 0 {
+		debounce = time.Duration(v) * time.Millisecond
+	}
+
+	var timeoutCh <-chan time.Time
+	if debounce > 0 {
+		timer := time.NewTimer(debounce)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	} else {
+		closedCh := make(chan time.Time)
+		close(closedCh)
+		timeoutCh = closedCh
+	}
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return kicks, nil
+
+		case r := <-mgr.plannerCh:
+			if r.op != WORK_KICK {
+				return kicks, r
+			}
+
+			atomic.AddUint64(&mgr.stats.TotPlannerKickCoalesced, 1)
+
+			kicks = append(kicks, r)
+
+		case <-timeoutCh:
+			return kicks, nil
+		}
+	}
+}
+
+// plannerKickReasons aggregates the distinct msgs of kick requests.
+func plannerKickReasons(kicks []*workReq) string {
+	if len(kicks) == 1 {
+		return kicks[0].msg
+	}
 
-			atomic.AddUint64(&mgr.stats.TotPlannerOpDone, 1)
+	var reasons []string
+	seen := map[string]bool{}
+	for _, r := range kicks {
+		if !seen[r.msg] {
+			seen[r.msg] = true
+			reasons = append(reasons, r.msg)
 		}
 	}
+
+	return fmt.Sprintf("%s (coalesced kicks: %d)",
+		strings.Join(reasons, "; "), len(kicks))
 }
 
 // PlannerOnce is the main body of a PlannerLoop.
@@ -171,8 +257,34 @@ func (mgr *Manager) PlannerOnce(reason string) (bool, error) {
 		return false, fmt.Errorf("planner: skipped due to nil cfg")
 	}
 
-	return Plan(mgr.log, mgr.cfg, mgr.version, mgr.uuid, mgr.server,
-		mgr.Options(), nil)
+	options := mgr.Options()
+	if options["plannerObserve"] == "true" {
+		return false, mgr.plannerObserve(reason, options)
+	}
+
+	if options["plannerIncremental"] == "false" {
+		mgr.plannerInc.reset()
+
+		return planOnce(mgr.log, mgr.cfg, mgr.version, mgr.uuid, mgr.server,
+			options, nil, nil, mgr.onPlanned)
+	}
+
+	return planOnce(mgr.log, mgr.cfg, mgr.version, mgr.uuid, mgr.server,
+		options, nil, &mgr.plannerInc, mgr.onPlanned)
+}
+
+// onPlanned emits the events of a new plan that's saved by this node.
+func (mgr *Manager) onPlanned(prev, curr *PlanPIndexes) {
+	mgr.addIndexPlannedEvents(prev, curr)
+
+	if curr != nil {
+		mgr.PublishEvent(EVENT_CATEGORY_PLAN, map[string]interface{}{
+			"event":    "planned",
+			"uuid":     curr.UUID,
+			"pindexes": len(curr.PlanPIndexes),
+			"time":     Now().Format(time.RFC3339Nano),
+		})
+	}
 }
 
 // A PlannerFilter callback func should return true if the plans for
@@ -184,37 +296,60 @@ type PlannerFilter func(indexDef *IndexDef,
 // Plan runs the planner once.
 func Plan(log Log, cfg Cfg, version, uuid, server string, options map[string]string,
 	plannerFilter PlannerFilter) (bool, error) {
+	return planOnce(log, cfg, version, uuid, server, options,
+		plannerFilter, nil, nil)
+}
+
+// planOnce runs the planner once, where an optional plannerIncremental
+// allows re-planning only the changed indexes, and an optional
+// onPlanned callback is invoked after a new plan is saved.
+func planOnce(log Log, cfg Cfg, version, uuid, server string,
+	options map[string]string, plannerFilter PlannerFilter,
+	inc *plannerIncremental,
+	onPlanned func(prev, curr *PlanPIndexes)) (bool, error) {
 	indexDefs, nodeDefs, planPIndexesPrev, cas, err :=
 		PlannerGetPlan(log, cfg, version, uuid)
 	if err != nil {
 		return false, err
 	}
 
-	// use the effective version while calculating the new plan
-	eVersion := CfgGetVersion(cfg)
-	if eVersion != version {
-		log.Printf("planner: Plan, incoming version: %s, effective"+
-			"Cfg version used: %s", version, eVersion)
-		version = eVersion
-	}
-
-	planPIndexes, err := CalcPlan(log, "", indexDefs, nodeDefs,
-		planPIndexesPrev, version, server, options, plannerFilter)
+	planPIndexes, indexDefs, version, err := plannerCalcPlan(log, cfg,
+		version, server, options, indexDefs, nodeDefs, planPIndexesPrev,
+		plannerFilter, inc)
 	if err != nil {
-		return false, fmt.Errorf("planner: CalcPlan, err: %v", err)
+		return false, err
 	}
 
 	if SamePlanPIndexes(planPIndexes, planPIndexesPrev) {
+		if inc != nil && planPIndexesPrev != nil {
+			inc.planned(indexDefs, nodeDefs, planPIndexesPrev.UUID,
+				version, options)
+		}
 		return false, nil
 	}
 
 	_, err = CfgSetPlanPIndexes(cfg, planPIndexes, cas)
 	if err != nil {
+		if _, ok := err.(*CfgCASError); ok {
+			RecordCASConflict(PLAN_PINDEXES_KEY)
+		}
+		if inc != nil {
+			inc.reset()
+		}
 		return false, fmt.Errorf("planner: could not save new plan,"+
 			" perhaps a concurrent planner won, cas: %d, err: %v",
 			cas, err)
 	}
 
+	if inc != nil && planPIndexes != nil {
+		inc.planned(indexDefs, nodeDefs, planPIndexes.UUID,
+			version, options)
+	}
+
+	if onPlanned != nil {
+		onPlanned(planPIndexesPrev, planPIndexes)
+	}
+
 	return true, nil
 }
 
@@ -341,6 +476,49 @@ func PlannerGetPlanPIndexes(cfg Cfg, version string) (
 	return planPIndexesPrev, cas, nil
 }
 
+// plannerCalcPlan is the calculation part of planOnce(), which
+// doesn't change the Cfg, and returns the new plan, the indexDefs as
+// planned, such as with weights from rates, and the effective version.
+func plannerCalcPlan(log Log, cfg Cfg, version, server string,
+	options map[string]string, indexDefs *IndexDefs, nodeDefs *NodeDefs,
+	planPIndexesPrev *PlanPIndexes, plannerFilter PlannerFilter,
+	inc *plannerIncremental) (*PlanPIndexes, *IndexDefs, string, error) {
+	// use the effective version while calculating the new plan
+	eVersion := CfgGetVersion(cfg)
+	if eVersion != version {
+		log.Printf("planner: Plan, incoming version: %s, effective"+
+			"Cfg version used: %s", version, eVersion)
+		version = eVersion
+	}
+
+	if options["pindexWeightsFromRates"] == "true" {
+		indexDefs = plannerApplyPIndexRateWeights(log, cfg,
+			indexDefs, nodeDefs)
+	}
+
+	if inc != nil && plannerFilter == nil {
+		plannerFilter = inc.filter(indexDefs, nodeDefs, planPIndexesPrev,
+			version, options)
+	}
+
+	var running *PIndexesRunning
+	if nodeDefsNoAccept(nodeDefs) {
+		var err error
+		running, _, err = CfgGetPIndexesRunning(cfg)
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+
+	planPIndexes, err := calcPlan(log, "", indexDefs, nodeDefs,
+		planPIndexesPrev, version, server, options, plannerFilter, running)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("planner: CalcPlan, err: %v", err)
+	}
+
+	return planPIndexes, indexDefs, version, nil
+}
+
 // Split logical indexes into PIndexes and assign PIndexes to nodes.
 // As part of this, planner hook callbacks will be invoked to allow
 // advanced applications to adjust the planning outcome.
@@ -348,6 +526,17 @@ func CalcPlan(log Log, mode string, indexDefs *IndexDefs, nodeDefs *NodeDefs,
 	planPIndexesPrev *PlanPIndexes, version, server string,
 	options map[string]string, plannerFilter PlannerFilter) (
 	*PlanPIndexes, error) {
+	return calcPlan(log, mode, indexDefs, nodeDefs, planPIndexesPrev,
+		version, server, options, plannerFilter, nil)
+}
+
+// calcPlan is CalcPlan, where the optional running pindexes of the
+// nodes tell which assignments the NoAccept nodes keep, see
+// applyNoAcceptNodes().
+func calcPlan(log Log, mode string, indexDefs *IndexDefs, nodeDefs *NodeDefs,
+	planPIndexesPrev *PlanPIndexes, version, server string,
+	options map[string]string, plannerFilter PlannerFilter,
+	running *PIndexesRunning) (*PlanPIndexes, error) {
 	plannerHook := PlannerHooks[options["plannerHookName"]]
 	if plannerHook == nil {
 		plannerHook = NoopPlannerHook
@@ -358,6 +547,7 @@ func CalcPlan(log Log, mode string, indexDefs *IndexDefs, nodeDefs *NodeDefs,
 	var nodeUUIDsToRemove []string
 	var nodeWeights map[string]int
 	var nodeHierarchy map[string]string
+	var nodeTags map[string][]string
 	var planPIndexes *PlanPIndexes
 
 	plannerHookCall := func(phase string, indexDef *IndexDef,
@@ -421,6 +611,10 @@ func CalcPlan(log Log, mode string, indexDefs *IndexDefs, nodeDefs *NodeDefs,
 		return planPIndexes, err
 	}
 
+	nodeTags = CalcNodeTags(nodeDefs)
+
+	maxPIndexes := nodeMaxPIndexes(options, nodeDefs)
+
 	if planPIndexes == nil {
 		planPIndexes = NewPlanPIndexes(version)
 	}
@@ -458,14 +652,32 @@ func CalcPlan(log Log, mode string, indexDefs *IndexDefs, nodeDefs *NodeDefs,
 
 		// Skip indexDef's with no instantiatable pindexImplType, such
 		// as index aliases.
-		pindexImplType, exists := PIndexImplTypes[indexDef.Type]
-		if !exists ||
-			pindexImplType == nil ||
+		pindexImplType := GetPIndexImplType(indexDef.Type)
+		if pindexImplType == nil ||
 			pindexImplType.New == nil ||
 			pindexImplType.Open == nil {
 			continue
 		}
 
+		// An index whose pindex names would be invalid, such as one
+		// created with a long name before the names were validated,
+		// keeps its previous plan rather than losing its pindexes.
+		err2 = ValidatePIndexName(PlanPIndexName(indexDef, ""))
+		if err2 != nil {
+			log.Warnf("planner: keeping previous plan,"+
+				" indexDef.Name: %s, err: %v", indexDef.Name, err2)
+			if planPIndexesPrev != nil {
+				for n, p := range planPIndexesPrev.PlanPIndexes {
+					if p.IndexName == indexDef.Name {
+						planPIndexes.PlanPIndexes[n] = p
+					}
+				}
+			}
+			planPIndexes.Warnings[indexDef.Name] = []string{
+				"invalid pindex names, kept previous plan: " + err2.Error()}
+			continue
+		}
+
 		// Split each indexDef into 1 or more PlanPIndexes.
 		planPIndexesForIndex, err2 := SplitIndexDefIntoPlanPIndexes(
 			indexDef, server, options, planPIndexes)
@@ -489,10 +701,19 @@ func CalcPlan(log Log, mode string, indexDefs *IndexDefs, nodeDefs *NodeDefs,
 
 		// Once we have a 1 or more PlanPIndexes for an IndexDef, use
 		// blance to assign the PlanPIndexes to nodes.
-		warnings := BlancePlanPIndexes(mode, indexDef,
+		warnings := BlancePlanPIndexesEx(mode, indexDef,
 			planPIndexesForIndex, planPIndexesPrev,
 			nodeUUIDsAll, nodeUUIDsToAdd, nodeUUIDsToRemove,
-			nodeWeights, nodeHierarchy)
+			nodeWeights, nodeHierarchy, nodeTags)
+
+		warnings = append(warnings, applyNoAcceptNodes(indexDef,
+			planPIndexesForIndex, planPIndexesPrev, nodeDefs, running,
+			StringsRemoveStrings(nodeUUIDsAll, nodeUUIDsToRemove))...)
+
+		warnings = append(warnings, applyMaxPIndexesPerNode(indexDef,
+			planPIndexesForIndex, planPIndexes, planPIndexesPrev, nodeDefs,
+			maxPIndexes, StringsRemoveStrings(nodeUUIDsAll, nodeUUIDsToRemove))...)
+
 		planPIndexes.Warnings[indexDef.Name] = warnings
 
 		for _, warning := range warnings {
@@ -590,6 +811,14 @@ func SplitIndexDefIntoPlanPIndexes(indexDef *IndexDef, server string,
 	map[string]*PlanPIndex, error) {
 	maxPartitionsPerPIndex := indexDef.PlanParams.MaxPartitionsPerPIndex
 
+	// The partitions hash has a fixed length, so any one of the
+	// pindex names of the index checks them all.
+	err := ValidatePIndexName(PlanPIndexName(indexDef, ""))
+	if err != nil {
+		return nil, fmt.Errorf("planner: invalid pindex name,"+
+			" indexDef.Name: %s, err: %v", indexDef.Name, err)
+	}
+
 	sourcePartitionsArr, err := dataSourcePartitions(indexDef.SourceType,
 		indexDef.SourceName, indexDef.SourceUUID, indexDef.SourceParams,
 		server, options)
@@ -657,7 +886,27 @@ func BlancePlanPIndexes(mode string,
 	nodeUUIDsToRemove []string,
 	nodeWeights map[string]int,
 	nodeHierarchy map[string]string) []string {
-	model, modelConstraints := BlancePartitionModel(indexDef)
+	return BlancePlanPIndexesEx(mode, indexDef,
+		planPIndexesForIndex, planPIndexesPrev,
+		nodeUUIDsAll, nodeUUIDsToAdd, nodeUUIDsToRemove,
+		nodeWeights, nodeHierarchy, nil)
+}
+
+// BlancePlanPIndexesEx is like BlancePlanPIndexes, but also takes
+// the tags of the nodes, keyed by node UUID, which are needed for
+// the PrimaryNodeTags and ReplicaNodeTags of the PlanParams.  See
+// CalcNodeTags().
+func BlancePlanPIndexesEx(mode string,
+	indexDef *IndexDef,
+	planPIndexesForIndex map[string]*PlanPIndex,
+	planPIndexesPrev *PlanPIndexes,
+	nodeUUIDsAll []string,
+	nodeUUIDsToAdd []string,
+	nodeUUIDsToRemove []string,
+	nodeWeights map[string]int,
+	nodeHierarchy map[string]string,
+	nodeTags map[string][]string) []string {
+	model, modelConstraints := blancePartitionModel(indexDef)
 
 	// First, reconstruct previous blance map from planPIndexesPrev.
 	blancePrevMap := BlanceMap(planPIndexesForIndex, planPIndexesPrev)
@@ -669,52 +918,47 @@ func BlancePlanPIndexes(mode string,
 		stateStickiness = map[string]int{"primary": 100000}
 	}
 
-	// Compute nodeUUIDsAllForIndex by rotating the nodeUUIDsAll based
-	// on a function of index name, so that multiple indexes will have
-	// layouts that favor different starting nodes, but whose
-	// computation is repeatable.
-	var nodeUUIDsAllForIndex []string
+	nodeUUIDsAllForIndex := NodeUUIDsForIndex(indexDef.Name, nodeUUIDsAll)
 
-	h := crc32.NewIEEE()
-	io.WriteString(h, indexDef.Name)
-	next := sort.SearchStrings(nodeUUIDsAll, fmt.Sprintf("%x", h.Sum32()))
+	hierarchyRules := IndexHierarchyRules(indexDef, nodeHierarchy)
 
-	for range nodeUUIDsAll {
-		if next >= len(nodeUUIDsAll) {
-			next = 0
-		}
-
-		nodeUUIDsAllForIndex =
-			append(nodeUUIDsAllForIndex, nodeUUIDsAll[next])
-
-		next++
+	placementPolicy := indexDef.PlanParams.PlacementPolicy
+	if placementPolicy != nil {
+		nodeHierarchy = placementHierarchy(nodeHierarchy)
 	}
 
-	// If there are server groups/racks defined and there are no explicit
-	// hierarchyRules available then assume a rule which assigns
-	// the replica partitions to different server groups/racks.
-	// Node hierarchy would look like datacenter/serverGroup/nodeUUID
-	// where nodeUUIDs are at level zero, serverGroups are at level one
-	// and datacenter is at level two.
-	// HierarchyRules specify which levels to include and which levels to
-	// exclude while considering the replica assignments.
-	// eg: ExcludeLevel: 1 means skip the same rack allocations.
-	if indexDef.PlanParams.HierarchyRules == nil &&
-		len(nodeHierarchy) > 0 {
-		indexDef.PlanParams.HierarchyRules = blance.HierarchyRules{
-			"replica": []*blance.HierarchyRule{{
-				IncludeLevel: 2,
-				ExcludeLevel: 1}}}
+	var blanceNextMap blance.PartitionMap
+	var warnings []string
+
+	tiered := len(indexDef.PlanParams.PrimaryNodeTags) > 0 ||
+		len(indexDef.PlanParams.ReplicaNodeTags) > 0
+	if tiered {
+		blanceNextMap, warnings = blanceTieredPlanNextMap(indexDef,
+			blancePrevMap,
+			nodeUUIDsAllForIndex, nodeUUIDsToRemove, nodeUUIDsToAdd,
+			model, modelConstraints,
+			partitionWeights,
+			stateStickiness,
+			nodeWeights,
+			nodeHierarchy,
+			nodeTags)
+	} else {
+		blanceNextMap, warnings = blance.PlanNextMap(blancePrevMap,
+			nodeUUIDsAllForIndex, nodeUUIDsToRemove, nodeUUIDsToAdd,
+			model, modelConstraints,
+			partitionWeights,
+			stateStickiness,
+			nodeWeights,
+			nodeHierarchy,
+			hierarchyRules)
 	}
 
-	blanceNextMap, warnings := blance.PlanNextMap(blancePrevMap,
-		nodeUUIDsAllForIndex, nodeUUIDsToRemove, nodeUUIDsToAdd,
-		model, modelConstraints,
-		partitionWeights,
-		stateStickiness,
-		nodeWeights,
-		nodeHierarchy,
-		indexDef.PlanParams.HierarchyRules)
+	if len(indexDef.PlanParams.PIndexPins) > 0 {
+		warnings = append(warnings, applyPIndexPins(indexDef,
+			planPIndexesForIndex, blanceNextMap,
+			StringsRemoveStrings(nodeUUIDsAll, nodeUUIDsToRemove),
+			model)...)
+	}
 
 	for planPIndexName, blancePartition := range blanceNextMap {
 		planPIndex := planPIndexesForIndex[planPIndexName]
@@ -765,9 +1009,71 @@ func BlancePlanPIndexes(mode string,
 		}
 	}
 
+	if placementPolicy != nil {
+		warnings = append(warnings, placementPolicyWarnings(
+			placementPolicy, planPIndexesForIndex, nodeHierarchy)...)
+	} else if !tiered {
+		warnings = append(warnings, hierarchyRulesWarnings(
+			planPIndexesForIndex, nodeHierarchy, hierarchyRules)...)
+	}
+
 	return warnings
 }
 
+// NodeUUIDsForIndex rotates the nodeUUIDsAll based on a function of
+// the index name, so that multiple indexes will have layouts that
+// favor different starting nodes, but whose computation is
+// repeatable.  Blance breaks its ties in this order.
+func NodeUUIDsForIndex(indexName string, nodeUUIDsAll []string) []string {
+	nodeUUIDsAllForIndex := make([]string, 0, len(nodeUUIDsAll))
+
+	h := crc32.NewIEEE()
+	io.WriteString(h, indexName)
+	next := sort.SearchStrings(nodeUUIDsAll,
+		strconv.FormatUint(uint64(h.Sum32()), 16))
+
+	for range nodeUUIDsAll {
+		if next >= len(nodeUUIDsAll) {
+			next = 0
+		}
+
+		nodeUUIDsAllForIndex =
+			append(nodeUUIDsAllForIndex, nodeUUIDsAll[next])
+
+		next++
+	}
+
+	return nodeUUIDsAllForIndex
+}
+
+// IndexHierarchyRules returns the HierarchyRules that the planner
+// applies to an index, where a PlacementPolicy is turned into rules.
+//
+// If there are server groups/racks defined and there are no explicit
+// hierarchyRules available then assume a rule which assigns
+// the replica partitions to different server groups/racks.
+// Node hierarchy would look like datacenter/serverGroup/nodeUUID
+// where nodeUUIDs are at level zero, serverGroups are at level one
+// and datacenter is at level two.
+// HierarchyRules specify which levels to include and which levels to
+// exclude while considering the replica assignments.
+// eg: ExcludeLevel: 1 means skip the same rack allocations.
+func IndexHierarchyRules(indexDef *IndexDef,
+	nodeHierarchy map[string]string) blance.HierarchyRules {
+	if p := indexDef.PlanParams.PlacementPolicy; p != nil {
+		return placementPolicyRules(p, indexDef.PlanParams.NumReplicas)
+	}
+
+	hierarchyRules := indexDef.PlanParams.HierarchyRules
+	if hierarchyRules == nil && len(nodeHierarchy) > 0 {
+		hierarchyRules = blance.HierarchyRules{
+			"replica": []*blance.HierarchyRule{{
+				IncludeLevel: 2,
+				ExcludeLevel: 1}}}
+	}
+	return hierarchyRules
+}
+
 // BlancePartitionModel returns a blance library PartitionModel and
 // model constraints based on an input index definition.
 func BlancePartitionModel(indexDef *IndexDef) (
@@ -788,15 +1094,41 @@ func BlancePartitionModel(indexDef *IndexDef) (
 	}, map[string]int(nil)
 }
 
-func getPrevPlanName(newPlan *PlanPIndex,
-	planPIndexesPrev map[string]*PlanPIndex) string {
+// blancePartitionModels caches the partition models of
+// blancePartitionModel(), keyed by the number of replicas.
+var blancePartitionModels sync.Map
+
+// blancePartitionModel is like BlancePartitionModel, but returns a
+// shared partition model, which must be treated as read-only.
+func blancePartitionModel(indexDef *IndexDef) (
+	model blance.PartitionModel,
+	modelConstraints map[string]int,
+) {
+	numReplicas := indexDef.PlanParams.NumReplicas
+	if v, exists := blancePartitionModels.Load(numReplicas); exists {
+		return v.(blance.PartitionModel), nil
+	}
+
+	model, modelConstraints = BlancePartitionModel(indexDef)
+	if modelConstraints == nil {
+		blancePartitionModels.Store(numReplicas, model)
+	}
+
+	return model, modelConstraints
+}
+
+// prevPlanNames returns the names of an index's planPIndexes, keyed
+// by their source partitions, for finding the previous plan of a
+// planPIndex whose name changed due to an index definition update.
+func prevPlanNames(indexName string,
+	planPIndexesPrev map[string]*PlanPIndex) map[string]string {
+	rv := map[string]string{}
 	for _, plan := range planPIndexesPrev {
-		if plan.IndexName == newPlan.IndexName &&
-			plan.SourcePartitions == newPlan.SourcePartitions {
-			return plan.Name
+		if plan.IndexName == indexName {
+			rv[plan.SourcePartitions] = plan.Name
 		}
 	}
-	return ""
+	return rv
 }
 
 // BlanceMap reconstructs a blance map from an existing plan.
@@ -806,6 +1138,9 @@ func BlanceMap(
 ) blance.PartitionMap {
 	m := blance.PartitionMap{}
 
+	// Lazily populated, keyed by index name, see prevPlanNames().
+	var prevNames map[string]map[string]string
+
 	for _, planPIndex := range planPIndexesForIndex {
 		blancePartition := &blance.Partition{
 			Name:         planPIndex.Name,
@@ -823,9 +1158,16 @@ func BlanceMap(
 				// It only helps to feed blance with the existing
 				// partition layouts while creating the new partition
 				// assignments.
-				p, exists = planPIndexes.PlanPIndexes[getPrevPlanName(
-					planPIndex,
-					planPIndexes.PlanPIndexes)]
+				names, ok := prevNames[planPIndex.IndexName]
+				if !ok {
+					names = prevPlanNames(planPIndex.IndexName,
+						planPIndexes.PlanPIndexes)
+					if prevNames == nil {
+						prevNames = map[string]map[string]string{}
+					}
+					prevNames[planPIndex.IndexName] = names
+				}
+				p, exists = planPIndexes.PlanPIndexes[names[planPIndex.SourcePartitions]]
 			}
 			if exists && p != nil {
 				// Sort by planPIndexNode.Priority for stability.
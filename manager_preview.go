@@ -0,0 +1,205 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An IndexPreview describes how an index definition would be split
+// into pindexes and how those pindexes would be placed onto the
+// nodes, as computed by a simulated planner run against the current
+// Cfg, so that planParams can be sanity-checked before an index is
+// created or updated.
+type IndexPreview struct {
+	IndexName string           `json:"indexName"`
+	IndexDef  *IndexDef        `json:"indexDef"`
+	PIndexes  []*PIndexPreview `json:"pindexes"` // Sorted by name.
+	Warnings  []string         `json:"warnings,omitempty"`
+}
+
+// A PIndexPreview is a would-be pindex of an IndexPreview.  The
+// pindex name embeds the index UUID, which is only assigned when
+// the index definition is saved, so the created pindexes share just
+// the index name prefix and the source partitions hash of the name.
+type PIndexPreview struct {
+	Name             string               `json:"name"`
+	SourcePartitions string               `json:"sourcePartitions"`
+	NumPartitions    int                  `json:"numPartitions"`
+	Nodes            []*PIndexPreviewNode `json:"nodes"` // By priority.
+}
+
+// A PIndexPreviewNode is a would-be assignment of a pindex to a node.
+type PIndexPreviewNode struct {
+	UUID     string `json:"uuid"`
+	HostPort string `json:"hostPort"`
+	Priority int    `json:"priority"`
+	CanRead  bool   `json:"canRead"`
+	CanWrite bool   `json:"canWrite"`
+}
+
+// PreviewIndex is a dry-run of CreateIndex: the index definition is
+// validated and prepared as by CreateIndex, and is then split into
+// pindexes and placed onto the current nodes, without changing the
+// Cfg.  The prevIndexUUID has the same meaning as for CreateIndexEx.
+func (mgr *Manager) PreviewIndex(sourceType,
+	sourceName, sourceUUID, sourceParams,
+	indexType, indexName, indexParams string, planParams PlanParams,
+	prevIndexUUID string) (*IndexPreview, error) {
+	indexDef, err := mgr.prepareIndexDef(sourceType, sourceName,
+		sourceUUID, sourceParams, indexType, indexName, indexParams,
+		planParams)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeDefsKnown, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_KNOWN)
+	if err != nil {
+		return nil, fmt.Errorf("manager_preview: CfgGetNodeDefs,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+	if nodeDefsKnown == nil ||
+		len(nodeDefsKnown.NodeDefs) < planParams.NumReplicas+1 {
+		return nil, fmt.Errorf("manager_preview: cluster needs %d"+
+			" search nodes to support the requested replica count of %d",
+			planParams.NumReplicas+1, planParams.NumReplicas)
+	}
+
+	indexDefs, nodeDefs, planPIndexesPrev, _, err :=
+		PlannerGetPlan(mgr.log, mgr.cfg, mgr.version, "")
+	if err != nil {
+		return nil, fmt.Errorf("manager_preview: PlannerGetPlan,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	return CalcIndexPreview(mgr.log, indexDefs, nodeDefs,
+		planPIndexesPrev, indexDef, prevIndexUUID,
+		CfgGetVersion(mgr.cfg), mgr.server, mgr.Options())
+}
+
+// CalcIndexPreview computes the pindexes and their node placements
+// of a prepared index definition, by running the planner against a
+// copy of the index definitions that includes the indexDef.
+func CalcIndexPreview(log Log, indexDefs *IndexDefs,
+	nodeDefs *NodeDefs, planPIndexesPrev *PlanPIndexes,
+	indexDef *IndexDef, prevIndexUUID string, version, server string,
+	options map[string]string) (*IndexPreview, error) {
+	indexName := indexDef.Name
+
+	if nodeDefs == nil ||
+		len(nodeDefs.NodeDefs) < indexDef.PlanParams.NumReplicas+1 {
+		return nil, fmt.Errorf("manager_preview: cluster needs %d"+
+			" search nodes to support the requested replica count of %d",
+			indexDef.PlanParams.NumReplicas+1,
+			indexDef.PlanParams.NumReplicas)
+	}
+
+	indexDefsSim := NewIndexDefs(version)
+	if indexDefs != nil {
+		var err error
+		indexDefsSim, err = copyIndexDefs(indexDefs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prevIndex := indexDefsSim.IndexDefs[indexName]
+	switch prevIndexUUID {
+	case "": // New index creation.
+		if prevIndex != nil {
+			return nil, fmt.Errorf("manager_preview: an index with the"+
+				" same name already exists: %s", indexName)
+		}
+	case "*":
+	default: // Update index definition.
+		if prevIndex == nil {
+			return nil, fmt.Errorf("manager_preview: index missing for"+
+				" update, indexName: %s", indexName)
+		}
+		if prevIndex.UUID != prevIndexUUID {
+			return nil, fmt.Errorf("manager_preview: current index UUID: %s,"+
+				" did not match input UUID: %s", prevIndex.UUID, prevIndexUUID)
+		}
+	}
+
+	indexDefSim := *indexDef
+	indexDefSim.UUID = NewUUID()
+	indexDefsSim.IndexDefs[indexName] = &indexDefSim
+
+	onlyIndex := func(def *IndexDef, prev, curr *PlanPIndexes) bool {
+		return def.Name == indexName
+	}
+
+	planPIndexes, err := CalcPlan(log, "", indexDefsSim, nodeDefs,
+		planPIndexesPrev, version, server, options, onlyIndex)
+	if err != nil {
+		return nil, fmt.Errorf("manager_preview: CalcPlan,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+	if planPIndexes == nil {
+		return nil, fmt.Errorf("manager_preview: no plan,"+
+			" indexName: %s", indexName)
+	}
+
+	rv := &IndexPreview{
+		IndexName: indexName,
+		IndexDef:  indexDef,
+		PIndexes:  []*PIndexPreview{},
+		Warnings:  planPIndexes.Warnings[indexName],
+	}
+
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.IndexName != indexName {
+			continue
+		}
+
+		p := &PIndexPreview{
+			Name:             planPIndex.Name,
+			SourcePartitions: planPIndex.SourcePartitions,
+			Nodes:            []*PIndexPreviewNode{},
+		}
+		if planPIndex.SourcePartitions != "" {
+			p.NumPartitions =
+				len(strings.Split(planPIndex.SourcePartitions, ","))
+		}
+
+		for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+			n := &PIndexPreviewNode{
+				UUID:     nodeUUID,
+				Priority: planPIndexNode.Priority,
+				CanRead:  planPIndexNode.CanRead,
+				CanWrite: planPIndexNode.CanWrite,
+			}
+			if nodeDef := nodeDefs.NodeDefs[nodeUUID]; nodeDef != nil {
+				n.HostPort = nodeDef.HostPort
+			}
+			p.Nodes = append(p.Nodes, n)
+		}
+
+		sort.Slice(p.Nodes, func(i, j int) bool {
+			if p.Nodes[i].Priority != p.Nodes[j].Priority {
+				return p.Nodes[i].Priority < p.Nodes[j].Priority
+			}
+			return p.Nodes[i].UUID < p.Nodes[j].UUID
+		})
+
+		rv.PIndexes = append(rv.PIndexes, p)
+	}
+
+	sort.Slice(rv.PIndexes, func(i, j int) bool {
+		return rv.PIndexes[i].Name < rv.PIndexes[j].Name
+	})
+
+	return rv, nil
+}
@@ -0,0 +1,122 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestManagerPreviewIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	options := map[string]string{
+		"maxReplicasAllowed": "3",
+	}
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, options)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	var err error
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		err = registerNode(&NodeDef{
+			HostPort:    "2",
+			UUID:        "2",
+			ImplVersion: Version,
+		}, kind, m)
+		if err != nil {
+			t.Fatalf("registerNode err: %v", err)
+		}
+	}
+
+	sourceParams := "{\"numPartitions\":5}"
+	planParams := PlanParams{MaxPartitionsPerPIndex: 2, NumReplicas: 1}
+
+	if _, err = m.PreviewIndex("primary", "default", "123", sourceParams,
+		"not-a-type", "foo", "", planParams, ""); err == nil {
+		t.Errorf("expected err on unknown indexType")
+	}
+	if _, err = m.PreviewIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "", PlanParams{NumReplicas: 2}, ""); err == nil {
+		t.Errorf("expected err with too few nodes")
+	}
+
+	preview, err := m.PreviewIndex("primary", "default", "123",
+		sourceParams, "blackhole", "foo", "", planParams, "")
+	if err != nil {
+		t.Fatalf("expected preview to work, err: %v", err)
+	}
+	if len(preview.Warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", preview.Warnings)
+	}
+	if len(preview.PIndexes) != 3 {
+		t.Fatalf("expected 3 pindexes, got: %d", len(preview.PIndexes))
+	}
+	numPartitions := 0
+	for _, p := range preview.PIndexes {
+		if !strings.HasPrefix(p.Name, "foo_") {
+			t.Errorf("unexpected pindex name: %s", p.Name)
+		}
+		if p.NumPartitions < 1 || p.NumPartitions > 2 {
+			t.Errorf("unexpected numPartitions: %#v", p)
+		}
+		numPartitions += p.NumPartitions
+		if len(p.Nodes) != 2 ||
+			p.Nodes[0].Priority != 0 || p.Nodes[1].Priority != 1 ||
+			p.Nodes[0].UUID == p.Nodes[1].UUID {
+			t.Errorf("expected a primary and a replica node, got: %#v",
+				p.Nodes)
+		}
+	}
+	if numPartitions != 5 {
+		t.Errorf("expected 5 partitions, got: %d", numPartitions)
+	}
+
+	indexDefs, _, _ := CfgGetIndexDefs(cfg)
+	if indexDefs != nil && indexDefs.IndexDefs["foo"] != nil {
+		t.Errorf("expected preview to not save the indexDef")
+	}
+	planPIndexes, _, _ := CfgGetPlanPIndexes(cfg)
+	if planPIndexes != nil && len(planPIndexes.PlanPIndexes) != 0 {
+		t.Errorf("expected preview to not change the plan")
+	}
+
+	if err = m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "", planParams, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	if _, err = m.PreviewIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "", planParams, ""); err == nil {
+		t.Errorf("expected err on an existing index")
+	}
+	if _, err = m.PreviewIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "", planParams, "wrong-uuid"); err == nil {
+		t.Errorf("expected err on a mismatched prevIndexUUID")
+	}
+
+	preview, err = m.PreviewIndex("primary", "default", "123",
+		sourceParams, "blackhole", "foo", "", PlanParams{}, "*")
+	if err != nil {
+		t.Fatalf("expected update preview to work, err: %v", err)
+	}
+	if len(preview.PIndexes) != 1 || preview.PIndexes[0].NumPartitions != 5 {
+		t.Errorf("expected 1 pindex of 5 partitions, got: %#v",
+			preview.PIndexes)
+	}
+}
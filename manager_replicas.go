@@ -0,0 +1,434 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// A ReplicaMove represents a single pindex replica that will be
+// added to or removed from a node as part of a replica count change.
+type ReplicaMove struct {
+	SourcePartitions string `json:"sourcePartitions"`
+	Node             string `json:"node"`
+	Op               string `json:"op"` // "add" or "del".
+}
+
+// A ReplicaCountChange describes the outcome of changing the
+// NumReplicas of an index definition, as computed by a simulated
+// planner run against the current Cfg.
+type ReplicaCountChange struct {
+	IndexName       string         `json:"indexName"`
+	IndexUUID       string         `json:"indexUUID"`
+	PrevIndexUUID   string         `json:"prevIndexUUID,omitempty"`
+	PrevNumReplicas int            `json:"prevNumReplicas"`
+	NumReplicas     int            `json:"numReplicas"`
+	Moves           []*ReplicaMove `json:"moves"`
+	Warnings        []string       `json:"warnings,omitempty"`
+}
+
+// ReplicaCountProgress reports how many of the moves of a
+// ReplicaCountChange have been carried out by the nodes, along with
+// the rollout of all the planned pindexes of the updated index.
+type ReplicaCountProgress struct {
+	TotMoves  int `json:"totMoves"`
+	DoneMoves int `json:"doneMoves"`
+
+	// TotPIndexNodes is the number of planned pindex assignments to
+	// nodes of the updated index, of which RunningPIndexNodes are
+	// running.
+	TotPIndexNodes     int `json:"totPIndexNodes"`
+	RunningPIndexNodes int `json:"runningPIndexNodes"`
+}
+
+// Done returns true when all the moves have been carried out and all
+// the planned pindexes of the updated index are running.
+func (p *ReplicaCountProgress) Done() bool {
+	return p.DoneMoves >= p.TotMoves && p.TotPIndexNodes > 0 &&
+		p.RunningPIndexNodes >= p.TotPIndexNodes
+}
+
+// PreviewReplicaCount simulates a change of an index's NumReplicas
+// and returns the resulting replica moves, without changing the Cfg.
+// An error is returned if the cluster can't satisfy the requested
+// replica count, including any rack/hierarchy constraints.
+func (mgr *Manager) PreviewReplicaCount(indexName string,
+	numReplicas int) (*ReplicaCountChange, error) {
+	indexDefs, nodeDefs, planPIndexesPrev, _, err :=
+		PlannerGetPlan(mgr.log, mgr.cfg, mgr.version, "")
+	if err != nil {
+		return nil, fmt.Errorf("manager_replicas: PlannerGetPlan,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	return CalcReplicaCountChange(mgr.log, indexDefs, nodeDefs,
+		planPIndexesPrev, indexName, numReplicas,
+		CfgGetVersion(mgr.cfg), mgr.server, mgr.Options())
+}
+
+// CalcReplicaCountChange computes the replica moves that would
+// result from changing the NumReplicas of the named index, by
+// running the planner against a copy of the index definitions.
+func CalcReplicaCountChange(log Log, indexDefs *IndexDefs,
+	nodeDefs *NodeDefs, planPIndexesPrev *PlanPIndexes,
+	indexName string, numReplicas int, version, server string,
+	options map[string]string) (*ReplicaCountChange, error) {
+	if indexDefs == nil || indexDefs.IndexDefs[indexName] == nil {
+		return nil, fmt.Errorf("manager_replicas: no index,"+
+			" indexName: %s", indexName)
+	}
+
+	maxReplicasAllowed, _ := strconv.Atoi(options["maxReplicasAllowed"])
+	if numReplicas < 0 || numReplicas > maxReplicasAllowed {
+		return nil, fmt.Errorf("manager_replicas: maxReplicasAllowed:"+
+			" '%v', but request for '%v'", maxReplicasAllowed, numReplicas)
+	}
+
+	indexDefsSim, err := copyIndexDefs(indexDefs)
+	if err != nil {
+		return nil, err
+	}
+
+	indexDef := indexDefsSim.IndexDefs[indexName]
+	if indexDef.PlanParams.PlanFrozen {
+		return nil, fmt.Errorf("manager_replicas: cannot change"+
+			" replica count for a planFrozen index, indexName: %s",
+			indexName)
+	}
+
+	rv := &ReplicaCountChange{
+		IndexName:       indexName,
+		IndexUUID:       indexDef.UUID,
+		PrevNumReplicas: indexDef.PlanParams.NumReplicas,
+		NumReplicas:     numReplicas,
+	}
+
+	indexDef.PlanParams.NumReplicas = numReplicas
+
+	err = checkReplicaCountSatisfiable(indexDef, nodeDefs, planPIndexesPrev)
+	if err != nil {
+		return nil, err
+	}
+
+	onlyIndex := func(def *IndexDef, prev, curr *PlanPIndexes) bool {
+		return def.Name == indexName
+	}
+
+	planPIndexes, err := CalcPlan(log, "", indexDefsSim, nodeDefs,
+		planPIndexesPrev, version, server, options, onlyIndex)
+	if err != nil {
+		return nil, fmt.Errorf("manager_replicas: CalcPlan,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+	if planPIndexes == nil {
+		return nil, fmt.Errorf("manager_replicas: no plan,"+
+			" indexName: %s", indexName)
+	}
+
+	rv.Warnings = planPIndexes.Warnings[indexName]
+	if len(rv.Warnings) > 0 {
+		return rv, fmt.Errorf("manager_replicas: replica count: %d"+
+			" not satisfiable, indexName: %s, warnings: %v",
+			numReplicas, indexName, rv.Warnings)
+	}
+
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		if len(planPIndex.Nodes) < numReplicas+1 {
+			return rv, fmt.Errorf("manager_replicas: replica count: %d"+
+				" not satisfiable, indexName: %s, planPIndex: %s"+
+				" only has %d nodes", numReplicas, indexName,
+				planPIndex.Name, len(planPIndex.Nodes))
+		}
+	}
+
+	rv.Moves = diffReplicaNodes(indexName, planPIndexesPrev, planPIndexes)
+
+	return rv, nil
+}
+
+// SetReplicaCount changes the NumReplicas of an index definition as
+// an explicit operation.  The moves are first previewed and validated
+// and then the updated index definition is saved, retrying on CAS
+// conflicts, and the planner is kicked.  The returned
+// ReplicaCountChange can be passed to GetReplicaCountProgress to
+// track the change.
+func (mgr *Manager) SetReplicaCount(indexName string, numReplicas int) (
+	*ReplicaCountChange, error) {
+	atomic.AddUint64(&mgr.stats.TotSetReplicaCount, 1)
+
+	change, err := mgr.PreviewReplicaCount(indexName, numReplicas)
+	if err != nil {
+		return nil, err
+	}
+
+	prevIndexUUID := change.IndexUUID
+
+	var indexUUID string
+
+	retry := NewCASRetry(INDEX_DEFS_KEY)
+	tries := 0
+	for {
+		tries += 1
+		if tries > 100 {
+			return nil, fmt.Errorf("manager_replicas: SetReplicaCount,"+
+				" too many tries: %d", tries)
+		}
+
+		indexUUID, err = mgr.saveReplicaCount(indexName, prevIndexUUID,
+			numReplicas)
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				retry.Conflict()
+				continue // Retry on CAS mismatch.
+			}
+
+			return nil, err
+		}
+
+		retry.Done(nil)
+		break // Success.
+	}
+
+	change.PrevIndexUUID = prevIndexUUID
+	change.IndexUUID = indexUUID
+
+	mgr.log.Printf("manager_replicas: replica count changed,"+
+		" indexName: %s, numReplicas: %d -> %d, moves: %d",
+		indexName, change.PrevNumReplicas, numReplicas, len(change.Moves))
+
+	mgr.GetIndexDefs(true)
+	mgr.PlannerKick("api/SetReplicaCount, indexName: " + indexName)
+	atomic.AddUint64(&mgr.stats.TotSetReplicaCountOk, 1)
+
+	return change, nil
+}
+
+// saveReplicaCount updates the NumReplicas of an index definition in
+// the Cfg, returning the new index UUID.  A *CfgCASError is returned
+// as-is so that the caller can retry.
+func (mgr *Manager) saveReplicaCount(indexName, prevIndexUUID string,
+	numReplicas int) (string, error) {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return "", err
+	}
+	if indexDefs == nil {
+		return "", fmt.Errorf("manager_replicas: no indexes,"+
+			" indexName: %s", indexName)
+	}
+	if VersionGTE(mgr.version, indexDefs.ImplVersion) == false {
+		return "", fmt.Errorf("manager_replicas: could not set replica"+
+			" count, indexDefs.ImplVersion: %s > mgr.version: %s",
+			indexDefs.ImplVersion, mgr.version)
+	}
+	indexDef, exists := indexDefs.IndexDefs[indexName]
+	if !exists || indexDef == nil {
+		return "", fmt.Errorf("manager_replicas: no index,"+
+			" indexName: %s", indexName)
+	}
+	if indexDef.UUID != prevIndexUUID {
+		return "", fmt.Errorf("manager_replicas: concurrent index"+
+			" definition update, indexName: %s", indexName)
+	}
+
+	indexDef.PlanParams.NumReplicas = numReplicas
+	indexDef.UUID = NewUUID()
+	indexDefs.UUID = indexDef.UUID
+	indexDefs.ImplVersion = CfgGetVersion(mgr.cfg)
+
+	_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+	if err != nil {
+		if _, ok := err.(*CfgCASError); ok {
+			return "", err
+		}
+
+		return "", fmt.Errorf("manager_replicas: could not save indexDefs,"+
+			" err: %v", err)
+	}
+
+	return indexDef.UUID, nil
+}
+
+// GetReplicaCountProgress returns how many of the moves of a
+// previously applied ReplicaCountChange have been carried out, based
+// on the pindexes that the nodes report as running.  An "add" move is
+// done once its node runs the pindex of the updated index, and a
+// "del" move once its node runs neither the previous nor the updated
+// pindex of the source partitions.
+func (mgr *Manager) GetReplicaCountProgress(change *ReplicaCountChange) (
+	*ReplicaCountProgress, error) {
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+	pindexesRunning, _, err := CfgGetPIndexesRunning(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &ReplicaCountProgress{TotMoves: len(change.Moves)}
+
+	rv.TotPIndexNodes, rv.RunningPIndexNodes = calcIndexRollout(
+		change.IndexName, change.IndexUUID, planPIndexes, pindexesRunning)
+
+	runningByNode := map[string]map[string]bool{}
+	if pindexesRunning != nil {
+		for nodeUUID, n := range pindexesRunning.Nodes {
+			if n != nil {
+				runningByNode[nodeUUID] = StringsToMap(n.PIndexes)
+			}
+		}
+	}
+
+	indexDef := &IndexDef{Name: change.IndexName, UUID: change.IndexUUID}
+	indexDefPrev := &IndexDef{Name: change.IndexName,
+		UUID: change.PrevIndexUUID}
+
+	for _, move := range change.Moves {
+		running := runningByNode[move.Node]
+		curr := running[PlanPIndexName(indexDef, move.SourcePartitions)]
+		if move.Op == "add" && curr {
+			rv.DoneMoves++
+		}
+		if move.Op == "del" && !curr &&
+			!running[PlanPIndexName(indexDefPrev, move.SourcePartitions)] {
+			rv.DoneMoves++
+		}
+	}
+
+	return rv, nil
+}
+
+// --------------------------------------------------------
+
+// checkReplicaCountSatisfiable validates that there are enough nodes,
+// and, when the default rack-awareness rule applies, enough distinct
+// containers to host numReplicas+1 copies of every pindex.
+func checkReplicaCountSatisfiable(indexDef *IndexDef,
+	nodeDefs *NodeDefs, planPIndexesPrev *PlanPIndexes) error {
+	if nodeDefs == nil {
+		return fmt.Errorf("manager_replicas: no nodeDefs")
+	}
+
+	want := indexDef.PlanParams.NumReplicas + 1
+
+	nodeUUIDsAll, _, nodeUUIDsToRemove, _, nodeHierarchy :=
+		CalcNodesLayout(&IndexDefs{}, nodeDefs, planPIndexesPrev)
+	nodeUUIDs := StringsRemoveStrings(nodeUUIDsAll, nodeUUIDsToRemove)
+	if len(nodeUUIDs) < want {
+		return fmt.Errorf("manager_replicas: cluster needs %d nodes to"+
+			" support the requested replica count of %d, has: %d",
+			want, indexDef.PlanParams.NumReplicas, len(nodeUUIDs))
+	}
+
+	if indexDef.PlanParams.HierarchyRules != nil ||
+		indexDef.PlanParams.PlacementPolicy != nil ||
+		len(nodeHierarchy) <= 0 {
+		return nil // Explicit rules are checked via planner warnings.
+	}
+
+	racks := map[string]bool{}
+	for _, nodeUUID := range nodeUUIDs {
+		racks[nodeHierarchy[nodeUUID]] = true
+	}
+	if len(racks) < want {
+		rackNames := make([]string, 0, len(racks))
+		for rack := range racks {
+			rackNames = append(rackNames, rack)
+		}
+		sort.Strings(rackNames)
+
+		return fmt.Errorf("manager_replicas: replica count of %d needs %d"+
+			" distinct containers, has: %s", indexDef.PlanParams.NumReplicas,
+			want, strings.Join(rackNames, ","))
+	}
+
+	return nil
+}
+
+// diffReplicaNodes compares the node assignments of an index between
+// two plans, keyed by source partitions since the pindex names
+// change along with the index definition UUID.
+func diffReplicaNodes(indexName string,
+	planPIndexesPrev, planPIndexes *PlanPIndexes) []*ReplicaMove {
+	nodesPrev := map[string]map[string]*PlanPIndexNode{}
+	if planPIndexesPrev != nil {
+		for _, p := range planPIndexesPrev.PlanPIndexes {
+			if p.IndexName == indexName {
+				nodesPrev[p.SourcePartitions] = p.Nodes
+			}
+		}
+	}
+
+	var rv []*ReplicaMove
+
+	for _, p := range planPIndexes.PlanPIndexes {
+		if p.IndexName != indexName {
+			continue
+		}
+		prev := nodesPrev[p.SourcePartitions]
+		for node := range p.Nodes {
+			if _, exists := prev[node]; !exists {
+				rv = append(rv, &ReplicaMove{
+					SourcePartitions: p.SourcePartitions,
+					Node:             node,
+					Op:               "add",
+				})
+			}
+		}
+		for node := range prev {
+			if _, exists := p.Nodes[node]; !exists {
+				rv = append(rv, &ReplicaMove{
+					SourcePartitions: p.SourcePartitions,
+					Node:             node,
+					Op:               "del",
+				})
+			}
+		}
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].SourcePartitions != rv[j].SourcePartitions {
+			return rv[i].SourcePartitions < rv[j].SourcePartitions
+		}
+		if rv[i].Node != rv[j].Node {
+			return rv[i].Node < rv[j].Node
+		}
+		return rv[i].Op < rv[j].Op
+	})
+
+	return rv
+}
+
+// copyIndexDefs returns a deep copy of the index definitions.
+func copyIndexDefs(indexDefs *IndexDefs) (*IndexDefs, error) {
+	j, err := json.Marshal(indexDefs)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &IndexDefs{}
+	err = json.Unmarshal(j, rv)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,170 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// casConflictCfg makes the next conflicts writes of the index
+// definitions lose a race against a concurrent writer.
+type casConflictCfg struct {
+	*CfgMem
+	conflicts int
+}
+
+func (c *casConflictCfg) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	if key == INDEX_DEFS_KEY && c.conflicts > 0 {
+		c.conflicts--
+		prev, prevCAS, _ := c.CfgMem.Get(key, 0)
+		c.CfgMem.Set(key, prev, prevCAS)
+	}
+	return c.CfgMem.Set(key, val, cas)
+}
+
+func TestManagerSetReplicaCount(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := &casConflictCfg{CfgMem: NewCfgMem()}
+	options := map[string]string{
+		"maxReplicasAllowed": "3",
+	}
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, options)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	sourceParams := "{\"numPartitions\":4}"
+	planParams := PlanParams{MaxPartitionsPerPIndex: 1}
+	if err := m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "", planParams, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+
+	if _, err := m.PreviewReplicaCount("notAnIndex", 1); err == nil {
+		t.Errorf("expected err on missing index")
+	}
+	if _, err := m.PreviewReplicaCount("foo", 1); err == nil {
+		t.Errorf("expected err with too few nodes")
+	}
+	if _, err := m.PreviewReplicaCount("foo", 4); err == nil {
+		t.Errorf("expected err over maxReplicasAllowed")
+	}
+
+	err := registerNode(&NodeDef{
+		HostPort:    "2",
+		UUID:        "2",
+		ImplVersion: Version,
+	}, NODE_DEFS_WANTED, m)
+	if err != nil {
+		t.Fatalf("registerNode err: %v", err)
+	}
+
+	change, err := m.PreviewReplicaCount("foo", 1)
+	if err != nil {
+		t.Fatalf("expected preview to work, err: %v", err)
+	}
+	if change.PrevNumReplicas != 0 || change.NumReplicas != 1 {
+		t.Errorf("unexpected change: %#v", change)
+	}
+	if len(change.Moves) != 4 {
+		t.Errorf("expected 4 moves, got: %d", len(change.Moves))
+	}
+	for _, move := range change.Moves {
+		if move.Op != "add" {
+			t.Errorf("expected only add moves, got: %#v", move)
+		}
+	}
+
+	indexDef, _, _ := m.GetIndexDef("foo", true)
+	if indexDef.PlanParams.NumReplicas != 0 {
+		t.Errorf("expected preview to not change the indexDef")
+	}
+
+	// A concurrent write of the index definitions is retried.
+	cfg.conflicts = 2
+
+	change, err = m.SetReplicaCount("foo", 1)
+	if err != nil {
+		t.Fatalf("expected SetReplicaCount to work, err: %v", err)
+	}
+	if cfg.conflicts != 0 || change.PrevIndexUUID == change.IndexUUID {
+		t.Errorf("expected retried CAS conflicts, change: %#v", change)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	// The plan has the new replicas, but node 2 isn't running them.
+	progress, err := m.GetReplicaCountProgress(change)
+	if err != nil {
+		t.Fatalf("expected progress to work, err: %v", err)
+	}
+	if progress.Done() || progress.TotMoves != 4 || progress.DoneMoves != 0 ||
+		progress.TotPIndexNodes != 8 || progress.RunningPIndexNodes != 4 {
+		t.Errorf("expected partial progress, got: %#v", progress)
+	}
+
+	planPIndexes, _, _ := CfgGetPlanPIndexes(cfg)
+	running, cas, _ := CfgGetPIndexesRunning(cfg)
+	running.Nodes["2"] = &NodePIndexesRunning{}
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.Nodes["2"] != nil {
+			running.Nodes["2"].PIndexes =
+				append(running.Nodes["2"].PIndexes, name)
+		}
+	}
+	if _, err = CfgSetPIndexesRunning(cfg, running, cas); err != nil {
+		t.Fatalf("expected CfgSetPIndexesRunning to work, err: %v", err)
+	}
+
+	progress, err = m.GetReplicaCountProgress(change)
+	if err != nil {
+		t.Fatalf("expected progress to work, err: %v", err)
+	}
+	if !progress.Done() || progress.DoneMoves != 4 {
+		t.Errorf("expected done progress, got: %#v", progress)
+	}
+
+	indexDef, _, _ = m.GetIndexDef("foo", true)
+	if indexDef.PlanParams.NumReplicas != 1 {
+		t.Errorf("expected NumReplicas 1, got: %d",
+			indexDef.PlanParams.NumReplicas)
+	}
+}
+
+func TestCheckReplicaCountSatisfiableRacks(t *testing.T) {
+	nodeDefs := &NodeDefs{
+		NodeDefs: map[string]*NodeDef{
+			"a": {UUID: "a", Container: "dc/rack0"},
+			"b": {UUID: "b", Container: "dc/rack0"},
+			"c": {UUID: "c", Container: "dc/rack1"},
+		},
+	}
+	indexDef := &IndexDef{
+		Name:       "foo",
+		PlanParams: PlanParams{NumReplicas: 1},
+	}
+	if err := checkReplicaCountSatisfiable(indexDef, nodeDefs, nil); err != nil {
+		t.Errorf("expected 2 racks to satisfy 1 replica, err: %v", err)
+	}
+
+	indexDef.PlanParams.NumReplicas = 2
+	if err := checkReplicaCountSatisfiable(indexDef, nodeDefs, nil); err == nil {
+		t.Errorf("expected 2 racks to not satisfy 2 replicas")
+	}
+}
@@ -0,0 +1,245 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The policies for when an index's source has been recreated with a
+// different sourceUUID, such as a bucket that was deleted and then
+// created again with the same name.
+const (
+	// SourceUUIDChangeNone only logs and emits an event.
+	SourceUUIDChangeNone = ""
+
+	// SourceUUIDChangeReset adopts the new sourceUUID, which wipes
+	// the index's pindexes and rebuilds them from seq 0.
+	SourceUUIDChangeReset = "reset"
+
+	// SourceUUIDChangePause disallows both reads and writes on the
+	// index, until an operator intervenes.
+	SourceUUIDChangePause = "pause"
+
+	// SourceUUIDChangeReadOnly stops ingest but keeps serving the
+	// existing, stale index data to queries.
+	SourceUUIDChangeReadOnly = "readOnly"
+)
+
+// A SourceUUIDChange records that the current sourceUUID of an
+// index's source no longer matches the index definition.
+type SourceUUIDChange struct {
+	IndexName     string `json:"indexName"`
+	IndexUUID     string `json:"indexUUID"`
+	SourceType    string `json:"sourceType"`
+	SourceName    string `json:"sourceName"`
+	SourceUUID    string `json:"sourceUUID"`    // As in the indexDef.
+	NewSourceUUID string `json:"newSourceUUID"` // As looked up.
+	Policy        string `json:"policy"`
+}
+
+// SourceUUIDChangePolicy returns the effective policy for an index,
+// where the indexDef's PlanParams take precedence over the
+// "sourceUUIDChangePolicy" manager option.
+func SourceUUIDChangePolicy(indexDef *IndexDef,
+	options map[string]string) string {
+	if indexDef.PlanParams.SourceUUIDChangePolicy != "" {
+		return indexDef.PlanParams.SourceUUIDChangePolicy
+	}
+	return options["sourceUUIDChangePolicy"]
+}
+
+// CheckSourceUUIDs looks up the current sourceUUID of every index
+// definition's source, via the FeedType's SourceUUIDLookUp, and
+// applies the configured policy to the indexes whose source was
+// recreated.  The detected changes are returned.
+func (mgr *Manager) CheckSourceUUIDs() ([]*SourceUUIDChange, error) {
+	atomic.AddUint64(&mgr.stats.TotCheckSourceUUIDs, 1)
+
+	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if indexDefs == nil {
+		return nil, nil
+	}
+
+	options := mgr.Options()
+
+	var indexNames []string
+	for indexName := range indexDefs.IndexDefs {
+		indexNames = append(indexNames, indexName)
+	}
+	sort.Strings(indexNames)
+
+	var changes []*SourceUUIDChange
+
+	for _, indexName := range indexNames {
+		indexDef := indexDefs.IndexDefs[indexName]
+		if indexDef.SourceUUID == "" {
+			continue // The index accepts any incarnation of the source.
+		}
+
+		sourceUUID, err := DataSourceUUID(indexDef.SourceType,
+			indexDef.SourceName, indexDef.SourceParams, mgr.server, options)
+		if err != nil {
+			mgr.log.Warnf("manager_source_uuid: lookup failed,"+
+				" indexName: %s, sourceName: %s, err: %v",
+				indexName, indexDef.SourceName, err)
+			continue
+		}
+		if sourceUUID == "" || sourceUUID == indexDef.SourceUUID {
+			continue
+		}
+
+		policy := SourceUUIDChangePolicy(indexDef, options)
+		if sourceUUIDChangeApplied(indexDef, policy) {
+			continue
+		}
+
+		changes = append(changes, &SourceUUIDChange{
+			IndexName:     indexName,
+			IndexUUID:     indexDef.UUID,
+			SourceType:    indexDef.SourceType,
+			SourceName:    indexDef.SourceName,
+			SourceUUID:    indexDef.SourceUUID,
+			NewSourceUUID: sourceUUID,
+			Policy:        policy,
+		})
+	}
+
+	for _, change := range changes {
+		atomic.AddUint64(&mgr.stats.TotSourceUUIDChanged, 1)
+
+		mgr.log.Warnf("manager_source_uuid: source recreated,"+
+			" indexName: %s, sourceName: %s, sourceUUID: %s -> %s,"+
+			" policy: %q", change.IndexName, change.SourceName,
+			change.SourceUUID, change.NewSourceUUID, change.Policy)
+
+		event, _ := json.Marshal(struct {
+			Event string `json:"event"`
+			Time  string `json:"time"`
+			*SourceUUIDChange
+		}{"sourceUUIDChanged", Now().Format(time.RFC3339Nano), change})
+		mgr.AddEvent(event)
+
+		if change.Policy == SourceUUIDChangePause ||
+			change.Policy == SourceUUIDChangeReadOnly {
+			mgr.addIndexEvent(INDEX_EVENT_DEGRADED, change.IndexName,
+				change.IndexUUID, "source recreated, policy: "+change.Policy)
+		}
+
+		err = mgr.applySourceUUIDChange(change)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// applySourceUUIDChange updates the index definition according to
+// the change's policy.
+func (mgr *Manager) applySourceUUIDChange(change *SourceUUIDChange) error {
+	switch change.Policy {
+	case SourceUUIDChangeNone:
+		return nil
+
+	case SourceUUIDChangeReset:
+		mgr.m.Lock()
+		defer mgr.m.Unlock()
+
+		indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
+		if err != nil {
+			return err
+		}
+		if indexDefs == nil {
+			return nil
+		}
+		indexDef := indexDefs.IndexDefs[change.IndexName]
+		if indexDef == nil || indexDef.UUID != change.IndexUUID {
+			return nil // Concurrently updated, so check again later.
+		}
+
+		// A new indexDef UUID leads to new pindex names, so janitors
+		// will remove the old pindexes and rebuild from scratch.
+		indexDef.SourceUUID = change.NewSourceUUID
+		indexDef.UUID = NewUUID()
+		indexDefs.UUID = indexDef.UUID
+		indexDefs.ImplVersion = CfgGetVersion(mgr.cfg)
+
+		_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+		if err != nil {
+			return fmt.Errorf("manager_source_uuid: could not save"+
+				" indexDefs, err: %v", err)
+		}
+
+		return nil
+
+	case SourceUUIDChangePause:
+		return mgr.IndexControl(change.IndexName, change.IndexUUID,
+			"disallow", "pause", "")
+
+	case SourceUUIDChangeReadOnly:
+		return mgr.IndexControl(change.IndexName, change.IndexUUID,
+			"allow", "pause", "")
+	}
+
+	return fmt.Errorf("manager_source_uuid: unknown policy: %q,"+
+		" indexName: %s", change.Policy, change.IndexName)
+}
+
+// sourceUUIDChangeApplied returns true when an index was already
+// paused or made read-only by an earlier check.
+func sourceUUIDChangeApplied(indexDef *IndexDef, policy string) bool {
+	if policy != SourceUUIDChangePause && policy != SourceUUIDChangeReadOnly {
+		return false
+	}
+
+	npp := GetNodePlanParam(indexDef.PlanParams.NodePlanParams, "", "", "")
+	if npp == nil || npp.CanWrite {
+		return false
+	}
+
+	return npp.CanRead == (policy == SourceUUIDChangeReadOnly)
+}
+
+// SourceUUIDCheckLoop periodically invokes CheckSourceUUIDs(), based
+// on the "sourceUUIDCheckIntervalMS" manager option.  The loop exits
+// immediately when the option isn't a positive number.
+func (mgr *Manager) SourceUUIDCheckLoop() {
+	intervalMS, _ := strconv.Atoi(mgr.Options()["sourceUUIDCheckIntervalMS"])
+	if intervalMS <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(intervalMS) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			_, err := mgr.CheckSourceUUIDs()
+			if err != nil {
+				mgr.log.Warnf("manager_source_uuid: CheckSourceUUIDs,"+
+					" err: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,232 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_STALE_PLAN_CHECK_INTERVAL is how often a node checks that
+// it keeps up with the plan in the Cfg, which may be overridden by
+// the "stalePlanCheckInterval" manager option, such as "10s".
+const DEFAULT_STALE_PLAN_CHECK_INTERVAL = 30 * time.Second
+
+// DEFAULT_STALE_PLAN_THRESHOLD is how long a node may stay behind the
+// plan in the Cfg, without making progress, before the stale plan
+// alarm is raised, which may be overridden by the
+// "stalePlanThreshold" manager option, where "0" disables the alarm.
+const DEFAULT_STALE_PLAN_THRESHOLD = 2 * time.Minute
+
+// A StalePlanStatus describes a node that stays behind the plan in the
+// Cfg, either as its cached plan is stale, such as when its Cfg
+// subscription was lost, or as its janitor hasn't worked on the
+// latest plan, such as when the janitor is stuck.  Either way, the
+// node's pindexes and feeds silently drift from the plan.
+type StalePlanStatus struct {
+	Since           string `json:"since"`
+	CfgPlanUUID     string `json:"cfgPlanUUID"`
+	CachedPlanUUID  string `json:"cachedPlanUUID,omitempty"`
+	JanitorPlanUUID string `json:"janitorPlanUUID,omitempty"`
+	CacheBehind     bool   `json:"cacheBehind"`
+	JanitorBehind   bool   `json:"janitorBehind"`
+}
+
+// A stalePlanTracker tracks how long a part of a node is behind the
+// plan in the Cfg, without making progress.
+type stalePlanTracker struct {
+	cas   uint64 // The CAS of the plan the part was last at.
+	since time.Time
+}
+
+// update returns how long the part is behind, where any progress of
+// the part, even if to a plan that's not the latest, restarts the
+// tracking.
+func (t *stalePlanTracker) update(behind bool, cas uint64,
+	now time.Time) time.Duration {
+	if !behind {
+		t.since = time.Time{}
+		return 0
+	}
+	if t.since.IsZero() || t.cas != cas {
+		t.cas = cas
+		t.since = now
+	}
+	return now.Sub(t.since)
+}
+
+// StalePlanLoop periodically checks whether the node stays behind
+// the plan in the Cfg.  See checkStalePlanOnce().
+func (mgr *Manager) StalePlanLoop() {
+	interval := DEFAULT_STALE_PLAN_CHECK_INTERVAL
+	if v, err := time.ParseDuration(
+		mgr.Options()["stalePlanCheckInterval"]); err == nil && v > 0 {
+		interval = v
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			mgr.checkStalePlanOnce(time.Now())
+		}
+	}
+}
+
+// StalePlan returns the status of the stale plan alarm, or nil when
+// the node keeps up with the plan in the Cfg.
+func (mgr *Manager) StalePlan() *StalePlanStatus {
+	mgr.stalePlanMutex.Lock()
+	defer mgr.stalePlanMutex.Unlock()
+
+	if mgr.stalePlan == nil {
+		return nil
+	}
+	rv := *mgr.stalePlan
+	return &rv
+}
+
+// janitorPlanned records the plan that the janitor last worked on.
+func (mgr *Manager) janitorPlanned(planUUID string, cas uint64) {
+	mgr.stalePlanMutex.Lock()
+	mgr.janitorPlanUUID = planUUID
+	mgr.janitorPlanCAS = cas
+	mgr.stalePlanMutex.Unlock()
+}
+
+// checkStalePlanOnce compares the plan in the Cfg with the node's
+// cached plan and with the plan of its last JanitorOnce, by their CAS,
+// and raises the stale plan alarm when either stays behind, without
+// progress, for longer than the threshold.  On raising the alarm,
+// the plan key is subscribed again, the cached plan is refreshed and
+// the janitor is kicked.  The alarm is cleared once the node caught
+// up, and both transitions are reported as events.
+func (mgr *Manager) checkStalePlanOnce(now time.Time) {
+	threshold := DEFAULT_STALE_PLAN_THRESHOLD
+	if v, err := time.ParseDuration(
+		mgr.Options()["stalePlanThreshold"]); err == nil {
+		threshold = v
+	}
+	if threshold <= 0 || mgr.cfg == nil {
+		return
+	}
+
+	atomic.AddUint64(&mgr.stats.TotStalePlanCheck, 1)
+
+	val, cas, err := mgr.cfg.Get(PLAN_PINDEXES_KEY, 0)
+	if err != nil || val == nil {
+		// An unreachable Cfg is handled as a degraded manager.
+		return
+	}
+
+	mgr.m.RLock()
+	cached := mgr.lastPlanPIndexes
+	cachedCAS := mgr.lastPlanPIndexesCAS
+	mgr.m.RUnlock()
+
+	// A plan that was never cached is loaded on its first use.
+	cacheBehind := cached != nil && cachedCAS != cas
+
+	janitor := mgr.tagsMap == nil ||
+		(mgr.tagsMap["pindex"] && mgr.tagsMap["janitor"])
+
+	mgr.stalePlanMutex.Lock()
+	janitorBehind := janitor && mgr.janitorPlanCAS != cas
+	janitorPlanUUID := mgr.janitorPlanUUID
+
+	cacheStale := mgr.stalePlanCache.update(cacheBehind, cachedCAS, now)
+	janitorStale := mgr.stalePlanJanitor.update(janitorBehind,
+		mgr.janitorPlanCAS, now)
+
+	since := mgr.stalePlanCache.since
+	if since.IsZero() || (!mgr.stalePlanJanitor.since.IsZero() &&
+		mgr.stalePlanJanitor.since.Before(since)) {
+		since = mgr.stalePlanJanitor.since
+	}
+
+	prev := mgr.stalePlan
+	stale := cacheStale >= threshold || janitorStale >= threshold
+
+	var curr *StalePlanStatus
+	if stale {
+		curr = &StalePlanStatus{
+			Since:           since.Format(time.RFC3339Nano),
+			JanitorPlanUUID: janitorPlanUUID,
+			CacheBehind:     cacheBehind,
+			JanitorBehind:   janitorBehind,
+		}
+		if prev != nil {
+			curr.CfgPlanUUID = prev.CfgPlanUUID
+		}
+		if cached != nil {
+			curr.CachedPlanUUID = cached.UUID
+		}
+	}
+	mgr.stalePlan = curr
+	mgr.stalePlanMutex.Unlock()
+
+	if stale && prev == nil {
+		// Only a stale node pays to parse the plan, for its UUID.
+		planPIndexes := &PlanPIndexes{}
+		if json.Unmarshal(val, planPIndexes) == nil {
+			mgr.stalePlanMutex.Lock()
+			curr.CfgPlanUUID = planPIndexes.UUID
+			mgr.stalePlanMutex.Unlock()
+		}
+
+		atomic.AddUint64(&mgr.stats.TotStalePlan, 1)
+
+		mgr.log.Warnf("manager_stale_plan: behind the cfg plan: %s,"+
+			" cached plan: %s, cacheBehind: %t, janitor plan: %s,"+
+			" janitorBehind: %t, since: %s", curr.CfgPlanUUID,
+			curr.CachedPlanUUID, cacheBehind, janitorPlanUUID,
+			janitorBehind, curr.Since)
+
+		mgr.addStalePlanEvent("planStale", curr)
+
+		if mgr.cfgHub != nil {
+			err = mgr.cfgHub.Resubscribe([]string{PLAN_PINDEXES_KEY})
+			if err != nil {
+				mgr.log.Warnf("manager_stale_plan: resubscribe, err: %v", err)
+			}
+		}
+
+		mgr.GetPlanPIndexes(true)
+
+		// The janitor might be stuck, so don't wait for it.
+		go mgr.JanitorKick("manager_stale_plan: behind the cfg plan")
+
+		return
+	}
+
+	if !stale && prev != nil {
+		atomic.AddUint64(&mgr.stats.TotStalePlanRecovered, 1)
+
+		mgr.log.Printf("manager_stale_plan: caught up with the cfg plan")
+
+		mgr.addStalePlanEvent("planStaleRecovered", prev)
+	}
+}
+
+func (mgr *Manager) addStalePlanEvent(name string, s *StalePlanStatus) {
+	event, _ := json.Marshal(struct {
+		Event string `json:"event"`
+		*StalePlanStatus
+		Time string `json:"time"`
+	}{name, s, time.Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+}
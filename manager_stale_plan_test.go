@@ -0,0 +1,132 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStalePlan(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil,
+		map[string]string{"stalePlanThreshold": "1m"})
+
+	// Without a Start(), the manager has no Cfg subscriptions and no
+	// janitor, as if they were lost or stuck.
+	setPlan := func() (string, uint64) {
+		p := NewPlanPIndexes(Version)
+		_, cas, _ := CfgGetPlanPIndexes(cfg)
+		cas, err := CfgSetPlanPIndexes(cfg, p, cas)
+		if err != nil {
+			t.Fatalf("expected CfgSetPlanPIndexes() to work, err: %v", err)
+		}
+		return p.UUID, cas
+	}
+
+	planEvents := func() (rv []string) {
+		m.VisitEvents(func(event []byte) {
+			var e StalePlanStatus
+			var name struct {
+				Event string `json:"event"`
+			}
+			json.Unmarshal(event, &e)
+			json.Unmarshal(event, &name)
+			rv = append(rv, name.Event+":"+e.CfgPlanUUID)
+		})
+		return rv
+	}
+
+	uuid0, cas0 := setPlan()
+	m.GetPlanPIndexes(true)
+	m.janitorPlanned(uuid0, cas0)
+
+	t0 := time.Now()
+	m.checkStalePlanOnce(t0)
+	if m.StalePlan() != nil {
+		t.Errorf("expected no stale plan")
+	}
+
+	uuid1, cas1 := setPlan()
+
+	m.checkStalePlanOnce(t0.Add(time.Second))
+	if m.StalePlan() != nil {
+		t.Errorf("expected no stale plan within the threshold")
+	}
+
+	m.checkStalePlanOnce(t0.Add(2 * time.Minute))
+	s := m.StalePlan()
+	if s == nil || !s.CacheBehind || !s.JanitorBehind ||
+		s.CfgPlanUUID != uuid1 || s.CachedPlanUUID != uuid0 ||
+		s.JanitorPlanUUID != uuid0 {
+		t.Fatalf("expected a stale plan, got: %#v", s)
+	}
+	if h := m.Health(); h.Status != "degraded" || h.StalePlan == nil ||
+		h.CfgErr != "" {
+		t.Errorf("expected a degraded health, got: %#v", h)
+	}
+
+	// The alarm refreshed the cached plan, while the janitor is still
+	// behind until it works on the latest plan.
+	if p, _, _ := m.GetPlanPIndexes(false); p == nil || p.UUID != uuid1 {
+		t.Errorf("expected a refreshed plan, got: %#v", p)
+	}
+	m.checkStalePlanOnce(t0.Add(3 * time.Minute))
+	if s = m.StalePlan(); s == nil || s.CacheBehind || !s.JanitorBehind {
+		t.Errorf("expected only the janitor behind, got: %#v", s)
+	}
+
+	m.janitorPlanned(uuid1, cas1)
+	m.checkStalePlanOnce(t0.Add(4 * time.Minute))
+	if h := m.Health(); h.Status != "ok" || h.StalePlan != nil {
+		t.Errorf("expected an ok health, got: %#v", h)
+	}
+
+	exp := []string{"planStale:" + uuid1, "planStaleRecovered:" + uuid1}
+	if got := planEvents(); len(got) != 2 || got[0] != exp[0] || got[1] != exp[1] {
+		t.Errorf("expected events: %v, got: %v", exp, got)
+	}
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotStalePlan != 1 || stats.TotStalePlanRecovered != 1 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+}
+
+func TestStalePlanTrackerProgress(t *testing.T) {
+	var tr stalePlanTracker
+
+	t0 := time.Now()
+	if d := tr.update(true, 1, t0); d != 0 {
+		t.Errorf("expected 0, got: %v", d)
+	}
+	if d := tr.update(true, 1, t0.Add(time.Minute)); d != time.Minute {
+		t.Errorf("expected a minute, got: %v", d)
+	}
+	// Progress to a plan that's still not the latest restarts the
+	// tracking.
+	if d := tr.update(true, 2, t0.Add(2*time.Minute)); d != 0 {
+		t.Errorf("expected 0 on progress, got: %v", d)
+	}
+	if d := tr.update(false, 3, t0.Add(3*time.Minute)); d != 0 ||
+		!tr.since.IsZero() {
+		t.Errorf("expected a reset, got: %v", d)
+	}
+}
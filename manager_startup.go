@@ -0,0 +1,240 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_REGISTER_AFTER_LOAD_TIMEOUT is the default of the
+// "registerAfterLoadTimeout" manager option, which bounds the time
+// that a node waits for its local pindexes before it registers as
+// wanted anyways.
+const DEFAULT_REGISTER_AFTER_LOAD_TIMEOUT = 10 * time.Minute
+
+// The phases of a node's startup, see StartupStatus.
+const (
+	STARTUP_PHASE_REGISTER        = "register"
+	STARTUP_PHASE_REGISTER_KNOWN  = "registerKnown"
+	STARTUP_PHASE_LOAD_DATA_DIR   = "loadDataDir"
+	STARTUP_PHASE_VERIFY_PINDEXES = "verifyPIndexes"
+	STARTUP_PHASE_REGISTER_WANTED = "registerWanted"
+)
+
+// A StartupPhase records the duration of a phase of the startup.
+type StartupPhase struct {
+	Name       string   `json:"name"`
+	Start      string   `json:"start"`
+	DurationMS int64    `json:"durationMS"`
+	TimedOut   bool     `json:"timedOut,omitempty"`
+	NotReady   []string `json:"notReady,omitempty"` // The pindex names.
+	Err        string   `json:"err,omitempty"`
+}
+
+// StartupStatus reports the progress of a node's sequenced startup,
+// see the "registerAfterLoad" manager option.
+type StartupStatus struct {
+	Sequenced bool            `json:"sequenced"`
+	Done      bool            `json:"done"`
+	Phases    []*StartupPhase `json:"phases"`
+}
+
+// startupSequenced returns whether Start() should register the node
+// as wanted only after its local pindexes were loaded and verified,
+// which the "registerAfterLoad" manager option enables, so that the
+// planners don't count a node that can't serve yet.
+func (mgr *Manager) startupSequenced(register string) bool {
+	if mgr.Options()["registerAfterLoad"] != "true" {
+		return false
+	}
+	if mgr.tagsMap != nil && !mgr.tagsMap["pindex"] {
+		return false
+	}
+	return register == "wanted" || register == "wantedForce"
+}
+
+// StartupStatus returns the phases of the node's startup so far.
+func (mgr *Manager) StartupStatus() *StartupStatus {
+	mgr.startupMutex.Lock()
+	defer mgr.startupMutex.Unlock()
+
+	rv := &StartupStatus{
+		Sequenced: mgr.startupSequencedFlag,
+		Done:      mgr.startupDone,
+		Phases:    make([]*StartupPhase, 0, len(mgr.startupPhases)),
+	}
+	for _, p := range mgr.startupPhases {
+		c := *p
+		rv.Phases = append(rv.Phases, &c)
+	}
+	return rv
+}
+
+// startupPhase runs a phase of the startup and records its duration.
+func (mgr *Manager) startupPhase(name string,
+	f func(p *StartupPhase) error) error {
+	startTime := Now()
+
+	p := &StartupPhase{Name: name, Start: startTime.Format(time.RFC3339Nano)}
+
+	err := f(p)
+	if err != nil {
+		p.Err = err.Error()
+	}
+	p.DurationMS = int64(Now().Sub(startTime) / time.Millisecond)
+
+	mgr.startupMutex.Lock()
+	mgr.startupPhases = append(mgr.startupPhases, p)
+	mgr.startupMutex.Unlock()
+
+	mgr.log.Printf("manager_startup: phase: %s, durationMS: %d,"+
+		" timedOut: %t, notReady: %d, err: %v", name, p.DurationMS,
+		p.TimedOut, len(p.NotReady), err)
+
+	return err
+}
+
+// registerAfterLoad waits, up to the "registerAfterLoadTimeout", for
+// the LoadDataDir() to finish and for the loaded pindexes to be
+// queryable, and then registers the node as wanted.
+func (mgr *Manager) registerAfterLoad(register string,
+	loadDoneCh chan struct{}) {
+	timeout := DEFAULT_REGISTER_AFTER_LOAD_TIMEOUT
+	if v, err := time.ParseDuration(
+		mgr.Options()["registerAfterLoadTimeout"]); err == nil && v > 0 {
+		timeout = v
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	stopped := false
+
+	mgr.startupPhase(STARTUP_PHASE_LOAD_DATA_DIR, func(p *StartupPhase) error {
+		select {
+		case <-loadDoneCh:
+		case <-timer.C:
+			p.TimedOut = true
+			atomic.AddUint64(&mgr.stats.TotStartupTimeout, 1)
+		case <-mgr.stopCh:
+			stopped = true
+		}
+		return nil
+	})
+	if stopped {
+		return
+	}
+
+	mgr.startupPhase(STARTUP_PHASE_VERIFY_PINDEXES, func(p *StartupPhase) error {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			p.NotReady = mgr.startupNotReadyPIndexes()
+			if len(p.NotReady) == 0 {
+				return nil
+			}
+
+			select {
+			case <-ticker.C:
+			case <-timer.C:
+				p.TimedOut = true
+				atomic.AddUint64(&mgr.stats.TotStartupTimeout, 1)
+				return nil
+			case <-mgr.stopCh:
+				stopped = true
+				return nil
+			}
+		}
+	})
+	if stopped {
+		return
+	}
+
+	err := mgr.startupPhase(STARTUP_PHASE_REGISTER_WANTED,
+		func(p *StartupPhase) error {
+			return mgr.Register(register)
+		})
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotStartupRegisterErr, 1)
+		mgr.log.Errorf("manager_startup: Register, register: %s, err: %v",
+			register, err)
+	}
+
+	mgr.startupMutex.Lock()
+	mgr.startupDone = true
+	phases := mgr.startupPhases
+	mgr.startupMutex.Unlock()
+
+	event, _ := json.Marshal(struct {
+		Event  string          `json:"event"`
+		Phases []*StartupPhase `json:"phases"`
+		Time   string          `json:"time"`
+	}{"startup", phases, Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+
+	mgr.PlannerKick("registerAfterLoad")
+}
+
+// startupLoaded records the loadDataDir phase of a startup that
+// isn't sequenced.
+func (mgr *Manager) startupLoaded(loadDoneCh chan struct{}) {
+	stopped := false
+	mgr.startupPhase(STARTUP_PHASE_LOAD_DATA_DIR, func(p *StartupPhase) error {
+		select {
+		case <-loadDoneCh:
+		case <-mgr.stopCh:
+			stopped = true
+		}
+		return nil
+	})
+
+	mgr.startupMutex.Lock()
+	mgr.startupDone = !stopped
+	mgr.startupMutex.Unlock()
+}
+
+// startupNotReadyPIndexes returns the sorted names of the local
+// pindexes that are still booting, warming, or not queryable.
+func (mgr *Manager) startupNotReadyPIndexes() []string {
+	mgr.m.RLock()
+	names := make(map[string]bool, len(mgr.pindexes)+len(mgr.bootingPIndexes))
+	for name := range mgr.bootingPIndexes {
+		names[name] = true
+	}
+	for name := range mgr.warmingPIndexes {
+		names[name] = true
+	}
+	var loaded []string
+	for name := range mgr.pindexes {
+		if !names[name] {
+			loaded = append(loaded, name)
+		}
+	}
+	mgr.m.RUnlock()
+
+	for _, name := range loaded {
+		if ready, err := mgr.PIndexReady(name); !ready || err != nil {
+			names[name] = true
+		}
+	}
+
+	rv := make([]string, 0, len(names))
+	for name := range names {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
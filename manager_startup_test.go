@@ -0,0 +1,120 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type startupTestDest struct {
+	TestDest
+	ready int32
+}
+
+func (d *startupTestDest) Ready() (bool, error) {
+	return atomic.LoadInt32(&d.ready) != 0, nil
+}
+
+func TestStartupRegisterAfterLoad(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), []string{"pindex"}, "",
+		1, "", ":1000", emptyDir, "", nil, map[string]string{
+			"registerAfterLoad":        "true",
+			"registerAfterLoadTimeout": "10s",
+		})
+	defer mgr.Stop()
+
+	d := &startupTestDest{}
+	mgr.registerPIndex(&PIndex{Name: "p0", Dest: d})
+
+	err := mgr.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Start to work, err: %v", err)
+	}
+
+	registered := func(kind string) bool {
+		nodeDefs, _, _ := CfgGetNodeDefs(cfg, kind)
+		return nodeDefs != nil && nodeDefs.NodeDefs[mgr.UUID()] != nil
+	}
+
+	if !registered(NODE_DEFS_KNOWN) || registered(NODE_DEFS_WANTED) {
+		t.Fatalf("expected only a known node before the pindexes are ready")
+	}
+	if s := mgr.StartupStatus(); !s.Sequenced || s.Done {
+		t.Errorf("expected a sequenced startup in progress, got: %+v", s)
+	}
+
+	atomic.StoreInt32(&d.ready, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !mgr.StartupStatus().Done && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !registered(NODE_DEFS_WANTED) {
+		t.Fatalf("expected a wanted node once the pindexes are ready")
+	}
+
+	var names []string
+	for _, p := range mgr.StartupStatus().Phases {
+		names = append(names, p.Name)
+		if p.TimedOut || p.Err != "" {
+			t.Errorf("expected no timeout or err, phase: %+v", p)
+		}
+	}
+	exp := []string{STARTUP_PHASE_REGISTER_KNOWN, STARTUP_PHASE_LOAD_DATA_DIR,
+		STARTUP_PHASE_VERIFY_PINDEXES, STARTUP_PHASE_REGISTER_WANTED}
+	if !reflect.DeepEqual(names, exp) {
+		t.Errorf("expected phases: %v, got: %v", exp, names)
+	}
+}
+
+func TestStartupRegisterAfterLoadTimeout(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), []string{"pindex"}, "",
+		1, "", ":1000", emptyDir, "", nil, map[string]string{
+			"registerAfterLoadTimeout": "50ms",
+		})
+	defer mgr.Stop()
+
+	mgr.registerPIndex(&PIndex{Name: "p0", Dest: &startupTestDest{}})
+
+	loadDoneCh := make(chan struct{})
+	close(loadDoneCh)
+
+	mgr.registerAfterLoad("wanted", loadDoneCh)
+
+	nodeDefs, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if nodeDefs == nil || nodeDefs.NodeDefs[mgr.UUID()] == nil {
+		t.Fatalf("expected a wanted node after the timeout")
+	}
+
+	phases := mgr.StartupStatus().Phases
+	if len(phases) != 3 || !phases[1].TimedOut ||
+		!reflect.DeepEqual(phases[1].NotReady, []string{"p0"}) {
+		t.Errorf("expected a timed out verify phase, got: %+v", phases[1])
+	}
+	if atomic.LoadUint64(&mgr.stats.TotStartupTimeout) != 1 {
+		t.Errorf("expected a startup timeout stat")
+	}
+}
@@ -17,6 +17,8 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -77,6 +79,57 @@ func TestPIndexPath(t *testing.T) {
 	if n != "" {
 		t.Errorf("expected empty string on bad pindex path")
 	}
+	n, ok = m.ParsePIndexPath("dir" + string(os.PathSeparator) +
+		".." + string(os.PathSeparator) + "x" + pindexPathSuffix)
+	if ok || n != "" {
+		t.Errorf("expected not-ok on an escaping pindex path, got: %s", n)
+	}
+	for _, name := range []string{"", "../etc/pswd", "a/b", ".x",
+		strings.Repeat("x", PINDEX_NAME_MAX_LEN+1)} {
+		if p = m.PIndexPath(name); p != "" {
+			t.Errorf("expected no path for invalid pindex name: %q,"+
+				" got: %s", name, p)
+		}
+		if ValidatePIndexName(name) == nil {
+			t.Errorf("expected invalid pindex name: %q", name)
+		}
+	}
+	if ValidatePIndexName(strings.Repeat("x", PINDEX_NAME_MAX_LEN)) != nil {
+		t.Errorf("expected a max length pindex name to be valid")
+	}
+}
+
+func TestCalcPlanKeepsInvalidPIndexNames(t *testing.T) {
+	longName := "x" + strings.Repeat("y", PINDEX_NAME_MAX_LEN)
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs[longName] = &IndexDef{Name: longName, UUID: "u",
+		Type: "blackhole", SourceType: "primary"}
+
+	nodeDefs := NewNodeDefs(Version)
+	nodeDefs.NodeDefs["a"] = &NodeDef{UUID: "a", ImplVersion: Version,
+		HostPort: "a:1"}
+
+	planPIndexesPrev := NewPlanPIndexes(Version)
+	planPIndexesPrev.PlanPIndexes["prev"] = &PlanPIndex{Name: "prev",
+		IndexName: longName, IndexUUID: "u",
+		Nodes: map[string]*PlanPIndexNode{"a": {CanRead: true}}}
+
+	log := NewStdLibLog(ioutil.Discard, "", 0)
+
+	planPIndexes, err := CalcPlan(log, "", indexDefs, nodeDefs,
+		planPIndexesPrev, Version, "", nil, nil)
+	if err != nil {
+		t.Fatalf("expected CalcPlan() to work, err: %v", err)
+	}
+	if len(planPIndexes.PlanPIndexes) != 1 ||
+		planPIndexes.PlanPIndexes["prev"] == nil {
+		t.Errorf("expected the previous plan to be kept, got: %+v",
+			planPIndexes.PlanPIndexes)
+	}
+	if len(planPIndexes.Warnings[longName]) != 1 {
+		t.Errorf("expected a warning, got: %v", planPIndexes.Warnings)
+	}
 }
 
 func TestManagerStart(t *testing.T) {
@@ -243,6 +296,12 @@ func TestManagerCreateDeleteIndex(t *testing.T) {
 	if err := m.DeleteIndex("not-an-actual-index-name"); err == nil {
 		t.Errorf("expected bad DeleteIndex() to fail")
 	}
+	longName := strings.Repeat("x", PINDEX_NAME_MAX_LEN-len(
+		PlanPIndexName(&IndexDef{UUID: NewUUID()}, ""))+1)
+	if err := m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", longName, "", PlanParams{}, ""); err == nil {
+		t.Errorf("expected CreateIndex() with a too long name to fail")
+	}
 	m.PlannerNOOP("test")
 	m.JanitorNOOP("test")
 	feeds, pindexes := m.CurrentMaps()
@@ -297,6 +356,17 @@ func TestManagerDeleteAllIndex(t *testing.T) {
 			" got feeds: %+v, pindexes: %+v",
 			feeds, pindexes)
 	}
+	indexNames, err := m.DeleteIndexesBySource("primary", "default", "123",
+		true)
+	if err != nil || len(indexNames) != 2 ||
+		indexNames[0] != "foo1" || indexNames[1] != "foo2" {
+		t.Errorf("expected dry run to list foo1 and foo2,"+
+			" got: %v, err: %v", indexNames, err)
+	}
+	if _, pindexes = m.CurrentMaps(); len(pindexes) != 3 {
+		t.Errorf("expected dry run to not delete, got pindexes: %+v",
+			pindexes)
+	}
 	m.DeleteAllIndexFromSource("primary", "default", "123")
 	m.PlannerNOOP("test")
 	m.JanitorNOOP("test")
@@ -703,6 +773,122 @@ func TestManagerStrangeWorkReqs(t *testing.T) {
 	}
 }
 
+func TestManagerGetPlanPIndexesSnapshot(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+
+	planPIndexes := NewPlanPIndexes(Version)
+	planPIndexes.PlanPIndexes["p0"] = &PlanPIndex{Name: "p0", IndexName: "x"}
+	cas, err := CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p0, byName0, err := m.GetPlanPIndexes(true)
+	if err != nil || p0 == nil || len(byName0["x"]) != 1 {
+		t.Fatalf("expected plan, got: %#v, err: %v", p0, err)
+	}
+	p1, _, err := m.GetPlanPIndexes(true)
+	if err != nil || p1 != p0 {
+		t.Errorf("expected the snapshot to be reused on the same cas")
+	}
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotRefreshLastPlanPIndexes != 1 ||
+		stats.TotRefreshLastPlanPIndexesSame != 1 {
+		t.Errorf("expected 1 refresh and 1 reuse, got: %#v", stats)
+	}
+
+	planPIndexes.UUID = NewUUID()
+	_, err = CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, _, err := m.GetPlanPIndexes(true)
+	if err != nil || p2 == p0 || p2.UUID != planPIndexes.UUID {
+		t.Errorf("expected a new snapshot on a changed plan, got: %#v", p2)
+	}
+}
+
+func TestManagerGetIndexDefsRefresh(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+
+	indexDefs := NewIndexDefs(Version)
+	cas, err := CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d0, _, err := m.GetIndexDefs(true)
+	if err != nil || d0 == nil || d0.UUID != indexDefs.UUID {
+		t.Fatalf("expected index defs, got: %#v, err: %v", d0, err)
+	}
+
+	indexDefs.UUID = NewUUID()
+	indexDefs.IndexDefs["x"] = &IndexDef{Name: "x", UUID: NewUUID()}
+	_, err = CfgSetIndexDefs(cfg, indexDefs, cas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1, byName1, err := m.GetIndexDefs(true)
+	if err != nil || d1 == d0 || d1.UUID != indexDefs.UUID ||
+		byName1["x"] == nil {
+		t.Errorf("expected the refreshed index defs, got: %#v", d1)
+	}
+}
+
+func TestManagerPlannerKickCoalesce(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil,
+		map[string]string{"plannerKickDebounceMS": "200"})
+	defer m.Stop()
+	go m.PlannerLoop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			m.PlannerKick(fmt.Sprintf("kick-%d", i))
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotPlannerKick != 5 ||
+		stats.TotPlannerKickStart != 1 ||
+		stats.TotPlannerKickCoalesced != 4 ||
+		stats.TotPlannerOpRes != 5 {
+		t.Errorf("expected kicks to be coalesced, stats: %#v", stats)
+	}
+
+	// A NOOP ends the debounce window, and is handled after the kick.
+	doneCh := make(chan struct{})
+	go func() {
+		m.PlannerKick("kick-again")
+		close(doneCh)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	m.PlannerNOOP("noop")
+	<-doneCh
+
+	m.StatsCopyTo(&stats)
+	if stats.TotPlannerKickStart != 2 || stats.TotPlannerNOOPOk != 1 {
+		t.Errorf("expected NOOP after kick, stats: %#v", stats)
+	}
+}
+
 func TestManagerStartFeedByType(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
@@ -728,12 +914,23 @@ func TestManagerStartPIndex(t *testing.T) {
 		t.Errorf("expected err on unknown index type")
 	}
 	err = m.startPIndex(&PlanPIndex{
+		Name:      "a_0",
 		IndexType: "blackhole",
 		IndexName: "a",
 	})
 	if err != nil {
 		t.Errorf("expected new blackhole pindex to work, err: %v", err)
 	}
+	for _, name := range []string{"", "../a_1", "a/../../b"} {
+		err = m.startPIndex(&PlanPIndex{
+			Name:      name,
+			IndexType: "blackhole",
+			IndexName: "a",
+		})
+		if err == nil {
+			t.Errorf("expected err on invalid pindex name: %q", name)
+		}
+	}
 }
 
 func TestManagerReStartPIndex(t *testing.T) {
@@ -1079,6 +1276,56 @@ func TestUnregisterNodes(t *testing.T) {
 	}
 }
 
+func TestStandbyRegisterAndPromote(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Start("standby"); err != nil {
+		t.Fatalf("expected Manager.Start(standby) to work, err: %v", err)
+	}
+
+	isIn := func(kind string) bool {
+		nd, _, err := CfgGetNodeDefs(cfg, kind)
+		if err != nil {
+			t.Fatalf("expected CfgGetNodeDefs to work, err: %v", err)
+		}
+		return nd != nil && nd.NodeDefs[m.UUID()] != nil
+	}
+
+	if !isIn(NODE_DEFS_KNOWN) || !isIn(NODE_DEFS_STANDBY) ||
+		isIn(NODE_DEFS_WANTED) {
+		t.Errorf("expected a standby node to be known and not wanted")
+	}
+
+	res, err := m.GCNodeDefs(NodeDefsGCOptions{})
+	if err != nil || len(res.Stale) != 0 {
+		t.Errorf("expected a standby node to not be stale,"+
+			" res: %#v, err: %v", res, err)
+	}
+
+	err = PromoteStandbyNodes(cfg, Version, []string{"not-a-standby"})
+	if err == nil {
+		t.Errorf("expected promoting a non-standby node to fail")
+	}
+
+	err = PromoteStandbyNodes(cfg, Version, []string{m.UUID()})
+	if err != nil {
+		t.Errorf("expected PromoteStandbyNodes to work, err: %v", err)
+	}
+	if !isIn(NODE_DEFS_KNOWN) || isIn(NODE_DEFS_STANDBY) ||
+		!isIn(NODE_DEFS_WANTED) {
+		t.Errorf("expected a promoted node to be known and wanted")
+	}
+
+	err = PromoteStandbyNodes(cfg, Version, []string{m.UUID()})
+	if err != nil {
+		t.Errorf("expected promoting a wanted node to work, err: %v", err)
+	}
+}
+
 func TestManagerRestartPIndex(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
@@ -1487,3 +1734,201 @@ func verifyMgrCurrentMap(m *Manager, feedsCount,
 		time.Sleep(50 * time.Millisecond)
 	}
 }
+
+func TestManagerGCNodeDefs(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	for _, uuid := range []string{"gone0", "gone1"} {
+		err := registerNode(&NodeDef{
+			HostPort:    uuid,
+			UUID:        uuid,
+			ImplVersion: Version,
+		}, NODE_DEFS_KNOWN, m)
+		if err != nil {
+			t.Fatalf("registerNode err: %v", err)
+		}
+	}
+
+	res, err := m.GCNodeDefs(NodeDefsGCOptions{})
+	if err != nil {
+		t.Fatalf("expected GCNodeDefs to work, err: %v", err)
+	}
+	if len(res.Stale) != 2 || len(res.Removed) != 0 {
+		t.Errorf("expected 2 stale and none removed, res: %#v", res)
+	}
+
+	res, err = m.GCNodeDefs(NodeDefsGCOptions{
+		UUIDs:  []string{"gone0", m.UUID()},
+		DryRun: true,
+	})
+	if err != nil || len(res.Removed) != 1 || res.Removed[0] != "gone0" {
+		t.Errorf("expected dry run to remove gone0, res: %#v, err: %v",
+			res, err)
+	}
+
+	res, err = m.GCNodeDefs(NodeDefsGCOptions{UUIDs: []string{"gone0"}})
+	if err != nil || len(res.Removed) != 1 {
+		t.Errorf("expected gone0 removed, res: %#v, err: %v", res, err)
+	}
+
+	res, err = m.GCNodeDefs(NodeDefsGCOptions{MaxAge: time.Nanosecond})
+	if err != nil || len(res.Removed) != 1 || res.Removed[0] != "gone1" {
+		t.Errorf("expected gone1 removed by age, res: %#v, err: %v",
+			res, err)
+	}
+
+	nodeDefs, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if len(nodeDefs.NodeDefs) != 1 || nodeDefs.NodeDefs[m.UUID()] == nil {
+		t.Errorf("expected only the manager's nodeDef, got: %#v",
+			nodeDefs.NodeDefs)
+	}
+}
+
+func TestManagerCheckSourceUUIDs(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	sourceUUID := "123"
+	primary := FeedTypes["primary"]
+	RegisterFeedType("recreatable", &FeedType{
+		Start:      primary.Start,
+		Partitions: primary.Partitions,
+		SourceUUIDLookUp: func(sourceName, sourceParams, server string,
+			options map[string]string) (string, error) {
+			return sourceUUID, nil
+		},
+	})
+	defer delete(FeedTypes, "recreatable")
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	for _, policy := range []string{"", "reset", "readOnly"} {
+		err := m.CreateIndex("recreatable", "default", "123", "",
+			"blackhole", "foo_"+policy, "",
+			PlanParams{SourceUUIDChangePolicy: policy}, "")
+		if err != nil {
+			t.Fatalf("expected CreateIndex() to work, err: %v", err)
+		}
+	}
+	err := m.CreateIndex("recreatable", "default", "123", "",
+		"blackhole", "bar", "",
+		PlanParams{SourceUUIDChangePolicy: "bogus"}, "")
+	if err == nil {
+		t.Errorf("expected CreateIndex() err on bogus policy")
+	}
+
+	changes, err := m.CheckSourceUUIDs()
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes, got: %v, err: %v", changes, err)
+	}
+
+	sourceUUID = "456"
+	changes, err = m.CheckSourceUUIDs()
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got: %v, err: %v", changes, err)
+	}
+
+	indexDefs, _, _ := CfgGetIndexDefs(cfg)
+	if indexDefs.IndexDefs["foo_"].SourceUUID != "123" {
+		t.Errorf("expected unchanged sourceUUID with no policy")
+	}
+	if indexDefs.IndexDefs["foo_reset"].SourceUUID != "456" {
+		t.Errorf("expected new sourceUUID with reset policy")
+	}
+	npp := GetNodePlanParam(
+		indexDefs.IndexDefs["foo_readOnly"].PlanParams.NodePlanParams,
+		"", "", "")
+	if npp == nil || !npp.CanRead || npp.CanWrite {
+		t.Errorf("expected read-only index, got: %#v", npp)
+	}
+
+	changes, _ = m.CheckSourceUUIDs()
+	if len(changes) != 1 || changes[0].IndexName != "foo_" {
+		t.Errorf("expected only the unhandled change, got: %v", changes)
+	}
+}
+
+func TestBootPlanMatches(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+
+	planPIndexes := NewPlanPIndexes(Version)
+
+	paths := map[string]string{}
+	for _, name := range []string{"match", "otherUUID", "otherNode", "unplanned"} {
+		p, err := NewPIndex(mgr, name, "uuid", "blackhole",
+			"indexName", "indexUUID", "",
+			"sourceType", "sourceName", "sourceUUID",
+			"", "0", mgr.PIndexPath(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Close(false)
+		paths[name] = p.Path
+
+		planPIndex := &PlanPIndex{
+			Name:             name,
+			IndexType:        "blackhole",
+			IndexName:        "indexName",
+			IndexUUID:        "indexUUID",
+			SourceType:       "sourceType",
+			SourceName:       "sourceName",
+			SourceUUID:       "sourceUUID",
+			SourcePartitions: "0",
+			Nodes: map[string]*PlanPIndexNode{
+				mgr.UUID(): {CanRead: true, CanWrite: true},
+			},
+		}
+		switch name {
+		case "otherUUID":
+			planPIndex.IndexUUID = "recreated"
+		case "otherNode":
+			planPIndex.Nodes = map[string]*PlanPIndexNode{
+				"node1": {CanRead: true, CanWrite: true},
+			}
+		case "unplanned":
+			continue
+		}
+		planPIndexes.PlanPIndexes[name] = planPIndex
+	}
+
+	if got := mgr.bootPlanMatches(paths); got != nil {
+		t.Errorf("expected no fast path without a plan, got: %v", got)
+	}
+
+	_, err := CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := mgr.bootPlanMatches(paths)
+	if !reflect.DeepEqual(got, map[string]bool{"match": true}) {
+		t.Errorf("expected only the matching pindex, got: %v", got)
+	}
+	if mgr.stats.TotLoadDataDirPlanMatch != 1 ||
+		mgr.stats.TotLoadDataDirPlanMismatch != 3 {
+		t.Errorf("expected match stats, got: %+v", mgr.stats)
+	}
+
+	mgr.SetOptions(map[string]string{"loadDataDirFastPathDisable": "true"})
+	if got := mgr.bootPlanMatches(paths); got != nil {
+		t.Errorf("expected no fast path when disabled, got: %v", got)
+	}
+}
@@ -0,0 +1,441 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// INDEX_DEFS_TRASH_KEY is used for Cfg access to the soft-deleted
+// index definitions.
+const INDEX_DEFS_TRASH_KEY = "indexDefsTrash"
+
+// DEFAULT_INDEX_TRASH_WINDOW is how long soft-deleted indexes are
+// retained when the "indexTrashWindow" manager option isn't set.
+const DEFAULT_INDEX_TRASH_WINDOW = 24 * time.Hour
+
+// INDEX_TRASH_DIR is the subdirectory of the dataDir where the files
+// of soft-deleted pindexes are retained.
+const INDEX_TRASH_DIR = "trash"
+
+// IndexDefsTrash holds soft-deleted index definitions, which can be
+// undeleted until they are purged.
+type IndexDefsTrash struct {
+	UUID        string                         `json:"uuid"`
+	ImplVersion string                         `json:"implVersion"`
+	Entries     map[string]*IndexDefTrashEntry `json:"entries"` // Key is name.
+}
+
+// An IndexDefTrashEntry is a soft-deleted index definition.
+type IndexDefTrashEntry struct {
+	IndexDef  *IndexDef `json:"indexDef"`
+	DeletedAt int64     `json:"deletedAt"` // Unix nanoseconds.
+}
+
+// NewIndexDefsTrash returns an initialized IndexDefsTrash.
+func NewIndexDefsTrash(version string) *IndexDefsTrash {
+	return &IndexDefsTrash{
+		UUID:        NewUUID(),
+		ImplVersion: version,
+		Entries:     make(map[string]*IndexDefTrashEntry),
+	}
+}
+
+// CfgGetIndexDefsTrash returns the soft-deleted index definitions
+// from a Cfg provider.
+func CfgGetIndexDefsTrash(cfg Cfg) (*IndexDefsTrash, uint64, error) {
+	v, cas, err := cfg.Get(INDEX_DEFS_TRASH_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &IndexDefsTrash{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetIndexDefsTrash updates the soft-deleted index definitions on
+// a Cfg provider.
+func CfgSetIndexDefsTrash(cfg Cfg, trash *IndexDefsTrash,
+	cas uint64) (uint64, error) {
+	buf, err := json.Marshal(trash)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(INDEX_DEFS_TRASH_KEY, buf, cas)
+}
+
+// ------------------------------------------------------------------------
+
+// SoftDeleteIndex deletes a logical index definition, but retains it
+// and its local pindex files in a trash area, so that it can be
+// restored with UndeleteIndex() until the trash window passes.
+// Feeds are stopped and queries rejected just like a DeleteIndex(),
+// and the same OP_QUORUM_DELETE_INDEX confirmations are needed, as
+// the trash is purged after the trash window.
+func (mgr *Manager) SoftDeleteIndex(indexName, indexUUID string) (
+	string, error) {
+	err := mgr.checkIndexDeletesQuorum([]*PendingIndexOp{{
+		Op:        "delete",
+		IndexName: indexName,
+		IndexUUID: indexUUID,
+	}})
+	if err != nil {
+		return "", err
+	}
+
+	rv, err := mgr.softDeleteIndex(indexName, indexUUID)
+	if err == nil {
+		mgr.consumeIndexDeletesQuorum([]string{indexName})
+	}
+
+	return rv, err
+}
+
+// softDeleteIndex is SoftDeleteIndex() without the OpQuorum check.
+func (mgr *Manager) softDeleteIndex(indexName, indexUUID string) (
+	string, error) {
+	atomic.AddUint64(&mgr.stats.TotSoftDeleteIndex, 1)
+
+	indexDef, err := mgr.CheckAndGetIndexDef(indexName, true)
+	if err != nil {
+		return "", err
+	}
+	if indexDef == nil {
+		return "", fmt.Errorf("manager_trash: index to delete missing,"+
+			" indexName: %s", indexName)
+	}
+	if indexUUID != "" && indexDef.UUID != indexUUID {
+		return "", fmt.Errorf("manager_trash: index to delete wrong UUID,"+
+			" indexName: %s", indexName)
+	}
+
+	err = mgr.updateIndexDefsTrash(func(trash *IndexDefsTrash) bool {
+		trash.Entries[indexName] = &IndexDefTrashEntry{
+			IndexDef:  indexDef,
+			DeletedAt: Now().UnixNano(),
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// The trash entry is in place before the indexDef goes away, so
+	// that janitors retain the pindex files instead of removing them.
+	_, err = mgr.deleteIndexEx(indexName, indexDef.UUID)
+	if err != nil {
+		mgr.updateIndexDefsTrash(func(trash *IndexDefsTrash) bool {
+			delete(trash.Entries, indexName)
+			return true
+		})
+		return "", err
+	}
+
+	mgr.log.Printf("manager_trash: index definition soft deleted,"+
+		" indexName: %s, indexUUID: %s", indexName, indexDef.UUID)
+
+	atomic.AddUint64(&mgr.stats.TotSoftDeleteIndexOk, 1)
+	return indexDef.UUID, nil
+}
+
+// UndeleteIndex restores a soft-deleted index definition that's
+// still in the trash.  Janitors will reuse the retained pindex files.
+func (mgr *Manager) UndeleteIndex(indexName string) (string, error) {
+	atomic.AddUint64(&mgr.stats.TotUndeleteIndex, 1)
+
+	trash, _, err := CfgGetIndexDefsTrash(mgr.cfg)
+	if err != nil {
+		return "", err
+	}
+	if trash == nil || trash.Entries[indexName] == nil {
+		return "", fmt.Errorf("manager_trash: no index in trash,"+
+			" indexName: %s", indexName)
+	}
+	indexDef := trash.Entries[indexName].IndexDef
+
+	for tries := 0; ; tries++ {
+		if tries > 100 {
+			return "", fmt.Errorf("manager_trash: UndeleteIndex,"+
+				" too many tries: %d", tries)
+		}
+
+		indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
+		if err != nil {
+			return "", err
+		}
+		if indexDefs == nil {
+			indexDefs = NewIndexDefs(CfgGetVersion(mgr.cfg))
+		}
+		if VersionGTE(mgr.version, indexDefs.ImplVersion) == false {
+			return "", fmt.Errorf("manager_trash: could not undelete index,"+
+				" indexDefs.ImplVersion: %s > mgr.version: %s",
+				indexDefs.ImplVersion, mgr.version)
+		}
+		if _, exists := indexDefs.IndexDefs[indexName]; exists {
+			return "", fmt.Errorf("manager_trash: cannot undelete index"+
+				" because an index with the same name already exists: %s",
+				indexName)
+		}
+
+		// Keep the indexDef.UUID, so the planned pindex names and
+		// therefore the retained pindex files are the same as before.
+		indexDefs.UUID = NewUUID()
+		indexDefs.IndexDefs[indexName] = indexDef
+		indexDefs.ImplVersion = CfgGetVersion(mgr.cfg)
+
+		_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				continue // Retry on CAS mismatch.
+			}
+			return "", fmt.Errorf("manager_trash: could not save indexDefs,"+
+				" err: %v", err)
+		}
+
+		break // Success.
+	}
+
+	err = mgr.updateIndexDefsTrash(func(trash *IndexDefsTrash) bool {
+		entry := trash.Entries[indexName]
+		if entry == nil || entry.IndexDef.UUID != indexDef.UUID {
+			return false
+		}
+		delete(trash.Entries, indexName)
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	mgr.log.Printf("manager_trash: index definition undeleted,"+
+		" indexName: %s, indexUUID: %s", indexName, indexDef.UUID)
+
+	mgr.GetIndexDefs(true)
+	mgr.PlannerKick("api/UndeleteIndex, indexName: " + indexName)
+	atomic.AddUint64(&mgr.stats.TotUndeleteIndexOk, 1)
+	return indexDef.UUID, nil
+}
+
+// PurgeIndexTrash removes expired entries from the trash, along with
+// any local pindex files that are no longer retained by the trash.
+// The janitor invokes this on every run.
+func (mgr *Manager) PurgeIndexTrash() error {
+	window := DEFAULT_INDEX_TRASH_WINDOW
+	if v, exists := mgr.GetOptions()["indexTrashWindow"]; exists {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("manager_trash: indexTrashWindow: %q,"+
+				" err: %v", v, err)
+		}
+		window = d
+	}
+
+	now := Now()
+	expired := func(entry *IndexDefTrashEntry) bool {
+		return now.Sub(time.Unix(0, entry.DeletedAt)) >= window
+	}
+
+	var retained map[string]*IndexDefTrashEntry
+
+	err := mgr.updateIndexDefsTrash(func(trash *IndexDefsTrash) bool {
+		retained = map[string]*IndexDefTrashEntry{}
+		changed := false
+		for indexName, entry := range trash.Entries {
+			if expired(entry) {
+				delete(trash.Entries, indexName)
+				changed = true
+
+				mgr.log.Printf("manager_trash: purged index definition,"+
+					" indexName: %s, indexUUID: %s",
+					indexName, entry.IndexDef.UUID)
+				continue
+			}
+			retained[indexName] = entry
+		}
+		return changed
+	})
+	if err != nil {
+		return err
+	}
+
+	trashDir := filepath.Join(mgr.dataDir, INDEX_TRASH_DIR)
+	dirEntries, err := ioutil.ReadDir(trashDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if len(dirEntries) <= 0 {
+		return nil
+	}
+
+	// An undeleted index is no longer in the trash, but its files
+	// might not have been restored by the janitor yet.
+	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, dirEntry := range dirEntries {
+		indexName, indexUUID, ok := parseTrashedPIndexName(dirEntry.Name())
+		if ok {
+			entry := retained[indexName]
+			if entry != nil && entry.IndexDef.UUID == indexUUID {
+				continue // Still retained.
+			}
+			if indexDefs != nil && indexDefs.IndexDefs[indexName] != nil &&
+				indexDefs.IndexDefs[indexName].UUID == indexUUID {
+				continue // Undeleted.
+			}
+		}
+
+		os.RemoveAll(filepath.Join(trashDir, dirEntry.Name()))
+		atomic.AddUint64(&mgr.stats.TotPurgeTrashPIndex, 1)
+	}
+
+	return nil
+}
+
+// ------------------------------------------------------------------------
+
+// updateIndexDefsTrash applies a change to the trash, retrying on CAS
+// mismatches.  The cb should return false when there's no change.
+func (mgr *Manager) updateIndexDefsTrash(cb func(*IndexDefsTrash) bool) error {
+	for tries := 0; tries < 100; tries++ {
+		trash, cas, err := CfgGetIndexDefsTrash(mgr.cfg)
+		if err != nil {
+			return err
+		}
+		if trash == nil {
+			trash = NewIndexDefsTrash(CfgGetVersion(mgr.cfg))
+		}
+		if trash.Entries == nil {
+			trash.Entries = make(map[string]*IndexDefTrashEntry)
+		}
+
+		if !cb(trash) {
+			return nil
+		}
+
+		trash.UUID = NewUUID()
+		trash.ImplVersion = CfgGetVersion(mgr.cfg)
+
+		_, err = CfgSetIndexDefsTrash(mgr.cfg, trash, cas)
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				continue // Retry on CAS mismatch.
+			}
+			return fmt.Errorf("manager_trash: could not save trash,"+
+				" err: %v", err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("manager_trash: could not save trash, too many tries")
+}
+
+// isPIndexTrashed returns true when the pindex belongs to an index
+// definition that's currently soft-deleted.
+func (mgr *Manager) isPIndexTrashed(pindex *PIndex) bool {
+	if mgr.cfg == nil { // Can occur during testing.
+		return false
+	}
+	trash, _, err := CfgGetIndexDefsTrash(mgr.cfg)
+	if err != nil || trash == nil {
+		return false
+	}
+	entry := trash.Entries[pindex.IndexName]
+	return entry != nil && entry.IndexDef.UUID == pindex.IndexUUID
+}
+
+// trashPIndex closes a pindex and moves its files to the trash dir.
+func (mgr *Manager) trashPIndex(pindex *PIndex) error {
+	err := pindex.Close(false)
+	if err != nil {
+		return err
+	}
+
+	trashDir := filepath.Join(mgr.dataDir, INDEX_TRASH_DIR)
+	err = os.MkdirAll(trashDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(pindex.Path,
+		filepath.Join(trashDir, filepath.Base(pindex.Path)))
+	if err != nil {
+		return fmt.Errorf("manager_trash: could not trash pindex: %s,"+
+			" err: %v", pindex.Name, err)
+	}
+
+	atomic.AddUint64(&mgr.stats.TotTrashPIndex, 1)
+	return nil
+}
+
+// restoreTrashedPIndex moves a retained pindex from the trash dir
+// back to the given path, if the path doesn't already exist.
+func (mgr *Manager) restoreTrashedPIndex(path string) {
+	trashPath := filepath.Join(mgr.dataDir, INDEX_TRASH_DIR,
+		filepath.Base(path))
+	if _, err := os.Stat(trashPath); err != nil {
+		return
+	}
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+
+	err := os.Rename(trashPath, path)
+	if err != nil {
+		mgr.log.Warnf("manager_trash: could not restore pindex,"+
+			" path: %s, err: %v", path, err)
+		return
+	}
+
+	atomic.AddUint64(&mgr.stats.TotRestoreTrashPIndex, 1)
+}
+
+// parseTrashedPIndexName parses the index name and index UUID from a
+// trashed pindex dir name, whose format follows PlanPIndexName().
+func parseTrashedPIndexName(name string) (string, string, bool) {
+	if !strings.HasSuffix(name, pindexPathSuffix) {
+		return "", "", false
+	}
+	name = name[0 : len(name)-len(pindexPathSuffix)]
+
+	i := strings.LastIndex(name, "_") // Skip the partitions hash.
+	if i <= 0 {
+		return "", "", false
+	}
+	name = name[0:i]
+
+	i = strings.LastIndex(name, "_")
+	if i <= 0 {
+		return "", "", false
+	}
+	return name[0:i], name[i+1:], true
+}
@@ -0,0 +1,138 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTrashedPIndexName(t *testing.T) {
+	tests := []struct {
+		name      string
+		indexName string
+		indexUUID string
+		ok        bool
+	}{
+		{"foo_123_abc.pindex", "foo", "123", true},
+		{"foo_bar_123_abc.pindex", "foo_bar", "123", true},
+		{"foo_123_abc", "", "", false},
+		{"foo.pindex", "", "", false},
+	}
+	for _, test := range tests {
+		indexName, indexUUID, ok := parseTrashedPIndexName(test.name)
+		if indexName != test.indexName ||
+			indexUUID != test.indexUUID || ok != test.ok {
+			t.Errorf("unexpected parse, test: %#v, got: %s, %s, %t",
+				test, indexName, indexUUID, ok)
+		}
+	}
+}
+
+func TestManagerSoftDeleteIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil,
+		map[string]string{"indexDeleteMode": "soft"})
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	sourceParams := "{\"numPartitions\":2}"
+	planParams := PlanParams{MaxPartitionsPerPIndex: 1}
+	if err := m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "", planParams, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	if _, pindexes := m.CurrentMaps(); len(pindexes) != 2 {
+		t.Fatalf("expected 2 pindexes, got: %d", len(pindexes))
+	}
+
+	if _, err := m.UndeleteIndex("foo"); err == nil {
+		t.Errorf("expected undelete err for index not in trash")
+	}
+
+	if err := m.DeleteIndex("foo"); err != nil {
+		t.Fatalf("expected soft DeleteIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	if _, pindexes := m.CurrentMaps(); len(pindexes) != 0 {
+		t.Errorf("expected no pindexes, got: %d", len(pindexes))
+	}
+	trashed, _ := ioutil.ReadDir(filepath.Join(emptyDir, INDEX_TRASH_DIR))
+	if len(trashed) != 2 {
+		t.Errorf("expected 2 trashed pindexes, got: %d", len(trashed))
+	}
+
+	if _, err := m.UndeleteIndex("foo"); err != nil {
+		t.Fatalf("expected UndeleteIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	if _, pindexes := m.CurrentMaps(); len(pindexes) != 2 {
+		t.Errorf("expected 2 restored pindexes, got: %d", len(pindexes))
+	}
+	if m.stats.TotRestoreTrashPIndex != 2 {
+		t.Errorf("expected 2 restores, got: %d", m.stats.TotRestoreTrashPIndex)
+	}
+
+	// The deletes of a dropped source also go into the trash.
+	indexNames, err := m.DeleteIndexesBySource("primary", "default", "",
+		false)
+	if err != nil || len(indexNames) != 1 || indexNames[0] != "foo" {
+		t.Fatalf("expected soft DeleteIndexesBySource() to work,"+
+			" indexNames: %v, err: %v", indexNames, err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	if _, pindexes := m.CurrentMaps(); len(pindexes) != 0 {
+		t.Errorf("expected no pindexes, got: %d", len(pindexes))
+	}
+	if _, err := m.UndeleteIndex("foo"); err != nil {
+		t.Fatalf("expected UndeleteIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	m.SetOptions(map[string]string{
+		"indexDeleteMode":  "soft",
+		"indexTrashWindow": "0s",
+	})
+	if err := m.DeleteIndex("foo"); err != nil {
+		t.Fatalf("expected soft DeleteIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	if err := m.PurgeIndexTrash(); err != nil {
+		t.Errorf("expected PurgeIndexTrash() to work, err: %v", err)
+	}
+	trashed, _ = ioutil.ReadDir(filepath.Join(emptyDir, INDEX_TRASH_DIR))
+	if len(trashed) != 0 {
+		t.Errorf("expected purged trash, got: %d", len(trashed))
+	}
+	if _, err := m.UndeleteIndex("foo"); err == nil {
+		t.Errorf("expected undelete err after purge")
+	}
+}
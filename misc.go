@@ -108,7 +108,13 @@ func VersionGTE(x, y string) bool {
 	return len(xa) >= len(ya)
 }
 
+// NewUUID returns a new UUID from the UUID generator, which may be
+// overridden by SetUUIDGenerator.
 func NewUUID() string {
+	return uuidGenerator.Load().(func() string)()
+}
+
+func newRandomUUID() string {
 	val1 := rand.Int63()
 	val2 := rand.Int63()
 	uuid := fmt.Sprintf("%x%x", val1, val2)
@@ -284,8 +290,36 @@ func AtomicCopyMetrics(s, r interface{},
 
 // StructChanges uses reflection to compare the fields of two structs,
 // which must the same type, and returns info on the changes of field
-// values.
+// values.  See StructFieldChanges() for the typed changes.
 func StructChanges(a1, a2 interface{}) (rv []string) {
+	for _, c := range StructFieldChanges(a1, a2) {
+		rv = append(rv, c.String())
+	}
+	return rv
+}
+
+// A FieldChange is a change of the value of an integer field between
+// two structs.  Unsigned values, like the uint64 counters of the
+// ManagerStats, are converted to int64.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   int64  `json:"old"`
+	New   int64  `json:"new"`
+}
+
+// Delta returns the New value minus the Old value.
+func (c FieldChange) Delta() int64 {
+	return c.New - c.Old
+}
+
+func (c FieldChange) String() string {
+	return fmt.Sprintf("%s: %d -> %d", c.Field, c.Old, c.New)
+}
+
+// StructFieldChanges uses reflection to compare the integer fields of
+// two structs, which must be the same type, and returns the changes of
+// field values, in field order.
+func StructFieldChanges(a1, a2 interface{}) (rv []FieldChange) {
 	if a1 == nil || a2 == nil {
 		return nil
 	}
@@ -301,14 +335,23 @@ func StructChanges(a1, a2 interface{}) (rv []string) {
 	}
 
 	for i := 0; i < v1.NumField(); i++ {
-		v1f := v1.Field(i)
-		v2f := v2.Field(i)
-		if v1f.Kind() == v2f.Kind() &&
-			v1f.Kind() == reflect.Int {
-			if v1f.Int() != v2f.Int() {
-				rv = append(rv, fmt.Sprintf("%s: %d -> %d",
-					v2.Type().Field(i).Name, v1f.Int(), v2f.Int()))
-			}
+		var x1, x2 int64
+		switch v1.Field(i).Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16,
+			reflect.Int32, reflect.Int64:
+			x1, x2 = v1.Field(i).Int(), v2.Field(i).Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16,
+			reflect.Uint32, reflect.Uint64:
+			x1, x2 = int64(v1.Field(i).Uint()), int64(v2.Field(i).Uint())
+		default:
+			continue
+		}
+		if x1 != x2 {
+			rv = append(rv, FieldChange{
+				Field: v2.Type().Field(i).Name,
+				Old:   x1,
+				New:   x2,
+			})
 		}
 	}
 
@@ -250,6 +250,45 @@ func TestStructChanges(t *testing.T) {
 	}
 }
 
+func TestStructFieldChanges(t *testing.T) {
+	type s struct {
+		Name string
+		A    int
+		B    uint64
+		C    int32
+	}
+
+	c := StructFieldChanges(s{"x", 1, 10, 5}, s{"y", 3, 7, 5})
+	exp := []FieldChange{
+		{Field: "A", Old: 1, New: 3},
+		{Field: "B", Old: 10, New: 7},
+	}
+	if !reflect.DeepEqual(c, exp) {
+		t.Errorf("expected typed changes, got: %#v", c)
+	}
+	if c[0].Delta() != 2 || c[1].Delta() != -3 {
+		t.Errorf("unexpected deltas, got: %#v", c)
+	}
+	if c[1].String() != "B: 10 -> 7" {
+		t.Errorf("unexpected string, got: %s", c[1])
+	}
+
+	if StructFieldChanges(s{}, 1) != nil || StructFieldChanges(1, 2) != nil {
+		t.Errorf("expected nil for mismatched or non-structs")
+	}
+
+	a := &ManagerStats{TotKick: 1}
+	b := &ManagerStats{TotKick: 4, TotSetOptions: 1}
+	c = DiffManagerStats(a, b)
+	exp = []FieldChange{
+		{Field: "TotKick", Old: 1, New: 4},
+		{Field: "TotSetOptions", Old: 0, New: 1},
+	}
+	if !reflect.DeepEqual(c, exp) {
+		t.Errorf("expected manager stats changes, got: %#v", c)
+	}
+}
+
 func TestIsNanOrInf(t *testing.T) {
 	zval := 0.0
 	tests := []struct {
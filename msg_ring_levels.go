@@ -0,0 +1,349 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The severity levels of a LeveledMsgRing.
+const (
+	MsgRingLevelError = "error"
+	MsgRingLevelWarn  = "warn"
+	MsgRingLevelInfo  = "info"
+	MsgRingLevelDebug = "debug"
+	MsgRingLevelTrace = "trace"
+)
+
+// MsgRingLevels are the severity levels, most severe first.
+var MsgRingLevels = []string{MsgRingLevelError, MsgRingLevelWarn,
+	MsgRingLevelInfo, MsgRingLevelDebug, MsgRingLevelTrace}
+
+// DEFAULT_MSG_RING_CAPACITY is the number of messages remembered per
+// level, unless overridden in the LeveledMsgRingOptions.
+const DEFAULT_MSG_RING_CAPACITY = 1000
+
+// msgRingTimeFormat is fixed width, so that messages sort by time.
+const msgRingTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// LeveledMsgRingOptions configures a LeveledMsgRing.
+type LeveledMsgRingOptions struct {
+	// Capacities are the ring sizes keyed by level, where a missing
+	// level gets the DEFAULT_MSG_RING_CAPACITY.
+	Capacities map[string]int
+
+	// ErrorsPath, when non-empty, is a file, such as in the dataDir,
+	// that persists the error messages across restarts.
+	ErrorsPath string
+
+	// Inner, when non-nil, also receives every message.
+	Inner io.Writer
+}
+
+// A LeveledMsgRing is a Log that remembers the recent messages in a
+// separate MsgRing per severity level, so that a flood of verbose
+// messages doesn't evict the rarer, more important ones.  Each
+// message is a line, prefixed by its UTC time and level.
+type LeveledMsgRing struct {
+	rings map[string]*MsgRing
+	inner io.Writer
+
+	m              sync.Mutex // Protects the fields that follow.
+	errorsPath     string
+	errorsFile     *os.File
+	errorsAppended int
+}
+
+// NewLeveledMsgRing returns a LeveledMsgRing, which loads any error
+// messages that were persisted to the options.ErrorsPath.
+func NewLeveledMsgRing(options LeveledMsgRingOptions) (
+	*LeveledMsgRing, error) {
+	r := &LeveledMsgRing{
+		rings:      map[string]*MsgRing{},
+		inner:      options.Inner,
+		errorsPath: options.ErrorsPath,
+	}
+	if r.inner == nil {
+		r.inner = ioutil.Discard
+	}
+
+	for _, level := range MsgRingLevels {
+		capacity, exists := options.Capacities[level]
+		if !exists {
+			capacity = DEFAULT_MSG_RING_CAPACITY
+		}
+		ring, err := NewMsgRing(ioutil.Discard, capacity)
+		if err != nil {
+			return nil, fmt.Errorf("msg_ring_levels: level: %s, err: %v",
+				level, err)
+		}
+		r.rings[level] = ring
+	}
+	for level := range options.Capacities {
+		if r.rings[level] == nil {
+			return nil, fmt.Errorf("msg_ring_levels: unknown level: %s",
+				level)
+		}
+	}
+
+	if r.errorsPath != "" {
+		err := r.loadErrors()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// loadErrors reads the persisted error messages into the error ring,
+// and then compacts the file to just those messages.
+func (r *LeveledMsgRing) loadErrors() error {
+	buf, err := ioutil.ReadFile(r.errorsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("msg_ring_levels: read errors, err: %v", err)
+	}
+
+	ring := r.rings[MsgRingLevelError]
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); len(line) > 0 {
+			ring.Write(append(append([]byte(nil), line...), '\n'))
+		}
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.compactErrorsLOCKED()
+}
+
+// compactErrorsLOCKED rewrites the errors file from the error ring, so
+// that the file stays bounded.
+func (r *LeveledMsgRing) compactErrorsLOCKED() error {
+	if r.errorsFile != nil {
+		r.errorsFile.Close()
+		r.errorsFile = nil
+	}
+
+	var b bytes.Buffer
+	for _, msg := range r.rings[MsgRingLevelError].Messages() {
+		b.Write(msg)
+	}
+
+	tmpPath := r.errorsPath + ".tmp"
+	err := ioutil.WriteFile(tmpPath, b.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("msg_ring_levels: write errors, err: %v", err)
+	}
+	err = os.Rename(tmpPath, r.errorsPath)
+	if err != nil {
+		return fmt.Errorf("msg_ring_levels: rename errors, err: %v", err)
+	}
+
+	r.errorsFile, err = os.OpenFile(r.errorsPath,
+		os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("msg_ring_levels: open errors, err: %v", err)
+	}
+	r.errorsAppended = 0
+
+	return nil
+}
+
+// Close closes the errors file, if any.
+func (r *LeveledMsgRing) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.errorsFile == nil {
+		return nil
+	}
+	err := r.errorsFile.Close()
+	r.errorsFile = nil
+	return err
+}
+
+func (r *LeveledMsgRing) write(level, msg string) {
+	line := []byte(time.Now().UTC().Format(msgRingTimeFormat) + " " +
+		strings.ToUpper(level) + " " + strings.TrimRight(msg, "\n") + "\n")
+
+	ring := r.rings[level]
+	ring.Write(line)
+
+	if level == MsgRingLevelError && r.errorsPath != "" {
+		r.m.Lock()
+		if r.errorsFile != nil {
+			r.errorsFile.Write(line)
+			r.errorsAppended++
+			if r.errorsAppended >= len(ring.Msgs) {
+				r.compactErrorsLOCKED()
+			}
+		}
+		r.m.Unlock()
+	}
+
+	r.inner.Write(line)
+}
+
+func (r *LeveledMsgRing) Print(args ...interface{}) {
+	r.write(MsgRingLevelInfo, fmt.Sprint(args...))
+}
+
+func (r *LeveledMsgRing) Printf(format string, args ...interface{}) {
+	r.write(MsgRingLevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (r *LeveledMsgRing) Error(err error) error {
+	r.write(MsgRingLevelError, fmt.Sprint(err))
+	return err
+}
+
+func (r *LeveledMsgRing) Errorf(format string, args ...interface{}) {
+	r.write(MsgRingLevelError, fmt.Sprintf(format, args...))
+}
+
+func (r *LeveledMsgRing) Warn(args ...interface{}) {
+	r.write(MsgRingLevelWarn, fmt.Sprint(args...))
+}
+
+func (r *LeveledMsgRing) Warnf(format string, args ...interface{}) {
+	r.write(MsgRingLevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (r *LeveledMsgRing) Debug(args ...interface{}) {
+	r.write(MsgRingLevelDebug, fmt.Sprint(args...))
+}
+
+func (r *LeveledMsgRing) Debugf(format string, args ...interface{}) {
+	r.write(MsgRingLevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (r *LeveledMsgRing) Trace(args ...interface{}) {
+	r.write(MsgRingLevelTrace, fmt.Sprint(args...))
+}
+
+func (r *LeveledMsgRing) Tracef(format string, args ...interface{}) {
+	r.write(MsgRingLevelTrace, fmt.Sprintf(format, args...))
+}
+
+// ---------------------------------------------------------
+
+// A MsgRingFilter selects the messages of a LeveledMsgRing.
+type MsgRingFilter struct {
+	Levels   []string  // Empty means all levels.
+	Contains string    // A substring that messages must contain.
+	Since    time.Time // Zero means no time limit.
+	Limit    int       // The most recent messages, where 0 means all.
+}
+
+// ParseMsgRingFilter parses the query parameters of a log endpoint:
+// "level" (repeatable or comma-separated), "contains", "since"
+// (RFC3339) and "limit".
+func ParseMsgRingFilter(q url.Values) (MsgRingFilter, error) {
+	var f MsgRingFilter
+
+	for _, v := range q["level"] {
+		for _, level := range strings.Split(v, ",") {
+			if level = strings.TrimSpace(level); level != "" {
+				f.Levels = append(f.Levels, strings.ToLower(level))
+			}
+		}
+	}
+
+	f.Contains = q.Get("contains")
+
+	if v := q.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return f, fmt.Errorf("msg_ring_levels: since, err: %v", err)
+		}
+		f.Since = since
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return f, fmt.Errorf("msg_ring_levels: invalid limit: %q", v)
+		}
+		f.Limit = limit
+	}
+
+	return f, nil
+}
+
+// Messages returns the remembered messages that match the filter,
+// oldest first.
+func (r *LeveledMsgRing) Messages(f MsgRingFilter) ([][]byte, error) {
+	levels := f.Levels
+	if len(levels) <= 0 {
+		levels = MsgRingLevels
+	}
+
+	var since string
+	if !f.Since.IsZero() {
+		since = f.Since.UTC().Format(msgRingTimeFormat)
+	}
+
+	var rv [][]byte
+	for _, level := range levels {
+		ring := r.rings[level]
+		if ring == nil {
+			return nil, fmt.Errorf("msg_ring_levels: unknown level: %s",
+				level)
+		}
+		for _, msg := range ring.Messages() {
+			if since != "" && string(msgRingTime(msg)) < since {
+				continue
+			}
+			if f.Contains != "" && !bytes.Contains(msg, []byte(f.Contains)) {
+				continue
+			}
+			rv = append(rv, msg)
+		}
+	}
+
+	// The fixed width time prefix sorts the levels' messages by time.
+	sort.SliceStable(rv, func(i, j int) bool {
+		return bytes.Compare(msgRingTime(rv[i]), msgRingTime(rv[j])) < 0
+	})
+
+	if f.Limit > 0 && len(rv) > f.Limit {
+		rv = rv[len(rv)-f.Limit:]
+	}
+
+	return rv, nil
+}
+
+func msgRingTime(msg []byte) []byte {
+	return msg[:minInt(len(msgRingTimeFormat), len(msg))]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
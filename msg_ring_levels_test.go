@@ -0,0 +1,149 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLeveledMsgRing(t *testing.T) {
+	var _ Log = &LeveledMsgRing{}
+
+	if _, err := NewLeveledMsgRing(LeveledMsgRingOptions{
+		Capacities: map[string]int{"not-a-level": 1},
+	}); err == nil {
+		t.Errorf("expected err on an unknown level")
+	}
+	if _, err := NewLeveledMsgRing(LeveledMsgRingOptions{
+		Capacities: map[string]int{MsgRingLevelInfo: 0},
+	}); err == nil {
+		t.Errorf("expected err on a zero capacity")
+	}
+
+	var inner bytes.Buffer
+	r, err := NewLeveledMsgRing(LeveledMsgRingOptions{
+		Capacities: map[string]int{MsgRingLevelInfo: 2},
+		Inner:      &inner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Errorf("e0")
+	for i := 0; i < 5; i++ {
+		r.Printf("i%d", i)
+	}
+	r.Warn("w0")
+
+	msgs, err := r.Messages(MsgRingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, strings.Fields(string(msg))[2])
+	}
+	if exp := "e0 i3 i4 w0"; strings.Join(got, " ") != exp {
+		t.Errorf("expected the info ring to not evict others,"+
+			" exp: %s, got: %v", exp, got)
+	}
+	if n := strings.Count(inner.String(), "\n"); n != 7 {
+		t.Errorf("expected all messages written to inner, got: %d", n)
+	}
+
+	msgs, _ = r.Messages(MsgRingFilter{
+		Levels: []string{MsgRingLevelInfo}, Contains: "i4"})
+	if len(msgs) != 1 || !bytes.Contains(msgs[0], []byte(" INFO i4")) {
+		t.Errorf("expected a filtered info message, got: %q", msgs)
+	}
+	msgs, _ = r.Messages(MsgRingFilter{Limit: 1})
+	if len(msgs) != 1 || !bytes.Contains(msgs[0], []byte("w0")) {
+		t.Errorf("expected the most recent message, got: %q", msgs)
+	}
+	if _, err = r.Messages(MsgRingFilter{Levels: []string{"x"}}); err == nil {
+		t.Errorf("expected err on an unknown level")
+	}
+}
+
+func TestLeveledMsgRingPersistErrors(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := filepath.Join(emptyDir, "errors.log")
+	options := LeveledMsgRingOptions{
+		Capacities: map[string]int{MsgRingLevelError: 3},
+		ErrorsPath: path,
+	}
+
+	r, err := NewLeveledMsgRing(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		r.Error(fmt.Errorf("e%d", i))
+	}
+	r.Printf("not persisted")
+	r.Close()
+
+	buf, _ := ioutil.ReadFile(path)
+	if n := strings.Count(string(buf), "\n"); n > 2*3 {
+		t.Errorf("expected the errors file compacted, got lines: %d", n)
+	}
+
+	r, err = NewLeveledMsgRing(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	msgs, _ := r.Messages(MsgRingFilter{})
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, strings.Fields(string(msg))[2])
+	}
+	if exp := "e7 e8 e9"; strings.Join(got, " ") != exp {
+		t.Errorf("expected persisted errors after restart,"+
+			" exp: %s, got: %v", exp, got)
+	}
+}
+
+func TestParseMsgRingFilter(t *testing.T) {
+	f, err := ParseMsgRingFilter(url.Values{
+		"level":    {"error,WARN", "info"},
+		"contains": {"x"},
+		"since":    {"2020-01-02T03:04:05Z"},
+		"limit":    {"10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(f.Levels, ",") != "error,warn,info" ||
+		f.Contains != "x" || f.Limit != 10 || f.Since.Year() != 2020 {
+		t.Errorf("unexpected filter: %#v", f)
+	}
+
+	for _, q := range []url.Values{
+		{"since": {"yesterday"}},
+		{"limit": {"-1"}},
+	} {
+		if _, err = ParseMsgRingFilter(q); err == nil {
+			t.Errorf("expected err, q: %v", q)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// The disk classes of a HardwareProfile.
+const (
+	DISK_CLASS_SSD     = "ssd"
+	DISK_CLASS_HDD     = "hdd"
+	DISK_CLASS_UNKNOWN = "unknown"
+)
+
+// A HardwareProfile describes the resources of a node, as probed at
+// startup, from which a NodeWeightFormula derives the node's weight.
+type HardwareProfile struct {
+	NumCPU      int    `json:"numCPU"`
+	MemoryTotal uint64 `json:"memoryTotal"` // In bytes, 0 when unknown.
+	DiskClass   string `json:"diskClass"`   // Of the dataDir.
+}
+
+// A NodeWeightFormula returns the weight of a node with a
+// HardwareProfile, where a weight <= 0 keeps the configured weight.
+type NodeWeightFormula func(hw *HardwareProfile) int
+
+// NodeWeightFormulas are the NodeWeightFormulas keyed by name, which
+// the "nodeWeightFormula" manager option selects.  An application may
+// register its own formulas during its init().
+var NodeWeightFormulas = map[string]NodeWeightFormula{
+	"default": DefaultNodeWeightFormula,
+}
+
+// DefaultNodeWeightFormula weighs a node by its CPUs, limited to one
+// CPU per 2GB of RAM, so that a node with many CPUs but little RAM
+// isn't overloaded, and halves the weight of a node with rotational
+// disks.
+func DefaultNodeWeightFormula(hw *HardwareProfile) int {
+	weight := hw.NumCPU
+	if hw.MemoryTotal > 0 {
+		byMemory := int(hw.MemoryTotal / (2 * 1024 * 1024 * 1024))
+		if weight > byMemory {
+			weight = byMemory
+		}
+	}
+	if hw.DiskClass == DISK_CLASS_HDD {
+		weight /= 2
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	return weight
+}
+
+// probeHardware returns the HardwareProfile of this node, and is a
+// var for testing.
+var probeHardware = probeHardwareDefault
+
+// probeHardwareDefault returns the HardwareProfile of this node, with
+// the disk class of a dataDir.
+func probeHardwareDefault(dataDir string) *HardwareProfile {
+	memoryTotal, diskClass := probeHardwareOS(dataDir)
+	return &HardwareProfile{
+		NumCPU:      runtime.NumCPU(),
+		MemoryTotal: memoryTotal,
+		DiskClass:   diskClass,
+	}
+}
+
+// probeNodeWeight derives the node's weight from its HardwareProfile
+// when the "nodeWeightFormula" manager option names a formula, before
+// the node registers its NodeDef, so that heterogeneous clusters get
+// sensible placements without tuning the weight of each node.
+func (mgr *Manager) probeNodeWeight() error {
+	name := mgr.Options()["nodeWeightFormula"]
+	if name == "" {
+		return nil
+	}
+
+	formula := NodeWeightFormulas[name]
+	if formula == nil {
+		return fmt.Errorf("node_weight: unknown nodeWeightFormula: %q", name)
+	}
+
+	hw := probeHardware(mgr.dataDir)
+
+	weightPrev := mgr.weight
+
+	weight := formula(hw)
+	if weight > 0 {
+		mgr.weight = weight
+	}
+
+	mgr.hardwareProfile = hw
+
+	mgr.log.Printf("node_weight: probed, formula: %s, numCPU: %d,"+
+		" memoryTotal: %d, diskClass: %s, weight: %d, weightPrev: %d",
+		name, hw.NumCPU, hw.MemoryTotal, hw.DiskClass, mgr.weight, weightPrev)
+
+	eventBytes, _ := json.Marshal(struct {
+		Event      string           `json:"event"`
+		Formula    string           `json:"formula"`
+		Hardware   *HardwareProfile `json:"hardware"`
+		Weight     int              `json:"weight"`
+		WeightPrev int              `json:"weightPrev"`
+		Time       string           `json:"time"`
+	}{"nodeWeightProbed", name, hw, mgr.weight, weightPrev,
+		Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(eventBytes)
+
+	return nil
+}
+
+// HardwareProfile returns the HardwareProfile that was probed at
+// startup, or nil when the weight wasn't derived from the hardware.
+func (mgr *Manager) HardwareProfile() *HardwareProfile {
+	return mgr.hardwareProfile
+}
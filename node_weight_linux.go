@@ -0,0 +1,84 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+//go:build linux
+// +build linux
+
+package cbgt
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// probeHardwareOS returns the total RAM from /proc/meminfo, and the
+// disk class of the block device of a dataDir from sysfs.
+func probeHardwareOS(dataDir string) (memoryTotal uint64, diskClass string) {
+	return memoryTotalOS(), diskClassOS(dataDir)
+}
+
+func memoryTotalOS() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text()) // "MemTotal: 123 kB".
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+
+	return 0
+}
+
+func diskClassOS(dataDir string) string {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dataDir, &st); err != nil {
+		return DISK_CLASS_UNKNOWN
+	}
+
+	dev := uint64(st.Dev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) & ^uint64(0xfff))
+	minor := (dev & 0xff) | ((dev >> 12) & ^uint64(0xff))
+
+	// A partition has its queue at its parent disk.
+	base := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	for _, path := range []string{
+		base + "/queue/rotational",
+		base + "/../queue/rotational",
+	} {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(string(buf)) {
+		case "0":
+			return DISK_CLASS_SSD
+		case "1":
+			return DISK_CLASS_HDD
+		}
+	}
+
+	return DISK_CLASS_UNKNOWN
+}
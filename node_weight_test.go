@@ -0,0 +1,100 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDefaultNodeWeightFormula(t *testing.T) {
+	const gb = 1024 * 1024 * 1024
+
+	tests := []struct {
+		hw     HardwareProfile
+		expect int
+	}{
+		{HardwareProfile{NumCPU: 8, MemoryTotal: 32 * gb, DiskClass: DISK_CLASS_SSD}, 8},
+		{HardwareProfile{NumCPU: 16, MemoryTotal: 8 * gb, DiskClass: DISK_CLASS_SSD}, 4},
+		{HardwareProfile{NumCPU: 8, MemoryTotal: 32 * gb, DiskClass: DISK_CLASS_HDD}, 4},
+		{HardwareProfile{NumCPU: 4, DiskClass: DISK_CLASS_UNKNOWN}, 4},
+		{HardwareProfile{NumCPU: 1, MemoryTotal: 1 * gb, DiskClass: DISK_CLASS_HDD}, 1},
+	}
+
+	for i, test := range tests {
+		got := DefaultNodeWeightFormula(&test.hw)
+		if got != test.expect {
+			t.Errorf("test: %d, expected weight: %d, got: %d",
+				i, test.expect, got)
+		}
+	}
+}
+
+func TestProbeNodeWeight(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	probeHardware = func(dataDir string) *HardwareProfile {
+		return &HardwareProfile{NumCPU: 6, DiskClass: DISK_CLASS_SSD}
+	}
+	defer func() { probeHardware = probeHardwareDefault }()
+
+	NodeWeightFormulas["test"] = func(hw *HardwareProfile) int {
+		return hw.NumCPU * 10
+	}
+	defer delete(NodeWeightFormulas, "test")
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), nil, "",
+		1, "", ":1000", emptyDir, "", nil, map[string]string{
+			"nodeWeightFormula": "test",
+		})
+
+	err := mgr.probeNodeWeight()
+	if err != nil {
+		t.Fatalf("expected probeNodeWeight to work, err: %v", err)
+	}
+	err = mgr.Register("wanted")
+	if err != nil {
+		t.Fatalf("expected Register to work, err: %v", err)
+	}
+
+	if mgr.Weight() != 60 {
+		t.Errorf("expected weight 60, got: %d", mgr.Weight())
+	}
+	if mgr.HardwareProfile() == nil || mgr.HardwareProfile().NumCPU != 6 {
+		t.Errorf("expected the probed profile, got: %+v",
+			mgr.HardwareProfile())
+	}
+
+	nodeDefs, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if nodeDefs.NodeDefs[mgr.UUID()].Weight != 60 {
+		t.Errorf("expected a NodeDef weight of 60, got: %d",
+			nodeDefs.NodeDefs[mgr.UUID()].Weight)
+	}
+
+	mgr = NewManager(Version, cfg, nil, NewUUID(), nil, "",
+		1, "", ":1000", emptyDir, "", nil, map[string]string{
+			"nodeWeightFormula": "unknown",
+		})
+	if mgr.probeNodeWeight() == nil {
+		t.Errorf("expected an error for an unknown formula")
+	}
+
+	mgr = NewManager(Version, cfg, nil, NewUUID(), nil, "",
+		3, "", ":1000", emptyDir, "", nil, nil)
+	if mgr.probeNodeWeight() != nil || mgr.Weight() != 3 ||
+		mgr.HardwareProfile() != nil {
+		t.Errorf("expected the configured weight without a formula")
+	}
+}
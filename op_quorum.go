@@ -0,0 +1,365 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OP_QUORUM_KEY is the Cfg key of the OpQuorum.
+const OP_QUORUM_KEY = "opQuorum"
+
+// The destructive operations that are gated by the OpQuorum.
+const (
+	OP_QUORUM_DELETE_INDEX     = "deleteIndex"     // Target is the index name.
+	OP_QUORUM_UNREGISTER_NODES = "unregisterNodes" // See OpQuorumNodesTarget().
+	OP_QUORUM_FAILOVER         = "failover"        // See OpQuorumNodesTarget().
+	OP_QUORUM_DISABLE          = "disableOpQuorum" // Target is "".
+)
+
+// OP_QUORUM_CONFIRM_TTL is how long a node's confirmation of an
+// operation remains valid.
+var OP_QUORUM_CONFIRM_TTL = 10 * time.Minute
+
+// OpQuorum is the Cfg-wide safety mode for destructive operations.
+// While enabled, an operation such as DeleteIndexEx(),
+// UnregisterNodes() or Failover() is refused unless a quorum, which
+// is a majority, of the wanted planner nodes have each recently
+// confirmed that same operation and target with ConfirmOp().  That
+// way, a single misconfigured client can't wipe a cluster.  An
+// operation consumes its confirmations once it succeeds, so they
+// can't be replayed.
+//
+// Disabling the safety mode is itself gated, by the
+// OP_QUORUM_DISABLE operation.
+type OpQuorum struct {
+	UUID     string                `json:"uuid"`
+	Enabled  bool                  `json:"enabled"`
+	Confirms map[string]*OpConfirm `json:"confirms"` // See opQuorumKey().
+}
+
+// OpConfirm holds the confirmations of an operation on a target.
+type OpConfirm struct {
+	Op     string            `json:"op"`
+	Target string            `json:"target"`
+	Nodes  map[string]string `json:"nodes"` // Confirm time keyed by node UUID.
+}
+
+// OpQuorumError is returned for an operation that lacks a quorum of
+// confirmations.
+type OpQuorumError struct {
+	Op       string
+	Target   string
+	Confirms int
+	Quorum   int
+}
+
+func (e *OpQuorumError) Error() string {
+	return fmt.Sprintf("op_quorum: op: %s, target: %q, needs"+
+		" confirmations from %d planner nodes, has: %d",
+		e.Op, e.Target, e.Quorum, e.Confirms)
+}
+
+// OpQuorumNodesTarget returns the target of an operation on nodes,
+// which is independent of the order of the node UUIDs.
+func OpQuorumNodesTarget(nodeUUIDs []string) string {
+	s := append([]string(nil), nodeUUIDs...)
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func opQuorumKey(op, target string) string {
+	return op + "/" + target
+}
+
+// CfgGetOpQuorum returns the OpQuorum from a Cfg.
+func CfgGetOpQuorum(cfg Cfg) (*OpQuorum, uint64, error) {
+	v, cas, err := cfg.Get(OP_QUORUM_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &OpQuorum{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetOpQuorum updates the OpQuorum on a Cfg.
+func CfgSetOpQuorum(cfg Cfg, opQuorum *OpQuorum, cas uint64) (
+	uint64, error) {
+	buf, err := json.Marshal(opQuorum)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(OP_QUORUM_KEY, buf, cas)
+}
+
+// updateOpQuorum applies a change to the OpQuorum with CAS retries,
+// where the change returns false when there's nothing to save.
+func updateOpQuorum(cfg Cfg,
+	cb func(opQuorum *OpQuorum) (bool, error)) error {
+	retry := NewCASRetry(OP_QUORUM_KEY)
+	for tries := 0; tries < 10; tries++ {
+		opQuorum, cas, err := CfgGetOpQuorum(cfg)
+		if err != nil {
+			return err
+		}
+		if opQuorum == nil {
+			opQuorum = &OpQuorum{}
+		}
+		if opQuorum.Confirms == nil {
+			opQuorum.Confirms = map[string]*OpConfirm{}
+		}
+
+		changed, err := cb(opQuorum)
+		if err != nil || !changed {
+			return err
+		}
+
+		opQuorum.UUID = NewUUID()
+
+		_, err = CfgSetOpQuorum(cfg, opQuorum, cas)
+		if _, ok := err.(*CfgCASError); ok {
+			retry.Conflict()
+			continue
+		}
+		retry.Done(err)
+		return err
+	}
+
+	return fmt.Errorf("op_quorum: too many CAS conflicts")
+}
+
+// opQuorumPlanners returns the wanted nodes that have the planner
+// role, where a node without tags has every role.
+func opQuorumPlanners(cfg Cfg) (map[string]bool, error) {
+	nodeDefs, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]bool{}
+	if nodeDefs != nil {
+		for nodeUUID, nodeDef := range nodeDefs.NodeDefs {
+			if len(nodeDef.Tags) <= 0 ||
+				StringsToMap(nodeDef.Tags)["planner"] {
+				rv[nodeUUID] = true
+			}
+		}
+	}
+	return rv, nil
+}
+
+// pruneOpConfirms removes the expired confirmations, and returns
+// whether any were removed.
+func pruneOpConfirms(opQuorum *OpQuorum, now time.Time) bool {
+	pruned := false
+	for k, c := range opQuorum.Confirms {
+		for nodeUUID, at := range c.Nodes {
+			t, err := time.Parse(time.RFC3339Nano, at)
+			if err != nil || now.Sub(t) > OP_QUORUM_CONFIRM_TTL {
+				delete(c.Nodes, nodeUUID)
+				pruned = true
+			}
+		}
+		if len(c.Nodes) <= 0 {
+			delete(opQuorum.Confirms, k)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// EnableOpQuorum enables the safety mode for destructive operations.
+func EnableOpQuorum(cfg Cfg) error {
+	return updateOpQuorum(cfg, func(opQuorum *OpQuorum) (bool, error) {
+		if opQuorum.Enabled {
+			return false, nil
+		}
+		opQuorum.Enabled = true
+		return true, nil
+	})
+}
+
+// DisableOpQuorum disables the safety mode for destructive
+// operations, which needs a quorum for the OP_QUORUM_DISABLE.
+func DisableOpQuorum(cfg Cfg) error {
+	err := CheckOpQuorum(cfg, OP_QUORUM_DISABLE, "")
+	if err != nil {
+		return err
+	}
+
+	return updateOpQuorum(cfg, func(opQuorum *OpQuorum) (bool, error) {
+		if !opQuorum.Enabled {
+			return false, nil
+		}
+		opQuorum.Enabled = false
+		opQuorum.Confirms = nil
+		return true, nil
+	})
+}
+
+// ConfirmOp records a planner node's confirmation of an operation on
+// a target, which is valid for the OP_QUORUM_CONFIRM_TTL.
+func ConfirmOp(cfg Cfg, nodeUUID, op, target string) error {
+	planners, err := opQuorumPlanners(cfg)
+	if err != nil {
+		return err
+	}
+	if !planners[nodeUUID] {
+		return fmt.Errorf("op_quorum: not a wanted planner node: %s",
+			nodeUUID)
+	}
+
+	return updateOpQuorum(cfg, func(opQuorum *OpQuorum) (bool, error) {
+		now := Now()
+
+		pruneOpConfirms(opQuorum, now)
+
+		k := opQuorumKey(op, target)
+		c := opQuorum.Confirms[k]
+		if c == nil {
+			c = &OpConfirm{Op: op, Target: target, Nodes: map[string]string{}}
+			opQuorum.Confirms[k] = c
+		}
+		c.Nodes[nodeUUID] = now.Format(time.RFC3339Nano)
+		return true, nil
+	})
+}
+
+// CheckOpQuorum returns nil when the safety mode is disabled, or when
+// a quorum of the wanted planner nodes have confirmed the operation
+// on the target, in which case the confirmations are consumed.
+// Otherwise, an *OpQuorumError is returned.  Applications can also
+// gate their own destructive operations with CheckOpQuorum.
+func CheckOpQuorum(cfg Cfg, op, target string) error {
+	planners, err := opQuorumPlanners(cfg)
+	if err != nil {
+		return err
+	}
+
+	var rv error
+
+	err = updateOpQuorum(cfg, func(opQuorum *OpQuorum) (bool, error) {
+		rv = nil
+
+		if !opQuorum.Enabled {
+			return false, nil
+		}
+
+		pruned := pruneOpConfirms(opQuorum, Now())
+
+		rv = opQuorumCheck(opQuorum, planners, op, target)
+		if rv != nil {
+			return pruned, nil
+		}
+
+		delete(opQuorum.Confirms, opQuorumKey(op, target))
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return rv
+}
+
+// HasOpQuorum is like CheckOpQuorum for every one of the targets,
+// but doesn't consume any confirmations, so that an operation on
+// several targets can be checked as a whole before it's attempted.
+// On success, the operation should then ConsumeOpQuorum().
+func HasOpQuorum(cfg Cfg, op string, targets []string) error {
+	opQuorum, _, err := CfgGetOpQuorum(cfg)
+	if err != nil {
+		return err
+	}
+	if opQuorum == nil || !opQuorum.Enabled {
+		return nil
+	}
+
+	planners, err := opQuorumPlanners(cfg)
+	if err != nil {
+		return err
+	}
+
+	pruneOpConfirms(opQuorum, Now())
+
+	for _, target := range targets {
+		err = opQuorumCheck(opQuorum, planners, op, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConsumeOpQuorum removes the confirmations of an operation on the
+// targets, after the operation succeeded, so that they can't be
+// replayed.
+func ConsumeOpQuorum(cfg Cfg, op string, targets []string) error {
+	return updateOpQuorum(cfg, func(opQuorum *OpQuorum) (bool, error) {
+		changed := false
+		for _, target := range targets {
+			k := opQuorumKey(op, target)
+			if opQuorum.Confirms[k] != nil {
+				delete(opQuorum.Confirms, k)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+// opQuorumCheck returns an *OpQuorumError when fewer than a quorum of
+// the planners have confirmed the operation on the target.
+func opQuorumCheck(opQuorum *OpQuorum, planners map[string]bool,
+	op, target string) error {
+	quorum := len(planners)/2 + 1
+
+	confirms := 0
+	if c := opQuorum.Confirms[opQuorumKey(op, target)]; c != nil {
+		for nodeUUID := range c.Nodes {
+			if planners[nodeUUID] {
+				confirms++
+			}
+		}
+	}
+
+	if confirms < quorum {
+		return &OpQuorumError{
+			Op:       op,
+			Target:   target,
+			Confirms: confirms,
+			Quorum:   quorum,
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// ConfirmOp records this node's confirmation of a destructive
+// operation on a target, see OpQuorum.
+func (mgr *Manager) ConfirmOp(op, target string) error {
+	return ConfirmOp(mgr.cfg, mgr.uuid, op, target)
+}
@@ -0,0 +1,252 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOpQuorum(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := &casConflictCfg{CfgMem: NewCfgMem()}
+	mgr := NewManager(Version, cfg, nil, "n1", []string{"pindex"},
+		"", 1, "", ":1000", emptyDir, "", nil, nil)
+	defer mgr.Stop()
+
+	// The planners are n1 and the untagged n2, so the quorum is 2.
+	nodeDefs := NewNodeDefs(Version)
+	nodeDefs.NodeDefs["n1"] = &NodeDef{UUID: "n1", Tags: []string{"planner"}}
+	nodeDefs.NodeDefs["n2"] = &NodeDef{UUID: "n2"}
+	nodeDefs.NodeDefs["n3"] = &NodeDef{UUID: "n3", Tags: []string{"pindex"}}
+	_, err := CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, CFG_CAS_FORCE)
+	if err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["idx"] = &IndexDef{Name: "idx", UUID: "u",
+		Type: "blackhole", SourceType: "nil"}
+	_, err = CfgSetIndexDefs(cfg, indexDefs, CFG_CAS_FORCE)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	// Disabled by default.
+	err = CheckOpQuorum(cfg, OP_QUORUM_DELETE_INDEX, "idx")
+	if err != nil {
+		t.Errorf("expected no gate while disabled, err: %v", err)
+	}
+
+	err = EnableOpQuorum(cfg)
+	if err != nil {
+		t.Fatalf("expected EnableOpQuorum to work, err: %v", err)
+	}
+
+	_, err = mgr.DeleteIndexEx("idx", "")
+	if qerr, ok := err.(*OpQuorumError); !ok ||
+		qerr.Confirms != 0 || qerr.Quorum != 2 {
+		t.Fatalf("expected an OpQuorumError, err: %v", err)
+	}
+
+	err = ConfirmOp(cfg, "n3", OP_QUORUM_DELETE_INDEX, "idx")
+	if err == nil {
+		t.Errorf("expected a non-planner node's confirm to fail")
+	}
+
+	err = mgr.ConfirmOp(OP_QUORUM_DELETE_INDEX, "idx")
+	if err != nil {
+		t.Fatalf("expected ConfirmOp to work, err: %v", err)
+	}
+	err = ConfirmOp(cfg, "n2", OP_QUORUM_DELETE_INDEX, "other")
+	if err != nil {
+		t.Fatalf("expected ConfirmOp to work, err: %v", err)
+	}
+
+	_, err = mgr.DeleteIndexEx("idx", "")
+	if qerr, ok := err.(*OpQuorumError); !ok || qerr.Confirms != 1 {
+		t.Fatalf("expected a partial quorum, err: %v", err)
+	}
+
+	err = ConfirmOp(cfg, "n2", OP_QUORUM_DELETE_INDEX, "idx")
+	if err != nil {
+		t.Fatalf("expected ConfirmOp to work, err: %v", err)
+	}
+
+	_, err = mgr.DeleteIndexEx("idx", "")
+	if err != nil {
+		t.Fatalf("expected DeleteIndexEx with a quorum to work, err: %v", err)
+	}
+
+	opQuorum, _, _ := CfgGetOpQuorum(cfg)
+	if opQuorum.Confirms[opQuorumKey(OP_QUORUM_DELETE_INDEX, "idx")] != nil {
+		t.Errorf("expected the confirmations to be consumed")
+	}
+
+	// The deletes of a dropped source are gated as a whole.
+	indexDefs, cas, _ := CfgGetIndexDefs(cfg)
+	indexDefs.UUID = NewUUID()
+	for _, name := range []string{"src", "src2"} {
+		indexDefs.IndexDefs[name] = &IndexDef{Name: name, UUID: name,
+			Type: "blackhole", SourceType: "nil", SourceName: "b"}
+	}
+	_, err = CfgSetIndexDefs(cfg, indexDefs, cas)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	_, err = mgr.DeleteIndexesBySource("nil", "b", "", false)
+	if _, ok := err.(*OpQuorumError); !ok {
+		t.Fatalf("expected DeleteIndexesBySource to be gated, err: %v", err)
+	}
+
+	confirmed := func(target string) bool {
+		opQuorum, _, _ := CfgGetOpQuorum(cfg)
+		return opQuorum.Confirms[opQuorumKey(OP_QUORUM_DELETE_INDEX,
+			target)] != nil
+	}
+
+	for _, nodeUUID := range []string{"n1", "n2"} {
+		err = ConfirmOp(cfg, nodeUUID, OP_QUORUM_DELETE_INDEX, "src")
+		if err != nil {
+			t.Fatalf("expected ConfirmOp to work, err: %v", err)
+		}
+	}
+
+	// A partial quorum deletes nothing and keeps the confirmations.
+	_, err = mgr.DeleteIndexesBySource("nil", "b", "", false)
+	if qerr, ok := err.(*OpQuorumError); !ok || qerr.Target != "src2" {
+		t.Fatalf("expected a partial quorum, err: %v", err)
+	}
+	if !confirmed("src") {
+		t.Errorf("expected the confirmations of src to be kept")
+	}
+
+	for _, nodeUUID := range []string{"n1", "n2"} {
+		err = ConfirmOp(cfg, nodeUUID, OP_QUORUM_DELETE_INDEX, "src2")
+		if err != nil {
+			t.Fatalf("expected ConfirmOp to work, err: %v", err)
+		}
+	}
+
+	// A failed Cfg write also keeps the confirmations.
+	cfg.conflicts = 1
+	_, err = mgr.DeleteIndexesBySource("nil", "b", "", false)
+	if err == nil {
+		t.Fatalf("expected a CAS failure")
+	}
+	if !confirmed("src") || !confirmed("src2") {
+		t.Errorf("expected the confirmations to be kept")
+	}
+
+	indexNames, err := mgr.DeleteIndexesBySource("nil", "b", "", false)
+	if err != nil || len(indexNames) != 2 {
+		t.Fatalf("expected DeleteIndexesBySource with a quorum to work,"+
+			" indexNames: %v, err: %v", indexNames, err)
+	}
+	if confirmed("src") || confirmed("src2") {
+		t.Errorf("expected the confirmations to be consumed")
+	}
+
+	// The soft deletes are gated the same way.
+	mgr.SetOptions(map[string]string{"indexDeleteMode": "soft"})
+
+	indexDefs, cas, _ = CfgGetIndexDefs(cfg)
+	indexDefs.UUID = NewUUID()
+	indexDefs.IndexDefs["soft"] = &IndexDef{Name: "soft", UUID: "soft",
+		Type: "blackhole", SourceType: "nil", SourceName: "c"}
+	_, err = CfgSetIndexDefs(cfg, indexDefs, cas)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	mgr.GetIndexDefs(true)
+
+	err = mgr.DeleteIndex("soft")
+	if _, ok := err.(*OpQuorumError); !ok {
+		t.Fatalf("expected a soft DeleteIndex to be gated, err: %v", err)
+	}
+	_, err = mgr.DeleteIndexesBySource("nil", "c", "", false)
+	if _, ok := err.(*OpQuorumError); !ok {
+		t.Fatalf("expected a soft DeleteIndexesBySource to be gated,"+
+			" err: %v", err)
+	}
+	for _, nodeUUID := range []string{"n1", "n2"} {
+		err = ConfirmOp(cfg, nodeUUID, OP_QUORUM_DELETE_INDEX, "soft")
+		if err != nil {
+			t.Fatalf("expected ConfirmOp to work, err: %v", err)
+		}
+	}
+	err = mgr.DeleteIndex("soft")
+	if err != nil {
+		t.Fatalf("expected a soft DeleteIndex with a quorum to work,"+
+			" err: %v", err)
+	}
+	if confirmed("soft") {
+		t.Errorf("expected the confirmations to be consumed")
+	}
+
+	mgr.SetOptions(nil)
+
+	// The confirmations of nodes are independent of their order.
+	err = UnregisterNodes(cfg, Version, []string{"n3"})
+	if _, ok := err.(*OpQuorumError); !ok {
+		t.Fatalf("expected UnregisterNodes to be gated, err: %v", err)
+	}
+	for _, nodeUUID := range []string{"n1", "n2"} {
+		err = ConfirmOp(cfg, nodeUUID, OP_QUORUM_UNREGISTER_NODES,
+			OpQuorumNodesTarget([]string{"n3"}))
+		if err != nil {
+			t.Fatalf("expected ConfirmOp to work, err: %v", err)
+		}
+	}
+	err = UnregisterNodes(cfg, Version, []string{"n3"})
+	if err != nil {
+		t.Fatalf("expected UnregisterNodes to work, err: %v", err)
+	}
+
+	_, err = Failover(mgr.log, cfg, Version, "", nil, []string{"n2"}, false)
+	if _, ok := err.(*OpQuorumError); !ok {
+		t.Errorf("expected Failover to be gated, err: %v", err)
+	}
+	_, err = Failover(mgr.log, cfg, Version, "", nil, []string{"n2"}, true)
+	if err != nil {
+		t.Errorf("expected a dry run Failover to work, err: %v", err)
+	}
+
+	// Expired confirmations don't count.
+	prevTTL := OP_QUORUM_CONFIRM_TTL
+	OP_QUORUM_CONFIRM_TTL = -1
+	defer func() { OP_QUORUM_CONFIRM_TTL = prevTTL }()
+
+	ConfirmOp(cfg, "n1", OP_QUORUM_DISABLE, "")
+	ConfirmOp(cfg, "n2", OP_QUORUM_DISABLE, "")
+	err = DisableOpQuorum(cfg)
+	if _, ok := err.(*OpQuorumError); !ok {
+		t.Errorf("expected expired confirmations, err: %v", err)
+	}
+
+	OP_QUORUM_CONFIRM_TTL = prevTTL
+
+	ConfirmOp(cfg, "n1", OP_QUORUM_DISABLE, "")
+	ConfirmOp(cfg, "n2", OP_QUORUM_DISABLE, "")
+	err = DisableOpQuorum(cfg)
+	if err != nil {
+		t.Fatalf("expected DisableOpQuorum to work, err: %v", err)
+	}
+	opQuorum, _, _ = CfgGetOpQuorum(cfg)
+	if opQuorum.Enabled {
+		t.Errorf("expected the safety mode to be disabled")
+	}
+}
@@ -0,0 +1,229 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// PARTITION_SEQS_PROTOBUF is the media type of the protobuf encoding
+// of the PartitionSeqs, see partition_seqs.proto.
+const PARTITION_SEQS_PROTOBUF = "application/x-protobuf"
+
+// PartitionSeqs are the seqs of the source partitions of the pindexes
+// of a node, keyed by pindex name and then by source partition, which
+// are what the rebalance monitor consumes from /api/stats?partitions=true.
+//
+// A /api/stats handler can negotiate a binary encoding of just the
+// PartitionSeqs with the monitor, which saves the marshal and
+// unmarshal of the full JSON stats on large clusters:
+//
+//	if cbgt.AcceptsPartitionSeqsProtobuf(req) {
+//	    cbgt.WritePartitionSeqsProtobuf(w, seqs)
+//	    return
+//	}
+type PartitionSeqs map[string]map[string]UUIDSeq
+
+// The messages of partition_seqs.proto, which are maintained by hand,
+// as in destgrpc.
+
+type partitionSeqsPB struct {
+	PIndexes []*pindexSeqsPB `protobuf:"bytes,1,rep,name=pindexes,proto3"`
+}
+
+func (m *partitionSeqsPB) Reset()         { *m = partitionSeqsPB{} }
+func (m *partitionSeqsPB) String() string { return proto.CompactTextString(m) }
+func (*partitionSeqsPB) ProtoMessage()    {}
+
+type pindexSeqsPB struct {
+	Name       string            `protobuf:"bytes,1,opt,name=name,proto3"`
+	Partitions []*partitionSeqPB `protobuf:"bytes,2,rep,name=partitions,proto3"`
+}
+
+func (m *pindexSeqsPB) Reset()         { *m = pindexSeqsPB{} }
+func (m *pindexSeqsPB) String() string { return proto.CompactTextString(m) }
+func (*pindexSeqsPB) ProtoMessage()    {}
+
+type partitionSeqPB struct {
+	Partition string `protobuf:"bytes,1,opt,name=partition,proto3"`
+	Uuid      string `protobuf:"bytes,2,opt,name=uuid,proto3"`
+	Seq       uint64 `protobuf:"varint,3,opt,name=seq,proto3"`
+}
+
+func (m *partitionSeqPB) Reset()         { *m = partitionSeqPB{} }
+func (m *partitionSeqPB) String() string { return proto.CompactTextString(m) }
+func (*partitionSeqPB) ProtoMessage()    {}
+
+// MarshalPartitionSeqsProtobuf returns the protobuf encoding of the
+// PartitionSeqs, ordered by pindex and partition.
+func MarshalPartitionSeqsProtobuf(seqs PartitionSeqs) ([]byte, error) {
+	m := &partitionSeqsPB{PIndexes: make([]*pindexSeqsPB, 0, len(seqs))}
+
+	for _, pindex := range sortedKeys(seqs) {
+		partitions := seqs[pindex]
+
+		p := &pindexSeqsPB{
+			Name:       pindex,
+			Partitions: make([]*partitionSeqPB, 0, len(partitions)),
+		}
+		for partition, uuidSeq := range partitions {
+			p.Partitions = append(p.Partitions, &partitionSeqPB{
+				Partition: partition,
+				Uuid:      uuidSeq.UUID,
+				Seq:       uuidSeq.Seq,
+			})
+		}
+		sort.Slice(p.Partitions, func(i, j int) bool {
+			return p.Partitions[i].Partition < p.Partitions[j].Partition
+		})
+
+		m.PIndexes = append(m.PIndexes, p)
+	}
+
+	return proto.Marshal(m)
+}
+
+func sortedKeys(seqs PartitionSeqs) []string {
+	rv := make([]string, 0, len(seqs))
+	for k := range seqs {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// MarshalPartitionSeqsJSON returns the JSON encoding of the
+// PartitionSeqs, in the form of /api/stats?partitions=true.
+func MarshalPartitionSeqsJSON(seqs PartitionSeqs) ([]byte, error) {
+	type uuidSeqJSON struct {
+		UUID string `json:"uuid"`
+		Seq  uint64 `json:"seq"`
+	}
+	type pindexJSON struct {
+		Partitions map[string]uuidSeqJSON `json:"partitions"`
+	}
+
+	m := struct {
+		PIndexes map[string]pindexJSON `json:"pindexes"`
+	}{PIndexes: make(map[string]pindexJSON, len(seqs))}
+
+	for pindex, partitions := range seqs {
+		p := pindexJSON{Partitions: make(map[string]uuidSeqJSON, len(partitions))}
+		for partition, uuidSeq := range partitions {
+			p.Partitions[partition] = uuidSeqJSON{uuidSeq.UUID, uuidSeq.Seq}
+		}
+		m.PIndexes[pindex] = p
+	}
+
+	return json.Marshal(&m)
+}
+
+// UnmarshalPartitionSeqs decodes the PartitionSeqs of a
+// /api/stats?partitions=true response, which is either the protobuf
+// encoding, or else the JSON stats.
+func UnmarshalPartitionSeqs(contentType string, data []byte) (
+	PartitionSeqs, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == PARTITION_SEQS_PROTOBUF {
+		m := &partitionSeqsPB{}
+		err := proto.Unmarshal(data, m)
+		if err != nil {
+			return nil, fmt.Errorf("partition_seqs: protobuf, err: %v", err)
+		}
+
+		rv := make(PartitionSeqs, len(m.PIndexes))
+		for _, p := range m.PIndexes {
+			partitions := make(map[string]UUIDSeq, len(p.Partitions))
+			for _, ps := range p.Partitions {
+				partitions[ps.Partition] = UUIDSeq{UUID: ps.Uuid, Seq: ps.Seq}
+			}
+			rv[p.Name] = partitions
+		}
+		return rv, nil
+	}
+
+	m := struct {
+		PIndexes map[string]struct {
+			Partitions map[string]struct {
+				UUID string `json:"uuid"`
+				Seq  uint64 `json:"seq"`
+			} `json:"partitions"`
+		} `json:"pindexes"`
+	}{}
+
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make(PartitionSeqs, len(m.PIndexes))
+	for pindex, p := range m.PIndexes {
+		partitions := make(map[string]UUIDSeq, len(p.Partitions))
+		for partition, uuidSeq := range p.Partitions {
+			partitions[partition] = UUIDSeq{UUID: uuidSeq.UUID, Seq: uuidSeq.Seq}
+		}
+		rv[pindex] = partitions
+	}
+	return rv, nil
+}
+
+// AcceptsPartitionSeqsProtobuf returns whether a request's Accept
+// header prefers the protobuf encoding of the PartitionSeqs over
+// JSON.
+func AcceptsPartitionSeqsProtobuf(r *http.Request) bool {
+	protobufQ, jsonQ := -1.0, -1.0
+
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case PARTITION_SEQS_PROTOBUF:
+			protobufQ = q
+		case "application/json", "*/*":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+
+	return protobufQ > 0 && protobufQ >= jsonQ
+}
+
+// WritePartitionSeqsProtobuf writes the protobuf encoding of the
+// PartitionSeqs as a response.
+func WritePartitionSeqsProtobuf(w http.ResponseWriter,
+	seqs PartitionSeqs) error {
+	buf, err := MarshalPartitionSeqsProtobuf(seqs)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", PARTITION_SEQS_PROTOBUF)
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,125 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func testPartitionSeqs(numPIndexes, numPartitions int) PartitionSeqs {
+	rv := PartitionSeqs{}
+	for i := 0; i < numPIndexes; i++ {
+		partitions := map[string]UUIDSeq{}
+		for j := 0; j < numPartitions; j++ {
+			partitions[fmt.Sprintf("%d", i*numPartitions+j)] =
+				UUIDSeq{UUID: fmt.Sprintf("uuid-%d", j), Seq: uint64(i*j + 1)}
+		}
+		rv[fmt.Sprintf("idx_%d_pindex", i)] = partitions
+	}
+	return rv
+}
+
+func TestPartitionSeqsRoundTrip(t *testing.T) {
+	seqs := testPartitionSeqs(3, 5)
+
+	pb, err := MarshalPartitionSeqsProtobuf(seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnmarshalPartitionSeqs(PARTITION_SEQS_PROTOBUF, pb)
+	if err != nil || !reflect.DeepEqual(got, seqs) {
+		t.Errorf("protobuf round trip, err: %v, got: %v", err, got)
+	}
+
+	j, err := MarshalPartitionSeqsJSON(seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = UnmarshalPartitionSeqs("application/json", j)
+	if err != nil || !reflect.DeepEqual(got, seqs) {
+		t.Errorf("json round trip, err: %v, got: %v", err, got)
+	}
+
+	// A content type that isn't protobuf is JSON, such as from an
+	// older node.
+	got, err = UnmarshalPartitionSeqs("", j)
+	if err != nil || !reflect.DeepEqual(got, seqs) {
+		t.Errorf("json fallback, err: %v, got: %v", err, got)
+	}
+
+	_, err = UnmarshalPartitionSeqs(PARTITION_SEQS_PROTOBUF, []byte("{}x"))
+	if err == nil {
+		t.Errorf("expected an err on a bad protobuf")
+	}
+}
+
+func TestAcceptsPartitionSeqsProtobuf(t *testing.T) {
+	tests := []struct {
+		accept string
+		exp    bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"*/*", false},
+		{PARTITION_SEQS_PROTOBUF, true},
+		{PARTITION_SEQS_PROTOBUF + ", application/json;q=0.9", true},
+		{PARTITION_SEQS_PROTOBUF + ";q=0.5, application/json", false},
+		{PARTITION_SEQS_PROTOBUF + ";q=0", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/stats", nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		if got := AcceptsPartitionSeqsProtobuf(r); got != test.exp {
+			t.Errorf("accept: %q, expected: %v, got: %v",
+				test.accept, test.exp, got)
+		}
+	}
+}
+
+func benchmarkUnmarshalPartitionSeqs(b *testing.B, contentType string) {
+	seqs := testPartitionSeqs(16, 256)
+
+	var data []byte
+	var err error
+	if contentType == PARTITION_SEQS_PROTOBUF {
+		data, err = MarshalPartitionSeqsProtobuf(seqs)
+	} else {
+		data, err = MarshalPartitionSeqsJSON(seqs)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err = UnmarshalPartitionSeqs(contentType, data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalPartitionSeqsJSON(b *testing.B) {
+	benchmarkUnmarshalPartitionSeqs(b, "application/json")
+}
+
+func BenchmarkUnmarshalPartitionSeqsProtobuf(b *testing.B) {
+	benchmarkUnmarshalPartitionSeqs(b, PARTITION_SEQS_PROTOBUF)
+}
@@ -18,6 +18,7 @@ import (
 	"log"
 	"math"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
 )
@@ -25,6 +26,32 @@ import (
 const PINDEX_META_FILENAME string = "PINDEX_META"
 const pindexPathSuffix string = ".pindex"
 
+// PINDEX_NAME_REGEXP is used to validate pindex names, which are also
+// the dir names of the pindexes in the dataDir, so that a pindex path
+// can't escape the dataDir, as in "../etc/pswd".
+const PINDEX_NAME_REGEXP = `^[0-9A-Za-z][0-9A-Za-z_\-]*$`
+
+// PINDEX_NAME_MAX_LEN is the longest valid pindex name, which keeps
+// the pindex dir names within the usual filesystem limit.
+const PINDEX_NAME_MAX_LEN = 240
+
+var pindexNameRE = regexp.MustCompile(PINDEX_NAME_REGEXP)
+
+// ValidatePIndexName returns an error if a pindex name has characters
+// outside of the PINDEX_NAME_REGEXP or is longer than the
+// PINDEX_NAME_MAX_LEN.
+func ValidatePIndexName(pindexName string) error {
+	if len(pindexName) > PINDEX_NAME_MAX_LEN {
+		return fmt.Errorf("pindex: pindex name too long,"+
+			" len: %d, max: %d", len(pindexName), PINDEX_NAME_MAX_LEN)
+	}
+	if !pindexNameRE.MatchString(pindexName) {
+		return fmt.Errorf("pindex: invalid pindex name: %q,"+
+			" expected: %s", pindexName, PINDEX_NAME_REGEXP)
+	}
+	return nil
+}
+
 // A PIndex represents a partition of an index, or an "index
 // partition".  A logical index definition will be split into one or
 // more pindexes.
@@ -46,6 +73,9 @@ type PIndex struct {
 
 	sourcePartitionsMap map[string]bool // Non-persisted memoization.
 
+	totIngest uint64 // Accessed atomically, for the rates sampler.
+	totQuery  uint64 // Accessed atomically, for the rates sampler.
+
 	m      sync.Mutex
 	closed bool
 
@@ -221,6 +251,14 @@ func openPIndex(mgr *Manager, path string) (pindex *PIndex, err error) {
 			return nil, fmt.Errorf("pindex: could not parse pindex json,"+
 				" path: %s, err: %v", path, err)
 		}
+
+		name, ok := parsePIndexPath(mgr.dataDir, path)
+		if !ok || name != pindex.Name {
+			mgr.log.Warnf("pindex: rejected opening pindex outside of"+
+				" dataDir, name: %q, path: %s", pindex.Name, path)
+			return nil, fmt.Errorf("pindex: invalid pindex path: %s,"+
+				" name: %q", path, pindex.Name)
+		}
 	}
 
 	restart := func() {
@@ -254,13 +292,18 @@ func openPIndex(mgr *Manager, path string) (pindex *PIndex, err error) {
 	return pindex, nil
 }
 
-// Computes the storage path for a pindex.
-func pIndexPath(dataDir, pindexName string) string {
-	// TODO: Need path security checks / mapping here; ex: "../etc/pswd"
-	return dataDir + string(os.PathSeparator) + pindexName + pindexPathSuffix
+// Computes the storage path for a pindex, or returns an error for an
+// invalid pindex name.
+func pIndexPath(dataDir, pindexName string) (string, error) {
+	err := ValidatePIndexName(pindexName)
+	if err != nil {
+		return "", err
+	}
+	return dataDir + string(os.PathSeparator) + pindexName + pindexPathSuffix, nil
 }
 
-// Retrieves a pindex name from a pindex path.
+// Retrieves a pindex name from a pindex path, where an invalid pindex
+// name is not ok.
 func parsePIndexPath(dataDir, pindexPath string) (string, bool) {
 	if !strings.HasSuffix(pindexPath, pindexPathSuffix) {
 		return "", false
@@ -271,6 +314,9 @@ func parsePIndexPath(dataDir, pindexPath string) (string, bool) {
 	}
 	pindexName := pindexPath[len(prefix):]
 	pindexName = pindexName[0 : len(pindexName)-len(pindexPathSuffix)]
+	if ValidatePIndexName(pindexName) != nil {
+		return "", false
+	}
 	return pindexName, true
 }
 
@@ -470,11 +516,17 @@ func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
 
 	_, pindexes := mgr.CurrentMaps()
 
+	mgr.m.RLock()
+	warmingPIndexes := mgr.warmingPIndexes
+	mgr.m.RUnlock()
+
 	selfUUID := mgr.UUID()
 
 	for _, planPIndex := range planPIndexes {
 		lowestNodePriority := math.MaxInt64
 		var lowestNode *NodeDef
+		var warmingNode *NodeDef
+		var cordonedNode *NodeDef
 
 		// look through each of the nodes
 		for nodeUUID, planPIndexNode := range planPIndex.Nodes {
@@ -495,6 +547,21 @@ func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
 			// node does pindexes and it is wanted
 			if nodeDef, ok := nodeDoesPIndexes(nodeUUID); ok &&
 				planPIndexFilter(planPIndexNode) {
+				if nodeLocalOK &&
+					warmingPIndexes[planPIndex.Name] == pindexes[planPIndex.Name] {
+					// local pindex is still warming, so prefer others
+					warmingNode = nodeDef
+					continue
+				}
+
+				if nodeDef.Cordoned {
+					// node is draining for a rolling restart
+					if !nodeLocal || nodeLocalOK {
+						cordonedNode = nodeDef
+					}
+					continue
+				}
+
 				if planPIndexNode.Priority < lowestNodePriority {
 					// candidate node has lower priority
 					if !nodeLocal || (nodeLocal && nodeLocalOK) {
@@ -511,6 +578,16 @@ func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
 			}
 		}
 
+		if lowestNode == nil {
+			// a cold, warming pindex is better than none
+			lowestNode = warmingNode
+		}
+
+		if lowestNode == nil {
+			// a cordoned node still serves until it restarts
+			lowestNode = cordonedNode
+		}
+
 		// now add the node we found to the correct list
 		if lowestNode == nil {
 			// couldn't find anyone with this pindex
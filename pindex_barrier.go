@@ -0,0 +1,184 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_QUERY_BARRIER_TIMEOUT bounds how long a query waits for a
+// newly promoted local pindex to reach its consistency barrier,
+// which may be overridden by the "queryBarrierTimeoutMS" option.
+const DEFAULT_QUERY_BARRIER_TIMEOUT = 5 * time.Second
+
+// PlanPIndexNodeHasBarrier returns true if the PlanPIndexNode carries
+// a consistency barrier; see PlanPIndexNode.MinSeqs.
+func PlanPIndexNodeHasBarrier(p *PlanPIndexNode) bool {
+	return p != nil && len(p.MinSeqs) > 0
+}
+
+// ConsistencyWaitBarrier waits, bounded by the timeout, for all the
+// partitions of a pindex to reach the minimum seqs of a barrier.
+func ConsistencyWaitBarrier(pindex *PIndex, minSeqs map[string]uint64,
+	timeout time.Duration, cancelCh <-chan bool) error {
+	if len(minSeqs) <= 0 {
+		return nil
+	}
+
+	waitCancelCh := make(chan bool)
+	doneCh := make(chan error, 1)
+
+	go func() {
+		doneCh <- ConsistencyWaitPartitions(pindex.Dest,
+			pindex.sourcePartitionsMap, "at_plus", minSeqs, waitCancelCh)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-doneCh:
+		return err
+
+	case <-timer.C:
+		close(waitCancelCh)
+
+		return &ErrorConsistencyWait{
+			Err: fmt.Errorf("pindex_barrier: timeout, pindex: %s,"+
+				" timeout: %v", pindex.Name, timeout),
+			Status: "timeout",
+		}
+
+	case <-cancelCh:
+		close(waitCancelCh)
+
+		return fmt.Errorf("pindex_barrier: cancelled, pindex: %s",
+			pindex.Name)
+	}
+}
+
+// ConsistencyWaitBarriers is meant to be invoked by a scatter/gather
+// layer on the local pindexes returned by CoveringPIndexes().  For
+// each local pindex whose plan entry for this node carries a
+// consistency barrier, it waits (bounded) for the barrier to be
+// reached.  On a timeout, the pindex falls back to another readable
+// node without a barrier, usually the former primary, which is
+// returned as a RemotePlanPIndex.  An error is returned when a
+// barrier times out and there's no node to fall back to.
+func (mgr *Manager) ConsistencyWaitBarriers(localPIndexes []*PIndex,
+	cancelCh <-chan bool) ([]*PIndex, []*RemotePlanPIndex, error) {
+	planPIndexes, _, err := mgr.GetPlanPIndexes(false)
+	if err != nil || planPIndexes == nil {
+		return localPIndexes, nil, err
+	}
+
+	timeout := DEFAULT_QUERY_BARRIER_TIMEOUT
+	if v, exists := mgr.Options()["queryBarrierTimeoutMS"]; exists {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pindex_barrier:"+
+				" queryBarrierTimeoutMS: %q, err: %v", v, err)
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	selfUUID := mgr.UUID()
+
+	rvLocal := make([]*PIndex, 0, len(localPIndexes))
+	var rvRemote []*RemotePlanPIndex
+
+	for _, pindex := range localPIndexes {
+		planPIndex := planPIndexes.PlanPIndexes[pindex.Name]
+		if planPIndex == nil ||
+			!PlanPIndexNodeHasBarrier(planPIndex.Nodes[selfUUID]) {
+			rvLocal = append(rvLocal, pindex)
+			continue
+		}
+
+		atomic.AddUint64(&mgr.stats.TotQueryBarrierWait, 1)
+
+		err = ConsistencyWaitBarrier(pindex,
+			planPIndex.Nodes[selfUUID].MinSeqs, time.Until(deadline), cancelCh)
+		if err == nil {
+			rvLocal = append(rvLocal, pindex)
+			continue
+		}
+
+		if _, ok := err.(*ErrorConsistencyWait); !ok {
+			return nil, nil, err
+		}
+
+		atomic.AddUint64(&mgr.stats.TotQueryBarrierTimeout, 1)
+
+		nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		remotePlanPIndex := CalcBarrierFallback(planPIndex, selfUUID, nodeDefs)
+		if remotePlanPIndex == nil {
+			return nil, nil, fmt.Errorf("pindex_barrier: barrier not reached"+
+				" and no fallback node, pindex: %s", pindex.Name)
+		}
+
+		atomic.AddUint64(&mgr.stats.TotQueryBarrierFallback, 1)
+
+		rvRemote = append(rvRemote, remotePlanPIndex)
+	}
+
+	return rvLocal, rvRemote, nil
+}
+
+// CalcBarrierFallback returns the highest priority, wanted and
+// readable node of a planPIndex, other than the excluded node, that
+// doesn't have a consistency barrier.  Returns nil if there's none.
+func CalcBarrierFallback(planPIndex *PlanPIndex, excludeNodeUUID string,
+	nodeDefs *NodeDefs) *RemotePlanPIndex {
+	if nodeDefs == nil {
+		return nil
+	}
+
+	lowestNodePriority := math.MaxInt64
+	var lowestNode *NodeDef
+
+	for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+		if nodeUUID == excludeNodeUUID ||
+			!PlanPIndexNodeCanRead(planPIndexNode) ||
+			PlanPIndexNodeHasBarrier(planPIndexNode) {
+			continue
+		}
+
+		nodeDef := nodeDefs.NodeDefs[nodeUUID]
+		if nodeDef == nil {
+			continue
+		}
+
+		if planPIndexNode.Priority < lowestNodePriority ||
+			(planPIndexNode.Priority == lowestNodePriority &&
+				nodeUUID < lowestNode.UUID) {
+			lowestNode = nodeDef
+			lowestNodePriority = planPIndexNode.Priority
+		}
+	}
+
+	if lowestNode == nil {
+		return nil
+	}
+
+	return &RemotePlanPIndex{PlanPIndex: planPIndex, NodeDef: lowestNode}
+}
@@ -0,0 +1,108 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// barrierTestDest only reaches seqs up to its seq.
+type barrierTestDest struct {
+	TestDest
+	seq uint64
+}
+
+func (t *barrierTestDest) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	if consistencySeq <= t.seq {
+		return nil
+	}
+	<-cancelCh
+	return fmt.Errorf("cancelled")
+}
+
+func TestConsistencyWaitBarrier(t *testing.T) {
+	pindex := &PIndex{
+		Name:                "p0",
+		Dest:                &barrierTestDest{seq: 10},
+		sourcePartitionsMap: map[string]bool{"0": true, "1": true},
+	}
+
+	err := ConsistencyWaitBarrier(pindex, nil, time.Millisecond, nil)
+	if err != nil {
+		t.Errorf("expected no barrier to be reached, err: %v", err)
+	}
+
+	err = ConsistencyWaitBarrier(pindex,
+		map[string]uint64{"0": 10, "1": 5}, time.Second, nil)
+	if err != nil {
+		t.Errorf("expected barrier to be reached, err: %v", err)
+	}
+
+	err = ConsistencyWaitBarrier(pindex,
+		map[string]uint64{"0": 10, "1": 11}, time.Millisecond, nil)
+	if e, ok := err.(*ErrorConsistencyWait); !ok || e.Status != "timeout" {
+		t.Errorf("expected barrier timeout, err: %v", err)
+	}
+
+	cancelCh := make(chan bool)
+	close(cancelCh)
+	err = ConsistencyWaitBarrier(pindex,
+		map[string]uint64{"0": 11}, time.Minute, cancelCh)
+	if _, ok := err.(*ErrorConsistencyWait); ok || err == nil {
+		t.Errorf("expected barrier cancelled, err: %v", err)
+	}
+}
+
+func TestCalcBarrierFallback(t *testing.T) {
+	nodeDefs := &NodeDefs{NodeDefs: map[string]*NodeDef{
+		"a": {UUID: "a"},
+		"b": {UUID: "b"},
+		"c": {UUID: "c"},
+	}}
+
+	planPIndex := &PlanPIndex{
+		Name: "p0",
+		Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true, Priority: 0,
+				MinSeqs: map[string]uint64{"0": 10}},
+			"b": {CanRead: true, Priority: 1},
+			"c": {CanRead: true, Priority: 2},
+			"d": {CanRead: true, Priority: 0}, // Not wanted.
+		},
+	}
+
+	rv := CalcBarrierFallback(planPIndex, "a", nodeDefs)
+	if rv == nil || rv.NodeDef.UUID != "b" || rv.PlanPIndex != planPIndex {
+		t.Errorf("expected fallback to b, got: %#v", rv)
+	}
+
+	planPIndex.Nodes["b"].CanRead = false
+	rv = CalcBarrierFallback(planPIndex, "a", nodeDefs)
+	if rv == nil || rv.NodeDef.UUID != "c" {
+		t.Errorf("expected fallback to c, got: %#v", rv)
+	}
+
+	planPIndex.Nodes["c"].MinSeqs = map[string]uint64{"0": 1}
+	rv = CalcBarrierFallback(planPIndex, "a", nodeDefs)
+	if rv != nil {
+		t.Errorf("expected no fallback, got: %#v", rv)
+	}
+
+	if CalcBarrierFallback(planPIndex, "a", nil) != nil {
+		t.Errorf("expected no fallback with nil nodeDefs")
+	}
+}
@@ -0,0 +1,360 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_PINDEX_BREAKER_COOL_DOWN is how long a pindex stays
+// read-only after its write circuit breaker opened, before writes are
+// probed again.  It may be overridden by the "pindexBreakerCoolDown"
+// manager option.
+const DEFAULT_PINDEX_BREAKER_COOL_DOWN = time.Minute
+
+// The states of a pindex write circuit breaker.
+const (
+	pindexBreakerClosed   = int32(0) // Writes are allowed.
+	pindexBreakerOpen     = int32(1) // The pindex is read-only.
+	pindexBreakerHalfOpen = int32(2) // Writes are being probed.
+)
+
+// A pindexBreaker tracks the consecutive write errors of a pindex's
+// Dest.  Once the errors reach the "pindexBreakerMaxWriteErrors"
+// manager option, the breaker opens, which makes the pindex read-only
+// by adding a canWrite=false NodePlanParam for the planPIndex to the
+// index definition.  After a cool-down, the NodePlanParam is removed
+// so that the feed restarts, and the next write either closes the
+// breaker or opens it again.
+type pindexBreaker struct {
+	state int32  // Accessed atomically.
+	errs  uint64 // Consecutive write errors, accessed atomically.
+}
+
+// breakerDest wraps a pindex's Dest to track its write errors.
+type breakerDest struct {
+	Dest
+	mgr     *Manager
+	pindex  *PIndex
+	breaker *pindexBreaker
+	maxErrs uint64
+}
+
+// breakerDestEx is a breakerDest for a Dest that's also a DestEx.
+type breakerDestEx struct {
+	*breakerDest
+	destEx DestEx
+}
+
+// unwrapBreakerDest returns the Dest that was wrapped by a
+// breakerDest, if any.
+func unwrapBreakerDest(dest Dest) Dest {
+	switch d := dest.(type) {
+	case *breakerDest:
+		return d.Dest
+	case *breakerDestEx:
+		return d.breakerDest.Dest
+	}
+	return dest
+}
+
+// wrapBreakerDest returns the Dest to hand to a feed for the pindex,
+// which tracks write errors when the breaker is enabled.
+func (mgr *Manager) wrapBreakerDest(pindex *PIndex) Dest {
+	maxErrs, _ := strconv.ParseUint(
+		mgr.Options()["pindexBreakerMaxWriteErrors"], 10, 64)
+	if maxErrs <= 0 || pindex.Dest == nil {
+		return pindex.Dest
+	}
+
+	mgr.breakersMutex.Lock()
+	if mgr.breakers == nil {
+		mgr.breakers = map[string]*pindexBreaker{}
+	}
+	breaker := mgr.breakers[pindex.Name]
+	if breaker == nil {
+		breaker = &pindexBreaker{}
+		mgr.breakers[pindex.Name] = breaker
+	}
+	mgr.breakersMutex.Unlock()
+
+	d := &breakerDest{
+		Dest:    pindex.Dest,
+		mgr:     mgr,
+		pindex:  pindex,
+		breaker: breaker,
+		maxErrs: maxErrs,
+	}
+
+	if destEx, ok := pindex.Dest.(DestEx); ok {
+		return &breakerDestEx{breakerDest: d, destEx: destEx}
+	}
+
+	return d
+}
+
+// removeBreaker forgets the breaker of a removed pindex.
+func (mgr *Manager) removeBreaker(pindexName string) {
+	mgr.breakersMutex.Lock()
+	delete(mgr.breakers, pindexName)
+	mgr.breakersMutex.Unlock()
+}
+
+// ---------------------------------------------------------
+
+func (d *breakerDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return d.onWrite(d.Dest.DataUpdate(partition, key, seq, val, cas,
+		extrasType, extras))
+}
+
+func (d *breakerDest) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return d.onWrite(d.Dest.DataDelete(partition, key, seq, cas,
+		extrasType, extras))
+}
+
+func (d *breakerDest) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	return d.onWrite(d.Dest.SnapshotStart(partition, snapStart, snapEnd))
+}
+
+func (d *breakerDest) OpaqueSet(partition string, value []byte) error {
+	return d.onWrite(d.Dest.OpaqueSet(partition, value))
+}
+
+// CheckpointPropose forwards the DestCheckpointer protocol, where a
+// failed ack counts as a write error.
+func (d *breakerDest) CheckpointPropose(partition string, seq uint64,
+	ack func(err error)) error {
+	return DestCheckpointPropose(d.Dest, partition, seq, func(err error) {
+		ack(d.onWrite(err))
+	})
+}
+
+func (d *breakerDestEx) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return d.onWrite(d.destEx.DataUpdateEx(partition, key, seq, val, cas,
+		extrasType, req))
+}
+
+func (d *breakerDestEx) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return d.onWrite(d.destEx.DataDeleteEx(partition, key, seq, cas,
+		extrasType, req))
+}
+
+func (d *breakerDestEx) RollbackEx(partition string,
+	partitionUUID uint64, rollbackSeq uint64) error {
+	return d.destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+}
+
+// onWrite updates the breaker with the outcome of a write.
+func (d *breakerDest) onWrite(err error) error {
+	b := d.breaker
+
+	if err == nil {
+		if atomic.LoadUint64(&b.errs) != 0 {
+			atomic.StoreUint64(&b.errs, 0)
+		}
+		if atomic.CompareAndSwapInt32(&b.state,
+			pindexBreakerHalfOpen, pindexBreakerClosed) {
+			go d.mgr.closedBreaker(d.pindex)
+		}
+		return nil
+	}
+
+	errs := atomic.AddUint64(&b.errs, 1)
+	if (errs >= d.maxErrs && atomic.CompareAndSwapInt32(&b.state,
+		pindexBreakerClosed, pindexBreakerOpen)) ||
+		atomic.CompareAndSwapInt32(&b.state,
+			pindexBreakerHalfOpen, pindexBreakerOpen) {
+		go d.mgr.openBreaker(d.pindex, b, errs, err)
+	}
+
+	return err
+}
+
+// ---------------------------------------------------------
+
+// openBreaker makes a pindex read-only and schedules the cool-down
+// probe.
+func (mgr *Manager) openBreaker(pindex *PIndex, b *pindexBreaker,
+	errs uint64, err error) {
+	atomic.AddUint64(&mgr.stats.TotPIndexBreakerOpen, 1)
+
+	mgr.log.Warnf("pindex_breaker: open, pindex: %s, errs: %d, err: %v",
+		pindex.Name, errs, err)
+
+	mgr.addBreakerEvent("pindexBreakerOpen", pindex, err)
+	mgr.addIndexEvent(INDEX_EVENT_DEGRADED, pindex.IndexName,
+		pindex.IndexUUID, "pindex read-only by its write breaker: "+pindex.Name)
+
+	errSet := mgr.setBreakerNodePlanParam(pindex, false)
+	if errSet != nil {
+		mgr.log.Warnf("pindex_breaker: open, pindex: %s, err: %v",
+			pindex.Name, errSet)
+	}
+
+	coolDown := DEFAULT_PINDEX_BREAKER_COOL_DOWN
+	if v, exists := mgr.Options()["pindexBreakerCoolDown"]; exists {
+		d, errParse := time.ParseDuration(v)
+		if errParse == nil {
+			coolDown = d
+		}
+	}
+
+	time.AfterFunc(coolDown, func() {
+		mgr.probeBreaker(pindex, b)
+	})
+}
+
+// probeBreaker allows writes again on a pindex whose breaker is open,
+// so that the next write will either close or re-open the breaker.
+func (mgr *Manager) probeBreaker(pindex *PIndex, b *pindexBreaker) {
+	select {
+	case <-mgr.stopCh:
+		return
+	default:
+	}
+
+	if !atomic.CompareAndSwapInt32(&b.state,
+		pindexBreakerOpen, pindexBreakerHalfOpen) {
+		return
+	}
+
+	atomic.StoreUint64(&b.errs, 0)
+
+	err := mgr.setBreakerNodePlanParam(pindex, true)
+	if err != nil {
+		mgr.log.Warnf("pindex_breaker: probe, pindex: %s, err: %v",
+			pindex.Name, err)
+	}
+}
+
+// closedBreaker records that a probe write succeeded.
+func (mgr *Manager) closedBreaker(pindex *PIndex) {
+	atomic.AddUint64(&mgr.stats.TotPIndexBreakerClose, 1)
+
+	mgr.log.Printf("pindex_breaker: closed, pindex: %s", pindex.Name)
+
+	mgr.addBreakerEvent("pindexBreakerClosed", pindex, nil)
+}
+
+func (mgr *Manager) addBreakerEvent(name string, pindex *PIndex,
+	err error) {
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	event, _ := json.Marshal(struct {
+		Event     string `json:"event"`
+		PIndex    string `json:"pindex"`
+		IndexName string `json:"indexName"`
+		Err       string `json:"err,omitempty"`
+		Time      string `json:"time"`
+	}{name, pindex.Name, pindex.IndexName, errStr,
+		Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+}
+
+// setBreakerNodePlanParam adds (or, with canWrite, removes) the
+// canWrite=false NodePlanParam for a planPIndex, retrying on CAS
+// conflicts.  The indexDef's UUID is left as-is, so the pindexes
+// aren't rebuilt.
+func (mgr *Manager) setBreakerNodePlanParam(pindex *PIndex,
+	canWrite bool) error {
+	retry := NewCASRetry(INDEX_DEFS_KEY)
+	for tries := 0; tries < 10; tries++ {
+		err := mgr.setBreakerNodePlanParamOnce(pindex, canWrite)
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				retry.Conflict()
+				continue // Retry on CAS mismatch.
+			}
+			return err
+		}
+		retry.Done(nil)
+		return nil
+	}
+
+	return fmt.Errorf("pindex_breaker: could not update indexDefs,"+
+		" pindex: %s, too many tries", pindex.Name)
+}
+
+func (mgr *Manager) setBreakerNodePlanParamOnce(pindex *PIndex,
+	canWrite bool) error {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return err
+	}
+	if indexDefs == nil {
+		return nil
+	}
+	indexDef := indexDefs.IndexDefs[pindex.IndexName]
+	if indexDef == nil || indexDef.UUID != pindex.IndexUUID {
+		return nil // The index was concurrently deleted or updated.
+	}
+
+	npps := indexDef.PlanParams.NodePlanParams
+
+	if canWrite {
+		npp := npps[""][pindex.Name]
+		if npp == nil || npp.CanWrite {
+			return nil
+		}
+		delete(npps[""], pindex.Name)
+		if len(npps[""]) <= 0 {
+			delete(npps, "")
+		}
+	} else {
+		canRead := true
+		if npp := GetNodePlanParam(npps, "", indexDef.Name,
+			pindex.Name); npp != nil {
+			canRead = npp.CanRead
+		}
+		if npps == nil {
+			npps = map[string]map[string]*NodePlanParam{}
+			indexDef.PlanParams.NodePlanParams = npps
+		}
+		if npps[""] == nil {
+			npps[""] = map[string]*NodePlanParam{}
+		}
+		npps[""][pindex.Name] = &NodePlanParam{
+			CanRead:  canRead,
+			CanWrite: false,
+		}
+	}
+
+	indexDefs.UUID = NewUUID()
+	indexDefs.ImplVersion = CfgGetVersion(mgr.cfg)
+
+	_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+
+	return err
+}
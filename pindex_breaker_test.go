@@ -0,0 +1,127 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// breakerTestDest fails its writes while failing is non-zero.
+type breakerTestDest struct {
+	TestDest
+	failing int32
+}
+
+func (t *breakerTestDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	if atomic.LoadInt32(&t.failing) != 0 {
+		return fmt.Errorf("disk full")
+	}
+	return nil
+}
+
+func TestPIndexBreaker(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, map[string]string{
+			"pindexBreakerMaxWriteErrors": "2",
+			"pindexBreakerCoolDown":       "1h",
+		})
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	sourceParams := "{\"numPartitions\":1}"
+	if err := m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	_, pindexes := m.CurrentMaps()
+	if len(pindexes) != 1 {
+		t.Fatalf("expected 1 pindex, got: %d", len(pindexes))
+	}
+	var pindex *PIndex
+	for _, p := range pindexes {
+		pindex = p.Clone()
+	}
+
+	testDest := &breakerTestDest{failing: 1}
+	pindex.Dest = testDest
+
+	dest := m.wrapBreakerDest(pindex)
+	if unwrapBreakerDest(dest) != testDest {
+		t.Fatalf("expected wrapped dest")
+	}
+
+	nodePlanParam := func() *NodePlanParam {
+		indexDefs, _, _ := CfgGetIndexDefs(cfg)
+		return indexDefs.IndexDefs["foo"].PlanParams.
+			NodePlanParams[""][pindex.Name]
+	}
+
+	dest.DataUpdate("0", []byte("k"), 1, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if atomic.LoadUint64(&m.stats.TotPIndexBreakerOpen) != 0 {
+		t.Errorf("expected breaker to stay closed")
+	}
+
+	dest.DataUpdate("0", []byte("k"), 2, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	for i := 0; i < 100 && nodePlanParam() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	npp := nodePlanParam()
+	if npp == nil || npp.CanWrite || !npp.CanRead {
+		t.Fatalf("expected read-only pindex, got: %#v", npp)
+	}
+
+	m.PlannerNOOP("test")
+	planPIndexes, _, _ := CfgGetPlanPIndexes(cfg)
+	if planPIndexes.PlanPIndexes[pindex.Name].Nodes[m.UUID()].CanWrite {
+		t.Errorf("expected canWrite false in plan")
+	}
+
+	m.breakersMutex.Lock()
+	breaker := m.breakers[pindex.Name]
+	m.breakersMutex.Unlock()
+
+	m.probeBreaker(pindex, breaker)
+	if nodePlanParam() != nil {
+		t.Errorf("expected restored writes on probe")
+	}
+
+	atomic.StoreInt32(&testDest.failing, 0)
+	err := dest.DataUpdate("0", []byte("k"), 3, nil, 0,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Errorf("expected probe write to work, err: %v", err)
+	}
+	for i := 0; i < 100 &&
+		atomic.LoadUint64(&m.stats.TotPIndexBreakerClose) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&breaker.state) != pindexBreakerClosed ||
+		atomic.LoadUint64(&m.stats.TotPIndexBreakerClose) != 1 {
+		t.Errorf("expected closed breaker")
+	}
+}
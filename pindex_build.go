@@ -0,0 +1,359 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// INDEX_BUILD_TARGETS_KEY is the Cfg key of the IndexBuildTargets.
+const INDEX_BUILD_TARGETS_KEY = "indexBuildTargets"
+
+// DEFAULT_INDEX_BUILD_CHECK_INTERVAL is how often a node checks
+// whether the initial builds of its indexes completed, which may be
+// overridden by the "indexBuildCheckInterval" manager option, such as
+// "1s".
+const DEFAULT_INDEX_BUILD_CHECK_INTERVAL = 10 * time.Second
+
+// IndexBuildTargets holds the source partition seqs as of the
+// creation of each index, which are the targets of the indexes'
+// initial builds.  A target is only recorded for the indexes whose
+// FeedType supports PartitionSeqs.
+type IndexBuildTargets struct {
+	UUID    string                       `json:"uuid"`
+	Indexes map[string]*IndexBuildTarget `json:"indexes"` // Keyed by index name.
+}
+
+// IndexBuildTarget is the initial build target of an index.
+type IndexBuildTarget struct {
+	IndexUUID string             `json:"indexUUID"`
+	Time      string             `json:"time"`
+	Seqs      map[string]UUIDSeq `json:"seqs"` // Keyed by source partition.
+}
+
+// IndexBuildProgress is the progress of the initial build of an
+// index on a node, over the pindexes that are planned to the node.
+type IndexBuildProgress struct {
+	IndexName string `json:"indexName"`
+	IndexUUID string `json:"indexUUID"`
+
+	// Percent is the percentage of the target seqs that the local
+	// pindexes ingested, from 0 to 100.
+	Percent float64 `json:"percent"`
+
+	// Complete is whether all the local pindexes reached their
+	// target seqs, which stays true once reached.
+	Complete    bool   `json:"complete"`
+	CompletedAt string `json:"completedAt,omitempty"`
+
+	PIndexes map[string]float64 `json:"pindexes"` // Percent by pindex name.
+}
+
+// CfgGetIndexBuildTargets returns the IndexBuildTargets from a Cfg.
+func CfgGetIndexBuildTargets(cfg Cfg) (*IndexBuildTargets, uint64, error) {
+	v, cas, err := cfg.Get(INDEX_BUILD_TARGETS_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &IndexBuildTargets{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetIndexBuildTargets updates the IndexBuildTargets on a Cfg.
+func CfgSetIndexBuildTargets(cfg Cfg, targets *IndexBuildTargets,
+	cas uint64) (uint64, error) {
+	buf, err := json.Marshal(targets)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(INDEX_BUILD_TARGETS_KEY, buf, cas)
+}
+
+// ---------------------------------------------------------
+
+// saveIndexBuildTarget records the current source partition seqs as
+// the initial build target of a newly created or updated index, and
+// forgets the targets of the deleted indexes.
+func (mgr *Manager) saveIndexBuildTarget(indexDef *IndexDef) (err error) {
+	feedType := FeedTypes[indexDef.SourceType]
+	if feedType == nil || feedType.PartitionSeqs == nil {
+		return nil
+	}
+
+	seqs, err := feedType.PartitionSeqs(indexDef.SourceType,
+		indexDef.SourceName, indexDef.SourceUUID, indexDef.SourceParams,
+		mgr.server, mgr.Options())
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotIndexBuildTargetSaveErr, 1)
+		return err
+	}
+
+	_, indexDefsByName, _ := mgr.GetIndexDefs(false)
+
+	target := &IndexBuildTarget{
+		IndexUUID: indexDef.UUID,
+		Time:      Now().Format(time.RFC3339Nano),
+		Seqs:      seqs,
+	}
+
+	for tries := 0; tries < 10; tries++ {
+		var all *IndexBuildTargets
+		var cas uint64
+
+		all, cas, err = CfgGetIndexBuildTargets(mgr.cfg)
+		if err != nil {
+			break
+		}
+		if all == nil {
+			all = &IndexBuildTargets{}
+		}
+		if all.Indexes == nil {
+			all.Indexes = map[string]*IndexBuildTarget{}
+		}
+
+		for indexName := range all.Indexes {
+			if indexDefsByName != nil && indexDefsByName[indexName] == nil {
+				delete(all.Indexes, indexName)
+			}
+		}
+
+		all.UUID = NewUUID()
+		all.Indexes[indexDef.Name] = target
+
+		_, err = CfgSetIndexBuildTargets(mgr.cfg, all, cas)
+		if err == nil {
+			atomic.AddUint64(&mgr.stats.TotIndexBuildTargetSave, 1)
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			break
+		}
+	}
+
+	atomic.AddUint64(&mgr.stats.TotIndexBuildTargetSaveErr, 1)
+
+	return err
+}
+
+// IndexBuildProgress returns the progress of the initial builds of
+// the indexes that have pindexes planned to this node, keyed by index
+// name.  Indexes without a build target aren't included.
+func (mgr *Manager) IndexBuildProgress() (
+	map[string]*IndexBuildProgress, error) {
+	if mgr.cfg == nil { // Can occur during testing.
+		return nil, nil
+	}
+
+	targets, _, err := CfgGetIndexBuildTargets(mgr.cfg)
+	if err != nil || targets == nil {
+		return nil, err
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, planPIndexesByName, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, pindexes := mgr.CurrentMaps()
+
+	mgr.buildMutex.Lock()
+	completed := mgr.buildCompleted
+	mgr.buildMutex.Unlock()
+
+	rv := map[string]*IndexBuildProgress{}
+
+	for indexName, target := range targets.Indexes {
+		indexDef := indexDefsByName[indexName]
+		if indexDef == nil || indexDef.UUID != target.IndexUUID {
+			continue
+		}
+
+		p := &IndexBuildProgress{
+			IndexName: indexName,
+			IndexUUID: indexDef.UUID,
+			PIndexes:  map[string]float64{},
+		}
+
+		var done, total uint64
+		var missing bool
+
+		for _, planPIndex := range planPIndexesByName[indexName] {
+			if planPIndex.IndexUUID != indexDef.UUID ||
+				planPIndex.Nodes[mgr.uuid] == nil {
+				continue
+			}
+
+			d, t := pindexBuildSeqs(pindexes[planPIndex.Name],
+				planPIndex.SourcePartitions, target.Seqs)
+			if pindexes[planPIndex.Name] == nil {
+				missing = true
+			}
+
+			p.PIndexes[planPIndex.Name] = buildPercent(d, t)
+
+			done += d
+			total += t
+		}
+
+		if len(p.PIndexes) <= 0 {
+			continue
+		}
+
+		p.Percent = buildPercent(done, total)
+		p.Complete = !missing && done >= total
+
+		if at, exists := completed[indexDef.UUID]; exists {
+			p.Percent = 100
+			p.Complete = true
+			p.CompletedAt = at
+			for name := range p.PIndexes {
+				p.PIndexes[name] = 100
+			}
+		}
+
+		rv[indexName] = p
+	}
+
+	return rv, nil
+}
+
+// pindexBuildSeqs returns the seqs that a pindex ingested towards the
+// target seqs of its source partitions, and the total of the target
+// seqs.  A pindex that's not yet registered has ingested nothing.
+func pindexBuildSeqs(pindex *PIndex, sourcePartitions string,
+	seqs map[string]UUIDSeq) (done, total uint64) {
+	var partitions []string
+	if sourcePartitions != "" {
+		partitions = strings.Split(sourcePartitions, ",")
+	} else {
+		for partition := range seqs {
+			partitions = append(partitions, partition)
+		}
+	}
+
+	for _, partition := range partitions {
+		target := seqs[partition].Seq
+		total += target
+
+		if pindex == nil || pindex.Dest == nil || target <= 0 {
+			continue
+		}
+
+		_, lastSeq, err := pindex.Dest.OpaqueGet(partition)
+		if err != nil {
+			continue
+		}
+		if lastSeq > target {
+			lastSeq = target
+		}
+		done += lastSeq
+	}
+
+	return done, total
+}
+
+// buildPercent rounds the percentage to 2 decimals, where a zero
+// total is complete.
+func buildPercent(done, total uint64) float64 {
+	if total <= 0 {
+		return 100
+	}
+	return math.Round(float64(done)*10000/float64(total)) / 100
+}
+
+// IndexBuildLoop periodically checks the initial builds of the
+// indexes on this node, and adds an "indexBuildComplete" event when
+// the build of an index completes.
+func (mgr *Manager) IndexBuildLoop() {
+	interval := DEFAULT_INDEX_BUILD_CHECK_INTERVAL
+	if v, err := time.ParseDuration(
+		mgr.Options()["indexBuildCheckInterval"]); err == nil && v > 0 {
+		interval = v
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			mgr.checkIndexBuildsOnce()
+		}
+	}
+}
+
+// checkIndexBuildsOnce records the newly completed builds, and
+// forgets the completed builds of the indexes that are gone.
+func (mgr *Manager) checkIndexBuildsOnce() {
+	if mgr.cfg == nil { // Can occur during testing.
+		return
+	}
+
+	progress, err := mgr.IndexBuildProgress()
+	if err != nil {
+		mgr.log.Warnf("pindex_build: IndexBuildProgress, err: %v", err)
+		return
+	}
+
+	_, indexDefsByName, _ := mgr.GetIndexDefs(false)
+
+	mgr.buildMutex.Lock()
+	completed := make(map[string]string, len(mgr.buildCompleted))
+	for _, indexDef := range indexDefsByName {
+		if at, exists := mgr.buildCompleted[indexDef.UUID]; exists {
+			completed[indexDef.UUID] = at
+		}
+	}
+
+	var events []*IndexBuildProgress
+
+	for _, p := range progress {
+		if _, exists := completed[p.IndexUUID]; exists {
+			continue
+		}
+		if p.Complete {
+			p.CompletedAt = Now().Format(time.RFC3339Nano)
+			completed[p.IndexUUID] = p.CompletedAt
+			events = append(events, p)
+		}
+	}
+
+	mgr.buildCompleted = completed
+	mgr.buildMutex.Unlock()
+
+	for _, p := range events {
+		atomic.AddUint64(&mgr.stats.TotIndexBuildComplete, 1)
+
+		mgr.log.Printf("pindex_build: build complete, indexName: %s,"+
+			" indexUUID: %s", p.IndexName, p.IndexUUID)
+
+		mgr.addIndexEvent(INDEX_EVENT_BUILT, p.IndexName, p.IndexUUID, "")
+	}
+}
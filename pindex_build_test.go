@@ -0,0 +1,187 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterFeedType("buildTestFeed", &FeedType{
+		Partitions: func(sourceType, sourceName, sourceUUID,
+			sourceParams, server string,
+			options map[string]string) ([]string, error) {
+			return []string{"0", "1"}, nil
+		},
+		PartitionSeqs: func(sourceType, sourceName, sourceUUID,
+			sourceParams, server string,
+			options map[string]string) (map[string]UUIDSeq, error) {
+			return map[string]UUIDSeq{
+				"0": {UUID: "u0", Seq: 10},
+				"1": {UUID: "u1", Seq: 30},
+			}, nil
+		},
+	})
+}
+
+func TestBuildPercent(t *testing.T) {
+	tests := []struct {
+		done, total uint64
+		exp         float64
+	}{
+		{0, 0, 100},
+		{0, 10, 0},
+		{1, 3, 33.33},
+		{10, 10, 100},
+	}
+	for _, test := range tests {
+		if got := buildPercent(test.done, test.total); got != test.exp {
+			t.Errorf("buildPercent(%d, %d), expected: %v, got: %v",
+				test.done, test.total, test.exp, got)
+		}
+	}
+}
+
+func TestIndexBuildProgress(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), []string{"pindex"},
+		"", 1, "", ":1000", emptyDir, "", nil, map[string]string{
+			"maxReplicasAllowed": "1",
+		})
+	defer mgr.Stop()
+
+	err := mgr.Register("wanted")
+	if err != nil {
+		t.Fatalf("expected Register to work, err: %v", err)
+	}
+
+	indexUUID, err := mgr.CreateIndexEx("buildTestFeed", "src", "", "",
+		"blackhole", "idx", "", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndexEx to work, err: %v", err)
+	}
+
+	targets, _, err := CfgGetIndexBuildTargets(cfg)
+	if err != nil || targets == nil || targets.Indexes["idx"] == nil ||
+		targets.Indexes["idx"].IndexUUID != indexUUID ||
+		targets.Indexes["idx"].Seqs["1"].Seq != 30 {
+		t.Fatalf("expected the build target, got: %+v, %v", targets, err)
+	}
+
+	planPIndexes := NewPlanPIndexes(Version)
+	for name, partitions := range map[string]string{"p0": "0", "p1": "1"} {
+		planPIndexes.PlanPIndexes[name] = &PlanPIndex{
+			Name:             name,
+			IndexName:        "idx",
+			IndexUUID:        indexUUID,
+			SourcePartitions: partitions,
+			Nodes: map[string]*PlanPIndexNode{
+				mgr.UUID(): {CanRead: true, CanWrite: true},
+			},
+		}
+	}
+	_, err = CfgSetPlanPIndexes(cfg, planPIndexes, CFG_CAS_FORCE)
+	if err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+	mgr.GetPlanPIndexes(true)
+
+	dest := NewCounting()
+	err = mgr.registerPIndex(&PIndex{Name: "p0", IndexName: "idx",
+		IndexUUID: indexUUID, SourcePartitions: "0", Dest: dest})
+	if err != nil {
+		t.Fatalf("expected registerPIndex to work, err: %v", err)
+	}
+	dest.DataUpdate("0", []byte("a"), 10, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	// The unregistered p1 hasn't ingested anything yet.
+	progress, err := mgr.IndexBuildProgress()
+	if err != nil {
+		t.Fatalf("expected IndexBuildProgress to work, err: %v", err)
+	}
+	exp := &IndexBuildProgress{
+		IndexName: "idx",
+		IndexUUID: indexUUID,
+		Percent:   25,
+		PIndexes:  map[string]float64{"p0": 100, "p1": 0},
+	}
+	if !reflect.DeepEqual(progress["idx"], exp) {
+		t.Errorf("expected: %+v, got: %+v", exp, progress["idx"])
+	}
+
+	mgr.checkIndexBuildsOnce()
+
+	dest1 := NewCounting()
+	err = mgr.registerPIndex(&PIndex{Name: "p1", IndexName: "idx",
+		IndexUUID: indexUUID, SourcePartitions: "1", Dest: dest1})
+	if err != nil {
+		t.Fatalf("expected registerPIndex to work, err: %v", err)
+	}
+	dest1.DataUpdate("1", []byte("b"), 35, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	mgr.checkIndexBuildsOnce()
+	mgr.checkIndexBuildsOnce()
+
+	progress, _ = mgr.IndexBuildProgress()
+	if p := progress["idx"]; p == nil || !p.Complete || p.Percent != 100 ||
+		p.CompletedAt == "" {
+		t.Errorf("expected a complete build, got: %+v", p)
+	}
+
+	// A completed build stays complete, such as after a rollback.
+	dest1.Rollback("1", 5)
+	progress, _ = mgr.IndexBuildProgress()
+	if p := progress["idx"]; p == nil || !p.Complete || p.PIndexes["p1"] != 100 {
+		t.Errorf("expected a sticky complete build, got: %+v", p)
+	}
+
+	var events []string
+	mgr.VisitEvents(func(event []byte) {
+		if strings.Contains(string(event), `"indexBuildComplete"`) {
+			events = append(events, string(event))
+		}
+	})
+	if len(events) != 1 {
+		t.Errorf("expected one build complete event, got: %v", events)
+	}
+}
+
+func TestIndexBuildLoopNilCfg(t *testing.T) {
+	mgr := NewManager(Version, nil, nil, NewUUID(), []string{"pindex"},
+		"", 1, "", "", "dir", "svr", nil, map[string]string{
+			"indexBuildCheckInterval": "1ms",
+		})
+
+	progress, err := mgr.IndexBuildProgress()
+	if err != nil || progress != nil {
+		t.Errorf("expected no progress without a cfg, got: %v, %v",
+			progress, err)
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		mgr.IndexBuildLoop()
+		close(doneCh)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	mgr.Stop()
+	<-doneCh
+}
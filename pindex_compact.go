@@ -0,0 +1,271 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_COMPACTION_CHECK_INTERVAL is the default of the
+// "compactionCheckInterval" manager option.
+const DEFAULT_COMPACTION_CHECK_INTERVAL = time.Minute
+
+// DEFAULT_COMPACTION_INTERVAL is the default of the
+// "compactionInterval" manager option, which is the least time
+// between two compactions of a pindex.
+const DEFAULT_COMPACTION_INTERVAL = 24 * time.Hour
+
+// CompactionStatus reports the compactions of the local pindexes.
+type CompactionStatus struct {
+	Running []string          `json:"running"`
+	Last    map[string]string `json:"last"` // Keyed by pindex name.
+}
+
+// CompactionLoop periodically starts the compactions of the local
+// pindexes whose PIndexImplType has a Compact callback.  The
+// compactions only start within the "compactionWindows" manager
+// option, comma separated off-peak windows of local time like
+// "01:00-05:00,22:30-23:30", where empty means any time, and never
+// while a rebalance is running.  At most "compactionMaxConcurrent"
+// (default 1) compactions run at a time on the node, and a pindex is
+// compacted at most once per "compactionInterval" (default 24h).
+func (mgr *Manager) CompactionLoop() {
+	interval := DEFAULT_COMPACTION_CHECK_INTERVAL
+	if v, err := time.ParseDuration(
+		mgr.Options()["compactionCheckInterval"]); err == nil && v > 0 {
+		interval = v
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			mgr.checkCompactionsOnce()
+		}
+	}
+}
+
+// checkCompactionsOnce starts the due compactions, where the pindexes
+// that were compacted the longest ago go first.
+func (mgr *Manager) checkCompactionsOnce() {
+	options := mgr.Options()
+	now := Now()
+
+	inWindow, err := inCompactionWindows(options["compactionWindows"], now)
+	if err != nil {
+		mgr.log.Warnf("pindex_compact: err: %v", err)
+		return
+	}
+	if !inWindow {
+		return
+	}
+
+	maxConcurrent := 1
+	if v, err := strconv.Atoi(options["compactionMaxConcurrent"]); err == nil && v > 0 {
+		maxConcurrent = v
+	}
+
+	minInterval := DEFAULT_COMPACTION_INTERVAL
+	if v, err := time.ParseDuration(options["compactionInterval"]); err == nil && v >= 0 {
+		minInterval = v
+	}
+
+	_, pindexes := mgr.CurrentMaps()
+
+	mgr.compactMutex.Lock()
+
+	var due []*PIndex
+	for name, pindex := range pindexes {
+		pindexImplType := GetPIndexImplType(pindex.IndexType)
+		if pindexImplType == nil || pindexImplType.Compact == nil ||
+			mgr.compactRunning[name] {
+			continue
+		}
+		if last, exists := mgr.compactLast[name]; exists &&
+			now.Sub(last) < minInterval {
+			continue
+		}
+		due = append(due, pindex)
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		a, b := mgr.compactLast[due[i].Name], mgr.compactLast[due[j].Name]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return due[i].Name < due[j].Name
+	})
+
+	if n := maxConcurrent - len(mgr.compactRunning); n < len(due) {
+		if n < 0 {
+			n = 0
+		}
+		due = due[:n]
+	}
+
+	if len(due) > 0 && mgr.compactRebalanceRunning != nil &&
+		mgr.compactRebalanceRunning(mgr.cfg) {
+		mgr.compactMutex.Unlock()
+		atomic.AddUint64(&mgr.stats.TotCompactionSkipRebalance, 1)
+		return
+	}
+
+	if mgr.compactRunning == nil {
+		mgr.compactRunning = map[string]bool{}
+	}
+	for _, pindex := range due {
+		mgr.compactRunning[pindex.Name] = true
+	}
+
+	mgr.compactMutex.Unlock()
+
+	for _, pindex := range due {
+		go mgr.runCompaction(pindex)
+	}
+}
+
+// runCompaction invokes the Compact callback of a pindex.
+func (mgr *Manager) runCompaction(pindex *PIndex) {
+	atomic.AddUint64(&mgr.stats.TotCompaction, 1)
+
+	startTime := Now()
+
+	var err error
+	if pindexImplType := GetPIndexImplType(pindex.IndexType); pindexImplType != nil &&
+		pindexImplType.Compact != nil {
+		err = pindexImplType.Compact(mgr, pindex)
+	}
+
+	mgr.compactMutex.Lock()
+	delete(mgr.compactRunning, pindex.Name)
+	if mgr.compactLast == nil {
+		mgr.compactLast = map[string]time.Time{}
+	}
+	// A failed compaction is retried after the interval as well, so
+	// that a broken pindex doesn't hog the compaction slots.
+	mgr.compactLast[pindex.Name] = startTime
+	mgr.compactMutex.Unlock()
+
+	errStr := ""
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotCompactionErr, 1)
+		mgr.log.Warnf("pindex_compact: compact failed, pindex: %s, err: %v",
+			pindex.Name, err)
+		errStr = err.Error()
+	} else {
+		atomic.AddUint64(&mgr.stats.TotCompactionOk, 1)
+	}
+
+	event, _ := json.Marshal(struct {
+		Event      string `json:"event"`
+		Name       string `json:"name"`
+		DurationMS int64  `json:"durationMS"`
+		Err        string `json:"err,omitempty"`
+		Time       string `json:"time"`
+	}{"compactPIndex", pindex.Name,
+		int64(Now().Sub(startTime) / time.Millisecond), errStr,
+		Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+}
+
+// SetRebalanceRunning sets the check of whether a rebalance is
+// running across the cluster, so that compactions don't compete with
+// the moves of pindexes, such as the rebalance package's
+// RebalanceRunning().  A nil check, the default, never holds off the
+// compactions.
+func (mgr *Manager) SetRebalanceRunning(f func(cfg Cfg) bool) {
+	mgr.compactMutex.Lock()
+	mgr.compactRebalanceRunning = f
+	mgr.compactMutex.Unlock()
+}
+
+// CompactionStatus returns the running and the last compactions of
+// the local pindexes.
+func (mgr *Manager) CompactionStatus() *CompactionStatus {
+	mgr.compactMutex.Lock()
+	defer mgr.compactMutex.Unlock()
+
+	rv := &CompactionStatus{
+		Running: make([]string, 0, len(mgr.compactRunning)),
+		Last:    make(map[string]string, len(mgr.compactLast)),
+	}
+	for name := range mgr.compactRunning {
+		rv.Running = append(rv.Running, name)
+	}
+	sort.Strings(rv.Running)
+	for name, t := range mgr.compactLast {
+		rv.Last[name] = t.Format(time.RFC3339Nano)
+	}
+	return rv
+}
+
+// removeCompaction forgets the compactions of a removed pindex.
+func (mgr *Manager) removeCompaction(pindexName string) {
+	mgr.compactMutex.Lock()
+	delete(mgr.compactLast, pindexName)
+	mgr.compactMutex.Unlock()
+}
+
+// inCompactionWindows returns whether the local time of day of now is
+// within one of the comma separated "HH:MM-HH:MM" windows, where a
+// window may wrap around midnight, and no windows means any time.
+func inCompactionWindows(windows string, now time.Time) (bool, error) {
+	windows = strings.TrimSpace(windows)
+	if windows == "" {
+		return true, nil
+	}
+
+	minuteOfDay := func(s string) (int, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf("pindex_compact: invalid time: %q", s)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+
+	curr := now.Hour()*60 + now.Minute()
+
+	for _, window := range strings.Split(windows, ",") {
+		parts := strings.Split(window, "-")
+		if len(parts) != 2 {
+			return false, fmt.Errorf("pindex_compact: invalid window: %q",
+				window)
+		}
+		beg, err := minuteOfDay(parts[0])
+		if err != nil {
+			return false, err
+		}
+		end, err := minuteOfDay(parts[1])
+		if err != nil {
+			return false, err
+		}
+		if beg <= end {
+			if curr >= beg && curr < end {
+				return true, nil
+			}
+		} else if curr >= beg || curr < end {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInCompactionWindows(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		t, _ := time.Parse("15:04", hhmm)
+		return t
+	}
+
+	tests := []struct {
+		windows string
+		now     string
+		expect  bool
+		err     bool
+	}{
+		{"", "12:00", true, false},
+		{"01:00-05:00", "03:30", true, false},
+		{"01:00-05:00", "05:00", false, false},
+		{"22:00-02:00", "23:59", true, false},
+		{"22:00-02:00", "01:00", true, false},
+		{"22:00-02:00", "12:00", false, false},
+		{"01:00-02:00, 12:00-13:00", "12:30", true, false},
+		{"01:00", "01:00", false, true},
+		{"01:00-25:00", "01:00", false, true},
+	}
+
+	for i, test := range tests {
+		got, err := inCompactionWindows(test.windows, at(test.now))
+		if got != test.expect || (err != nil) != test.err {
+			t.Errorf("test: %d, windows: %q, now: %s, got: %v, err: %v",
+				i, test.windows, test.now, got, err)
+		}
+	}
+}
+
+func TestCompactionSchedule(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	compactCh := make(chan string, 10)
+	releaseCh := make(chan struct{})
+
+	RegisterPIndexImplType("compact-test", &PIndexImplType{
+		Compact: func(mgr *Manager, pindex *PIndex) error {
+			compactCh <- pindex.Name
+			<-releaseCh
+			return nil
+		},
+	})
+	defer UnregisterPIndexImplType("compact-test")
+
+	mgr := NewManager(Version, NewCfgMem(), nil, NewUUID(), nil, "",
+		1, "", ":1000", emptyDir, "", nil, map[string]string{
+			"compactionMaxConcurrent": "1",
+		})
+	defer mgr.Stop()
+
+	rebalancing := true
+	mgr.SetRebalanceRunning(func(cfg Cfg) bool { return rebalancing })
+
+	for _, name := range []string{"p0", "p1"} {
+		mgr.registerPIndex(&PIndex{Name: name, IndexType: "compact-test"})
+	}
+	mgr.registerPIndex(&PIndex{Name: "other", IndexType: "blackhole"})
+
+	mgr.checkCompactionsOnce()
+	if atomic.LoadUint64(&mgr.stats.TotCompactionSkipRebalance) != 1 {
+		t.Fatalf("expected a skip during the rebalance")
+	}
+
+	rebalancing = false
+
+	mgr.checkCompactionsOnce()
+	if name := <-compactCh; name != "p0" {
+		t.Errorf("expected p0 first, got: %s", name)
+	}
+
+	// The max concurrent compaction is running.
+	mgr.checkCompactionsOnce()
+	if got := mgr.CompactionStatus().Running; !reflect.DeepEqual(got,
+		[]string{"p0"}) {
+		t.Errorf("expected only p0 running, got: %v", got)
+	}
+
+	releaseCh <- struct{}{}
+	for len(mgr.CompactionStatus().Running) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	mgr.checkCompactionsOnce()
+	if name := <-compactCh; name != "p1" {
+		t.Errorf("expected p1 next, got: %s", name)
+	}
+	releaseCh <- struct{}{}
+	for len(mgr.CompactionStatus().Running) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Both were compacted within the interval.
+	mgr.checkCompactionsOnce()
+	if len(mgr.CompactionStatus().Running) != 0 ||
+		len(mgr.CompactionStatus().Last) != 2 {
+		t.Errorf("expected no compactions, got: %+v",
+			mgr.CompactionStatus())
+	}
+	if n := atomic.LoadUint64(&mgr.stats.TotCompaction); n != 2 {
+		t.Errorf("expected 2 compactions, got: %d", n)
+	}
+}
@@ -0,0 +1,319 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The "maxPIndexesPerNode" cluster option caps the number of pindexes,
+// primaries plus replicas, that the planner assigns to a node, which
+// protects small nodes from running out of file handles and memory.
+// A node may override the cap with its "nodeMaxPIndexes" manager
+// option, see NodeDef.MaxPIndexes, where 0 means no cap.
+
+// nodeMaxPIndexes returns the effective pindex caps of the nodes,
+// keyed by node UUID, or nil when no node has a cap.
+func nodeMaxPIndexes(options map[string]string,
+	nodeDefs *NodeDefs) map[string]int {
+	if nodeDefs == nil {
+		return nil
+	}
+
+	clusterMax, _ := strconv.Atoi(options["maxPIndexesPerNode"])
+
+	var rv map[string]int
+	for nodeUUID, nodeDef := range nodeDefs.NodeDefs {
+		max := clusterMax
+		if nodeDef.MaxPIndexes > 0 {
+			max = nodeDef.MaxPIndexes
+		}
+		if max > 0 {
+			if rv == nil {
+				rv = map[string]int{}
+			}
+			rv[nodeUUID] = max
+		}
+	}
+
+	return rv
+}
+
+// planPIndexesLoads returns the number of pindexes of each node in a
+// plan.
+func planPIndexesLoads(planPIndexes *PlanPIndexes) map[string]int {
+	loads := map[string]int{}
+	if planPIndexes != nil {
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			for nodeUUID := range planPIndex.Nodes {
+				loads[nodeUUID]++
+			}
+		}
+	}
+	return loads
+}
+
+// applyMaxPIndexesPerNode moves the planPIndexes of an index off the
+// nodes that, across the plan so far, host more pindexes than their
+// caps.  The assignments that are new to the plan move first, then the
+// replicas, so that the nodes keep their existing pindexes where
+// possible.  A moved assignment goes to the least loaded of the nodes
+// with room that don't already have the planPIndex.  When there's no
+// such node, which is reported as a warning, a replica is dropped,
+// while a primary is kept, over the cap.
+func applyMaxPIndexesPerNode(indexDef *IndexDef,
+	planPIndexesForIndex map[string]*PlanPIndex,
+	planPIndexes, planPIndexesPrev *PlanPIndexes, nodeDefs *NodeDefs,
+	maxPIndexes map[string]int, nodeUUIDs []string) (warnings []string) {
+	if len(maxPIndexes) <= 0 {
+		return nil
+	}
+
+	loads := planPIndexesLoads(planPIndexes)
+
+	over := func(nodeUUID string) bool {
+		max, exists := maxPIndexes[nodeUUID]
+		return exists && loads[nodeUUID] > max
+	}
+
+	room := func(nodeUUID string) bool {
+		max, exists := maxPIndexes[nodeUUID]
+		return !exists || loads[nodeUUID] < max
+	}
+
+	isNew := func(planPIndexName, nodeUUID string) bool {
+		if planPIndexesPrev == nil {
+			return true
+		}
+		prev := planPIndexesPrev.PlanPIndexes[planPIndexName]
+		return prev == nil || prev.Nodes[nodeUUID] == nil
+	}
+
+	type assignment struct {
+		name     string
+		nodeUUID string
+		priority int
+		isNew    bool
+	}
+
+	var candidates []*assignment
+	for name, planPIndex := range planPIndexesForIndex {
+		for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+			if over(nodeUUID) {
+				candidates = append(candidates, &assignment{
+					name:     name,
+					nodeUUID: nodeUUID,
+					priority: planPIndexNode.Priority,
+					isNew:    isNew(name, nodeUUID),
+				})
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.isNew != b.isNew {
+			return a.isNew
+		}
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.nodeUUID < b.nodeUUID
+	})
+
+	for _, c := range candidates {
+		if !over(c.nodeUUID) {
+			continue // Earlier moves made enough room.
+		}
+
+		planPIndex := planPIndexesForIndex[c.name]
+
+		target := ""
+		for _, n := range nodeUUIDs {
+			nodeDef := nodeDefs.NodeDefs[n]
+			if nodeDef == nil || nodeDef.NoAccept ||
+				planPIndex.Nodes[n] != nil || !room(n) {
+				continue
+			}
+			if target == "" || loads[n] < loads[target] {
+				target = n
+			}
+		}
+
+		if target == "" {
+			if c.priority <= 0 {
+				warnings = append(warnings, fmt.Sprintf("planPIndex: %s,"+
+					" exceeds the max pindexes: %d, of node: %s,"+
+					" as no other node has room for it", c.name,
+					maxPIndexes[c.nodeUUID], c.nodeUUID))
+				continue
+			}
+
+			delete(planPIndex.Nodes, c.nodeUUID)
+			loads[c.nodeUUID]--
+
+			warnings = append(warnings, fmt.Sprintf("could not assign"+
+				" replica of planPIndex: %s, as node: %s is at its max"+
+				" pindexes: %d, and no other node has room for it",
+				c.name, c.nodeUUID, maxPIndexes[c.nodeUUID]))
+			continue
+		}
+
+		planPIndexNode := planPIndex.Nodes[c.nodeUUID]
+		delete(planPIndex.Nodes, c.nodeUUID)
+		loads[c.nodeUUID]--
+
+		canRead, canWrite := true, true
+		if npp := GetNodePlanParam(indexDef.PlanParams.NodePlanParams,
+			target, indexDef.Name, c.name); npp != nil {
+			canRead, canWrite = npp.CanRead, npp.CanWrite
+		}
+
+		planPIndex.Nodes[target] = &PlanPIndexNode{
+			CanRead:  canRead,
+			CanWrite: canWrite,
+			Priority: planPIndexNode.Priority,
+		}
+		loads[target]++
+	}
+
+	return warnings
+}
+
+// ---------------------------------------------------------
+
+// PIndexDensityAdvice compares the pindexes that a cluster wants to
+// host against the pindex caps of its nodes, and suggests the number
+// of nodes that's needed to host them all.
+type PIndexDensityAdvice struct {
+	Nodes int `json:"nodes"`
+
+	// Wanted are the pindexes, primaries plus wanted replicas, that
+	// the plan should assign.
+	Wanted int `json:"wanted"`
+
+	// Capacity is the sum of the nodes' caps, where -1 means that a
+	// node without a cap makes the capacity unlimited.
+	Capacity int `json:"capacity"`
+
+	// OverNodes are the nodes that host more pindexes than their caps,
+	// keyed by node UUID, with their number of pindexes.
+	OverNodes map[string]int `json:"overNodes,omitempty"`
+
+	// NodesNeeded is the suggested node count, where the added nodes
+	// have the cluster's "maxPIndexesPerNode" cap.
+	NodesNeeded int `json:"nodesNeeded"`
+
+	// Unsatisfiable is true when the nodes can't host the wanted
+	// pindexes, and more nodes are needed.
+	Unsatisfiable bool `json:"unsatisfiable"`
+}
+
+// CalcPIndexDensityAdvice returns the PIndexDensityAdvice of a plan,
+// for the wanted nodes and the "maxPIndexesPerNode" cluster option.
+// The indexDefs may be nil, where the planPIndexes' assignments are
+// then taken as wanted.
+func CalcPIndexDensityAdvice(indexDefs *IndexDefs, nodeDefs *NodeDefs,
+	planPIndexes *PlanPIndexes, options map[string]string) *PIndexDensityAdvice {
+	rv := &PIndexDensityAdvice{}
+
+	maxPIndexes := nodeMaxPIndexes(options, nodeDefs)
+	if nodeDefs != nil {
+		rv.Nodes = len(nodeDefs.NodeDefs)
+		for nodeUUID := range nodeDefs.NodeDefs {
+			max, exists := maxPIndexes[nodeUUID]
+			if !exists || rv.Capacity < 0 {
+				rv.Capacity = -1
+				continue
+			}
+			rv.Capacity += max
+		}
+	}
+
+	// The copies of a pindex need distinct nodes.
+	minNodes := 0
+
+	if planPIndexes != nil {
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			wanted := len(planPIndex.Nodes)
+			if indexDefs != nil {
+				if indexDef := indexDefs.IndexDefs[planPIndex.IndexName]; indexDef != nil {
+					wanted = 1 + indexDef.PlanParams.NumReplicas
+				}
+			}
+			rv.Wanted += wanted
+			if minNodes < wanted {
+				minNodes = wanted
+			}
+		}
+	}
+
+	for nodeUUID, load := range planPIndexesLoads(planPIndexes) {
+		if max, exists := maxPIndexes[nodeUUID]; exists && load > max {
+			if rv.OverNodes == nil {
+				rv.OverNodes = map[string]int{}
+			}
+			rv.OverNodes[nodeUUID] = load
+		}
+	}
+
+	rv.NodesNeeded = rv.Nodes
+	if rv.Capacity >= 0 && rv.Wanted > rv.Capacity {
+		clusterMax, _ := strconv.Atoi(options["maxPIndexesPerNode"])
+		if clusterMax > 0 {
+			rv.NodesNeeded += (rv.Wanted - rv.Capacity + clusterMax - 1) /
+				clusterMax
+		} else {
+			rv.NodesNeeded++ // An added node has no cap.
+		}
+	}
+	if rv.NodesNeeded < minNodes {
+		rv.NodesNeeded = minNodes
+	}
+
+	rv.Unsatisfiable = rv.NodesNeeded > rv.Nodes
+
+	return rv
+}
+
+// PIndexDensityAdvice returns the PIndexDensityAdvice of the cluster,
+// from the manager's cached Cfg data.
+func (mgr *Manager) PIndexDensityAdvice() (*PIndexDensityAdvice, error) {
+	indexDefs, _, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+	nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, false)
+	if err != nil {
+		return nil, err
+	}
+	planPIndexes, _, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, err
+	}
+	return CalcPIndexDensityAdvice(indexDefs, nodeDefs, planPIndexes,
+		mgr.Options()), nil
+}
+
+// nodeDefMaxPIndexes returns the node's "nodeMaxPIndexes" option.
+func (mgr *Manager) nodeDefMaxPIndexes() int {
+	v, err := strconv.Atoi(mgr.Options()["nodeMaxPIndexes"])
+	if err != nil || v < 0 {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,98 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestMaxPIndexesPerNode(t *testing.T) {
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["x"] = &IndexDef{Name: "x", UUID: "xx",
+		Type: "blackhole", SourceType: "primary",
+		SourceParams: `{"numPartitions":4}`,
+		PlanParams:   PlanParams{MaxPartitionsPerPIndex: 1, NumReplicas: 1}}
+
+	nodeDefs := NewNodeDefs(Version)
+	for _, nodeUUID := range []string{"a", "b", "c"} {
+		nodeDefs.NodeDefs[nodeUUID] = &NodeDef{UUID: nodeUUID,
+			ImplVersion: Version, HostPort: nodeUUID + ":1"}
+	}
+	nodeDefs.NodeDefs["a"].MaxPIndexes = 1
+
+	log := NewStdLibLog(ioutil.Discard, "", 0)
+
+	planPIndexes, err := CalcPlan(log, "", indexDefs, nodeDefs, nil,
+		Version, "", nil, nil)
+	if err != nil {
+		t.Fatalf("expected CalcPlan() to work, err: %v", err)
+	}
+
+	loads := planPIndexesLoads(planPIndexes)
+	if loads["a"] > 1 || loads["a"]+loads["b"]+loads["c"] != 8 {
+		t.Errorf("expected node a to be capped, got: %v", loads)
+	}
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		if len(planPIndex.Nodes) != 2 {
+			t.Errorf("expected 2 nodes for: %s, got: %+v", name, planPIndex.Nodes)
+		}
+	}
+	if len(planPIndexes.Warnings["x"]) != 0 {
+		t.Errorf("expected no warnings, got: %v", planPIndexes.Warnings)
+	}
+
+	advice := CalcPIndexDensityAdvice(indexDefs, nodeDefs, planPIndexes, nil)
+	if advice.Unsatisfiable || advice.Capacity != -1 ||
+		advice.Wanted != 8 || advice.NodesNeeded != 3 {
+		t.Errorf("expected satisfiable advice, got: %+v", advice)
+	}
+
+	// A cluster cap that can't host all the replicas.
+	options := map[string]string{"maxPIndexesPerNode": "2"}
+
+	planPIndexes, err = CalcPlan(log, "", indexDefs, nodeDefs, planPIndexes,
+		Version, "", options, nil)
+	if err != nil {
+		t.Fatalf("expected CalcPlan() to work, err: %v", err)
+	}
+
+	loads = planPIndexesLoads(planPIndexes)
+	if loads["a"] > 1 || loads["b"] > 2 || loads["c"] > 2 {
+		t.Errorf("expected capped nodes, got: %v", loads)
+	}
+	if len(planPIndexes.Warnings["x"]) == 0 {
+		t.Errorf("expected unsatisfiable warnings")
+	}
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		primaries := 0
+		for _, planPIndexNode := range planPIndex.Nodes {
+			if planPIndexNode.Priority <= 0 {
+				primaries++
+			}
+		}
+		if primaries != 1 {
+			t.Errorf("expected a primary for: %s, got: %+v", name,
+				planPIndex.Nodes)
+		}
+	}
+
+	advice = CalcPIndexDensityAdvice(indexDefs, nodeDefs, planPIndexes, options)
+	if !advice.Unsatisfiable || advice.Capacity != 5 ||
+		advice.Wanted != 8 || advice.NodesNeeded != 5 {
+		t.Errorf("expected unsatisfiable advice, got: %+v", advice)
+	}
+
+	if max := nodeMaxPIndexes(nil, nodeDefs); len(max) != 1 || max["a"] != 1 {
+		t.Errorf("expected only node a to be capped, got: %v", max)
+	}
+}
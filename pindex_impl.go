@@ -15,6 +15,8 @@ import (
 	"container/list"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 
 	"github.com/gorilla/mux"
 
@@ -60,6 +62,23 @@ type PIndexImplType struct {
 	OpenUsing func(indexType, path, indexParams string,
 		restart func()) (PIndexImpl, Dest, error)
 
+	// Optional, invoked by the manager after a pindex was opened or
+	// created, so that the implementation can warm its caches.  Until
+	// Warm() returns, the pindex is in a "warming" state and is only
+	// chosen by CoveringPIndexes() when no other node can serve it.
+	Warm func(mgr *Manager, pindex *PIndex) error
+
+	// Optional, invoked by the manager's CompactionLoop() when it's
+	// the pindex's turn to compact its storage, so that compactions
+	// are scheduled across the node's pindexes, in off-peak windows
+	// and outside of rebalances, instead of by each pindex on its own.
+	Compact func(mgr *Manager, pindex *PIndex) error
+
+	// Optional, invoked by the manager's ReplicaDivergenceLoop() for
+	// the count of documents of a single pindex, so that a replica's
+	// count can be compared with its primary's count.
+	CountPIndex func(mgr *Manager, pindex *PIndex) (uint64, error)
+
 	// Invoked by the manager when it wants a count of documents from
 	// an index.  The registered Count() function can be nil.
 	Count func(mgr *Manager, indexName, indexUUID string) (
@@ -115,6 +134,26 @@ type PIndexImplType struct {
 	// on the index.
 	SubmitTaskRequest func(mgr *Manager, indexName,
 		indexUUID string, req []byte) (*TaskRequestStatus, error)
+
+	// Optional, the behaviors that the pindex implementation supports
+	// beyond the required ones, which callers should consult instead
+	// of nil-checking the optional functions.
+	Capabilities PIndexImplCapabilities
+}
+
+// PIndexImplCapabilities are the optional behaviors of a pindex
+// implementation type, where the zero value means none.
+type PIndexImplCapabilities struct {
+	// The pindex's files may be copied, such as for a backup, while
+	// the pindex is open.
+	SupportsSnapshot bool `json:"supportsSnapshot"`
+
+	// The Dest can roll back a partition to a sequence number that's
+	// greater than zero, rather than only all the way back to zero.
+	SupportsRollbackPartial bool `json:"supportsRollbackPartial"`
+
+	// The Count() function is available.
+	SupportsCount bool `json:"supportsCount"`
 }
 
 // ConfigAnalyzeRequest wraps up the various configuration
@@ -136,21 +175,71 @@ const (
 )
 
 // PIndexImplTypes is a global registry of pindex type backends or
-// implementations.  It is keyed by indexType and should be treated as
-// immutable/read-only after process init/startup.
+// implementations.  It is keyed by indexType.  As index types may be
+// registered or unregistered after process init/startup, such as by
+// plugins, readers should use GetPIndexImplType() rather than access
+// the map directly.
 var PIndexImplTypes = make(map[string]*PIndexImplType)
 
-// RegisterPIndexImplType registers a index type into the system.
+// pindexImplTypesM protects the PIndexImplTypes.
+var pindexImplTypesM sync.RWMutex
+
+// RegisterPIndexImplType registers a index type into the system,
+// replacing any previous registration of the index type.  It's safe
+// to invoke concurrently with the manager.
 func RegisterPIndexImplType(indexType string, t *PIndexImplType) {
+	pindexImplTypesM.Lock()
 	PIndexImplTypes[indexType] = t
+	pindexImplTypesM.Unlock()
+}
+
+// UnregisterPIndexImplType removes an index type from the system.
+// The existing pindexes of the index type are unaffected, but the
+// janitor will be unable to open or create more of them.
+func UnregisterPIndexImplType(indexType string) {
+	pindexImplTypesM.Lock()
+	delete(PIndexImplTypes, indexType)
+	pindexImplTypesM.Unlock()
+}
+
+// GetPIndexImplType returns the registered PIndexImplType of an index
+// type, or nil.
+func GetPIndexImplType(indexType string) *PIndexImplType {
+	pindexImplTypesM.RLock()
+	t := PIndexImplTypes[indexType]
+	pindexImplTypesM.RUnlock()
+	return t
+}
+
+// PIndexImplTypeNames returns the sorted index types that are
+// registered.
+func PIndexImplTypeNames() []string {
+	pindexImplTypesM.RLock()
+	rv := make([]string, 0, len(PIndexImplTypes))
+	for indexType := range PIndexImplTypes {
+		rv = append(rv, indexType)
+	}
+	pindexImplTypesM.RUnlock()
+	sort.Strings(rv)
+	return rv
+}
+
+// GetPIndexImplCapabilities returns the capabilities of an index
+// type, where an unknown index type has none.
+func GetPIndexImplCapabilities(indexType string) PIndexImplCapabilities {
+	t := GetPIndexImplType(indexType)
+	if t == nil {
+		return PIndexImplCapabilities{}
+	}
+	return t.Capabilities
 }
 
 // NewPIndexImpl creates an index partition of the given, registered
 // index type.
 func NewPIndexImpl(indexType, indexParams, path string, restart func()) (
 	PIndexImpl, Dest, error) {
-	t, exists := PIndexImplTypes[indexType]
-	if !exists || t == nil || t.New == nil {
+	t := GetPIndexImplType(indexType)
+	if t == nil || t.New == nil {
 		return nil, nil,
 			fmt.Errorf("pindex_impl: NewPIndexImpl indexType: %s",
 				indexType)
@@ -163,8 +252,8 @@ func NewPIndexImpl(indexType, indexParams, path string, restart func()) (
 // index type from a given path.
 func OpenPIndexImpl(indexType, path string, restart func()) (
 	PIndexImpl, Dest, error) {
-	t, exists := PIndexImplTypes[indexType]
-	if !exists || t == nil || t.Open == nil {
+	t := GetPIndexImplType(indexType)
+	if t == nil || t.Open == nil {
 		return nil, nil, fmt.Errorf("pindex_impl: OpenPIndexImpl"+
 			" indexType: %s", indexType)
 	}
@@ -176,8 +265,8 @@ func OpenPIndexImpl(indexType, path string, restart func()) (
 // index type from a given path with the given indexParams.
 func OpenPIndexImplUsing(indexType, path, indexParams string,
 	restart func()) (PIndexImpl, Dest, error) {
-	t, exists := PIndexImplTypes[indexType]
-	if !exists || t == nil || t.OpenUsing == nil {
+	t := GetPIndexImplType(indexType)
+	if t == nil || t.OpenUsing == nil {
 		return nil, nil, fmt.Errorf("pindex_impl: OpenPIndexImplUsing"+
 			" indexType: %s", indexType)
 	}
@@ -210,7 +299,7 @@ func GetIndexDef(cfg Cfg, indexName string) (
 			" indexName: %s", indexName)
 	}
 
-	pindexImplType := PIndexImplTypes[indexDef.Type]
+	pindexImplType := GetPIndexImplType(indexDef.Type)
 	if pindexImplType == nil {
 		return nil, nil, fmt.Errorf("pindex_impl: no pindexImplType,"+
 			" indexName: %s, indexDef.Type: %s",
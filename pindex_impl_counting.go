@@ -0,0 +1,325 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+func init() {
+	RegisterPIndexImplType("counting", &PIndexImplType{
+		New:       NewCountingPIndexImpl,
+		Open:      OpenCountingPIndexImpl,
+		OpenUsing: OpenCountingPIndexImplUsing,
+
+		AnalyzeIndexDefUpdates: restartOnIndexDefChanges,
+
+		Description: "advanced/counting" +
+			" - a counting index counts the mutations per partition and" +
+			" verifies that their seqs increase, and is not queryable;" +
+			" used for rebalance and feed testing",
+		Capabilities: PIndexImplCapabilities{
+			SupportsRollbackPartial: true,
+		},
+	})
+}
+
+// The most seq violation messages that a Counting dest remembers.
+const countingMaxViolations = 100
+
+const countingFileName = "counting"
+
+func NewCountingPIndexImpl(indexType, indexParams,
+	path string, restart func()) (PIndexImpl, Dest, error) {
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(path, countingFileName),
+		EMPTY_BYTES, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dest := NewCounting()
+	return dest, dest, nil
+}
+
+func OpenCountingPIndexImpl(indexType, path string, restart func()) (
+	PIndexImpl, Dest, error) {
+	return OpenCountingPIndexImplUsing(indexType, path, "", restart)
+}
+
+func OpenCountingPIndexImplUsing(indexType, path, indexParams string,
+	restart func()) (PIndexImpl, Dest, error) {
+	_, err := os.Stat(filepath.Join(path, countingFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dest := NewCounting()
+	return dest, dest, nil
+}
+
+// ---------------------------------------------------------
+
+// Counting implements both Dest and PIndexImpl interfaces.  It keeps
+// only the counts, opaque and last seq of each partition, in memory,
+// and records a violation whenever a mutation's seq doesn't increase
+// past the partition's last seq or falls outside of the current
+// snapshot.  A rollback resets the partition's last seq.
+type Counting struct {
+	m          sync.Mutex // Protects the fields that follow.
+	partitions map[string]*countingPartition
+	violations []string
+	totViolate uint64
+}
+
+type countingPartition struct {
+	opaque    []byte
+	lastSeq   uint64
+	snapStart uint64
+	snapEnd   uint64
+	updates   uint64
+	deletes   uint64
+	rollbacks uint64
+	waiters   []*ConsistencyWaitReq
+}
+
+// NewCounting returns a ready Counting dest.
+func NewCounting() *Counting {
+	return &Counting{partitions: map[string]*countingPartition{}}
+}
+
+func (t *Counting) partitionLOCKED(partition string) *countingPartition {
+	p := t.partitions[partition]
+	if p == nil {
+		p = &countingPartition{}
+		t.partitions[partition] = p
+	}
+	return p
+}
+
+func (t *Counting) mutationLOCKED(partition string, seq uint64) {
+	p := t.partitionLOCKED(partition)
+
+	if seq <= p.lastSeq {
+		t.violateLOCKED(fmt.Sprintf("partition: %s, seq: %d,"+
+			" not after lastSeq: %d", partition, seq, p.lastSeq))
+	} else if p.snapEnd > 0 && (seq < p.snapStart || seq > p.snapEnd) {
+		t.violateLOCKED(fmt.Sprintf("partition: %s, seq: %d,"+
+			" outside snapshot: %d-%d", partition, seq,
+			p.snapStart, p.snapEnd))
+	}
+
+	if seq > p.lastSeq {
+		p.lastSeq = seq
+	}
+
+	waiters := p.waiters[:0]
+	for _, w := range p.waiters {
+		if w.ConsistencySeq <= p.lastSeq {
+			close(w.DoneCh)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	p.waiters = waiters
+}
+
+func (t *Counting) violateLOCKED(msg string) {
+	t.totViolate++
+	if len(t.violations) < countingMaxViolations {
+		t.violations = append(t.violations, msg)
+	}
+}
+
+// Violations returns the total number of seq violations and the
+// messages of the first ones.
+func (t *Counting) Violations() (uint64, []string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.totViolate, append([]string(nil), t.violations...)
+}
+
+func (t *Counting) Close() error {
+	t.m.Lock()
+	for _, p := range t.partitions {
+		for _, w := range p.waiters {
+			w.DoneCh <- fmt.Errorf("pindex_impl_counting: closed")
+			close(w.DoneCh)
+		}
+		p.waiters = nil
+	}
+	t.m.Unlock()
+	return nil
+}
+
+func (t *Counting) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	t.m.Lock()
+	t.partitionLOCKED(partition).updates++
+	t.mutationLOCKED(partition, seq)
+	t.m.Unlock()
+	return nil
+}
+
+func (t *Counting) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	t.m.Lock()
+	t.partitionLOCKED(partition).deletes++
+	t.mutationLOCKED(partition, seq)
+	t.m.Unlock()
+	return nil
+}
+
+func (t *Counting) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	t.m.Lock()
+	p := t.partitionLOCKED(partition)
+	if snapEnd < snapStart {
+		t.violateLOCKED(fmt.Sprintf("partition: %s,"+
+			" snapshot end before start: %d-%d",
+			partition, snapStart, snapEnd))
+	}
+	p.snapStart, p.snapEnd = snapStart, snapEnd
+	t.m.Unlock()
+	return nil
+}
+
+func (t *Counting) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	p := t.partitions[partition]
+	if p == nil {
+		return nil, 0, nil
+	}
+	return p.opaque, p.lastSeq, nil
+}
+
+func (t *Counting) OpaqueSet(partition string, value []byte) error {
+	t.m.Lock()
+	t.partitionLOCKED(partition).opaque = append([]byte(nil), value...)
+	t.m.Unlock()
+	return nil
+}
+
+func (t *Counting) Rollback(partition string, rollbackSeq uint64) error {
+	t.m.Lock()
+	p := t.partitionLOCKED(partition)
+	if rollbackSeq < p.lastSeq {
+		p.lastSeq = rollbackSeq
+	}
+	p.snapStart, p.snapEnd = 0, 0
+	p.rollbacks++
+	t.m.Unlock()
+	return nil
+}
+
+func (t *Counting) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	if consistencyLevel == "" {
+		return nil
+	}
+	if consistencyLevel != "at_plus" {
+		return fmt.Errorf("pindex_impl_counting: unsupported"+
+			" consistencyLevel: %s", consistencyLevel)
+	}
+
+	t.m.Lock()
+	p := t.partitionLOCKED(partition)
+	if p.lastSeq >= consistencySeq {
+		t.m.Unlock()
+		return nil
+	}
+	cwr := &ConsistencyWaitReq{
+		PartitionUUID:    partitionUUID,
+		ConsistencyLevel: consistencyLevel,
+		ConsistencySeq:   consistencySeq,
+		CancelCh:         cancelCh,
+		DoneCh:           make(chan error, 1),
+	}
+	p.waiters = append(p.waiters, cwr)
+	t.m.Unlock()
+
+	return ConsistencyWaitDone(partition, cancelCh, cwr.DoneCh,
+		func() uint64 {
+			t.m.Lock()
+			defer t.m.Unlock()
+			return p.lastSeq
+		})
+}
+
+// Count returns the number of mutations, updates and deletes, that
+// the dest has received.
+func (t *Counting) Count(pindex *PIndex,
+	cancelCh <-chan bool) (uint64, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	var rv uint64
+	for _, p := range t.partitions {
+		rv += p.updates + p.deletes
+	}
+	return rv, nil
+}
+
+func (t *Counting) Query(pindex *PIndex, req []byte, w io.Writer,
+	cancelCh <-chan bool) error {
+	return fmt.Errorf("pindex_impl_counting: not queryable")
+}
+
+// Stats writes the counts and last seq of each partition and the seq
+// violations.
+func (t *Counting) Stats(w io.Writer) error {
+	type partitionStats struct {
+		LastSeq   uint64 `json:"lastSeq"`
+		Updates   uint64 `json:"updates"`
+		Deletes   uint64 `json:"deletes"`
+		Rollbacks uint64 `json:"rollbacks"`
+	}
+
+	t.m.Lock()
+	stats := struct {
+		Partitions    map[string]partitionStats `json:"partitions"`
+		TotViolations uint64                    `json:"totViolations"`
+		Violations    []string                  `json:"violations"`
+	}{
+		Partitions:    map[string]partitionStats{},
+		TotViolations: t.totViolate,
+		Violations:    append([]string{}, t.violations...),
+	}
+	for partition, p := range t.partitions {
+		stats.Partitions[partition] = partitionStats{
+			LastSeq:   p.lastSeq,
+			Updates:   p.updates,
+			Deletes:   p.deletes,
+			Rollbacks: p.rollbacks,
+		}
+	}
+	t.m.Unlock()
+
+	return json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,99 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCountingSeqViolations(t *testing.T) {
+	c := NewCounting()
+
+	c.SnapshotStart("0", 1, 10)
+	c.DataUpdate("0", []byte("a"), 1, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	c.DataDelete("0", []byte("a"), 2, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if tot, _ := c.Violations(); tot != 0 {
+		t.Errorf("expected no violations, got: %d", tot)
+	}
+
+	c.DataUpdate("0", []byte("b"), 2, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	c.DataUpdate("0", []byte("c"), 11, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	tot, violations := c.Violations()
+	if tot != 2 || len(violations) != 2 {
+		t.Errorf("expected a repeated seq and an out of snapshot seq,"+
+			" got: %d, %v", tot, violations)
+	}
+
+	c.Rollback("0", 1)
+	c.DataUpdate("0", []byte("d"), 2, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if tot, _ = c.Violations(); tot != 2 {
+		t.Errorf("expected seqs after a rollback to be fine, got: %d", tot)
+	}
+
+	if count, _ := c.Count(nil, nil); count != 5 {
+		t.Errorf("expected 5 mutations, got: %d", count)
+	}
+
+	var b bytes.Buffer
+	if err := c.Stats(&b); err != nil || !json.Valid(b.Bytes()) {
+		t.Errorf("expected json stats, got: %s, err: %v", b.String(), err)
+	}
+}
+
+func TestLatencyPIndexImpl(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	for _, indexParams := range []string{
+		`not-json`,
+		`{"delays":{"notAnOp":"1ms"}}`,
+		`{"delays":{"dataUpdate":"-1ms"}}`,
+		`{"errorRates":{"dataUpdate":2}}`,
+	} {
+		if _, _, err := NewLatencyPIndexImpl("latency", indexParams,
+			emptyDir, nil); err == nil {
+			t.Errorf("expected err, indexParams: %s", indexParams)
+		}
+	}
+
+	_, _, err := NewLatencyPIndexImpl("latency",
+		`{"params":"{\"errorRates\":{\"dataUpdate\":1}}"}`, emptyDir, nil)
+	if err != nil {
+		t.Fatalf("expected NewLatencyPIndexImpl() to work, err: %v", err)
+	}
+
+	_, dest, err := OpenLatencyPIndexImpl("latency", emptyDir, nil)
+	if err != nil {
+		t.Fatalf("expected OpenLatencyPIndexImpl() to work, err: %v", err)
+	}
+	if err = dest.DataUpdate("0", []byte("a"), 1, nil, 0,
+		DEST_EXTRAS_TYPE_NIL, nil); err == nil {
+		t.Errorf("expected the reopened error rate to fail the update")
+	}
+	if err = dest.DataDelete("0", []byte("a"), 2, 0,
+		DEST_EXTRAS_TYPE_NIL, nil); err != nil {
+		t.Errorf("expected the delete to work, err: %v", err)
+	}
+
+	var b bytes.Buffer
+	dest.Stats(&b)
+	var stats map[string]map[string]uint64
+	if err = json.Unmarshal(b.Bytes(), &stats); err != nil ||
+		stats[LatencyOpDataUpdate]["errs"] != 1 ||
+		stats[LatencyOpDataDelete]["ops"] != 1 {
+		t.Errorf("unexpected stats: %s, err: %v", b.String(), err)
+	}
+}
@@ -0,0 +1,263 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterPIndexImplType("latency", &PIndexImplType{
+		New:       NewLatencyPIndexImpl,
+		Open:      OpenLatencyPIndexImpl,
+		OpenUsing: OpenLatencyPIndexImplUsing,
+
+		AnalyzeIndexDefUpdates: restartOnIndexDefChanges,
+
+		Description: "advanced/latency" +
+			" - a latency index ignores all data after simulated delays" +
+			" and errors, and is not queryable; used for load testing",
+		StartSample: &LatencyParams{
+			Delays:     map[string]string{LatencyOpDataUpdate: "1ms"},
+			ErrorRates: map[string]float64{LatencyOpDataUpdate: 0.001},
+		},
+	})
+}
+
+// The operations of a Latency dest whose delays and error rates can
+// be configured.
+const (
+	LatencyOpDataUpdate    = "dataUpdate"
+	LatencyOpDataDelete    = "dataDelete"
+	LatencyOpSnapshotStart = "snapshotStart"
+	LatencyOpOpaqueSet     = "opaqueSet"
+	LatencyOpRollback      = "rollback"
+	LatencyOpCount         = "count"
+	LatencyOpQuery         = "query"
+)
+
+var latencyOps = []string{LatencyOpDataUpdate, LatencyOpDataDelete,
+	LatencyOpSnapshotStart, LatencyOpOpaqueSet, LatencyOpRollback,
+	LatencyOpCount, LatencyOpQuery}
+
+// LatencyParams are the indexParams of a "latency" index.
+type LatencyParams struct {
+	// Delays are durations, such as "2ms", keyed by operation.
+	Delays map[string]string `json:"delays"`
+
+	// ErrorRates are the fractions, from 0 to 1, of the invocations
+	// of an operation that fail, keyed by operation.
+	ErrorRates map[string]float64 `json:"errorRates"`
+}
+
+const latencyParamsFileName = "latency.json"
+
+func NewLatencyPIndexImpl(indexType, indexParams,
+	path string, restart func()) (PIndexImpl, Dest, error) {
+	// The manager wraps the indexParams in IndexPrepParams.
+	var prepParams IndexPrepParams
+	if json.Unmarshal([]byte(indexParams), &prepParams) == nil &&
+		prepParams.Params != "" {
+		indexParams = prepParams.Params
+	}
+
+	return OpenLatencyPIndexImplUsing(indexType, path, indexParams, restart)
+}
+
+func OpenLatencyPIndexImpl(indexType, path string, restart func()) (
+	PIndexImpl, Dest, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(path, latencyParamsFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dest, err := newLatency(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dest, dest, nil
+}
+
+func OpenLatencyPIndexImplUsing(indexType, path, indexParams string,
+	restart func()) (PIndexImpl, Dest, error) {
+	if indexParams == "" {
+		indexParams = "{}"
+	}
+
+	dest, err := newLatency([]byte(indexParams))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(path, latencyParamsFileName),
+		[]byte(indexParams), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dest, dest, nil
+}
+
+// ---------------------------------------------------------
+
+// Latency implements both Dest and PIndexImpl interfaces.  Like a
+// BlackHole, it ignores all data, but only after sleeping for the
+// configured delay of each operation, and it fails a configured
+// fraction of the operations, so that feeds, rebalance and
+// throughput can be exercised against a slow or unreliable index.
+type Latency struct {
+	delays     map[string]time.Duration
+	errorRates map[string]float64
+
+	ops  map[string]*uint64 // Invocations, keyed by operation.
+	errs map[string]*uint64 // Simulated errors, keyed by operation.
+}
+
+func newLatency(indexParams []byte) (*Latency, error) {
+	var params LatencyParams
+	err := json.Unmarshal(indexParams, &params)
+	if err != nil {
+		return nil, fmt.Errorf("pindex_impl_latency: parse indexParams,"+
+			" err: %v", err)
+	}
+
+	t := &Latency{
+		delays:     map[string]time.Duration{},
+		errorRates: map[string]float64{},
+		ops:        map[string]*uint64{},
+		errs:       map[string]*uint64{},
+	}
+	for _, op := range latencyOps {
+		t.ops[op] = new(uint64)
+		t.errs[op] = new(uint64)
+	}
+
+	for op, v := range params.Delays {
+		if t.ops[op] == nil {
+			return nil, fmt.Errorf("pindex_impl_latency: unknown op: %s", op)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("pindex_impl_latency: invalid delay,"+
+				" op: %s, delay: %q", op, v)
+		}
+		t.delays[op] = d
+	}
+
+	for op, rate := range params.ErrorRates {
+		if t.ops[op] == nil {
+			return nil, fmt.Errorf("pindex_impl_latency: unknown op: %s", op)
+		}
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("pindex_impl_latency: invalid error rate,"+
+				" op: %s, rate: %v", op, rate)
+		}
+		t.errorRates[op] = rate
+	}
+
+	return t, nil
+}
+
+// simulate sleeps for the op's delay and then returns a simulated
+// error for the op's error rate of invocations.
+func (t *Latency) simulate(op string) error {
+	atomic.AddUint64(t.ops[op], 1)
+
+	if d := t.delays[op]; d > 0 {
+		time.Sleep(d)
+	}
+
+	if rate := t.errorRates[op]; rate > 0 && rand.Float64() < rate {
+		atomic.AddUint64(t.errs[op], 1)
+		return fmt.Errorf("pindex_impl_latency: simulated error, op: %s", op)
+	}
+
+	return nil
+}
+
+func (t *Latency) Close() error {
+	return nil
+}
+
+func (t *Latency) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return t.simulate(LatencyOpDataUpdate)
+}
+
+func (t *Latency) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return t.simulate(LatencyOpDataDelete)
+}
+
+func (t *Latency) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	return t.simulate(LatencyOpSnapshotStart)
+}
+
+func (t *Latency) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	return nil, 0, nil
+}
+
+func (t *Latency) OpaqueSet(partition string, value []byte) error {
+	return t.simulate(LatencyOpOpaqueSet)
+}
+
+func (t *Latency) Rollback(partition string, rollbackSeq uint64) error {
+	return t.simulate(LatencyOpRollback)
+}
+
+func (t *Latency) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	return nil
+}
+
+func (t *Latency) Count(pindex *PIndex,
+	cancelCh <-chan bool) (uint64, error) {
+	return 0, t.simulate(LatencyOpCount)
+}
+
+func (t *Latency) Query(pindex *PIndex, req []byte, w io.Writer,
+	cancelCh <-chan bool) error {
+	return t.simulate(LatencyOpQuery)
+}
+
+// Stats writes the invocations and simulated errors per operation.
+func (t *Latency) Stats(w io.Writer) error {
+	stats := map[string]map[string]uint64{}
+	for _, op := range latencyOps {
+		stats[op] = map[string]uint64{
+			"ops":  atomic.LoadUint64(t.ops[op]),
+			"errs": atomic.LoadUint64(t.errs[op]),
+		}
+	}
+	return json.NewEncoder(w).Encode(stats)
+}
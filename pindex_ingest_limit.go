@@ -0,0 +1,354 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An IngestLimit bounds the rate at which the feeds of an index send
+// mutations to the index's pindexes on a node, so that a bulk-loading
+// index can't starve the other indexes of the node.  A rate that's <=
+// 0 is unlimited.  A limit allows a burst of up to a second's worth
+// of mutations.  An IngestLimit is configured by an index's
+// PlanParams.IngestLimit, or else by the "ingestLimit" field of its
+// sourceParams, and may be adjusted at runtime per node by
+// Manager.SetIngestLimit().
+type IngestLimit struct {
+	DocsPerSec  float64 `json:"docsPerSec,omitempty"`
+	BytesPerSec float64 `json:"bytesPerSec,omitempty"`
+}
+
+func (l *IngestLimit) limited() bool {
+	return l != nil && (l.DocsPerSec > 0 || l.BytesPerSec > 0)
+}
+
+// IngestLimitStatus is the ingest limit of an index on a node.
+type IngestLimitStatus struct {
+	Limit      *IngestLimit `json:"limit"`      // The effective limit, or nil.
+	Configured *IngestLimit `json:"configured"` // From the index definition.
+	Override   *IngestLimit `json:"override"`   // From SetIngestLimit().
+
+	TotThrottled   uint64 `json:"totThrottled"` // Mutations that were delayed.
+	TotThrottledMS uint64 `json:"totThrottledMS"`
+}
+
+// ingestLimitBurst is how much unused rate a limiter accumulates.
+const ingestLimitBurst = time.Second
+
+// An ingestLimiter is shared by the pindexes of an index on a node.
+// It's a virtual scheduler, where each mutation reserves the time
+// that it costs at the limit, and waits when the reservations are
+// ahead of the clock.
+type ingestLimiter struct {
+	enabled int32 // Accessed atomically, for a fast unlimited path.
+
+	totThrottled   uint64 // Accessed atomically.
+	totThrottledNS uint64 // Accessed atomically.
+
+	m          sync.Mutex // Protects the fields that follow.
+	configured *IngestLimit
+	override   *IngestLimit
+	limit      *IngestLimit
+	docsNext   time.Time
+	bytesNext  time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newIngestLimiter() *ingestLimiter {
+	return &ingestLimiter{now: time.Now, sleep: time.Sleep}
+}
+
+// setLOCKED recomputes the effective limit.
+func (l *ingestLimiter) setLOCKED() {
+	l.limit = l.configured
+	if l.override != nil {
+		l.limit = l.override
+	}
+	if !l.limit.limited() {
+		l.limit = nil
+		atomic.StoreInt32(&l.enabled, 0)
+		return
+	}
+	atomic.StoreInt32(&l.enabled, 1)
+}
+
+// wait blocks until a mutation of a size fits within the limit.
+func (l *ingestLimiter) wait(size int) {
+	if atomic.LoadInt32(&l.enabled) == 0 {
+		return
+	}
+
+	l.m.Lock()
+	var delay time.Duration
+	if l.limit != nil {
+		now := l.now()
+		if l.limit.DocsPerSec > 0 {
+			delay = ingestLimitReserve(&l.docsNext, now,
+				1/l.limit.DocsPerSec)
+		}
+		if l.limit.BytesPerSec > 0 {
+			d := ingestLimitReserve(&l.bytesNext, now,
+				float64(size)/l.limit.BytesPerSec)
+			if delay < d {
+				delay = d
+			}
+		}
+	}
+	l.m.Unlock()
+
+	if delay > 0 {
+		atomic.AddUint64(&l.totThrottled, 1)
+		atomic.AddUint64(&l.totThrottledNS, uint64(delay))
+		l.sleep(delay)
+	}
+}
+
+// ingestLimitReserve reserves a cost, in seconds, after the next
+// reservation time, and returns how long to wait for the reservation.
+func ingestLimitReserve(next *time.Time, now time.Time,
+	cost float64) time.Duration {
+	if next.Before(now.Add(-ingestLimitBurst)) {
+		*next = now.Add(-ingestLimitBurst)
+	}
+	*next = next.Add(time.Duration(cost * float64(time.Second)))
+	if next.After(now) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// ---------------------------------------------------------
+
+// configuredIngestLimit returns the IngestLimit of an index
+// definition's planParams, or else of its sourceParams, if any.
+func configuredIngestLimit(planParams *PlanParams,
+	sourceParams string) *IngestLimit {
+	if planParams != nil && planParams.IngestLimit != nil {
+		return planParams.IngestLimit
+	}
+	if sourceParams == "" {
+		return nil
+	}
+	var sp struct {
+		IngestLimit *IngestLimit `json:"ingestLimit"`
+	}
+	if json.Unmarshal([]byte(sourceParams), &sp) != nil {
+		return nil
+	}
+	return sp.IngestLimit
+}
+
+// ingestLimiterLOCKED returns the limiter of an index, creating it as
+// needed.
+func (mgr *Manager) ingestLimiterLOCKED(indexName string) *ingestLimiter {
+	if mgr.ingestLimiters == nil {
+		mgr.ingestLimiters = map[string]*ingestLimiter{}
+	}
+	l := mgr.ingestLimiters[indexName]
+	if l == nil {
+		l = newIngestLimiter()
+		mgr.ingestLimiters[indexName] = l
+	}
+	return l
+}
+
+// refreshIngestLimits applies the configured limits of the index
+// definitions, and forgets the limiters of the deleted indexes.
+func (mgr *Manager) refreshIngestLimits(indexDefsByName map[string]*IndexDef) {
+	mgr.ingestLimitsMutex.Lock()
+	defer mgr.ingestLimitsMutex.Unlock()
+
+	for indexName, l := range mgr.ingestLimiters {
+		indexDef := indexDefsByName[indexName]
+		if indexDef == nil {
+			delete(mgr.ingestLimiters, indexName)
+			continue
+		}
+
+		l.m.Lock()
+		l.configured = configuredIngestLimit(&indexDef.PlanParams,
+			indexDef.SourceParams)
+		l.setLOCKED()
+		l.m.Unlock()
+	}
+}
+
+// SetIngestLimit overrides the ingest limit of an index on this node
+// at runtime, such as from a REST handler, taking effect right away
+// for the running feeds.  A nil limit removes the override, reverting
+// to the configured limit, and a zero limit means unlimited.  The
+// override isn't persisted.
+func (mgr *Manager) SetIngestLimit(indexName string, limit *IngestLimit) {
+	mgr.ingestLimitsMutex.Lock()
+	l := mgr.ingestLimiterLOCKED(indexName)
+	mgr.ingestLimitsMutex.Unlock()
+
+	if limit != nil {
+		c := *limit
+		limit = &c
+	}
+
+	l.m.Lock()
+	l.override = limit
+	l.setLOCKED()
+	l.m.Unlock()
+
+	mgr.log.Printf("pindex_ingest_limit: set, indexName: %s, limit: %+v",
+		indexName, limit)
+}
+
+// IngestLimitStatus returns the ingest limit of an index on this
+// node, or nil if the index has no feeds or override on this node.
+func (mgr *Manager) IngestLimitStatus(indexName string) *IngestLimitStatus {
+	mgr.ingestLimitsMutex.Lock()
+	l := mgr.ingestLimiters[indexName]
+	mgr.ingestLimitsMutex.Unlock()
+
+	if l == nil {
+		return nil
+	}
+
+	l.m.Lock()
+	rv := &IngestLimitStatus{
+		Limit:      l.limit,
+		Configured: l.configured,
+		Override:   l.override,
+	}
+	l.m.Unlock()
+
+	rv.TotThrottled = atomic.LoadUint64(&l.totThrottled)
+	rv.TotThrottledMS = atomic.LoadUint64(&l.totThrottledNS) /
+		uint64(time.Millisecond)
+
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// ingestLimitDest wraps a pindex's Dest to enforce its index's
+// ingest limit, and the pause of the feeds by the node's memory quota.
+type ingestLimitDest struct {
+	Dest
+	l   *ingestLimiter
+	mgr *Manager
+}
+
+// ingestLimitDestEx is an ingestLimitDest for a Dest that's also a
+// DestEx.
+type ingestLimitDestEx struct {
+	*ingestLimitDest
+	destEx DestEx
+}
+
+// unwrapIngestLimitDest returns the Dest that was wrapped by an
+// ingestLimitDest, if any.
+func unwrapIngestLimitDest(dest Dest) Dest {
+	switch d := dest.(type) {
+	case *ingestLimitDest:
+		return d.Dest
+	case *ingestLimitDestEx:
+		return d.ingestLimitDest.Dest
+	}
+	return dest
+}
+
+// wrapIngestLimitDest returns the Dest to hand to a feed for the
+// pindex, which enforces the ingest limit of the pindex's index,
+// including a limit that's set after the feed started.
+func (mgr *Manager) wrapIngestLimitDest(pindex *PIndex, dest Dest) Dest {
+	if dest == nil {
+		return dest
+	}
+
+	var configured *IngestLimit
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err == nil && indexDefsByName[pindex.IndexName] != nil {
+		indexDef := indexDefsByName[pindex.IndexName]
+		configured = configuredIngestLimit(&indexDef.PlanParams,
+			indexDef.SourceParams)
+	} else {
+		configured = configuredIngestLimit(nil, pindex.SourceParams)
+	}
+
+	mgr.ingestLimitsMutex.Lock()
+	l := mgr.ingestLimiterLOCKED(pindex.IndexName)
+	mgr.ingestLimitsMutex.Unlock()
+
+	l.m.Lock()
+	l.configured = configured
+	l.setLOCKED()
+	l.m.Unlock()
+
+	d := &ingestLimitDest{Dest: dest, l: l, mgr: mgr}
+
+	if destEx, ok := dest.(DestEx); ok {
+		return &ingestLimitDestEx{ingestLimitDest: d, destEx: destEx}
+	}
+
+	return d
+}
+
+func (d *ingestLimitDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.mgr.memoryPauseWait()
+	d.l.wait(len(key) + len(val))
+	return d.Dest.DataUpdate(partition, key, seq, val, cas,
+		extrasType, extras)
+}
+
+func (d *ingestLimitDest) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.mgr.memoryPauseWait()
+	d.l.wait(len(key))
+	return d.Dest.DataDelete(partition, key, seq, cas,
+		extrasType, extras)
+}
+
+func (d *ingestLimitDest) CheckpointPropose(partition string, seq uint64,
+	ack func(err error)) error {
+	return DestCheckpointPropose(d.Dest, partition, seq, ack)
+}
+
+func (d *ingestLimitDestEx) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	d.mgr.memoryPauseWait()
+	d.l.wait(len(key) + len(val))
+	return d.destEx.DataUpdateEx(partition, key, seq, val, cas,
+		extrasType, req)
+}
+
+func (d *ingestLimitDestEx) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	d.mgr.memoryPauseWait()
+	d.l.wait(len(key))
+	return d.destEx.DataDeleteEx(partition, key, seq, cas,
+		extrasType, req)
+}
+
+func (d *ingestLimitDestEx) RollbackEx(partition string,
+	partitionUUID uint64, rollbackSeq uint64) error {
+	return d.destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+}
@@ -0,0 +1,142 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIngestLimiter(t *testing.T) {
+	now := time.Now()
+	var sleeps []time.Duration
+
+	l := newIngestLimiter()
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	l.wait(100)
+	if len(sleeps) != 0 {
+		t.Errorf("expected no limit, got: %v", sleeps)
+	}
+
+	l.configured = &IngestLimit{DocsPerSec: 10}
+	l.setLOCKED()
+
+	// A second's worth of docs is a burst.
+	for i := 0; i < 10; i++ {
+		l.wait(100)
+	}
+	if len(sleeps) != 0 {
+		t.Errorf("expected a burst without waits, got: %v", sleeps)
+	}
+	l.wait(100)
+	if !reflect.DeepEqual(sleeps, []time.Duration{100 * time.Millisecond}) {
+		t.Errorf("expected a wait for the 11th doc, got: %v", sleeps)
+	}
+
+	// The rate recovers over time, up to the burst.
+	now = now.Add(time.Hour)
+	sleeps = nil
+	l.override = &IngestLimit{BytesPerSec: 1000}
+	l.setLOCKED()
+
+	l.wait(1000)
+	l.wait(500)
+	if !reflect.DeepEqual(sleeps, []time.Duration{500 * time.Millisecond}) {
+		t.Errorf("expected a wait for the bytes, got: %v", sleeps)
+	}
+
+	// A zero override means unlimited.
+	sleeps = nil
+	l.override = &IngestLimit{}
+	l.setLOCKED()
+	for i := 0; i < 100; i++ {
+		l.wait(1000)
+	}
+	if len(sleeps) != 0 || l.limit != nil {
+		t.Errorf("expected no limit, got: %v, %+v", sleeps, l.limit)
+	}
+}
+
+func TestIngestLimitManager(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "", nil, nil)
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["a"] = &IndexDef{
+		Name:       "a",
+		PlanParams: PlanParams{IngestLimit: &IngestLimit{DocsPerSec: 5}},
+	}
+	indexDefs.IndexDefs["b"] = &IndexDef{
+		Name:         "b",
+		SourceParams: `{"ingestLimit":{"bytesPerSec":100}}`,
+	}
+	_, err := CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	if mgr.IngestLimitStatus("a") != nil {
+		t.Errorf("expected no status before a feed")
+	}
+
+	destA := mgr.wrapIngestLimitDest(&PIndex{IndexName: "a"}, &TestDest{})
+	if unwrapIngestLimitDest(destA) == destA {
+		t.Errorf("expected an ingestLimitDest")
+	}
+	mgr.wrapIngestLimitDest(&PIndex{IndexName: "b"}, &TestDest{})
+
+	if s := mgr.IngestLimitStatus("a"); s == nil ||
+		!reflect.DeepEqual(s.Limit, &IngestLimit{DocsPerSec: 5}) {
+		t.Errorf("expected the planParams limit, got: %+v", s)
+	}
+	if s := mgr.IngestLimitStatus("b"); s == nil ||
+		!reflect.DeepEqual(s.Limit, &IngestLimit{BytesPerSec: 100}) {
+		t.Errorf("expected the sourceParams limit, got: %+v", s)
+	}
+
+	mgr.SetIngestLimit("a", &IngestLimit{DocsPerSec: 50})
+	if s := mgr.IngestLimitStatus("a"); !reflect.DeepEqual(s.Limit,
+		&IngestLimit{DocsPerSec: 50}) {
+		t.Errorf("expected the override, got: %+v", s)
+	}
+
+	mgr.SetIngestLimit("a", nil)
+	if s := mgr.IngestLimitStatus("a"); !reflect.DeepEqual(s.Limit,
+		&IngestLimit{DocsPerSec: 5}) || s.Override != nil {
+		t.Errorf("expected the configured limit again, got: %+v", s)
+	}
+
+	// The index definition changes are applied to the running feeds.
+	indexDefs.IndexDefs["a"].PlanParams.IngestLimit = nil
+	delete(indexDefs.IndexDefs, "b")
+	_, err = CfgSetIndexDefs(cfg, indexDefs, CFG_CAS_FORCE)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	mgr.GetIndexDefs(true)
+
+	if s := mgr.IngestLimitStatus("a"); s == nil || s.Limit != nil {
+		t.Errorf("expected no limit, got: %+v", s)
+	}
+	if s := mgr.IngestLimitStatus("b"); s != nil {
+		t.Errorf("expected the deleted index to be forgotten, got: %+v", s)
+	}
+}
@@ -0,0 +1,322 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PIndexMemoryReporter is an optional interface of a PIndexImpl or of
+// a pindex's Dest, which reports the bytes of memory that the pindex
+// uses, so that a node can enforce its "ftsMemoryQuota".
+type PIndexMemoryReporter interface {
+	MemoryUsed() uint64
+}
+
+// DEFAULT_MEMORY_QUOTA_CHECK_INTERVAL is how often the memory used by
+// the pindexes of a node is checked against the node's quota, which
+// may be overridden by the "memoryQuotaCheckInterval" manager option,
+// such as "1s".
+const DEFAULT_MEMORY_QUOTA_CHECK_INTERVAL = 10 * time.Second
+
+// DEFAULT_MEMORY_QUOTA_RESUME_PERCENT is the percentage of the quota
+// that the memory used must fall to before a node that exceeded its
+// quota recovers, which may be overridden by the
+// "memoryQuotaResumePercent" manager option.
+const DEFAULT_MEMORY_QUOTA_RESUME_PERCENT = 90
+
+// The actions of a node that exceeded its memory quota, as listed by
+// the comma-separated "memoryQuotaActions" manager option, which
+// defaults to MEMORY_QUOTA_ACTION_ALERT.
+const (
+	// Feeds block their mutations until the node recovers.
+	MEMORY_QUOTA_ACTION_PAUSE = "pause"
+
+	// The node's NodeDef weight is reduced to the "memoryQuotaWeight"
+	// manager option, by default 1, so that the planner assigns new
+	// pindexes to other nodes instead.  The reduction only has an
+	// effect when the node is registered with a weight that's higher
+	// than the reduced weight.
+	MEMORY_QUOTA_ACTION_WEIGHT = "weight"
+
+	// An event, warning and stat is reported.
+	MEMORY_QUOTA_ACTION_ALERT = "alert"
+)
+
+// MemoryQuotaStatus is the memory used by the pindexes of a node
+// against the node's quota, as of the last check.
+type MemoryQuotaStatus struct {
+	Quota    uint64            `json:"quota"` // In bytes, 0 is unlimited.
+	Used     uint64            `json:"used"`
+	PIndexes map[string]uint64 `json:"pindexes"` // Keyed by pindex name.
+	Exceeded bool              `json:"exceeded"`
+	Since    string            `json:"since,omitempty"` // When exceeded.
+	Actions  []string          `json:"actions,omitempty"`
+	Paused   bool              `json:"paused"`
+	Weight   int               `json:"weight"` // Of the NodeDef.
+}
+
+// memoryQuotaOptions parses the manager options of the memory quota.
+func memoryQuotaOptions(options map[string]string) (quota uint64,
+	actions map[string]bool, resumePercent uint64, weight int) {
+	quota, _ = strconv.ParseUint(options["ftsMemoryQuota"], 10, 64)
+
+	actions = map[string]bool{}
+	for _, a := range strings.Split(options["memoryQuotaActions"], ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			actions[a] = true
+		}
+	}
+	if len(actions) <= 0 {
+		actions[MEMORY_QUOTA_ACTION_ALERT] = true
+	}
+
+	resumePercent = DEFAULT_MEMORY_QUOTA_RESUME_PERCENT
+	if v, err := strconv.ParseUint(options["memoryQuotaResumePercent"],
+		10, 64); err == nil && v <= 100 {
+		resumePercent = v
+	}
+
+	weight = 1
+	if v, err := strconv.Atoi(options["memoryQuotaWeight"]); err == nil && v > 0 {
+		weight = v
+	}
+
+	return quota, actions, resumePercent, weight
+}
+
+// memoryUsed returns the memory reported by the local pindexes.
+func (mgr *Manager) memoryUsed() (uint64, map[string]uint64) {
+	_, pindexes := mgr.CurrentMaps()
+
+	var used uint64
+	rv := map[string]uint64{}
+
+	for name, pindex := range pindexes {
+		r, ok := pindex.Impl.(PIndexMemoryReporter)
+		if !ok {
+			r, ok = pindex.Dest.(PIndexMemoryReporter)
+		}
+		if ok {
+			n := r.MemoryUsed()
+			rv[name] = n
+			used += n
+		}
+	}
+
+	return used, rv
+}
+
+// MemoryQuotaLoop periodically checks the memory used by the local
+// pindexes against the node's "ftsMemoryQuota" manager option, in
+// bytes, and applies the "memoryQuotaActions" while the quota is
+// exceeded.
+func (mgr *Manager) MemoryQuotaLoop() {
+	interval := DEFAULT_MEMORY_QUOTA_CHECK_INTERVAL
+	if v, err := time.ParseDuration(
+		mgr.Options()["memoryQuotaCheckInterval"]); err == nil && v > 0 {
+		interval = v
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+			mgr.checkMemoryQuotaOnce()
+		}
+	}
+}
+
+// checkMemoryQuotaOnce checks the memory used against the quota and
+// applies or lifts the actions.  A node that exceeded its quota
+// recovers once its memory used falls to the resume percentage of
+// the quota, so that the actions don't flap around the quota.
+func (mgr *Manager) checkMemoryQuotaOnce() {
+	atomic.AddUint64(&mgr.stats.TotMemoryQuotaCheck, 1)
+
+	quota, actions, resumePercent, weight := memoryQuotaOptions(mgr.Options())
+
+	used, byPIndex := mgr.memoryUsed()
+
+	mgr.memoryMutex.Lock()
+
+	wasExceeded := mgr.memoryExceeded
+
+	exceeded := wasExceeded
+	if quota <= 0 {
+		exceeded = false
+	} else if used > quota {
+		exceeded = true
+	} else if float64(used) <= float64(quota)*float64(resumePercent)/100 {
+		exceeded = false
+	}
+
+	now := Now()
+	if exceeded && !wasExceeded {
+		mgr.memorySince = now
+	}
+
+	mgr.memoryQuota = quota
+	mgr.memoryUsedLast = used
+	mgr.memoryPIndexes = byPIndex
+	mgr.memoryExceeded = exceeded
+	mgr.memoryActions = actions
+
+	// Pause or resume the feeds.
+	if exceeded && actions[MEMORY_QUOTA_ACTION_PAUSE] {
+		if mgr.memoryResumeCh == nil {
+			mgr.memoryResumeCh = make(chan struct{})
+			atomic.StoreInt32(&mgr.memoryPaused, 1)
+		}
+	} else if mgr.memoryResumeCh != nil {
+		atomic.StoreInt32(&mgr.memoryPaused, 0)
+		close(mgr.memoryResumeCh)
+		mgr.memoryResumeCh = nil
+	}
+
+	// Reduce or restore the NodeDef weight.
+	weightPrev := mgr.memoryWeight
+	if exceeded && actions[MEMORY_QUOTA_ACTION_WEIGHT] &&
+		weight < mgr.weight {
+		mgr.memoryWeight = weight
+	} else {
+		mgr.memoryWeight = 0
+	}
+	weightChanged := weightPrev != mgr.memoryWeight
+
+	mgr.memoryMutex.Unlock()
+
+	if weightChanged {
+		mgr.saveNodeDefsRegistered()
+	}
+
+	if exceeded == wasExceeded {
+		return
+	}
+
+	event := "memoryQuotaRecovered"
+	if exceeded {
+		event = "memoryQuotaExceeded"
+		atomic.AddUint64(&mgr.stats.TotMemoryQuotaExceeded, 1)
+		mgr.log.Warnf("pindex_memory: quota exceeded, quota: %d, used: %d",
+			quota, used)
+	} else {
+		atomic.AddUint64(&mgr.stats.TotMemoryQuotaRecovered, 1)
+		mgr.log.Printf("pindex_memory: quota recovered, quota: %d, used: %d",
+			quota, used)
+	}
+
+	if actions[MEMORY_QUOTA_ACTION_ALERT] {
+		eventBytes, _ := json.Marshal(struct {
+			Event string `json:"event"`
+			Quota uint64 `json:"quota"`
+			Used  uint64 `json:"used"`
+			Time  string `json:"time"`
+		}{event, quota, used, now.Format(time.RFC3339Nano)})
+		mgr.AddEvent(eventBytes)
+	}
+}
+
+// saveNodeDefsRegistered saves the NodeDef of this node into the
+// kinds of NodeDefs that it's already registered in, such as after
+// its weight changed.
+func (mgr *Manager) saveNodeDefsRegistered() {
+	if mgr.cfg == nil {
+		return
+	}
+
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, kind)
+		if err != nil || nodeDefs == nil || nodeDefs.NodeDefs[mgr.uuid] == nil {
+			continue
+		}
+		err = mgr.SaveNodeDef(kind, false)
+		if err != nil {
+			mgr.log.Warnf("pindex_memory: SaveNodeDef, kind: %s, err: %v",
+				kind, err)
+		}
+	}
+}
+
+// nodeDefWeight returns the weight of this node's NodeDef, which is
+// reduced while the node exceeds its memory quota.
+func (mgr *Manager) nodeDefWeight() int {
+	mgr.memoryMutex.Lock()
+	defer mgr.memoryMutex.Unlock()
+	if mgr.memoryWeight > 0 {
+		return mgr.memoryWeight
+	}
+	return mgr.weight
+}
+
+// memoryPauseWait blocks a feed's mutation while the node's feeds are
+// paused by the memory quota, or until the manager stops.
+func (mgr *Manager) memoryPauseWait() {
+	if atomic.LoadInt32(&mgr.memoryPaused) == 0 {
+		return
+	}
+
+	mgr.memoryMutex.Lock()
+	resumeCh := mgr.memoryResumeCh
+	mgr.memoryMutex.Unlock()
+
+	if resumeCh == nil {
+		return
+	}
+
+	atomic.AddUint64(&mgr.stats.TotMemoryQuotaPauseWait, 1)
+
+	select {
+	case <-resumeCh:
+	case <-mgr.stopCh:
+	}
+}
+
+// MemoryQuotaStatus returns the memory used by the local pindexes
+// against the node's quota, as of the last check.
+func (mgr *Manager) MemoryQuotaStatus() *MemoryQuotaStatus {
+	mgr.memoryMutex.Lock()
+	defer mgr.memoryMutex.Unlock()
+
+	rv := &MemoryQuotaStatus{
+		Quota:    mgr.memoryQuota,
+		Used:     mgr.memoryUsedLast,
+		PIndexes: map[string]uint64{},
+		Exceeded: mgr.memoryExceeded,
+		Paused:   mgr.memoryResumeCh != nil,
+		Weight:   mgr.weight,
+	}
+	for name, n := range mgr.memoryPIndexes {
+		rv.PIndexes[name] = n
+	}
+	if mgr.memoryExceeded {
+		rv.Since = mgr.memorySince.Format(time.RFC3339Nano)
+		for a := range mgr.memoryActions {
+			rv.Actions = append(rv.Actions, a)
+		}
+		sort.Strings(rv.Actions)
+	}
+	if mgr.memoryWeight > 0 {
+		rv.Weight = mgr.memoryWeight
+	}
+
+	return rv
+}
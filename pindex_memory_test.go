@@ -0,0 +1,160 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type memoryTestDest struct {
+	TestDest
+	used uint64 // Accessed atomically.
+}
+
+func (d *memoryTestDest) MemoryUsed() uint64 {
+	return atomic.LoadUint64(&d.used)
+}
+
+func TestMemoryQuotaOptions(t *testing.T) {
+	quota, actions, resumePercent, weight := memoryQuotaOptions(nil)
+	if quota != 0 || !reflect.DeepEqual(actions,
+		map[string]bool{MEMORY_QUOTA_ACTION_ALERT: true}) ||
+		resumePercent != DEFAULT_MEMORY_QUOTA_RESUME_PERCENT || weight != 1 {
+		t.Errorf("unexpected defaults: %d, %v, %d, %d",
+			quota, actions, resumePercent, weight)
+	}
+
+	quota, actions, resumePercent, weight = memoryQuotaOptions(map[string]string{
+		"ftsMemoryQuota":           "1000",
+		"memoryQuotaActions":       "pause, weight",
+		"memoryQuotaResumePercent": "50",
+		"memoryQuotaWeight":        "2",
+	})
+	if quota != 1000 || !reflect.DeepEqual(actions, map[string]bool{
+		MEMORY_QUOTA_ACTION_PAUSE:  true,
+		MEMORY_QUOTA_ACTION_WEIGHT: true,
+	}) || resumePercent != 50 || weight != 2 {
+		t.Errorf("unexpected options: %d, %v, %d, %d",
+			quota, actions, resumePercent, weight)
+	}
+}
+
+func TestMemoryQuota(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), nil, "", 4, "",
+		":1000", emptyDir, "", nil, map[string]string{
+			"ftsMemoryQuota":     "100",
+			"memoryQuotaActions": "pause,weight,alert",
+		})
+	defer mgr.Stop()
+
+	err := mgr.Register("wanted")
+	if err != nil {
+		t.Fatalf("expected Register to work, err: %v", err)
+	}
+
+	dest := &memoryTestDest{}
+	err = mgr.registerPIndex(&PIndex{Name: "p0", IndexName: "a", Dest: dest})
+	if err != nil {
+		t.Fatalf("expected registerPIndex to work, err: %v", err)
+	}
+	err = mgr.registerPIndex(&PIndex{Name: "p1", IndexName: "a",
+		Dest: &TestDest{}})
+	if err != nil {
+		t.Fatalf("expected registerPIndex to work, err: %v", err)
+	}
+
+	feedDest := mgr.wrapIngestLimitDest(&PIndex{IndexName: "a"}, dest)
+
+	nodeDefWeight := func() int {
+		nodeDefs, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+		return nodeDefs.NodeDefs[mgr.UUID()].Weight
+	}
+
+	atomic.StoreUint64(&dest.used, 150)
+	mgr.checkMemoryQuotaOnce()
+
+	s := mgr.MemoryQuotaStatus()
+	if !s.Exceeded || !s.Paused || s.Used != 150 || s.Weight != 1 ||
+		!reflect.DeepEqual(s.PIndexes, map[string]uint64{"p0": 150}) {
+		t.Errorf("expected exceeded, got: %+v", s)
+	}
+	if nodeDefWeight() != 1 {
+		t.Errorf("expected a reduced NodeDef weight, got: %d", nodeDefWeight())
+	}
+
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- feedDest.DataUpdate("0", []byte("k"), 1, nil, 0,
+			DEST_EXTRAS_TYPE_NIL, nil)
+	}()
+
+	select {
+	case <-doneCh:
+		t.Fatalf("expected the paused feed to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Under the quota, but not yet under the resume percentage.
+	atomic.StoreUint64(&dest.used, 95)
+	mgr.checkMemoryQuotaOnce()
+	if !mgr.MemoryQuotaStatus().Exceeded {
+		t.Errorf("expected still exceeded")
+	}
+
+	atomic.StoreUint64(&dest.used, 50)
+	mgr.checkMemoryQuotaOnce()
+
+	select {
+	case err = <-doneCh:
+		if err != nil {
+			t.Errorf("expected DataUpdate to work, err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the resumed feed to unblock")
+	}
+
+	s = mgr.MemoryQuotaStatus()
+	if s.Exceeded || s.Paused || s.Weight != 4 {
+		t.Errorf("expected recovered, got: %+v", s)
+	}
+	if nodeDefWeight() != 4 {
+		t.Errorf("expected the NodeDef weight back, got: %d", nodeDefWeight())
+	}
+
+	var events []string
+	mgr.VisitEvents(func(event []byte) {
+		events = append(events, string(event))
+	})
+	if len(events) != 2 ||
+		!strings.Contains(events[0], `"memoryQuotaExceeded"`) ||
+		!strings.Contains(events[1], `"memoryQuotaRecovered"`) {
+		t.Errorf("expected the alerts, got: %v", events)
+	}
+
+	var stats ManagerStats
+	mgr.stats.AtomicCopyTo(&stats)
+	if stats.TotMemoryQuotaExceeded != 1 ||
+		stats.TotMemoryQuotaRecovered != 1 ||
+		stats.TotMemoryQuotaPauseWait != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
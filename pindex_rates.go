@@ -0,0 +1,439 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// PINDEX_RATES_KEY is the Cfg key of the PIndexRates.
+const PINDEX_RATES_KEY = "pindexRates"
+
+// DEFAULT_PINDEX_RATES_INTERVAL is how often the pindex ingest and
+// query rates are sampled, which may be overridden by the
+// "pindexRatesIntervalMS" manager option.
+const DEFAULT_PINDEX_RATES_INTERVAL = time.Minute
+
+// PINDEX_RATES_MAX_WEIGHT caps the partition weight that's derived
+// from the rates of a pindex.
+const PINDEX_RATES_MAX_WEIGHT = 8
+
+// PIndexRates holds the recently sampled ingest and query rates of
+// the pindexes, as published by each node into the Cfg.
+//
+// When the "pindexWeightsFromRates" cluster option is "true", each
+// node samples the rates of its pindexes, and the planner derives
+// the partition weights of an index from the rates, so that hot
+// pindexes are spread across the nodes.  Explicit PIndexWeights of an
+// index's PlanParams take precedence over the derived weights.
+type PIndexRates struct {
+	UUID  string                      `json:"uuid"`
+	Nodes map[string]*NodePIndexRates `json:"nodes"` // Keyed by node UUID.
+}
+
+// NodePIndexRates holds the rates of the pindexes on a node.
+type NodePIndexRates struct {
+	Time     string                 `json:"time"`
+	PIndexes map[string]*PIndexRate `json:"pindexes"` // Keyed by pindex name.
+}
+
+// PIndexRate is the sampled rates of a pindex, in operations per
+// second.
+type PIndexRate struct {
+	IndexName string  `json:"indexName"`
+	Ingest    float64 `json:"ingest"`
+	Query     float64 `json:"query"`
+}
+
+// CfgGetPIndexRates returns the PIndexRates from a Cfg.
+func CfgGetPIndexRates(cfg Cfg) (*PIndexRates, uint64, error) {
+	v, cas, err := cfg.Get(PINDEX_RATES_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &PIndexRates{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetPIndexRates updates the PIndexRates on a Cfg.
+func CfgSetPIndexRates(cfg Cfg, rates *PIndexRates, cas uint64) (
+	uint64, error) {
+	buf, err := json.Marshal(rates)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(PINDEX_RATES_KEY, buf, cas)
+}
+
+// ---------------------------------------------------------
+
+// RecordQuery counts a query against the pindex, for the rates
+// sampler.  A PIndexImplType's query path should invoke it once per
+// query that's served by the pindex.
+func (p *PIndex) RecordQuery() {
+	atomic.AddUint64(&p.totQuery, 1)
+}
+
+// rateDest wraps a pindex's Dest to count its ingested mutations.
+type rateDest struct {
+	Dest
+	pindex *PIndex
+}
+
+// rateDestEx is a rateDest for a Dest that's also a DestEx.
+type rateDestEx struct {
+	*rateDest
+	destEx DestEx
+}
+
+// unwrapRateDest returns the Dest that was wrapped by a rateDest, if
+// any.
+func unwrapRateDest(dest Dest) Dest {
+	switch d := dest.(type) {
+	case *rateDest:
+		return d.Dest
+	case *rateDestEx:
+		return d.rateDest.Dest
+	}
+	return dest
+}
+
+// wrapRateDest returns the Dest to hand to a feed for the pindex,
+// which counts the ingested mutations when the rates are sampled.
+func (mgr *Manager) wrapRateDest(pindex *PIndex, dest Dest) Dest {
+	if mgr.Options()["pindexWeightsFromRates"] != "true" || dest == nil {
+		return dest
+	}
+
+	d := &rateDest{Dest: dest, pindex: pindex}
+
+	if destEx, ok := dest.(DestEx); ok {
+		return &rateDestEx{rateDest: d, destEx: destEx}
+	}
+
+	return d
+}
+
+func (d *rateDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	atomic.AddUint64(&d.pindex.totIngest, 1)
+	return d.Dest.DataUpdate(partition, key, seq, val, cas,
+		extrasType, extras)
+}
+
+func (d *rateDest) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	atomic.AddUint64(&d.pindex.totIngest, 1)
+	return d.Dest.DataDelete(partition, key, seq, cas,
+		extrasType, extras)
+}
+
+func (d *rateDest) CheckpointPropose(partition string, seq uint64,
+	ack func(err error)) error {
+	return DestCheckpointPropose(d.Dest, partition, seq, ack)
+}
+
+func (d *rateDestEx) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	atomic.AddUint64(&d.pindex.totIngest, 1)
+	return d.destEx.DataUpdateEx(partition, key, seq, val, cas,
+		extrasType, req)
+}
+
+func (d *rateDestEx) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	atomic.AddUint64(&d.pindex.totIngest, 1)
+	return d.destEx.DataDeleteEx(partition, key, seq, cas,
+		extrasType, req)
+}
+
+func (d *rateDestEx) RollbackEx(partition string,
+	partitionUUID uint64, rollbackSeq uint64) error {
+	return d.destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+}
+
+// ---------------------------------------------------------
+
+// pindexRatesSampler computes the rates of the local pindexes from
+// the deltas of their counters between samples.
+type pindexRatesSampler struct {
+	prevTime time.Time
+	prev     map[string]pindexRatesCounts // Keyed by pindex UUID.
+}
+
+type pindexRatesCounts struct {
+	ingest, query uint64
+}
+
+// sample returns the rates of the pindexes since the previous sample,
+// or nil on the first sample.  A pindex that's new since the
+// previous sample is skipped until the next sample.
+func (s *pindexRatesSampler) sample(pindexes map[string]*PIndex,
+	now time.Time) map[string]*PIndexRate {
+	curr := make(map[string]pindexRatesCounts, len(pindexes))
+	for _, pindex := range pindexes {
+		curr[pindex.UUID] = pindexRatesCounts{
+			ingest: atomic.LoadUint64(&pindex.totIngest),
+			query:  atomic.LoadUint64(&pindex.totQuery),
+		}
+	}
+
+	prev, prevTime := s.prev, s.prevTime
+	s.prev, s.prevTime = curr, now
+
+	secs := now.Sub(prevTime).Seconds()
+	if prev == nil || secs <= 0 {
+		return nil
+	}
+
+	rv := make(map[string]*PIndexRate, len(pindexes))
+	for name, pindex := range pindexes {
+		p, exists := prev[pindex.UUID]
+		if !exists {
+			continue
+		}
+		c := curr[pindex.UUID]
+		rv[name] = &PIndexRate{
+			IndexName: pindex.IndexName,
+			Ingest:    roundRate(float64(c.ingest-p.ingest) / secs),
+			Query:     roundRate(float64(c.query-p.query) / secs),
+		}
+	}
+
+	return rv
+}
+
+// roundRate rounds a rate to 2 decimals, so that tiny fluctuations
+// don't cause needless Cfg updates.
+func roundRate(r float64) float64 {
+	return math.Round(r*100) / 100
+}
+
+// PIndexRatesLoop periodically samples the rates of the local
+// pindexes and publishes them into the Cfg, while the
+// "pindexWeightsFromRates" option is "true".
+func (mgr *Manager) PIndexRatesLoop() {
+	interval := DEFAULT_PINDEX_RATES_INTERVAL
+	if v, err := strconv.Atoi(mgr.Options()["pindexRatesIntervalMS"]); err == nil && v > 0 {
+		interval = time.Duration(v) * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	sampler := &pindexRatesSampler{}
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case now := <-ticker.C:
+			if mgr.Options()["pindexWeightsFromRates"] != "true" {
+				sampler.prev = nil
+				continue
+			}
+
+			_, pindexes := mgr.CurrentMaps()
+
+			rates := sampler.sample(pindexes, now)
+			if rates == nil {
+				continue
+			}
+
+			err := mgr.publishPIndexRates(rates, now)
+			if err != nil {
+				mgr.log.Warnf("pindex_rates: publish, err: %v", err)
+			}
+		}
+	}
+}
+
+// publishPIndexRates updates the entry of this node in the Cfg's
+// PIndexRates, retrying on concurrent updates by other nodes.
+func (mgr *Manager) publishPIndexRates(rates map[string]*PIndexRate,
+	now time.Time) (err error) {
+	for tries := 0; tries < 10; tries++ {
+		var all *PIndexRates
+		var cas uint64
+
+		all, cas, err = CfgGetPIndexRates(mgr.cfg)
+		if err != nil {
+			break
+		}
+		if all == nil {
+			all = &PIndexRates{}
+		}
+		if all.Nodes == nil {
+			all.Nodes = map[string]*NodePIndexRates{}
+		}
+
+		if prev := all.Nodes[mgr.uuid]; prev != nil &&
+			reflect.DeepEqual(prev.PIndexes, rates) {
+			return nil // Skip the Cfg update, as nothing changed.
+		}
+
+		all.UUID = NewUUID()
+		all.Nodes[mgr.uuid] = &NodePIndexRates{
+			Time:     now.Format(time.RFC3339Nano),
+			PIndexes: rates,
+		}
+
+		_, err = CfgSetPIndexRates(mgr.cfg, all, cas)
+		if err == nil {
+			atomic.AddUint64(&mgr.stats.TotPIndexRatesPublish, 1)
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			break
+		}
+	}
+
+	atomic.AddUint64(&mgr.stats.TotPIndexRatesPublishErr, 1)
+
+	return err
+}
+
+// ---------------------------------------------------------
+
+// CalcPIndexRateWeights derives partition weights from the rates of
+// the pindexes on the given nodes, keyed by index name and then by
+// pindex name.  A pindex's load is its highest ingest rate across its
+// replicas plus its query rate summed across its replicas.  The
+// weight of a pindex is its load relative to the average load of its
+// index, rounded and capped at PINDEX_RATES_MAX_WEIGHT.  Only weights
+// above the default weight of 1 are returned.
+func CalcPIndexRateWeights(rates *PIndexRates,
+	nodeDefs *NodeDefs) map[string]map[string]int {
+	if rates == nil || nodeDefs == nil {
+		return nil
+	}
+
+	loads := map[string]map[string]*PIndexRate{} // Keyed by index, pindex.
+	for nodeUUID, nodeRates := range rates.Nodes {
+		if nodeDefs.NodeDefs[nodeUUID] == nil || nodeRates == nil {
+			continue // Such as a node that's been removed.
+		}
+		for name, r := range nodeRates.PIndexes {
+			byName := loads[r.IndexName]
+			if byName == nil {
+				byName = map[string]*PIndexRate{}
+				loads[r.IndexName] = byName
+			}
+			l := byName[name]
+			if l == nil {
+				l = &PIndexRate{IndexName: r.IndexName}
+				byName[name] = l
+			}
+			l.Ingest = math.Max(l.Ingest, r.Ingest)
+			l.Query += r.Query
+		}
+	}
+
+	var rv map[string]map[string]int
+
+	for indexName, byName := range loads {
+		var total float64
+		for _, l := range byName {
+			total += l.Ingest + l.Query
+		}
+		if total <= 0 {
+			continue
+		}
+		avg := total / float64(len(byName))
+
+		for name, l := range byName {
+			w := int(math.Round((l.Ingest + l.Query) / avg))
+			if w > PINDEX_RATES_MAX_WEIGHT {
+				w = PINDEX_RATES_MAX_WEIGHT
+			}
+			if w <= 1 {
+				continue
+			}
+			if rv == nil {
+				rv = map[string]map[string]int{}
+			}
+			if rv[indexName] == nil {
+				rv[indexName] = map[string]int{}
+			}
+			rv[indexName][name] = w
+		}
+	}
+
+	return rv
+}
+
+// plannerApplyPIndexRateWeights returns the indexDefs with the
+// partition weights derived from the rates in the Cfg merged into
+// their PlanParams.  The given indexDefs aren't modified.
+func plannerApplyPIndexRateWeights(log Log, cfg Cfg,
+	indexDefs *IndexDefs, nodeDefs *NodeDefs) *IndexDefs {
+	if indexDefs == nil {
+		return nil
+	}
+
+	rates, _, err := CfgGetPIndexRates(cfg)
+	if err != nil {
+		log.Warnf("planner: CfgGetPIndexRates, err: %v", err)
+		return indexDefs
+	}
+
+	weights := CalcPIndexRateWeights(rates, nodeDefs)
+	if len(weights) <= 0 {
+		return indexDefs
+	}
+
+	rv := *indexDefs
+	rv.IndexDefs = make(map[string]*IndexDef, len(indexDefs.IndexDefs))
+
+	for name, indexDef := range indexDefs.IndexDefs {
+		w := weights[name]
+		if len(w) <= 0 {
+			rv.IndexDefs[name] = indexDef
+			continue
+		}
+
+		merged := make(map[string]int,
+			len(w)+len(indexDef.PlanParams.PIndexWeights))
+		for pindexName, weight := range w {
+			merged[pindexName] = weight
+		}
+		for pindexName, weight := range indexDef.PlanParams.PIndexWeights {
+			merged[pindexName] = weight
+		}
+
+		indexDefCopy := *indexDef
+		indexDefCopy.PlanParams.PIndexWeights = merged
+		rv.IndexDefs[name] = &indexDefCopy
+	}
+
+	return &rv
+}
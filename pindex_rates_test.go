@@ -0,0 +1,160 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPIndexRatesSampler(t *testing.T) {
+	p0 := &PIndex{Name: "p0", UUID: "u0", IndexName: "x"}
+	pindexes := map[string]*PIndex{"p0": p0}
+
+	dest := (&Manager{options: map[string]string{
+		"pindexWeightsFromRates": "true",
+	}}).wrapRateDest(p0, &TestDest{})
+	if unwrapRateDest(dest) == dest {
+		t.Fatalf("expected a rateDest")
+	}
+
+	s := &pindexRatesSampler{}
+	now := time.Now()
+	if s.sample(pindexes, now) != nil {
+		t.Errorf("expected no rates on the first sample")
+	}
+
+	for i := 0; i < 20; i++ {
+		dest.DataUpdate("0", []byte("k"), uint64(i+1), nil, 0,
+			DEST_EXTRAS_TYPE_NIL, nil)
+	}
+	p0.RecordQuery()
+	p0.RecordQuery()
+
+	pindexes["p1"] = &PIndex{Name: "p1", UUID: "u1", IndexName: "x"}
+
+	rates := s.sample(pindexes, now.Add(2*time.Second))
+	exp := map[string]*PIndexRate{
+		"p0": {IndexName: "x", Ingest: 10, Query: 1},
+	}
+	if !reflect.DeepEqual(rates, exp) {
+		t.Errorf("expected rates: %#v, got: %#v", exp, rates)
+	}
+}
+
+func TestCalcPIndexRateWeights(t *testing.T) {
+	nodeDefs := &NodeDefs{NodeDefs: map[string]*NodeDef{
+		"n0": {UUID: "n0"},
+		"n1": {UUID: "n1"},
+	}}
+
+	rates := &PIndexRates{Nodes: map[string]*NodePIndexRates{
+		"n0": {PIndexes: map[string]*PIndexRate{
+			"p0": {IndexName: "x", Ingest: 100, Query: 50},
+			"p1": {IndexName: "x", Ingest: 10},
+		}},
+		"n1": {PIndexes: map[string]*PIndexRate{
+			"p0": {IndexName: "x", Ingest: 100, Query: 50},
+			"p2": {IndexName: "x", Ingest: 10},
+			"q0": {IndexName: "y"},
+		}},
+		"gone": {PIndexes: map[string]*PIndexRate{
+			"p1": {IndexName: "x", Ingest: 1000},
+		}},
+	}}
+
+	// The load of p0 is 100 + 50 + 50, so the average is 220 / 3.
+	w := CalcPIndexRateWeights(rates, nodeDefs)
+	exp := map[string]map[string]int{"x": {"p0": 3}}
+	if !reflect.DeepEqual(w, exp) {
+		t.Errorf("expected weights: %#v, got: %#v", exp, w)
+	}
+
+	if CalcPIndexRateWeights(nil, nodeDefs) != nil {
+		t.Errorf("expected no weights without rates")
+	}
+}
+
+func TestPlannerApplyPIndexRateWeights(t *testing.T) {
+	cfg := NewCfgMem()
+	log := NewStdLibLog(ioutil.Discard, "", 0)
+
+	nodeDefs := &NodeDefs{NodeDefs: map[string]*NodeDef{"n0": {UUID: "n0"}}}
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["x"] = &IndexDef{Name: "x",
+		PlanParams: PlanParams{PIndexWeights: map[string]int{"p1": 5}}}
+	indexDefs.IndexDefs["y"] = &IndexDef{Name: "y"}
+
+	if plannerApplyPIndexRateWeights(log, cfg, indexDefs,
+		nodeDefs) != indexDefs {
+		t.Errorf("expected unchanged indexDefs without rates")
+	}
+
+	_, err := CfgSetPIndexRates(cfg, &PIndexRates{
+		Nodes: map[string]*NodePIndexRates{
+			"n0": {PIndexes: map[string]*PIndexRate{
+				"p0": {IndexName: "x", Ingest: 30},
+				"p1": {IndexName: "x", Ingest: 30},
+				"p2": {IndexName: "x"},
+				"p3": {IndexName: "x"},
+			}},
+		}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rv := plannerApplyPIndexRateWeights(log, cfg, indexDefs, nodeDefs)
+	exp := map[string]int{"p0": 2, "p1": 5}
+	if !reflect.DeepEqual(rv.IndexDefs["x"].PlanParams.PIndexWeights, exp) {
+		t.Errorf("expected weights: %#v, got: %#v", exp,
+			rv.IndexDefs["x"].PlanParams.PIndexWeights)
+	}
+	if rv.IndexDefs["y"] != indexDefs.IndexDefs["y"] {
+		t.Errorf("expected the unweighted indexDef to be shared")
+	}
+	if len(indexDefs.IndexDefs["x"].PlanParams.PIndexWeights) != 1 {
+		t.Errorf("expected the original indexDef to be unchanged")
+	}
+}
+
+func TestPublishPIndexRates(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, "n0", nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+
+	rates := map[string]*PIndexRate{"p0": {IndexName: "x", Ingest: 1}}
+	for i := 0; i < 2; i++ {
+		if err := m.publishPIndexRates(rates, time.Now()); err != nil {
+			t.Fatalf("expected publish to work, err: %v", err)
+		}
+	}
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotPIndexRatesPublish != 1 {
+		t.Errorf("expected the unchanged rates to be published once,"+
+			" got: %d", stats.TotPIndexRatesPublish)
+	}
+
+	all, _, err := CfgGetPIndexRates(cfg)
+	if err != nil || all == nil ||
+		!reflect.DeepEqual(all.Nodes["n0"].PIndexes, rates) {
+		t.Errorf("expected published rates, got: %#v, err: %v", all, err)
+	}
+}
@@ -0,0 +1,82 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// PINDEX_READY_PATH is the REST path, with a "pindex" query param,
+// where a node reports whether one of its pindexes is queryable, see
+// PIndexReadyHandler().  A rebalance checks it before it removes a
+// former primary pindex.
+const PINDEX_READY_PATH = "/api/pindexReady"
+
+// DestReady is an optional interface of a Dest that knows whether
+// it's fully queryable, such as after its index files were loaded
+// and its caches warmed up, which can be later than when it caught
+// up with the seqs of its partitions.  A Dest that isn't a DestReady
+// is queryable as soon as its pindex is registered.
+type DestReady interface {
+	Ready() (bool, error)
+}
+
+// PIndexReady returns whether a local pindex is queryable, where a
+// missing pindex is not.
+func (mgr *Manager) PIndexReady(pindexName string) (bool, error) {
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		return false, fmt.Errorf("pindex_ready: no pindex: %s", pindexName)
+	}
+
+	if dr, ok := pindex.Dest.(DestReady); ok {
+		return dr.Ready()
+	}
+
+	return pindex.Dest != nil, nil
+}
+
+// A PIndexReadyStatus is the response of the PIndexReadyHandler().
+type PIndexReadyStatus struct {
+	PIndex string `json:"pindex"`
+	Ready  bool   `json:"ready"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PIndexReadyHandler is the REST handler of PINDEX_READY_PATH, which
+// responds with a PIndexReadyStatus, with a 404 status for a missing
+// pindex.
+func PIndexReadyHandler(mgr *Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("pindex")
+
+		rv := &PIndexReadyStatus{PIndex: name}
+
+		status := http.StatusOK
+		if mgr.GetPIndex(name) == nil {
+			status = http.StatusNotFound
+			rv.Error = "no pindex"
+		} else {
+			ready, err := mgr.PIndexReady(name)
+			rv.Ready = ready && err == nil
+			if err != nil {
+				rv.Error = err.Error()
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(rv)
+	})
+}
@@ -0,0 +1,87 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+type testReadyDest struct {
+	Dest
+	ready bool
+}
+
+func (d *testReadyDest) Ready() (bool, error) {
+	return d.ready, nil
+}
+
+func TestPIndexReady(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+
+	handler := PIndexReadyHandler(mgr)
+
+	get := func(name string) (int, *PIndexReadyStatus) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", PINDEX_READY_PATH+"?pindex="+name, nil)
+		handler.ServeHTTP(rec, req)
+		rv := &PIndexReadyStatus{}
+		json.Unmarshal(rec.Body.Bytes(), rv)
+		return rec.Code, rv
+	}
+
+	if code, status := get("p0"); code != http.StatusNotFound || status.Ready {
+		t.Errorf("expected missing pindex, got: %d, %+v", code, status)
+	}
+
+	p, err := NewPIndex(mgr, "p0", "uuid", "blackhole",
+		"indexName", "indexUUID", "",
+		"sourceType", "sourceName", "sourceUUID",
+		"", "sourcePartitions", mgr.PIndexPath("p0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := &testReadyDest{Dest: p.Dest}
+	p.Dest = dest
+
+	err = mgr.registerPIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, status := get("p0")
+	if code != http.StatusOK || status.Ready || status.PIndex != "p0" {
+		t.Errorf("expected not ready, got: %d, %+v", code, status)
+	}
+
+	dest.ready = true
+
+	if code, status = get("p0"); code != http.StatusOK || !status.Ready {
+		t.Errorf("expected ready, got: %d, %+v", code, status)
+	}
+
+	// A Dest that isn't a DestReady is ready once registered.
+	p.Dest = dest.Dest
+	if ready, err := mgr.PIndexReady("p0"); !ready || err != nil {
+		t.Errorf("expected ready, got: %v, err: %v", ready, err)
+	}
+}
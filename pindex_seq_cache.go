@@ -0,0 +1,337 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DestPartitionSeqs is an optional interface of a Dest that knows the
+// UUIDs and seqs of its partitions, such as from its opaques, which
+// then seeds the partition seq cache.  The seqs of a Dest that isn't
+// a DestPartitionSeqs are seeded from its OpaqueGet().
+type DestPartitionSeqs interface {
+	PartitionSeqs() (map[string]UUIDSeq, error)
+}
+
+// A seqCache is the partition seq cache of a pindex, which its
+// seqCacheDest keeps up to date on the Dest callbacks, so that a
+// stats request doesn't recompute the seqs of every partition from
+// the Dest.  The snapshot of a pindex whose partitions weren't
+// touched since the previous request is reused as-is, while any
+// touched partition has the snapshot copied, as the previous one
+// might still be in use.
+//
+// NOTE: A seq is advanced as soon as the Dest applied a mutation,
+// which can be ahead of the seq in the Dest's persisted opaques, as
+// seen by OpaqueGet().  So a rebalance or other monitor of the seqs
+// sees a pindex as caught up once it applied, but not necessarily
+// persisted, the mutations.  The "partitionSeqCacheDisable" manager
+// option restores the seqs of the Dest.
+type seqCache struct {
+	m      sync.Mutex
+	pindex *PIndex
+	seeded bool
+	curr   map[string]UUIDSeq  // Updated by the Dest callbacks.
+	dirty  map[string]struct{} // Partitions changed since the snap.
+	snap   map[string]UUIDSeq  // Immutable, once handed out.
+}
+
+// seqCacheDest wraps a pindex's Dest to update its seqCache.
+type seqCacheDest struct {
+	Dest
+	c *seqCache
+}
+
+// seqCacheDestEx is a seqCacheDest for a Dest that's also a DestEx.
+type seqCacheDestEx struct {
+	*seqCacheDest
+	destEx DestEx
+}
+
+// unwrapSeqCacheDest returns the Dest that was wrapped by a
+// seqCacheDest, if any.
+func unwrapSeqCacheDest(dest Dest) Dest {
+	switch d := dest.(type) {
+	case *seqCacheDest:
+		return d.Dest
+	case *seqCacheDestEx:
+		return d.seqCacheDest.Dest
+	}
+	return dest
+}
+
+// wrapSeqCacheDest returns the Dest to hand to a feed for the pindex,
+// which maintains the pindex's seqCache, unless the
+// "partitionSeqCacheDisable" manager option is "true".
+func (mgr *Manager) wrapSeqCacheDest(pindex *PIndex, dest Dest) Dest {
+	if mgr.Options()["partitionSeqCacheDisable"] == "true" || dest == nil {
+		return dest
+	}
+
+	c := &seqCache{
+		pindex: pindex,
+		curr:   map[string]UUIDSeq{},
+		dirty:  map[string]struct{}{},
+	}
+
+	mgr.seqCachesMutex.Lock()
+	if mgr.seqCaches == nil {
+		mgr.seqCaches = map[string]*seqCache{}
+	}
+	mgr.seqCaches[pindex.Name] = c
+	mgr.seqCachesMutex.Unlock()
+
+	d := &seqCacheDest{Dest: dest, c: c}
+
+	if destEx, ok := dest.(DestEx); ok {
+		return &seqCacheDestEx{seqCacheDest: d, destEx: destEx}
+	}
+
+	return d
+}
+
+// removeSeqCache forgets the seqCache of a stopped pindex.
+func (mgr *Manager) removeSeqCache(pindex *PIndex) {
+	mgr.seqCachesMutex.Lock()
+	if c := mgr.seqCaches[pindex.Name]; c != nil && c.pindex == pindex {
+		delete(mgr.seqCaches, pindex.Name)
+	}
+	mgr.seqCachesMutex.Unlock()
+}
+
+// ---------------------------------------------------------
+
+// advance records a seq of a partition, where a seq only moves
+// forwards, except on a rollback.
+func (c *seqCache) advance(partition string, seq uint64) {
+	c.m.Lock()
+	if us := c.curr[partition]; seq > us.Seq {
+		us.Seq = seq
+		c.curr[partition] = us
+		c.dirty[partition] = struct{}{}
+	}
+	c.m.Unlock()
+}
+
+func (c *seqCache) rollback(partition, uuid string, seq uint64) {
+	c.m.Lock()
+	us := c.curr[partition]
+	if seq < us.Seq {
+		us.Seq = seq
+	}
+	if uuid != "" {
+		us.UUID = uuid
+	}
+	c.curr[partition] = us
+	c.dirty[partition] = struct{}{}
+	c.m.Unlock()
+}
+
+func (d *seqCacheDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	err := d.Dest.DataUpdate(partition, key, seq, val, cas,
+		extrasType, extras)
+	if err == nil {
+		d.c.advance(partition, seq)
+	}
+	return err
+}
+
+func (d *seqCacheDest) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	err := d.Dest.DataDelete(partition, key, seq, cas,
+		extrasType, extras)
+	if err == nil {
+		d.c.advance(partition, seq)
+	}
+	return err
+}
+
+func (d *seqCacheDest) Rollback(partition string, rollbackSeq uint64) error {
+	err := d.Dest.Rollback(partition, rollbackSeq)
+	if err == nil {
+		d.c.rollback(partition, "", rollbackSeq)
+	}
+	return err
+}
+
+func (d *seqCacheDest) CheckpointPropose(partition string, seq uint64,
+	ack func(err error)) error {
+	return DestCheckpointPropose(d.Dest, partition, seq, ack)
+}
+
+func (d *seqCacheDestEx) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	err := d.destEx.DataUpdateEx(partition, key, seq, val, cas,
+		extrasType, req)
+	if err == nil {
+		d.c.advance(partition, seq)
+	}
+	return err
+}
+
+func (d *seqCacheDestEx) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	err := d.destEx.DataDeleteEx(partition, key, seq, cas,
+		extrasType, req)
+	if err == nil {
+		d.c.advance(partition, seq)
+	}
+	return err
+}
+
+func (d *seqCacheDestEx) RollbackEx(partition string,
+	partitionUUID uint64, rollbackSeq uint64) error {
+	err := d.destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+	if err == nil {
+		d.c.rollback(partition,
+			strconv.FormatUint(partitionUUID, 10), rollbackSeq)
+	}
+	return err
+}
+
+// ---------------------------------------------------------
+
+// PartitionSeqs returns the UUIDs and seqs of the partitions of the
+// local pindexes, such as for a /api/stats?partitions=true response.
+// The seqs of a pindex come from its seqCache, where the cached map of
+// a pindex is reused when none of its partitions were touched since
+// the previous call, and is otherwise copied with the touched
+// partitions applied; the seqs of a pindex without a seqCache, or
+// whose seqCache isn't seeded yet, are computed from its Dest.  The
+// cached seqs are the applied seqs, see seqCache.  The returned maps
+// must not be modified.
+func (mgr *Manager) PartitionSeqs() PartitionSeqs {
+	_, pindexes := mgr.CurrentMaps()
+
+	rv := make(PartitionSeqs, len(pindexes))
+
+	for name, pindex := range pindexes {
+		mgr.seqCachesMutex.Lock()
+		c := mgr.seqCaches[name]
+		mgr.seqCachesMutex.Unlock()
+
+		if c == nil || c.pindex != pindex {
+			atomic.AddUint64(&mgr.stats.TotPartitionSeqsCacheMiss, 1)
+			rv[name] = destPartitionSeqs(pindex)
+			continue
+		}
+
+		rv[name] = mgr.seqCacheSnapshot(c)
+	}
+
+	return rv
+}
+
+// seqCacheSnapshot returns a seqCache's snapshot, after applying the
+// partitions that were touched since the previous snapshot, which
+// copies the snapshot of all the pindex's partitions.
+func (mgr *Manager) seqCacheSnapshot(c *seqCache) map[string]UUIDSeq {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if !c.seeded {
+		c.seeded = true
+
+		atomic.AddUint64(&mgr.stats.TotPartitionSeqsCacheMiss, 1)
+
+		// Seqs that arrived before the seeding take precedence.
+		for partition, us := range destPartitionSeqs(c.pindex) {
+			if curr, exists := c.curr[partition]; exists {
+				if curr.UUID == "" {
+					curr.UUID = us.UUID
+				}
+				if curr.Seq < us.Seq {
+					curr.Seq = us.Seq
+				}
+				us = curr
+			}
+			c.curr[partition] = us
+		}
+
+		c.snap = make(map[string]UUIDSeq, len(c.curr))
+		for partition, us := range c.curr {
+			c.snap[partition] = us
+		}
+		c.dirty = map[string]struct{}{}
+
+		return c.snap
+	}
+
+	atomic.AddUint64(&mgr.stats.TotPartitionSeqsCacheHit, 1)
+
+	if len(c.dirty) <= 0 {
+		return c.snap
+	}
+
+	atomic.AddUint64(&mgr.stats.TotPartitionSeqsCacheUpdate,
+		uint64(len(c.dirty)))
+
+	// The previous snap might still be in use, so it's copied.
+	snap := make(map[string]UUIDSeq, len(c.curr))
+	for partition, us := range c.snap {
+		snap[partition] = us
+	}
+	for partition := range c.dirty {
+		snap[partition] = c.curr[partition]
+	}
+	c.snap = snap
+	c.dirty = map[string]struct{}{}
+
+	return c.snap
+}
+
+// destPartitionSeqs computes the seqs of a pindex's partitions from
+// its Dest.
+func destPartitionSeqs(pindex *PIndex) map[string]UUIDSeq {
+	rv := map[string]UUIDSeq{}
+
+	dest := pindex.Dest
+	if dest == nil {
+		return rv
+	}
+
+	if dps, ok := dest.(DestPartitionSeqs); ok {
+		seqs, err := dps.PartitionSeqs()
+		if err == nil {
+			for partition, us := range seqs {
+				rv[partition] = us
+			}
+			return rv
+		}
+	}
+
+	if pindex.SourcePartitions == "" {
+		return rv
+	}
+
+	for _, partition := range strings.Split(pindex.SourcePartitions, ",") {
+		_, lastSeq, err := dest.OpaqueGet(partition)
+		if err == nil {
+			rv[partition] = UUIDSeq{Seq: lastSeq}
+		}
+	}
+
+	return rv
+}
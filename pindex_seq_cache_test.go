@@ -0,0 +1,86 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"reflect"
+	"testing"
+)
+
+type seqCacheTestDest struct {
+	TestDest
+	opaqueGets int
+}
+
+func (d *seqCacheTestDest) OpaqueGet(partition string) ([]byte, uint64, error) {
+	d.opaqueGets++
+	return nil, 5, nil
+}
+
+func TestPartitionSeqsCache(t *testing.T) {
+	d0 := &seqCacheTestDest{}
+	p0 := &PIndex{Name: "p0", SourcePartitions: "0,1", Dest: d0}
+	p1 := &PIndex{Name: "p1", SourcePartitions: "2", Dest: &seqCacheTestDest{}}
+
+	mgr := &Manager{
+		options:  map[string]string{},
+		pindexes: map[string]*PIndex{"p0": p0, "p1": p1},
+	}
+
+	dest := mgr.wrapSeqCacheDest(p0, p0.Dest)
+	if unwrapFeedDest(dest) != p0.Dest {
+		t.Fatalf("expected a seqCacheDest")
+	}
+
+	dest.DataUpdate("0", []byte("k"), 7, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	exp := PartitionSeqs{
+		"p0": {"0": {Seq: 7}, "1": {Seq: 5}},
+		"p1": {"2": {Seq: 5}},
+	}
+	if got := mgr.PartitionSeqs(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	if d0.opaqueGets != 2 || mgr.stats.TotPartitionSeqsCacheMiss != 2 {
+		t.Errorf("expected the seeding, opaqueGets: %d, misses: %d",
+			d0.opaqueGets, mgr.stats.TotPartitionSeqsCacheMiss)
+	}
+
+	prev := mgr.PartitionSeqs()
+
+	dest.DataDelete("1", []byte("k"), 9, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	dest.DataUpdate("1", []byte("k"), 8, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	exp["p0"] = map[string]UUIDSeq{"0": {Seq: 7}, "1": {Seq: 9}}
+	if got := mgr.PartitionSeqs(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	if prev["p0"]["1"].Seq != 5 {
+		t.Errorf("expected a previous snapshot to be unchanged")
+	}
+	if d0.opaqueGets != 2 ||
+		mgr.stats.TotPartitionSeqsCacheHit != 2 ||
+		mgr.stats.TotPartitionSeqsCacheUpdate != 1 {
+		t.Errorf("expected cache hits, stats: %+v", mgr.stats)
+	}
+
+	dest.Rollback("0", 3)
+	if got := mgr.PartitionSeqs()["p0"]["0"].Seq; got != 3 {
+		t.Errorf("expected the rollback seq, got: %d", got)
+	}
+
+	mgr.removeSeqCache(p0)
+	if got := mgr.PartitionSeqs(); !reflect.DeepEqual(got["p0"],
+		map[string]UUIDSeq{"0": {Seq: 5}, "1": {Seq: 5}}) {
+		t.Errorf("expected the dest's seqs without a cache, got: %v", got)
+	}
+}
@@ -0,0 +1,252 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_SOURCE_FLUSH_WINDOW is the default of the
+// "sourceFlushWindow" manager option, within which the rollbacks to
+// seq 0 of all of an index's local partitions signal that its source
+// was flushed.
+const DEFAULT_SOURCE_FLUSH_WINDOW = time.Minute
+
+// When a source, such as a bucket, is flushed or recreated, every
+// partition's failover log is reset, so a feed sees rollbacks to seq
+// 0 across all the partitions.  Resuming with the stale opaques then
+// leads to rollbacks over and over.  The flush detector recognizes
+// that signature, resets the opaques, restarts the index's feeds to
+// ingest from seq 0, and reports a single "sourceFlushed" event,
+// where the rollbacks that follow within the window are not reported.
+
+// A sourceFlush tracks the rollbacks to seq 0 of an index's local
+// partitions.
+type sourceFlush struct {
+	rolledBack map[string]time.Time // Keyed by "pindexName/partition".
+	flushedAt  time.Time
+}
+
+// flushDest wraps a pindex's Dest to detect a flush of its source.
+type flushDest struct {
+	Dest
+	mgr    *Manager
+	pindex *PIndex
+}
+
+// flushDestEx is a flushDest for a Dest that's also a DestEx.
+type flushDestEx struct {
+	*flushDest
+	destEx DestEx
+}
+
+// unwrapFlushDest returns the Dest that was wrapped by a flushDest,
+// if any.
+func unwrapFlushDest(dest Dest) Dest {
+	switch d := dest.(type) {
+	case *flushDest:
+		return d.Dest
+	case *flushDestEx:
+		return d.flushDest.Dest
+	}
+	return dest
+}
+
+// wrapFlushDest returns the Dest to hand to a feed for the pindex,
+// which detects a flush of its source, unless the
+// "sourceFlushDetectDisable" manager option is "true".
+func (mgr *Manager) wrapFlushDest(pindex *PIndex, dest Dest) Dest {
+	if mgr.Options()["sourceFlushDetectDisable"] == "true" || dest == nil {
+		return dest
+	}
+
+	d := &flushDest{Dest: dest, mgr: mgr, pindex: pindex}
+
+	if destEx, ok := dest.(DestEx); ok {
+		return &flushDestEx{flushDest: d, destEx: destEx}
+	}
+
+	return d
+}
+
+func (d *flushDest) Rollback(partition string, rollbackSeq uint64) error {
+	err := d.Dest.Rollback(partition, rollbackSeq)
+	if err == nil && rollbackSeq == 0 {
+		d.mgr.sourceRolledBack(d.pindex, partition)
+	}
+	return err
+}
+
+func (d *flushDest) CheckpointPropose(partition string, seq uint64,
+	ack func(err error)) error {
+	return DestCheckpointPropose(d.Dest, partition, seq, ack)
+}
+
+func (d *flushDestEx) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return d.destEx.DataUpdateEx(partition, key, seq, val, cas,
+		extrasType, req)
+}
+
+func (d *flushDestEx) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return d.destEx.DataDeleteEx(partition, key, seq, cas,
+		extrasType, req)
+}
+
+func (d *flushDestEx) RollbackEx(partition string,
+	partitionUUID uint64, rollbackSeq uint64) error {
+	err := d.destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+	if err == nil && rollbackSeq == 0 {
+		d.mgr.sourceRolledBack(d.pindex, partition)
+	}
+	return err
+}
+
+// ---------------------------------------------------------
+
+// sourceFlushWindow returns the "sourceFlushWindow" manager option.
+func (mgr *Manager) sourceFlushWindow() time.Duration {
+	if v, err := time.ParseDuration(
+		mgr.Options()["sourceFlushWindow"]); err == nil && v > 0 {
+		return v
+	}
+	return DEFAULT_SOURCE_FLUSH_WINDOW
+}
+
+// sourceRolledBack records a rollback to seq 0 of a pindex's
+// partition, and handles the flush of the source once all the local
+// partitions of the pindex's index rolled back within the window.
+func (mgr *Manager) sourceRolledBack(pindex *PIndex, partition string) {
+	now := Now()
+	window := mgr.sourceFlushWindow()
+
+	// The local partitions of the index, keyed like the rolledBack.
+	_, pindexes := mgr.CurrentMaps()
+	var indexPIndexes []*PIndex
+	partitions := map[string]struct{}{}
+	for _, p := range pindexes {
+		if p.IndexName != pindex.IndexName || p.IndexUUID != pindex.IndexUUID {
+			continue
+		}
+		indexPIndexes = append(indexPIndexes, p)
+		for _, sp := range strings.Split(p.SourcePartitions, ",") {
+			partitions[p.Name+"/"+sp] = struct{}{}
+		}
+	}
+
+	mgr.sourceFlushMutex.Lock()
+
+	if mgr.sourceFlushes == nil {
+		mgr.sourceFlushes = map[string]*sourceFlush{}
+	}
+	f := mgr.sourceFlushes[pindex.IndexUUID]
+	if f == nil {
+		f = &sourceFlush{rolledBack: map[string]time.Time{}}
+		mgr.sourceFlushes[pindex.IndexUUID] = f
+	}
+
+	if !f.flushedAt.IsZero() && now.Sub(f.flushedAt) < window {
+		// The rollbacks that follow a detected flush are expected.
+		mgr.sourceFlushMutex.Unlock()
+		atomic.AddUint64(&mgr.stats.TotSourceFlushRollbackQuiet, 1)
+		return
+	}
+
+	f.rolledBack[pindex.Name+"/"+partition] = now
+	for k, at := range f.rolledBack {
+		if now.Sub(at) >= window {
+			delete(f.rolledBack, k)
+		}
+	}
+
+	flushed := len(partitions) > 0
+	for k := range partitions {
+		if _, exists := f.rolledBack[k]; !exists {
+			flushed = false
+			break
+		}
+	}
+	if flushed {
+		f.flushedAt = now
+		f.rolledBack = map[string]time.Time{}
+	}
+
+	mgr.sourceFlushMutex.Unlock()
+
+	if flushed {
+		mgr.sourceFlushed(pindex, indexPIndexes)
+	}
+}
+
+// sourceFlushed resets the opaques of the index's local pindexes, so
+// that their feeds don't resume with the failover logs of the former
+// source, and restarts the index's feeds to ingest from seq 0.
+func (mgr *Manager) sourceFlushed(pindex *PIndex, pindexes []*PIndex) {
+	atomic.AddUint64(&mgr.stats.TotSourceFlushed, 1)
+
+	var names []string
+	for _, p := range pindexes {
+		names = append(names, p.Name)
+		if p.Dest == nil {
+			continue
+		}
+		for _, sp := range strings.Split(p.SourcePartitions, ",") {
+			err := p.Dest.OpaqueSet(sp, nil)
+			if err != nil {
+				mgr.log.Warnf("pindex_source_flush: OpaqueSet, pindex: %s,"+
+					" partition: %s, err: %v", p.Name, sp, err)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	mgr.log.Warnf("pindex_source_flush: source was flushed, index: %s,"+
+		" sourceName: %s, pindexes: %v, restarting ingestion from seq 0",
+		pindex.IndexName, pindex.SourceName, names)
+
+	event, _ := json.Marshal(struct {
+		Event      string   `json:"event"`
+		IndexName  string   `json:"indexName"`
+		IndexUUID  string   `json:"indexUUID"`
+		SourceName string   `json:"sourceName"`
+		PIndexes   []string `json:"pindexes"`
+		Time       string   `json:"time"`
+	}{"sourceFlushed", pindex.IndexName, pindex.IndexUUID,
+		pindex.SourceName, names, Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+
+	// The feed that invoked the rollback can't wait for its own
+	// restart, so the restart is asynchronous.
+	go func() {
+		_, err := mgr.RestartIndexFeeds(pindex.IndexName)
+		if err != nil {
+			mgr.log.Warnf("pindex_source_flush: RestartIndexFeeds,"+
+				" index: %s, err: %v", pindex.IndexName, err)
+		}
+	}()
+}
+
+// removeSourceFlush forgets the flush detection of a deleted index.
+func (mgr *Manager) removeSourceFlush(indexUUID string) {
+	mgr.sourceFlushMutex.Lock()
+	delete(mgr.sourceFlushes, indexUUID)
+	mgr.sourceFlushMutex.Unlock()
+}
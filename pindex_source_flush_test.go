@@ -0,0 +1,94 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+)
+
+type flushTestDest struct {
+	TestDest
+	m          sync.Mutex
+	opaqueSets []string
+}
+
+func (d *flushTestDest) OpaqueSet(partition string, value []byte) error {
+	d.m.Lock()
+	if value == nil {
+		d.opaqueSets = append(d.opaqueSets, partition)
+	}
+	d.m.Unlock()
+	return nil
+}
+
+func TestSourceFlushDetect(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := NewManager(Version, NewCfgMem(), nil, NewUUID(),
+		[]string{"pindex"}, "", 1, "", ":1000", emptyDir, "", nil, nil)
+
+	d0, d1 := &flushTestDest{}, &flushTestDest{}
+	p0 := &PIndex{Name: "p0", IndexName: "i", IndexUUID: "u",
+		SourcePartitions: "0,1", Dest: d0}
+	p1 := &PIndex{Name: "p1", IndexName: "i", IndexUUID: "u",
+		SourcePartitions: "2", Dest: d1}
+	mgr.registerPIndex(p0)
+	mgr.registerPIndex(p1)
+
+	dest0 := mgr.wrapFlushDest(p0, p0.Dest)
+	dest1 := mgr.wrapFlushDest(p1, p1.Dest)
+	if unwrapFeedDest(dest0) != p0.Dest {
+		t.Fatalf("expected a flushDest")
+	}
+
+	// A partial rollback, or the rollbacks of only some partitions,
+	// are not a flush.
+	dest0.Rollback("0", 0)
+	dest0.Rollback("1", 5)
+	dest1.Rollback("2", 0)
+	if mgr.stats.TotSourceFlushed != 0 {
+		t.Fatalf("expected no flush")
+	}
+
+	dest0.Rollback("1", 0)
+	if mgr.stats.TotSourceFlushed != 1 {
+		t.Fatalf("expected a flush")
+	}
+
+	sort.Strings(d0.opaqueSets)
+	if len(d0.opaqueSets) != 2 || d0.opaqueSets[0] != "0" ||
+		d0.opaqueSets[1] != "1" || len(d1.opaqueSets) != 1 {
+		t.Errorf("expected the opaques reset, got: %v, %v",
+			d0.opaqueSets, d1.opaqueSets)
+	}
+
+	// The rollbacks that follow the flush are quiet.
+	dest0.Rollback("0", 0)
+	dest1.Rollback("2", 0)
+	dest0.Rollback("1", 0)
+	if mgr.stats.TotSourceFlushed != 1 ||
+		mgr.stats.TotSourceFlushRollbackQuiet != 3 {
+		t.Errorf("expected quiet rollbacks, stats: %+v", mgr.stats)
+	}
+
+	mgr.removeSourceFlush("u")
+
+	mgr.SetOptions(map[string]string{"sourceFlushDetectDisable": "true"})
+	if mgr.wrapFlushDest(p0, p0.Dest) != p0.Dest {
+		t.Errorf("expected no flushDest when disabled")
+	}
+}
@@ -0,0 +1,130 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PIndexStatus is the detailed status of a pindex on this node, which
+// aggregates its meta, plan, feed, stats, disk usage and events.
+type PIndexStatus struct {
+	PIndex *PIndex `json:"pindex"` // The pindex's meta.
+
+	// SourcePartitions are the pindex's source partitions, sorted.
+	SourcePartitions []string `json:"sourcePartitions"`
+
+	// Seqs are the last seqs that the Dest persisted, keyed by
+	// source partition, from Dest.OpaqueGet().
+	Seqs map[string]uint64 `json:"seqs"`
+
+	// Feeds are the names of the feeds sending to the pindex.
+	Feeds []string `json:"feeds"`
+
+	// PlanNode is this node's assignment in the planPIndex, if any.
+	PlanNode *PlanPIndexNode `json:"planNode,omitempty"`
+
+	DestStats json.RawMessage `json:"destStats,omitempty"`
+
+	DiskSize int64 `json:"diskSize"` // Bytes used by the pindex's path.
+
+	// LastErr is the most recent error event about the pindex, if
+	// any, such as from its write circuit breaker.
+	LastErr string `json:"lastErr,omitempty"`
+}
+
+// PIndexStatus returns the detailed status of a pindex, so that
+// callers needn't correlate the stats, events and plan by hand.
+func (mgr *Manager) PIndexStatus(pindexName string) (*PIndexStatus, error) {
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		return nil, fmt.Errorf("pindex_status: no pindex, name: %s",
+			pindexName)
+	}
+
+	rv := &PIndexStatus{
+		PIndex:           pindex,
+		SourcePartitions: []string{},
+		Seqs:             map[string]uint64{},
+		Feeds:            []string{},
+	}
+
+	for _, partition := range strings.Split(pindex.SourcePartitions, ",") {
+		if partition != "" {
+			rv.SourcePartitions = append(rv.SourcePartitions, partition)
+		}
+	}
+	sort.Strings(rv.SourcePartitions)
+
+	if pindex.Dest != nil {
+		for _, partition := range rv.SourcePartitions {
+			_, lastSeq, err := pindex.Dest.OpaqueGet(partition)
+			if err == nil {
+				rv.Seqs[partition] = lastSeq
+			}
+		}
+
+		var buf bytes.Buffer
+		if pindex.Dest.Stats(&buf) == nil && json.Valid(buf.Bytes()) {
+			rv.DestStats = buf.Bytes()
+		}
+
+		feeds, _ := mgr.CurrentMaps()
+		for _, feed := range feeds {
+			for _, dest := range feed.Dests() {
+				if unwrapFeedDest(dest) == pindex.Dest {
+					rv.Feeds = append(rv.Feeds, feed.Name())
+					break
+				}
+			}
+		}
+		sort.Strings(rv.Feeds)
+	}
+
+	planPIndexes, _, err := mgr.GetPlanPIndexes(false)
+	if err == nil && planPIndexes != nil {
+		planPIndex := planPIndexes.PlanPIndexes[pindex.Name]
+		if planPIndex != nil {
+			rv.PlanNode = planPIndex.Nodes[mgr.uuid]
+		}
+	}
+
+	if pindex.Path != "" {
+		filepath.Walk(pindex.Path,
+			func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					rv.DiskSize += info.Size()
+				}
+				return nil
+			})
+	}
+
+	mgr.VisitEvents(func(event []byte) {
+		var e struct {
+			PIndex string `json:"pindex"`
+			Name   string `json:"name"`
+			Err    string `json:"err"`
+		}
+		if json.Unmarshal(event, &e) == nil && e.Err != "" &&
+			(e.PIndex == pindex.Name || e.Name == pindex.Name) {
+			rv.LastErr = e.Err
+		}
+	})
+
+	return rv, nil
+}
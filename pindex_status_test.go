@@ -0,0 +1,76 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManagerPIndexStatus(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+
+	go func() {
+		for r := range m.plannerCh {
+			close(r.resCh)
+		}
+	}()
+
+	if _, err := m.PIndexStatus("not-a-pindex"); err == nil {
+		t.Errorf("expected err on an unknown pindex")
+	}
+
+	if err := m.CreateIndex("primary", "default", "123", "{}",
+		"blackhole", "x", "{}", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	if _, err := m.PlannerOnce("test"); err != nil {
+		t.Fatalf("expected PlannerOnce() to work, err: %v", err)
+	}
+	if err := m.JanitorOnce("test"); err != nil {
+		t.Fatalf("expected JanitorOnce() to work, err: %v", err)
+	}
+
+	_, pindexes := m.CurrentMaps()
+	if len(pindexes) != 1 {
+		t.Fatalf("expected 1 pindex, got: %#v", pindexes)
+	}
+	var pindex *PIndex
+	for _, p := range pindexes {
+		pindex = p
+	}
+
+	m.AddEvent([]byte(`{"event":"x","pindex":"` + pindex.Name +
+		`","err":"oops"}`))
+	m.AddEvent([]byte(`{"event":"x","pindex":"other","err":"not-mine"}`))
+
+	s, err := m.PIndexStatus(pindex.Name)
+	if err != nil {
+		t.Fatalf("expected PIndexStatus() to work, err: %v", err)
+	}
+	if s.PIndex != pindex || len(s.Feeds) != 1 || s.PlanNode == nil ||
+		len(s.Seqs) != len(s.SourcePartitions) {
+		t.Errorf("unexpected status: %#v", s)
+	}
+	if s.LastErr != "oops" {
+		t.Errorf("expected the pindex's last err, got: %q", s.LastErr)
+	}
+}
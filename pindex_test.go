@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 
 	"reflect"
@@ -35,11 +36,12 @@ func TestNewPIndex(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
 
+	path, _ := pIndexPath(emptyDir, "fake")
+
 	pindex, err := NewPIndex(nil, "fake", "uuid",
 		"blackhole", "indexName", "indexUUID", "",
 		"sourceType", "sourceName", "sourceUUID",
-		"sourceParams", "sourcePartitions",
-		pIndexPath(emptyDir, "fake"))
+		"sourceParams", "sourcePartitions", path)
 	if pindex == nil || err != nil {
 		t.Errorf("expected NewPIndex to work")
 	}
@@ -53,11 +55,12 @@ func TestClonePIndex(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
 
+	path, _ := pIndexPath(emptyDir, "fake")
+
 	pindex, err := NewPIndex(nil, "fake", "uuid",
 		"blackhole", "indexName", "indexUUID", "",
 		"sourceType", "sourceName", "sourceUUID",
-		"sourceParams", "sourcePartitions",
-		pIndexPath(emptyDir, "fake"))
+		"sourceParams", "sourcePartitions", path)
 	if pindex == nil || err != nil {
 		t.Errorf("expected NewPIndex to work")
 	}
@@ -157,7 +160,7 @@ func TestBlackholePIndexImpl(t *testing.T) {
 		t.Errorf("expected nothing from blackhole.OpaqueGet()")
 	}
 
-	bt := PIndexImplTypes["blackhole"]
+	bt := GetPIndexImplType("blackhole")
 	if bt == nil {
 		t.Errorf("expected blackhole in PIndexImplTypes")
 	}
@@ -170,6 +173,44 @@ func TestBlackholePIndexImpl(t *testing.T) {
 	if bt.Query != nil {
 		t.Errorf("expected blackhole query nil")
 	}
+	if GetPIndexImplCapabilities("blackhole").SupportsCount {
+		t.Errorf("expected blackhole to not support count")
+	}
+}
+
+func TestRegisterPIndexImplTypeConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		indexType := fmt.Sprintf("hottest%d", i)
+		wg.Add(2)
+		go func() {
+			RegisterPIndexImplType(indexType, &PIndexImplType{
+				Capabilities: PIndexImplCapabilities{SupportsCount: true},
+			})
+			wg.Done()
+		}()
+		go func() {
+			GetPIndexImplType(indexType)
+			PIndexImplTypeNames()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		indexType := fmt.Sprintf("hottest%d", i)
+		if !GetPIndexImplCapabilities(indexType).SupportsCount {
+			t.Errorf("expected registered capabilities, indexType: %s",
+				indexType)
+		}
+		UnregisterPIndexImplType(indexType)
+		if GetPIndexImplType(indexType) != nil {
+			t.Errorf("expected unregistered, indexType: %s", indexType)
+		}
+	}
+	if (GetPIndexImplCapabilities("not-a-type") != PIndexImplCapabilities{}) {
+		t.Errorf("expected no capabilities for an unknown type")
+	}
 }
 
 func TestErrorConsistencyWait(t *testing.T) {
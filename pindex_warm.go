@@ -0,0 +1,113 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// WarmingPIndexes returns the sorted names of the local pindexes that
+// are still in the "warming" state; see PIndexImplType.Warm.
+func (mgr *Manager) WarmingPIndexes() []string {
+	mgr.m.RLock()
+	rv := make([]string, 0, len(mgr.warmingPIndexes))
+	for name := range mgr.warmingPIndexes {
+		rv = append(rv, name)
+	}
+	mgr.m.RUnlock()
+
+	sort.Strings(rv)
+
+	return rv
+}
+
+// warmPIndexLOCKED puts a newly registered pindex into the warming
+// state and asynchronously invokes its PIndexImplType.Warm callback,
+// if the pindex implementation has one.
+func (mgr *Manager) warmPIndexLOCKED(pindex *PIndex) {
+	pindexImplType := GetPIndexImplType(pindex.IndexType)
+	if pindexImplType == nil || pindexImplType.Warm == nil {
+		return
+	}
+
+	atomic.AddUint64(&mgr.stats.TotWarmPIndex, 1)
+
+	mgr.setWarmingPIndexLOCKED(pindex.Name, pindex)
+
+	go mgr.runWarmPIndex(pindexImplType.Warm, pindex)
+}
+
+// runWarmPIndex invokes the warm callback and then exposes the pindex
+// to CoveringPIndexes().  A pindex whose warming failed is exposed
+// anyways, as it's still usable, but cold.
+func (mgr *Manager) runWarmPIndex(
+	warm func(mgr *Manager, pindex *PIndex) error, pindex *PIndex) {
+	startTime := Now()
+
+	err := warm(mgr, pindex)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotWarmPIndexErr, 1)
+
+		mgr.log.Warnf("pindex_warm: warm failed, pindex: %s, err: %v",
+			pindex.Name, err)
+	} else {
+		atomic.AddUint64(&mgr.stats.TotWarmPIndexOk, 1)
+	}
+
+	mgr.m.Lock()
+	warmed := mgr.warmingPIndexes[pindex.Name] == pindex
+	if warmed {
+		mgr.setWarmingPIndexLOCKED(pindex.Name, nil)
+		mgr.coveringCache = nil
+	}
+	mgr.m.Unlock()
+
+	if !warmed {
+		return // The pindex was concurrently unregistered.
+	}
+
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	event, _ := json.Marshal(struct {
+		Event      string `json:"event"`
+		Name       string `json:"name"`
+		DurationMS int64  `json:"durationMS"`
+		Err        string `json:"err,omitempty"`
+		Time       string `json:"time"`
+	}{"warmPIndex", pindex.Name,
+		int64(Now().Sub(startTime) / time.Millisecond), errStr,
+		Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+}
+
+// setWarmingPIndexLOCKED updates the copy-on-write warmingPIndexes,
+// where a nil pindex removes the entry.
+func (mgr *Manager) setWarmingPIndexLOCKED(name string, pindex *PIndex) {
+	warmingPIndexes := make(map[string]*PIndex, len(mgr.warmingPIndexes)+1)
+	for k, v := range mgr.warmingPIndexes {
+		warmingPIndexes[k] = v
+	}
+
+	if pindex != nil {
+		warmingPIndexes[name] = pindex
+	} else {
+		delete(warmingPIndexes, name)
+	}
+
+	mgr.warmingPIndexes = warmingPIndexes
+}
@@ -0,0 +1,79 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManagerWarmPIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	warmCh := make(chan struct{})
+
+	RegisterPIndexImplType("warmtest", &PIndexImplType{
+		New:       NewBlackHolePIndexImpl,
+		Open:      OpenBlackHolePIndexImpl,
+		OpenUsing: OpenBlackHolePIndexImplUsing,
+		Warm: func(mgr *Manager, pindex *PIndex) error {
+			<-warmCh
+			return nil
+		},
+	})
+	defer UnregisterPIndexImplType("warmtest")
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	sourceParams := "{\"numPartitions\":1}"
+	if err := m.CreateIndex("primary", "default", "123", sourceParams,
+		"warmtest", "foo", "", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	warming := m.WarmingPIndexes()
+	if len(warming) != 1 {
+		t.Fatalf("expected 1 warming pindex, got: %v", warming)
+	}
+
+	// With no other node to serve it, the warming pindex is used.
+	localPIndexes, _, missing, err := m.CoveringPIndexesEx(
+		CoveringPIndexesSpec{IndexName: "foo"}, PlanPIndexNodeOk, false)
+	if err != nil || len(localPIndexes) != 1 || len(missing) != 0 {
+		t.Errorf("expected warming local pindex, got: %v, %v, %v",
+			localPIndexes, missing, err)
+	}
+
+	close(warmCh)
+
+	for i := 0; i < 100 && len(m.WarmingPIndexes()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(m.WarmingPIndexes()) != 0 {
+		t.Errorf("expected warming to be done")
+	}
+	if atomic.LoadUint64(&m.stats.TotWarmPIndexOk) != 1 {
+		t.Errorf("expected 1 warmed pindex, got: %d",
+			atomic.LoadUint64(&m.stats.TotWarmPIndexOk))
+	}
+}
@@ -0,0 +1,185 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A PlanDistribution is a balance report of a plan, with the pindex
+// counts of each index per node, which mirrors the planner's warnings
+// for operators.
+type PlanDistribution struct {
+	PlanPIndexesUUID string                        `json:"planPIndexesUUID"`
+	Indexes          map[string]*IndexDistribution `json:"indexes"` // Keyed by index name.
+}
+
+// An IndexDistribution is the balance of an index's pindexes.
+type IndexDistribution struct {
+	Nodes map[string]*NodeDistribution `json:"nodes"` // Keyed by node UUID.
+
+	// PrimarySkew and ReplicaSkew are the percentages by which the
+	// most loaded node exceeds an even distribution of the primary
+	// and replica pindexes across the pindex nodes, where 0 is even.
+	PrimarySkew float64 `json:"primarySkew"`
+	ReplicaSkew float64 `json:"replicaSkew"`
+
+	// RackCoverage is the percentage of the replicated pindexes whose
+	// nodes span more than one rack, or -1 when the nodes have no
+	// racks or the index has no replicas.  The SameRackPIndexes are
+	// the replicated pindexes whose nodes are all in one rack.
+	RackCoverage     float64  `json:"rackCoverage"`
+	SameRackPIndexes []string `json:"sameRackPIndexes,omitempty"`
+
+	// Warnings are the planner's warnings for the index.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// A NodeDistribution counts an index's pindexes on a node.
+type NodeDistribution struct {
+	Primary int `json:"primary"`
+	Replica int `json:"replica"`
+}
+
+// CalcPlanDistribution returns the balance report of a plan, where
+// the pindex nodes of the nodeDefs, which may be nil, are included
+// even when they have no pindexes.  A node's rack is the last level of
+// its container, as with the planner's node hierarchy.
+func CalcPlanDistribution(nodeDefs *NodeDefs,
+	planPIndexes *PlanPIndexes) *PlanDistribution {
+	rv := &PlanDistribution{Indexes: map[string]*IndexDistribution{}}
+	if planPIndexes == nil {
+		return rv
+	}
+	rv.PlanPIndexesUUID = planPIndexes.UUID
+
+	racks := map[string]string{} // Keyed by node UUID.
+	var nodeUUIDs []string
+	for _, nodeUUID := range sortedNodeUUIDs(nodeDefs) {
+		nodeDef := nodeDefs.NodeDefs[nodeUUID]
+		tags := StringsToMap(nodeDef.Tags)
+		if tags != nil && !tags["pindex"] {
+			continue
+		}
+		nodeUUIDs = append(nodeUUIDs, nodeUUID)
+
+		ancestors := strings.Split(nodeDef.Container, "/")
+		if rack := ancestors[len(ancestors)-1]; rack != "" {
+			racks[nodeUUID] = rack
+		}
+	}
+
+	index := func(indexName string) *IndexDistribution {
+		d := rv.Indexes[indexName]
+		if d == nil {
+			d = &IndexDistribution{
+				Nodes:    map[string]*NodeDistribution{},
+				Warnings: planPIndexes.Warnings[indexName],
+			}
+			for _, nodeUUID := range nodeUUIDs {
+				d.Nodes[nodeUUID] = &NodeDistribution{}
+			}
+			rv.Indexes[indexName] = d
+		}
+		return d
+	}
+
+	replicated := map[string]int{} // Keyed by index name.
+	spanning := map[string]int{}   // Keyed by index name.
+
+	for _, planPIndex := range sortedPlanPIndexes(planPIndexes) {
+		d := index(planPIndex.IndexName)
+
+		planPIndexRacks := map[string]bool{}
+		for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+			n := d.Nodes[nodeUUID]
+			if n == nil {
+				n = &NodeDistribution{}
+				d.Nodes[nodeUUID] = n
+			}
+			if planPIndexNode.Priority <= 0 {
+				n.Primary++
+			} else {
+				n.Replica++
+			}
+			planPIndexRacks[racks[nodeUUID]] = true
+		}
+
+		if len(planPIndex.Nodes) > 1 {
+			replicated[planPIndex.IndexName]++
+			if len(planPIndexRacks) > 1 {
+				spanning[planPIndex.IndexName]++
+			} else {
+				d.SameRackPIndexes =
+					append(d.SameRackPIndexes, planPIndex.Name)
+			}
+		}
+	}
+
+	for indexName, d := range rv.Indexes {
+		var primaries, replicas []int
+		for _, n := range d.Nodes {
+			primaries = append(primaries, n.Primary)
+			replicas = append(replicas, n.Replica)
+		}
+		d.PrimarySkew = distributionSkew(primaries)
+		d.ReplicaSkew = distributionSkew(replicas)
+
+		d.RackCoverage = -1
+		if len(racks) > 0 && replicated[indexName] > 0 {
+			d.RackCoverage = 100 * float64(spanning[indexName]) /
+				float64(replicated[indexName])
+		} else {
+			d.SameRackPIndexes = nil
+		}
+	}
+
+	return rv
+}
+
+// distributionSkew returns the percentage by which the largest count
+// exceeds the mean count.
+func distributionSkew(counts []int) float64 {
+	if len(counts) == 0 {
+		return 0
+	}
+	tot, max := 0, 0
+	for _, c := range counts {
+		tot += c
+		if c > max {
+			max = c
+		}
+	}
+	if tot == 0 {
+		return 0
+	}
+	mean := float64(tot) / float64(len(counts))
+	return 100 * (float64(max) - mean) / mean
+}
+
+// PlanDistribution returns the balance report of the current plan.
+func (mgr *Manager) PlanDistribution() (*PlanDistribution, error) {
+	nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_WANTED)
+	if err != nil {
+		return nil, fmt.Errorf("plan_distribution: could not get"+
+			" nodeDefs, err: %v", err)
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("plan_distribution: could not get"+
+			" planPIndexes, err: %v", err)
+	}
+
+	return CalcPlanDistribution(nodeDefs, planPIndexes), nil
+}
@@ -0,0 +1,73 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCalcPlanDistribution(t *testing.T) {
+	nodeDefs := NewNodeDefs(Version)
+	nodeDefs.NodeDefs["a"] = &NodeDef{UUID: "a", Container: "dc/r0"}
+	nodeDefs.NodeDefs["b"] = &NodeDef{UUID: "b", Container: "dc/r0"}
+	nodeDefs.NodeDefs["c"] = &NodeDef{UUID: "c", Container: "dc/r1"}
+	nodeDefs.NodeDefs["q"] = &NodeDef{UUID: "q", Tags: []string{"queryer"}}
+
+	p := NewPlanPIndexes(Version)
+	p.UUID = "planUUID"
+	p.PlanPIndexes["x_0"] = &PlanPIndex{Name: "x_0", IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{"a": {}, "b": {Priority: 1}}}
+	p.PlanPIndexes["x_1"] = &PlanPIndex{Name: "x_1", IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{"a": {}, "c": {Priority: 1}}}
+	p.PlanPIndexes["x_2"] = &PlanPIndex{Name: "x_2", IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{"c": {}, "a": {Priority: 1}}}
+	p.PlanPIndexes["y_0"] = &PlanPIndex{Name: "y_0", IndexName: "y",
+		Nodes: map[string]*PlanPIndexNode{"b": {}}}
+	p.Warnings["x"] = []string{"some warning"}
+
+	d := CalcPlanDistribution(nodeDefs, p)
+	if d.PlanPIndexesUUID != "planUUID" || len(d.Indexes) != 2 {
+		t.Fatalf("unexpected distribution: %+v", d)
+	}
+
+	x := d.Indexes["x"]
+	expNodes := map[string]*NodeDistribution{
+		"a": {Primary: 2, Replica: 1},
+		"b": {Primary: 0, Replica: 1},
+		"c": {Primary: 1, Replica: 1},
+	}
+	if !reflect.DeepEqual(x.Nodes, expNodes) {
+		t.Errorf("unexpected x nodes: %+v", x.Nodes)
+	}
+	if x.PrimarySkew != 100 || x.ReplicaSkew != 0 {
+		t.Errorf("unexpected x skews: %+v", x)
+	}
+	if x.RackCoverage < 66 || x.RackCoverage > 67 ||
+		!reflect.DeepEqual(x.SameRackPIndexes, []string{"x_0"}) {
+		t.Errorf("unexpected x rack coverage: %+v", x)
+	}
+	if !reflect.DeepEqual(x.Warnings, []string{"some warning"}) {
+		t.Errorf("unexpected x warnings: %+v", x.Warnings)
+	}
+
+	y := d.Indexes["y"]
+	if len(y.Nodes) != 3 || y.Nodes["b"].Primary != 1 ||
+		y.PrimarySkew < 199.9 || y.PrimarySkew > 200.1 || y.RackCoverage != -1 {
+		t.Errorf("unexpected y: %+v", y)
+	}
+
+	d = CalcPlanDistribution(nil, nil)
+	if d == nil || len(d.Indexes) != 0 {
+		t.Errorf("expected empty distribution, got: %+v", d)
+	}
+}
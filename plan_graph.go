@@ -0,0 +1,229 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A PlanGraph is a plan as a graph, for visualizing the placement and
+// the replica spread, where the nodes and the pindexes are vertices,
+// and each assignment of a pindex to a node is an edge.  A PlanGraph
+// marshals to JSON, and see WritePlanGraphDOT() for graphviz.
+type PlanGraph struct {
+	Nodes    []*PlanGraphNode   `json:"nodes"`
+	Indexes  []*PlanGraphIndex  `json:"indexes"`
+	PIndexes []*PlanGraphPIndex `json:"pindexes"`
+	Edges    []*PlanGraphEdge   `json:"edges"`
+}
+
+// A PlanGraphNode is a node vertex of a PlanGraph.
+type PlanGraphNode struct {
+	UUID      string `json:"uuid"`
+	HostPort  string `json:"hostPort,omitempty"`
+	Container string `json:"container,omitempty"`
+
+	// Unknown is true for a node of the plan that's not in the
+	// nodeDefs, such as a removed node.
+	Unknown bool `json:"unknown,omitempty"`
+
+	Primaries int `json:"primaries"`
+	Replicas  int `json:"replicas"`
+}
+
+// A PlanGraphIndex groups the pindexes of an index.
+type PlanGraphIndex struct {
+	Name        string   `json:"name"`
+	UUID        string   `json:"uuid"`
+	Type        string   `json:"type"`
+	NumReplicas int      `json:"numReplicas"`
+	PIndexes    []string `json:"pindexes"` // PlanPIndex names.
+}
+
+// A PlanGraphPIndex is a pindex vertex of a PlanGraph.
+type PlanGraphPIndex struct {
+	Name             string `json:"name"`
+	IndexName        string `json:"indexName"`
+	SourcePartitions string `json:"sourcePartitions"`
+}
+
+// A PlanGraphEdge assigns a pindex to a node, as a primary when the
+// Priority is 0, or else as a replica.
+type PlanGraphEdge struct {
+	PIndex   string `json:"pindex"`
+	Node     string `json:"node"`
+	Priority int    `json:"priority"`
+	CanRead  bool   `json:"canRead"`
+	CanWrite bool   `json:"canWrite"`
+}
+
+// CalcPlanGraph returns the PlanGraph of the planPIndexes, optionally
+// of only the pindexes of an index when the indexName is non-empty.
+// The indexDefs and nodeDefs may be nil, where the nodes of the
+// nodeDefs that have no pindexes are still included.
+func CalcPlanGraph(indexDefs *IndexDefs, nodeDefs *NodeDefs,
+	planPIndexes *PlanPIndexes, indexName string) *PlanGraph {
+	rv := &PlanGraph{
+		Nodes:    []*PlanGraphNode{},
+		Indexes:  []*PlanGraphIndex{},
+		PIndexes: []*PlanGraphPIndex{},
+		Edges:    []*PlanGraphEdge{},
+	}
+
+	nodes := map[string]*PlanGraphNode{}
+	for _, nodeUUID := range sortedNodeUUIDs(nodeDefs) {
+		nodeDef := nodeDefs.NodeDefs[nodeUUID]
+		nodes[nodeUUID] = &PlanGraphNode{
+			UUID:      nodeUUID,
+			HostPort:  nodeDef.HostPort,
+			Container: nodeDef.Container,
+		}
+	}
+
+	indexes := map[string]*PlanGraphIndex{}
+
+	for _, planPIndex := range sortedPlanPIndexes(planPIndexes) {
+		if indexName != "" && planPIndex.IndexName != indexName {
+			continue
+		}
+
+		rv.PIndexes = append(rv.PIndexes, &PlanGraphPIndex{
+			Name:             planPIndex.Name,
+			IndexName:        planPIndex.IndexName,
+			SourcePartitions: planPIndex.SourcePartitions,
+		})
+
+		index := indexes[planPIndex.IndexName]
+		if index == nil {
+			index = &PlanGraphIndex{
+				Name:     planPIndex.IndexName,
+				UUID:     planPIndex.IndexUUID,
+				Type:     planPIndex.IndexType,
+				PIndexes: []string{},
+			}
+			if indexDefs != nil {
+				if indexDef := indexDefs.IndexDefs[index.Name]; indexDef != nil {
+					index.NumReplicas = indexDef.PlanParams.NumReplicas
+				}
+			}
+			indexes[index.Name] = index
+			rv.Indexes = append(rv.Indexes, index)
+		}
+		index.PIndexes = append(index.PIndexes, planPIndex.Name)
+
+		for _, nodeUUID := range planPIndexNodesByPriority(planPIndex) {
+			planPIndexNode := planPIndex.Nodes[nodeUUID]
+
+			node := nodes[nodeUUID]
+			if node == nil {
+				node = &PlanGraphNode{UUID: nodeUUID, Unknown: true}
+				nodes[nodeUUID] = node
+			}
+			if planPIndexNode.Priority <= 0 {
+				node.Primaries++
+			} else {
+				node.Replicas++
+			}
+
+			rv.Edges = append(rv.Edges, &PlanGraphEdge{
+				PIndex:   planPIndex.Name,
+				Node:     nodeUUID,
+				Priority: planPIndexNode.Priority,
+				CanRead:  planPIndexNode.CanRead,
+				CanWrite: planPIndexNode.CanWrite,
+			})
+		}
+	}
+
+	for _, node := range nodes {
+		rv.Nodes = append(rv.Nodes, node)
+	}
+	sort.Slice(rv.Nodes, func(i, j int) bool {
+		return rv.Nodes[i].UUID < rv.Nodes[j].UUID
+	})
+
+	return rv
+}
+
+// WritePlanGraphDOT writes a PlanGraph in the graphviz DOT format,
+// such as for "dot -Tsvg", where the pindexes are boxes that are
+// clustered by index, the nodes are ellipses that are clustered by
+// container, and the edges to the replicas are dashed.  A node of the
+// plan that's not in the nodeDefs is red.
+func WritePlanGraphDOT(w io.Writer, g *PlanGraph) error {
+	fmt.Fprintln(w, "digraph plan {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [fontsize=10];")
+
+	sourcePartitions := map[string]string{}
+	for _, planGraphPIndex := range g.PIndexes {
+		sourcePartitions[planGraphPIndex.Name] =
+			planGraphPIndex.SourcePartitions
+	}
+
+	for i, index := range g.Indexes {
+		fmt.Fprintf(w, "  subgraph cluster_index_%d {\n", i)
+		fmt.Fprintf(w, "    label=%q;\n", fmt.Sprintf("%s (%s), replicas: %d",
+			index.Name, index.Type, index.NumReplicas))
+		for _, name := range index.PIndexes {
+			fmt.Fprintf(w, "    %q [shape=box, label=%q];\n",
+				"pindex:"+name, name+"\n"+sourcePartitions[name])
+		}
+		fmt.Fprintln(w, "  }")
+	}
+
+	containers := []string{}
+	byContainer := map[string][]*PlanGraphNode{}
+	for _, node := range g.Nodes {
+		if byContainer[node.Container] == nil {
+			containers = append(containers, node.Container)
+		}
+		byContainer[node.Container] = append(byContainer[node.Container], node)
+	}
+	sort.Strings(containers)
+
+	for i, container := range containers {
+		indent := "  "
+		if container != "" {
+			fmt.Fprintf(w, "  subgraph cluster_container_%d {\n", i)
+			fmt.Fprintf(w, "    label=%q;\n", container)
+			indent = "    "
+		}
+		for _, node := range byContainer[container] {
+			label := fmt.Sprintf("%s\n%s\nP: %d, R: %d",
+				node.UUID, node.HostPort, node.Primaries, node.Replicas)
+			attrs := ""
+			if node.Unknown {
+				attrs = ", color=red"
+			}
+			fmt.Fprintf(w, "%s%q [shape=ellipse, label=%q%s];\n",
+				indent, "node:"+node.UUID, label, attrs)
+		}
+		if container != "" {
+			fmt.Fprintln(w, "  }")
+		}
+	}
+
+	for _, e := range g.Edges {
+		attrs := "style=bold"
+		if e.Priority > 0 {
+			attrs = fmt.Sprintf("style=dashed, label=\"R%d\"", e.Priority)
+		}
+		fmt.Fprintf(w, "  %q -> %q [%s];\n",
+			"pindex:"+e.PIndex, "node:"+e.Node, attrs)
+	}
+
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
@@ -0,0 +1,80 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPlanGraph(t *testing.T) {
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["x"] = &IndexDef{Name: "x",
+		PlanParams: PlanParams{NumReplicas: 1}}
+
+	nodeDefs := NewNodeDefs(Version)
+	nodeDefs.NodeDefs["a"] = &NodeDef{UUID: "a", HostPort: "h:1",
+		Container: "r0"}
+	nodeDefs.NodeDefs["b"] = &NodeDef{UUID: "b", HostPort: "h:2"}
+	nodeDefs.NodeDefs["idle"] = &NodeDef{UUID: "idle", HostPort: "h:3"}
+
+	p := NewPlanPIndexes(Version)
+	p.PlanPIndexes["x_0"] = &PlanPIndex{Name: "x_0", IndexName: "x",
+		IndexType: "blackhole", SourcePartitions: "0",
+		Nodes: map[string]*PlanPIndexNode{"a": {}, "b": {Priority: 1}}}
+	p.PlanPIndexes["x_1"] = &PlanPIndex{Name: "x_1", IndexName: "x",
+		IndexType: "blackhole", SourcePartitions: "1",
+		Nodes: map[string]*PlanPIndexNode{"b": {}, "gone": {Priority: 1}}}
+	p.PlanPIndexes["y_0"] = &PlanPIndex{Name: "y_0", IndexName: "y",
+		Nodes: map[string]*PlanPIndexNode{"a": {}}}
+
+	g := CalcPlanGraph(indexDefs, nodeDefs, p, "x")
+
+	if len(g.Indexes) != 1 || g.Indexes[0].NumReplicas != 1 ||
+		len(g.PIndexes) != 2 || len(g.Edges) != 4 {
+		t.Errorf("unexpected graph: %#v", g)
+	}
+
+	nodes := map[string]*PlanGraphNode{}
+	for _, node := range g.Nodes {
+		nodes[node.UUID] = node
+	}
+	if len(nodes) != 4 || nodes["idle"] == nil || !nodes["gone"].Unknown ||
+		nodes["b"].Primaries != 1 || nodes["b"].Replicas != 1 {
+		t.Errorf("unexpected nodes: %#v", nodes)
+	}
+
+	if _, err := json.Marshal(g); err != nil {
+		t.Errorf("expected a JSON graph, err: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WritePlanGraphDOT(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"digraph plan {",
+		`label="r0";`,
+		`"pindex:x_0" -> "node:a" [style=bold];`,
+		`"pindex:x_0" -> "node:b" [style=dashed, label="R1"];`,
+		`"node:gone" [shape=ellipse, label="gone\n\nP: 0, R: 1", color=red];`,
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected %q in output: %s", s, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "y_0") {
+		t.Errorf("expected only the x index, got: %s", buf.String())
+	}
+}
@@ -0,0 +1,286 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// The functions in this file render the Cfg's definitions and plans
+// in human readable form, for inspection tools that act as pure Cfg
+// clients.
+
+// WriteIndexDefs writes a table of the index definitions.
+func WriteIndexDefs(w io.Writer, indexDefs *IndexDefs) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tUUID\tSOURCE\tPARTITIONS/PINDEX\tREPLICAS")
+
+	if indexDefs != nil {
+		names := make([]string, 0, len(indexDefs.IndexDefs))
+		for name := range indexDefs.IndexDefs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			d := indexDefs.IndexDefs[name]
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s/%s\t%d\t%d\n",
+				d.Name, d.Type, d.UUID, d.SourceType, d.SourceName,
+				d.PlanParams.MaxPartitionsPerPIndex,
+				d.PlanParams.NumReplicas)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// WriteNodeDefs writes a table of the node definitions.
+func WriteNodeDefs(w io.Writer, nodeDefs *NodeDefs) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "UUID\tHOSTPORT\tCONTAINER\tWEIGHT\tTAGS")
+
+	for _, nodeUUID := range sortedNodeUUIDs(nodeDefs) {
+		n := nodeDefs.NodeDefs[nodeUUID]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n",
+			n.UUID, n.HostPort, n.Container, n.Weight,
+			strings.Join(n.Tags, ","))
+	}
+
+	return tw.Flush()
+}
+
+// WritePlanPIndexes writes a table of the planPIndexes, with their
+// nodes listed by priority.
+func WritePlanPIndexes(w io.Writer, planPIndexes *PlanPIndexes) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "PINDEX\tINDEX\tSOURCE PARTITIONS\tNODES")
+
+	for _, planPIndex := range sortedPlanPIndexes(planPIndexes) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			planPIndex.Name, planPIndex.IndexName,
+			planPIndex.SourcePartitions,
+			strings.Join(planPIndexNodesByPriority(planPIndex), ","))
+	}
+
+	return tw.Flush()
+}
+
+// WritePlacementTable writes a table of the pindex placement, with a
+// row per planPIndex and a column per node, where a cell is "P" for a
+// primary, "R<n>" for a replica of priority n, or "." for none.  A
+// last row counts the pindexes of each node.  The nodeDefs may be
+// nil, in which case the columns are the nodes of the plan.
+func WritePlacementTable(w io.Writer, planPIndexes *PlanPIndexes,
+	nodeDefs *NodeDefs) error {
+	nodeUUIDs := sortedNodeUUIDs(nodeDefs)
+	if nodeDefs == nil {
+		seen := map[string]bool{}
+		for _, planPIndex := range sortedPlanPIndexes(planPIndexes) {
+			for nodeUUID := range planPIndex.Nodes {
+				if !seen[nodeUUID] {
+					seen[nodeUUID] = true
+					nodeUUIDs = append(nodeUUIDs, nodeUUID)
+				}
+			}
+		}
+		sort.Strings(nodeUUIDs)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "PINDEX\t%s\n", strings.Join(nodeUUIDs, "\t"))
+
+	counts := make([]int, len(nodeUUIDs))
+
+	for _, planPIndex := range sortedPlanPIndexes(planPIndexes) {
+		cells := make([]string, len(nodeUUIDs))
+		for i, nodeUUID := range nodeUUIDs {
+			cells[i] = "."
+			if n := planPIndex.Nodes[nodeUUID]; n != nil {
+				cells[i] = "P"
+				if n.Priority > 0 {
+					cells[i] = fmt.Sprintf("R%d", n.Priority)
+				}
+				counts[i]++
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", planPIndex.Name,
+			strings.Join(cells, "\t"))
+	}
+
+	totals := make([]string, len(counts))
+	for i, count := range counts {
+		totals[i] = fmt.Sprintf("%d", count)
+	}
+	fmt.Fprintf(tw, "TOTAL\t%s\n", strings.Join(totals, "\t"))
+
+	return tw.Flush()
+}
+
+// ---------------------------------------------------------
+
+// A PlanDiff describes the differences between two plan snapshots.
+type PlanDiff struct {
+	Added   []string          `json:"added"`   // PlanPIndex names.
+	Removed []string          `json:"removed"` // PlanPIndex names.
+	Changed []*PlanPIndexDiff `json:"changed"`
+}
+
+// A PlanPIndexDiff describes how a planPIndex changed between two
+// plan snapshots.
+type PlanPIndexDiff struct {
+	Name         string   `json:"name"`
+	NodesAdded   []string `json:"nodesAdded,omitempty"`
+	NodesRemoved []string `json:"nodesRemoved,omitempty"`
+	NodesChanged []string `json:"nodesChanged,omitempty"` // Such as a priority.
+	DefChanged   bool     `json:"defChanged,omitempty"`
+}
+
+// Empty returns true when the plans are the same.
+func (d *PlanDiff) Empty() bool {
+	return len(d.Added) <= 0 && len(d.Removed) <= 0 && len(d.Changed) <= 0
+}
+
+// DiffPlanPIndexes compares two plan snapshots, where either may be
+// nil, ignoring any differences in UUID or ImplVersion.
+func DiffPlanPIndexes(a, b *PlanPIndexes) *PlanDiff {
+	rv := &PlanDiff{Added: []string{}, Removed: []string{},
+		Changed: []*PlanPIndexDiff{}}
+
+	am, bm := map[string]*PlanPIndex{}, map[string]*PlanPIndex{}
+	if a != nil {
+		am = a.PlanPIndexes
+	}
+	if b != nil {
+		bm = b.PlanPIndexes
+	}
+
+	for _, bp := range sortedPlanPIndexes(b) {
+		ap := am[bp.Name]
+		if ap == nil {
+			rv.Added = append(rv.Added, bp.Name)
+			continue
+		}
+
+		d := &PlanPIndexDiff{Name: bp.Name}
+
+		apc, bpc := *ap, *bp
+		apc.UUID, bpc.UUID = "", ""
+		apc.Nodes, bpc.Nodes = nil, nil
+		d.DefChanged = !SamePlanPIndex(&apc, &bpc)
+
+		for _, nodeUUID := range planPIndexNodesByPriority(bp) {
+			an := ap.Nodes[nodeUUID]
+			if an == nil {
+				d.NodesAdded = append(d.NodesAdded, nodeUUID)
+			} else if !reflect.DeepEqual(an, bp.Nodes[nodeUUID]) {
+				d.NodesChanged = append(d.NodesChanged, nodeUUID)
+			}
+		}
+		for _, nodeUUID := range planPIndexNodesByPriority(ap) {
+			if bp.Nodes[nodeUUID] == nil {
+				d.NodesRemoved = append(d.NodesRemoved, nodeUUID)
+			}
+		}
+
+		if d.DefChanged || len(d.NodesAdded) > 0 ||
+			len(d.NodesRemoved) > 0 || len(d.NodesChanged) > 0 {
+			rv.Changed = append(rv.Changed, d)
+		}
+	}
+
+	for _, ap := range sortedPlanPIndexes(a) {
+		if bm[ap.Name] == nil {
+			rv.Removed = append(rv.Removed, ap.Name)
+		}
+	}
+
+	return rv
+}
+
+// WritePlanDiff writes a PlanDiff in a unified diff-like form.
+func WritePlanDiff(w io.Writer, d *PlanDiff) error {
+	if d.Empty() {
+		_, err := fmt.Fprintln(w, "no differences")
+		return err
+	}
+
+	for _, name := range d.Removed {
+		fmt.Fprintf(w, "- %s\n", name)
+	}
+	for _, name := range d.Added {
+		fmt.Fprintf(w, "+ %s\n", name)
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(w, "~ %s\n", c.Name)
+		if c.DefChanged {
+			fmt.Fprintf(w, "    definition changed\n")
+		}
+		for _, nodeUUID := range c.NodesRemoved {
+			fmt.Fprintf(w, "    - node %s\n", nodeUUID)
+		}
+		for _, nodeUUID := range c.NodesAdded {
+			fmt.Fprintf(w, "    + node %s\n", nodeUUID)
+		}
+		for _, nodeUUID := range c.NodesChanged {
+			fmt.Fprintf(w, "    ~ node %s\n", nodeUUID)
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+func sortedNodeUUIDs(nodeDefs *NodeDefs) []string {
+	rv := []string{}
+	if nodeDefs != nil {
+		for nodeUUID := range nodeDefs.NodeDefs {
+			rv = append(rv, nodeUUID)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func sortedPlanPIndexes(planPIndexes *PlanPIndexes) []*PlanPIndex {
+	rv := []*PlanPIndex{}
+	if planPIndexes != nil {
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			rv = append(rv, planPIndex)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	return rv
+}
+
+// planPIndexNodesByPriority returns the node UUIDs of a planPIndex,
+// by priority and then by UUID.
+func planPIndexNodesByPriority(planPIndex *PlanPIndex) []string {
+	rv := make([]string, 0, len(planPIndex.Nodes))
+	for nodeUUID := range planPIndex.Nodes {
+		rv = append(rv, nodeUUID)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		pi := planPIndex.Nodes[rv[i]].Priority
+		pj := planPIndex.Nodes[rv[j]].Priority
+		if pi != pj {
+			return pi < pj
+		}
+		return rv[i] < rv[j]
+	})
+	return rv
+}
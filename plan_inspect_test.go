@@ -0,0 +1,112 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffPlanPIndexes(t *testing.T) {
+	a := NewPlanPIndexes(Version)
+	a.PlanPIndexes["x_0"] = &PlanPIndex{Name: "x_0", UUID: "u0",
+		Nodes: map[string]*PlanPIndexNode{"a": {}, "b": {Priority: 1}}}
+	a.PlanPIndexes["x_1"] = &PlanPIndex{Name: "x_1",
+		Nodes: map[string]*PlanPIndexNode{"a": {}}}
+	a.PlanPIndexes["x_2"] = &PlanPIndex{Name: "x_2",
+		Nodes: map[string]*PlanPIndexNode{"b": {}}}
+
+	b := NewPlanPIndexes(Version)
+	b.PlanPIndexes["x_0"] = &PlanPIndex{Name: "x_0", UUID: "changed",
+		Nodes: map[string]*PlanPIndexNode{"a": {Priority: 1}, "c": {}}}
+	b.PlanPIndexes["x_1"] = &PlanPIndex{Name: "x_1",
+		Nodes: map[string]*PlanPIndexNode{"a": {}}}
+	b.PlanPIndexes["x_3"] = &PlanPIndex{Name: "x_3",
+		Nodes: map[string]*PlanPIndexNode{"c": {}}}
+
+	d := DiffPlanPIndexes(a, b)
+	exp := &PlanDiff{
+		Added:   []string{"x_3"},
+		Removed: []string{"x_2"},
+		Changed: []*PlanPIndexDiff{{
+			Name:         "x_0",
+			NodesAdded:   []string{"c"},
+			NodesRemoved: []string{"b"},
+			NodesChanged: []string{"a"},
+		}},
+	}
+	if !reflect.DeepEqual(d, exp) {
+		t.Errorf("expected diff: %#v, got: %#v", exp, d)
+	}
+
+	var buf bytes.Buffer
+	WritePlanDiff(&buf, d)
+	for _, s := range []string{"- x_2\n", "+ x_3\n", "~ x_0\n", "+ node c"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected %q in diff output: %s", s, buf.String())
+		}
+	}
+
+	if !DiffPlanPIndexes(a, a).Empty() {
+		t.Errorf("expected no diff against itself")
+	}
+	if d = DiffPlanPIndexes(nil, b); len(d.Added) != 3 {
+		t.Errorf("expected all added from a nil plan, got: %#v", d)
+	}
+}
+
+func TestWritePlacementTable(t *testing.T) {
+	p := NewPlanPIndexes(Version)
+	p.PlanPIndexes["x_0"] = &PlanPIndex{Name: "x_0",
+		Nodes: map[string]*PlanPIndexNode{"a": {}, "b": {Priority: 1}}}
+	p.PlanPIndexes["x_1"] = &PlanPIndex{Name: "x_1",
+		Nodes: map[string]*PlanPIndexNode{"b": {}}}
+
+	var buf bytes.Buffer
+	if err := WritePlacementTable(&buf, p, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		rows = append(rows, strings.Fields(line))
+	}
+	exp := [][]string{
+		{"PINDEX", "a", "b"},
+		{"x_0", "P", "R1"},
+		{"x_1", ".", "P"},
+		{"TOTAL", "1", "2"},
+	}
+	if !reflect.DeepEqual(rows, exp) {
+		t.Errorf("expected table: %v, got: %v", exp, rows)
+	}
+}
+
+func TestWriteDefs(t *testing.T) {
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["x"] = &IndexDef{Name: "x", Type: "blackhole"}
+	nodeDefs := NewNodeDefs(Version)
+	nodeDefs.NodeDefs["a"] = &NodeDef{UUID: "a", HostPort: "h:1",
+		Tags: []string{"pindex"}}
+
+	var buf bytes.Buffer
+	WriteIndexDefs(&buf, indexDefs)
+	WriteNodeDefs(&buf, nodeDefs)
+	WritePlanPIndexes(&buf, nil)
+	for _, s := range []string{"blackhole", "h:1", "pindex", "PINDEX"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected %q in output: %s", s, buf.String())
+		}
+	}
+}
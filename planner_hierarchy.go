@@ -0,0 +1,133 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/blugelabs/blance"
+)
+
+// ValidateHierarchyRules checks that the HierarchyRules of the
+// PlanParams are only for the "replica" state, as a primary has no
+// copy to be placed relative to, and that each rule has levels that
+// leave some candidate nodes.
+func ValidateHierarchyRules(rules blance.HierarchyRules) error {
+	for stateName, stateRules := range rules {
+		if stateName != "replica" {
+			return fmt.Errorf("planner_hierarchy: unsupported state: %q,"+
+				" only the replica state has hierarchy rules", stateName)
+		}
+		for i, rule := range stateRules {
+			if rule == nil {
+				return fmt.Errorf("planner_hierarchy: rule #%d is nil", i)
+			}
+			if rule.IncludeLevel < 0 || rule.ExcludeLevel < 0 {
+				return fmt.Errorf("planner_hierarchy: rule #%d has a"+
+					" negative level", i)
+			}
+			if rule.ExcludeLevel >= rule.IncludeLevel {
+				return fmt.Errorf("planner_hierarchy: rule #%d excludes"+
+					" all the nodes it includes, excludeLevel: %d,"+
+					" includeLevel: %d", i, rule.ExcludeLevel,
+					rule.IncludeLevel)
+			}
+		}
+	}
+	return nil
+}
+
+// hierarchyRulesWarnings returns warnings for the replica hierarchy
+// rules that the placement of the planPIndexes doesn't satisfy, as
+// blance silently falls back to any node when a rule has no candidate
+// nodes in the current topology.  There's a warning per rule, rather
+// than per planPIndex.
+func hierarchyRulesWarnings(planPIndexesForIndex map[string]*PlanPIndex,
+	nodeHierarchy map[string]string,
+	hierarchyRules blance.HierarchyRules) (warnings []string) {
+	rules := hierarchyRules["replica"]
+	if len(rules) <= 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(planPIndexesForIndex))
+	for name := range planPIndexesForIndex {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	unsatisfied := make([]int, len(rules))
+	examples := make([]string, len(rules))
+	checked := make([]int, len(rules))
+
+	for _, name := range names {
+		refs := sortedPlanPIndexNodeRefs(planPIndexesForIndex[name].Nodes)
+		if len(refs) <= 0 || refs[0].Node.Priority != 0 {
+			continue
+		}
+		primary := refs[0].UUID
+
+		for i, ref := range refs[1:] {
+			if i >= len(rules) {
+				break
+			}
+			checked[i]++
+			if !hierarchyRuleSatisfied(primary, ref.UUID, rules[i],
+				nodeHierarchy) {
+				unsatisfied[i]++
+				if examples[i] == "" {
+					examples[i] = fmt.Sprintf("pindex: %s, primary: %s,"+
+						" replica: %s", name, primary, ref.UUID)
+				}
+			}
+		}
+	}
+
+	for i, rule := range rules {
+		if unsatisfied[i] > 0 {
+			warnings = append(warnings, fmt.Sprintf("hierarchy rule #%d"+
+				" of the replica state, includeLevel: %d, excludeLevel: %d,"+
+				" could not be satisfied by the node hierarchy for %d of"+
+				" %d pindexes, such as %s", i, rule.IncludeLevel,
+				rule.ExcludeLevel, unsatisfied[i], checked[i], examples[i]))
+		}
+	}
+
+	return warnings
+}
+
+// hierarchyRuleSatisfied returns true when a node is among the
+// candidates of a rule relative to the primary node: under the same
+// ancestor at the IncludeLevel, but not under the same ancestor at
+// the ExcludeLevel.
+func hierarchyRuleSatisfied(primary, node string, rule *blance.HierarchyRule,
+	nodeHierarchy map[string]string) bool {
+	include := hierarchyAncestor(primary, rule.IncludeLevel, nodeHierarchy)
+	if include == "" ||
+		include != hierarchyAncestor(node, rule.IncludeLevel, nodeHierarchy) {
+		return false
+	}
+	return hierarchyAncestor(primary, rule.ExcludeLevel, nodeHierarchy) !=
+		hierarchyAncestor(node, rule.ExcludeLevel, nodeHierarchy)
+}
+
+// hierarchyAncestor returns the ancestor of a node at a level, where
+// level 0 is the node itself, or "" when the level is past the top of
+// the node hierarchy.
+func hierarchyAncestor(node string, level int,
+	nodeHierarchy map[string]string) string {
+	for ; level > 0 && node != ""; level-- {
+		node = nodeHierarchy[node]
+	}
+	return node
+}
@@ -0,0 +1,101 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/blugelabs/blance"
+)
+
+func TestValidateHierarchyRules(t *testing.T) {
+	tests := []struct {
+		rules blance.HierarchyRules
+		ok    bool
+	}{
+		{nil, true},
+		{blance.HierarchyRules{"replica": {{IncludeLevel: 2, ExcludeLevel: 1}}}, true},
+		{blance.HierarchyRules{"replica": {{IncludeLevel: 1, ExcludeLevel: 0},
+			{IncludeLevel: 3, ExcludeLevel: 2}}}, true},
+		{blance.HierarchyRules{"primary": {{IncludeLevel: 2, ExcludeLevel: 1}}}, false},
+		{blance.HierarchyRules{"replica": {nil}}, false},
+		{blance.HierarchyRules{"replica": {{IncludeLevel: -1}}}, false},
+		{blance.HierarchyRules{"replica": {{IncludeLevel: 1, ExcludeLevel: 1}}}, false},
+		{blance.HierarchyRules{"replica": {{IncludeLevel: 1, ExcludeLevel: 2}}}, false},
+	}
+
+	for i, test := range tests {
+		err := ValidateHierarchyRules(test.rules)
+		if (err == nil) != test.ok {
+			t.Errorf("test: %d, rules: %v, ok: %v, err: %v",
+				i, test.rules, test.ok, err)
+		}
+	}
+}
+
+func TestBlancePlanPIndexesHierarchyWarnings(t *testing.T) {
+	// dc0/r0: a, b, dc0/r1: c.
+	nodeHierarchy := map[string]string{
+		"a": "r0", "b": "r0", "c": "r1", "r0": "dc0", "r1": "dc0",
+	}
+
+	plan := func(rules blance.HierarchyRules, numReplicas int,
+		nodes []string) []string {
+		indexDef := &IndexDef{Name: "x", UUID: "xx", PlanParams: PlanParams{
+			NumReplicas:    numReplicas,
+			HierarchyRules: rules,
+		}}
+
+		planPIndexesForIndex := map[string]*PlanPIndex{}
+		for i := 0; i < 4; i++ {
+			name := fmt.Sprintf("x_%d", i)
+			planPIndexesForIndex[name] = &PlanPIndex{
+				Name:             name,
+				IndexName:        "x",
+				SourcePartitions: fmt.Sprintf("%d", i),
+			}
+		}
+
+		return BlancePlanPIndexesEx("", indexDef,
+			planPIndexesForIndex, nil,
+			nodes, nodes, nil, nil, nodeHierarchy, nil)
+	}
+
+	// The default different rack rule is satisfiable.
+	if warnings := plan(nil, 1, []string{"a", "b", "c"}); len(warnings) > 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+
+	// Without the r1 rack, replicas land in the primary's rack.
+	warnings := plan(nil, 1, []string{"a", "b"})
+	if len(warnings) != 1 ||
+		!strings.HasPrefix(warnings[0], "hierarchy rule #0") ||
+		!strings.Contains(warnings[0], "for 4 of 4 pindexes") {
+		t.Errorf("expected a warning for the default rule, got: %v",
+			warnings)
+	}
+
+	// There's no level 3 ancestor, so a different datacenter rule
+	// can't be satisfied, while the first, different rack rule can be.
+	rules := blance.HierarchyRules{"replica": {
+		{IncludeLevel: 2, ExcludeLevel: 1},
+		{IncludeLevel: 3, ExcludeLevel: 2},
+	}}
+	warnings = plan(rules, 2, []string{"a", "b", "c"})
+	if len(warnings) != 1 ||
+		!strings.HasPrefix(warnings[0], "hierarchy rule #1") {
+		t.Errorf("expected a warning for the second rule, got: %v",
+			warnings)
+	}
+}
@@ -0,0 +1,138 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A plannerIncremental remembers the inputs of a manager's last
+// successful planning pass, so that the next pass can re-plan only
+// the indexes whose definitions changed.  This is only possible when
+// the plan in the Cfg is still the one from the last pass and when
+// the nodes, version and options are unchanged, as those affect the
+// plans of every index.  Otherwise, a full planning pass is done.
+//
+// An incremental pass may be disabled with the "plannerIncremental"
+// manager option set to "false".
+type plannerIncremental struct {
+	stats *ManagerStats
+
+	m         sync.Mutex // Protects the fields that follow.
+	planUUID  string     // The UUID of the plan of the last pass.
+	version   string
+	nodesSig  string
+	options   map[string]string
+	indexDefs map[string]*IndexDef
+}
+
+// filter returns the PlannerFilter for an incremental planning pass,
+// or nil when a full planning pass is needed.  For an unchanged index,
+// the filter copies the index's previous plan and returns false.
+func (p *plannerIncremental) filter(indexDefs *IndexDefs,
+	nodeDefs *NodeDefs, planPIndexesPrev *PlanPIndexes,
+	version string, options map[string]string) PlannerFilter {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.planUUID == "" ||
+		indexDefs == nil ||
+		nodeDefs == nil ||
+		planPIndexesPrev == nil ||
+		planPIndexesPrev.UUID != p.planUUID ||
+		p.version != version ||
+		p.nodesSig != plannerNodesSignature(nodeDefs) ||
+		!reflect.DeepEqual(p.options, options) ||
+		options["plannerHookName"] != "" {
+		atomic.AddUint64(&p.stats.TotPlannerFull, 1)
+		return nil
+	}
+
+	atomic.AddUint64(&p.stats.TotPlannerIncremental, 1)
+
+	indexDefsPrev := p.indexDefs
+
+	return func(indexDef *IndexDef,
+		planPIndexesPrev, planPIndexes *PlanPIndexes) bool {
+		indexDefPrev := indexDefsPrev[indexDef.Name]
+		if indexDefPrev == nil ||
+			indexDefPrev.UUID != indexDef.UUID ||
+			!reflect.DeepEqual(indexDefPrev, indexDef) {
+			return true
+		}
+
+		var copied bool
+		for name, planPIndex := range planPIndexesPrev.PlanPIndexes {
+			if planPIndex.IndexName == indexDef.Name &&
+				planPIndex.IndexUUID == indexDef.UUID {
+				planPIndexes.PlanPIndexes[name] = planPIndex
+				copied = true
+			}
+		}
+		if !copied {
+			return true // Such as an index that failed to be planned.
+		}
+
+		if warnings, exists := planPIndexesPrev.Warnings[indexDef.Name]; exists {
+			planPIndexes.Warnings[indexDef.Name] = warnings
+		}
+
+		atomic.AddUint64(&p.stats.TotPlannerIncrementalIndexSkipped, 1)
+
+		return false
+	}
+}
+
+// planned records the inputs of a successful planning pass, where
+// planUUID is the UUID of the plan that's now in the Cfg.
+func (p *plannerIncremental) planned(indexDefs *IndexDefs,
+	nodeDefs *NodeDefs, planUUID string,
+	version string, options map[string]string) {
+	p.m.Lock()
+	p.planUUID = planUUID
+	p.version = version
+	p.nodesSig = plannerNodesSignature(nodeDefs)
+	p.options = options
+	p.indexDefs = indexDefs.IndexDefs
+	p.m.Unlock()
+}
+
+// reset forces the next planning pass to be a full pass.
+func (p *plannerIncremental) reset() {
+	p.m.Lock()
+	p.planUUID = ""
+	p.indexDefs = nil
+	p.m.Unlock()
+}
+
+// plannerNodesSignature returns a string that changes whenever the
+// nodes change in a way that affects the planning.
+func plannerNodesSignature(nodeDefs *NodeDefs) string {
+	if nodeDefs == nil {
+		return ""
+	}
+
+	sigs := make([]string, 0, len(nodeDefs.NodeDefs))
+	for _, nodeDef := range nodeDefs.NodeDefs {
+		sigs = append(sigs, fmt.Sprintf("%s/%v/%d/%s/%t/%d", nodeDef.UUID,
+			nodeDef.Tags, nodeDef.Weight, nodeDef.Container,
+			nodeDef.NoAccept, nodeDef.MaxPIndexes))
+	}
+	sort.Strings(sigs)
+
+	return strings.Join(sigs, "\n")
+}
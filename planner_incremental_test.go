@@ -0,0 +1,115 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPlannerIncremental(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "dc/g0", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+
+	// Ack the planner kicks, so that only explicit PlannerOnce()
+	// calls do any planning.
+	go func() {
+		for r := range m.plannerCh {
+			close(r.resCh)
+		}
+	}()
+
+	sourceParams := "{\"numPartitions\":4}"
+	for _, name := range []string{"a", "b"} {
+		if err := m.CreateIndex("primary", "default", "123", sourceParams,
+			"blackhole", name, "{}", PlanParams{MaxPartitionsPerPIndex: 1},
+			""); err != nil {
+			t.Fatalf("expected CreateIndex() to work, err: %v", err)
+		}
+	}
+
+	var stats ManagerStats
+
+	changed, err := m.PlannerOnce("test")
+	if err != nil || !changed {
+		t.Fatalf("expected changed plan, err: %v", err)
+	}
+	m.StatsCopyTo(&stats)
+	if stats.TotPlannerFull != 1 || stats.TotPlannerIncremental != 0 {
+		t.Errorf("expected a full planning pass, stats: %#v", stats)
+	}
+
+	if err = m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", "c", "{}", PlanParams{MaxPartitionsPerPIndex: 1},
+		""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	changed, err = m.PlannerOnce("test")
+	if err != nil || !changed {
+		t.Fatalf("expected changed plan, err: %v", err)
+	}
+	m.StatsCopyTo(&stats)
+	if stats.TotPlannerIncremental != 1 ||
+		stats.TotPlannerIncrementalIndexSkipped != 2 {
+		t.Errorf("expected an incremental planning pass, stats: %#v", stats)
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(cfg)
+	if err != nil || len(planPIndexes.PlanPIndexes) != 12 {
+		t.Fatalf("expected 12 planPIndexes, got: %#v, err: %v",
+			planPIndexes, err)
+	}
+
+	// A full planning pass should find nothing to change.
+	m.options = map[string]string{"plannerIncremental": "false"}
+	changed, err = m.PlannerOnce("test")
+	if err != nil || changed {
+		t.Errorf("expected unchanged plan on full pass, err: %v", err)
+	}
+
+	// Re-enabled incremental planning starts with a full pass.
+	m.options = nil
+	m.PlannerOnce("test")
+	m.StatsCopyTo(&stats)
+	if stats.TotPlannerFull != 2 {
+		t.Errorf("expected a full planning pass, stats: %#v", stats)
+	}
+	m.PlannerOnce("test")
+	m.StatsCopyTo(&stats)
+	if stats.TotPlannerIncremental != 2 {
+		t.Errorf("expected an incremental planning pass, stats: %#v", stats)
+	}
+
+	// A changed node set leads to a full planning pass.
+	m2 := NewManager(Version, cfg, nil, NewUUID(), nil, "dc/g1", 1, "", ":1001",
+		emptyDir, "some-datasource", nil, nil)
+	if err = m2.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+	changed, err = m.PlannerOnce("test")
+	if err != nil || !changed {
+		t.Errorf("expected changed plan for new node, err: %v", err)
+	}
+	m.StatsCopyTo(&stats)
+	if stats.TotPlannerFull != 3 {
+		t.Errorf("expected a full planning pass, stats: %#v", stats)
+	}
+}
@@ -0,0 +1,168 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// A PlannerObservation is the outcome of a planner run in observer
+// mode.  When the "plannerObserve" manager option of a node is "true",
+// its planner computes the plans as usual, but only reports what it
+// would change, as a PlannerObservation, stats and events, and never
+// writes to the Cfg, not even to bump the Cfg version.  This allows
+// validating a new cbgt version or planner hook against the
+// production state before enabling it.
+type PlannerObservation struct {
+	Time   string `json:"time"`
+	Reason string `json:"reason"`
+
+	// Version is the effective Cfg version that was planned with.
+	Version string `json:"version"`
+
+	// PlanPIndexesUUID is the UUID of the current plan that the
+	// observed plan is compared to.
+	PlanPIndexesUUID string `json:"planPIndexesUUID"`
+
+	// Changed is true when the planner would have saved a new plan.
+	Changed bool      `json:"changed"`
+	Diff    *PlanDiff `json:"diff"`
+
+	// Warnings are the planner warnings of the observed plan, keyed
+	// by index name.
+	Warnings map[string][]string `json:"warnings,omitempty"`
+
+	Err string `json:"err,omitempty"`
+}
+
+// PlannerObservation returns the last PlannerObservation of the node,
+// or nil if the node's planner hasn't run in observer mode.
+func (mgr *Manager) PlannerObservation() *PlannerObservation {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	return mgr.plannerObservation
+}
+
+// plannerObserve is the observer mode variant of PlannerOnce().
+func (mgr *Manager) plannerObserve(reason string,
+	options map[string]string) error {
+	atomic.AddUint64(&mgr.stats.TotPlannerObserve, 1)
+
+	obs, err := ObservePlan(mgr.log, mgr.cfg, mgr.version, mgr.uuid,
+		mgr.server, options)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotPlannerObserveErr, 1)
+		obs = &PlannerObservation{Err: err.Error()}
+	}
+	obs.Time = Now().Format(time.RFC3339Nano)
+	obs.Reason = reason
+
+	mgr.m.Lock()
+	prev := mgr.plannerObservation
+	mgr.plannerObservation = obs
+	mgr.m.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if obs.Changed {
+		atomic.AddUint64(&mgr.stats.TotPlannerObserveChanged, 1)
+
+		mgr.log.Printf("planner: observe, would change the plan,"+
+			" added: %d, removed: %d, changed: %d, reason: %s",
+			len(obs.Diff.Added), len(obs.Diff.Removed),
+			len(obs.Diff.Changed), reason)
+	}
+
+	// Only the observations that differ from the last are emitted as
+	// events, as the planner often runs without any changes.
+	if prev != nil && prev.Changed == obs.Changed &&
+		prev.PlanPIndexesUUID == obs.PlanPIndexesUUID && prev.Err == "" {
+		return nil
+	}
+
+	eventBytes, _ := json.Marshal(struct {
+		Event            string `json:"event"`
+		PlanPIndexesUUID string `json:"planPIndexesUUID"`
+		Changed          bool   `json:"changed"`
+		Added            int    `json:"added"`
+		Removed          int    `json:"removed"`
+		Diffs            int    `json:"changedPIndexes"`
+		Warnings         int    `json:"warnings"`
+		Time             string `json:"time"`
+	}{"plannerObserved", obs.PlanPIndexesUUID, obs.Changed,
+		len(obs.Diff.Added), len(obs.Diff.Removed), len(obs.Diff.Changed),
+		len(obs.Warnings), obs.Time})
+	mgr.AddEvent(eventBytes)
+
+	mgr.PublishEvent(EVENT_CATEGORY_PLAN, obs)
+
+	return nil
+}
+
+// ObservePlan computes the plan that the planner would save, and
+// compares it to the current plan, without changing the Cfg.
+func ObservePlan(log Log, cfg Cfg, version, uuid, server string,
+	options map[string]string) (*PlannerObservation, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("planner_observer: nil cfg")
+	}
+
+	// Unlike PlannerGetPlan(), skip the PlannerCheckVersion(), which
+	// may bump the Cfg version.
+	indexDefs, err := PlannerGetIndexDefs(cfg, version)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeDefs, err := PlannerGetNodeDefs(cfg, version, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexesPrev, _, err := PlannerGetPlanPIndexes(cfg, version)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexes, _, version, err := plannerCalcPlan(log, cfg,
+		version, server, options, indexDefs, nodeDefs, planPIndexesPrev,
+		nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &PlannerObservation{
+		Version:          version,
+		PlanPIndexesUUID: planPIndexesPrev.UUID,
+		Changed:          !SamePlanPIndexes(planPIndexes, planPIndexesPrev),
+		Diff:             DiffPlanPIndexes(planPIndexesPrev, planPIndexes),
+	}
+
+	if planPIndexes != nil {
+		for indexName, warnings := range planPIndexes.Warnings {
+			if len(warnings) > 0 {
+				if rv.Warnings == nil {
+					rv.Warnings = map[string][]string{}
+				}
+				rv.Warnings[indexName] = warnings
+			}
+		}
+	}
+
+	return rv, nil
+}
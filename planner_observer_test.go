@@ -0,0 +1,89 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPlannerObserve(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	options := map[string]string{"plannerObserve": "true"}
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, options)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	if m.PlannerObservation() != nil {
+		t.Errorf("expected no observation before planning")
+	}
+
+	sourceParams := "{\"numPartitions\":4}"
+	planParams := PlanParams{MaxPartitionsPerPIndex: 1}
+	if err := m.CreateIndex("primary", "default", "123", sourceParams,
+		"blackhole", "foo", "{}", planParams, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+
+	changed, err := m.PlannerOnce("test")
+	if err != nil || changed {
+		t.Fatalf("expected an observing PlannerOnce, changed: %v, err: %v",
+			changed, err)
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(cfg)
+	if err != nil || planPIndexes != nil {
+		t.Errorf("expected no saved plan, planPIndexes: %#v, err: %v",
+			planPIndexes, err)
+	}
+
+	obs := m.PlannerObservation()
+	if obs == nil || !obs.Changed || obs.Err != "" || obs.Reason != "test" {
+		t.Fatalf("expected a changed observation, got: %#v", obs)
+	}
+	if len(obs.Diff.Added) != 4 || len(obs.Diff.Removed) != 0 {
+		t.Errorf("expected 4 added pindexes, got: %#v", obs.Diff)
+	}
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotPlannerObserve <= 0 || stats.TotPlannerObserveChanged <= 0 {
+		t.Errorf("expected observe stats, got: %#v", stats)
+	}
+
+	// Once observing is turned off, the planner saves the plan, which
+	// the observer then agrees with.
+	options2 := map[string]string{}
+	for k, v := range options {
+		options2[k] = v
+	}
+	options2["plannerObserve"] = "false"
+	m.SetOptions(options2)
+
+	changed, err = m.PlannerOnce("test")
+	if err != nil || !changed {
+		t.Fatalf("expected a saved plan, changed: %v, err: %v", changed, err)
+	}
+
+	obs, err = ObservePlan(m.log, cfg, Version, m.UUID(), m.server, options2)
+	if err != nil || obs.Changed || !obs.Diff.Empty() {
+		t.Errorf("expected an unchanged observation, got: %#v, err: %v",
+			obs, err)
+	}
+}
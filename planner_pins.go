@@ -0,0 +1,224 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/blugelabs/blance"
+)
+
+// A PIndexPin pins a PIndex to nodes, where the PIndex is identified
+// either by its planPIndex name or by a source partition that it
+// holds.  As a planPIndex name changes when the index definition is
+// updated, pinning by source partition is more durable.
+type PIndexPin struct {
+	PIndex          string `json:"pindex,omitempty"`
+	SourcePartition string `json:"sourcePartition,omitempty"`
+
+	// Nodes are the node UUIDs, where the first node is assigned the
+	// primary and the next nodes are assigned the replicas.  Copies
+	// beyond the pinned nodes are assigned by the planner.
+	Nodes []string `json:"nodes"`
+}
+
+// ValidatePIndexPins checks that each pin identifies its PIndex in
+// exactly one way and has at least one node.
+func ValidatePIndexPins(pins []*PIndexPin) error {
+	for i, pin := range pins {
+		if pin == nil {
+			return fmt.Errorf("planner_pins: pin #%d is nil", i)
+		}
+		if (pin.PIndex == "") == (pin.SourcePartition == "") {
+			return fmt.Errorf("planner_pins: pin #%d needs either"+
+				" a pindex or a sourcePartition", i)
+		}
+		if len(pin.Nodes) <= 0 {
+			return fmt.Errorf("planner_pins: pin #%d has no nodes", i)
+		}
+	}
+	return nil
+}
+
+// pinMatches returns true when the pin identifies the planPIndex.
+func (pin *PIndexPin) pinMatches(planPIndex *PlanPIndex) bool {
+	if pin.PIndex != "" {
+		return pin.PIndex == planPIndex.Name
+	}
+	for _, sourcePartition := range strings.Split(
+		planPIndex.SourcePartitions, ",") {
+		if sourcePartition == pin.SourcePartition {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPIndexPins reassigns the pinned planPIndexes of a blance map
+// to their pinned nodes, and returns warnings for the pins that
+// conflict, match no planPIndex, or name unavailable nodes.  When
+// several pins match a planPIndex, the first pin wins.
+func applyPIndexPins(indexDef *IndexDef,
+	planPIndexesForIndex map[string]*PlanPIndex,
+	nextMap blance.PartitionMap,
+	nodesNext []string,
+	model blance.PartitionModel) (warnings []string) {
+	pins := indexDef.PlanParams.PIndexPins
+
+	numCopies := model["primary"].Constraints
+	if model["replica"] != nil {
+		numCopies += model["replica"].Constraints
+	}
+
+	names := make([]string, 0, len(planPIndexesForIndex))
+	for name := range planPIndexesForIndex {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nodesNextMap := StringsToMap(nodesNext)
+
+	matched := make([]bool, len(pins))
+
+	for _, name := range names {
+		planPIndex := planPIndexesForIndex[name]
+		partition := nextMap[name]
+		if partition == nil {
+			continue
+		}
+
+		var pin *PIndexPin
+		for i, p := range pins {
+			if !p.pinMatches(planPIndex) {
+				continue
+			}
+			matched[i] = true
+			if pin == nil {
+				pin = p
+			} else if !reflect.DeepEqual(pin.Nodes, p.Nodes) {
+				warnings = append(warnings, fmt.Sprintf("conflicting pins,"+
+					" pindex: %s, using nodes: %v, ignoring nodes: %v",
+					name, pin.Nodes, p.Nodes))
+			}
+		}
+		if pin == nil {
+			continue
+		}
+
+		var nodes []string
+		for _, node := range pin.Nodes {
+			if !nodesNextMap[node] {
+				warnings = append(warnings, fmt.Sprintf("pinned node"+
+					" unavailable: %s, pindex: %s", node, name))
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+		nodes = StringsIntersectStrings(nodes, nodes) // Dedupe.
+		if len(nodes) <= 0 {
+			continue
+		}
+		if len(nodes) > numCopies {
+			warnings = append(warnings, fmt.Sprintf("pinned nodes: %v"+
+				" exceed the copies: %d, pindex: %s",
+				nodes, numCopies, name))
+			nodes = nodes[:numCopies]
+		}
+
+		// Fill any remaining copies from the computed assignment.
+		computed := append(append([]string(nil),
+			partition.NodesByState["primary"]...),
+			partition.NodesByState["replica"]...)
+		nodes = append(nodes, StringsRemoveStrings(computed, nodes)...)
+		if len(nodes) > numCopies {
+			nodes = nodes[:numCopies]
+		}
+
+		partition.NodesByState = map[string][]string{
+			"primary": nodes[:1],
+			"replica": nodes[1:],
+		}
+	}
+
+	for i, pin := range pins {
+		if !matched[i] {
+			warnings = append(warnings, fmt.Sprintf("pin matches no pindex,"+
+				" pindex: %q, sourcePartition: %q",
+				pin.PIndex, pin.SourcePartition))
+		}
+	}
+
+	return warnings
+}
+
+// ---------------------------------------------------------
+
+// PIndexPinStatus reports whether a pin of an index is satisfied by
+// the current plan.
+type PIndexPinStatus struct {
+	Pin          *PIndexPin `json:"pin"`
+	PlanPIndexes []string   `json:"planPIndexes"` // Names of the matches.
+	Satisfied    bool       `json:"satisfied"`
+}
+
+// GetIndexPins returns the status of each pin of an index against the
+// current plan, where a pin is satisfied when each matched planPIndex
+// has the pin's first node as its primary and has all the pin's nodes.
+func (mgr *Manager) GetIndexPins(indexName string) (
+	[]*PIndexPinStatus, error) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		return nil, fmt.Errorf("planner_pins: no index, indexName: %s",
+			indexName)
+	}
+
+	_, planPIndexesByName, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]*PIndexPinStatus, 0, len(indexDef.PlanParams.PIndexPins))
+	for _, pin := range indexDef.PlanParams.PIndexPins {
+		status := &PIndexPinStatus{Pin: pin, PlanPIndexes: []string{}}
+
+		satisfied := true
+		for _, planPIndex := range planPIndexesByName[indexName] {
+			if planPIndex.IndexUUID != indexDef.UUID ||
+				!pin.pinMatches(planPIndex) {
+				continue
+			}
+
+			status.PlanPIndexes = append(status.PlanPIndexes, planPIndex.Name)
+
+			for i, node := range pin.Nodes {
+				n := planPIndex.Nodes[node]
+				if n == nil || (i == 0 && n.Priority != 0) {
+					satisfied = false
+				}
+			}
+		}
+		sort.Strings(status.PlanPIndexes)
+
+		status.Satisfied = satisfied && len(status.PlanPIndexes) > 0
+
+		rv = append(rv, status)
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,153 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidatePIndexPins(t *testing.T) {
+	tests := []struct {
+		pins []*PIndexPin
+		ok   bool
+	}{
+		{nil, true},
+		{[]*PIndexPin{{PIndex: "p", Nodes: []string{"a"}}}, true},
+		{[]*PIndexPin{{SourcePartition: "0", Nodes: []string{"a"}}}, true},
+		{[]*PIndexPin{nil}, false},
+		{[]*PIndexPin{{Nodes: []string{"a"}}}, false},
+		{[]*PIndexPin{{PIndex: "p", SourcePartition: "0",
+			Nodes: []string{"a"}}}, false},
+		{[]*PIndexPin{{PIndex: "p"}}, false},
+	}
+	for i, test := range tests {
+		if err := ValidatePIndexPins(test.pins); (err == nil) != test.ok {
+			t.Errorf("test: %d, expected ok: %v, err: %v", i, test.ok, err)
+		}
+	}
+}
+
+func TestBlancePlanPIndexesPins(t *testing.T) {
+	nodes := []string{"n0", "n1", "n2", "n3"}
+
+	indexDef := &IndexDef{Name: "x", UUID: "xx", PlanParams: PlanParams{
+		NumReplicas: 1,
+		PIndexPins: []*PIndexPin{
+			{SourcePartition: "1", Nodes: []string{"n3", "n2"}},
+			{PIndex: "x_2", Nodes: []string{"n0"}},
+			{SourcePartition: "1", Nodes: []string{"n1"}},
+			{SourcePartition: "9", Nodes: []string{"n1"}},
+			{PIndex: "x_3", Nodes: []string{"nX"}},
+		},
+	}}
+
+	planPIndexesForIndex := map[string]*PlanPIndex{}
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("x_%d", i)
+		planPIndexesForIndex[name] = &PlanPIndex{
+			Name:             name,
+			IndexName:        "x",
+			SourcePartitions: fmt.Sprintf("%d", i),
+		}
+	}
+
+	warnings := BlancePlanPIndexes("", indexDef,
+		planPIndexesForIndex, nil, nodes, nodes, nil, nil, nil)
+
+	p1 := planPIndexesForIndex["x_1"]
+	if len(p1.Nodes) != 2 || p1.Nodes["n3"] == nil ||
+		p1.Nodes["n3"].Priority != 0 || p1.Nodes["n2"] == nil {
+		t.Errorf("expected x_1 pinned to n3 and n2, got: %#v", p1.Nodes)
+	}
+
+	p2 := planPIndexesForIndex["x_2"]
+	if len(p2.Nodes) != 2 || p2.Nodes["n0"] == nil ||
+		p2.Nodes["n0"].Priority != 0 {
+		t.Errorf("expected x_2 primary pinned to n0, got: %#v", p2.Nodes)
+	}
+
+	if len(planPIndexesForIndex["x_3"].Nodes) != 2 {
+		t.Errorf("expected x_3 to keep its computed nodes")
+	}
+
+	expWarnings := []string{"conflicting pins", "pinned node unavailable",
+		"pin matches no pindex"}
+	if len(warnings) != len(expWarnings) {
+		t.Fatalf("expected warnings: %v, got: %v", expWarnings, warnings)
+	}
+	for i, exp := range expWarnings {
+		if !strings.HasPrefix(warnings[i], exp) {
+			t.Errorf("expected warning: %q, got: %q", exp, warnings[i])
+		}
+	}
+}
+
+func TestManagerGetIndexPins(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+
+	go func() {
+		for r := range m.plannerCh {
+			close(r.resCh)
+		}
+	}()
+
+	if err := m.CreateIndex("primary", "default", "123",
+		"{\"numPartitions\":4}", "blackhole", "x", "{}", PlanParams{
+			MaxPartitionsPerPIndex: 1,
+			PIndexPins:             []*PIndexPin{{SourcePartition: "0"}},
+		}, ""); err == nil {
+		t.Errorf("expected CreateIndex() to fail on an invalid pin")
+	}
+
+	if err := m.CreateIndex("primary", "default", "123",
+		"{\"numPartitions\":4}", "blackhole", "x", "{}", PlanParams{
+			MaxPartitionsPerPIndex: 1,
+			PIndexPins: []*PIndexPin{
+				{SourcePartition: "0", Nodes: []string{m.UUID()}},
+				{SourcePartition: "1", Nodes: []string{"unknown"}},
+			},
+		}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	if _, err := m.PlannerOnce("test"); err != nil {
+		t.Fatalf("expected PlannerOnce() to work, err: %v", err)
+	}
+	m.GetPlanPIndexes(true)
+
+	statuses, err := m.GetIndexPins("x")
+	if err != nil || len(statuses) != 2 {
+		t.Fatalf("expected 2 pin statuses, got: %#v, err: %v", statuses, err)
+	}
+	if !statuses[0].Satisfied || len(statuses[0].PlanPIndexes) != 1 {
+		t.Errorf("expected first pin satisfied, got: %#v", statuses[0])
+	}
+	if statuses[1].Satisfied {
+		t.Errorf("expected second pin unsatisfied, got: %#v", statuses[1])
+	}
+
+	if _, err = m.GetIndexPins("not-an-index"); err == nil {
+		t.Errorf("expected err on an unknown index")
+	}
+}
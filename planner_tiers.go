@@ -0,0 +1,139 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+
+	"github.com/blugelabs/blance"
+)
+
+// CalcNodeTags returns the tags of the nodes, keyed by node UUID.
+func CalcNodeTags(nodeDefs *NodeDefs) map[string][]string {
+	if nodeDefs == nil {
+		return nil
+	}
+
+	rv := make(map[string][]string, len(nodeDefs.NodeDefs))
+	for _, nodeDef := range nodeDefs.NodeDefs {
+		rv[nodeDef.UUID] = nodeDef.Tags
+	}
+
+	return rv
+}
+
+// nodesWithTags returns the nodes having any of the tags, where a
+// node without tags, or whose tags aren't known, matches any tag.
+func nodesWithTags(nodes []string, nodeTags map[string][]string,
+	tags []string) []string {
+	if len(tags) <= 0 {
+		return nodes
+	}
+
+	rv := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		t := nodeTags[node]
+		if len(t) <= 0 || len(StringsIntersectStrings(t, tags)) > 0 {
+			rv = append(rv, node)
+		}
+	}
+
+	return rv
+}
+
+// blanceStateMap returns a copy of a blance map with only the nodes
+// of the given state.
+func blanceStateMap(m blance.PartitionMap,
+	stateName string) blance.PartitionMap {
+	rv := make(blance.PartitionMap, len(m))
+	for name, partition := range m {
+		rv[name] = &blance.Partition{
+			Name: partition.Name,
+			NodesByState: map[string][]string{
+				stateName: partition.NodesByState[stateName],
+			},
+		}
+	}
+	return rv
+}
+
+// blanceTieredPlanNextMap is like blance.PlanNextMap, but assigns the
+// primaries only to the nodes matching the PrimaryNodeTags and the
+// replicas only to the nodes matching the ReplicaNodeTags of the
+// indexDef.  As blance can't restrict a model state to a subset of
+// the nodes, each state is planned separately with a single state
+// model over its own nodes.  The replica placement is thus
+// independent of the primary placement, and the HierarchyRules are
+// not applied.  A replica that lands on its primary's node, which is
+// only possible when the tiers overlap, is dropped with a warning.
+func blanceTieredPlanNextMap(indexDef *IndexDef,
+	prevMap blance.PartitionMap,
+	nodesAll []string,
+	nodesToRemove []string,
+	nodesToAdd []string,
+	model blance.PartitionModel,
+	modelConstraints map[string]int,
+	partitionWeights map[string]int,
+	stateStickiness map[string]int,
+	nodeWeights map[string]int,
+	nodeHierarchy map[string]string,
+	nodeTags map[string][]string) (blance.PartitionMap, []string) {
+	plan := func(stateName string, tags []string) (
+		blance.PartitionMap, []string) {
+		nodes := nodesWithTags(nodesAll, nodeTags, tags)
+
+		var constraints map[string]int
+		if c, exists := modelConstraints[stateName]; exists {
+			constraints = map[string]int{stateName: c}
+		}
+
+		return blance.PlanNextMap(blanceStateMap(prevMap, stateName),
+			nodes, nodesToRemove, StringsIntersectStrings(nodesToAdd, nodes),
+			blance.PartitionModel{stateName: model[stateName]}, constraints,
+			partitionWeights,
+			stateStickiness,
+			nodeWeights,
+			nodeHierarchy,
+			nil)
+	}
+
+	nextMap, warnings := plan("primary", indexDef.PlanParams.PrimaryNodeTags)
+
+	if model["replica"] == nil || model["replica"].Constraints <= 0 {
+		return nextMap, warnings
+	}
+
+	replicaMap, replicaWarnings :=
+		plan("replica", indexDef.PlanParams.ReplicaNodeTags)
+	warnings = append(warnings, replicaWarnings...)
+
+	for name, partition := range nextMap {
+		primaries := partition.NodesByState["primary"]
+
+		var replicas []string
+		if replicaPartition := replicaMap[name]; replicaPartition != nil {
+			for _, node := range replicaPartition.NodesByState["replica"] {
+				if len(primaries) > 0 && primaries[0] == node {
+					warnings = append(warnings,
+						fmt.Sprintf("replica on the primary's node: %s,"+
+							" partitionName: %s", node, name))
+					continue
+				}
+				replicas = append(replicas, node)
+			}
+		}
+
+		partition.NodesByState["replica"] = replicas
+	}
+
+	return nextMap, warnings
+}
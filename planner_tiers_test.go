@@ -0,0 +1,104 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestNodesWithTags(t *testing.T) {
+	nodeTags := map[string][]string{
+		"a": {"indexer"},
+		"b": {"query", "pindex"},
+		"c": nil,
+	}
+	nodes := []string{"a", "b", "c", "d"}
+
+	if got := nodesWithTags(nodes, nodeTags, nil); !reflect.DeepEqual(got, nodes) {
+		t.Errorf("expected all nodes without tags, got: %v", got)
+	}
+	if got := nodesWithTags(nodes, nodeTags, []string{"query"}); !reflect.DeepEqual(got,
+		[]string{"b", "c", "d"}) {
+		t.Errorf("expected query and untagged nodes, got: %v", got)
+	}
+}
+
+func TestBlancePlanPIndexesTiers(t *testing.T) {
+	nodeTags := map[string][]string{
+		"i0": {"pindex", "indexer"},
+		"i1": {"pindex", "indexer"},
+		"q0": {"pindex", "query"},
+		"q1": {"pindex", "query"},
+	}
+	nodes := []string{"i0", "i1", "q0", "q1"}
+
+	indexDef := &IndexDef{Name: "x", UUID: "xx", PlanParams: PlanParams{
+		NumReplicas:     1,
+		PrimaryNodeTags: []string{"indexer"},
+		ReplicaNodeTags: []string{"query"},
+	}}
+
+	var planPIndexesPrev *PlanPIndexes
+
+	for pass := 0; pass < 2; pass++ {
+		planPIndexesForIndex := map[string]*PlanPIndex{}
+		for i := 0; i < 8; i++ {
+			name := fmt.Sprintf("x_%d", i)
+			planPIndexesForIndex[name] = &PlanPIndex{
+				Name:             name,
+				IndexName:        "x",
+				SourcePartitions: fmt.Sprintf("%d", i),
+			}
+		}
+
+		nodesToAdd := nodes
+		if pass > 0 {
+			nodesToAdd = nil
+		}
+
+		warnings := BlancePlanPIndexesEx("", indexDef,
+			planPIndexesForIndex, planPIndexesPrev,
+			nodes, nodesToAdd, nil, nil, nil, nodeTags)
+		if len(warnings) > 0 {
+			t.Errorf("pass: %d, expected no warnings, got: %v", pass, warnings)
+		}
+
+		counts := map[string]int{}
+		for name, planPIndex := range planPIndexesForIndex {
+			if len(planPIndex.Nodes) != 2 {
+				t.Fatalf("pass: %d, expected 2 nodes, planPIndex: %s,"+
+					" nodes: %#v", pass, name, planPIndex.Nodes)
+			}
+			for nodeUUID, node := range planPIndex.Nodes {
+				counts[nodeUUID]++
+				role := nodeTags[nodeUUID][1]
+				if (node.Priority == 0) != (role == "indexer") {
+					t.Errorf("pass: %d, planPIndex: %s, node: %s,"+
+						" priority: %d", pass, name, nodeUUID, node.Priority)
+				}
+			}
+		}
+		for _, nodeUUID := range nodes {
+			if counts[nodeUUID] != 4 {
+				t.Errorf("pass: %d, expected balanced nodes, got: %v",
+					pass, counts)
+			}
+		}
+
+		planPIndexesPrev = NewPlanPIndexes(Version)
+		for name, planPIndex := range planPIndexesForIndex {
+			planPIndexesPrev.PlanPIndexes[name] = planPIndex
+		}
+	}
+}
@@ -0,0 +1,387 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blugelabs/blance"
+)
+
+// TOPOLOGY_ROOT is the synthetic container above the top level
+// containers of the nodes, so that a PlacementPolicy can span the
+// top level, such as regions that have no common container.  It
+// can't clash with a container name, as those are split by "/".
+const TOPOLOGY_ROOT = "/"
+
+// A PlacementPolicy is a per-index placement policy over a node
+// topology of any depth, as named by its Levels, which the planner
+// turns into HierarchyRules.  For example, "the copies must span at
+// least 2 zones, preferably within the same region" is...
+//
+//	{"levels":["rack","zone","region"],
+//	 "spanLevel":"zone","minSpan":2,"preferSameLevel":"region"}
+//
+// where the nodes have a NodeDef.Container like "us/us-east-1a/r7".
+type PlacementPolicy struct {
+	// Levels names the container levels of the nodes, nearest first,
+	// so Levels[0] names level 1, such as the rack.
+	Levels []string `json:"levels"`
+
+	// The copies of each pindex must span at least MinSpan distinct
+	// containers at the SpanLevel.  The planner places the first
+	// MinSpan-1 replicas outside the primary's SpanLevel container,
+	// and warns when the topology leaves it no such nodes.
+	SpanLevel string `json:"spanLevel,omitempty"`
+	MinSpan   int    `json:"minSpan,omitempty"`
+
+	// PreferSameLevel optionally keeps the replicas within the
+	// primary's container at that level, which must be above the
+	// SpanLevel.  This is a preference, so the planner falls back to
+	// other containers with a warning.
+	PreferSameLevel string `json:"preferSameLevel,omitempty"`
+}
+
+// Level returns the level of a level name, where 0 means none.
+func (p *PlacementPolicy) Level(name string) int {
+	for i, level := range p.Levels {
+		if level == name {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// ValidatePlacementPolicy checks a PlacementPolicy against the rest
+// of the PlanParams.
+func ValidatePlacementPolicy(planParams *PlanParams) error {
+	p := planParams.PlacementPolicy
+	if p == nil {
+		return nil
+	}
+	if planParams.HierarchyRules != nil {
+		return fmt.Errorf("planner_topology: a placementPolicy" +
+			" and hierarchyRules are exclusive")
+	}
+	if len(planParams.PrimaryNodeTags) > 0 ||
+		len(planParams.ReplicaNodeTags) > 0 {
+		return fmt.Errorf("planner_topology: a placementPolicy" +
+			" and node tags are exclusive")
+	}
+	if len(p.Levels) <= 0 {
+		return fmt.Errorf("planner_topology: placementPolicy needs levels")
+	}
+	for i, level := range p.Levels {
+		if level == "" || p.Level(level) != i+1 {
+			return fmt.Errorf("planner_topology: placementPolicy levels"+
+				" must be unique and non-empty, levels: %v", p.Levels)
+		}
+	}
+	if p.MinSpan < 0 {
+		return fmt.Errorf("planner_topology: negative minSpan: %d",
+			p.MinSpan)
+	}
+	if p.MinSpan > planParams.NumReplicas+1 {
+		return fmt.Errorf("planner_topology: minSpan: %d needs at least"+
+			" %d replicas, numReplicas: %d", p.MinSpan, p.MinSpan-1,
+			planParams.NumReplicas)
+	}
+	if p.MinSpan > 0 && p.Level(p.SpanLevel) <= 0 {
+		return fmt.Errorf("planner_topology: unknown spanLevel: %q,"+
+			" levels: %v", p.SpanLevel, p.Levels)
+	}
+	if p.PreferSameLevel != "" {
+		if p.Level(p.PreferSameLevel) <= 0 {
+			return fmt.Errorf("planner_topology: unknown preferSameLevel:"+
+				" %q, levels: %v", p.PreferSameLevel, p.Levels)
+		}
+		if p.Level(p.PreferSameLevel) <= p.Level(p.SpanLevel) {
+			return fmt.Errorf("planner_topology: preferSameLevel: %q"+
+				" must be above spanLevel: %q", p.PreferSameLevel,
+				p.SpanLevel)
+		}
+	}
+	return nil
+}
+
+// placementPolicyRules returns the replica HierarchyRules of a
+// PlacementPolicy, which are relative to the node hierarchy of
+// placementHierarchy().
+func placementPolicyRules(p *PlacementPolicy,
+	numReplicas int) blance.HierarchyRules {
+	includeLevel := len(p.Levels) + 1 // The TOPOLOGY_ROOT.
+	if p.PreferSameLevel != "" {
+		includeLevel = p.Level(p.PreferSameLevel)
+	}
+
+	rules := make([]*blance.HierarchyRule, 0, numReplicas)
+	for i := 0; i < numReplicas; i++ {
+		excludeLevel := 0
+		if i < p.MinSpan-1 {
+			excludeLevel = p.Level(p.SpanLevel)
+		}
+		rules = append(rules, &blance.HierarchyRule{
+			IncludeLevel: includeLevel,
+			ExcludeLevel: excludeLevel,
+		})
+	}
+
+	return blance.HierarchyRules{"replica": rules}
+}
+
+// placementHierarchy returns a copy of the node hierarchy, where the
+// top level containers have the TOPOLOGY_ROOT as their parent.
+func placementHierarchy(nodeHierarchy map[string]string) map[string]string {
+	rv := make(map[string]string, len(nodeHierarchy))
+	for child, parent := range nodeHierarchy {
+		rv[child] = parent
+		if _, exists := nodeHierarchy[parent]; !exists {
+			rv[parent] = TOPOLOGY_ROOT
+		}
+	}
+	return rv
+}
+
+// placementPolicyWarnings returns warnings for the pindexes whose
+// copies don't span enough containers, or that aren't kept within
+// the preferred container, of a PlacementPolicy.  There's a warning
+// per policy clause, rather than per planPIndex.
+func placementPolicyWarnings(p *PlacementPolicy,
+	planPIndexesForIndex map[string]*PlanPIndex,
+	nodeHierarchy map[string]string) (warnings []string) {
+	names := make([]string, 0, len(planPIndexesForIndex))
+	for name := range planPIndexesForIndex {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var spanShort, preferCrossed int
+	var spanExample, preferExample string
+
+	for _, name := range names {
+		nodes := planPIndexesForIndex[name].Nodes
+
+		if p.MinSpan > 1 {
+			spanned := map[string]bool{}
+			for nodeUUID := range nodes {
+				spanned[hierarchyAncestor(nodeUUID,
+					p.Level(p.SpanLevel), nodeHierarchy)] = true
+			}
+			if len(spanned) < p.MinSpan && len(nodes) > 0 {
+				spanShort++
+				if spanExample == "" {
+					spanExample = fmt.Sprintf("pindex: %s, %ss: %d",
+						name, p.SpanLevel, len(spanned))
+				}
+			}
+		}
+
+		if p.PreferSameLevel != "" {
+			preferred := map[string]bool{}
+			for nodeUUID := range nodes {
+				preferred[hierarchyAncestor(nodeUUID,
+					p.Level(p.PreferSameLevel), nodeHierarchy)] = true
+			}
+			if len(preferred) > 1 {
+				preferCrossed++
+				if preferExample == "" {
+					preferExample = fmt.Sprintf("pindex: %s, %ss: %d",
+						name, p.PreferSameLevel, len(preferred))
+				}
+			}
+		}
+	}
+
+	if spanShort > 0 {
+		warnings = append(warnings, fmt.Sprintf("placementPolicy:"+
+			" copies span fewer than %d %ss for %d of %d pindexes,"+
+			" such as %s", p.MinSpan, p.SpanLevel, spanShort,
+			len(names), spanExample))
+	}
+	if preferCrossed > 0 {
+		warnings = append(warnings, fmt.Sprintf("placementPolicy:"+
+			" copies are not within the same %s for %d of %d pindexes,"+
+			" such as %s", p.PreferSameLevel, preferCrossed,
+			len(names), preferExample))
+	}
+
+	return warnings
+}
+
+// ---------------------------------------------------------
+
+// A TopologyReport describes the node topology, as given by the
+// containers of the nodes, along with the problems that affect the
+// placement, such as for the PlacementPolicy of each index.
+type TopologyReport struct {
+	// Containers are the container paths of the nodes, keyed by node
+	// UUID, such as "us/us-east-1a/r7".
+	Containers map[string]string `json:"containers"`
+
+	// Depth is the most levels of containers of any node.
+	Depth int `json:"depth"`
+
+	// Counts are the numbers of distinct containers at each level,
+	// where Counts[0] is of level 1.
+	Counts []int `json:"counts"`
+
+	Errors   []string `json:"errors,omitempty"`   // Break the placement.
+	Warnings []string `json:"warnings,omitempty"` // Weaken the placement.
+
+	// Indexes are the problems of the indexes with a PlacementPolicy,
+	// keyed by index name.
+	Indexes map[string][]string `json:"indexes,omitempty"`
+}
+
+// ValidateTopology reports on the topology of the wanted nodes,
+// against the PlacementPolicy of each index.
+func (mgr *Manager) ValidateTopology() (*TopologyReport, error) {
+	indexDefs, nodeDefs, _, _, err :=
+		PlannerGetPlan(mgr.log, mgr.cfg, mgr.version, "")
+	if err != nil {
+		return nil, fmt.Errorf("planner_topology: PlannerGetPlan,"+
+			" err: %v", err)
+	}
+
+	return CalcTopologyReport(indexDefs, nodeDefs), nil
+}
+
+// CalcTopologyReport reports on the topology of the nodes that can
+// hold pindexes.
+func CalcTopologyReport(indexDefs *IndexDefs,
+	nodeDefs *NodeDefs) *TopologyReport {
+	rv := &TopologyReport{
+		Containers: map[string]string{},
+		Counts:     []int{},
+	}
+
+	var nodeUUIDs []string
+	if nodeDefs != nil {
+		for _, nodeDef := range nodeDefs.NodeDefs {
+			tags := StringsToMap(nodeDef.Tags)
+			if tags == nil || tags["pindex"] {
+				nodeUUIDs = append(nodeUUIDs, nodeDef.UUID)
+			}
+		}
+	}
+	sort.Strings(nodeUUIDs)
+
+	nodeUUIDsMap := StringsToMap(nodeUUIDs)
+
+	parents := map[string]string{} // Keyed by container name.
+	levels := map[string]int{}     // Keyed by container name.
+	depths := map[int][]string{}   // Node UUIDs, keyed by depth.
+
+	for _, nodeUUID := range nodeUUIDs {
+		var path []string
+		container := nodeDefs.NodeDefs[nodeUUID].Container
+		for _, c := range strings.Split(container, "/") {
+			if c != "" {
+				path = append(path, c)
+			}
+		}
+		rv.Containers[nodeUUID] = strings.Join(path, "/")
+		depths[len(path)] = append(depths[len(path)], nodeUUID)
+		if rv.Depth < len(path) {
+			rv.Depth = len(path)
+		}
+
+		for i, c := range path {
+			level := len(path) - i
+			parent := ""
+			if i > 0 {
+				parent = path[i-1]
+			}
+
+			if nodeUUIDsMap[c] {
+				rv.Errors = append(rv.Errors, fmt.Sprintf("container: %s"+
+					" has the name of a node", c))
+			}
+			if prev, exists := parents[c]; exists && prev != parent {
+				rv.Errors = append(rv.Errors, fmt.Sprintf("container: %s"+
+					" is under both %q and %q, as container names must be"+
+					" unique", c, prev, parent))
+			}
+			if prev, exists := levels[c]; exists && prev != level {
+				rv.Errors = append(rv.Errors, fmt.Sprintf("container: %s"+
+					" is at both level %d and %d", c, prev, level))
+			}
+			parents[c], levels[c] = parent, level
+		}
+	}
+
+	rv.Errors = StringsRemoveDuplicates(rv.Errors)
+
+	for level := 1; level <= rv.Depth; level++ {
+		count := 0
+		for _, l := range levels {
+			if l == level {
+				count++
+			}
+		}
+		rv.Counts = append(rv.Counts, count)
+	}
+
+	if len(depths) > 1 {
+		var ds []int
+		for d := range depths {
+			ds = append(ds, d)
+		}
+		sort.Ints(ds)
+		for _, d := range ds {
+			rv.Warnings = append(rv.Warnings, fmt.Sprintf("%d node(s) have"+
+				" %d container levels, such as node: %s", len(depths[d]), d,
+				depths[d][0]))
+		}
+	}
+
+	if indexDefs == nil {
+		return rv
+	}
+
+	for indexName, indexDef := range indexDefs.IndexDefs {
+		p := indexDef.PlanParams.PlacementPolicy
+		if p == nil {
+			continue
+		}
+
+		var problems []string
+
+		if err := ValidatePlacementPolicy(&indexDef.PlanParams); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if len(p.Levels) != rv.Depth {
+			problems = append(problems, fmt.Sprintf("policy has %d levels,"+
+				" but the topology has %d", len(p.Levels), rv.Depth))
+		}
+		if l := p.Level(p.SpanLevel); p.MinSpan > 1 && l > 0 &&
+			(l > len(rv.Counts) || rv.Counts[l-1] < p.MinSpan) {
+			count := 0
+			if l <= len(rv.Counts) {
+				count = rv.Counts[l-1]
+			}
+			problems = append(problems, fmt.Sprintf("minSpan: %d, but"+
+				" there are %d %ss", p.MinSpan, count, p.SpanLevel))
+		}
+
+		if len(problems) > 0 {
+			if rv.Indexes == nil {
+				rv.Indexes = map[string][]string{}
+			}
+			rv.Indexes[indexName] = problems
+		}
+	}
+
+	return rv
+}
@@ -0,0 +1,207 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blugelabs/blance"
+)
+
+var testPlacementLevels = []string{"rack", "zone", "region"}
+
+func TestValidatePlacementPolicy(t *testing.T) {
+	tests := []struct {
+		planParams PlanParams
+		ok         bool
+	}{
+		{PlanParams{}, true},
+		{PlanParams{NumReplicas: 1, PlacementPolicy: &PlacementPolicy{
+			Levels: testPlacementLevels, SpanLevel: "zone", MinSpan: 2,
+			PreferSameLevel: "region"}}, true},
+		{PlanParams{NumReplicas: 1, PlacementPolicy: &PlacementPolicy{
+			Levels: testPlacementLevels}}, true},
+		{PlanParams{PlacementPolicy: &PlacementPolicy{}}, false},
+		{PlanParams{PlacementPolicy: &PlacementPolicy{
+			Levels: []string{"rack", "rack"}}}, false},
+		{PlanParams{NumReplicas: 1, PlacementPolicy: &PlacementPolicy{
+			Levels: testPlacementLevels, SpanLevel: "zone", MinSpan: 3}}, false},
+		{PlanParams{NumReplicas: 1, PlacementPolicy: &PlacementPolicy{
+			Levels: testPlacementLevels, SpanLevel: "row", MinSpan: 2}}, false},
+		{PlanParams{NumReplicas: 1, PlacementPolicy: &PlacementPolicy{
+			Levels: testPlacementLevels, SpanLevel: "zone", MinSpan: 2,
+			PreferSameLevel: "rack"}}, false},
+		{PlanParams{NumReplicas: 1, PlacementPolicy: &PlacementPolicy{
+			Levels: testPlacementLevels},
+			HierarchyRules: blance.HierarchyRules{}}, false},
+		{PlanParams{NumReplicas: 1, PlacementPolicy: &PlacementPolicy{
+			Levels: testPlacementLevels},
+			ReplicaNodeTags: []string{"query"}}, false},
+	}
+
+	for i, test := range tests {
+		err := ValidatePlacementPolicy(&test.planParams)
+		if (err == nil) != test.ok {
+			t.Errorf("test: %d, ok: %v, err: %v", i, test.ok, err)
+		}
+	}
+}
+
+func TestPlacementPolicyRules(t *testing.T) {
+	p := &PlacementPolicy{Levels: testPlacementLevels,
+		SpanLevel: "zone", MinSpan: 2, PreferSameLevel: "region"}
+
+	exp := blance.HierarchyRules{"replica": {
+		{IncludeLevel: 3, ExcludeLevel: 2},
+		{IncludeLevel: 3, ExcludeLevel: 0},
+	}}
+	if got := placementPolicyRules(p, 2); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	p.PreferSameLevel = ""
+	if got := placementPolicyRules(p, 1); got["replica"][0].IncludeLevel != 4 {
+		t.Errorf("expected the topology root level, got: %v", got)
+	}
+}
+
+func TestBlancePlanPIndexesPlacementPolicy(t *testing.T) {
+	containers := map[string]string{
+		"a": "us/z1/r1",
+		"b": "us/z1/r2",
+		"c": "us/z2/r3",
+		"d": "eu/z3/r4",
+	}
+
+	plan := func(p *PlacementPolicy, nodes []string) (
+		map[string]*PlanPIndex, []string) {
+		nodeDefs := NewNodeDefs(Version)
+		for _, n := range nodes {
+			nodeDefs.NodeDefs[n] = &NodeDef{UUID: n, Container: containers[n]}
+		}
+		_, _, _, _, nodeHierarchy :=
+			CalcNodesLayout(NewIndexDefs(Version), nodeDefs, nil)
+
+		indexDef := &IndexDef{Name: "x", UUID: "xx", PlanParams: PlanParams{
+			NumReplicas:     1,
+			PlacementPolicy: p,
+		}}
+
+		planPIndexesForIndex := map[string]*PlanPIndex{}
+		for i := 0; i < 6; i++ {
+			name := fmt.Sprintf("x_%d", i)
+			planPIndexesForIndex[name] = &PlanPIndex{
+				Name:             name,
+				IndexName:        "x",
+				SourcePartitions: fmt.Sprintf("%d", i),
+			}
+		}
+
+		warnings := BlancePlanPIndexesEx("", indexDef,
+			planPIndexesForIndex, nil,
+			nodes, nodes, nil, nil, nodeHierarchy, nil)
+
+		return planPIndexesForIndex, warnings
+	}
+
+	spanned := func(planPIndex *PlanPIndex, level int) int {
+		m := map[string]bool{}
+		for n := range planPIndex.Nodes {
+			m[strings.Split(containers[n], "/")[3-level]] = true
+		}
+		return len(m)
+	}
+
+	// Span 2 zones within the us region.
+	planPIndexes, warnings := plan(&PlacementPolicy{
+		Levels: testPlacementLevels, SpanLevel: "zone", MinSpan: 2,
+		PreferSameLevel: "region"}, []string{"a", "b", "c"})
+	if len(warnings) > 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	for name, planPIndex := range planPIndexes {
+		if spanned(planPIndex, 2) != 2 {
+			t.Errorf("expected 2 zones, pindex: %s, nodes: %v",
+				name, planPIndex.Nodes)
+		}
+	}
+
+	// Span 2 regions, which have no common container.
+	planPIndexes, warnings = plan(&PlacementPolicy{
+		Levels: testPlacementLevels, SpanLevel: "region", MinSpan: 2},
+		[]string{"a", "b", "d"})
+	if len(warnings) > 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	for name, planPIndex := range planPIndexes {
+		if spanned(planPIndex, 3) != 2 {
+			t.Errorf("expected 2 regions, pindex: %s, nodes: %v",
+				name, planPIndex.Nodes)
+		}
+	}
+
+	// With a single region, the regions can't be spanned.
+	_, warnings = plan(&PlacementPolicy{
+		Levels: testPlacementLevels, SpanLevel: "region", MinSpan: 2},
+		[]string{"a", "b", "c"})
+	if len(warnings) != 1 ||
+		!strings.Contains(warnings[0], "span fewer than 2 regions") {
+		t.Errorf("expected a span warning, got: %v", warnings)
+	}
+}
+
+func TestCalcTopologyReport(t *testing.T) {
+	nodeDefs := NewNodeDefs(Version)
+	for n, container := range map[string]string{
+		"a": "us/z1/r1",
+		"b": "us/z2/r1", // The r1 rack name is reused.
+		"c": "us/z2/r2",
+		"d": "z3/r3",
+		"q": "us/z1/r9",
+	} {
+		nodeDefs.NodeDefs[n] = &NodeDef{UUID: n, Container: container}
+	}
+	nodeDefs.NodeDefs["q"].Tags = []string{"queryer"}
+
+	indexDefs := NewIndexDefs(Version)
+	indexDefs.IndexDefs["x"] = &IndexDef{Name: "x", PlanParams: PlanParams{
+		NumReplicas: 2,
+		PlacementPolicy: &PlacementPolicy{Levels: testPlacementLevels,
+			SpanLevel: "region", MinSpan: 2},
+	}}
+	indexDefs.IndexDefs["y"] = &IndexDef{Name: "y"}
+
+	rv := CalcTopologyReport(indexDefs, nodeDefs)
+
+	if rv.Depth != 3 || rv.Containers["d"] != "z3/r3" ||
+		rv.Containers["q"] != "" {
+		t.Errorf("unexpected report: %#v", rv)
+	}
+	if !reflect.DeepEqual(rv.Counts, []int{3, 3, 1}) {
+		t.Errorf("unexpected counts: %v", rv.Counts)
+	}
+	if len(rv.Errors) != 1 ||
+		!strings.Contains(rv.Errors[0], "container: r1 is under both") {
+		t.Errorf("unexpected errors: %v", rv.Errors)
+	}
+	if len(rv.Warnings) != 2 {
+		t.Errorf("expected warnings for the mixed depths, got: %v",
+			rv.Warnings)
+	}
+	if len(rv.Indexes) != 1 || len(rv.Indexes["x"]) != 1 ||
+		!strings.Contains(rv.Indexes["x"][0], "minSpan: 2, but there are 1") {
+		t.Errorf("unexpected index problems: %v", rv.Indexes)
+	}
+}
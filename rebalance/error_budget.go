@@ -0,0 +1,201 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rebalance
+
+import (
+	"sync"
+	"time"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// The kinds of errors that a rebalance tracks against a node's
+// error budgets.
+const (
+	// ErrorKindNetwork is a failed or empty monitoring sample.
+	ErrorKindNetwork = "network"
+
+	// ErrorKindPIndexMissing is a pindex that's missing from a node's
+	// stats, such as due to plan propagation lag.
+	ErrorKindPIndexMissing = "pindexMissing"
+)
+
+// The responses to an exceeded error budget.
+const (
+	// ErrorBudgetAbort stops the rebalance with the error.
+	ErrorBudgetAbort = "abort"
+
+	// ErrorBudgetSkipNode ignores the node's further samples and no
+	// longer waits for the node's pindexes to catch up.
+	ErrorBudgetSkipNode = "skipNode"
+
+	// ErrorBudgetPause pauses new assignments and alerts, so that an
+	// operator can investigate and then ResumeNewAssignments().  The
+	// node's budget then starts over.
+	ErrorBudgetPause = "pause"
+)
+
+// An ErrorBudget allows up to MaxErrors errors of a kind per node
+// within a sliding Window, where a Window <= 0 means the whole
+// rebalance, before its Action is taken.
+type ErrorBudget struct {
+	MaxErrors int           `json:"maxErrors"`
+	Window    time.Duration `json:"window"`
+	Action    string        `json:"action"`
+}
+
+// An ErrorBudgetPolicy configures the per-node error budgets of a
+// rebalance.  See RebalanceOptions.ErrorBudgetPolicy.
+type ErrorBudgetPolicy struct {
+	Network       ErrorBudget `json:"network"`
+	PIndexMissing ErrorBudget `json:"pindexMissing"`
+
+	// Optional, invoked when a budget is exceeded, such as to alert an
+	// operator.  It must not block.
+	OnExceeded func(*ErrorBudgetEvent) `json:"-"`
+}
+
+// DefaultErrorBudgetPolicy is an ErrorBudgetPolicy that tolerates
+// short network blips and the propagation lag of new pindexes.
+var DefaultErrorBudgetPolicy = ErrorBudgetPolicy{
+	Network: ErrorBudget{
+		MaxErrors: 5,
+		Window:    30 * time.Second,
+		Action:    ErrorBudgetAbort,
+	},
+	PIndexMissing: ErrorBudget{
+		MaxErrors: 10,
+		Window:    time.Minute,
+		Action:    ErrorBudgetAbort,
+	},
+}
+
+// An ErrorBudgetEvent describes an exceeded error budget, which is
+// also sent as the RebalanceProgress.ErrorBudget.
+type ErrorBudgetEvent struct {
+	Node   string `json:"node"`
+	Kind   string `json:"kind"`
+	Action string `json:"action"`
+	Errors int    `json:"errors"` // The errors within the window.
+	Err    error  `json:"-"`      // The last error.
+	Time   string `json:"time"`
+}
+
+// errorBudgets tracks the errors of each node against an
+// ErrorBudgetPolicy.
+type errorBudgets struct {
+	policy ErrorBudgetPolicy
+
+	m       sync.Mutex
+	errs    map[string][]time.Time // Keyed by node + " " + kind.
+	skipped map[string]bool        // Keyed by node.
+}
+
+func newErrorBudgets(policy ErrorBudgetPolicy) *errorBudgets {
+	return &errorBudgets{
+		policy:  policy,
+		errs:    map[string][]time.Time{},
+		skipped: map[string]bool{},
+	}
+}
+
+// record counts an error of a kind for a node, and returns an
+// ErrorBudgetEvent when the node's budget for the kind is exceeded.
+func (b *errorBudgets) record(node, kind string,
+	err error) *ErrorBudgetEvent {
+	budget := b.policy.Network
+	if kind == ErrorKindPIndexMissing {
+		budget = b.policy.PIndexMissing
+	}
+
+	now := cbgt.Now()
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	k := node + " " + kind
+	errs := append(b.errs[k], now)
+	if budget.Window > 0 {
+		i := 0
+		for i < len(errs) && now.Sub(errs[i]) > budget.Window {
+			i++
+		}
+		errs = errs[i:]
+	}
+	b.errs[k] = errs
+
+	if len(errs) <= budget.MaxErrors {
+		return nil
+	}
+
+	action := budget.Action
+	if action == "" {
+		action = ErrorBudgetAbort
+	}
+
+	switch action {
+	case ErrorBudgetSkipNode:
+		b.skipped[node] = true
+	case ErrorBudgetPause:
+		delete(b.errs, k) // Start over after the operator's resume.
+	}
+
+	return &ErrorBudgetEvent{
+		Node:   node,
+		Kind:   kind,
+		Action: action,
+		Errors: len(errs),
+		Err:    err,
+		Time:   now.Format(time.RFC3339Nano),
+	}
+}
+
+func (b *errorBudgets) isSkipped(node string) bool {
+	b.m.Lock()
+	rv := b.skipped[node]
+	b.m.Unlock()
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// isNodeSkipped returns true if the node exceeded an error budget
+// whose action is ErrorBudgetSkipNode.
+func (r *Rebalancer) isNodeSkipped(node string) bool {
+	return r.errorBudgets != nil && r.errorBudgets.isSkipped(node)
+}
+
+// errorBudgetExceeded responds to an exceeded error budget.
+func (r *Rebalancer) errorBudgetExceeded(ev *ErrorBudgetEvent) {
+	r.log.Printf("rebalance: error budget exceeded, node: %s, kind: %s,"+
+		" errors: %d, action: %s, err: %v",
+		ev.Node, ev.Kind, ev.Errors, ev.Action, ev.Err)
+
+	if r.errorBudgets.policy.OnExceeded != nil {
+		r.errorBudgets.policy.OnExceeded(ev)
+	}
+
+	if ev.Action == ErrorBudgetAbort {
+		r.progressCh <- RebalanceProgress{Error: ev.Err, ErrorBudget: ev}
+		r.Stop()
+		return
+	}
+
+	if ev.Action == ErrorBudgetPause {
+		err := r.PauseNewAssignments()
+		if err != nil {
+			r.log.Printf("rebalance: error budget, pause, err: %v", err)
+		}
+	}
+
+	r.progressCh <- RebalanceProgress{ErrorBudget: ev}
+}
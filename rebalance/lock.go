@@ -0,0 +1,273 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rebalance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// REBALANCE_LOCK_KEY is the Cfg key of the RebalanceLock.
+const REBALANCE_LOCK_KEY = "rebalanceLock"
+
+// REBALANCE_LOCK_TTL is how long a RebalanceLock is held without a
+// renewal, after which the lock is considered abandoned, such as
+// when its owner crashed, and may be acquired by another rebalance.
+// A running rebalance renews its lock every third of the TTL.
+var REBALANCE_LOCK_TTL = 30 * time.Second
+
+// ErrorRebalanceLockLost is the RebalanceProgress.Error of a
+// rebalance whose lock was stolen or expired.
+var ErrorRebalanceLockLost = errors.New("rebalance lock lost")
+
+// A RebalanceLock in the Cfg allows only a single rebalance to run
+// across the cluster, even when started from different tools.  See
+// RebalanceOptions.Owner and RebalanceOptions.ForceLock.
+type RebalanceLock struct {
+	RunID      string `json:"runID"`
+	Owner      string `json:"owner"`
+	Host       string `json:"host,omitempty"`
+	Pid        int    `json:"pid,omitempty"`
+	AcquiredAt string `json:"acquiredAt"`
+	RenewedAt  string `json:"renewedAt"`
+	ExpiresAt  string `json:"expiresAt"`
+}
+
+// expired returns true when the lock wasn't renewed in time.
+func (l *RebalanceLock) expired(now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339Nano, l.ExpiresAt)
+	return err != nil || !now.Before(expiresAt)
+}
+
+// A RebalanceLockedError is returned when another rebalance holds
+// the RebalanceLock.
+type RebalanceLockedError struct {
+	Lock *RebalanceLock
+}
+
+func (e *RebalanceLockedError) Error() string {
+	return fmt.Sprintf("lock: a rebalance is already running, runID: %s,"+
+		" owner: %s, host: %s, expiresAt: %s", e.Lock.RunID, e.Lock.Owner,
+		e.Lock.Host, e.Lock.ExpiresAt)
+}
+
+// CfgGetRebalanceLock returns the RebalanceLock from a Cfg, which is
+// nil when there's none, although it might have expired.
+func CfgGetRebalanceLock(cfg cbgt.Cfg) (*RebalanceLock, uint64, error) {
+	v, cas, err := cfg.Get(REBALANCE_LOCK_KEY, 0)
+	if err != nil || v == nil {
+		return nil, cas, err
+	}
+	rv := &RebalanceLock{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// updateRebalanceLock applies a change to the RebalanceLock with CAS
+// retries, where the change returns the lock to save, or nil to
+// delete the lock, and false when there's nothing to save.
+func updateRebalanceLock(cfg cbgt.Cfg,
+	cb func(lock *RebalanceLock) (*RebalanceLock, bool, error)) (
+	*RebalanceLock, error) {
+	retry := cbgt.NewCASRetry(REBALANCE_LOCK_KEY)
+	for tries := 0; tries < 10; tries++ {
+		lock, cas, err := CfgGetRebalanceLock(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		next, changed, err := cb(lock)
+		if err != nil || !changed {
+			return lock, err
+		}
+
+		if next == nil {
+			err = cfg.Del(REBALANCE_LOCK_KEY, cas)
+		} else {
+			var buf []byte
+			buf, err = json.Marshal(next)
+			if err != nil {
+				return nil, err
+			}
+			_, err = cfg.Set(REBALANCE_LOCK_KEY, buf, cas)
+		}
+		if _, ok := err.(*cbgt.CfgCASError); ok || (err != nil && cas == 0) {
+			// A zero cas Set() also fails when another rebalance
+			// created the lock in the meantime.
+			retry.Conflict()
+			continue
+		}
+		retry.Done(err)
+		return next, err
+	}
+
+	return nil, fmt.Errorf("lock: too many CAS conflicts")
+}
+
+// AcquireRebalanceLock acquires the RebalanceLock for a rebalance
+// run, or renews it when the run already holds it, so that retrying
+// the acquisition is idempotent.  A lock that's held by another run
+// is only taken over when it expired, or when force is true, which
+// steals the lock from a rebalance that might still be running.
+// Otherwise, a RebalanceLockedError is returned.
+func AcquireRebalanceLock(cfg cbgt.Cfg, runID, owner string,
+	force bool) (*RebalanceLock, error) {
+	host, _ := os.Hostname()
+
+	return updateRebalanceLock(cfg, func(lock *RebalanceLock) (
+		*RebalanceLock, bool, error) {
+		now := cbgt.Now()
+
+		next := &RebalanceLock{
+			RunID:      runID,
+			Owner:      owner,
+			Host:       host,
+			Pid:        os.Getpid(),
+			AcquiredAt: now.Format(time.RFC3339Nano),
+			RenewedAt:  now.Format(time.RFC3339Nano),
+			ExpiresAt:  now.Add(REBALANCE_LOCK_TTL).Format(time.RFC3339Nano),
+		}
+
+		if lock != nil {
+			if lock.RunID == runID {
+				next.AcquiredAt = lock.AcquiredAt
+			} else if !force && !lock.expired(now) {
+				return nil, false, &RebalanceLockedError{Lock: lock}
+			}
+		}
+
+		return next, true, nil
+	})
+}
+
+// RenewRebalanceLock extends the RebalanceLock of a rebalance run,
+// or returns ErrorRebalanceLockLost when the run no longer holds it.
+func RenewRebalanceLock(cfg cbgt.Cfg, runID string) error {
+	_, err := updateRebalanceLock(cfg, func(lock *RebalanceLock) (
+		*RebalanceLock, bool, error) {
+		if lock == nil || lock.RunID != runID {
+			return nil, false, ErrorRebalanceLockLost
+		}
+
+		now := cbgt.Now()
+
+		next := *lock
+		next.RenewedAt = now.Format(time.RFC3339Nano)
+		next.ExpiresAt = now.Add(REBALANCE_LOCK_TTL).Format(time.RFC3339Nano)
+
+		return &next, true, nil
+	})
+	return err
+}
+
+// ReleaseRebalanceLock removes the RebalanceLock of a rebalance run,
+// where a lock that's held by another run is kept.
+func ReleaseRebalanceLock(cfg cbgt.Cfg, runID string) error {
+	_, err := updateRebalanceLock(cfg, func(lock *RebalanceLock) (
+		*RebalanceLock, bool, error) {
+		return nil, lock != nil && lock.RunID == runID, nil
+	})
+	return err
+}
+
+// RebalanceStatus reports whether a rebalance is running across the
+// cluster, and by whom.
+type RebalanceStatus struct {
+	Running bool           `json:"running"`
+	Lock    *RebalanceLock `json:"lock,omitempty"`
+
+	// Expired is true for a lock that wasn't renewed in time, such as
+	// when its rebalance crashed.
+	Expired bool `json:"expired,omitempty"`
+}
+
+// GetRebalanceStatus returns the RebalanceStatus from a Cfg.
+func GetRebalanceStatus(cfg cbgt.Cfg) (*RebalanceStatus, error) {
+	lock, _, err := CfgGetRebalanceLock(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		return &RebalanceStatus{}, nil
+	}
+	expired := lock.expired(cbgt.Now())
+	return &RebalanceStatus{
+		Running: !expired,
+		Lock:    lock,
+		Expired: expired,
+	}, nil
+}
+
+// RebalanceRunning returns whether a rebalance holds the lock, for
+// the manager's schedulers, such as its compactions, to hold off via
+// Manager.SetRebalanceRunning(RebalanceRunning).
+func RebalanceRunning(cfg cbgt.Cfg) bool {
+	if cfg == nil {
+		return false
+	}
+	status, err := GetRebalanceStatus(cfg)
+	return err == nil && status.Running
+}
+
+// ------------------------------------------------------------------
+
+// The Rebalancers that are running in this process, keyed by runID,
+// so that a retried StartRebalance of a run returns its Rebalancer.
+var rebalancersM sync.Mutex
+var rebalancers = map[string]*Rebalancer{}
+
+// runLockHeartbeat renews the rebalance's lock until the rebalance
+// stops, and stops the rebalance when the lock was lost.
+func (r *Rebalancer) runLockHeartbeat(stopCh chan struct{}) {
+	defer close(r.lockDoneCh)
+
+	ticker := time.NewTicker(REBALANCE_LOCK_TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+
+		case <-ticker.C:
+			err := RenewRebalanceLock(r.cfg, r.runID)
+			if err == nil {
+				continue
+			}
+
+			r.log.Warnf("rebalance: runLockHeartbeat, runID: %s, err: %v",
+				r.runID, err)
+
+			if err != ErrorRebalanceLockLost {
+				// A transient Cfg error, so retry on the next tick,
+				// while the lock's TTL covers a few of them.
+				continue
+			}
+
+			select {
+			case <-stopCh:
+			case r.progressCh <- RebalanceProgress{Error: err}:
+			}
+			r.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rebalance
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/blugelabs/cbgt"
+)
+
+func TestRebalanceLock(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	status, err := GetRebalanceStatus(cfg)
+	if err != nil || status.Running || status.Lock != nil {
+		t.Fatalf("expected no rebalance, got: %+v, err: %v", status, err)
+	}
+
+	lock, err := AcquireRebalanceLock(cfg, "r0", "alice", false)
+	if err != nil || lock.RunID != "r0" || lock.Owner != "alice" {
+		t.Fatalf("expected lock, got: %+v, err: %v", lock, err)
+	}
+
+	// Acquiring again by the same run is idempotent.
+	again, err := AcquireRebalanceLock(cfg, "r0", "alice", false)
+	if err != nil || again.AcquiredAt != lock.AcquiredAt {
+		t.Errorf("expected idempotent acquire, got: %+v, err: %v", again, err)
+	}
+
+	_, err = AcquireRebalanceLock(cfg, "r1", "bob", false)
+	if e, ok := err.(*RebalanceLockedError); !ok || e.Lock.Owner != "alice" {
+		t.Errorf("expected RebalanceLockedError, got: %v", err)
+	}
+
+	status, _ = GetRebalanceStatus(cfg)
+	if !status.Running || status.Expired || status.Lock.RunID != "r0" {
+		t.Errorf("expected running r0, got: %+v", status)
+	}
+	if !RebalanceRunning(cfg) || RebalanceRunning(nil) {
+		t.Errorf("expected RebalanceRunning only with the lock")
+	}
+
+	if err = RenewRebalanceLock(cfg, "r0"); err != nil {
+		t.Errorf("expected renew, err: %v", err)
+	}
+
+	// Another run doesn't release the lock.
+	ReleaseRebalanceLock(cfg, "r1")
+	if status, _ = GetRebalanceStatus(cfg); !status.Running {
+		t.Errorf("expected the lock to be kept")
+	}
+
+	// Stealing the lock.
+	_, err = AcquireRebalanceLock(cfg, "r1", "bob", true)
+	if err != nil {
+		t.Fatalf("expected forced acquire, err: %v", err)
+	}
+	if err = RenewRebalanceLock(cfg, "r0"); err != ErrorRebalanceLockLost {
+		t.Errorf("expected lost lock, got: %v", err)
+	}
+
+	// An expired lock may be taken over.
+	REBALANCE_LOCK_TTL = time.Millisecond
+	defer func() { REBALANCE_LOCK_TTL = 30 * time.Second }()
+
+	AcquireRebalanceLock(cfg, "r1", "bob", false)
+	time.Sleep(5 * time.Millisecond)
+
+	status, _ = GetRebalanceStatus(cfg)
+	if status.Running || !status.Expired {
+		t.Errorf("expected expired lock, got: %+v", status)
+	}
+
+	_, err = AcquireRebalanceLock(cfg, "r2", "carol", false)
+	if err != nil {
+		t.Errorf("expected expired lock to be acquired, err: %v", err)
+	}
+
+	if err = ReleaseRebalanceLock(cfg, "r2"); err != nil {
+		t.Errorf("expected release, err: %v", err)
+	}
+	if status, _ = GetRebalanceStatus(cfg); status.Lock != nil {
+		t.Errorf("expected released lock, got: %+v", status)
+	}
+	if RebalanceRunning(cfg) {
+		t.Errorf("expected no RebalanceRunning after the release")
+	}
+}
+
+func TestStartRebalanceLock(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+	log := cbgt.NewStdLibLog(ioutil.Discard, "", 0)
+
+	AcquireRebalanceLock(cfg, "other", "bob", false)
+
+	_, err := StartRebalance(cbgt.Version, cfg, log, ".", nil, nil,
+		RebalanceOptions{RunID: "r0", Owner: "alice"})
+	if e, ok := err.(*RebalanceLockedError); !ok || e.Lock.RunID != "other" {
+		t.Fatalf("expected a locked rebalance to fail, got: %v", err)
+	}
+
+	// A dry run doesn't need the lock.
+	r, err := StartRebalance(cbgt.Version, cfg, log, ".", nil, nil,
+		RebalanceOptions{RunID: "dry", DryRun: true})
+	if err != nil {
+		t.Fatalf("expected dry run, err: %v", err)
+	}
+	for range r.ProgressCh() {
+	}
+
+	r, err = StartRebalance(cbgt.Version, cfg, log, ".", nil, nil,
+		RebalanceOptions{RunID: "r0", Owner: "alice", ForceLock: true})
+	if err != nil {
+		t.Fatalf("expected forced rebalance, err: %v", err)
+	}
+	for range r.ProgressCh() {
+	}
+
+	// The lock is released once the rebalance is done.
+	status, _ := GetRebalanceStatus(cfg)
+	if status.Lock != nil {
+		t.Errorf("expected released lock, got: %+v", status)
+	}
+
+	// Starting a running run again returns its Rebalancer.
+	running := &Rebalancer{runID: "r1"}
+	rebalancersM.Lock()
+	rebalancers["r1"] = running
+	rebalancersM.Unlock()
+	defer func() {
+		rebalancersM.Lock()
+		delete(rebalancers, "r1")
+		rebalancersM.Unlock()
+	}()
+
+	r, err = StartRebalance(cbgt.Version, cfg, log, ".", nil, nil,
+		RebalanceOptions{RunID: "r1"})
+	if err != nil || r != running {
+		t.Errorf("expected the running Rebalancer, got: %v, err: %v", r, err)
+	}
+}
@@ -12,10 +12,13 @@
 package rebalance
 
 import (
+	"context"
 	"fmt"
 	"github.com/blugelabs/cbgt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -36,6 +39,16 @@ type MonitorSample struct {
 	Duration time.Duration // How long it took to get this sample.
 	Error    error
 	Data     []byte
+	WireSize int64 // The body's bytes on the wire, which may be gzip'ed.
+
+	// ContentType is of the Data, which for a "/api/stats" sample may
+	// be the cbgt.PARTITION_SEQS_PROTOBUF, see
+	// cbgt.UnmarshalPartitionSeqs().
+	ContentType string
+
+	// TraceParent is the traceparent header that was sent, so that
+	// the sample can be found in a tracing backend.
+	TraceParent string
 }
 
 // UrlUUID associates a URL with a UUID.
@@ -77,11 +90,11 @@ func (m *MonitorNodes) runNode(urlUUID UrlUUID) {
 	defer diagTicker.Stop()
 
 	if !m.options.StatsSampleDisable {
-		m.sample(urlUUID, "/api/stats?partitions=true", time.Now())
+		m.sample(urlUUID, "/api/stats?partitions=true", cbgt.Now())
 	}
 
 	if !m.options.DiagSampleDisable {
-		m.sample(urlUUID, "/api/diag", time.Now())
+		m.sample(urlUUID, "/api/diag", cbgt.Now())
 	}
 
 	for {
@@ -89,22 +102,22 @@ func (m *MonitorNodes) runNode(urlUUID UrlUUID) {
 		case <-m.stopCh:
 			return
 
-		case t, ok := <-statsTicker.C:
+		case _, ok := <-statsTicker.C:
 			if !ok {
 				return
 			}
 
 			if !m.options.StatsSampleDisable {
-				m.sample(urlUUID, "/api/stats?partitions=true", t)
+				m.sample(urlUUID, "/api/stats?partitions=true", cbgt.Now())
 			}
 
-		case t, ok := <-diagTicker.C:
+		case _, ok := <-diagTicker.C:
 			if !ok {
 				return
 			}
 
 			if !m.options.DiagSampleDisable {
-				m.sample(urlUUID, "/api/diag", t)
+				m.sample(urlUUID, "/api/diag", cbgt.Now())
 			}
 		}
 	}
@@ -114,21 +127,60 @@ func (m *MonitorNodes) sample(
 	urlUUID UrlUUID,
 	kind string,
 	start time.Time) {
-	httpGet := m.options.HttpGet
-	if httpGet == nil {
-		httpGet = http.Get
-	}
+	var traceParent *cbgt.TraceParent
+
+	var res *http.Response
+	var err error
+
+	if m.options.HttpGet != nil {
+		res, err = m.options.HttpGet(urlUUID.Url + kind)
+	} else {
+		var req *http.Request
+		req, err = http.NewRequest("GET", urlUUID.Url+kind, nil)
+		if err == nil {
+			ctx := context.Background()
+			if m.options.TraceParent != nil {
+				ctx = cbgt.ContextWithTraceParent(ctx, m.options.TraceParent)
+			}
+			traceParent = cbgt.InjectTraceParent(ctx, req.Header)
+
+			// Explicitly, as the http.Transport otherwise requests
+			// gzip on its own, hiding the wire bytes.
+			if m.options.CompressionDisable {
+				req.Header.Set("Accept-Encoding", "identity")
+			} else {
+				req.Header.Set("Accept-Encoding", "gzip")
+			}
+
+			if strings.HasPrefix(kind, "/api/stats") &&
+				!m.options.StatsProtobufDisable {
+				req.Header.Set("Accept", cbgt.PARTITION_SEQS_PROTOBUF+
+					", application/json;q=0.9")
+			}
 
-	res, err := httpGet(urlUUID.Url + kind)
+			res, err = http.DefaultClient.Do(req)
+		}
+	}
 
-	duration := time.Now().Sub(start)
+	duration := cbgt.Now().Sub(start)
 
 	data := []byte(nil)
+	contentType := ""
+	wire := &countingReader{}
 	if err == nil && res != nil {
+		body := res.Body
+		wire.r = body
+		res.Body = ioutil.NopCloser(wire)
+
 		if res.StatusCode == 200 {
 			var dataErr error
 
-			data, dataErr = ioutil.ReadAll(res.Body)
+			contentType = res.Header.Get("Content-Type")
+
+			dataErr = cbgt.GunzipResponse(res)
+			if dataErr == nil {
+				data, dataErr = ioutil.ReadAll(res.Body)
+			}
 			if err == nil && dataErr != nil {
 				err = dataErr
 			}
@@ -138,7 +190,7 @@ func (m *MonitorNodes) sample(
 				res, urlUUID, kind, err)
 		}
 
-		res.Body.Close()
+		body.Close()
 	} else {
 		err = fmt.Errorf("nodes: sample,"+
 			" res: %#v, urlUUID: %#v, kind: %s, err: %v",
@@ -153,6 +205,12 @@ func (m *MonitorNodes) sample(
 		Duration: duration,
 		Error:    err,
 		Data:     data,
+		WireSize: wire.n,
+
+		ContentType: contentType,
+	}
+	if traceParent != nil {
+		monitorSample.TraceParent = traceParent.String()
 	}
 
 	select {
@@ -168,9 +226,34 @@ type MonitorNodesOptions struct {
 	DiagSampleInterval time.Duration
 	DiagSampleDisable  bool
 
-	// Optional, defaults to http.Get(); this is used, for example,
-	// for unit testing.
+	// Optional, defaults to an http GET with the trace context
+	// headers; this is used, for example, for unit testing.
 	HttpGet func(url string) (resp *http.Response, err error)
+
+	// Optional, the span whose trace the samples join, where nil means
+	// each sample starts its own trace.
+	TraceParent *cbgt.TraceParent
+
+	// CompressionDisable, when true, doesn't request gzip'ed samples,
+	// which are otherwise accepted, see cbgt.GzipHandler().
+	CompressionDisable bool
+
+	// StatsProtobufDisable, when true, doesn't request the protobuf
+	// encoding of the "/api/stats" samples, which is otherwise
+	// preferred over JSON, see cbgt.PartitionSeqs.
+	StatsProtobufDisable bool
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 func NodeDefsUrlUUIDs(nodeDefs *cbgt.NodeDefs) (r []UrlUUID) {
@@ -180,7 +263,8 @@ func NodeDefsUrlUUIDs(nodeDefs *cbgt.NodeDefs) (r []UrlUUID) {
 
 	for _, nodeDef := range nodeDefs.NodeDefs {
 		// TODO: Security/auth.
-		r = append(r, UrlUUID{"http://" + nodeDef.HostPort, nodeDef.UUID})
+		r = append(r, UrlUUID{cbgt.HostPortURL("http", nodeDef.HostPort),
+			nodeDef.UUID})
 	}
 
 	return r
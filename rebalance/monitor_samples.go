@@ -0,0 +1,184 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rebalance
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// MonitorSamplesPath returns the path of the persisted monitor samples
+// of a rebalance run in a dir, such as a node's dataDir.
+func MonitorSamplesPath(dir, runID string) string {
+	return filepath.Join(dir, "rebalance-"+runID+".samples.json.gz")
+}
+
+// A MonitorSampleRecord is the persisted form of a MonitorSample.
+type MonitorSampleRecord struct {
+	Kind        string          `json:"kind"`
+	Url         string          `json:"url"`
+	UUID        string          `json:"uuid"`
+	Start       time.Time       `json:"start"`
+	Duration    time.Duration   `json:"duration"`
+	Error       string          `json:"error,omitempty"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	TraceParent string          `json:"traceParent,omitempty"`
+}
+
+// A monitorSampleWriter writes the monitor samples of a rebalance run
+// as gzip'ed lines of JSON, keeping every sample that has an error and
+// every Nth of the other samples of each node and kind.
+type monitorSampleWriter struct {
+	f     *os.File
+	gz    *gzip.Writer
+	every int
+	seen  map[string]int // Keyed by node UUID + kind.
+	err   error          // The first write error, after which it's a no-op.
+}
+
+func newMonitorSampleWriter(path string, every int) (
+	*monitorSampleWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("monitor_samples: create, path: %s,"+
+			" err: %v", path, err)
+	}
+
+	if every <= 0 {
+		every = 1
+	}
+
+	return &monitorSampleWriter{
+		f:     f,
+		gz:    gzip.NewWriter(f),
+		every: every,
+		seen:  map[string]int{},
+	}, nil
+}
+
+func (w *monitorSampleWriter) write(s MonitorSample) error {
+	if w.err != nil {
+		return nil // Only the first write error is reported.
+	}
+
+	if s.Error == nil {
+		k := s.UUID + " " + s.Kind
+		n := w.seen[k]
+		w.seen[k] = n + 1
+		if n%w.every != 0 {
+			return nil
+		}
+	}
+
+	rec := MonitorSampleRecord{
+		Kind:        s.Kind,
+		Url:         s.Url,
+		UUID:        s.UUID,
+		Start:       s.Start,
+		Duration:    s.Duration,
+		TraceParent: s.TraceParent,
+	}
+	if s.Error != nil {
+		rec.Error = s.Error.Error()
+	}
+	if len(s.Data) > 0 && strings.HasPrefix(s.ContentType,
+		cbgt.PARTITION_SEQS_PROTOBUF) {
+		// Persisted as the equivalent JSON, to stay readable.
+		seqs, err := cbgt.UnmarshalPartitionSeqs(s.ContentType, s.Data)
+		if err == nil {
+			rec.Data, err = cbgt.MarshalPartitionSeqsJSON(seqs)
+		}
+		if err != nil {
+			rec.Data, _ = json.Marshal(string(s.Data))
+		}
+	} else if len(s.Data) > 0 {
+		if json.Valid(s.Data) {
+			rec.Data = s.Data
+		} else {
+			rec.Data, _ = json.Marshal(string(s.Data))
+		}
+	}
+
+	buf, err := json.Marshal(&rec)
+	if err == nil {
+		_, err = w.gz.Write(append(buf, '\n'))
+	}
+	if err == nil {
+		// Flushed so a crashed rebalance's samples are readable.
+		err = w.gz.Flush()
+	}
+	if err != nil {
+		w.err = fmt.Errorf("monitor_samples: write, path: %s, err: %v",
+			w.f.Name(), err)
+		return w.err
+	}
+
+	return nil
+}
+
+func (w *monitorSampleWriter) Close() error {
+	err := w.gz.Close()
+	err2 := w.f.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+// ReadMonitorSamples reads the persisted monitor samples of a
+// rebalance run, such as from MonitorSamplesPath(), for offline
+// analysis.  The samples of a rebalance that's still running, or
+// that crashed, are read up to the last complete sample.
+func ReadMonitorSamples(path string) ([]*MonitorSampleRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("monitor_samples: gzip, path: %s,"+
+			" err: %v", path, err)
+	}
+	defer gz.Close()
+
+	var rv []*MonitorSampleRecord
+
+	r := bufio.NewReader(gz)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return rv, nil
+			}
+			return rv, err
+		}
+
+		rec := &MonitorSampleRecord{}
+		err = json.Unmarshal(line, rec)
+		if err != nil {
+			return rv, fmt.Errorf("monitor_samples: json, path: %s,"+
+				" err: %v", path, err)
+		}
+		rv = append(rv, rec)
+	}
+}
@@ -0,0 +1,162 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rebalance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/blugelabs/blance"
+
+	"github.com/blugelabs/cbgt"
+)
+
+// waitFormerPrimaryRemovable blocks before a pindex is deleted from a
+// node that was its primary at the start of the rebalance, until the
+// pindex's new primaries are queryable, when the
+// RebalanceOptions.WaitPrimaryReady, and then for the
+// RebalanceOptions.FormerPrimaryGrace, so that the former primary
+// remains for a quick rollback of a bad move.
+func (r *Rebalancer) waitFormerPrimaryRemovable(stopCh, stopCh2 chan struct{},
+	pindex, node string) error {
+	if r.optionsReb.DryRun ||
+		(!r.optionsReb.WaitPrimaryReady && r.optionsReb.FormerPrimaryGrace <= 0) {
+		return nil
+	}
+
+	begPlanPIndex := r.begPlanPIndexes.PlanPIndexes[pindex]
+	if begPlanPIndex == nil || begPlanPIndex.Nodes[node] == nil ||
+		begPlanPIndex.Nodes[node].Priority > 0 {
+		return nil // Not a former primary.
+	}
+
+	planPIndexes, _, err := cbgt.PlannerGetPlanPIndexes(r.cfg, r.version)
+	if err != nil {
+		return err
+	}
+
+	var primaries []string
+	if planPIndex := planPIndexes.PlanPIndexes[pindex]; planPIndex != nil {
+		for n, planPIndexNode := range planPIndex.Nodes {
+			if n != node && planPIndexNode.Priority <= 0 {
+				primaries = append(primaries, n)
+			}
+		}
+	}
+	if len(primaries) == 0 {
+		return nil // Not a move, such as when the pindex is dropped.
+	}
+	sort.Strings(primaries)
+
+	if r.optionsReb.WaitPrimaryReady {
+		for _, primary := range primaries {
+			err = r.waitPIndexReady(stopCh, stopCh2, pindex, primary)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.optionsReb.FormerPrimaryGrace > 0 {
+		r.log.Printf("rebalance: waitFormerPrimaryRemovable, keeping"+
+			" pindex: %s, on node: %s, for: %v, new primaries: %v",
+			pindex, node, r.optionsReb.FormerPrimaryGrace, primaries)
+
+		timer := time.NewTimer(r.optionsReb.FormerPrimaryGrace)
+		defer timer.Stop()
+
+		select {
+		case <-stopCh:
+			return blance.ErrorStopped
+		case <-stopCh2:
+			return blance.ErrorStopped
+		case <-timer.C:
+		}
+	}
+
+	return nil
+}
+
+// waitPIndexReady polls a node's PINDEX_READY_PATH until its pindex
+// is queryable, at the stats sample interval.
+func (r *Rebalancer) waitPIndexReady(stopCh, stopCh2 chan struct{},
+	pindex, node string) error {
+	nodeDef := r.begNodeDefs.NodeDefs[node]
+	if nodeDef == nil {
+		r.log.Printf("rebalance: waitPIndexReady, unknown node: %s", node)
+		return nil
+	}
+
+	u := cbgt.HostPortURL("http", nodeDef.HostPort) + cbgt.PINDEX_READY_PATH +
+		"?pindex=" + url.QueryEscape(pindex)
+
+	ticker := time.NewTicker(r.Settings().StatsSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		if r.isNodeSkipped(node) {
+			r.log.Printf("rebalance: waitPIndexReady, skipped node,"+
+				" pindex: %s, node: %s", pindex, node)
+			return nil
+		}
+
+		ready, err := r.pindexReady(u)
+		if ready {
+			r.log.Printf("rebalance: waitPIndexReady, ready,"+
+				" pindex: %s, node: %s", pindex, node)
+			return nil
+		}
+
+		r.log.Printf("rebalance: waitPIndexReady, not ready,"+
+			" pindex: %s, node: %s, err: %v", pindex, node, err)
+
+		select {
+		case <-stopCh:
+			return blance.ErrorStopped
+		case <-stopCh2:
+			return blance.ErrorStopped
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Rebalancer) pindexReady(u string) (bool, error) {
+	httpGet := r.optionsReb.HttpGet
+	if httpGet == nil {
+		httpGet = http.Get
+	}
+
+	resp, err := httpGet(u)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status: %d", resp.StatusCode)
+	}
+
+	var status cbgt.PIndexReadyStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return false, err
+	}
+	if status.Error != "" {
+		return false, fmt.Errorf("%s", status.Error)
+	}
+
+	return status.Ready, nil
+}
@@ -0,0 +1,196 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rebalance
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The names of the built-in RebalanceProfiles.
+const (
+	// ProfileConservative moves one pindex per node at a time, via
+	// replica promotion, samples the nodes less often, pauses rather
+	// than aborts on an exceeded error budget, and keeps a former
+	// primary for a while after its new primary is queryable.
+	ProfileConservative = "conservative"
+
+	// ProfileBalanced is a middle ground for most clusters, which
+	// waits for a new primary to be queryable before deleting the
+	// former primary.
+	ProfileBalanced = "balanced"
+
+	// ProfileAggressive moves many pindexes per node concurrently,
+	// assigns primaries directly, favors the fewest node changes, and
+	// skips a misbehaving node rather than aborting.
+	ProfileAggressive = "aggressive"
+)
+
+// A RebalanceProfile is a named preset of the rebalance knobs.  See
+// RebalanceOptions.Profile.
+type RebalanceProfile struct {
+	FavorMinNodes                      bool
+	MaxConcurrentPartitionMovesPerNode int
+	AddPrimaryDirectly                 bool
+	StatsSampleInterval                time.Duration
+	ErrorBudgetPolicy                  *ErrorBudgetPolicy
+	WaitPrimaryReady                   bool
+	FormerPrimaryGrace                 time.Duration
+}
+
+// RebalanceProfiles are the RebalanceProfiles keyed by name, which
+// an application may extend during its init().
+var RebalanceProfiles = map[string]*RebalanceProfile{
+	ProfileConservative: {
+		MaxConcurrentPartitionMovesPerNode: 1,
+		StatsSampleInterval:                5 * time.Second,
+		WaitPrimaryReady:                   true,
+		FormerPrimaryGrace:                 time.Minute,
+		ErrorBudgetPolicy: &ErrorBudgetPolicy{
+			Network: ErrorBudget{
+				MaxErrors: 10,
+				Window:    time.Minute,
+				Action:    ErrorBudgetPause,
+			},
+			PIndexMissing: ErrorBudget{
+				MaxErrors: 20,
+				Window:    2 * time.Minute,
+				Action:    ErrorBudgetPause,
+			},
+		},
+	},
+	ProfileBalanced: {
+		MaxConcurrentPartitionMovesPerNode: 2,
+		StatsSampleInterval:                DEFAULT_STATS_SAMPLE_INTERVAL_SECS * time.Second,
+		ErrorBudgetPolicy:                  &DefaultErrorBudgetPolicy,
+		WaitPrimaryReady:                   true,
+	},
+	ProfileAggressive: {
+		FavorMinNodes:                      true,
+		MaxConcurrentPartitionMovesPerNode: 8,
+		AddPrimaryDirectly:                 true,
+		StatsSampleInterval:                500 * time.Millisecond,
+		ErrorBudgetPolicy: &ErrorBudgetPolicy{
+			Network: ErrorBudget{
+				MaxErrors: 5,
+				Window:    30 * time.Second,
+				Action:    ErrorBudgetSkipNode,
+			},
+			PIndexMissing: ErrorBudget{
+				MaxErrors: 10,
+				Window:    time.Minute,
+				Action:    ErrorBudgetSkipNode,
+			},
+		},
+	},
+}
+
+// RebalanceProfileNames returns the sorted names of the
+// RebalanceProfiles.
+func RebalanceProfileNames() []string {
+	rv := make([]string, 0, len(RebalanceProfiles))
+	for name := range RebalanceProfiles {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// RebalanceSettings are the effective settings of a rebalance, after
+// its RebalanceOptions.Profile, if any, was expanded.
+type RebalanceSettings struct {
+	Profile string `json:"profile,omitempty"`
+
+	FavorMinNodes                      bool          `json:"favorMinNodes"`
+	MaxConcurrentPartitionMovesPerNode int           `json:"maxConcurrentPartitionMovesPerNode"`
+	AddPrimaryDirectly                 bool          `json:"addPrimaryDirectly"`
+	StatsSampleInterval                time.Duration `json:"statsSampleInterval"`
+	StatsSampleErrorThreshold          int           `json:"statsSampleErrorThreshold,omitempty"`
+
+	ErrorBudgetPolicy *ErrorBudgetPolicy `json:"errorBudgetPolicy,omitempty"`
+
+	WaitPrimaryReady   bool          `json:"waitPrimaryReady"`
+	FormerPrimaryGrace time.Duration `json:"formerPrimaryGrace"`
+
+	DryRun bool `json:"dryRun"`
+}
+
+// expandProfile returns the options with the knobs of their Profile
+// filled in, where the knobs that were explicitly set, as non-zero
+// values, are kept.
+func expandProfile(o RebalanceOptions) (RebalanceOptions, error) {
+	if o.Profile == "" {
+		return o, nil
+	}
+
+	p := RebalanceProfiles[o.Profile]
+	if p == nil {
+		return o, fmt.Errorf("profile: unknown profile: %q, known: %v",
+			o.Profile, RebalanceProfileNames())
+	}
+
+	o.FavorMinNodes = o.FavorMinNodes || p.FavorMinNodes
+	o.AddPrimaryDirectly = o.AddPrimaryDirectly || p.AddPrimaryDirectly
+	o.WaitPrimaryReady = o.WaitPrimaryReady || p.WaitPrimaryReady
+	if o.FormerPrimaryGrace <= 0 {
+		o.FormerPrimaryGrace = p.FormerPrimaryGrace
+	}
+	if o.MaxConcurrentPartitionMovesPerNode <= 0 {
+		o.MaxConcurrentPartitionMovesPerNode =
+			p.MaxConcurrentPartitionMovesPerNode
+	}
+	if o.StatsSampleInterval <= 0 {
+		o.StatsSampleInterval = p.StatsSampleInterval
+	}
+	if o.ErrorBudgetPolicy == nil && o.StatsSampleErrorThreshold == nil &&
+		p.ErrorBudgetPolicy != nil {
+		policy := *p.ErrorBudgetPolicy
+		o.ErrorBudgetPolicy = &policy
+	}
+
+	return o, nil
+}
+
+// settingsOf returns the effective settings of the expanded options.
+func settingsOf(o RebalanceOptions) *RebalanceSettings {
+	rv := &RebalanceSettings{
+		Profile:                            o.Profile,
+		FavorMinNodes:                      o.FavorMinNodes,
+		MaxConcurrentPartitionMovesPerNode: o.MaxConcurrentPartitionMovesPerNode,
+		AddPrimaryDirectly:                 o.AddPrimaryDirectly,
+		StatsSampleInterval:                o.StatsSampleInterval,
+		ErrorBudgetPolicy:                  o.ErrorBudgetPolicy,
+		WaitPrimaryReady:                   o.WaitPrimaryReady,
+		FormerPrimaryGrace:                 o.FormerPrimaryGrace,
+		DryRun:                             o.DryRun,
+	}
+	if rv.MaxConcurrentPartitionMovesPerNode <= 0 {
+		rv.MaxConcurrentPartitionMovesPerNode = 1 // The blance default.
+	}
+	if rv.StatsSampleInterval <= 0 {
+		rv.StatsSampleInterval =
+			DEFAULT_STATS_SAMPLE_INTERVAL_SECS * time.Second
+	}
+	if rv.ErrorBudgetPolicy == nil {
+		rv.StatsSampleErrorThreshold = int(StatsSampleErrorThreshold)
+		if o.StatsSampleErrorThreshold != nil {
+			rv.StatsSampleErrorThreshold = *o.StatsSampleErrorThreshold
+		}
+	}
+	return rv
+}
+
+// Settings returns the effective settings of the rebalance.
+func (r *Rebalancer) Settings() *RebalanceSettings {
+	return settingsOf(r.optionsReb)
+}
@@ -12,6 +12,7 @@
 package rebalance
 
 import (
+	"encoding/json"
 	"sort"
 
 	"github.com/blugelabs/blance"
@@ -46,6 +47,13 @@ type ProgressEntry struct {
 	Done bool
 }
 
+// DiffOrchestratorProgress returns the changes of the counters of an
+// OrchestratorProgress from a to b, such as between two consecutive
+// RebalanceProgress updates of an index.
+func DiffOrchestratorProgress(a, b blance.OrchestratorProgress) []cbgt.FieldChange {
+	return cbgt.StructFieldChanges(a, b)
+}
+
 // ReportProgress tracks progress in progress entries and invokes the
 // progressToString handler, whose output will be logged.
 func ReportProgress(r *Rebalancer,
@@ -66,6 +74,9 @@ func ReportProgress(r *Rebalancer,
 	seenPIndexes := map[string]bool{}
 	seenPIndexesSorted := []string(nil)
 
+	settingsJSON, _ := json.Marshal(r.Settings())
+	r.log.Printf("progress: settings: %s", settingsJSON)
+
 	updateProgressEntry := func(pindex, sourcePartition, node string,
 		cb func(*ProgressEntry)) {
 		if !seenNodes[node] {
@@ -119,6 +130,8 @@ func ReportProgress(r *Rebalancer,
 	}
 
 	for progress := range r.ProgressCh() {
+		publishProgress(r, &progress)
+
 		if progress.Error != nil {
 			r.log.Printf("progress: error, progress: %+v", progress)
 
@@ -131,6 +144,20 @@ func ReportProgress(r *Rebalancer,
 			continue
 		}
 
+		if progress.ErrorBudget != nil {
+			r.log.Printf("progress: warning, error budget exceeded,"+
+				" node: %s, kind: %s, action: %s",
+				progress.ErrorBudget.Node, progress.ErrorBudget.Kind,
+				progress.ErrorBudget.Action)
+		}
+
+		if progress.FrozenPlan != nil {
+			r.log.Printf("progress: warning, plan frozen, index: %s,"+
+				" pindexes remain on departing nodes: %v",
+				progress.FrozenPlan.Index,
+				progress.FrozenPlan.StrandedPIndexes)
+		}
+
 		UpdateProgressEntries(r, updateProgressEntry)
 
 		currEmit := progressToString(maxNodeLen, maxPIndexLen,
@@ -149,6 +176,42 @@ func ReportProgress(r *Rebalancer,
 	return firstError
 }
 
+// A ProgressEvent is a RebalanceProgress that's published to the
+// cbgt.EventSinks of the RebalanceOptions.Manager, if any.
+type ProgressEvent struct {
+	Event string `json:"event"` // Always "rebalanceProgress".
+	Index string `json:"index,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	OrchestratorProgress blance.OrchestratorProgress `json:"orchestratorProgress"`
+
+	FrozenPlan  *FrozenPlanWarning `json:"frozenPlan,omitempty"`
+	ErrorBudget *ErrorBudgetEvent  `json:"errorBudget,omitempty"`
+
+	// Settings are the effective settings of the rebalance.
+	Settings *RebalanceSettings `json:"settings,omitempty"`
+}
+
+func publishProgress(r *Rebalancer, progress *RebalanceProgress) {
+	if r.optionsReb.Manager == nil {
+		return
+	}
+
+	e := &ProgressEvent{
+		Event:                "rebalanceProgress",
+		Index:                progress.Index,
+		OrchestratorProgress: progress.OrchestratorProgress,
+		FrozenPlan:           progress.FrozenPlan,
+		ErrorBudget:          progress.ErrorBudget,
+		Settings:             r.Settings(),
+	}
+	if progress.Error != nil {
+		e.Error = progress.Error.Error()
+	}
+
+	r.optionsReb.Manager.PublishEvent(cbgt.EVENT_CATEGORY_REBALANCE, e)
+}
+
 // UpdateProgressEntries invokes the updateProgressEntry callback to
 // help maintain progress entries information.
 func UpdateProgressEntries(
@@ -15,10 +15,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/blugelabs/blance"
 	"github.com/blugelabs/cbgt"
@@ -40,9 +42,34 @@ type RebalanceProgress struct {
 	Index string
 
 	OrchestratorProgress blance.OrchestratorProgress
+
+	// FrozenPlan, when non-nil, warns that the Index's plan is frozen
+	// and was skipped, stranding pindexes on departing nodes.
+	FrozenPlan *FrozenPlanWarning
+
+	// ErrorBudget, when non-nil, reports a node's exceeded error
+	// budget.  See RebalanceOptions.ErrorBudgetPolicy.
+	ErrorBudget *ErrorBudgetEvent
+}
+
+// A FrozenPlanWarning describes a frozen index whose plan the
+// rebalance skipped, even though some of its pindexes remain on
+// nodes that are being removed.
+type FrozenPlanWarning struct {
+	Index string `json:"index"`
+
+	// StrandedPIndexes are keyed by pindex name, with the departing
+	// nodes of each pindex.
+	StrandedPIndexes map[string][]string `json:"strandedPIndexes"`
 }
 
 type RebalanceOptions struct {
+	// Optional, the name of a RebalanceProfile, such as
+	// ProfileConservative, whose knobs fill in the options that are
+	// left at their zero values.  See Rebalancer.Settings() for the
+	// effective, expanded settings.
+	Profile string
+
 	// See blance.CalcPartitionMoves(favorMinNodes).
 	FavorMinNodes bool
 
@@ -56,6 +83,33 @@ type RebalanceOptions struct {
 
 	DryRun bool // When true, no changes, for analysis/planning.
 
+	// OverrideFrozenPlans, when true, means the indexes with frozen
+	// plans are rebalanced like any other index.  Otherwise, their
+	// plans are kept as-is, and any of their pindexes that remain on
+	// departing nodes are reported as a FrozenPlanWarning.
+	OverrideFrozenPlans bool
+
+	// ForceUnsafeMoves, when true, means the rebalance moves the
+	// pindexes of an index even when it could lose some of them,
+	// which are then only logged.  Otherwise, the rebalance stops
+	// with an UnsafeRebalanceError.  See CalcPIndexesAtRisk().
+	ForceUnsafeMoves bool
+
+	// WaitPrimaryReady, when true, means a former primary pindex is
+	// only deleted from a node once its new primaries report that
+	// they're queryable, see cbgt.PINDEX_READY_PATH and
+	// cbgt.DestReady, rather than only caught up with the seqs.
+	WaitPrimaryReady bool
+
+	// FormerPrimaryGrace is how long a former primary pindex is kept
+	// after its move, before it's deleted, for a quick rollback of a
+	// bad move.
+	FormerPrimaryGrace time.Duration
+
+	// Optional, how often the nodes' stats are sampled, which
+	// defaults to DEFAULT_STATS_SAMPLE_INTERVAL_SECS.
+	StatsSampleInterval time.Duration
+
 	Log     RebalanceLogFunc
 	Verbose int
 
@@ -63,11 +117,43 @@ type RebalanceOptions struct {
 	// for unit testing.
 	HttpGet func(url string) (resp *http.Response, err error)
 
+	// Optional, the span whose trace the rebalance's monitoring
+	// samples join, where nil means the rebalance starts a trace.
+	TraceParent *cbgt.TraceParent
+
+	// Optional, the id of the rebalance run, which defaults to a new
+	// UUID.  See Rebalancer.RunID().  Starting a run again while it's
+	// running returns its Rebalancer, so retries are idempotent.
+	RunID string
+
+	// Optional, who starts the rebalance, such as a tool and user,
+	// which is recorded in the RebalanceLock.  See GetRebalanceStatus().
+	Owner string
+
+	// ForceLock, when true, steals the RebalanceLock from another
+	// rebalance, which then stops with ErrorRebalanceLockLost.
+	// Otherwise, the start fails with a RebalanceLockedError while
+	// another rebalance is running.
+	ForceLock bool
+
+	// SamplesDir, when non-empty, is a dir, such as the dataDir, where
+	// the monitor samples of the rebalance are persisted, for offline
+	// analysis of a failed rebalance.  See MonitorSamplesPath() and
+	// ReadMonitorSamples().  When SamplesEvery is > 1, only every Nth
+	// sample of each node and kind is persisted, plus the errors.
+	SamplesDir   string
+	SamplesEvery int
+
 	SkipSeqChecks bool // For unit-testing.
 
 	Manager *cbgt.Manager
 
 	StatsSampleErrorThreshold *int
+
+	// Optional, per-node error budgets over sliding windows, which
+	// replace the StatsSampleErrorThreshold's consecutive error
+	// counting.  See DefaultErrorBudgetPolicy.
+	ErrorBudgetPolicy *ErrorBudgetPolicy
 }
 
 type RebalanceLogFunc func(format string, v ...interface{})
@@ -81,17 +167,26 @@ type Rebalancer struct {
 	optionsMgr map[string]string // See cbgt.Manager's options.
 	optionsReb RebalanceOptions
 	progressCh chan RebalanceProgress
+	runID      string
+
+	sampleWriter *monitorSampleWriter // Only used by runMonitor().
+
+	errorBudgets *errorBudgets // Nil when there's no ErrorBudgetPolicy.
+
+	locked     bool          // True when holding the RebalanceLock.
+	lockDoneCh chan struct{} // Closed when runLockHeartbeat() is done.
 
 	monitor             *MonitorNodes
 	monitorDoneCh       chan struct{}
 	monitorSampleCh     chan MonitorSample
 	monitorSampleWantCh chan chan MonitorSample
 
-	nodesAll      []string          // Array of node UUID's.
-	nodesToAdd    []string          // Array of node UUID's.
-	nodesToRemove []string          // Array of node UUID's.
-	nodeWeights   map[string]int    // Keyed by node UUID.
-	nodeHierarchy map[string]string // Keyed by node UUID.
+	nodesAll      []string            // Array of node UUID's.
+	nodesToAdd    []string            // Array of node UUID's.
+	nodesToRemove []string            // Array of node UUID's.
+	nodeWeights   map[string]int      // Keyed by node UUID.
+	nodeHierarchy map[string]string   // Keyed by node UUID.
+	nodeTags      map[string][]string // Keyed by node UUID.
 
 	begIndexDefs       *cbgt.IndexDefs
 	begNodeDefs        *cbgt.NodeDefs
@@ -104,6 +199,8 @@ type Rebalancer struct {
 
 	endPlanPIndexes *cbgt.PlanPIndexes
 
+	frozenPlanWarnings []*FrozenPlanWarning
+
 	// We start a new blance.Orchestrator for each index.
 	o *blance.Orchestrator
 
@@ -151,6 +248,20 @@ func StartRebalance(version string, cfg cbgt.Cfg, log cbgt.Log, server string,
 	*Rebalancer, error) {
 	// TODO: Need timeouts on moves.
 	//
+	optionsReb, err := expandProfile(optionsReb)
+	if err != nil {
+		return nil, fmt.Errorf("rebalance: %v", err)
+	}
+
+	// Starts are serialized, so that a retried start of a run that's
+	// running in this process returns its Rebalancer.
+	rebalancersM.Lock()
+	defer rebalancersM.Unlock()
+
+	if r := rebalancers[optionsReb.RunID]; r != nil {
+		return r, nil
+	}
+
 	uuid := "" // We don't have a uuid, as we're not a node.
 
 	begIndexDefs, begNodeDefs, begPlanPIndexes, begPlanPIndexesCAS, err :=
@@ -181,14 +292,57 @@ func StartRebalance(version string, cfg cbgt.Cfg, log cbgt.Log, server string,
 
 	monitorSampleCh := make(chan MonitorSample)
 
+	runID := optionsReb.RunID
+	if runID == "" {
+		runID = cbgt.NewUUID()
+	}
+
+	// A dry run changes nothing, so it doesn't need the lock.
+	locked := !optionsReb.DryRun
+	if locked {
+		_, err = AcquireRebalanceLock(cfg, runID, optionsReb.Owner,
+			optionsReb.ForceLock)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	releaseLock := func() {
+		if locked {
+			ReleaseRebalanceLock(cfg, runID)
+		}
+	}
+
+	var sampleWriter *monitorSampleWriter
+	if optionsReb.SamplesDir != "" {
+		sampleWriter, err = newMonitorSampleWriter(
+			MonitorSamplesPath(optionsReb.SamplesDir, runID),
+			optionsReb.SamplesEvery)
+		if err != nil {
+			releaseLock()
+			return nil, err
+		}
+	}
+
+	traceParent := optionsReb.TraceParent
+	if traceParent == nil {
+		traceParent = cbgt.NewTraceParent()
+	}
+
 	monitorOptions := MonitorNodesOptions{
-		DiagSampleDisable: true,
-		HttpGet:           optionsReb.HttpGet,
+		StatsSampleInterval: optionsReb.StatsSampleInterval,
+		DiagSampleDisable:   true,
+		HttpGet:             optionsReb.HttpGet,
+		TraceParent:         traceParent,
 	}
 
 	monitorInst, err := StartMonitorNodes(urlUUIDs,
 		monitorSampleCh, monitorOptions)
 	if err != nil {
+		if sampleWriter != nil {
+			sampleWriter.Close()
+		}
+		releaseLock()
 		return nil, err
 	}
 
@@ -203,8 +357,12 @@ func StartRebalance(version string, cfg cbgt.Cfg, log cbgt.Log, server string,
 		optionsMgr:          optionsMgr,
 		optionsReb:          optionsReb,
 		progressCh:          make(chan RebalanceProgress),
+		runID:               runID,
+		sampleWriter:        sampleWriter,
 		monitor:             monitorInst,
 		monitorDoneCh:       make(chan struct{}),
+		locked:              locked,
+		lockDoneCh:          make(chan struct{}),
 		monitorSampleCh:     monitorSampleCh,
 		monitorSampleWantCh: make(chan chan MonitorSample),
 		nodesAll:            nodesAll,
@@ -212,6 +370,7 @@ func StartRebalance(version string, cfg cbgt.Cfg, log cbgt.Log, server string,
 		nodesToRemove:       nodesToRemove,
 		nodeWeights:         nodeWeights,
 		nodeHierarchy:       nodeHierarchy,
+		nodeTags:            cbgt.CalcNodeTags(begNodeDefs),
 		begIndexDefs:        begIndexDefs,
 		begNodeDefs:         begNodeDefs,
 		begPlanPIndexes:     begPlanPIndexes,
@@ -224,6 +383,13 @@ func StartRebalance(version string, cfg cbgt.Cfg, log cbgt.Log, server string,
 		log:                 log,
 	}
 
+	if optionsReb.ErrorBudgetPolicy != nil {
+		r.errorBudgets = newErrorBudgets(*optionsReb.ErrorBudgetPolicy)
+	}
+
+	r.log.Printf("rebalance: runID: %s", runID)
+	settingsJSON, _ := json.Marshal(r.Settings())
+	r.log.Printf("rebalance: settings: %s", settingsJSON)
 	r.log.Printf("rebalance: nodesAll: %#v", nodesAll)
 	r.log.Printf("rebalance: nodesToAdd: %#v", nodesToAdd)
 	r.log.Printf("rebalance: nodesToRemove: %#v", nodesToRemove)
@@ -234,6 +400,7 @@ func StartRebalance(version string, cfg cbgt.Cfg, log cbgt.Log, server string,
 	// r.log.Printf("rebalance: begNodeDefs: %#v", begNodeDefs)
 
 	r.log.Printf("rebalance: monitor urlUUIDs: %#v", urlUUIDs)
+	r.log.Printf("rebalance: monitor traceparent: %s", traceParent)
 
 	r.initPlansForRecoveryRebalance(nodesToAdd)
 
@@ -245,6 +412,14 @@ func StartRebalance(version string, cfg cbgt.Cfg, log cbgt.Log, server string,
 	// TODO: Prepopulate currStates so that we can double-check that
 	// our state transitions in assignPartition are valid.
 
+	rebalancers[runID] = r
+
+	if locked {
+		go r.runLockHeartbeat(stopCh)
+	} else {
+		close(r.lockDoneCh)
+	}
+
 	go r.runMonitor(stopCh)
 
 	go r.runRebalanceIndexes(stopCh)
@@ -268,6 +443,11 @@ func (r *Rebalancer) Stop() {
 	r.m.Unlock()
 }
 
+// RunID returns the id of the rebalance run.
+func (r *Rebalancer) RunID() string {
+	return r.runID
+}
+
 // ProgressCh() returns a channel that is updated occasionally when
 // the rebalance has made some progress on one or more partition
 // reassignments, or has reached an error.  The channel is closed when
@@ -325,11 +505,27 @@ func (r *Rebalancer) Visit(visitor VisitFunc) {
 // --------------------------------------------------------
 
 // GetEndPlanPIndexes return value should be treated as immutable.
+// It structurally shares the PlanPIndex children, which are never
+// modified in place by the rebalancer.
 func (r *Rebalancer) GetEndPlanPIndexes() *cbgt.PlanPIndexes {
 	r.m.Lock()
-	ppi := *r.endPlanPIndexes
+	ppi := r.endPlanPIndexes.Clone()
 	r.m.Unlock()
-	return &ppi
+	return ppi
+}
+
+// WriteEndPlanPIndexesJSON writes the current endPlanPIndexes as JSON
+// to a io.Writer, such as for diagnosing a rebalance.
+func (r *Rebalancer) WriteEndPlanPIndexesJSON(w io.Writer) error {
+	r.m.Lock()
+	j, err := json.Marshal(r.endPlanPIndexes)
+	r.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(j)
+	return err
 }
 
 // --------------------------------------------------------
@@ -347,6 +543,20 @@ func (r *Rebalancer) runRebalanceIndexes(stopCh chan struct{}) {
 
 		<-r.monitorDoneCh
 
+		<-r.lockDoneCh
+
+		if r.locked {
+			err := ReleaseRebalanceLock(r.cfg, r.runID)
+			if err != nil {
+				r.log.Warnf("rebalance: release lock, runID: %s, err: %v",
+					r.runID, err)
+			}
+		}
+
+		rebalancersM.Lock()
+		delete(rebalancers, r.runID)
+		rebalancersM.Unlock()
+
 		close(r.progressCh)
 
 		// TODO: Need to close monitorSampleWantCh?
@@ -380,6 +590,47 @@ func (r *Rebalancer) runRebalanceIndexes(stopCh chan struct{}) {
 
 // --------------------------------------------------------
 
+// calcFrozenPlanWarningLOCKED returns a FrozenPlanWarning if any of
+// the index's pindexes in the endPlanPIndexes are on departing nodes.
+func (r *Rebalancer) calcFrozenPlanWarningLOCKED(
+	indexName string) *FrozenPlanWarning {
+	if len(r.nodesToRemove) == 0 {
+		return nil
+	}
+
+	departing := cbgt.StringsToMap(r.nodesToRemove)
+
+	stranded := map[string][]string{}
+	for name, planPIndex := range r.endPlanPIndexes.PlanPIndexes {
+		if planPIndex.IndexName != indexName {
+			continue
+		}
+		for node := range planPIndex.Nodes {
+			if departing[node] {
+				stranded[name] = append(stranded[name], node)
+			}
+		}
+		sort.Strings(stranded[name])
+	}
+	if len(stranded) == 0 {
+		return nil
+	}
+
+	return &FrozenPlanWarning{Index: indexName, StrandedPIndexes: stranded}
+}
+
+// FrozenPlanWarnings returns the warnings for the frozen indexes that
+// the rebalance has skipped so far, whose pindexes remain on departing
+// nodes.
+func (r *Rebalancer) FrozenPlanWarnings() []*FrozenPlanWarning {
+	r.m.Lock()
+	rv := append([]*FrozenPlanWarning(nil), r.frozenPlanWarnings...)
+	r.m.Unlock()
+	return rv
+}
+
+// --------------------------------------------------------
+
 // GetMovingPartitionsCount returns the total partitions
 // to be moved as a part of the rebalance operation.
 func (r *Rebalancer) GetMovingPartitionsCount() int {
@@ -415,22 +666,42 @@ func (r *Rebalancer) rebalanceIndex(stopCh chan struct{},
 	changed bool, err error) {
 	r.log.Printf(" rebalanceIndex: indexDef.Name: %s", indexDef.Name)
 
-	r.m.Lock()
-	if cbgt.CasePlanFrozen(indexDef, r.begPlanPIndexes, r.endPlanPIndexes) {
-		r.m.Unlock()
-
+	if indexDef.PlanParams.PlanFrozen && r.optionsReb.OverrideFrozenPlans {
 		r.log.Printf("  plan frozen: indexDef.Name: %s,"+
-			" cloned previous plan", indexDef.Name)
+			" overridden, rebalancing", indexDef.Name)
+	} else {
+		r.m.Lock()
+		if cbgt.CasePlanFrozen(indexDef, r.begPlanPIndexes, r.endPlanPIndexes) {
+			w := r.calcFrozenPlanWarningLOCKED(indexDef.Name)
+			if w != nil {
+				r.frozenPlanWarnings = append(r.frozenPlanWarnings, w)
+			}
+			r.m.Unlock()
 
-		return false, nil
+			r.log.Printf("  plan frozen: indexDef.Name: %s,"+
+				" cloned previous plan", indexDef.Name)
+
+			if w != nil {
+				r.log.Printf("  plan frozen: indexDef.Name: %s,"+
+					" WARNING: pindexes remain on departing nodes: %v,"+
+					" see RebalanceOptions.OverrideFrozenPlans",
+					indexDef.Name, w.StrandedPIndexes)
+
+				r.progressCh <- RebalanceProgress{
+					Index:      indexDef.Name,
+					FrozenPlan: w,
+				}
+			}
+
+			return false, nil
+		}
+		r.m.Unlock()
 	}
-	r.m.Unlock()
 
 	// Skip indexDef's with no instantiatable pindexImplType, such
 	// as index aliases.
-	pindexImplType, exists := cbgt.PIndexImplTypes[indexDef.Type]
-	if !exists ||
-		pindexImplType == nil ||
+	pindexImplType := cbgt.GetPIndexImplType(indexDef.Type)
+	if pindexImplType == nil ||
 		pindexImplType.New == nil ||
 		pindexImplType.Open == nil {
 		return false, nil
@@ -441,6 +712,24 @@ func (r *Rebalancer) rebalanceIndex(stopCh chan struct{},
 		return false, err
 	}
 
+	atRisk := CalcPIndexesAtRisk(partitionModel, begMap, endMap,
+		r.nodesToRemove, r.optionsReb.FavorMinNodes)
+	if len(atRisk) > 0 {
+		errUnsafe := &UnsafeRebalanceError{
+			Index:    indexDef.Name,
+			PIndexes: atRisk,
+		}
+		if !r.optionsReb.ForceUnsafeMoves {
+			r.log.Printf("  rebalanceIndex: %v", errUnsafe)
+			r.progressCh <- RebalanceProgress{
+				Error: errUnsafe,
+				Index: indexDef.Name,
+			}
+			return false, errUnsafe
+		}
+		r.log.Printf("  rebalanceIndex: forced, WARNING: %v", errUnsafe)
+	}
+
 	assignPartitionsFunc := func(stopCh2 chan struct{}, node string,
 		partitions, states, ops []string) error {
 		r.log.Printf("rebalance: assignPIndexes, index: %s, node: %s, partitions: %v,"+
@@ -594,16 +883,16 @@ func (r *Rebalancer) calcBegEndMaps(indexDef *cbgt.IndexDef) (
 		// be able to come up with the same exact plan for the
 		// same set of nodes and the original planPIndexes.
 		r.log.Printf("  calcBegEndMaps: recovery rebalance for index: %s", indexDef.Name)
-		warnings = cbgt.BlancePlanPIndexes("", indexDef,
+		warnings = cbgt.BlancePlanPIndexesEx("", indexDef,
 			endPlanPIndexesForIndex, r.recoveryPlanPIndexes,
 			r.nodesAll, []string{}, r.nodesToRemove,
-			r.nodeWeights, r.nodeHierarchy)
+			r.nodeWeights, r.nodeHierarchy, r.nodeTags)
 	} else {
 		// Invoke blance to assign the endPlanPIndexesForIndex to nodes.
-		warnings = cbgt.BlancePlanPIndexes("", indexDef,
+		warnings = cbgt.BlancePlanPIndexesEx("", indexDef,
 			endPlanPIndexesForIndex, r.begPlanPIndexes,
 			r.nodesAll, r.nodesToAdd, r.nodesToRemove,
-			r.nodeWeights, r.nodeHierarchy)
+			r.nodeWeights, r.nodeHierarchy, r.nodeTags)
 	}
 
 	r.endPlanPIndexes.Warnings[indexDef.Name] = warnings
@@ -614,9 +903,19 @@ func (r *Rebalancer) calcBegEndMaps(indexDef *cbgt.IndexDef) (
 			indexDef.Name, warning)
 	}
 
-	j, _ := json.Marshal(r.endPlanPIndexes)
+	// Only summarize the endPlanPIndexes, as marshaling all of them on
+	// every index is O(cluster size) per index.  See also
+	// WriteEndPlanPIndexesJSON() for an on-demand dump.
 	r.log.Printf("  calcBegEndMaps: indexDef.Name: %s,"+
-		" endPlanPIndexes: %s", indexDef.Name, j)
+		" planPIndexes for index: %d, endPlanPIndexes: %d, warnings: %d",
+		indexDef.Name, len(endPlanPIndexesForIndex),
+		len(r.endPlanPIndexes.PlanPIndexes), len(warnings))
+
+	if r.optionsReb.Verbose > 1 {
+		j, _ := json.Marshal(endPlanPIndexesForIndex)
+		r.log.Printf("  calcBegEndMaps: indexDef.Name: %s,"+
+			" planPIndexes for index: %s", indexDef.Name, j)
+	}
 
 	partitionModel, _ = cbgt.BlancePartitionModel(indexDef)
 
@@ -646,6 +945,28 @@ func (r *Rebalancer) assignPIndexes(stopCh, stopCh2 chan struct{},
 		" pindexes: %v, node: %s, target states: %v, target ops: %v",
 		index, pindexes, node, states, ops)
 
+	// Move then delete, so a former primary is only deleted once its
+	// replacements are verified.
+	var wgDel sync.WaitGroup
+	delErrCh := make(chan error, len(pindexesMoves))
+	for _, pm := range pindexesMoves {
+		if pm.stateOps[0].Op == "del" {
+			wgDel.Add(1)
+			go func(pindex string) {
+				delErrCh <- r.waitFormerPrimaryRemovable(stopCh, stopCh2,
+					pindex, node)
+				wgDel.Done()
+			}(pm.name)
+		}
+	}
+	wgDel.Wait()
+	close(delErrCh)
+	for err := range delErrCh {
+		if err != nil {
+			return err
+		}
+	}
+
 	// Move multiple partitions one step at a time. There could be a
 	// few potential multi-step partition movements.
 	var next int
@@ -878,6 +1199,11 @@ func (r *Rebalancer) updatePlanPIndexesLOCKED(
 		return "", err
 	}
 
+	// Clone on modify, as the planPIndex might be shared, such as with
+	// the result of an earlier GetEndPlanPIndexes().
+	planPIndex = planPIndex.Clone()
+	planPIndexes.PlanPIndexes[pindex] = planPIndex
+
 	formerPrimaryNode := ""
 	for node, planPIndexNode := range planPIndex.Nodes {
 		if planPIndexNode.Priority <= 0 {
@@ -911,6 +1237,8 @@ func (r *Rebalancer) updatePlanPIndexesLOCKED(
 			CanRead:  canRead,
 			CanWrite: canWrite,
 			Priority: priority,
+			MinSeqs: r.calcMinSeqsLOCKED(planPIndex, node,
+				state, formerPrimaryNode),
 		}
 	} else {
 		if planPIndex.Nodes[node] == nil {
@@ -943,6 +1271,8 @@ func (r *Rebalancer) updatePlanPIndexesLOCKED(
 				CanRead:  canRead,
 				CanWrite: canWrite,
 				Priority: priority,
+				MinSeqs: r.calcMinSeqsLOCKED(planPIndex, node,
+					state, formerPrimaryNode),
 			}
 		}
 	}
@@ -956,6 +1286,39 @@ func (r *Rebalancer) updatePlanPIndexesLOCKED(
 
 // --------------------------------------------------------
 
+// calcMinSeqsLOCKED returns the consistency barrier for a node that's
+// being promoted to primary, so that queries will wait for, or fall
+// back to the former primary until, the node reaches the seqs that
+// the former primary had.  Returns nil if no barrier is needed.
+func (r *Rebalancer) calcMinSeqsLOCKED(planPIndex *cbgt.PlanPIndex,
+	node, state, formerPrimaryNode string) map[string]uint64 {
+	if state != "primary" ||
+		formerPrimaryNode == "" || formerPrimaryNode == node {
+		return nil
+	}
+
+	var rv map[string]uint64
+
+	for _, sourcePartition := range strings.Split(planPIndex.SourcePartitions, ",") {
+		uuidSeq, exists := GetUUIDSeq(r.wantSeqs, planPIndex.Name,
+			sourcePartition, node)
+		if !exists {
+			uuidSeq, exists = GetUUIDSeq(r.currSeqs, planPIndex.Name,
+				sourcePartition, formerPrimaryNode)
+		}
+		if exists && uuidSeq.Seq > 0 {
+			if rv == nil {
+				rv = map[string]uint64{}
+			}
+			rv[sourcePartition] = uuidSeq.Seq
+		}
+	}
+
+	return rv
+}
+
+// --------------------------------------------------------
+
 // getPlanPIndexLOCKED returns the planPIndex, defaulting to the
 // endPlanPIndex's definition if necessary.
 func (r *Rebalancer) getPlanPIndexLOCKED(
@@ -1024,21 +1387,12 @@ func (r *Rebalancer) grabCurrentSample(stopCh, stopCh2 chan struct{},
 
 				// err upon not finding the pindex data in
 				// the stats response since that could indicate an index deletion
-				m := struct {
-					PIndexes map[string]struct {
-						Partitions map[string]struct {
-							UUID string `json:"uuid"`
-							Seq  uint64 `json:"seq"`
-						} `json:"partitions"`
-					} `json:"pindexes"`
-				}{}
-
-				err := json.Unmarshal(s.Data, &m)
+				seqs, err := cbgt.UnmarshalPartitionSeqs(s.ContentType, s.Data)
 				if err != nil {
 					return err
 				}
 
-				if _, exists := m.PIndexes[pindex]; !exists {
+				if _, exists := seqs[pindex]; !exists {
 					return ErrorNoIndexDefinitionFound
 				}
 			}
@@ -1072,6 +1426,13 @@ func (r *Rebalancer) waitAssignPIndexDone(stopCh, stopCh2 chan struct{},
 		return nil
 	}
 
+	if r.isNodeSkipped(node) || r.isNodeSkipped(formerPrimaryNode) {
+		r.log.Printf("rebalance: waitAssignPIndexDone, skipped node,"+
+			" pindex: %s, node: %s, formerPrimaryNode: %s",
+			pindex, node, formerPrimaryNode)
+		return nil
+	}
+
 	r.m.Lock()
 	planPIndex, err := r.getPlanPIndexLOCKED(planPIndexes, pindex)
 	r.m.Unlock()
@@ -1109,6 +1470,21 @@ func (r *Rebalancer) waitAssignPIndexDone(stopCh, stopCh2 chan struct{},
 					if err != nil {
 						// adding more resiliency with pindex not found errors to safe guard against
 						// any plan propagation or implementation lag at the remote nodes.
+						if err == ErrorNoIndexDefinitionFound && r.errorBudgets != nil {
+							ev := r.errorBudgets.record(formerPrimaryNode,
+								ErrorKindPIndexMissing, err)
+							if ev == nil {
+								continue INIT_WANT_SEQ
+							}
+							r.errorBudgetExceeded(ev)
+							if ev.Action == ErrorBudgetPause {
+								continue INIT_WANT_SEQ
+							}
+							if ev.Action == ErrorBudgetSkipNode {
+								return nil
+							}
+							return err
+						}
 						if err == ErrorNoIndexDefinitionFound && errThreshold > 0 {
 							errThreshold--
 							continue INIT_WANT_SEQ
@@ -1153,6 +1529,12 @@ func (r *Rebalancer) waitAssignPIndexDone(stopCh, stopCh2 chan struct{},
 		caughtUp := false
 
 		for !caughtUp {
+			if r.isNodeSkipped(node) || r.isNodeSkipped(formerPrimaryNode) {
+				r.log.Printf("rebalance: waitAssignPIndexDone,"+
+					" skipped node, pindex: %s, node: %s", pindex, node)
+				return nil
+			}
+
 			sampleWantCh := make(chan MonitorSample)
 
 			select {
@@ -1362,6 +1744,16 @@ func SetUUIDSeq(
 func (r *Rebalancer) runMonitor(stopCh chan struct{}) {
 	defer close(r.monitorDoneCh)
 
+	if r.sampleWriter != nil {
+		defer func() {
+			err := r.sampleWriter.Close()
+			if err != nil {
+				r.log.Printf("rebalance: runMonitor, close samples,"+
+					" err: %v", err)
+			}
+		}()
+	}
+
 	errMap := make(map[string]uint8, len(r.nodesAll))
 
 	errThreshold := StatsSampleErrorThreshold
@@ -1381,6 +1773,36 @@ func (r *Rebalancer) runMonitor(stopCh chan struct{}) {
 
 			r.log.Printf("      monitor: %s, node: %s", s.Kind, s.UUID)
 
+			if r.sampleWriter != nil {
+				err := r.sampleWriter.write(s)
+				if err != nil {
+					r.log.Printf("rebalance: runMonitor, %v", err)
+				}
+			}
+
+			if r.errorBudgets != nil {
+				if r.errorBudgets.isSkipped(s.UUID) {
+					continue
+				}
+
+				err := s.Error
+				if err == nil && s.Kind == "/api/stats?partitions=true" &&
+					s.Data == nil {
+					err = fmt.Errorf("rebalance: runMonitor,"+
+						" empty response for node: %s", s.UUID)
+				}
+				if err != nil {
+					ev := r.errorBudgets.record(s.UUID, ErrorKindNetwork, err)
+					if ev == nil {
+						r.log.Printf("rebalance: runMonitor, within error"+
+							" budget, node: %s, err: %v", s.UUID, err)
+					} else {
+						r.errorBudgetExceeded(ev)
+					}
+					continue
+				}
+			}
+
 			if s.Error != nil {
 				errMap[s.UUID]++
 				if errMap[s.UUID] < errThreshold {
@@ -1410,18 +1832,9 @@ func (r *Rebalancer) runMonitor(stopCh chan struct{}) {
 				// reset the error resiliency count to zero upon a successful response.
 				errMap[s.UUID] = 0
 
-				m := struct {
-					PIndexes map[string]struct {
-						Partitions map[string]struct {
-							UUID string `json:"uuid"`
-							Seq  uint64 `json:"seq"`
-						} `json:"partitions"`
-					} `json:"pindexes"`
-				}{}
-
-				err := json.Unmarshal(s.Data, &m)
+				seqs, err := cbgt.UnmarshalPartitionSeqs(s.ContentType, s.Data)
 				if err != nil {
-					r.log.Printf("rebalance: runMonitor json, s.Data: %s, err: %#v",
+					r.log.Printf("rebalance: runMonitor json, s.Data: %q, err: %#v",
 						s.Data, err)
 
 					r.progressCh <- RebalanceProgress{Error: err}
@@ -1433,8 +1846,8 @@ func (r *Rebalancer) runMonitor(stopCh chan struct{}) {
 				// if it hits a sequential run of errors for a given node.
 				errMap[s.UUID] = 0
 
-				for pindex, x := range m.PIndexes {
-					for sourcePartition, uuidSeq := range x.Partitions {
+				for pindex, partitions := range seqs {
+					for sourcePartition, uuidSeq := range partitions {
 						uuidSeqPrev, uuidSeqPrevExists := r.setUUIDSeq(
 							r.currSeqs, pindex, sourcePartition,
 							s.UUID, uuidSeq.UUID, uuidSeq.Seq)
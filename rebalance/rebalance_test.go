@@ -13,15 +13,19 @@ package rebalance
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/blugelabs/blance"
 
@@ -745,3 +749,504 @@ func TestRebalanceStatsErrorCase(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteEndPlanPIndexesJSON(t *testing.T) {
+	endPlanPIndexes := cbgt.NewPlanPIndexes(cbgt.Version)
+	endPlanPIndexes.PlanPIndexes["p0"] = &cbgt.PlanPIndex{
+		Name:      "p0",
+		IndexName: "i0",
+		Nodes:     map[string]*cbgt.PlanPIndexNode{},
+	}
+
+	r := &Rebalancer{endPlanPIndexes: endPlanPIndexes}
+
+	var buf bytes.Buffer
+	if err := r.WriteEndPlanPIndexesJSON(&buf); err != nil {
+		t.Fatalf("expected WriteEndPlanPIndexesJSON() to work, err: %v", err)
+	}
+
+	planPIndexes := &cbgt.PlanPIndexes{}
+	if err := json.Unmarshal(buf.Bytes(), planPIndexes); err != nil {
+		t.Fatalf("expected JSON, err: %v, buf: %s", err, buf.Bytes())
+	}
+	if planPIndexes.UUID != endPlanPIndexes.UUID ||
+		planPIndexes.PlanPIndexes["p0"] == nil {
+		t.Errorf("expected endPlanPIndexes, got: %s", buf.Bytes())
+	}
+}
+
+func TestRebalanceFrozenPlanWarning(t *testing.T) {
+	indexDef := &cbgt.IndexDef{Name: "i0", UUID: "u0",
+		PlanParams: cbgt.PlanParams{PlanFrozen: true}}
+
+	begPlanPIndexes := cbgt.NewPlanPIndexes(cbgt.Version)
+	begPlanPIndexes.PlanPIndexes["p0"] = &cbgt.PlanPIndex{
+		Name: "p0", IndexName: "i0", IndexUUID: "u0",
+		Nodes: map[string]*cbgt.PlanPIndexNode{
+			"a": {}, "b": {Priority: 1}},
+	}
+	begPlanPIndexes.PlanPIndexes["p1"] = &cbgt.PlanPIndex{
+		Name: "p1", IndexName: "i0", IndexUUID: "u0",
+		Nodes: map[string]*cbgt.PlanPIndexNode{"a": {}},
+	}
+
+	r := &Rebalancer{
+		nodesToRemove:   []string{"b"},
+		begPlanPIndexes: begPlanPIndexes,
+		endPlanPIndexes: cbgt.NewPlanPIndexes(cbgt.Version),
+		progressCh:      make(chan RebalanceProgress, 1),
+		log:             cbgt.NewStdLibLog(ioutil.Discard, "", 0),
+	}
+
+	changed, err := r.rebalanceIndex(nil, indexDef)
+	if changed || err != nil {
+		t.Fatalf("expected frozen plan to be skipped, err: %v", err)
+	}
+	if len(r.endPlanPIndexes.PlanPIndexes) != 2 {
+		t.Errorf("expected cloned plan, got: %+v", r.endPlanPIndexes)
+	}
+
+	exp := &FrozenPlanWarning{Index: "i0",
+		StrandedPIndexes: map[string][]string{"p0": {"b"}}}
+
+	progress := <-r.progressCh
+	if !reflect.DeepEqual(progress.FrozenPlan, exp) ||
+		progress.Index != "i0" || progress.Error != nil {
+		t.Errorf("expected frozen plan warning, got: %+v", progress)
+	}
+
+	warnings := r.FrozenPlanWarnings()
+	if len(warnings) != 1 || !reflect.DeepEqual(warnings[0], exp) {
+		t.Errorf("expected FrozenPlanWarnings, got: %+v", warnings)
+	}
+
+	// No warning when no pindexes are on departing nodes.
+	r.nodesToRemove = []string{"c"}
+	r.endPlanPIndexes = cbgt.NewPlanPIndexes(cbgt.Version)
+
+	r.rebalanceIndex(nil, indexDef)
+	if len(r.progressCh) != 0 || len(r.FrozenPlanWarnings()) != 1 {
+		t.Errorf("expected no new frozen plan warning")
+	}
+}
+
+func TestCalcPIndexesAtRisk(t *testing.T) {
+	model, _ := cbgt.BlancePartitionModel(&cbgt.IndexDef{
+		PlanParams: cbgt.PlanParams{NumReplicas: 1}})
+
+	p := func(name string, primary, replica []string) *blance.Partition {
+		return &blance.Partition{Name: name,
+			NodesByState: map[string][]string{
+				"primary": primary, "replica": replica}}
+	}
+
+	begMap := blance.PartitionMap{
+		"moved":      p("moved", []string{"a"}, nil),
+		"replicated": p("replicated", []string{"a"}, []string{"b"}),
+		"dropped":    p("dropped", []string{"c"}, nil),
+		"new":        p("new", nil, nil),
+	}
+	endMap := blance.PartitionMap{
+		"moved":      p("moved", []string{"b"}, nil),
+		"replicated": p("replicated", []string{"b"}, []string{"d"}),
+		"dropped":    p("dropped", nil, nil),
+		"new":        p("new", []string{"a"}, nil),
+	}
+
+	atRisk := CalcPIndexesAtRisk(model, begMap, endMap,
+		[]string{"a", "c"}, false)
+	exp := []*PIndexAtRisk{
+		{PIndex: "dropped", Reason: PIndexRiskLastCopy, Step: -1,
+			BegNodes: []string{"c"}},
+	}
+	if !reflect.DeepEqual(atRisk, exp) {
+		t.Errorf("expected only the dropped pindex at risk, got: %+v",
+			atRisk)
+	}
+
+	// Favoring min nodes deletes before adding.
+	atRisk = CalcPIndexesAtRisk(model, begMap, endMap,
+		[]string{"a", "c"}, true)
+	if len(atRisk) != 2 ||
+		atRisk[1].PIndex != "moved" ||
+		atRisk[1].Reason != PIndexRiskZeroNodes ||
+		atRisk[1].Step != 0 {
+		t.Errorf("expected the moved pindex at risk, got: %+v", atRisk)
+	}
+
+	err := &UnsafeRebalanceError{Index: "x", PIndexes: atRisk}
+	if !strings.Contains(err.Error(), "moved (zeroNodes)") {
+		t.Errorf("expected pindexes in err, got: %v", err)
+	}
+}
+
+func TestMonitorSamplesPersistence(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	path := MonitorSamplesPath(testDir, "run0")
+
+	w, err := newMonitorSampleWriter(path, 2)
+	if err != nil {
+		t.Fatalf("expected writer, err: %v", err)
+	}
+
+	start := time.Unix(1000, 0).UTC()
+	for i := 0; i < 5; i++ {
+		w.write(MonitorSample{Kind: "/api/stats", UUID: "a",
+			Start: start.Add(time.Duration(i) * time.Second),
+			Data:  []byte(fmt.Sprintf(`{"i":%d}`, i))})
+	}
+	w.write(MonitorSample{Kind: "/api/stats", UUID: "a",
+		Error: fmt.Errorf("oops"), Data: []byte("not json")})
+
+	// The flushed samples are readable before the writer is closed.
+	recs, err := ReadMonitorSamples(path)
+	if err != nil || len(recs) != 4 {
+		t.Fatalf("expected 4 samples before close, got: %d, err: %v",
+			len(recs), err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatalf("expected close, err: %v", err)
+	}
+
+	recs, err = ReadMonitorSamples(path)
+	if err != nil || len(recs) != 4 {
+		t.Fatalf("expected 4 samples, got: %d, err: %v", len(recs), err)
+	}
+	if string(recs[1].Data) != `{"i":2}` ||
+		!recs[1].Start.Equal(start.Add(2*time.Second)) {
+		t.Errorf("expected down-sampled sample, got: %+v", recs[1])
+	}
+	if recs[3].Error != "oops" || string(recs[3].Data) != `"not json"` {
+		t.Errorf("expected error sample, got: %+v", recs[3])
+	}
+
+	// A run's samples aren't overwritten.
+	if _, err = newMonitorSampleWriter(path, 1); err == nil {
+		t.Errorf("expected err on existing samples")
+	}
+}
+
+func TestErrorBudgets(t *testing.T) {
+	clock := cbgt.NewManualClock(time.Unix(1000, 0))
+	defer cbgt.SetClock(clock.Now)()
+
+	var exceeded []*ErrorBudgetEvent
+
+	b := newErrorBudgets(ErrorBudgetPolicy{
+		Network: ErrorBudget{MaxErrors: 2, Window: 10 * time.Second,
+			Action: ErrorBudgetSkipNode},
+		PIndexMissing: ErrorBudget{MaxErrors: 1,
+			Action: ErrorBudgetPause},
+		OnExceeded: func(ev *ErrorBudgetEvent) {
+			exceeded = append(exceeded, ev)
+		},
+	})
+
+	errNet := fmt.Errorf("net")
+
+	// Errors that fall out of the window don't count.
+	for i := 0; i < 5; i++ {
+		if ev := b.record("a", ErrorKindNetwork, errNet); ev != nil {
+			t.Fatalf("expected within budget, i: %d, got: %+v", i, ev)
+		}
+		clock.Advance(6 * time.Second)
+	}
+
+	b.record("a", ErrorKindNetwork, errNet)
+	ev := b.record("a", ErrorKindNetwork, errNet)
+	if ev == nil || ev.Node != "a" || ev.Kind != ErrorKindNetwork ||
+		ev.Action != ErrorBudgetSkipNode || ev.Errors != 3 ||
+		ev.Err != errNet {
+		t.Fatalf("expected skipNode, got: %+v", ev)
+	}
+	if !b.isSkipped("a") || b.isSkipped("b") {
+		t.Errorf("expected only node a skipped")
+	}
+
+	// The kinds have separate budgets, and a pause starts over.
+	if b.record("b", ErrorKindPIndexMissing, nil) != nil {
+		t.Errorf("expected within pindexMissing budget")
+	}
+	ev = b.record("b", ErrorKindPIndexMissing, nil)
+	if ev == nil || ev.Action != ErrorBudgetPause {
+		t.Fatalf("expected pause, got: %+v", ev)
+	}
+	if b.record("b", ErrorKindPIndexMissing, nil) != nil {
+		t.Errorf("expected budget to start over after pause")
+	}
+
+	r := &Rebalancer{
+		errorBudgets: b,
+		progressCh:   make(chan RebalanceProgress, 1),
+		log:          cbgt.NewStdLibLog(ioutil.Discard, "", 0),
+	}
+	r.errorBudgetExceeded(ev)
+
+	progress := <-r.progressCh
+	if progress.ErrorBudget != ev || progress.Error != nil ||
+		len(exceeded) != 1 || exceeded[0] != ev {
+		t.Errorf("expected alert, got: %+v, exceeded: %+v",
+			progress, exceeded)
+	}
+	if !r.isNodeSkipped("a") {
+		t.Errorf("expected node a skipped")
+	}
+}
+
+func TestMonitorNodesTraceParent(t *testing.T) {
+	headerCh := make(chan string, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			headerCh <- r.Header.Get(cbgt.TRACEPARENT_HEADER)
+			w.Write([]byte("{}"))
+		}))
+	defer server.Close()
+
+	root := cbgt.NewTraceParent()
+
+	sampleCh := make(chan MonitorSample)
+	m, err := StartMonitorNodes([]UrlUUID{{server.URL, "n0"}}, sampleCh,
+		MonitorNodesOptions{DiagSampleDisable: true, TraceParent: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	sample := <-sampleCh
+	header := <-headerCh
+
+	tp, err := cbgt.ParseTraceParent(header)
+	if sample.Error != nil || err != nil || tp.TraceID != root.TraceID ||
+		sample.TraceParent != header {
+		t.Errorf("expected the sample to join the trace, root: %s,"+
+			" header: %q, sample: %#v", root, header, sample)
+	}
+}
+
+func TestMonitorNodesGzip(t *testing.T) {
+	stats := map[string]interface{}{}
+	for i := 0; i < 1000; i++ {
+		stats[fmt.Sprintf("pindex-%d", i)] = map[string]int{"seq": i}
+	}
+
+	server := httptest.NewServer(cbgt.GzipHandler(0, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			cbgt.StreamJSON(w, stats)
+		})))
+	defer server.Close()
+
+	for _, disable := range []bool{false, true} {
+		sampleCh := make(chan MonitorSample)
+		m, err := StartMonitorNodes([]UrlUUID{{server.URL, "n0"}}, sampleCh,
+			MonitorNodesOptions{DiagSampleDisable: true,
+				CompressionDisable: disable})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sample := <-sampleCh
+		m.Stop()
+
+		var got map[string]interface{}
+		err = json.Unmarshal(sample.Data, &got)
+		if sample.Error != nil || err != nil || len(got) != len(stats) {
+			t.Fatalf("expected the decompressed sample, err: %v, %v",
+				sample.Error, err)
+		}
+		compressed := sample.WireSize < int64(len(sample.Data))/4
+		if compressed == disable {
+			t.Errorf("disable: %v, unexpected wire size: %d, data: %d",
+				disable, sample.WireSize, len(sample.Data))
+		}
+	}
+}
+
+func TestMonitorNodesProtobuf(t *testing.T) {
+	seqs := cbgt.PartitionSeqs{
+		"p0": {"0": {UUID: "u0", Seq: 10}, "1": {UUID: "u1", Seq: 11}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if cbgt.AcceptsPartitionSeqsProtobuf(r) {
+				cbgt.WritePartitionSeqsProtobuf(w, seqs)
+				return
+			}
+			buf, _ := cbgt.MarshalPartitionSeqsJSON(seqs)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(buf)
+		}))
+	defer server.Close()
+
+	for _, disable := range []bool{false, true} {
+		sampleCh := make(chan MonitorSample)
+		m, err := StartMonitorNodes([]UrlUUID{{server.URL, "n0"}}, sampleCh,
+			MonitorNodesOptions{DiagSampleDisable: true,
+				StatsProtobufDisable: disable})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sample := <-sampleCh
+		m.Stop()
+
+		isProtobuf := sample.ContentType == cbgt.PARTITION_SEQS_PROTOBUF
+		if isProtobuf == disable {
+			t.Errorf("disable: %v, unexpected content type: %q",
+				disable, sample.ContentType)
+		}
+
+		got, err := cbgt.UnmarshalPartitionSeqs(sample.ContentType, sample.Data)
+		if sample.Error != nil || err != nil || !reflect.DeepEqual(got, seqs) {
+			t.Errorf("disable: %v, err: %v, %v, got: %v",
+				disable, sample.Error, err, got)
+		}
+	}
+}
+
+func TestRebalanceProfiles(t *testing.T) {
+	o, err := expandProfile(RebalanceOptions{DryRun: true})
+	if err != nil || o.MaxConcurrentPartitionMovesPerNode != 0 ||
+		o.ErrorBudgetPolicy != nil {
+		t.Fatalf("expected no profile to keep the options, got: %+v", o)
+	}
+
+	s := settingsOf(o)
+	if s.MaxConcurrentPartitionMovesPerNode != 1 ||
+		s.StatsSampleInterval != time.Second ||
+		s.StatsSampleErrorThreshold != int(StatsSampleErrorThreshold) ||
+		!s.DryRun {
+		t.Errorf("expected default settings, got: %+v", s)
+	}
+
+	_, err = expandProfile(RebalanceOptions{Profile: "reckless"})
+	if err == nil {
+		t.Errorf("expected unknown profile err")
+	}
+
+	o, err = expandProfile(RebalanceOptions{Profile: ProfileAggressive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = settingsOf(o)
+	if s.Profile != ProfileAggressive || !s.FavorMinNodes ||
+		!s.AddPrimaryDirectly || s.MaxConcurrentPartitionMovesPerNode != 8 ||
+		s.StatsSampleInterval != 500*time.Millisecond ||
+		s.ErrorBudgetPolicy == nil ||
+		s.ErrorBudgetPolicy.Network.Action != ErrorBudgetSkipNode ||
+		s.StatsSampleErrorThreshold != 0 {
+		t.Errorf("expected aggressive settings, got: %+v", s)
+	}
+
+	// The explicitly set options are kept.
+	threshold := 7
+	o, err = expandProfile(RebalanceOptions{
+		Profile:                            ProfileConservative,
+		MaxConcurrentPartitionMovesPerNode: 4,
+		AddPrimaryDirectly:                 true,
+		StatsSampleErrorThreshold:          &threshold,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = settingsOf(o)
+	if s.MaxConcurrentPartitionMovesPerNode != 4 || !s.AddPrimaryDirectly ||
+		s.FavorMinNodes || s.StatsSampleInterval != 5*time.Second ||
+		s.ErrorBudgetPolicy != nil || s.StatsSampleErrorThreshold != 7 {
+		t.Errorf("expected overridden conservative settings, got: %+v", s)
+	}
+
+	// The expanded policy is a copy, so the profile stays intact.
+	o, _ = expandProfile(RebalanceOptions{Profile: ProfileBalanced})
+	o.ErrorBudgetPolicy.Network.MaxErrors = 1000
+	if DefaultErrorBudgetPolicy.Network.MaxErrors == 1000 {
+		t.Errorf("expected the profile's policy to be copied")
+	}
+
+	if !reflect.DeepEqual(RebalanceProfileNames(),
+		[]string{ProfileAggressive, ProfileBalanced, ProfileConservative}) {
+		t.Errorf("expected profile names, got: %v", RebalanceProfileNames())
+	}
+}
+
+func TestWaitFormerPrimaryRemovable(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	begPlanPIndexes := cbgt.NewPlanPIndexes(cbgt.Version)
+	begPlanPIndexes.PlanPIndexes["p0"] = &cbgt.PlanPIndex{
+		Name: "p0", IndexName: "i0", IndexUUID: "u0",
+		Nodes: map[string]*cbgt.PlanPIndexNode{"a": {}, "c": {Priority: 1}},
+	}
+
+	planPIndexes := cbgt.NewPlanPIndexes(cbgt.Version)
+	planPIndexes.PlanPIndexes["p0"] = &cbgt.PlanPIndex{
+		Name: "p0", IndexName: "i0", IndexUUID: "u0",
+		Nodes: map[string]*cbgt.PlanPIndexNode{"a": {}, "b": {},
+			"c": {Priority: 1}},
+	}
+	_, err := cbgt.CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mut sync.Mutex
+	var urls []string
+	httpGet := func(url string) (resp *http.Response, err error) {
+		mut.Lock()
+		urls = append(urls, url)
+		n := len(urls)
+		mut.Unlock()
+
+		body, _ := json.Marshal(&cbgt.PIndexReadyStatus{
+			PIndex: "p0", Ready: n >= 3})
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(body)),
+		}, nil
+	}
+
+	r := &Rebalancer{
+		version: cbgt.Version,
+		cfg:     cfg,
+		optionsReb: RebalanceOptions{
+			WaitPrimaryReady:    true,
+			FormerPrimaryGrace:  time.Millisecond,
+			StatsSampleInterval: time.Millisecond,
+			HttpGet:             httpGet,
+		},
+		begNodeDefs: &cbgt.NodeDefs{NodeDefs: map[string]*cbgt.NodeDef{
+			"a": {UUID: "a", HostPort: "a:8094"},
+			"b": {UUID: "b", HostPort: "b:8094"},
+		}},
+		begPlanPIndexes: begPlanPIndexes,
+		log:             cbgt.NewStdLibLog(ioutil.Discard, "", 0),
+	}
+
+	// Not a former primary.
+	err = r.waitFormerPrimaryRemovable(nil, nil, "p0", "c")
+	if err != nil || len(urls) != 0 {
+		t.Errorf("expected no wait for a replica, err: %v, urls: %v", err, urls)
+	}
+
+	err = r.waitFormerPrimaryRemovable(nil, nil, "p0", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 3 ||
+		urls[0] != "http://b:8094"+cbgt.PINDEX_READY_PATH+"?pindex=p0" {
+		t.Errorf("expected polls of the new primary, got: %v", urls)
+	}
+
+	// A stop while waiting for the grace period.
+	r.optionsReb.FormerPrimaryGrace = time.Hour
+	stopCh := make(chan struct{})
+	close(stopCh)
+	err = r.waitFormerPrimaryRemovable(stopCh, nil, "p0", "a")
+	if err != blance.ErrorStopped {
+		t.Errorf("expected stopped, got: %v", err)
+	}
+}
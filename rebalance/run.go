@@ -18,13 +18,15 @@ import (
 )
 
 // RunRebalance synchronously runs a rebalance and reports progress
-// until the rebalance is done or has errored.
+// until the rebalance is done or has errored.  The optional
+// "rebalanceProfile" option names a RebalanceProfile.
 func RunRebalance(cfg cbgt.Cfg, server string, options map[string]string,
 	nodesToRemove []string, favorMinNodes bool, dryRun bool, verbose int,
 	progressToString ProgressToString, log cbgt.Log) error {
 	r, err := StartRebalance(cbgt.Version, cfg, log, server, options,
 		nodesToRemove,
 		RebalanceOptions{
+			Profile:       options["rebalanceProfile"],
 			FavorMinNodes: favorMinNodes,
 			DryRun:        dryRun,
 			Verbose:       verbose,
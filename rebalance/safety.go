@@ -0,0 +1,141 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rebalance
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blugelabs/blance"
+	"github.com/blugelabs/cbgt"
+)
+
+// The reasons that a pindex is at risk in a rebalance.
+const (
+	// PIndexRiskZeroNodes means a step of the pindex's moves leaves
+	// it assigned to no nodes, such as a del before an add.
+	PIndexRiskZeroNodes = "zeroNodes"
+
+	// PIndexRiskLastCopy means the pindex's only copies are on
+	// departing nodes and the end plan assigns it to no nodes.
+	PIndexRiskLastCopy = "lastCopy"
+)
+
+// A PIndexAtRisk is a pindex that a rebalance could lose.
+type PIndexAtRisk struct {
+	PIndex   string   `json:"pindex"`
+	Reason   string   `json:"reason"`
+	Step     int      `json:"step"` // The move that has zero nodes, or -1.
+	BegNodes []string `json:"begNodes"`
+}
+
+// An UnsafeRebalanceError is returned, as a RebalanceProgress error,
+// when a rebalance refuses to move the pindexes of an index because
+// it could lose some of them.  See RebalanceOptions.ForceUnsafeMoves.
+type UnsafeRebalanceError struct {
+	Index    string
+	PIndexes []*PIndexAtRisk
+}
+
+func (e *UnsafeRebalanceError) Error() string {
+	a := make([]string, 0, len(e.PIndexes))
+	for _, p := range e.PIndexes {
+		a = append(a, p.PIndex+" ("+p.Reason+")")
+	}
+	return fmt.Sprintf("rebalance: unsafe, index: %s,"+
+		" pindexes at risk: %s", e.Index, strings.Join(a, ", "))
+}
+
+// CalcPIndexesAtRisk analyzes the beg and end maps of an index, where
+// the partitions are pindexes, and returns the pindexes that could be
+// lost by the moves that a blance.Orchestrator would make.
+func CalcPIndexesAtRisk(model blance.PartitionModel,
+	begMap, endMap blance.PartitionMap, nodesToRemove []string,
+	favorMinNodes bool) []*PIndexAtRisk {
+	states := make([]string, 0, len(model))
+	for state := range model {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if model[states[i]].Priority != model[states[j]].Priority {
+			return model[states[i]].Priority < model[states[j]].Priority
+		}
+		return states[i] < states[j]
+	})
+
+	departing := cbgt.StringsToMap(nodesToRemove)
+
+	var rv []*PIndexAtRisk
+
+	names := make([]string, 0, len(begMap))
+	for name := range begMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		beg := begMap[name]
+		end := endMap[name]
+		if beg == nil || end == nil {
+			continue
+		}
+
+		begNodes := flattenNodes(beg.NodesByState)
+		if len(begNodes) == 0 {
+			continue // A new pindex has nothing to lose.
+		}
+
+		if len(flattenNodes(end.NodesByState)) == 0 {
+			allDeparting := true
+			for _, node := range begNodes {
+				if !departing[node] {
+					allDeparting = false
+				}
+			}
+			if allDeparting {
+				rv = append(rv, &PIndexAtRisk{PIndex: name,
+					Reason: PIndexRiskLastCopy, Step: -1, BegNodes: begNodes})
+			}
+			continue
+		}
+
+		nodes := cbgt.StringsToMap(begNodes)
+
+		moves := blance.CalcPartitionMoves(states,
+			beg.NodesByState, end.NodesByState, favorMinNodes)
+		for i, move := range moves {
+			if move.Op == "del" {
+				delete(nodes, move.Node)
+			} else {
+				nodes[move.Node] = true
+			}
+			if len(nodes) == 0 {
+				rv = append(rv, &PIndexAtRisk{PIndex: name,
+					Reason: PIndexRiskZeroNodes, Step: i, BegNodes: begNodes})
+				break
+			}
+		}
+	}
+
+	return rv
+}
+
+func flattenNodes(nodesByState map[string][]string) []string {
+	var rv []string
+	for _, nodes := range nodesByState {
+		rv = append(rv, nodes...)
+	}
+	rv = cbgt.StringsIntersectStrings(rv, rv) // Dedupe.
+	sort.Strings(rv)
+	return rv
+}
@@ -0,0 +1,521 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRemoteNodeUnavailable is returned for a request to a node whose
+// circuit breaker is open.
+var ErrRemoteNodeUnavailable = errors.New("remote_client_pool:" +
+	" node unavailable, circuit breaker open")
+
+// RemoteClientPoolOptions are the tunables of a RemoteClientPool,
+// where the zero values mean the defaults.
+type RemoteClientPoolOptions struct {
+	Timeout             time.Duration // Default is no timeout.
+	MaxIdleConnsPerHost int           // Default is 16.
+
+	// BreakerMaxErrors is the number of consecutive errors of a node
+	// that opens its circuit breaker, where the default is 5.
+	BreakerMaxErrors int
+
+	// BreakerCoolDown is how long an open breaker rejects requests,
+	// before a request is allowed as a probe, default is 10 seconds.
+	BreakerCoolDown time.Duration
+
+	// MaxAttempts is the number of replicas that DoRemotePlanPIndex()
+	// tries, default is 2.
+	MaxAttempts int
+
+	// Dial, when non-nil, opens a connection to a node for Conn(),
+	// such as a *grpc.ClientConn.
+	Dial func(nodeDef *NodeDef) (io.Closer, error)
+
+	// Transport is an optional base http.RoundTripper.
+	Transport http.RoundTripper
+}
+
+// RemoteClientPoolStats are the counters of a RemoteClientPool.
+type RemoteClientPoolStats struct {
+	TotRequest    uint64 `json:"totRequest"`
+	TotRequestErr uint64 `json:"totRequestErr"`
+	TotRetry      uint64 `json:"totRetry"` // Retries on another replica.
+
+	TotBreakerOpen     uint64 `json:"totBreakerOpen"`
+	TotBreakerClose    uint64 `json:"totBreakerClose"`
+	TotBreakerRejected uint64 `json:"totBreakerRejected"`
+
+	TotConnNew    uint64 `json:"totConnNew"`    // HTTP conns established.
+	TotConnReused uint64 `json:"totConnReused"` // HTTP conns reused.
+
+	TotDial    uint64 `json:"totDial"`
+	TotDialErr uint64 `json:"totDialErr"`
+}
+
+// A RemoteClientPool manages the HTTP and gRPC clients to the remote
+// nodes of RemotePlanPIndexes, so that an application's scatter/gather
+// code reuses its connections, skips the nodes whose circuit breakers
+// are open, and retries a failed pindex on a different replica.
+type RemoteClientPool struct {
+	options RemoteClientPoolOptions
+	base    http.RoundTripper
+	client  *http.Client
+
+	m     sync.Mutex
+	nodes map[string]*remoteNode // Keyed by node UUID.
+
+	stats RemoteClientPoolStats
+}
+
+// A remoteNode is the circuit breaker and connection of a node.
+type remoteNode struct {
+	errs     int
+	open     bool
+	openedAt time.Time
+	probing  bool
+
+	conn     io.Closer
+	hostPort string
+}
+
+// NewRemoteClientPool returns a ready-to-use RemoteClientPool.
+func NewRemoteClientPool(options RemoteClientPoolOptions) *RemoteClientPool {
+	if options.MaxIdleConnsPerHost <= 0 {
+		options.MaxIdleConnsPerHost = 16
+	}
+	if options.BreakerMaxErrors <= 0 {
+		options.BreakerMaxErrors = 5
+	}
+	if options.BreakerCoolDown <= 0 {
+		options.BreakerCoolDown = 10 * time.Second
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = 2
+	}
+
+	base := options.Transport
+	if base == nil {
+		base = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        options.MaxIdleConnsPerHost * 8,
+			MaxIdleConnsPerHost: options.MaxIdleConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	}
+
+	p := &RemoteClientPool{
+		options: options,
+		base:    base,
+		nodes:   map[string]*remoteNode{},
+	}
+
+	p.client = &http.Client{
+		Transport: &remoteTransport{p: p, base: &TraceTransport{Base: base}},
+		Timeout:   options.Timeout,
+	}
+
+	return p
+}
+
+// Client returns the pooled http.Client, such as for the callback of
+// a DoRemotePlanPIndex(), which already tracks the node's breaker.
+func (p *RemoteClientPool) Client() *http.Client {
+	return p.client
+}
+
+// remoteTransport counts the new and reused connections.
+type remoteTransport struct {
+	p    *RemoteClientPool
+	base http.RoundTripper
+}
+
+func (t *remoteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddUint64(&t.p.stats.TotRequest, 1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&t.p.stats.TotConnReused, 1)
+			} else {
+				atomic.AddUint64(&t.p.stats.TotConnNew, 1)
+			}
+		},
+	}
+
+	res, err := t.base.RoundTrip(
+		req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		atomic.AddUint64(&t.p.stats.TotRequestErr, 1)
+	}
+	return res, err
+}
+
+// Stats returns a copy of the counters.
+func (p *RemoteClientPool) Stats() RemoteClientPoolStats {
+	var rv RemoteClientPoolStats
+	AtomicCopyMetrics(&p.stats, &rv, nil)
+	return rv
+}
+
+// URL returns the base URL of a node, such as "http://[::1]:8094".
+func (p *RemoteClientPool) URL(nodeDef *NodeDef) string {
+	return HostPortURL("http", nodeDef.HostPort)
+}
+
+// ---------------------------------------------------------
+
+// Allow returns whether a request may be sent to a node, where an
+// open breaker allows a single probe request after its cool-down,
+// whose outcome must then be reported with Done().
+func (p *RemoteClientPool) Allow(nodeUUID string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	n := p.nodes[nodeUUID]
+	if n == nil || !n.open {
+		return true
+	}
+	if n.probing || Now().Sub(n.openedAt) < p.options.BreakerCoolDown {
+		atomic.AddUint64(&p.stats.TotBreakerRejected, 1)
+		return false
+	}
+	n.probing = true
+	return true
+}
+
+// done updates the breaker of a node with the outcome of a request.
+func (p *RemoteClientPool) done(nodeUUID string, err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	n := p.nodes[nodeUUID]
+	if n == nil {
+		if err == nil {
+			return
+		}
+		n = &remoteNode{}
+		p.nodes[nodeUUID] = n
+	}
+
+	n.probing = false
+
+	if err == nil {
+		n.errs = 0
+		if n.open {
+			n.open = false
+			atomic.AddUint64(&p.stats.TotBreakerClose, 1)
+		}
+		return
+	}
+
+	n.errs++
+	if n.open || n.errs >= p.options.BreakerMaxErrors {
+		if !n.open {
+			atomic.AddUint64(&p.stats.TotBreakerOpen, 1)
+		}
+		n.open = true
+		n.openedAt = Now()
+	}
+}
+
+// release ends a probe of a node without an outcome, such as for a
+// cancelled request.
+func (p *RemoteClientPool) release(nodeUUID string) {
+	p.m.Lock()
+	if n := p.nodes[nodeUUID]; n != nil {
+		n.probing = false
+	}
+	p.m.Unlock()
+}
+
+// BreakerOpen returns whether the circuit breaker of a node is open.
+func (p *RemoteClientPool) BreakerOpen(nodeUUID string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	n := p.nodes[nodeUUID]
+	return n != nil && n.open
+}
+
+// Do sends an HTTP request to a node through the pooled client, for
+// requests outside of a DoRemotePlanPIndex().  A
+// transport error or a 5xx response counts against the node's circuit
+// breaker, and ErrRemoteNodeUnavailable is returned while it's open.
+func (p *RemoteClientPool) Do(nodeUUID string, req *http.Request) (
+	*http.Response, error) {
+	if !p.Allow(nodeUUID) {
+		return nil, ErrRemoteNodeUnavailable
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil && req.Context().Err() != nil {
+		p.release(nodeUUID)
+	} else if err == nil && res.StatusCode >= 500 {
+		p.done(nodeUUID, fmt.Errorf("remote_client_pool: status: %d",
+			res.StatusCode))
+	} else {
+		p.done(nodeUUID, err)
+	}
+
+	return res, err
+}
+
+// Conn returns the pooled connection to a node, such as a
+// *grpc.ClientConn, which is opened on first use by the Dial option,
+// and reopened when the node's hostPort changes.  Outside of a
+// DoRemotePlanPIndex() callback, the caller checks Allow() and
+// reports the outcome of its calls on the connection with Done().
+func (p *RemoteClientPool) Conn(nodeDef *NodeDef) (io.Closer, error) {
+	if p.options.Dial == nil {
+		return nil, fmt.Errorf("remote_client_pool: no Dial option")
+	}
+	p.m.Lock()
+	n := p.nodes[nodeDef.UUID]
+	if n != nil && n.conn != nil && n.hostPort == nodeDef.HostPort {
+		conn := n.conn
+		p.m.Unlock()
+		return conn, nil
+	}
+	p.m.Unlock()
+
+	atomic.AddUint64(&p.stats.TotDial, 1)
+
+	conn, err := p.options.Dial(nodeDef)
+	if err != nil {
+		atomic.AddUint64(&p.stats.TotDialErr, 1)
+		return nil, err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	n = p.nodes[nodeDef.UUID]
+	if n == nil {
+		n = &remoteNode{}
+		p.nodes[nodeDef.UUID] = n
+	}
+	if n.conn != nil {
+		if n.hostPort == nodeDef.HostPort { // Lost a race with another dial.
+			conn.Close()
+			return n.conn, nil
+		}
+		n.conn.Close()
+	}
+	n.conn, n.hostPort = conn, nodeDef.HostPort
+
+	return conn, nil
+}
+
+// Done reports the outcome of a call on a Conn() to the node's circuit
+// breaker, where a DoRemotePlanPIndex() callback doesn't need to.
+func (p *RemoteClientPool) Done(nodeUUID string, err error) {
+	atomic.AddUint64(&p.stats.TotRequest, 1)
+	if err != nil {
+		atomic.AddUint64(&p.stats.TotRequestErr, 1)
+	}
+	p.done(nodeUUID, err)
+}
+
+// RemoveNode forgets a node, such as one that left the cluster,
+// closing its pooled connection.
+func (p *RemoteClientPool) RemoveNode(nodeUUID string) {
+	p.m.Lock()
+	n := p.nodes[nodeUUID]
+	delete(p.nodes, nodeUUID)
+	p.m.Unlock()
+
+	if n != nil && n.conn != nil {
+		n.conn.Close()
+	}
+}
+
+// Close closes the pooled connections.
+func (p *RemoteClientPool) Close() {
+	p.m.Lock()
+	nodes := p.nodes
+	p.nodes = map[string]*remoteNode{}
+	p.m.Unlock()
+
+	for _, n := range nodes {
+		if n.conn != nil {
+			n.conn.Close()
+		}
+	}
+
+	if t, ok := p.base.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// ---------------------------------------------------------
+
+// RemoteNoRetry marks an error of a DoRemotePlanPIndex() callback as
+// not retryable on another replica, such as for a bad request.
+func RemoteNoRetry(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &remoteNoRetryError{err: err}
+}
+
+type remoteNoRetryError struct {
+	err error
+}
+
+func (e *remoteNoRetryError) Error() string { return e.err.Error() }
+
+func (e *remoteNoRetryError) Unwrap() error { return e.err }
+
+// RemotePlanPIndexReplicas returns the node of a RemotePlanPIndex,
+// followed by the other wanted and readable nodes of its planPIndex,
+// by priority, which are its fallbacks.
+func RemotePlanPIndexReplicas(rpp *RemotePlanPIndex,
+	nodeDefs *NodeDefs) []*NodeDef {
+	rv := []*NodeDef{rpp.NodeDef}
+	if nodeDefs == nil || rpp.PlanPIndex == nil {
+		return rv
+	}
+
+	type replica struct {
+		nodeDef  *NodeDef
+		priority int
+	}
+	var replicas []replica
+
+	for nodeUUID, planPIndexNode := range rpp.PlanPIndex.Nodes {
+		if nodeUUID == rpp.NodeDef.UUID ||
+			!PlanPIndexNodeCanRead(planPIndexNode) ||
+			PlanPIndexNodeHasBarrier(planPIndexNode) {
+			continue
+		}
+		if nodeDef := nodeDefs.NodeDefs[nodeUUID]; nodeDef != nil {
+			replicas = append(replicas,
+				replica{nodeDef, planPIndexNode.Priority})
+		}
+	}
+
+	sort.Slice(replicas, func(i, j int) bool {
+		if replicas[i].priority != replicas[j].priority {
+			return replicas[i].priority < replicas[j].priority
+		}
+		return replicas[i].nodeDef.UUID < replicas[j].nodeDef.UUID
+	})
+
+	for _, r := range replicas {
+		rv = append(rv, r.nodeDef)
+	}
+	return rv
+}
+
+// DoRemotePlanPIndex invokes a query callback for a RemotePlanPIndex,
+// with the pooled clients, on up to the MaxAttempts replicas of its
+// planPIndex, see RemotePlanPIndexReplicas().  The replicas whose
+// circuit breakers are open are skipped.  A callback error is retried
+// on the next replica, unless it's a RemoteNoRetry() error or the ctx
+// is done, and only the retried errors count against the node's
+// breaker.
+func (p *RemoteClientPool) DoRemotePlanPIndex(ctx context.Context,
+	rpp *RemotePlanPIndex, nodeDefs *NodeDefs,
+	cb func(ctx context.Context, nodeDef *NodeDef) error) error {
+	var err error
+
+	attempts := 0
+
+	for _, nodeDef := range RemotePlanPIndexReplicas(rpp, nodeDefs) {
+		if attempts >= p.options.MaxAttempts {
+			break
+		}
+		if !p.Allow(nodeDef.UUID) {
+			if err == nil {
+				err = ErrRemoteNodeUnavailable
+			}
+			continue
+		}
+
+		if attempts > 0 {
+			atomic.AddUint64(&p.stats.TotRetry, 1)
+		}
+		attempts++
+
+		err = cb(ctx, nodeDef)
+
+		var noRetry *remoteNoRetryError
+		if errors.As(err, &noRetry) {
+			p.done(nodeDef.UUID, nil)
+			return noRetry.err
+		}
+
+		if err != nil && ctx.Err() != nil {
+			p.release(nodeDef.UUID)
+			return err
+		}
+
+		p.done(nodeDef.UUID, err)
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	if err == nil {
+		err = ErrRemoteNodeUnavailable
+	}
+
+	return fmt.Errorf("remote_client_pool: pindex: %s, attempts: %d,"+
+		" err: %v", rpp.PlanPIndex.Name, attempts, err)
+}
+
+// ---------------------------------------------------------
+
+// RemoteClientPool returns the manager's RemoteClientPool, which is
+// configured by the "remoteClientTimeoutMS",
+// "remoteClientBreakerMaxErrors", "remoteClientBreakerCoolDownMS" and
+// "remoteClientMaxAttempts" manager options when first used.
+func (mgr *Manager) RemoteClientPool() *RemoteClientPool {
+	mgr.remoteClientPoolMutex.Lock()
+	defer mgr.remoteClientPoolMutex.Unlock()
+
+	if mgr.remoteClientPool == nil {
+		options := mgr.Options()
+		atoi := func(k string) int {
+			v, _ := strconv.Atoi(options[k])
+			return v
+		}
+
+		mgr.remoteClientPool = NewRemoteClientPool(RemoteClientPoolOptions{
+			Timeout: time.Duration(atoi("remoteClientTimeoutMS")) *
+				time.Millisecond,
+			BreakerMaxErrors: atoi("remoteClientBreakerMaxErrors"),
+			BreakerCoolDown: time.Duration(
+				atoi("remoteClientBreakerCoolDownMS")) * time.Millisecond,
+			MaxAttempts: atoi("remoteClientMaxAttempts"),
+		})
+	}
+
+	return mgr.remoteClientPool
+}
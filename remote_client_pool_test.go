@@ -0,0 +1,126 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteClientPool(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}))
+	defer bad.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("good"))
+		}))
+	defer good.Close()
+
+	nodeDefs := &NodeDefs{NodeDefs: map[string]*NodeDef{
+		"n0": {UUID: "n0", HostPort: strings.TrimPrefix(bad.URL, "http://")},
+		"n1": {UUID: "n1", HostPort: strings.TrimPrefix(good.URL, "http://")},
+	}}
+	rpp := &RemotePlanPIndex{
+		PlanPIndex: &PlanPIndex{Name: "p0", Nodes: map[string]*PlanPIndexNode{
+			"n0": {CanRead: true, Priority: 0},
+			"n1": {CanRead: true, Priority: 1},
+		}},
+		NodeDef: nodeDefs.NodeDefs["n0"],
+	}
+
+	p := NewRemoteClientPool(RemoteClientPoolOptions{
+		BreakerMaxErrors: 2,
+		BreakerCoolDown:  time.Hour,
+	})
+	defer p.Close()
+
+	query := func(ctx context.Context, nodeDef *NodeDef) error {
+		res, err := p.Client().Get(p.URL(nodeDef) + "/api/query")
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return errors.New(res.Status)
+		}
+		ioutil.ReadAll(res.Body)
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		err := p.DoRemotePlanPIndex(context.Background(), rpp, nodeDefs, query)
+		if err != nil {
+			t.Fatalf("expected a retry on the replica, err: %v", err)
+		}
+	}
+
+	if !p.BreakerOpen("n0") || p.BreakerOpen("n1") {
+		t.Errorf("expected only the breaker of n0 to be open")
+	}
+
+	stats := p.Stats()
+	if stats.TotRetry != 2 || stats.TotBreakerOpen != 1 ||
+		stats.TotBreakerRejected != 1 || stats.TotRequest != 5 ||
+		stats.TotConnReused <= 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	errBad := errors.New("bad request")
+	err := p.DoRemotePlanPIndex(context.Background(),
+		&RemotePlanPIndex{PlanPIndex: rpp.PlanPIndex,
+			NodeDef: nodeDefs.NodeDefs["n1"]}, nodeDefs,
+		func(ctx context.Context, nodeDef *NodeDef) error {
+			return RemoteNoRetry(errBad)
+		})
+	if err != errBad || p.BreakerOpen("n1") {
+		t.Errorf("expected no retry, err: %v", err)
+	}
+
+	_, err = p.Do("n0", httptest.NewRequest("GET", bad.URL, nil))
+	if err != ErrRemoteNodeUnavailable {
+		t.Errorf("expected an open breaker, err: %v", err)
+	}
+}
+
+func TestRemotePlanPIndexReplicas(t *testing.T) {
+	nodeDefs := &NodeDefs{NodeDefs: map[string]*NodeDef{
+		"a": {UUID: "a"}, "b": {UUID: "b"}, "c": {UUID: "c"}, "d": {UUID: "d"},
+	}}
+	rpp := &RemotePlanPIndex{
+		PlanPIndex: &PlanPIndex{Name: "p0", Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true, Priority: 1},
+			"b": {CanRead: true, Priority: 2},
+			"c": {CanRead: true, Priority: 0},
+			"d": {CanRead: false, Priority: 0},
+			"x": {CanRead: true, Priority: 0}, // Not a wanted node.
+		}},
+		NodeDef: nodeDefs.NodeDefs["a"],
+	}
+
+	var got []string
+	for _, nodeDef := range RemotePlanPIndexReplicas(rpp, nodeDefs) {
+		got = append(got, nodeDef.UUID)
+	}
+	if strings.Join(got, ",") != "a,c,b" {
+		t.Errorf("unexpected replicas: %v", got)
+	}
+}
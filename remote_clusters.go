@@ -0,0 +1,285 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// REMOTE_CLUSTERS_KEY is the Cfg key of the RemoteClusters registry.
+const REMOTE_CLUSTERS_KEY = "remoteClusters"
+
+// REMOTE_TARGET_SEP separates the remote cluster name from the index
+// name in a federated index target, as in "clusterName:indexName".
+const REMOTE_TARGET_SEP = ":"
+
+// RemoteClusters is a registry of remote cbgt clusters, so that
+// queries can be federated across clusters without any application
+// side fan-out.
+type RemoteClusters struct {
+	UUID           string                    `json:"uuid"`
+	ImplVersion    string                    `json:"implVersion"`
+	RemoteClusters map[string]*RemoteCluster `json:"remoteClusters"` // Keyed by Name.
+}
+
+// A RemoteCluster is a remote cbgt cluster, reachable through any of
+// its seed URLs.
+type RemoteCluster struct {
+	Name     string             `json:"name"`
+	SeedURLs []string           `json:"seedURLs"`
+	Auth     *RemoteClusterAuth `json:"auth,omitempty"`
+}
+
+// RemoteClusterAuth holds the credentials for a RemoteCluster.
+type RemoteClusterAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Redacted returns a copy of the RemoteCluster that's safe to log or
+// display, without its password.
+func (rc *RemoteCluster) Redacted() *RemoteCluster {
+	rv := *rc
+	if rc.Auth != nil {
+		rv.Auth = &RemoteClusterAuth{Username: rc.Auth.Username}
+		if rc.Auth.Password != "" {
+			rv.Auth.Password = "xxxx"
+		}
+	}
+	return &rv
+}
+
+// ValidateRemoteCluster checks the name and the seed URLs of a
+// RemoteCluster.
+func ValidateRemoteCluster(rc *RemoteCluster) error {
+	if rc == nil {
+		return fmt.Errorf("remote_clusters: nil remote cluster")
+	}
+
+	matched, err := regexp.MatchString(INDEX_NAME_REGEXP, rc.Name)
+	if err != nil || !matched {
+		return fmt.Errorf("remote_clusters: invalid name: %q", rc.Name)
+	}
+
+	if len(rc.SeedURLs) <= 0 {
+		return fmt.Errorf("remote_clusters: no seedURLs, name: %s", rc.Name)
+	}
+	for _, seedURL := range rc.SeedURLs {
+		u, err := url.Parse(seedURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+			return fmt.Errorf("remote_clusters: invalid seedURL: %q,"+
+				" name: %s", seedURL, rc.Name)
+		}
+	}
+
+	return nil
+}
+
+// CfgGetRemoteClusters returns the RemoteClusters from a Cfg.
+func CfgGetRemoteClusters(cfg Cfg) (*RemoteClusters, uint64, error) {
+	v, cas, err := cfg.Get(REMOTE_CLUSTERS_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &RemoteClusters{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetRemoteClusters updates the RemoteClusters on a Cfg.
+func CfgSetRemoteClusters(cfg Cfg, remoteClusters *RemoteClusters,
+	cas uint64) (uint64, error) {
+	buf, err := json.Marshal(remoteClusters)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(REMOTE_CLUSTERS_KEY, buf, cas)
+}
+
+// ---------------------------------------------------------
+
+// GetRemoteClusters returns the registered remote clusters.
+func (mgr *Manager) GetRemoteClusters() (*RemoteClusters, error) {
+	remoteClusters, _, err := CfgGetRemoteClusters(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if remoteClusters == nil {
+		remoteClusters = &RemoteClusters{
+			ImplVersion:    mgr.version,
+			RemoteClusters: map[string]*RemoteCluster{},
+		}
+	}
+	return remoteClusters, nil
+}
+
+// SetRemoteCluster adds or replaces a remote cluster in the registry.
+func (mgr *Manager) SetRemoteCluster(rc *RemoteCluster) error {
+	err := ValidateRemoteCluster(rc)
+	if err != nil {
+		return err
+	}
+
+	err = mgr.updateRemoteClusters(func(rcs *RemoteClusters) {
+		rcs.RemoteClusters[rc.Name] = rc
+	})
+	if err != nil {
+		return err
+	}
+
+	mgr.log.Printf("remote_clusters: set, name: %s, seedURLs: %v",
+		rc.Name, rc.SeedURLs)
+
+	return nil
+}
+
+// DeleteRemoteCluster removes a remote cluster from the registry.
+func (mgr *Manager) DeleteRemoteCluster(name string) error {
+	var exists bool
+
+	err := mgr.updateRemoteClusters(func(rcs *RemoteClusters) {
+		_, exists = rcs.RemoteClusters[name]
+		delete(rcs.RemoteClusters, name)
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("remote_clusters: no remote cluster, name: %s",
+			name)
+	}
+
+	mgr.log.Printf("remote_clusters: deleted, name: %s", name)
+
+	return nil
+}
+
+// updateRemoteClusters applies a change to the registry, retrying on
+// concurrent updates.
+func (mgr *Manager) updateRemoteClusters(change func(*RemoteClusters)) error {
+	for tries := 0; ; tries++ {
+		remoteClusters, cas, err := CfgGetRemoteClusters(mgr.cfg)
+		if err != nil {
+			return err
+		}
+		if remoteClusters == nil {
+			remoteClusters = &RemoteClusters{}
+		}
+		if remoteClusters.RemoteClusters == nil {
+			remoteClusters.RemoteClusters = map[string]*RemoteCluster{}
+		}
+
+		change(remoteClusters)
+
+		remoteClusters.UUID = NewUUID()
+		remoteClusters.ImplVersion = mgr.version
+
+		_, err = CfgSetRemoteClusters(mgr.cfg, remoteClusters, cas)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok || tries >= 10 {
+			return err
+		}
+	}
+}
+
+// ---------------------------------------------------------
+
+// ParseIndexTarget splits an index target into its remote cluster
+// name and index name, where the cluster name is "" for a local
+// index.
+func ParseIndexTarget(target string) (clusterName, indexName string) {
+	i := strings.Index(target, REMOTE_TARGET_SEP)
+	if i < 0 {
+		return "", target
+	}
+	return target[:i], target[i+len(REMOTE_TARGET_SEP):]
+}
+
+// A RemoteIndexTarget is an index on a remote cluster, which is
+// queried as a whole through the remote cluster's own scatter/gather.
+type RemoteIndexTarget struct {
+	Cluster   *RemoteCluster
+	IndexName string
+}
+
+// FederatedCoveringPIndexes are the targets for a federated query,
+// such as of an index alias that includes remote targets.
+type FederatedCoveringPIndexes struct {
+	CoveringPIndexes
+	RemoteIndexTargets []*RemoteIndexTarget
+}
+
+// CoveringPIndexesFederated returns the covering pindexes of the local
+// targets, and the remote index targets, of a federated query.  A
+// target is either a local index name or "clusterName:indexName" for
+// an index of a registered remote cluster.  The planPIndexFilterName
+// is as in the CoveringPIndexesSpec.
+func (mgr *Manager) CoveringPIndexesFederated(targets []string,
+	planPIndexFilterName string) (*FederatedCoveringPIndexes, error) {
+	rv := &FederatedCoveringPIndexes{}
+
+	var remoteClusters *RemoteClusters
+
+	for _, target := range targets {
+		clusterName, indexName := ParseIndexTarget(target)
+		if clusterName == "" {
+			localPIndexes, remotePlanPIndexes, missingPIndexNames, err :=
+				mgr.CoveringPIndexesEx(CoveringPIndexesSpec{
+					IndexName:            indexName,
+					PlanPIndexFilterName: planPIndexFilterName,
+				}, nil, false)
+			if err != nil {
+				return nil, err
+			}
+
+			rv.LocalPIndexes = append(rv.LocalPIndexes, localPIndexes...)
+			rv.RemotePlanPIndexes =
+				append(rv.RemotePlanPIndexes, remotePlanPIndexes...)
+			rv.MissingPIndexNames =
+				append(rv.MissingPIndexNames, missingPIndexNames...)
+
+			continue
+		}
+
+		if remoteClusters == nil {
+			var err error
+			remoteClusters, err = mgr.GetRemoteClusters()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		rc := remoteClusters.RemoteClusters[clusterName]
+		if rc == nil {
+			return nil, fmt.Errorf("remote_clusters: unknown remote"+
+				" cluster: %s, target: %s", clusterName, target)
+		}
+
+		rv.RemoteIndexTargets = append(rv.RemoteIndexTargets,
+			&RemoteIndexTarget{Cluster: rc, IndexName: indexName})
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,119 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestValidateRemoteCluster(t *testing.T) {
+	tests := []struct {
+		rc *RemoteCluster
+		ok bool
+	}{
+		{nil, false},
+		{&RemoteCluster{Name: "east",
+			SeedURLs: []string{"http://10.0.0.1:8094"}}, true},
+		{&RemoteCluster{Name: "east"}, false},
+		{&RemoteCluster{Name: "east:1",
+			SeedURLs: []string{"http://10.0.0.1:8094"}}, false},
+		{&RemoteCluster{Name: "east",
+			SeedURLs: []string{"10.0.0.1:8094"}}, false},
+	}
+	for i, test := range tests {
+		if err := ValidateRemoteCluster(test.rc); (err == nil) != test.ok {
+			t.Errorf("test: %d, expected ok: %v, err: %v", i, test.ok, err)
+		}
+	}
+}
+
+func TestParseIndexTarget(t *testing.T) {
+	if c, i := ParseIndexTarget("idx"); c != "" || i != "idx" {
+		t.Errorf("expected local target, got: %q, %q", c, i)
+	}
+	if c, i := ParseIndexTarget("east:idx"); c != "east" || i != "idx" {
+		t.Errorf("expected remote target, got: %q, %q", c, i)
+	}
+}
+
+func TestManagerRemoteClusters(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, nil)
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+
+	rcs, err := m.GetRemoteClusters()
+	if err != nil || len(rcs.RemoteClusters) != 0 {
+		t.Fatalf("expected no remote clusters, got: %#v, err: %v", rcs, err)
+	}
+
+	east := &RemoteCluster{Name: "east",
+		SeedURLs: []string{"http://10.0.0.1:8094"},
+		Auth:     &RemoteClusterAuth{Username: "u", Password: "secret"}}
+	if err = m.SetRemoteCluster(east); err != nil {
+		t.Fatalf("expected SetRemoteCluster() to work, err: %v", err)
+	}
+	if err = m.SetRemoteCluster(&RemoteCluster{Name: "bad"}); err == nil {
+		t.Errorf("expected err on an invalid remote cluster")
+	}
+
+	if east.Redacted().Auth.Password == "secret" ||
+		east.Auth.Password != "secret" {
+		t.Errorf("expected a redacted copy")
+	}
+
+	go func() {
+		for r := range m.plannerCh {
+			close(r.resCh)
+		}
+	}()
+
+	if err = m.CreateIndex("primary", "default", "123", "{}",
+		"blackhole", "x", "{}", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	if _, err = m.PlannerOnce("test"); err != nil {
+		t.Fatalf("expected PlannerOnce() to work, err: %v", err)
+	}
+	m.GetPlanPIndexes(true)
+
+	fcp, err := m.CoveringPIndexesFederated(
+		[]string{"x", "east:y"}, "ok")
+	if err != nil {
+		t.Fatalf("expected CoveringPIndexesFederated() to work, err: %v", err)
+	}
+	if len(fcp.RemoteIndexTargets) != 1 ||
+		fcp.RemoteIndexTargets[0].Cluster.Name != "east" ||
+		fcp.RemoteIndexTargets[0].IndexName != "y" {
+		t.Errorf("expected a remote index target, got: %#v",
+			fcp.RemoteIndexTargets)
+	}
+
+	if _, err = m.CoveringPIndexesFederated(
+		[]string{"west:y"}, "ok"); err == nil {
+		t.Errorf("expected err on an unknown remote cluster")
+	}
+
+	if err = m.DeleteRemoteCluster("east"); err != nil {
+		t.Fatalf("expected DeleteRemoteCluster() to work, err: %v", err)
+	}
+	if err = m.DeleteRemoteCluster("east"); err == nil {
+		t.Errorf("expected err on a second DeleteRemoteCluster()")
+	}
+}
@@ -0,0 +1,533 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// REPLICA_SAMPLES_KEY is the Cfg key of the ReplicaSamples.
+const REPLICA_SAMPLES_KEY = "replicaSamples"
+
+// REPLICA_DIVERGENCE_PATH is the REST path where a node reports the
+// divergence of the replicas of the cluster from their primaries, see
+// ReplicaDivergenceHandler().
+const REPLICA_DIVERGENCE_PATH = "/api/replicaDivergence"
+
+// DEFAULT_REPLICA_DIVERGENCE_INTERVAL is how often the replicas are
+// compared with their primaries, which may be overridden by the
+// "replicaDivergenceInterval" manager option.
+const DEFAULT_REPLICA_DIVERGENCE_INTERVAL = time.Minute
+
+// DEFAULT_REPLICA_DIVERGENCE_SEQ_LAG is how far, in the sum of the
+// seqs of its partitions, a replica may trail its primary, which may
+// be overridden by the "replicaDivergenceSeqLag" option.
+const DEFAULT_REPLICA_DIVERGENCE_SEQ_LAG = 100000
+
+// DEFAULT_REPLICA_DIVERGENCE_DOC_COUNT_PERCENT is how far, as a
+// percentage of its primary's doc count, a replica's doc count may
+// differ, which may be overridden by the
+// "replicaDivergenceDocCountPercent" option.
+const DEFAULT_REPLICA_DIVERGENCE_DOC_COUNT_PERCENT = 5.0
+
+// DEFAULT_REPLICA_DIVERGENCE_CHECKS is the number of consecutive
+// checks that a replica must diverge on before it's flagged, which
+// may be overridden by the "replicaDivergenceChecks" option, as a
+// replica normally trails its primary for a while during ingest.  A
+// check where a replica's seq lag shrank, as while it's catching up,
+// isn't counted.
+const DEFAULT_REPLICA_DIVERGENCE_CHECKS = 3
+
+// ReplicaSamples holds the recent seqs and doc counts of the
+// pindexes, as published by each node into the Cfg, so that any node
+// can compare the replicas of a pindex with its primary.
+//
+// When the "replicaDivergenceCheck" option is "true", each node
+// samples its pindexes and flags its replicas that diverge from their
+// primaries beyond the thresholds, with a "replicaDiverged" event.
+// When the "replicaDivergenceRebuild" option is also "true", a
+// flagged replica is removed, so that the janitor rebuilds it from
+// the source.
+type ReplicaSamples struct {
+	UUID  string                        `json:"uuid"`
+	Nodes map[string]*NodeReplicaSample `json:"nodes"` // Keyed by node UUID.
+}
+
+// NodeReplicaSample holds the samples of the pindexes on a node.
+type NodeReplicaSample struct {
+	Time     string                    `json:"time"`
+	PIndexes map[string]*ReplicaSample `json:"pindexes"` // Keyed by pindex name.
+}
+
+// ReplicaSample is the sampled progress of a pindex, where Seqs is the
+// sum of the seqs of its source partitions.  The DocCount is only
+// known when Counted, see PIndexImplType.CountPIndex.
+type ReplicaSample struct {
+	IndexUUID string `json:"indexUUID"`
+	Seqs      uint64 `json:"seqs"`
+	DocCount  uint64 `json:"docCount,omitempty"`
+	Counted   bool   `json:"counted,omitempty"`
+}
+
+// A ReplicaDivergence compares a replica of a pindex with its
+// primary.
+type ReplicaDivergence struct {
+	PIndex      string `json:"pindex"`
+	IndexName   string `json:"indexName"`
+	Node        string `json:"node"`        // UUID of the replica's node.
+	PrimaryNode string `json:"primaryNode"` // UUID of the primary's node.
+
+	SeqLag uint64 `json:"seqLag"`
+
+	DocCount         uint64  `json:"docCount,omitempty"`
+	PrimaryDocCount  uint64  `json:"primaryDocCount,omitempty"`
+	DocCountDiffPct  float64 `json:"docCountDiffPct,omitempty"`
+	DocCountsCounted bool    `json:"docCountsCounted,omitempty"`
+
+	Diverged bool `json:"diverged"`
+}
+
+// ReplicaDivergenceReport is the response of the
+// ReplicaDivergenceHandler().
+type ReplicaDivergenceReport struct {
+	SeqLag          uint64               `json:"seqLag"`
+	DocCountPercent float64              `json:"docCountPercent"`
+	Replicas        []*ReplicaDivergence `json:"replicas"`
+}
+
+// CfgGetReplicaSamples returns the ReplicaSamples from a Cfg.
+func CfgGetReplicaSamples(cfg Cfg) (*ReplicaSamples, uint64, error) {
+	v, cas, err := cfg.Get(REPLICA_SAMPLES_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &ReplicaSamples{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetReplicaSamples updates the ReplicaSamples on a Cfg.
+func CfgSetReplicaSamples(cfg Cfg, samples *ReplicaSamples, cas uint64) (
+	uint64, error) {
+	buf, err := json.Marshal(samples)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(REPLICA_SAMPLES_KEY, buf, cas)
+}
+
+// ---------------------------------------------------------
+
+// A replicaDivergenceCheck tracks a local replica that diverged from
+// its primary on consecutive checks.
+type replicaDivergenceCheck struct {
+	n       int    // Consecutive diverged checks.
+	seqLag  uint64 // Of the latest check.
+	flagged bool
+}
+
+// ReplicaDivergenceLoop periodically samples the local pindexes,
+// publishes the samples into the Cfg, and checks the local replicas
+// against their primaries, while the "replicaDivergenceCheck" option
+// is "true".
+func (mgr *Manager) ReplicaDivergenceLoop() {
+	interval := DEFAULT_REPLICA_DIVERGENCE_INTERVAL
+	if v, err := time.ParseDuration(
+		mgr.Options()["replicaDivergenceInterval"]); err == nil && v > 0 {
+		interval = v
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case now := <-ticker.C:
+			if mgr.Options()["replicaDivergenceCheck"] != "true" {
+				mgr.divergenceMutex.Lock()
+				mgr.divergenceChecks = nil
+				mgr.divergenceMutex.Unlock()
+				continue
+			}
+
+			mgr.checkReplicaDivergenceOnce(now)
+		}
+	}
+}
+
+// checkReplicaDivergenceOnce samples and publishes the local
+// pindexes, and then flags, and optionally rebuilds, the local
+// replicas that diverged from their primaries for enough consecutive
+// checks.
+func (mgr *Manager) checkReplicaDivergenceOnce(now time.Time) {
+	atomic.AddUint64(&mgr.stats.TotReplicaDivergenceCheck, 1)
+
+	err := mgr.publishReplicaSamples(mgr.sampleReplicas(), now)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotReplicaDivergenceCheckErr, 1)
+		mgr.log.Warnf("replica_divergence: publish, err: %v", err)
+		return
+	}
+
+	report, err := mgr.ReplicaDivergenceReport()
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotReplicaDivergenceCheckErr, 1)
+		mgr.log.Warnf("replica_divergence: report, err: %v", err)
+		return
+	}
+
+	options := mgr.Options()
+
+	checks := DEFAULT_REPLICA_DIVERGENCE_CHECKS
+	if v, err := strconv.Atoi(
+		options["replicaDivergenceChecks"]); err == nil && v > 0 {
+		checks = v
+	}
+
+	rebuild := options["replicaDivergenceRebuild"] == "true"
+
+	var flagged []*ReplicaDivergence
+
+	mgr.divergenceMutex.Lock()
+	prev := mgr.divergenceChecks
+	mgr.divergenceChecks = map[string]*replicaDivergenceCheck{}
+	for _, d := range report.Replicas {
+		if d.Node != mgr.uuid || !d.Diverged {
+			continue
+		}
+		c := &replicaDivergenceCheck{seqLag: d.SeqLag}
+		if p := prev[d.PIndex]; p != nil {
+			c.n, c.flagged = p.n, p.flagged
+			if d.SeqLag < p.seqLag {
+				// Catching up, such as after a rebuild, so the check
+				// isn't counted.
+				mgr.divergenceChecks[d.PIndex] = c
+				continue
+			}
+		}
+		c.n++
+		if c.n >= checks && !c.flagged {
+			c.flagged = true
+			flagged = append(flagged, d)
+			if rebuild {
+				continue // Starts over with the rebuilt replica.
+			}
+		}
+		mgr.divergenceChecks[d.PIndex] = c
+	}
+	mgr.divergenceMutex.Unlock()
+
+	for _, d := range flagged {
+		atomic.AddUint64(&mgr.stats.TotReplicaDiverged, 1)
+
+		mgr.log.Warnf("replica_divergence: diverged, pindex: %s,"+
+			" primaryNode: %s, seqLag: %d, docCountDiffPct: %.1f",
+			d.PIndex, d.PrimaryNode, d.SeqLag, d.DocCountDiffPct)
+
+		event, _ := json.Marshal(struct {
+			Event  string             `json:"event"`
+			Detail *ReplicaDivergence `json:"detail"`
+			Time   string             `json:"time"`
+		}{"replicaDiverged", d, now.Format(time.RFC3339Nano)})
+		mgr.AddEvent(event)
+
+		if rebuild {
+			mgr.rebuildReplica(d.PIndex, now)
+		}
+	}
+}
+
+// rebuildReplica removes a diverged local replica, so that the
+// janitor rebuilds it from the source.
+func (mgr *Manager) rebuildReplica(pindexName string, now time.Time) {
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		return
+	}
+
+	atomic.AddUint64(&mgr.stats.TotReplicaRebuild, 1)
+
+	err := mgr.RemovePIndex(pindex)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotReplicaRebuildErr, 1)
+		mgr.log.Warnf("replica_divergence: rebuild, pindex: %s, err: %v",
+			pindexName, err)
+	}
+
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	event, _ := json.Marshal(struct {
+		Event  string `json:"event"`
+		PIndex string `json:"pindex"`
+		Err    string `json:"err,omitempty"`
+		Time   string `json:"time"`
+	}{"replicaRebuild", pindexName, errStr, now.Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+
+	if err == nil {
+		mgr.JanitorKick("replica rebuild: " + pindexName)
+	}
+}
+
+// sampleReplicas returns the samples of the local pindexes.
+func (mgr *Manager) sampleReplicas() map[string]*ReplicaSample {
+	_, pindexes := mgr.CurrentMaps()
+
+	partitionSeqs := mgr.PartitionSeqs()
+
+	rv := make(map[string]*ReplicaSample, len(pindexes))
+
+	for name, pindex := range pindexes {
+		s := &ReplicaSample{IndexUUID: pindex.IndexUUID}
+
+		for _, us := range partitionSeqs[name] {
+			s.Seqs += us.Seq
+		}
+
+		t := GetPIndexImplType(pindex.IndexType)
+		if t != nil && t.CountPIndex != nil {
+			count, err := t.CountPIndex(mgr, pindex)
+			if err == nil {
+				s.DocCount, s.Counted = count, true
+			}
+		}
+
+		rv[name] = s
+	}
+
+	return rv
+}
+
+// publishReplicaSamples updates the entry of this node in the Cfg's
+// ReplicaSamples, retrying on concurrent updates by other nodes.
+func (mgr *Manager) publishReplicaSamples(samples map[string]*ReplicaSample,
+	now time.Time) (err error) {
+	for tries := 0; tries < 10; tries++ {
+		var all *ReplicaSamples
+		var cas uint64
+
+		all, cas, err = CfgGetReplicaSamples(mgr.cfg)
+		if err != nil {
+			return err
+		}
+		if all == nil {
+			all = &ReplicaSamples{}
+		}
+		if all.Nodes == nil {
+			all.Nodes = map[string]*NodeReplicaSample{}
+		}
+
+		if prev := all.Nodes[mgr.uuid]; prev != nil &&
+			reflect.DeepEqual(prev.PIndexes, samples) {
+			return nil // Skip the Cfg update, as nothing changed.
+		}
+
+		all.UUID = NewUUID()
+		all.Nodes[mgr.uuid] = &NodeReplicaSample{
+			Time:     now.Format(time.RFC3339Nano),
+			PIndexes: samples,
+		}
+
+		_, err = CfgSetReplicaSamples(mgr.cfg, all, cas)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			return err
+		}
+	}
+
+	return err
+}
+
+// ---------------------------------------------------------
+
+// ReplicaDivergenceReport compares the replicas of the cluster with
+// their primaries, from the samples that the nodes published into the
+// Cfg and the thresholds of the manager's options.
+func (mgr *Manager) ReplicaDivergenceReport() (
+	*ReplicaDivergenceReport, error) {
+	samples, _, err := CfgGetReplicaSamples(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexes, _, err := mgr.GetPlanPIndexes(true)
+	if err != nil {
+		return nil, err
+	}
+
+	options := mgr.Options()
+
+	rv := &ReplicaDivergenceReport{
+		SeqLag:          DEFAULT_REPLICA_DIVERGENCE_SEQ_LAG,
+		DocCountPercent: DEFAULT_REPLICA_DIVERGENCE_DOC_COUNT_PERCENT,
+	}
+	if v, err := strconv.ParseUint(
+		options["replicaDivergenceSeqLag"], 10, 64); err == nil {
+		rv.SeqLag = v
+	}
+	if v, err := strconv.ParseFloat(
+		options["replicaDivergenceDocCountPercent"], 64); err == nil && v >= 0 {
+		rv.DocCountPercent = v
+	}
+
+	rv.Replicas = CalcReplicaDivergence(samples, planPIndexes,
+		rv.SeqLag, rv.DocCountPercent)
+
+	return rv, nil
+}
+
+// CalcReplicaDivergence compares the samples of the replicas of each
+// planPIndex with the samples of its primary, which is the node with
+// the highest priority, ordered by pindex and node.  A replica
+// diverges when it trails its primary by more than the seqLag, or
+// when both doc counts are known and they differ by more than the
+// docCountPercent of the primary's count.  The replicas and
+// primaries without a sample for the planPIndex's index are skipped.
+func CalcReplicaDivergence(samples *ReplicaSamples,
+	planPIndexes *PlanPIndexes, seqLag uint64,
+	docCountPercent float64) []*ReplicaDivergence {
+	rv := []*ReplicaDivergence{}
+	if samples == nil || planPIndexes == nil {
+		return rv
+	}
+
+	sample := func(nodeUUID string, planPIndex *PlanPIndex) *ReplicaSample {
+		n := samples.Nodes[nodeUUID]
+		if n == nil {
+			return nil
+		}
+		s := n.PIndexes[planPIndex.Name]
+		if s == nil || s.IndexUUID != planPIndex.IndexUUID {
+			return nil
+		}
+		return s
+	}
+
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		nodeUUIDs := make([]string, 0, len(planPIndex.Nodes))
+		for nodeUUID := range planPIndex.Nodes {
+			nodeUUIDs = append(nodeUUIDs, nodeUUID)
+		}
+		if len(nodeUUIDs) < 2 {
+			continue
+		}
+		sort.Slice(nodeUUIDs, func(i, j int) bool {
+			pi := planPIndex.Nodes[nodeUUIDs[i]].Priority
+			pj := planPIndex.Nodes[nodeUUIDs[j]].Priority
+			if pi != pj {
+				return pi < pj
+			}
+			return nodeUUIDs[i] < nodeUUIDs[j]
+		})
+
+		primary := sample(nodeUUIDs[0], planPIndex)
+		if primary == nil {
+			continue
+		}
+
+		for _, nodeUUID := range nodeUUIDs[1:] {
+			replica := sample(nodeUUID, planPIndex)
+			if replica == nil {
+				continue
+			}
+
+			d := &ReplicaDivergence{
+				PIndex:      planPIndex.Name,
+				IndexName:   planPIndex.IndexName,
+				Node:        nodeUUID,
+				PrimaryNode: nodeUUIDs[0],
+			}
+
+			if primary.Seqs > replica.Seqs {
+				d.SeqLag = primary.Seqs - replica.Seqs
+			}
+			if d.SeqLag > seqLag {
+				d.Diverged = true
+			}
+
+			if primary.Counted && replica.Counted {
+				d.DocCountsCounted = true
+				d.DocCount = replica.DocCount
+				d.PrimaryDocCount = primary.DocCount
+
+				diff := math.Abs(float64(primary.DocCount) -
+					float64(replica.DocCount))
+				if primary.DocCount > 0 {
+					d.DocCountDiffPct = 100 * diff / float64(primary.DocCount)
+				} else if diff > 0 {
+					d.DocCountDiffPct = 100
+				}
+				if d.DocCountDiffPct > docCountPercent {
+					d.Diverged = true
+				}
+			}
+
+			rv = append(rv, d)
+		}
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].PIndex != rv[j].PIndex {
+			return rv[i].PIndex < rv[j].PIndex
+		}
+		return rv[i].Node < rv[j].Node
+	})
+
+	return rv
+}
+
+// ReplicaDivergenceHandler is the REST handler of
+// REPLICA_DIVERGENCE_PATH, which responds with a
+// ReplicaDivergenceReport, or only with the diverged replicas when
+// the "diverged" query param is "true".
+func ReplicaDivergenceHandler(mgr *Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := mgr.ReplicaDivergenceReport()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.URL.Query().Get("diverged") == "true" {
+			diverged := []*ReplicaDivergence{}
+			for _, d := range report.Replicas {
+				if d.Diverged {
+					diverged = append(diverged, d)
+				}
+			}
+			report.Replicas = diverged
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
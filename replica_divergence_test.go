@@ -0,0 +1,201 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCalcReplicaDivergence(t *testing.T) {
+	planPIndexes := &PlanPIndexes{PlanPIndexes: map[string]*PlanPIndex{
+		"p0": {Name: "p0", IndexName: "x", IndexUUID: "u",
+			Nodes: map[string]*PlanPIndexNode{
+				"a": {Priority: 0}, "b": {Priority: 1}, "c": {Priority: 1},
+			}},
+		"p1": {Name: "p1", IndexName: "x", IndexUUID: "u",
+			Nodes: map[string]*PlanPIndexNode{
+				"a": {Priority: 1}, "b": {Priority: 0},
+			}},
+		"p2": {Name: "p2", IndexName: "x", IndexUUID: "u",
+			Nodes: map[string]*PlanPIndexNode{
+				"a": {Priority: 0},
+			}},
+	}}
+
+	samples := &ReplicaSamples{Nodes: map[string]*NodeReplicaSample{
+		"a": {PIndexes: map[string]*ReplicaSample{
+			"p0": {IndexUUID: "u", Seqs: 1000, DocCount: 100, Counted: true},
+			"p1": {IndexUUID: "u", Seqs: 500, DocCount: 100, Counted: true},
+			"p2": {IndexUUID: "u", Seqs: 10},
+		}},
+		"b": {PIndexes: map[string]*ReplicaSample{
+			"p0": {IndexUUID: "u", Seqs: 990, DocCount: 90, Counted: true},
+			"p1": {IndexUUID: "u", Seqs: 400, DocCount: 100, Counted: true},
+		}},
+		"c": {PIndexes: map[string]*ReplicaSample{
+			"p0": {IndexUUID: "old", Seqs: 0},
+		}},
+	}}
+
+	got := CalcReplicaDivergence(samples, planPIndexes, 50, 5)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 replicas, got: %#v", got)
+	}
+
+	d := got[0]
+	if d.PIndex != "p0" || d.Node != "b" || d.PrimaryNode != "a" ||
+		d.SeqLag != 10 || !d.DocCountsCounted || d.DocCountDiffPct != 10 ||
+		!d.Diverged {
+		t.Errorf("expected a doc count divergence, got: %#v", d)
+	}
+
+	// A replica that's ahead of its primary has no seq lag.
+	d = got[1]
+	if d.PIndex != "p1" || d.Node != "a" || d.PrimaryNode != "b" ||
+		d.SeqLag != 0 || d.Diverged {
+		t.Errorf("expected no divergence, got: %#v", d)
+	}
+
+	got = CalcReplicaDivergence(samples, planPIndexes, 5, 20)
+	if !got[0].Diverged {
+		t.Errorf("expected a seq lag divergence, got: %#v", got[0])
+	}
+
+	if got = CalcReplicaDivergence(nil, planPIndexes, 5, 5); len(got) != 0 {
+		t.Errorf("expected no replicas without samples, got: %#v", got)
+	}
+}
+
+func TestReplicaDivergenceCheck(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, map[string]string{
+			"replicaDivergenceCheck":  "true",
+			"replicaDivergenceChecks": "2",
+		})
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	go func() {
+		for r := range m.plannerCh {
+			close(r.resCh)
+		}
+	}()
+
+	if err := m.CreateIndex("primary", "default", "123", "{}",
+		"blackhole", "x", "{}", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	if _, err := m.PlannerOnce("test"); err != nil {
+		t.Fatalf("expected PlannerOnce() to work, err: %v", err)
+	}
+	if err := m.JanitorOnce("test"); err != nil {
+		t.Fatalf("expected JanitorOnce() to work, err: %v", err)
+	}
+
+	go m.JanitorLoop()
+
+	// Make the local pindex a replica of a primary on another node,
+	// which is far ahead.
+	planPIndexes, cas, _ := CfgGetPlanPIndexes(cfg)
+	planPIndexes.UUID = NewUUID()
+	otherSamples := map[string]*ReplicaSample{}
+	var pindexName string
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		planPIndex.Nodes[m.UUID()].Priority = 1
+		planPIndex.Nodes["other"] = &PlanPIndexNode{
+			CanRead: true, CanWrite: true, Priority: 0,
+		}
+		otherSamples[name] = &ReplicaSample{
+			IndexUUID: planPIndex.IndexUUID, Seqs: 1000000,
+		}
+		pindexName = name
+	}
+	if _, err := CfgSetPlanPIndexes(cfg, planPIndexes, cas); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes() to work, err: %v", err)
+	}
+	if _, err := CfgSetReplicaSamples(cfg, &ReplicaSamples{
+		Nodes: map[string]*NodeReplicaSample{
+			"other": {PIndexes: otherSamples},
+		},
+	}, 0); err != nil {
+		t.Fatalf("expected CfgSetReplicaSamples() to work, err: %v", err)
+	}
+
+	now := time.Now()
+
+	m.checkReplicaDivergenceOnce(now)
+	if atomic.LoadUint64(&m.stats.TotReplicaDiverged) != 0 {
+		t.Errorf("expected no divergence on the first check")
+	}
+
+	samples, _, err := CfgGetReplicaSamples(cfg)
+	if err != nil || samples.Nodes[m.UUID()] == nil ||
+		samples.Nodes[m.UUID()].PIndexes[pindexName] == nil ||
+		samples.Nodes["other"] == nil {
+		t.Fatalf("expected the local samples, got: %#v, err: %v",
+			samples, err)
+	}
+
+	m.checkReplicaDivergenceOnce(now)
+	m.checkReplicaDivergenceOnce(now)
+	if atomic.LoadUint64(&m.stats.TotReplicaDiverged) != 1 {
+		t.Errorf("expected the replica to be flagged once, stats: %#v",
+			m.stats)
+	}
+
+	rr := httptest.NewRecorder()
+	ReplicaDivergenceHandler(m).ServeHTTP(rr,
+		httptest.NewRequest("GET", REPLICA_DIVERGENCE_PATH+"?diverged=true", nil))
+	var report ReplicaDivergenceReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatalf("expected a report, err: %v", err)
+	}
+	if len(report.Replicas) != 1 || report.Replicas[0].Node != m.UUID() ||
+		report.Replicas[0].SeqLag != 1000000 {
+		t.Errorf("expected a diverged replica, got: %s", rr.Body.String())
+	}
+
+	// With the rebuild enabled, the flagged replica is removed and
+	// rebuilt by the janitor.
+	pindex := m.GetPIndex(pindexName)
+
+	m.SetOptions(map[string]string{
+		"replicaDivergenceCheck":   "true",
+		"replicaDivergenceChecks":  "1",
+		"replicaDivergenceRebuild": "true",
+	})
+
+	m.divergenceMutex.Lock()
+	m.divergenceChecks = nil
+	m.divergenceMutex.Unlock()
+
+	m.checkReplicaDivergenceOnce(now)
+	if atomic.LoadUint64(&m.stats.TotReplicaRebuild) != 1 ||
+		atomic.LoadUint64(&m.stats.TotReplicaRebuildErr) != 0 {
+		t.Errorf("expected a replica rebuild, stats: %#v", m.stats)
+	}
+	if p := m.GetPIndex(pindexName); p == nil || p == pindex {
+		t.Errorf("expected a rebuilt pindex, got: %#v", p)
+	}
+}
@@ -0,0 +1,585 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ROLLING_RESTART_KEY is the Cfg key of the RollingRestart, which
+// every janitor watches for the requests to its own node.
+const ROLLING_RESTART_KEY = "rollingRestart"
+
+// DEFAULT_ROLLING_RESTART_POLL_INTERVAL is how often a rolling
+// restart checks whether a node has reached its next phase.
+const DEFAULT_ROLLING_RESTART_POLL_INTERVAL = 200 * time.Millisecond
+
+// DEFAULT_ROLLING_RESTART_COVERAGE_TIMEOUT is how long a rolling
+// restart waits, unless overridden by the
+// "rollingRestartCoverageTimeout" option, for a cordoned node's
+// pindexes to be covered by replicas on other nodes.
+const DEFAULT_ROLLING_RESTART_COVERAGE_TIMEOUT = 10 * time.Minute
+
+// DEFAULT_ROLLING_RESTART_REJOIN_TIMEOUT is how long a rolling
+// restart waits, unless overridden by the
+// "rollingRestartRejoinTimeout" option, for a restarted node to
+// rejoin with all its pindexes ready.
+const DEFAULT_ROLLING_RESTART_REJOIN_TIMEOUT = 10 * time.Minute
+
+// RollingRestart holds the requests of the running rolling restart to
+// its nodes.
+type RollingRestart struct {
+	UUID   string                         `json:"uuid"`
+	TaskID string                         `json:"taskID"`
+	Nodes  map[string]*RollingRestartNode `json:"nodes"` // Keyed by node UUID.
+}
+
+// A RollingRestartNode is the request of a rolling restart to a node.
+// A node re-registers itself as cordoned while Cordoned is true, and
+// restarts its feeds once for each new RestartID, which it then
+// acknowledges as the RejoinedID when all its pindexes are ready.
+type RollingRestartNode struct {
+	Cordoned   bool   `json:"cordoned,omitempty"`
+	RestartID  string `json:"restartID,omitempty"`
+	RejoinedID string `json:"rejoinedID,omitempty"`
+	Time       string `json:"time"`
+}
+
+// CfgGetRollingRestart retrieves the RollingRestart from a Cfg.
+func CfgGetRollingRestart(cfg Cfg) (*RollingRestart, uint64, error) {
+	v, cas, err := cfg.Get(ROLLING_RESTART_KEY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &RollingRestart{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetRollingRestart updates the RollingRestart in a Cfg.
+func CfgSetRollingRestart(cfg Cfg, r *RollingRestart, cas uint64) (
+	uint64, error) {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(ROLLING_RESTART_KEY, buf, cas)
+}
+
+// updateRollingRestart applies a change to the RollingRestart,
+// retrying on concurrent updates.
+func updateRollingRestart(cfg Cfg, change func(*RollingRestart) error) error {
+	for tries := 0; tries < 100; tries++ {
+		r, cas, err := CfgGetRollingRestart(cfg)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			r = &RollingRestart{}
+		}
+		if r.Nodes == nil {
+			r.Nodes = map[string]*RollingRestartNode{}
+		}
+
+		err = change(r)
+		if err != nil {
+			return err
+		}
+
+		r.UUID = NewUUID()
+
+		_, err = CfgSetRollingRestart(cfg, r, cas)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			return err
+		}
+	}
+
+	return fmt.Errorf("rolling_restart: could not save, too many tries")
+}
+
+// ---------------------------------------------------------
+
+// StartRollingRestart starts a task that restarts the feeds of the
+// given nodes one node at a time, such as so that the nodes pick up
+// new node-local options, or of all the wanted pindex nodes when
+// nodeUUIDs is empty.  Each node is first cordoned, so that the
+// queries move to the replicas on other nodes, and is only restarted
+// once every one of its pindexes is covered by a replica elsewhere.
+// The node then emits a "rollingRestart" event for the embedder and
+// restarts its feeds, and the task waits for the node to rejoin with
+// all its pindexes ready before it uncordons the node and continues
+// with the next one.  An embedder that instead restarts the whole
+// process on the event needs nothing more, as the rejoin is
+// acknowledged once the node has loaded its pindexes again.
+func (mgr *Manager) StartRollingRestart(nodeUUIDs []string) (string, error) {
+	nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, true)
+	if err != nil {
+		return "", err
+	}
+	if nodeDefs == nil {
+		return "", fmt.Errorf("rolling_restart: no wanted nodes")
+	}
+
+	if len(nodeUUIDs) <= 0 {
+		for nodeUUID, nodeDef := range nodeDefs.NodeDefs {
+			if nodeDefDoesPIndexes(nodeDef) {
+				nodeUUIDs = append(nodeUUIDs, nodeUUID)
+			}
+		}
+		sort.Strings(nodeUUIDs)
+	}
+	if len(nodeUUIDs) <= 0 {
+		return "", fmt.Errorf("rolling_restart: no nodes")
+	}
+	for _, nodeUUID := range nodeUUIDs {
+		if nodeDefs.NodeDefs[nodeUUID] == nil {
+			return "", fmt.Errorf("rolling_restart: unknown node: %s",
+				nodeUUID)
+		}
+	}
+
+	if taskID := mgr.runningRollingRestart(""); taskID != "" {
+		return "", fmt.Errorf("rolling_restart: already running,"+
+			" task: %s", taskID)
+	}
+
+	nodes := append([]string(nil), nodeUUIDs...)
+
+	return mgr.StartTask("rollingRestart",
+		func(ctx context.Context, h *TaskHandle) error {
+			return mgr.rollingRestart(ctx, h, nodes)
+		})
+}
+
+// runningRollingRestart returns the task ID of a rolling restart
+// that's still running, other than the given task.
+func (mgr *Manager) runningRollingRestart(exceptTaskID string) string {
+	r, _, err := CfgGetRollingRestart(mgr.cfg)
+	if err != nil || r == nil || r.TaskID == "" || r.TaskID == exceptTaskID {
+		return ""
+	}
+	task, err := mgr.GetTask(r.TaskID)
+	if err != nil || task.Done() {
+		return ""
+	}
+	return r.TaskID
+}
+
+// rollingRestart is the body of a rolling restart task.  On an error
+// or a cancellation, the node that's in the middle of its restart is
+// left to finish it, but is uncordoned.
+func (mgr *Manager) rollingRestart(ctx context.Context, h *TaskHandle,
+	nodeUUIDs []string) error {
+	err := updateRollingRestart(mgr.cfg, func(r *RollingRestart) error {
+		if taskID := mgr.runningRollingRestart(h.ID()); taskID != "" {
+			return fmt.Errorf("rolling_restart: already running,"+
+				" task: %s", taskID)
+		}
+		r.TaskID = h.ID()
+		r.Nodes = map[string]*RollingRestartNode{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := updateRollingRestart(mgr.cfg, func(r *RollingRestart) error {
+			if r.TaskID == h.ID() {
+				r.Nodes = map[string]*RollingRestartNode{}
+			}
+			return nil
+		})
+		if err != nil {
+			mgr.log.Warnf("rolling_restart: uncordon, task: %s, err: %v",
+				h.ID(), err)
+		}
+	}()
+
+	for i, nodeUUID := range nodeUUIDs {
+		progress := func(phase int, msg string) {
+			h.SetProgress((float64(i)+float64(phase)/5)/float64(len(nodeUUIDs)),
+				fmt.Sprintf("node %d of %d: %s, %s",
+					i+1, len(nodeUUIDs), nodeUUID, msg))
+		}
+
+		err = mgr.rollingRestartNode(ctx, h.ID(), nodeUUID, progress)
+		if err != nil {
+			return fmt.Errorf("rolling_restart: node: %s, err: %v",
+				nodeUUID, err)
+		}
+	}
+
+	return nil
+}
+
+// rollingRestartNode cordons, restarts and uncordons a single node.
+func (mgr *Manager) rollingRestartNode(ctx context.Context, taskID,
+	nodeUUID string, progress func(phase int, msg string)) error {
+	options := mgr.Options()
+
+	coverageTimeout := DEFAULT_ROLLING_RESTART_COVERAGE_TIMEOUT
+	if v, err := time.ParseDuration(
+		options["rollingRestartCoverageTimeout"]); err == nil && v > 0 {
+		coverageTimeout = v
+	}
+
+	rejoinTimeout := DEFAULT_ROLLING_RESTART_REJOIN_TIMEOUT
+	if v, err := time.ParseDuration(
+		options["rollingRestartRejoinTimeout"]); err == nil && v > 0 {
+		rejoinTimeout = v
+	}
+
+	setNode := func(change func(n *RollingRestartNode)) error {
+		return updateRollingRestart(mgr.cfg, func(r *RollingRestart) error {
+			if r.TaskID != taskID {
+				return fmt.Errorf("taken over by task: %s", r.TaskID)
+			}
+			n := r.Nodes[nodeUUID]
+			if n == nil {
+				n = &RollingRestartNode{}
+				r.Nodes[nodeUUID] = n
+			}
+			change(n)
+			n.Time = time.Now().Format(time.RFC3339Nano)
+			return nil
+		})
+	}
+
+	getNode := func() (*RollingRestartNode, error) {
+		r, _, err := CfgGetRollingRestart(mgr.cfg)
+		if err != nil || r == nil || r.Nodes[nodeUUID] == nil {
+			return nil, err
+		}
+		return r.Nodes[nodeUUID], nil
+	}
+
+	nodeCordoned := func(want bool) func() (bool, error) {
+		return func() (bool, error) {
+			nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, true)
+			if err != nil || nodeDefs == nil {
+				return false, err
+			}
+			nodeDef := nodeDefs.NodeDefs[nodeUUID]
+			return nodeDef != nil && nodeDef.Cordoned == want, nil
+		}
+	}
+
+	progress(0, "cordon")
+
+	err := setNode(func(n *RollingRestartNode) { n.Cordoned = true })
+	if err != nil {
+		return err
+	}
+
+	err = mgr.rollingRestartWait(ctx, coverageTimeout, "cordon",
+		nodeCordoned(true))
+	if err != nil {
+		return err
+	}
+
+	progress(1, "wait for replica coverage")
+
+	var uncovered []string
+
+	err = mgr.rollingRestartWait(ctx, coverageTimeout, "replica coverage",
+		func() (bool, error) {
+			nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, true)
+			if err != nil {
+				return false, err
+			}
+			planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+			if err != nil {
+				return false, err
+			}
+			uncovered = rollingRestartUncovered(nodeDefs, planPIndexes,
+				nodeUUID)
+			return len(uncovered) <= 0, nil
+		})
+	if err != nil {
+		if len(uncovered) > 0 {
+			return fmt.Errorf("%v, uncovered pindexes: %v", err, uncovered)
+		}
+		return err
+	}
+
+	progress(2, "restart")
+
+	restartID := NewUUID()
+
+	err = setNode(func(n *RollingRestartNode) { n.RestartID = restartID })
+	if err != nil {
+		return err
+	}
+
+	progress(3, "wait for rejoin")
+
+	err = mgr.rollingRestartWait(ctx, rejoinTimeout, "rejoin",
+		func() (bool, error) {
+			n, err := getNode()
+			if err != nil || n == nil || n.RejoinedID != restartID {
+				return false, err
+			}
+			return nodeCordoned(true)()
+		})
+	if err != nil {
+		return err
+	}
+
+	progress(4, "uncordon")
+
+	err = updateRollingRestart(mgr.cfg, func(r *RollingRestart) error {
+		delete(r.Nodes, nodeUUID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return mgr.rollingRestartWait(ctx, rejoinTimeout, "uncordon",
+		nodeCordoned(false))
+}
+
+// rollingRestartWait polls the cond until it's true, the timeout
+// passes, or the ctx is done.
+func (mgr *Manager) rollingRestartWait(ctx context.Context,
+	timeout time.Duration, what string, cond func() (bool, error)) error {
+	ticker := time.NewTicker(DEFAULT_ROLLING_RESTART_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		ok, err := cond()
+		if err != nil {
+			mgr.log.Warnf("rolling_restart: wait for %s, err: %v", what, err)
+		} else if ok {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for %s", what)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollingRestartUncovered returns the names of the planPIndexes of a
+// node that have no readable replica on another wanted, uncordoned
+// pindex node.
+func rollingRestartUncovered(nodeDefs *NodeDefs,
+	planPIndexes *PlanPIndexes, nodeUUID string) []string {
+	if planPIndexes == nil {
+		return nil
+	}
+	if nodeDefs == nil {
+		nodeDefs = &NodeDefs{}
+	}
+
+	var rv []string
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.Nodes[nodeUUID] == nil {
+			continue
+		}
+		covered := false
+		for otherUUID, planPIndexNode := range planPIndex.Nodes {
+			if otherUUID == nodeUUID || !planPIndexNode.CanRead {
+				continue
+			}
+			nodeDef := nodeDefs.NodeDefs[otherUUID]
+			if nodeDef != nil && !nodeDef.Cordoned &&
+				nodeDefDoesPIndexes(nodeDef) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			rv = append(rv, name)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv
+}
+
+// nodeDefDoesPIndexes returns whether a node has the "pindex" tag,
+// where a node without tags does everything.
+func nodeDefDoesPIndexes(nodeDef *NodeDef) bool {
+	if len(nodeDef.Tags) <= 0 {
+		return true
+	}
+	for _, tag := range nodeDef.Tags {
+		if tag == "pindex" {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------
+
+// applyRollingRestart acts on the rolling restart's request to this
+// node, re-registering the node when it's cordoned or uncordoned, and
+// restarting the node's feeds for a new restart request.  With
+// onlyMarkSeen, such as on startup when the feeds are new anyways, a
+// pending restart request is only acknowledged.
+func (mgr *Manager) applyRollingRestart(onlyMarkSeen bool) {
+	mgr.rollingApplyMutex.Lock()
+	defer mgr.rollingApplyMutex.Unlock()
+
+	r, _, err := CfgGetRollingRestart(mgr.cfg)
+	if err != nil {
+		mgr.log.Warnf("rolling_restart: apply, err: %v", err)
+		return
+	}
+
+	var n *RollingRestartNode
+	if r != nil {
+		n = r.Nodes[mgr.uuid]
+	}
+
+	cordoned := n != nil && n.Cordoned
+
+	mgr.rollingMutex.Lock()
+	cordonedChanged := mgr.rollingCordoned != cordoned
+	mgr.rollingCordoned = cordoned
+	restart := n != nil && n.RestartID != "" &&
+		n.RestartID != n.RejoinedID && n.RestartID != mgr.rollingSeen
+	if restart {
+		mgr.rollingSeen = n.RestartID
+	}
+	mgr.rollingMutex.Unlock()
+
+	if cordonedChanged {
+		nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_WANTED)
+		if err == nil && nodeDefs != nil && nodeDefs.NodeDefs[mgr.uuid] != nil {
+			err = mgr.SaveNodeDef(NODE_DEFS_WANTED, false)
+		}
+		if err != nil {
+			mgr.log.Warnf("rolling_restart: cordoned: %t, err: %v",
+				cordoned, err)
+		}
+	}
+
+	if !restart {
+		return
+	}
+
+	if !onlyMarkSeen {
+		err = mgr.rollingRestartFeeds(n.RestartID)
+		if err != nil {
+			atomic.AddUint64(&mgr.stats.TotRollingRestartNodeErr, 1)
+			mgr.log.Warnf("rolling_restart: restart, err: %v", err)
+			return
+		}
+	}
+
+	mgr.rollingRestartRejoin(n.RestartID)
+}
+
+// rollingRestartFeeds emits the "rollingRestart" event for the
+// embedder and restarts all the feeds of this node.
+func (mgr *Manager) rollingRestartFeeds(restartID string) error {
+	atomic.AddUint64(&mgr.stats.TotRollingRestartNode, 1)
+
+	event, _ := json.Marshal(struct {
+		Event     string `json:"event"`
+		RestartID string `json:"restartID"`
+		Time      string `json:"time"`
+	}{"rollingRestart", restartID, time.Now().Format(time.RFC3339Nano)})
+	mgr.AddEvent(event)
+
+	feeds, _ := mgr.CurrentMaps()
+
+	names := make([]string, 0, len(feeds))
+	for name := range feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mgr.log.Printf("rolling_restart: restarting feeds: %v", names)
+
+	for _, name := range names {
+		err := mgr.RestartFeed(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	mgr.JanitorKick("rolling restart")
+
+	return nil
+}
+
+// rollingRestartRejoin waits for this node's pindexes to be ready and
+// then acknowledges the restart request.
+func (mgr *Manager) rollingRestartRejoin(restartID string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-mgr.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	rejoinTimeout := DEFAULT_ROLLING_RESTART_REJOIN_TIMEOUT
+	if v, err := time.ParseDuration(
+		mgr.Options()["rollingRestartRejoinTimeout"]); err == nil && v > 0 {
+		rejoinTimeout = v
+	}
+
+	err := mgr.rollingRestartWait(ctx, rejoinTimeout, "pindexes ready",
+		func() (bool, error) {
+			return len(mgr.startupNotReadyPIndexes()) <= 0, nil
+		})
+	if err == nil {
+		err = updateRollingRestart(mgr.cfg, func(r *RollingRestart) error {
+			n := r.Nodes[mgr.uuid]
+			if n == nil || n.RestartID != restartID {
+				return fmt.Errorf("request changed")
+			}
+			n.RejoinedID = restartID
+			n.Time = time.Now().Format(time.RFC3339Nano)
+			return nil
+		})
+	}
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotRollingRestartNodeErr, 1)
+		mgr.log.Warnf("rolling_restart: rejoin, restartID: %s, err: %v",
+			restartID, err)
+		return
+	}
+
+	mgr.log.Printf("rolling_restart: rejoined, restartID: %s", restartID)
+}
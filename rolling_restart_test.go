@@ -0,0 +1,214 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRollingRestartUncovered(t *testing.T) {
+	nodeDefs := &NodeDefs{NodeDefs: map[string]*NodeDef{
+		"a": {UUID: "a"},
+		"b": {UUID: "b", Tags: []string{"pindex"}},
+		"c": {UUID: "c", Cordoned: true},
+		"d": {UUID: "d", Tags: []string{"queryer"}},
+	}}
+
+	planPIndexes := &PlanPIndexes{PlanPIndexes: map[string]*PlanPIndex{
+		"p0": {Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true}, "b": {CanRead: true},
+		}},
+		"p1": {Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true}, "b": {CanRead: false},
+		}},
+		"p2": {Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true}, "c": {CanRead: true},
+		}},
+		"p3": {Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true}, "d": {CanRead: true},
+		}},
+		"p4": {Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true}, "x": {CanRead: true},
+		}},
+		"p5": {Nodes: map[string]*PlanPIndexNode{
+			"b": {CanRead: true},
+		}},
+	}}
+
+	got := rollingRestartUncovered(nodeDefs, planPIndexes, "a")
+	exp := []string{"p1", "p2", "p3", "p4"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected uncovered: %v, got: %v", exp, got)
+	}
+
+	got = rollingRestartUncovered(nodeDefs, planPIndexes, "b")
+	exp = []string{"p5"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected uncovered: %v, got: %v", exp, got)
+	}
+}
+
+func TestRollingRestart(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, map[string]string{
+			"rollingRestartCoverageTimeout": "300ms",
+		})
+	if err := m.Register("wanted"); err != nil {
+		t.Fatalf("expected Register() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	go func() {
+		for r := range m.plannerCh {
+			close(r.resCh)
+		}
+	}()
+
+	if err := m.CreateIndex("primary", "default", "123", "{}",
+		"blackhole", "x", "{}", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	if _, err := m.PlannerOnce("test"); err != nil {
+		t.Fatalf("expected PlannerOnce() to work, err: %v", err)
+	}
+	if err := m.JanitorOnce("test"); err != nil {
+		t.Fatalf("expected JanitorOnce() to work, err: %v", err)
+	}
+
+	go m.JanitorLoop()
+
+	waitTask := func(id string) *Task {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			task, err := m.GetTask(id)
+			if err != nil {
+				t.Fatalf("expected GetTask() to work, err: %v", err)
+			}
+			if task.Done() {
+				return task
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected task to finish, got: %#v", task)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	waitCordoned := func(want bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			nodeDefs, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+			if nodeDefs != nil && nodeDefs.NodeDefs[m.UUID()] != nil &&
+				nodeDefs.NodeDefs[m.UUID()].Cordoned == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected cordoned: %t", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Without replicas, the node's pindexes can't be covered.
+	id, err := m.StartRollingRestart(nil)
+	if err != nil {
+		t.Fatalf("expected StartRollingRestart() to work, err: %v", err)
+	}
+	task := waitTask(id)
+	if task.State != TaskFailed {
+		t.Errorf("expected a failed task, got: %#v", task)
+	}
+	waitCordoned(false)
+
+	if _, err = m.StartRollingRestart([]string{"not-a-node"}); err == nil {
+		t.Errorf("expected err on an unknown node")
+	}
+
+	// Add a replica of every pindex on another node.
+	nodeDefs, cas, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	nodeDefs.UUID = NewUUID()
+	nodeDefs.NodeDefs["other"] = &NodeDef{UUID: "other",
+		HostPort: "other:1000", ImplVersion: Version}
+	if _, err = CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, cas); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs() to work, err: %v", err)
+	}
+
+	planPIndexes, cas, _ := CfgGetPlanPIndexes(cfg)
+	planPIndexes.UUID = NewUUID()
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		planPIndex.Nodes["other"] = &PlanPIndexNode{
+			CanRead: true, CanWrite: true, Priority: 1,
+		}
+	}
+	if _, err = CfgSetPlanPIndexes(cfg, planPIndexes, cas); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes() to work, err: %v", err)
+	}
+
+	// A cordoned node's queries move to the other node.
+	err = updateRollingRestart(cfg, func(r *RollingRestart) error {
+		r.Nodes[m.UUID()] = &RollingRestartNode{Cordoned: true}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected updateRollingRestart() to work, err: %v", err)
+	}
+	waitCordoned(true)
+
+	local, remote, _, err := m.CoveringPIndexesEx(CoveringPIndexesSpec{
+		IndexName: "x",
+	}, PlanPIndexNodeCanRead, true)
+	if err != nil || len(local) != 0 || len(remote) != 1 ||
+		remote[0].NodeDef.UUID != "other" {
+		t.Errorf("expected a remote covering pindex, got: %v, %v, err: %v",
+			local, remote, err)
+	}
+
+	err = updateRollingRestart(cfg, func(r *RollingRestart) error {
+		delete(r.Nodes, m.UUID())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected updateRollingRestart() to work, err: %v", err)
+	}
+	waitCordoned(false)
+
+	id, err = m.StartRollingRestart([]string{m.UUID()})
+	if err != nil {
+		t.Fatalf("expected StartRollingRestart() to work, err: %v", err)
+	}
+	task = waitTask(id)
+	if task.State != TaskSucceeded {
+		t.Fatalf("expected a succeeded task, got: %#v", task)
+	}
+	waitCordoned(false)
+
+	if atomic.LoadUint64(&m.stats.TotRollingRestartNode) != 1 {
+		t.Errorf("expected 1 node restart, stats: %#v", m.stats)
+	}
+	if atomic.LoadUint64(&m.stats.TotFeedRestart) != 1 {
+		t.Errorf("expected 1 feed restart, stats: %#v", m.stats)
+	}
+
+	r, _, err := CfgGetRollingRestart(cfg)
+	if err != nil || r == nil || r.TaskID != id || len(r.Nodes) != 0 {
+		t.Errorf("expected no pending requests, got: %#v, err: %v", r, err)
+	}
+}
@@ -0,0 +1,144 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"reflect"
+	"sort"
+	"sync/atomic"
+)
+
+// ServicePublishers allows applications to register service discovery
+// publishers, such as for Consul services or DNS-SD, so that front-end
+// load balancers can route index queries to the nodes that serve the
+// indexes.  A Manager uses the publisher named by its
+// "servicePublisherName" option, if any.  It should be modified only
+// during the init()'ialization phase of process startup.
+var ServicePublishers = map[string]ServicePublisher{}
+
+// A ServicePublisher publishes a node's ServiceInfo to an external
+// registry.  It's invoked whenever the ServiceInfo changes, such as on
+// Register() or a plan change, and must not block for long.
+type ServicePublisher interface {
+	PublishService(info *ServiceInfo) error
+}
+
+// A ServicePublisherFunc is a func that's a ServicePublisher, such as
+// an application's callback.
+type ServicePublisherFunc func(info *ServiceInfo) error
+
+// PublishService invokes the func.
+func (f ServicePublisherFunc) PublishService(info *ServiceInfo) error {
+	return f(info)
+}
+
+// A ServiceInfo describes the query endpoint of a node.
+type ServiceInfo struct {
+	NodeUUID  string   `json:"nodeUUID"`
+	BindHttp  string   `json:"bindHttp"` // The advertised address.
+	Container string   `json:"container,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+
+	// Indexes are the names of the indexes with pindexes that the
+	// plan assigns to the node as readable, sorted.
+	Indexes []string `json:"indexes"`
+
+	// Withdrawn is true when the node's no longer a known node, so
+	// the registry should remove its entry.
+	Withdrawn bool `json:"withdrawn,omitempty"`
+}
+
+// servicePublisher returns the configured ServicePublisher, or nil.
+func (mgr *Manager) servicePublisher() ServicePublisher {
+	name := mgr.Options()["servicePublisherName"]
+	if name == "" {
+		return nil
+	}
+	return ServicePublishers[name]
+}
+
+// PublishService publishes the node's current ServiceInfo to the
+// configured ServicePublisher, if any, unless it's unchanged since
+// the last successful publish.
+func (mgr *Manager) PublishService() error {
+	publisher := mgr.servicePublisher()
+	if publisher == nil || mgr.cfg == nil {
+		return nil
+	}
+
+	mgr.servicePublishMutex.Lock()
+	defer mgr.servicePublishMutex.Unlock()
+
+	info, err := mgr.calcServiceInfo()
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotServicePublishErr, 1)
+		return err
+	}
+	if reflect.DeepEqual(info, mgr.lastServiceInfo) {
+		return nil
+	}
+
+	atomic.AddUint64(&mgr.stats.TotServicePublish, 1)
+
+	err = publisher.PublishService(info)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotServicePublishErr, 1)
+		mgr.log.Warnf("service_publisher: publish, info: %+v, err: %v",
+			info, err)
+		return err
+	}
+
+	mgr.lastServiceInfo = info
+
+	return nil
+}
+
+func (mgr *Manager) calcServiceInfo() (*ServiceInfo, error) {
+	info := &ServiceInfo{
+		NodeUUID:  mgr.uuid,
+		BindHttp:  mgr.advertise,
+		Container: mgr.container,
+		Tags:      mgr.tags,
+		Indexes:   []string{},
+	}
+
+	nodeDefsKnown, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_KNOWN)
+	if err != nil {
+		return nil, err
+	}
+	if nodeDefsKnown == nil || nodeDefsKnown.NodeDefs[mgr.uuid] == nil {
+		info.Withdrawn = true
+		return info, nil
+	}
+
+	planPIndexes, _, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, err
+	}
+	if planPIndexes == nil {
+		return info, nil
+	}
+
+	indexes := map[string]bool{}
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		planPIndexNode := planPIndex.Nodes[mgr.uuid]
+		if planPIndexNode != nil && planPIndexNode.CanRead {
+			indexes[planPIndex.IndexName] = true
+		}
+	}
+	for indexName := range indexes {
+		info.Indexes = append(info.Indexes, indexName)
+	}
+	sort.Strings(info.Indexes)
+
+	return info, nil
+}
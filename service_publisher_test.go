@@ -0,0 +1,121 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServicePublisher(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	var m sync.Mutex
+	var published []*ServiceInfo
+	var publishErr error
+
+	name := "TestServicePublisher-" + NewUUID()
+	ServicePublishers[name] = ServicePublisherFunc(
+		func(info *ServiceInfo) error {
+			m.Lock()
+			defer m.Unlock()
+			if publishErr != nil {
+				return publishErr
+			}
+			published = append(published, info)
+			return nil
+		})
+	defer delete(ServicePublishers, name)
+
+	last := func() (*ServiceInfo, int) {
+		m.Lock()
+		defer m.Unlock()
+		if len(published) == 0 {
+			return nil, 0
+		}
+		return published[len(published)-1], len(published)
+	}
+
+	cfg := NewCfgMem()
+	mgr := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "", nil,
+		map[string]string{"servicePublisherName": name})
+	if err := mgr.Register("wanted"); err != nil {
+		t.Fatalf("expected Register to work, err: %v", err)
+	}
+
+	info, n := last()
+	if n != 1 || info.Withdrawn || info.BindHttp != ":1000" ||
+		info.NodeUUID != mgr.UUID() || len(info.Indexes) != 0 {
+		t.Errorf("expected a published registration, got: %d, %+v", n, info)
+	}
+
+	planPIndexes := NewPlanPIndexes(Version)
+	for i, indexName := range []string{"b", "a", "a", "c"} {
+		planPIndexes.PlanPIndexes[fmt.Sprintf("p%d", i)] = &PlanPIndex{
+			Name:      fmt.Sprintf("p%d", i),
+			IndexName: indexName,
+			Nodes: map[string]*PlanPIndexNode{
+				mgr.UUID(): {CanRead: indexName != "c", CanWrite: true},
+			},
+		}
+	}
+	_, err := CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+	mgr.GetPlanPIndexes(true)
+
+	if err = mgr.PublishService(); err != nil {
+		t.Errorf("expected PublishService to work, err: %v", err)
+	}
+	info, n = last()
+	if n != 2 || !reflect.DeepEqual(info.Indexes, []string{"a", "b"}) {
+		t.Errorf("expected the readable indexes, got: %d, %+v", n, info)
+	}
+
+	if err = mgr.PublishService(); err != nil {
+		t.Errorf("expected PublishService to work, err: %v", err)
+	}
+	if _, n = last(); n != 2 {
+		t.Errorf("expected no publish when unchanged, got: %d", n)
+	}
+
+	m.Lock()
+	publishErr = fmt.Errorf("registry down")
+	m.Unlock()
+
+	if err = mgr.Register("unknown"); err != nil {
+		t.Fatalf("expected Register to work, err: %v", err)
+	}
+	if atomic.LoadUint64(&mgr.stats.TotServicePublishErr) != 1 {
+		t.Errorf("expected a publish error")
+	}
+
+	m.Lock()
+	publishErr = nil
+	m.Unlock()
+
+	if err = mgr.PublishService(); err != nil {
+		t.Errorf("expected PublishService to work, err: %v", err)
+	}
+	info, n = last()
+	if n != 3 || !info.Withdrawn {
+		t.Errorf("expected a retried withdrawal, got: %d, %+v", n, info)
+	}
+}
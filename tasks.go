@@ -0,0 +1,398 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TASKS_KEY is the Cfg key of the Tasks of the cluster.
+const TASKS_KEY = "tasks"
+
+// MAX_DONE_TASKS is the number of finished tasks that are kept in the
+// Cfg, after which the oldest finished tasks are pruned.
+const MAX_DONE_TASKS = 100
+
+// DEFAULT_TASK_PROGRESS_INTERVAL is the minimum interval between the
+// Cfg writes of a task's progress updates.
+const DEFAULT_TASK_PROGRESS_INTERVAL = time.Second
+
+// The states of a Task.
+const (
+	TaskRunning   = "running"
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+	TaskCanceled  = "canceled"
+)
+
+// Tasks holds the long-running activities of a cluster, such as an
+// index rollout or a rebalance, keyed by Task.ID.
+type Tasks struct {
+	UUID  string           `json:"uuid"`
+	Tasks map[string]*Task `json:"tasks"`
+}
+
+// A Task is a long-running activity that's run by a node, with its
+// progress persisted in the Cfg so that it can be watched, and
+// canceled, from any node.
+type Task struct {
+	ID       string  `json:"id"`
+	Type     string  `json:"type"` // Such as "indexCreate".
+	Node     string  `json:"node"` // UUID of the node running the task.
+	State    string  `json:"state"`
+	Progress float64 `json:"progress"` // From 0.0 to 1.0.
+	Message  string  `json:"message,omitempty"`
+	Err      string  `json:"err,omitempty"`
+
+	CancelRequested bool `json:"cancelRequested,omitempty"`
+
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// Done returns true when the task has finished.
+func (t *Task) Done() bool {
+	return t.State != TaskRunning
+}
+
+// A TaskFunc is the body of a task, which should return promptly
+// once its ctx is done, as when the task is canceled or the manager
+// is stopped.
+type TaskFunc func(ctx context.Context, h *TaskHandle) error
+
+// CfgGetTasks returns the Tasks from a Cfg.
+func CfgGetTasks(cfg Cfg) (*Tasks, uint64, error) {
+	v, cas, err := cfg.Get(TASKS_KEY, 0)
+	if err != nil {
+		return nil, cas, err
+	}
+	if v == nil {
+		return nil, cas, nil
+	}
+	rv := &Tasks{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetTasks updates the Tasks on a Cfg.
+func CfgSetTasks(cfg Cfg, tasks *Tasks, cas uint64) (uint64, error) {
+	buf, err := json.Marshal(tasks)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(TASKS_KEY, buf, cas)
+}
+
+// ---------------------------------------------------------
+
+// A TaskHandle lets a TaskFunc report its progress.
+type TaskHandle struct {
+	mgr    *Manager
+	id     string
+	cancel context.CancelFunc
+
+	m           sync.Mutex // Protects the fields that follow.
+	lastPersist time.Time
+}
+
+// ID returns the ID of the task.
+func (h *TaskHandle) ID() string {
+	return h.id
+}
+
+// SetProgress records the progress, from 0.0 to 1.0, and a message of
+// the task.  Updates are persisted at most once per
+// DEFAULT_TASK_PROGRESS_INTERVAL, and may notice a cancellation that
+// was requested from another node.
+func (h *TaskHandle) SetProgress(progress float64, msg string) {
+	now := time.Now()
+
+	h.m.Lock()
+	if now.Sub(h.lastPersist) < DEFAULT_TASK_PROGRESS_INTERVAL {
+		h.m.Unlock()
+		return
+	}
+	h.lastPersist = now
+	h.m.Unlock()
+
+	var cancelRequested bool
+
+	err := h.mgr.updateTask(h.id, func(t *Task) error {
+		if t.Done() {
+			return nil
+		}
+		t.Progress, t.Message = progress, msg
+		cancelRequested = t.CancelRequested
+		return nil
+	})
+	if err != nil {
+		h.mgr.log.Warnf("tasks: progress, id: %s, err: %v", h.id, err)
+	}
+
+	if cancelRequested {
+		h.cancel()
+	}
+}
+
+// ---------------------------------------------------------
+
+// StartTask persists a new running task of the given type and runs its
+// fn in the background, returning the task's ID.
+func (mgr *Manager) StartTask(taskType string, fn TaskFunc) (string, error) {
+	now := time.Now().Format(time.RFC3339Nano)
+
+	task := &Task{
+		ID:        NewUUID(),
+		Type:      taskType,
+		Node:      mgr.uuid,
+		State:     TaskRunning,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err := mgr.updateTasks(func(tasks *Tasks) error {
+		tasks.Tasks[task.ID] = task
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	atomic.AddUint64(&mgr.stats.TotTaskStart, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h := &TaskHandle{mgr: mgr, id: task.ID, cancel: cancel}
+
+	mgr.tasksMutex.Lock()
+	if mgr.taskCancels == nil {
+		mgr.taskCancels = map[string]context.CancelFunc{}
+	}
+	mgr.taskCancels[task.ID] = cancel
+	mgr.tasksMutex.Unlock()
+
+	go func() {
+		select {
+		case <-mgr.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		errRun := fn(ctx, h)
+
+		canceled := ctx.Err() != nil
+
+		cancel()
+
+		mgr.tasksMutex.Lock()
+		delete(mgr.taskCancels, task.ID)
+		mgr.tasksMutex.Unlock()
+
+		err := mgr.updateTask(task.ID, func(t *Task) error {
+			switch {
+			case errRun == nil:
+				t.State, t.Progress = TaskSucceeded, 1.0
+			case canceled:
+				t.State = TaskCanceled
+			default:
+				t.State = TaskFailed
+			}
+			if errRun != nil {
+				t.Err = errRun.Error()
+			}
+			return nil
+		})
+		if err != nil {
+			mgr.log.Warnf("tasks: finish, id: %s, err: %v", task.ID, err)
+		}
+
+		if errRun != nil {
+			atomic.AddUint64(&mgr.stats.TotTaskErr, 1)
+		} else {
+			atomic.AddUint64(&mgr.stats.TotTaskOk, 1)
+		}
+
+		mgr.log.Printf("tasks: done, id: %s, type: %s, err: %v",
+			task.ID, taskType, errRun)
+	}()
+
+	mgr.log.Printf("tasks: started, id: %s, type: %s", task.ID, taskType)
+
+	return task.ID, nil
+}
+
+// CancelTask requests the cancellation of a running task.  A task of
+// this node is canceled right away, while a task of another node is
+// canceled on that node's next progress update.
+func (mgr *Manager) CancelTask(id string) error {
+	err := mgr.updateTask(id, func(t *Task) error {
+		if t.Done() {
+			return fmt.Errorf("tasks: task already done, id: %s,"+
+				" state: %s", id, t.State)
+		}
+		t.CancelRequested = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	mgr.tasksMutex.Lock()
+	cancel := mgr.taskCancels[id]
+	mgr.tasksMutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	return nil
+}
+
+// GetTask returns a task from the Cfg.
+func (mgr *Manager) GetTask(id string) (*Task, error) {
+	tasks, _, err := CfgGetTasks(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tasks == nil || tasks.Tasks[id] == nil {
+		return nil, fmt.Errorf("tasks: no task, id: %s", id)
+	}
+	return tasks.Tasks[id], nil
+}
+
+// GetTasks returns the tasks from the Cfg, oldest first.
+func (mgr *Manager) GetTasks() ([]*Task, error) {
+	tasks, _, err := CfgGetTasks(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []*Task{}
+	if tasks != nil {
+		for _, task := range tasks.Tasks {
+			rv = append(rv, task)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		ti, tj := taskTime(rv[i].CreatedAt), taskTime(rv[j].CreatedAt)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return rv[i].ID < rv[j].ID
+	})
+
+	return rv, nil
+}
+
+// failOrphanedTasks marks the running tasks of this node as failed, as
+// they were interrupted by a restart of the node.
+func (mgr *Manager) failOrphanedTasks() error {
+	return mgr.updateTasks(func(tasks *Tasks) error {
+		for _, t := range tasks.Tasks {
+			if t.Node == mgr.uuid && !t.Done() {
+				t.State = TaskFailed
+				t.Err = "tasks: interrupted by a node restart"
+				t.UpdatedAt = time.Now().Format(time.RFC3339Nano)
+			}
+		}
+		return nil
+	})
+}
+
+// updateTask applies a change to a task, retrying on concurrent
+// updates.
+func (mgr *Manager) updateTask(id string, change func(*Task) error) error {
+	return mgr.updateTasks(func(tasks *Tasks) error {
+		t := tasks.Tasks[id]
+		if t == nil {
+			return fmt.Errorf("tasks: no task, id: %s", id)
+		}
+		err := change(t)
+		if err != nil {
+			return err
+		}
+		t.UpdatedAt = time.Now().Format(time.RFC3339Nano)
+		return nil
+	})
+}
+
+// updateTasks applies a change to the Tasks, pruning the oldest
+// finished tasks and retrying on concurrent updates.
+func (mgr *Manager) updateTasks(change func(*Tasks) error) error {
+	for tries := 0; ; tries++ {
+		tasks, cas, err := CfgGetTasks(mgr.cfg)
+		if err != nil {
+			return err
+		}
+		if tasks == nil {
+			tasks = &Tasks{}
+		}
+		if tasks.Tasks == nil {
+			tasks.Tasks = map[string]*Task{}
+		}
+
+		err = change(tasks)
+		if err != nil {
+			return err
+		}
+
+		pruneDoneTasks(tasks, MAX_DONE_TASKS)
+
+		tasks.UUID = NewUUID()
+
+		_, err = CfgSetTasks(mgr.cfg, tasks, cas)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok || tries >= 100 {
+			return err
+		}
+	}
+}
+
+// pruneDoneTasks removes the oldest finished tasks beyond the maxDone.
+func pruneDoneTasks(tasks *Tasks, maxDone int) {
+	var done []*Task
+	for _, t := range tasks.Tasks {
+		if t.Done() {
+			done = append(done, t)
+		}
+	}
+	if len(done) <= maxDone {
+		return
+	}
+
+	sort.Slice(done, func(i, j int) bool {
+		return taskTime(done[i].UpdatedAt).Before(taskTime(done[j].UpdatedAt))
+	})
+	for _, t := range done[:len(done)-maxDone] {
+		delete(tasks.Tasks, t.ID)
+	}
+}
+
+// taskTime parses a task timestamp, as the RFC3339Nano strings don't
+// sort lexically.
+func taskTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
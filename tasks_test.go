@@ -0,0 +1,175 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func waitForTaskState(t *testing.T, m *Manager, id, state string) *Task {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		task, err := m.GetTask(id)
+		if err != nil {
+			t.Fatalf("expected GetTask() to work, err: %v", err)
+		}
+		if task.State == state {
+			return task
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected task state: %s, got: %#v", state, task)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManagerTasks(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(Version, NewCfgMem(), nil, NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, nil)
+
+	okID, err := m.StartTask("test", func(ctx context.Context,
+		h *TaskHandle) error {
+		h.SetProgress(0.5, "halfway")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected StartTask() to work, err: %v", err)
+	}
+	task := waitForTaskState(t, m, okID, TaskSucceeded)
+	if task.Progress != 1.0 || task.Node != m.UUID() || task.Type != "test" {
+		t.Errorf("expected a succeeded task, got: %#v", task)
+	}
+
+	errID, _ := m.StartTask("test", func(ctx context.Context,
+		h *TaskHandle) error {
+		return fmt.Errorf("boom")
+	})
+	task = waitForTaskState(t, m, errID, TaskFailed)
+	if task.Err != "boom" {
+		t.Errorf("expected the task's err, got: %#v", task)
+	}
+
+	waitID, _ := m.StartTask("test", func(ctx context.Context,
+		h *TaskHandle) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err = m.CancelTask(waitID); err != nil {
+		t.Fatalf("expected CancelTask() to work, err: %v", err)
+	}
+	task = waitForTaskState(t, m, waitID, TaskCanceled)
+	if !task.CancelRequested {
+		t.Errorf("expected cancelRequested, got: %#v", task)
+	}
+	if err = m.CancelTask(waitID); err == nil {
+		t.Errorf("expected err on canceling a done task")
+	}
+
+	tasks, err := m.GetTasks()
+	if err != nil || len(tasks) != 3 || tasks[0].ID != okID {
+		t.Errorf("expected 3 tasks, oldest first, got: %#v, err: %v",
+			tasks, err)
+	}
+
+	if _, err = m.GetTask("not-a-task"); err == nil {
+		t.Errorf("expected err on an unknown task")
+	}
+}
+
+func TestTaskCancelFromCfg(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(Version, NewCfgMem(), nil, NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, nil)
+
+	startCh := make(chan struct{})
+	progressCh := make(chan struct{})
+
+	id, err := m.StartTask("test", func(ctx context.Context,
+		h *TaskHandle) error {
+		close(startCh)
+		<-progressCh
+		h.SetProgress(0.1, "")
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-startCh
+
+	// As done by another node, which only marks the task in the Cfg.
+	err = m.updateTask(id, func(task *Task) error {
+		task.CancelRequested = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(progressCh)
+
+	waitForTaskState(t, m, id, TaskCanceled)
+}
+
+func TestFailOrphanedTasks(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(Version, cfg, nil, NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, nil)
+
+	tasks := &Tasks{Tasks: map[string]*Task{
+		"mine":   {ID: "mine", Node: m.UUID(), State: TaskRunning},
+		"others": {ID: "others", Node: "other", State: TaskRunning},
+	}}
+	if _, err := CfgSetTasks(cfg, tasks, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.failOrphanedTasks(); err != nil {
+		t.Fatalf("expected failOrphanedTasks() to work, err: %v", err)
+	}
+
+	if task, _ := m.GetTask("mine"); task.State != TaskFailed {
+		t.Errorf("expected this node's task failed, got: %#v", task)
+	}
+	if task, _ := m.GetTask("others"); task.State != TaskRunning {
+		t.Errorf("expected another node's task running, got: %#v", task)
+	}
+}
+
+func TestPruneDoneTasks(t *testing.T) {
+	tasks := &Tasks{Tasks: map[string]*Task{}}
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("%d", i)
+		tasks.Tasks[id] = &Task{ID: id, State: TaskSucceeded,
+			UpdatedAt: time.Unix(int64(i), 0).Format(time.RFC3339Nano)}
+	}
+	tasks.Tasks["r"] = &Task{ID: "r", State: TaskRunning}
+
+	pruneDoneTasks(tasks, 2)
+
+	if len(tasks.Tasks) != 3 || tasks.Tasks["r"] == nil ||
+		tasks.Tasks["3"] == nil || tasks.Tasks["4"] == nil {
+		t.Errorf("expected the newest done tasks kept, got: %#v", tasks.Tasks)
+	}
+}
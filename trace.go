@@ -0,0 +1,199 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// The W3C trace context headers, which are propagated on the
+// intra-cluster HTTP requests so that a request can be followed
+// across nodes in a tracing backend.
+const (
+	TRACEPARENT_HEADER = "traceparent"
+	TRACESTATE_HEADER  = "tracestate"
+)
+
+// A TraceParent is a parsed W3C traceparent header, as in
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+type TraceParent struct {
+	TraceID string // 32 lowercase hex chars.
+	SpanID  string // 16 lowercase hex chars, the caller's span.
+	Flags   byte   // Where 0x01 means sampled.
+
+	// TraceState is the optional, opaque tracestate header, which is
+	// propagated unchanged.
+	TraceState string
+}
+
+// NewTraceParent returns a sampled TraceParent that starts a trace.
+func NewTraceParent() *TraceParent {
+	return &TraceParent{
+		TraceID: randomTraceHex(16),
+		SpanID:  randomTraceHex(8),
+		Flags:   0x01,
+	}
+}
+
+// NewSpan returns a TraceParent for a child span in the same trace.
+func (tp *TraceParent) NewSpan() *TraceParent {
+	return &TraceParent{
+		TraceID:    tp.TraceID,
+		SpanID:     randomTraceHex(8),
+		Flags:      tp.Flags,
+		TraceState: tp.TraceState,
+	}
+}
+
+// String returns the traceparent header value.
+func (tp *TraceParent) String() string {
+	return fmt.Sprintf("00-%s-%s-%02x", tp.TraceID, tp.SpanID, tp.Flags)
+}
+
+// ParseTraceParent parses a traceparent header value.  Versions after
+// "00" are parsed by their "00" prefix, as the spec requires.
+func ParseTraceParent(v string) (*TraceParent, error) {
+	v = strings.TrimSpace(v)
+	if len(v) < 55 || (len(v) > 55 && (v[:2] == "00" || v[55] != '-')) {
+		return nil, fmt.Errorf("trace: invalid traceparent: %q", v)
+	}
+
+	a := strings.Split(v[:55], "-")
+	if len(a) != 4 || len(a[0]) != 2 || len(a[1]) != 32 ||
+		len(a[2]) != 16 || len(a[3]) != 2 || a[0] == "ff" {
+		return nil, fmt.Errorf("trace: invalid traceparent: %q", v)
+	}
+
+	for _, s := range a {
+		if !isLowerHex(s) {
+			return nil, fmt.Errorf("trace: invalid traceparent: %q", v)
+		}
+	}
+	if a[1] == strings.Repeat("0", 32) || a[2] == strings.Repeat("0", 16) {
+		return nil, fmt.Errorf("trace: zero id in traceparent: %q", v)
+	}
+
+	flags, _ := hex.DecodeString(a[3])
+
+	return &TraceParent{TraceID: a[1], SpanID: a[2], Flags: flags[0]}, nil
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomTraceHex(n int) string {
+	b := make([]byte, n)
+	for {
+		rand.Read(b)
+		for _, c := range b {
+			if c != 0 {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
+
+// ---------------------------------------------------------
+
+type traceParentKey struct{}
+
+// ContextWithTraceParent returns a child context that carries the
+// TraceParent of the current span.
+func ContextWithTraceParent(ctx context.Context,
+	tp *TraceParent) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, tp)
+}
+
+// TraceParentFromContext returns the TraceParent of the ctx, or nil.
+func TraceParentFromContext(ctx context.Context) *TraceParent {
+	tp, _ := ctx.Value(traceParentKey{}).(*TraceParent)
+	return tp
+}
+
+// ExtractTraceParent returns the TraceParent of the headers, or nil
+// if they have none or an invalid one.
+func ExtractTraceParent(h http.Header) *TraceParent {
+	tp, err := ParseTraceParent(h.Get(TRACEPARENT_HEADER))
+	if err != nil {
+		return nil
+	}
+	tp.TraceState = h.Get(TRACESTATE_HEADER)
+	return tp
+}
+
+// InjectTraceParent sets the trace context headers for an outbound
+// request, as a new span of the ctx's trace, or else as the start of
+// a new trace, and returns the injected TraceParent.
+func InjectTraceParent(ctx context.Context, h http.Header) *TraceParent {
+	var tp *TraceParent
+	if parent := TraceParentFromContext(ctx); parent != nil {
+		tp = parent.NewSpan()
+	} else {
+		tp = NewTraceParent()
+	}
+
+	h.Set(TRACEPARENT_HEADER, tp.String())
+	if tp.TraceState != "" {
+		h.Set(TRACESTATE_HEADER, tp.TraceState)
+	}
+
+	return tp
+}
+
+// TraceHandler wraps a REST handler so that the request's context
+// carries a span of the caller's trace, from the traceparent header,
+// or else of a new trace, for the handler's own outbound requests.
+func TraceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tp := ExtractTraceParent(r.Header)
+		if tp != nil {
+			tp = tp.NewSpan()
+		} else {
+			tp = NewTraceParent()
+		}
+
+		next.ServeHTTP(w, r.WithContext(
+			ContextWithTraceParent(r.Context(), tp)))
+	})
+}
+
+// TraceTransport is an http.RoundTripper that injects the trace
+// context headers into the requests that don't already have them.
+type TraceTransport struct {
+	Base http.RoundTripper // Optional, defaults to http.DefaultTransport.
+}
+
+func (t *TraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if req.Header.Get(TRACEPARENT_HEADER) == "" {
+		req = req.Clone(req.Context())
+		InjectTraceParent(req.Context(), req.Header)
+	}
+
+	return base.RoundTrip(req)
+}
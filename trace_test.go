@@ -0,0 +1,88 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	v := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tp, err := ParseTraceParent(v)
+	if err != nil || tp.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		tp.SpanID != "00f067aa0ba902b7" || tp.Flags != 1 ||
+		tp.String() != v {
+		t.Errorf("unexpected traceparent: %#v, err: %v", tp, err)
+	}
+
+	if _, err = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736" +
+		"-00f067aa0ba902b7-01-future"); err != nil {
+		t.Errorf("expected a future version to parse, err: %v", err)
+	}
+
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, err = ParseTraceParent(v); err == nil {
+			t.Errorf("expected err, v: %q", v)
+		}
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	var got *TraceParent
+
+	server := httptest.NewServer(TraceHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			got = TraceParentFromContext(r.Context())
+		})))
+	defer server.Close()
+
+	client := &http.Client{Transport: &TraceTransport{}}
+
+	root := NewTraceParent()
+	root.TraceState = "vendor=x"
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req = req.WithContext(ContextWithTraceParent(req.Context(), root))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if got == nil || got.TraceID != root.TraceID ||
+		got.SpanID == root.SpanID || got.TraceState != "vendor=x" {
+		t.Errorf("expected the handler to join the trace,"+
+			" root: %#v, got: %#v", root, got)
+	}
+	if req.Header.Get(TRACEPARENT_HEADER) != "" {
+		t.Errorf("expected the caller's request to be unmodified")
+	}
+
+	res, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if got == nil || got.TraceID == root.TraceID {
+		t.Errorf("expected a new trace without a traceparent, got: %#v", got)
+	}
+}
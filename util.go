@@ -3,19 +3,59 @@ package cbgt
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 func computeMD5(payload []byte) (string, error) {
-	hash := md5.New()
-	if _, err := io.Copy(hash, bytes.NewReader(payload)); err != nil {
+	return computeHash(md5.New(), payload)
+}
+
+func computeHash(h hash.Hash, payload []byte) (string, error) {
+	if _, err := io.Copy(h, bytes.NewReader(payload)); err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DEFAULT_PLAN_HASH is the name of the PlanHash that verifies the
+// contents of the persisted plans, unless configured otherwise.
+const DEFAULT_PLAN_HASH = "sha256"
+
+// A PlanHash is a hash function that verifies the contents of the
+// persisted plans, such as of the LocalPlanStore records, where the
+// Name of the PlanHash is encoded along with the hash.
+type PlanHash struct {
+	Name string
+	New  func() hash.Hash
+}
+
+// PlanHashes is a global registry of the PlanHashes, keyed by name.
+// A persisted plan whose hash isn't registered fails verification, so
+// an environment that forbids MD5 can delete the "md5" entry, which
+// is only needed to read the plans of older versions.
+var PlanHashes = map[string]*PlanHash{
+	"md5":    {Name: "md5", New: md5.New},
+	"sha256": {Name: "sha256", New: sha256.New},
+}
+
+var planHashNameRE = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+// RegisterPlanHash is invoked at init/startup time to register a
+// PlanHash, whose name must be lowercase alphanumeric, such as
+// "sha512".
+func RegisterPlanHash(h *PlanHash) error {
+	if !planHashNameRE.MatchString(h.Name) {
+		return fmt.Errorf("util: invalid plan hash name: %q", h.Name)
+	}
+	PlanHashes[h.Name] = h
+	return nil
 }
 
 // VersionReader is an interface to be implemented by the
@@ -34,6 +34,7 @@ const versionKey = "version"
 // Older versions (which are running with older JSON/struct definitions
 // or planning algorithms) will see false from their checkVersion()'s.
 func checkVersion(log Log, cfg Cfg, myVersion string) (bool, error) {
+	retry := NewCASRetry(versionKey)
 	tries := 0
 	for cfg != nil {
 		tries += 1
@@ -55,11 +56,13 @@ func checkVersion(log Log, cfg Cfg, myVersion string) (bool, error) {
 				if _, ok := err.(*CfgCASError); ok {
 					// Retry if it was a CAS mismatch due to
 					// multi-node startup races.
+					retry.Conflict()
 					continue
 				}
 				return false, fmt.Errorf("version:"+
 					" could not save Version to cfg, err: %v", err)
 			}
+			retry.Done(nil)
 			log.Printf("version: checkVersion, Cfg version updated %s",
 				myVersion)
 			continue
@@ -93,11 +96,13 @@ func checkVersion(log Log, cfg Cfg, myVersion string) (bool, error) {
 				if _, ok := err.(*CfgCASError); ok {
 					// Retry if it was a CAS mismatch due to
 					// multi-node startup races.
+					retry.Conflict()
 					continue
 				}
 				return false, fmt.Errorf("version:"+
 					" could not update Version in cfg, err: %v", err)
 			}
+			retry.Done(nil)
 			log.Printf("version: checkVersion, Cfg version updated %s",
 				myVersion)
 			continue